@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Address ordering strategies accepted by -address-order.
+const (
+	orderNone       = "none"
+	orderAscending  = "ascending"
+	orderDescending = "descending"
+	orderTopHalf    = "top-half"
+)
+
+// addressPlanner hands out requested-IP hints (DHCP option 50) so that
+// servers with predictable allocators consume addresses in a chosen order.
+// Once the planned range is used up Next returns nil and the server picks.
+type addressPlanner struct {
+	mu       sync.Mutex
+	strategy string
+	skip     map[uint32]bool
+	next     uint32
+	last     uint32
+	step     int
+	done     bool
+}
+
+// newAddressPlanner builds a planner for the usable host range of netCfg,
+// never hinting at the gateway or the host's own address.
+func newAddressPlanner(strategy string, netCfg *NetworkConfig) (*addressPlanner, error) {
+	p := &addressPlanner{strategy: strategy}
+	if strategy == orderNone || strategy == "" {
+		p.done = true
+		return p, nil
+	}
+
+	base := ipToUint32(netCfg.Subnet.IP)
+	ones, bits := netCfg.Subnet.Mask.Size()
+	size := uint32(1) << uint(bits-ones)
+	if size < 4 {
+		return nil, fmt.Errorf("subnet %s is too small for address ordering", netCfg.Subnet)
+	}
+	first, last := base+1, base+size-2
+
+	p.skip = map[uint32]bool{
+		ipToUint32(netCfg.Gateway): true,
+	}
+	if netCfg.HostIP != nil {
+		p.skip[ipToUint32(netCfg.HostIP)] = true
+	}
+	switch strategy {
+	case orderAscending:
+		p.next, p.last, p.step = first, last, 1
+	case orderDescending:
+		p.next, p.last, p.step = last, first, -1
+	case orderTopHalf:
+		p.next, p.last, p.step = base+size/2, last, 1
+	default:
+		return nil, fmt.Errorf("unknown address order %q (use none, ascending, descending or top-half)", strategy)
+	}
+	return p, nil
+}
+
+// Next returns the next address to request, or nil when there is no hint.
+func (p *addressPlanner) Next() net.IP {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for !p.done {
+		candidate := p.next
+		if candidate == p.last {
+			p.done = true
+		} else {
+			p.next = uint32(int64(p.next) + int64(p.step))
+		}
+		if !p.skip[candidate] {
+			return uint32ToIP(candidate)
+		}
+	}
+	return nil
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uint32ToIP(n uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
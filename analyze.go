@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	pcapMagicNanosec = 0xa1b23c4d
+	pcapngMagic      = 0x0a0d0d0a
+
+	// pcapLinkLinuxSLL is Linux cooked capture, written by tcpdump -i any.
+	pcapLinkLinuxSLL = 113
+)
+
+// pcapReader reads the records of a classic pcap file in either byte order
+// and timestamp resolution.
+type pcapReader struct {
+	r        *bufio.Reader
+	order    binary.ByteOrder
+	nanosec  bool
+	linkType uint32
+	header   [16]byte
+}
+
+func newPCAPReader(r io.Reader) (*pcapReader, error) {
+	p := &pcapReader{r: bufio.NewReader(r)}
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(p.r, header); err != nil {
+		return nil, fmt.Errorf("failed to read pcap header: %v", err)
+	}
+	switch magic := binary.LittleEndian.Uint32(header[0:4]); magic {
+	case pcapMagicMicrosec, pcapMagicNanosec:
+		p.order = binary.LittleEndian
+		p.nanosec = magic == pcapMagicNanosec
+	default:
+		switch binary.BigEndian.Uint32(header[0:4]) {
+		case pcapMagicMicrosec, pcapMagicNanosec:
+			p.order = binary.BigEndian
+			p.nanosec = binary.BigEndian.Uint32(header[0:4]) == pcapMagicNanosec
+		case pcapngMagic:
+			return nil, fmt.Errorf("pcapng files are not supported; convert with: editcap -F pcap in.pcapng out.pcap")
+		default:
+			return nil, fmt.Errorf("not a pcap file")
+		}
+	}
+	p.linkType = p.order.Uint32(header[20:24])
+	if p.linkType != pcapLinkEthernet && p.linkType != pcapLinkLinuxSLL {
+		return nil, fmt.Errorf("unsupported link type %d (Ethernet and Linux cooked captures are supported)", p.linkType)
+	}
+	return p, nil
+}
+
+// next returns the next record's timestamp and frame as an Ethernet frame,
+// or io.EOF after the last record.
+func (p *pcapReader) next() (time.Time, []byte, error) {
+	if _, err := io.ReadFull(p.r, p.header[:]); err == io.EOF {
+		return time.Time{}, nil, io.EOF
+	} else if err != nil {
+		return time.Time{}, nil, fmt.Errorf("truncated pcap record header: %v", err)
+	}
+	sec, frac := p.order.Uint32(p.header[0:4]), p.order.Uint32(p.header[4:8])
+	capLen := p.order.Uint32(p.header[8:12])
+	if capLen > 1<<18 {
+		return time.Time{}, nil, fmt.Errorf("corrupt pcap record of %d bytes", capLen)
+	}
+	data := make([]byte, capLen)
+	if _, err := io.ReadFull(p.r, data); err != nil {
+		return time.Time{}, nil, fmt.Errorf("truncated pcap record: %v", err)
+	}
+	if !p.nanosec {
+		frac *= 1000
+	}
+	ts := time.Unix(int64(sec), int64(frac))
+	if p.linkType == pcapLinkLinuxSLL {
+		data = sllToEthernet(data)
+	}
+	return ts, stripVLAN(data), nil
+}
+
+// sllToEthernet rewrites a Linux cooked capture record as an Ethernet frame.
+// The cooked header only carries the sender's address; the destination is
+// left zero.
+func sllToEthernet(data []byte) []byte {
+	if len(data) < 16 {
+		return nil
+	}
+	frame := make([]byte, 14+len(data)-16)
+	if addrLen := int(binary.BigEndian.Uint16(data[4:6])); addrLen == 6 {
+		copy(frame[6:12], data[6:12])
+	}
+	copy(frame[12:14], data[14:16])
+	copy(frame[14:], data[16:])
+	return frame
+}
+
+// stripVLAN removes an 802.1Q tag so the frame parses as untagged.
+func stripVLAN(frame []byte) []byte {
+	if len(frame) < 18 || binary.BigEndian.Uint16(frame[12:14]) != etherTypeVLAN {
+		return frame
+	}
+	return append(frame[:12:12], frame[16:]...)
+}
+
+// runAnalyze implements the analyze subcommand: it replays a capture through
+// the observer and prints the same report -observe does.
+func runAnalyze(args []string) {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	var trusted stringList
+	fs.Var(&trusted, "trusted-servers", "Comma-separated legitimate DHCP server IPs; others are reported as rogue")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage:
+  ./ipocalypse analyze [-trusted-servers ip,...] capture.pcap
+
+Runs the -observe DHCP analysis (latency, NAKs, servers, per-client
+outcomes) over a capture taken elsewhere, e.g. with
+  tcpdump -i eth0 -w capture.pcap 'udp port 67 or udp port 68'
+
+Options:
+`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err := analyzeCapture(fs.Arg(0), trusted); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// analyzeCapture feeds every DHCP message in the pcap at path to an observer
+// and prints its report.
+func analyzeCapture(path string, trusted []string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	reader, err := newPCAPReader(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	obs := newObserver(nil, trusted)
+	var first, last time.Time
+	packets, messages := 0, 0
+	for {
+		ts, data, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		packets++
+		if first.IsZero() {
+			first = ts
+		}
+		last = ts
+		frame, ok := parseUDPFrame(data)
+		if !ok || (frame.DstPort != dhcpServerPort && frame.DstPort != dhcpClientPort) {
+			continue
+		}
+		msg, err := parseDHCP(frame.Payload)
+		if err != nil {
+			continue
+		}
+		obs.record(ts, frame, msg)
+		messages++
+	}
+	obs.source = fmt.Sprintf("%s (%d packets, %d DHCP messages)", path, packets, messages)
+	if packets > 0 {
+		obs.source += fmt.Sprintf(", starting %s", first.Format(time.RFC3339))
+	}
+	obs.printReport(last.Sub(first))
+	return nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Name services -announce advertises client hostnames over.
+const (
+	announceMDNS    = "mdns"
+	announceLLMNR   = "llmnr"
+	announceNetBIOS = "netbios"
+	announceAll     = "all"
+)
+
+// Multicast groups and ports of the name services.
+var (
+	mdnsGroup  = net.IPv4(224, 0, 0, 251)
+	mdnsMAC    = net.HardwareAddr{0x01, 0x00, 0x5e, 0x00, 0x00, 0xfb}
+	llmnrGroup = net.IPv4(224, 0, 0, 252)
+	llmnrMAC   = net.HardwareAddr{0x01, 0x00, 0x5e, 0x00, 0x00, 0xfc}
+)
+
+const (
+	mdnsPort    = 5353
+	llmnrPort   = 5355
+	netbiosPort = 137
+	// mdnsTTL is the record TTL of mDNS announcements: 120s, as RFC 6762
+	// recommends for host address records.
+	mdnsTTL = 120
+	// netbiosTTL is the TTL of NetBIOS name registrations, the 300000s
+	// Windows uses.
+	netbiosTTL = 300000
+)
+
+// announcer makes the clients visible to discovery tooling the way real
+// hosts are: it advertises each client's hostname and address over mDNS,
+// LLMNR and NetBIOS from the client's own MAC and IP, and repeats it every
+// interval while the client holds its lease. The frames are sent from the
+// host on the parent interface, so this works for every engine, including
+// raw-mode clients that have no network stack of their own.
+type announcer struct {
+	conn      *packetConn
+	protocols []string
+	broadcast net.IP
+	// sharedMAC means the clients share the parent's MAC (ipvlan), so
+	// frames are sent from it rather than from the client's MAC.
+	sharedMAC bool
+
+	mu    sync.Mutex
+	names map[string]string // IP -> hostname
+}
+
+// parseAnnounce expands the -announce list, accepting all for every
+// protocol.
+func parseAnnounce(specs []string) ([]string, error) {
+	var protocols []string
+	for _, spec := range specs {
+		switch spec = strings.ToLower(spec); spec {
+		case announceAll:
+			return []string{announceMDNS, announceLLMNR, announceNetBIOS}, nil
+		case announceMDNS, announceLLMNR, announceNetBIOS:
+			protocols = append(protocols, spec)
+		default:
+			return nil, fmt.Errorf("invalid -announce protocol %q (use mdns, llmnr, netbios or all)", spec)
+		}
+	}
+	return protocols, nil
+}
+
+// newAnnouncer opens a send-only packet socket on netCfg's parent interface.
+// It returns nil when no protocols are given.
+func newAnnouncer(specs []string, netCfg *NetworkConfig) (*announcer, error) {
+	protocols, err := parseAnnounce(specs)
+	if err != nil || len(protocols) == 0 {
+		return nil, err
+	}
+	// Protocol 0 receives nothing; the socket only sends.
+	conn, err := openPacketConn(netCfg.Parent, 0)
+	if err != nil {
+		return nil, err
+	}
+	a := &announcer{conn: conn, protocols: protocols, broadcast: net.IPv4bcast, sharedMAC: netCfg.Driver == driverIpvlan, names: make(map[string]string)}
+	if netCfg.Subnet != nil {
+		a.broadcast = subnetBroadcast(netCfg.Subnet)
+	}
+	return a, nil
+}
+
+func (a *announcer) String() string {
+	return strings.Join(a.protocols, ", ")
+}
+
+// subnetBroadcast returns the directed broadcast address of an IPv4 subnet.
+func subnetBroadcast(subnet *net.IPNet) net.IP {
+	ip := subnet.IP.To4()
+	mask := net.IP(subnet.Mask).To4()
+	if ip == nil || mask == nil {
+		return net.IPv4bcast
+	}
+	bcast := make(net.IP, 4)
+	for i := range bcast {
+		bcast[i] = ip[i] | ^mask[i]
+	}
+	return bcast
+}
+
+// add announces a client that just obtained a lease. Clients without a
+// hostname, e.g. without -hostnames or a profile, have nothing to announce.
+// A nil announcer does nothing.
+func (a *announcer) add(mac, ip, hostname string) {
+	if a == nil || hostname == "" {
+		return
+	}
+	a.mu.Lock()
+	a.names[ip] = hostname
+	a.mu.Unlock()
+	if err := a.announce(mac, ip, hostname); err != nil {
+		slog.Warn("failed to announce client", "ip", ip, "hostname", hostname, "error", err)
+	}
+}
+
+// run repeats the announcements of the clients that still hold their leases
+// every interval until ctx is done.
+func (a *announcer) run(ctx context.Context, leases *leaseTable, interval time.Duration) {
+	if a == nil {
+		return
+	}
+	defer a.conn.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-clock.After(interval):
+		}
+		for _, r := range leases.held() {
+			a.mu.Lock()
+			hostname := a.names[r.IP]
+			a.mu.Unlock()
+			if hostname == "" {
+				continue
+			}
+			if err := a.announce(r.MAC, r.IP, hostname); err != nil {
+				slog.Warn("failed to announce client", "ip", r.IP, "hostname", hostname, "error", err)
+			}
+		}
+	}
+}
+
+// announce sends one announcement per protocol for a client.
+func (a *announcer) announce(mac, ip, hostname string) error {
+	srcMAC, err := net.ParseMAC(mac)
+	if err != nil || a.sharedMAC {
+		srcMAC = a.conn.iface.HardwareAddr
+	}
+	srcIP := net.ParseIP(ip).To4()
+	if srcIP == nil {
+		return fmt.Errorf("not an IPv4 address: %s", ip)
+	}
+	for _, protocol := range a.protocols {
+		var frame udpFrame
+		switch protocol {
+		case announceMDNS:
+			frame = udpFrame{DstMAC: mdnsMAC, DstIP: mdnsGroup, SrcPort: mdnsPort, DstPort: mdnsPort, TTL: 255, Payload: mdnsAnnouncement(hostname, srcIP)}
+		case announceLLMNR:
+			frame = udpFrame{DstMAC: llmnrMAC, DstIP: llmnrGroup, SrcPort: ephemeralPort(), DstPort: llmnrPort, TTL: 1, Payload: llmnrProbe(hostname)}
+		case announceNetBIOS:
+			frame = udpFrame{DstMAC: broadcastMAC, DstIP: a.broadcast, SrcPort: netbiosPort, DstPort: netbiosPort, Payload: netbiosRegistration(hostname, srcIP)}
+		}
+		frame.SrcMAC, frame.SrcIP = srcMAC, srcIP
+		if err := a.conn.writeFrame(buildUDPFrame(frame)); err != nil {
+			return fmt.Errorf("%s: %v", protocol, err)
+		}
+	}
+	return nil
+}
+
+// ephemeralPort picks a source port from the dynamic range.
+func ephemeralPort() uint16 {
+	return uint16(49152 + rand.Intn(16384))
+}
+
+// dnsName encodes a domain name as DNS labels.
+func dnsName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) > 63 {
+			label = label[:63]
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// mdnsAnnouncement is an unsolicited mDNS response claiming <hostname>.local
+// for ip, as a host sends when it joins the network (RFC 6762 section 8.3).
+func mdnsAnnouncement(hostname string, ip net.IP) []byte {
+	msg := make([]byte, 12, 64)
+	binary.BigEndian.PutUint16(msg[2:4], 0x8400) // response, authoritative
+	binary.BigEndian.PutUint16(msg[6:8], 1)      // one answer
+	msg = append(msg, dnsName(hostname+".local")...)
+	msg = binary.BigEndian.AppendUint16(msg, 1)      // A
+	msg = binary.BigEndian.AppendUint16(msg, 0x8001) // cache flush, IN
+	msg = binary.BigEndian.AppendUint32(msg, mdnsTTL)
+	msg = binary.BigEndian.AppendUint16(msg, 4)
+	return append(msg, ip.To4()...)
+}
+
+// llmnrProbe is the query for its own name a host sends to check it is
+// unique (RFC 4795 section 4.1). LLMNR has no announcements; this is how a
+// host's name shows up to tools listening on the segment.
+func llmnrProbe(hostname string) []byte {
+	msg := make([]byte, 12, 48)
+	binary.BigEndian.PutUint16(msg[0:2], uint16(rand.Intn(1<<16)))
+	binary.BigEndian.PutUint16(msg[4:6], 1) // one question
+	msg = append(msg, dnsName(hostname)...)
+	msg = binary.BigEndian.AppendUint16(msg, 1) // A
+	return binary.BigEndian.AppendUint16(msg, 1)
+}
+
+// netbiosRegistration is the broadcast name registration a B-node sends for
+// its workstation name (RFC 1002 section 4.2.2).
+func netbiosRegistration(hostname string, ip net.IP) []byte {
+	msg := make([]byte, 12, 72)
+	binary.BigEndian.PutUint16(msg[0:2], uint16(rand.Intn(1<<16)))
+	binary.BigEndian.PutUint16(msg[2:4], 0x2910) // registration, recursion desired, broadcast
+	binary.BigEndian.PutUint16(msg[4:6], 1)      // one question
+	binary.BigEndian.PutUint16(msg[10:12], 1)    // one additional record
+	msg = append(msg, netbiosName(hostname)...)
+	msg = binary.BigEndian.AppendUint16(msg, 0x0020) // NB
+	msg = binary.BigEndian.AppendUint16(msg, 1)      // IN
+	msg = append(msg, 0xc0, 0x0c)                    // the question's name
+	msg = binary.BigEndian.AppendUint16(msg, 0x0020)
+	msg = binary.BigEndian.AppendUint16(msg, 1)
+	msg = binary.BigEndian.AppendUint32(msg, netbiosTTL)
+	msg = binary.BigEndian.AppendUint16(msg, 6)
+	msg = binary.BigEndian.AppendUint16(msg, 0) // unique name, B-node
+	return append(msg, ip.To4()...)
+}
+
+// netbiosName encodes hostname as the first-level encoded NetBIOS name of a
+// workstation: upper case, padded to 15 characters, with suffix 0x00.
+func netbiosName(hostname string) []byte {
+	name := []byte(fmt.Sprintf("%-15.15s", strings.ToUpper(hostname)))
+	name = append(name, 0x00)
+	b := []byte{32}
+	for _, c := range name {
+		b = append(b, 'A'+c>>4, 'A'+c&0x0f)
+	}
+	return append(b, 0)
+}
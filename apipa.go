@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// apipaNet is the IPv4 link-local range clients self-assign from when DHCP fails.
+var apipaNet = &net.IPNet{IP: net.IPv4(169, 254, 0, 0), Mask: net.CIDRMask(16, 32)}
+
+// containerExec runs cmd inside a running container and returns its stdout.
+func containerExec(ctx context.Context, cli containerRuntime, containerID string, cmd []string) (string, error) {
+	created, err := cli.ContainerExecCreate(ctx, containerID, container.ExecOptions{
+		Cmd:          cmd,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return "", err
+	}
+	attach, err := cli.ContainerExecAttach(ctx, created.ID, container.ExecAttachOptions{})
+	if err != nil {
+		return "", err
+	}
+	defer attach.Close()
+
+	var stdout, stderr bytes.Buffer
+	if _, err := stdcopy.StdCopy(&stdout, &stderr, attach.Reader); err != nil {
+		return "", err
+	}
+	inspect, err := cli.ContainerExecInspect(ctx, created.ID)
+	if err != nil {
+		return "", err
+	}
+	if inspect.ExitCode != 0 {
+		return stdout.String(), fmt.Errorf("%s exited with code %d: %s", cmd[0], inspect.ExitCode, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// containerIPv4Addrs lists the IPv4 addresses configured inside a container.
+func containerIPv4Addrs(ctx context.Context, cli containerRuntime, containerID string) ([]net.IP, error) {
+	out, err := containerExec(ctx, cli, containerID, []string{"ip", "-4", "-o", "addr", "show"})
+	if err != nil {
+		return nil, err
+	}
+	var addrs []net.IP
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] != "inet" {
+				continue
+			}
+			if ip, _, err := net.ParseCIDR(fields[i+1]); err == nil {
+				addrs = append(addrs, ip)
+			}
+		}
+	}
+	return addrs, nil
+}
+
+// apipaAddress returns the link-local address a container fell back to after
+// failing DHCP, or nil if it has none. Images without the ip tool are treated
+// as having no fallback address.
+func apipaAddress(ctx context.Context, cli containerRuntime, containerID string) net.IP {
+	addrs, err := containerIPv4Addrs(ctx, cli, containerID)
+	if err != nil {
+		return nil
+	}
+	for _, ip := range addrs {
+		if apipaNet.Contains(ip) {
+			return ip
+		}
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// arpKeeper holds on to the run's addresses the way a live host does, so
+// servers that ping or ARP-probe an address before handing it out again
+// cannot reclaim it: every interval it sends a gratuitous ARP for each held
+// lease from the client's MAC, and, for raw-mode clients that have no
+// network stack to answer, it replies to ARP requests and probes for their
+// addresses. Like the announcer, it sends from the host on the parent
+// interface, so it works for every engine.
+type arpKeeper struct {
+	conn     *packetConn
+	interval time.Duration
+	// respond makes the keeper answer ARP for the clients, for raw mode.
+	respond bool
+	// sharedMAC means the clients share the parent's MAC (ipvlan, raw mode
+	// over Wi-Fi), so frames are sent from it rather than from the
+	// client's MAC.
+	sharedMAC bool
+
+	mu sync.Mutex
+	// held maps the addresses the run holds to their clients' MACs.
+	held    map[string]net.HardwareAddr
+	sent    int
+	replies int
+}
+
+// newARPKeeper opens the packet socket on netCfg's parent interface. It
+// returns nil when interval is 0.
+func newARPKeeper(interval time.Duration, respond, sharedMAC bool, netCfg *NetworkConfig) (*arpKeeper, error) {
+	if interval == 0 {
+		return nil, nil
+	}
+	if interval < 0 {
+		return nil, fmt.Errorf("-arp-keepalive must be positive")
+	}
+	conn, err := openPacketConn(netCfg.Parent, etherTypeARP)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.setReadTimeout(200 * time.Millisecond); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to set socket timeout: %v", err)
+	}
+	return &arpKeeper{conn: conn, interval: interval, respond: respond, sharedMAC: sharedMAC, held: make(map[string]net.HardwareAddr)}, nil
+}
+
+func (k *arpKeeper) String() string {
+	if k.respond {
+		return fmt.Sprintf("gratuitous ARP every %s, answering ARP for the clients", k.interval)
+	}
+	return fmt.Sprintf("gratuitous ARP every %s", k.interval)
+}
+
+// add starts holding a client's new lease with an announcement right away.
+// A nil keeper does nothing.
+func (k *arpKeeper) add(mac, ip string) {
+	if k == nil {
+		return
+	}
+	hw, addr := k.clientMAC(mac), net.ParseIP(ip).To4()
+	if addr == nil {
+		return
+	}
+	k.mu.Lock()
+	k.held[addr.String()] = hw
+	k.mu.Unlock()
+	k.announce(hw, addr)
+}
+
+// clientMAC is the MAC frames for the client with mac are sent from.
+func (k *arpKeeper) clientMAC(mac string) net.HardwareAddr {
+	hw, err := net.ParseMAC(mac)
+	if err != nil || k.sharedMAC {
+		return k.conn.iface.HardwareAddr
+	}
+	return hw
+}
+
+// run repeats the announcements of the leases the run still holds every
+// interval, and answers ARP for them if the keeper responds, until ctx is
+// done.
+func (k *arpKeeper) run(ctx context.Context, leases *leaseTable) {
+	if k == nil {
+		return
+	}
+	defer k.conn.Close()
+	if k.respond {
+		go k.answer(ctx)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-clock.After(k.interval):
+		}
+		held := make(map[string]net.HardwareAddr)
+		for _, r := range leases.held() {
+			if addr := net.ParseIP(r.IP).To4(); addr != nil {
+				held[addr.String()] = k.clientMAC(r.MAC)
+			}
+		}
+		// Released leases stop being held and answered for.
+		k.mu.Lock()
+		k.held = held
+		k.mu.Unlock()
+		for ip, hw := range held {
+			if ctx.Err() != nil {
+				return
+			}
+			k.announce(hw, net.ParseIP(ip).To4())
+		}
+	}
+}
+
+// announce sends a gratuitous ARP request for addr from hw: sender and
+// target are both the client's address, as hosts announce themselves.
+func (k *arpKeeper) announce(hw net.HardwareAddr, addr net.IP) {
+	frame := buildARPRequest(hw, addr, addr)
+	if err := k.conn.writeFrame(frame); err != nil {
+		slog.Warn("failed to send gratuitous ARP", "ip", addr, "error", err)
+		return
+	}
+	k.mu.Lock()
+	k.sent++
+	k.mu.Unlock()
+}
+
+// answer replies to the ARP requests and probes for the held addresses.
+func (k *arpKeeper) answer(ctx context.Context) {
+	buf := make([]byte, 1514)
+	for ctx.Err() == nil {
+		n, err := k.conn.readFrame(buf)
+		if err != nil || n < 42 {
+			continue
+		}
+		arp := buf[14:n]
+		if binary.BigEndian.Uint16(arp[6:8]) != 1 {
+			continue
+		}
+		target := net.IP(arp[24:28])
+		senderIP := net.IP(arp[14:18])
+		// A gratuitous request is an announcement, not a question; ours
+		// included.
+		if senderIP.Equal(target) {
+			continue
+		}
+		k.mu.Lock()
+		hw, ok := k.held[target.String()]
+		k.mu.Unlock()
+		if !ok {
+			continue
+		}
+		requester := append(net.HardwareAddr(nil), arp[8:14]...)
+		if err := k.conn.writeFrame(buildARPReply(hw, target, requester, senderIP)); err != nil {
+			slog.Warn("failed to answer ARP", "ip", target, "error", err)
+			continue
+		}
+		k.mu.Lock()
+		k.replies++
+		k.mu.Unlock()
+	}
+}
+
+// buildARPReply builds an is-at frame telling dstMAC that srcIP is at srcMAC.
+func buildARPReply(srcMAC net.HardwareAddr, srcIP net.IP, dstMAC net.HardwareAddr, dstIP net.IP) []byte {
+	frame := buildARPRequest(srcMAC, srcIP, dstIP)
+	copy(frame[0:6], dstMAC)
+	arp := frame[14:]
+	binary.BigEndian.PutUint16(arp[6:8], 2) // reply
+	copy(arp[18:24], dstMAC)
+	return frame
+}
+
+// printSummary reports the ARP the keeper sent. A nil keeper prints nothing.
+func (k *arpKeeper) printSummary() {
+	if k == nil {
+		return
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.respond {
+		fmt.Printf("ARP keepalive:     %d gratuitous ARPs sent, %d requests for client addresses answered\n", k.sent, k.replies)
+		return
+	}
+	fmt.Printf("ARP keepalive:     %d gratuitous ARPs sent\n", k.sent)
+}
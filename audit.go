@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/user"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditEntry is one line of the -audit-log. Each entry carries the hash of
+// the one before it in prev, and its own hash over everything else, so an
+// entry edited, removed or inserted later breaks the chain from there on.
+type auditEntry struct {
+	Seq        int             `json:"seq"`
+	Time       string          `json:"time"`
+	RunID      string          `json:"run_id"`
+	Engagement string          `json:"engagement"`
+	Operator   string          `json:"operator"`
+	Action     string          `json:"action"`
+	Details    json.RawMessage `json:"details,omitempty"`
+	Prev       string          `json:"prev"`
+	Hash       string          `json:"hash,omitempty"`
+}
+
+// auditGenesis is the prev of a log's first entry.
+var auditGenesis = strings.Repeat("0", 64)
+
+// sum returns the entry's hash: the SHA-256 of the entry without its hash.
+func (e auditEntry) sum() (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:]), nil
+}
+
+// auditLog appends the run's network-affecting actions to the -audit-log,
+// so an engagement has a record of exactly what was done, when and by whom.
+type auditLog struct {
+	mu         sync.Mutex
+	f          *os.File
+	path       string
+	seq        int
+	prev       string
+	engagement string
+	operator   string
+	// failed is set once a write failed, so the failure is logged once.
+	failed bool
+}
+
+// audit is the run's audit log, nil for runs that act on no network (dry
+// runs and the subcommands).
+var audit *auditLog
+
+// openAuditLog opens the log at path for appending, continuing its chain. A
+// log that fails verification is not appended to: it is evidence as it is.
+func openAuditLog(path, engagement, operator string) (*auditLog, error) {
+	if path == "" {
+		return nil, fmt.Errorf("-audit-log cannot be empty: every run that acts on the network is recorded")
+	}
+	entries, err := readAuditLog(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("audit log %s: %v; keep it as it is and name a new -audit-log", path, err)
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %v", err)
+	}
+	a := &auditLog{f: f, path: path, prev: auditGenesis, engagement: engagement, operator: operator}
+	if len(entries) > 0 {
+		last := entries[len(entries)-1]
+		a.seq, a.prev = last.Seq, last.Hash
+	}
+	return a, nil
+}
+
+// record appends an action with its details. A nil log records nothing.
+func (a *auditLog) record(action string, details map[string]any) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e := auditEntry{
+		Seq:        a.seq + 1,
+		Time:       clock.Now().UTC().Format(time.RFC3339Nano),
+		RunID:      runID,
+		Engagement: a.engagement,
+		Operator:   a.operator,
+		Action:     action,
+		Prev:       a.prev,
+	}
+	if len(details) > 0 {
+		data, err := json.Marshal(details)
+		if err != nil {
+			data, _ = json.Marshal(map[string]string{"unrecorded": err.Error()})
+		}
+		e.Details = data
+	}
+	var err error
+	if e.Hash, err = e.sum(); err == nil {
+		var line []byte
+		if line, err = json.Marshal(e); err == nil {
+			_, err = a.f.Write(append(line, '\n'))
+		}
+	}
+	if err != nil {
+		if !a.failed {
+			slog.Error("audit log not written", "path", a.path, "action", action, "error", err)
+			a.failed = true
+		}
+		return
+	}
+	a.seq, a.prev = e.Seq, e.Hash
+}
+
+// finish records the run's exit status and prints the chain head, which goes
+// into the engagement notes: a log that still ends in it was not altered.
+func (a *auditLog) finish(code int) {
+	if a == nil {
+		return
+	}
+	a.record("run_finished", map[string]any{"exit_status": code})
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.f.Sync()
+	fmt.Printf("Audit log: %s, entry %d, chain head %s\n", a.path, a.seq, a.prev)
+}
+
+// readAuditLog reads and verifies the log at path. On a break in the chain
+// it returns the entries before it with the error.
+func readAuditLog(path string) ([]auditEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []auditEntry
+	prev, seq := auditGenesis, 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var e auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return entries, fmt.Errorf("line %d is not an audit entry: %v", line, err)
+		}
+		sum, err := e.sum()
+		switch {
+		case err != nil:
+			return entries, fmt.Errorf("line %d: %v", line, err)
+		case e.Seq != seq+1:
+			return entries, fmt.Errorf("line %d is entry %d, expected %d: entries were removed or inserted", line, e.Seq, seq+1)
+		case e.Prev != prev:
+			return entries, fmt.Errorf("line %d does not follow entry %d: the chain is broken", line, seq)
+		case e.Hash != sum:
+			return entries, fmt.Errorf("line %d (entry %d) was altered: its hash does not match its content", line, e.Seq)
+		}
+		entries = append(entries, e)
+		prev, seq = e.Hash, e.Seq
+	}
+	return entries, scanner.Err()
+}
+
+// authorize checks that the run is covered by an engagement, named with
+// -engagement-id and -operator or confirmed on a terminal with
+// -i-am-authorized, and returns how, for the audit log. The operator's
+// name is asked for when -i-am-authorized is given without -operator.
+func authorize(cfg *Config, host *hostShell, targets []networkTarget, in io.Reader, interactive bool) (string, error) {
+	switch {
+	case cfg.EngagementID != "" && cfg.Operator != "":
+		return "engagement", nil
+	case !cfg.IAmAuthorized && cfg.EngagementID != "":
+		return "", fmt.Errorf("-engagement-id needs -operator, the name of whoever runs the test")
+	case !cfg.IAmAuthorized:
+		return "", fmt.Errorf("ipocalypse only runs on networks you are authorized to test: name the engagement with\n-engagement-id and -operator, or confirm your authorization on a terminal with -i-am-authorized")
+	case !interactive:
+		return "", fmt.Errorf("-i-am-authorized asks for confirmation on a terminal; without one, name the engagement with -engagement-id and -operator")
+	}
+	var parents, described []string
+	for _, target := range targets {
+		parent := orDash(targetParent(host, target))
+		parents = append(parents, parent)
+		if target.VLAN != 0 {
+			parent = fmt.Sprintf("%s (VLAN %d)", parent, target.VLAN)
+		}
+		described = append(described, parent)
+	}
+	r := bufio.NewReader(in)
+	fmt.Println("=== Authorization ===")
+	if cfg.Operator == "" {
+		fmt.Print("Operator name: ")
+		line, _ := r.ReadString('\n')
+		if cfg.Operator = strings.TrimSpace(line); cfg.Operator == "" {
+			return "", fmt.Errorf("-i-am-authorized needs the operator's name")
+		}
+	}
+	fmt.Printf("This run acts on the network of %s on %s; what it does is recorded in %s.\n", strings.Join(described, ", "), host, cfg.AuditLog)
+	fmt.Println("Only continue if you are authorized to test this network.")
+	want := strings.Join(parents, ",")
+	fmt.Printf("Type the interface name (%s) to confirm: ", want)
+	line, err := r.ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("-i-am-authorized was not confirmed: %v", err)
+	}
+	if strings.TrimSpace(line) != want {
+		return "", fmt.Errorf("-i-am-authorized was not confirmed")
+	}
+	return "confirmed", nil
+}
+
+// auditSecrets are the flags whose values are left out of the audit log.
+var auditSecrets = map[string]bool{"snmp-community": true, "snmp-auth-pass": true, "snmp-priv-pass": true}
+
+// redactArgs returns args with the values of auditSecrets replaced, given
+// as -flag=value or -flag value.
+func redactArgs(args []string) []string {
+	out := append([]string(nil), args...)
+	for i := 0; i < len(out); i++ {
+		if !strings.HasPrefix(out[i], "-") {
+			continue
+		}
+		name, _, hasValue := strings.Cut(strings.TrimLeft(out[i], "-"), "=")
+		if !auditSecrets[name] {
+			continue
+		}
+		if hasValue {
+			out[i] = out[i][:strings.Index(out[i], "=")] + "=REDACTED"
+		} else if i+1 < len(out) {
+			i++
+			out[i] = "REDACTED"
+		}
+	}
+	return out
+}
+
+// osUser returns the local account running ipocalypse, and the one that ran
+// sudo, if any.
+func osUser() (string, string) {
+	name := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	return name, os.Getenv("SUDO_USER")
+}
+
+// runAudit verifies an audit log and summarizes the runs it records.
+func runAudit(args []string) {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage:
+  ./ipocalypse audit [audit-log]
+
+Verifies the hash chain of an audit log written by runs (default:
+ipocalypse-audit.log) and lists the runs it records: when, by whom, for which
+engagement and with which exit status. The exit status is 1 when the chain is
+broken, naming the first entry that was altered, removed or inserted.
+`)
+	}
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	path := defaultConfig().AuditLog
+	if fs.NArg() == 1 {
+		path = fs.Arg(0)
+	}
+	entries, err := readAuditLog(path)
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	printAuditRuns(entries)
+	if err != nil {
+		fmt.Printf("FAIL: %s: %v\n", path, err)
+		os.Exit(1)
+	}
+	head := auditGenesis
+	if len(entries) > 0 {
+		head = entries[len(entries)-1].Hash
+	}
+	fmt.Printf("OK: %d entries, chain intact, head %s\n", len(entries), head)
+}
+
+// printAuditRuns lists the runs recorded in entries, in the order they
+// started.
+func printAuditRuns(entries []auditEntry) {
+	type auditRun struct {
+		id, engagement, operator, started, finished, status string
+		actions                                             int
+	}
+	runs := make(map[string]*auditRun)
+	var order []string
+	for _, e := range entries {
+		run, ok := runs[e.RunID]
+		if !ok {
+			run = &auditRun{id: e.RunID, engagement: e.Engagement, operator: e.Operator, started: e.Time}
+			runs[e.RunID] = run
+			order = append(order, e.RunID)
+		}
+		run.actions++
+		if e.Action == "run_finished" {
+			var d struct {
+				ExitStatus int `json:"exit_status"`
+			}
+			json.Unmarshal(e.Details, &d)
+			run.finished, run.status = e.Time, fmt.Sprint(d.ExitStatus)
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool { return runs[order[i]].started < runs[order[j]].started })
+	fmt.Printf("%-22s %-16s %-16s %-30s %-30s %7s %s\n", "RUN", "ENGAGEMENT", "OPERATOR", "STARTED", "FINISHED", "ACTIONS", "EXIT")
+	for _, id := range order {
+		run := runs[id]
+		fmt.Printf("%-22s %-16s %-16s %-30s %-30s %7d %s\n", orDash(run.id), orDash(run.engagement), orDash(run.operator), run.started, orDash(run.finished), run.actions, orDash(run.status))
+	}
+}
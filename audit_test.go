@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeTestAuditLog records three actions in a new log at path and returns
+// its lines.
+func writeTestAuditLog(t *testing.T, path string) []string {
+	t.Helper()
+	a, err := openAuditLog(path, "ACME-1", "jdoe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.record("network_created", map[string]any{"name": "ipocalypse_network"})
+	a.record("client_launched", map[string]any{"mac": "02:42:ac:11:00:02"})
+	a.record("network_removed", nil)
+	a.f.Close()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestAuditLogChain(t *testing.T) {
+	tests := []struct {
+		name        string
+		tamper      func(lines []string) []string
+		wantEntries int
+		wantErr     string
+	}{
+		{
+			name:        "intact",
+			tamper:      func(lines []string) []string { return lines },
+			wantEntries: 3,
+		},
+		{
+			name: "entry altered",
+			tamper: func(lines []string) []string {
+				lines[1] = strings.Replace(lines[1], "02:42:ac:11:00:02", "02:42:ac:11:00:99", 1)
+				return lines
+			},
+			wantEntries: 1,
+			wantErr:     "was altered",
+		},
+		{
+			name:        "entry removed",
+			tamper:      func(lines []string) []string { return append(lines[:1], lines[2:]...) },
+			wantEntries: 1,
+			wantErr:     "removed or inserted",
+		},
+		{
+			name:        "entries swapped",
+			tamper:      func(lines []string) []string { return []string{lines[0], lines[2], lines[1]} },
+			wantEntries: 1,
+			wantErr:     "removed or inserted",
+		},
+		{
+			name:        "not an entry",
+			tamper:      func(lines []string) []string { return append(lines, "edited by hand") },
+			wantEntries: 3,
+			wantErr:     "not an audit entry",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useManualClock(t)
+			path := filepath.Join(t.TempDir(), "audit.log")
+			lines := tt.tamper(writeTestAuditLog(t, path))
+			if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			entries, err := readAuditLog(path)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("readAuditLog() error = %v, want %q", err, tt.wantErr)
+			}
+			if len(entries) != tt.wantEntries {
+				t.Errorf("readAuditLog() returned %d entries, want %d", len(entries), tt.wantEntries)
+			}
+			// A log that fails verification is not appended to.
+			if _, err := openAuditLog(path, "ACME-1", "jdoe"); (err != nil) != (tt.wantErr != "") {
+				t.Errorf("openAuditLog() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestAuditLogContinues(t *testing.T) {
+	useManualClock(t)
+	path := filepath.Join(t.TempDir(), "audit.log")
+	writeTestAuditLog(t, path)
+	writeTestAuditLog(t, path)
+	entries, err := readAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 6 || entries[5].Seq != 6 || entries[3].Prev != entries[2].Hash {
+		t.Errorf("second run did not continue the chain: %+v", entries)
+	}
+	if e := entries[0]; e.Engagement != "ACME-1" || e.Operator != "jdoe" || e.Action != "network_created" || e.Prev != auditGenesis {
+		t.Errorf("first entry = %+v", e)
+	}
+}
+
+func TestRedactArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"-snmp-community=s3cret", "-workers", "5"}, []string{"-snmp-community=REDACTED", "-workers", "5"}},
+		{[]string{"--snmp-auth-pass", "pw", "-snmp-priv-pass=x=y"}, []string{"--snmp-auth-pass", "REDACTED", "-snmp-priv-pass=REDACTED"}},
+		{[]string{"-snmp-user", "ops"}, []string{"-snmp-user", "ops"}},
+		{[]string{"-snmp-community"}, []string{"-snmp-community"}},
+	}
+	for _, tt := range tests {
+		if got := redactArgs(tt.args); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("redactArgs(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Autoscaling judges the run every interval: a window in which more than
+// autoscaleFailureRate of the launches failed, or whose median lease latency
+// is over autoscaleLatencyFactor times the best window's, means the daemon
+// or the DHCP server is struggling.
+const (
+	autoscaleInterval      = 30 * time.Second
+	autoscaleFailureRate   = 0.1
+	autoscaleLatencyFactor = 2
+	// autoscaleGain is how much faster a window has to lease after an
+	// increase for the extra workers to count as worth it.
+	autoscaleGain = 1.05
+)
+
+// workerScaler replaces a fixed -workers count with one that follows what
+// the run sustains (-autoscale): while launches succeed quickly it adds a
+// quarter more workers every interval, halves them when failures or lease
+// latency climb, and steps back when more workers stopped leasing faster.
+// Counts that proved too many are not tried again, so the run converges on
+// the most workers that still raise the lease rate.
+type workerScaler struct {
+	ctl   *runControl
+	stats *runStats
+	max   int
+
+	mu sync.Mutex
+	// best is the lowest median lease latency of any window, the baseline a
+	// struggling daemon or server is measured against.
+	best time.Duration
+	// limit is the lowest worker count found to be too many, 0 until one is.
+	limit int
+	// grew means the last adjustment added workers, from prevWorkers that
+	// leased prevRate per minute.
+	grew        bool
+	prevWorkers int
+	prevRate    float64
+	peakRate    float64
+	peakWorkers int
+	steps       []scaleStep
+}
+
+// scaleStep is one change of the worker count and the window behind it.
+type scaleStep struct {
+	At          time.Duration
+	From, To    int
+	Rate        float64
+	Latency     time.Duration
+	FailureRate float64
+	Reason      string
+}
+
+// newWorkerScaler returns nil when autoscaling is disabled.
+func newWorkerScaler(enabled bool, maxWorkers int, ctl *runControl, stats *runStats) *workerScaler {
+	if !enabled {
+		return nil
+	}
+	return &workerScaler{ctl: ctl, stats: stats, max: maxWorkers}
+}
+
+// run adjusts the worker count every interval until ctx is done or the pool
+// is exhausted.
+func (a *workerScaler) run(ctx context.Context) {
+	if a == nil {
+		return
+	}
+	start := clock.Now()
+	for {
+		from := clock.Now()
+		select {
+		case <-ctx.Done():
+			return
+		case <-clock.After(autoscaleInterval):
+		}
+		if a.stats.isExhausted() {
+			return
+		}
+		leases, failures, latency := a.stats.window(from)
+		a.adjust(clock.Since(start), leases, failures, latency)
+	}
+}
+
+// adjust picks the worker count for the next window from the last one's
+// leases, failures and median latency.
+func (a *workerScaler) adjust(at time.Duration, leases, failures int, latency time.Duration) {
+	launches := leases + failures
+	if launches == 0 {
+		// Paused, or every launch still under way: nothing to judge by.
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	workers := a.ctl.workers()
+	rate := float64(leases) / autoscaleInterval.Minutes()
+	failureRate := float64(failures) / float64(launches)
+	if leases > 0 && (a.best == 0 || latency < a.best) {
+		a.best = latency
+	}
+	if rate > a.peakRate {
+		a.peakRate, a.peakWorkers = rate, workers
+	}
+
+	next, reason := workers, ""
+	switch {
+	case failureRate > autoscaleFailureRate:
+		next, reason = max(1, workers/2), fmt.Sprintf("%.0f%% of launches failed", failureRate*100)
+		a.limit = workers
+	case leases > 0 && latency > autoscaleLatencyFactor*a.best:
+		next, reason = max(1, workers/2), fmt.Sprintf("median latency %v, over %d times the best %v", latency.Round(time.Millisecond), autoscaleLatencyFactor, a.best.Round(time.Millisecond))
+		a.limit = workers
+	case a.grew && rate < a.prevRate*autoscaleGain:
+		next, reason = a.prevWorkers, fmt.Sprintf("%d workers leased %.1f/min, no faster than %d", workers, rate, a.prevWorkers)
+		a.limit = workers
+	default:
+		ceiling := a.max
+		if a.limit > 0 {
+			ceiling = min(ceiling, a.limit-1)
+		}
+		next, reason = min(ceiling, workers+max(1, workers/4)), "healthy"
+	}
+	a.grew, a.prevWorkers, a.prevRate = next > workers, workers, rate
+	if next == workers {
+		return
+	}
+	if err := a.ctl.setWorkers(next); err != nil {
+		return
+	}
+	a.steps = append(a.steps, scaleStep{At: at, From: workers, To: next, Rate: rate, Latency: latency, FailureRate: failureRate, Reason: reason})
+	slog.Info("autoscaling launch workers", "from", workers, "to", next, "leases_per_minute", fmt.Sprintf("%.1f", rate), "median_latency", latency.Round(time.Millisecond).String(), "reason", reason)
+}
+
+// printSummary reports where the worker count settled and every change. A
+// nil scaler prints nothing.
+func (a *workerScaler) printSummary() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	fmt.Printf("Autoscaling:       settled at %d workers (at most %d); peak %.1f leases/min with %d workers\n", a.ctl.workers(), a.max, a.peakRate, a.peakWorkers)
+	for _, s := range a.steps {
+		fmt.Printf("  %8v  %3d -> %-3d  %6.1f leases/min, p50 %v, %.0f%% failed: %s\n", s.At.Round(time.Second), s.From, s.To, s.Rate, s.Latency.Round(time.Millisecond), s.FailureRate*100, s.Reason)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// networkBaseline is what -observe saw on a network before any attack, kept
+// so later runs on the same subnet can report deltas against it.
+type networkBaseline struct {
+	Subnet     string        `json:"subnet"`
+	Interface  string        `json:"interface"`
+	ObservedAt time.Time     `json:"observed_at"`
+	Duration   time.Duration `json:"duration"`
+	Servers    []string      `json:"servers"`
+	Acks       int           `json:"acks"`
+	Naks       int           `json:"naks"`
+	Clients    int           `json:"clients"`
+	InUse      int           `json:"in_use"`
+	AvgLatency time.Duration `json:"avg_latency"`
+	P95Latency time.Duration `json:"p95_latency"`
+}
+
+// nakRate is the share of server answers to REQUESTs that were NAKs.
+func (b *networkBaseline) nakRate() float64 {
+	if b.Acks+b.Naks == 0 {
+		return 0
+	}
+	return float64(b.Naks) / float64(b.Acks+b.Naks) * 100
+}
+
+// baselinePath returns where the baseline for subnet is stored in dir.
+func baselinePath(dir, subnet string) string {
+	return subnetFile(dir, "baseline", subnet)
+}
+
+// subnetFile returns the path of the kind file kept for subnet in dir.
+func subnetFile(dir, kind, subnet string) string {
+	name := strings.NewReplacer("/", "_", ":", "-").Replace(subnet)
+	return filepath.Join(dir, kind+"-"+name+".json")
+}
+
+// saveBaseline writes b to dir, replacing any earlier baseline for the same
+// subnet, and returns the file path.
+func saveBaseline(dir string, b *networkBaseline) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create baseline directory: %v", err)
+	}
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := baselinePath(dir, b.Subnet)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return "", fmt.Errorf("failed to write baseline: %v", err)
+	}
+	return path, nil
+}
+
+// loadBaseline reads the baseline for subnet from dir. A missing baseline is
+// not an error and yields nil.
+func loadBaseline(dir, subnet string) (*networkBaseline, error) {
+	data, err := os.ReadFile(baselinePath(dir, subnet))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read baseline: %v", err)
+	}
+	var b networkBaseline
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, fmt.Errorf("failed to parse baseline: %v", err)
+	}
+	return &b, nil
+}
+
+// printBaselineComparison reports the attack phase against the baseline for
+// the same network: latency, NAK rate and the set of servers answering.
+// latencyNote explains what the attack latency covers when it is not a bare
+// DHCP exchange.
+func printBaselineComparison(b *networkBaseline, stats *runStats, leases *leaseTable, latencyNote string) {
+	stats.mu.Lock()
+	var avg time.Duration
+	if len(stats.latencies) > 0 {
+		var total time.Duration
+		for _, latency := range stats.latencies {
+			total += latency
+		}
+		avg = total / time.Duration(len(stats.latencies))
+	}
+	p95 := percentile(stats.latencies, 95)
+	naks := stats.failures["nak"]
+	acks := stats.leased
+	stats.mu.Unlock()
+
+	fmt.Printf("=== Compared With Baseline (observed %s) ===\n", b.ObservedAt.Format("2006-01-02 15:04"))
+	if b.AvgLatency > 0 && avg > 0 {
+		fmt.Printf("Lease latency:     avg %v -> %v (%s), p95 %v -> %v (%s)\n",
+			b.AvgLatency.Round(time.Microsecond), avg.Round(time.Microsecond), percentChange(b.AvgLatency, avg),
+			b.P95Latency.Round(time.Microsecond), p95.Round(time.Microsecond), percentChange(b.P95Latency, p95))
+		if latencyNote != "" {
+			fmt.Printf("                   (%s)\n", latencyNote)
+		}
+	} else {
+		fmt.Println("Lease latency:     no comparable samples")
+	}
+
+	var attackNAK float64
+	if acks+naks > 0 {
+		attackNAK = float64(naks) / float64(acks+naks) * 100
+	}
+	fmt.Printf("NAK rate:          %.1f%% -> %.1f%% (%+.1f points)\n", b.nakRate(), attackNAK, attackNAK-b.nakRate())
+
+	seen := make(map[string]bool)
+	for _, r := range leases.snapshot() {
+		if r.Server != "" {
+			seen[r.Server] = true
+		}
+	}
+	before := make(map[string]bool)
+	for _, s := range b.Servers {
+		before[s] = true
+	}
+	var added, missing []string
+	for s := range seen {
+		if !before[s] {
+			added = append(added, s)
+		}
+	}
+	for s := range before {
+		if !seen[s] {
+			missing = append(missing, s)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(missing)
+	fmt.Printf("DHCP servers:      %d -> %d", len(before), len(seen))
+	if len(added) > 0 {
+		fmt.Printf(", NEW: %s", strings.Join(added, ", "))
+	}
+	if len(missing) > 0 {
+		fmt.Printf(", no longer answering: %s", strings.Join(missing, ", "))
+	}
+	if len(added) == 0 && len(missing) == 0 {
+		fmt.Print(", unchanged")
+	}
+	fmt.Println()
+}
+
+// percentChange formats the relative change from before to after.
+func percentChange(before, after time.Duration) string {
+	if before == 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf("%+.0f%%", (float64(after)-float64(before))/float64(before)*100)
+}
+
+// compareWithBaseline prints the baseline comparison when -observe saved one
+// for subnet.
+func compareWithBaseline(dir, subnet string, stats *runStats, leases *leaseTable, latencyNote string) {
+	if dir == "" {
+		return
+	}
+	b, err := loadBaseline(dir, subnet)
+	if err != nil {
+		slog.Warn("baseline comparison skipped", "error", err)
+		return
+	}
+	if b != nil {
+		printBaselineComparison(b, stats, leases, latencyNote)
+	}
+}
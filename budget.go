@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// leaseBudget limits how hard a run presses on its network: how many leases it
+// may take and how fast clients are launched. Engagements that call for
+// pressure rather than a full outage set a cap below the pool size.
+type leaseBudget struct {
+	mu        sync.Mutex
+	maxLeases int     // 0 runs until the pool is exhausted
+	rate      float64 // launches per minute, 0 for no limit
+	next      time.Time
+	taken     int
+	pending   int
+
+	// ramp, when set, raises the rate in steps up to rate, or without
+	// limit when rate is 0.
+	ramp *rampSchedule
+
+	// networks are the budgets of the -networks entries given a cap or
+	// rate of their own, keyed by network name. A launch on one of them
+	// takes from its budget as well as the run's.
+	networks map[string]*leaseBudget
+}
+
+func newLeaseBudget(maxLeases int, rate float64) (*leaseBudget, error) {
+	if maxLeases < 0 {
+		return nil, fmt.Errorf("-max-leases must not be negative")
+	}
+	if rate < 0 {
+		return nil, fmt.Errorf("-rate must not be negative")
+	}
+	return &leaseBudget{maxLeases: maxLeases, rate: rate}, nil
+}
+
+// take reserves one launch, waiting for the rate limit if one is set. It
+// returns false once the lease cap is reached or ctx is done. While launches
+// in flight could still reach the cap, take waits to see whether they do.
+func (b *leaseBudget) take(ctx context.Context) bool {
+	for {
+		b.mu.Lock()
+		if b.maxLeases > 0 && b.taken >= b.maxLeases {
+			b.mu.Unlock()
+			return false
+		}
+		if b.maxLeases == 0 || b.taken+b.pending < b.maxLeases {
+			b.pending++
+			var wait time.Duration
+			now := clock.Now()
+			rate := b.rate
+			if b.ramp != nil {
+				rate = b.ramp.rateAt(b.ramp.step(now), b.rate)
+			}
+			if rate > 0 {
+				if b.next.Before(now) {
+					b.next = now
+				}
+				wait = b.next.Sub(now)
+				b.next = b.next.Add(time.Duration(float64(time.Minute) / rate))
+			}
+			b.mu.Unlock()
+			if wait > 0 {
+				select {
+				case <-clock.After(wait):
+				case <-ctx.Done():
+					b.settle(false)
+					return false
+				}
+			}
+			return true
+		}
+		b.mu.Unlock()
+		select {
+		case <-clock.After(time.Second):
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// settle records the outcome of a launch reserved with take and reports
+// whether the lease cap has now been reached.
+func (b *leaseBudget) settle(leased bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pending--
+	if leased {
+		b.taken++
+	}
+	return b.maxLeases > 0 && b.taken >= b.maxLeases
+}
+
+// recordLaunch adds the outcome of a launch started at start to the ramp
+// step it belongs to, if a ramp is set.
+func (b *leaseBudget) recordLaunch(start time.Time, err error) {
+	b.mu.Lock()
+	ramp, ceiling := b.ramp, b.rate
+	b.mu.Unlock()
+	ramp.record(start, clock.Since(start), err, ceiling)
+}
+
+// returned gives back a lease the run released on purpose on network,
+// making room for a replacement under the caps.
+func (b *leaseBudget) returned(network string) {
+	b.mu.Lock()
+	if b.taken > 0 {
+		b.taken--
+	}
+	nb := b.networks[network]
+	b.mu.Unlock()
+	if nb != nil {
+		nb.returned(network)
+	}
+}
+
+// limitNetwork gives the network name a lease cap and launch rate of its
+// own.
+func (b *leaseBudget) limitNetwork(name string, maxLeases int, rate float64) error {
+	nb, err := newLeaseBudget(maxLeases, rate)
+	if err != nil {
+		return fmt.Errorf("network %s: %w", name, err)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.networks == nil {
+		b.networks = make(map[string]*leaseBudget)
+	}
+	b.networks[name] = nb
+	return nil
+}
+
+// network returns the budget of the network name, or nil if it has none of
+// its own.
+func (b *leaseBudget) network(name string) *leaseBudget {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.networks[name]
+}
+
+// takeNetwork reserves a launch on the network name from its own budget,
+// as take does; it returns true at once for a network without one.
+func (b *leaseBudget) takeNetwork(ctx context.Context, name string) bool {
+	nb := b.network(name)
+	return nb == nil || nb.take(ctx)
+}
+
+// settleNetwork records the outcome of a launch reserved with takeNetwork
+// and reports whether the network's cap has now been reached.
+func (b *leaseBudget) settleNetwork(name string, leased bool) bool {
+	nb := b.network(name)
+	return nb != nil && nb.settle(leased)
+}
+
+// networkReached reports whether the network name has met its own cap.
+func (b *leaseBudget) networkReached(name string) bool {
+	nb := b.network(name)
+	return nb != nil && nb.reached()
+}
+
+// adopt counts leases a resumed run took over against the cap.
+func (b *leaseBudget) adopt(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.taken += n
+}
+
+// paced reports whether launches are spaced by a rate or ramp, in which case
+// workers need no pause of their own between launches.
+func (b *leaseBudget) paced() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate > 0 || b.ramp != nil
+}
+
+// set replaces the cap and rate while the run is in progress and reports
+// whether the new cap is already met.
+func (b *leaseBudget) set(maxLeases int, rate float64) (bool, error) {
+	if maxLeases < 0 {
+		return false, fmt.Errorf("lease cap must not be negative")
+	}
+	if rate < 0 {
+		return false, fmt.Errorf("rate must not be negative")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.maxLeases, b.rate = maxLeases, rate
+	// Launches already scheduled under the old rate keep their slots; the
+	// new spacing applies from now on.
+	b.next = clock.Now()
+	return maxLeases > 0 && b.taken >= maxLeases, nil
+}
+
+// limits returns the current cap and rate.
+func (b *leaseBudget) limits() (int, float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.maxLeases, b.rate
+}
+
+// reached reports whether the run stopped because of the lease cap.
+func (b *leaseBudget) reached() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.maxLeases > 0 && b.taken >= b.maxLeases
+}
+
+// String describes the budget for the run banner and summary.
+func (b *leaseBudget) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	limit := "until the pool is exhausted"
+	if b.maxLeases > 0 {
+		limit = fmt.Sprintf("%d leases", b.maxLeases)
+	}
+	if b.ramp != nil {
+		limit += ", " + b.ramp.String()
+	}
+	if b.rate > 0 {
+		return fmt.Sprintf("%s at up to %.1f launches/min", limit, b.rate)
+	}
+	return limit
+}
+
+// reloadOnHangup re-reads the -config file on SIGHUP and applies its
+// max_leases and rate to the running budget, so pressure can be dialled up
+// or down without restarting. Values in the file win over the command line
+// on reload; keys missing from the file keep their current values.
+func reloadOnHangup(ctl *runControl, cfg Config) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	go func() {
+		for range sigs {
+			if cfg.ConfigPath == "" {
+				slog.Warn("SIGHUP ignored, no -config file to reload")
+				continue
+			}
+			if err := reloadBudget(ctl, cfg); err != nil {
+				slog.Error("config reload failed", "error", err)
+				continue
+			}
+			slog.Info("configuration reloaded", "config", cfg.ConfigPath, "budget", ctl.budget.String())
+		}
+	}()
+}
+
+// reloadBudget re-reads cfg's -config file and applies its max_leases and
+// rate to the running budget.
+func reloadBudget(ctl *runControl, cfg Config) error {
+	next := cfg
+	next.MaxLeases, next.LaunchRate = ctl.budget.limits()
+	if err := loadConfig(cfg.ConfigPath, &next); err != nil {
+		return err
+	}
+	return ctl.setBudget(next.MaxLeases, next.LaunchRate)
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestLeaseBudgetCap(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxLeases   int
+		outcomes    []bool // whether each launch before the last take leased
+		wantTake    bool
+		wantReached bool
+	}{
+		{"no cap", 0, []bool{true, true, true}, true, false},
+		{"below the cap", 3, []bool{true, false, true}, true, false},
+		{"failed launches do not count", 2, []bool{false, false, true}, true, false},
+		{"cap reached", 2, []bool{true, false, true}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useManualClock(t)
+			b, err := newLeaseBudget(tt.maxLeases, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+			for i, leased := range tt.outcomes {
+				if !b.take(ctx) {
+					t.Fatalf("take %d refused", i+1)
+				}
+				b.settle(leased)
+			}
+			if got := b.take(ctx); got != tt.wantTake {
+				t.Errorf("take() = %v, want %v", got, tt.wantTake)
+			}
+			if got := b.reached(); got != tt.wantReached {
+				t.Errorf("reached() = %v, want %v", got, tt.wantReached)
+			}
+		})
+	}
+}
+
+// TestLeaseBudgetPending checks that a launch that could exceed the cap
+// waits for the ones in flight, and goes ahead only if they fail.
+func TestLeaseBudgetPending(t *testing.T) {
+	for _, leased := range []bool{false, true} {
+		c := useManualClock(t)
+		b, err := newLeaseBudget(1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !b.take(context.Background()) {
+			t.Fatal("first take refused")
+		}
+		done := make(chan bool, 1)
+		go func() { done <- b.take(context.Background()) }()
+		c.blockUntil(1)
+		select {
+		case <-done:
+			t.Fatal("second take went ahead with the first launch in flight")
+		default:
+		}
+		b.settle(leased)
+		c.advance(time.Second)
+		select {
+		case got := <-done:
+			if got == leased {
+				t.Errorf("with the first launch leased = %v, second take() = %v", leased, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("second take did not return")
+		}
+	}
+}
+
+func TestLeaseBudgetRate(t *testing.T) {
+	tests := []struct {
+		rate float64
+		want []time.Duration // when each take returns
+	}{
+		{0, []time.Duration{0, 0, 0}},
+		{60, []time.Duration{0, time.Second, 2 * time.Second}},
+		{20, []time.Duration{0, 3 * time.Second, 6 * time.Second}},
+	}
+	for _, tt := range tests {
+		c := useManualClock(t)
+		start := c.Now()
+		b, err := newLeaseBudget(0, tt.rate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		taken := make(chan time.Duration)
+		go func() {
+			for range tt.want {
+				if b.take(context.Background()) {
+					taken <- c.Since(start)
+				}
+				b.settle(true)
+			}
+		}()
+		var elapsed time.Duration
+		for i, want := range tt.want {
+			if want > elapsed {
+				c.blockUntil(1)
+				c.advance(want - elapsed)
+				elapsed = want
+			}
+			select {
+			case got := <-taken:
+				if got != want {
+					t.Errorf("rate %v: take %d at %v, want %v", tt.rate, i+1, got, want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("rate %v: take %d did not return", tt.rate, i+1)
+			}
+		}
+	}
+}
+
+func TestLeaseBudgetSet(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxLeases   int
+		rate        float64
+		wantReached bool
+		wantErr     bool
+	}{
+		{"raise the cap", 10, 30, false, false},
+		{"lower it to what is held", 3, 0, true, false},
+		{"negative cap", -1, 0, false, true},
+		{"negative rate", 5, -1, false, true},
+	}
+	for _, tt := range tests {
+		useManualClock(t)
+		b, err := newLeaseBudget(5, 60)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.adopt(3)
+		reached, err := b.set(tt.maxLeases, tt.rate)
+		if (err != nil) != tt.wantErr || reached != tt.wantReached {
+			t.Errorf("%s: set(%d, %v) = %v, %v; want %v, error %v", tt.name, tt.maxLeases, tt.rate, reached, err, tt.wantReached, tt.wantErr)
+		}
+		if maxLeases, rate := b.limits(); !tt.wantErr && (maxLeases != tt.maxLeases || rate != tt.rate) {
+			t.Errorf("%s: limits() = %d, %v", tt.name, maxLeases, rate)
+		}
+	}
+	for _, args := range [][2]float64{{-1, 0}, {0, -1}} {
+		if _, err := newLeaseBudget(int(args[0]), args[1]); err == nil {
+			t.Errorf("newLeaseBudget(%v, %v) accepted a negative value", args[0], args[1])
+		}
+	}
+}
+
+func TestLeaseBudgetNetworks(t *testing.T) {
+	useManualClock(t)
+	ctx := context.Background()
+	b, err := newLeaseBudget(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.limitNetwork("vlan40", 2, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.limitNetwork("vlan50", -1, 0); err == nil {
+		t.Error("limitNetwork() accepted a negative cap")
+	}
+	// A network without a budget of its own only takes from the run's.
+	for range 3 {
+		if !b.takeNetwork(ctx, "vlan30") || b.settleNetwork("vlan30", true) {
+			t.Fatal("network without a cap was limited")
+		}
+	}
+	for i, want := range []bool{false, true} {
+		if !b.takeNetwork(ctx, "vlan40") {
+			t.Fatalf("take %d on vlan40 refused", i+1)
+		}
+		if got := b.settleNetwork("vlan40", true); got != want {
+			t.Errorf("settle %d on vlan40 reported the cap reached = %v, want %v", i+1, got, want)
+		}
+	}
+	if !b.networkReached("vlan40") || b.networkReached("vlan30") {
+		t.Error("networkReached() does not report vlan40 alone at its cap")
+	}
+	if b.takeNetwork(ctx, "vlan40") {
+		t.Error("take on vlan40 went ahead past its cap")
+	}
+	// Churned leases make room on their network.
+	b.adopt(1)
+	b.returned("vlan40")
+	if b.networkReached("vlan40") {
+		t.Error("returned lease did not make room under the vlan40 cap")
+	}
+	if b.taken != 0 {
+		t.Errorf("run's budget holds %d leases after the return, want 0", b.taken)
+	}
+}
+
+func TestLeaseBudgetNetworkRate(t *testing.T) {
+	c := useManualClock(t)
+	start := c.Now()
+	b, err := newLeaseBudget(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.limitNetwork("vlan40", 0, 30); err != nil {
+		t.Fatal(err)
+	}
+	taken := make(chan time.Duration)
+	go func() {
+		for range 2 {
+			b.takeNetwork(context.Background(), "vlan40")
+			taken <- c.Since(start)
+			b.settleNetwork("vlan40", true)
+		}
+	}()
+	if got := <-taken; got != 0 {
+		t.Errorf("first take on vlan40 at %v, want at once", got)
+	}
+	// vlan40's rate does not hold back the other networks.
+	if !b.takeNetwork(context.Background(), "vlan30") {
+		t.Error("take on vlan30 refused")
+	}
+	c.blockUntil(1)
+	c.advance(2 * time.Second)
+	select {
+	case got := <-taken:
+		if got != 2*time.Second {
+			t.Errorf("second take on vlan40 at %v, want 2s", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("second take on vlan40 did not return")
+	}
+}
+
+func TestReloadBudget(t *testing.T) {
+	tests := []struct {
+		name        string
+		file        string
+		content     string
+		wantMax     int
+		wantRate    float64
+		wantErr     bool
+		wantStopped bool
+	}{
+		{"both", "run.yaml", "max_leases: 50\nrate: 30\n", 50, 30, false, false},
+		{"rate only", "run.yaml", "rate: 12.5\n", 100, 12.5, false, false},
+		{"toml", "run.toml", "max_leases = 80\n", 80, 60, false, false},
+		{"cap below the leases held", "run.yaml", "max_leases: 5\n", 5, 60, false, true},
+		{"unrelated keys", "run.yaml", "workers: 9\n", 100, 60, false, false},
+		{"invalid", "run.yaml", "max_leases: [\n", 100, 60, true, false},
+		{"negative", "run.yaml", "rate: -1\n", 100, 60, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useManualClock(t)
+			cfg := defaultConfig()
+			cfg.ConfigPath = filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(cfg.ConfigPath, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ctl := newRunControl(ctx, cancel, nil)
+			var err error
+			if ctl.budget, err = newLeaseBudget(100, 60); err != nil {
+				t.Fatal(err)
+			}
+			ctl.budget.adopt(10)
+
+			err = reloadBudget(ctl, cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("reloadBudget() error = %v, want error %v", err, tt.wantErr)
+			}
+			if maxLeases, rate := ctl.budget.limits(); maxLeases != tt.wantMax || rate != tt.wantRate {
+				t.Errorf("budget = %d leases at %v/min, want %d at %v/min", maxLeases, rate, tt.wantMax, tt.wantRate)
+			}
+			if stopped := ctx.Err() != nil; stopped != tt.wantStopped {
+				t.Errorf("run stopped = %v, want %v", stopped, tt.wantStopped)
+			}
+		})
+	}
+}
+
+func TestReloadOnHangup(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.ConfigPath = filepath.Join(t.TempDir(), "run.yaml")
+	if err := os.WriteFile(cfg.ConfigPath, []byte("max_leases: 40\nrate: 20\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctl := newRunControl(ctx, cancel, nil)
+	var err error
+	if ctl.budget, err = newLeaseBudget(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	reloadOnHangup(ctl, cfg)
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if maxLeases, rate := ctl.budget.limits(); maxLeases == 40 && rate == 20 {
+			return
+		}
+	}
+	t.Error("budget not reloaded from the config file on SIGHUP")
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/archive"
+)
+
+// buildErrorTail is how many lines of a failed build's output are shown with
+// its error.
+const buildErrorTail = 15
+
+// imageBuild is one client image built from a Dockerfile directory.
+type imageBuild struct {
+	Dir   string
+	Image string
+	// Dockerfile is the Dockerfile's path within Dir.
+	Dockerfile string
+
+	output  bytes.Buffer
+	elapsed time.Duration
+	err     error
+}
+
+// buildImages builds every image with at most parallel builds at a time. Each
+// build's output is collected and printed as one block when it finishes, so
+// concurrent builds do not interleave, trimmed to the verbosity; a failed
+// build always shows the tail of its full output. The first failure cancels the builds
+// still running and is returned naming the image that failed.
+func buildImages(cli containerRuntime, builder *imageBuilder, builds []*imageBuild, parallel int) error {
+	if len(builds) == 0 {
+		return nil
+	}
+	if parallel < 1 {
+		parallel = 1
+	}
+	fmt.Printf("Building %d images with %s, %d at a time\n", len(builds), builder, parallel)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		wg      sync.WaitGroup
+		printMu sync.Mutex
+		failed  *imageBuild
+		slots   = make(chan struct{}, parallel)
+	)
+	for _, b := range builds {
+		wg.Add(1)
+		go func(b *imageBuild) {
+			defer wg.Done()
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-slots }()
+			if ctx.Err() != nil {
+				return
+			}
+
+			start := clock.Now()
+			spanCtx, span := startSpan(ctx, "image.build", "image", b.Image, "dir", b.Dir)
+			b.err = builder.build(spanCtx, cli, b.Dir, b.Dockerfile, b.Image, &b.output)
+			endSpan(span, b.err)
+			b.elapsed = clock.Since(start)
+
+			printMu.Lock()
+			defer printMu.Unlock()
+			if b.err != nil {
+				// Builds cancelled because of another failure are not
+				// reported on their own.
+				if failed == nil {
+					failed = b
+					cancel()
+				}
+				return
+			}
+			fmt.Printf("=== Built image %s from %s in %v ===\n", b.Image, b.Dir, b.elapsed.Round(time.Second))
+			events.emit("build_complete", map[string]any{"image": b.Image, "dir": b.Dir, "seconds": b.elapsed.Seconds()})
+			fmt.Print(buildProgress(b.output.String()))
+		}(b)
+	}
+	wg.Wait()
+
+	if failed != nil {
+		fmt.Printf("=== Build of %s from %s failed after %v ===\n", failed.Image, failed.Dir, failed.elapsed.Round(time.Second))
+		lines := strings.Split(strings.TrimRight(failed.output.String(), "\n"), "\n")
+		if len(lines) > buildErrorTail {
+			fmt.Printf("... (%d earlier lines)\n", len(lines)-buildErrorTail)
+			lines = lines[len(lines)-buildErrorTail:]
+		}
+		fmt.Println(strings.Join(lines, "\n"))
+		return fmt.Errorf("%w: %s from %s: %w", ErrBuildFailed, failed.Image, failed.Dir, failed.err)
+	}
+	return nil
+}
+
+// buildImage builds a Docker image from the specified directory with the
+// Dockerfile at dockerfile within it, and tags it with the provided imageName,
+// writing the build output to out.
+func buildImage(ctx context.Context, cli containerRuntime, dockerfileDir, dockerfile, imageName string, out io.Writer) error {
+	// Create a tar archive of the Dockerfile directory.
+	buildContext, err := archive.TarWithOptions(dockerfileDir, &archive.TarOptions{})
+	if err != nil {
+		return err
+	}
+	buildOptions := types.ImageBuildOptions{
+		Tags:       []string{imageName},
+		Dockerfile: filepath.ToSlash(dockerfile),
+		Remove:     true,
+		Labels:     runLabels(),
+		Platform:   platformString(clientPlatform),
+	}
+	response, err := cli.ImageBuild(ctx, buildContext, buildOptions)
+	if err != nil {
+		return runtimeError(err)
+	}
+	defer response.Body.Close()
+
+	// The daemon streams JSON messages; a failing build step arrives as an
+	// error message rather than an HTTP error.
+	dec := json.NewDecoder(response.Body)
+	for {
+		var msg struct {
+			Stream string `json:"stream"`
+			Error  string `json:"error"`
+		}
+		if err := dec.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if msg.Error != "" {
+			return fmt.Errorf("%s", strings.TrimSpace(msg.Error))
+		}
+		io.WriteString(out, msg.Stream)
+	}
+}
+
+// imageNameInvalid matches the runs of characters an image name may not
+// contain.
+var imageNameInvalid = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+// buildImageName names the image built from dir after the directory, as
+// ipocalypse_basic_image:latest, made a valid image name for directories
+// whose names are not, such as "Printer Image" or ".".
+func buildImageName(dir string) string {
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	name := imageNameInvalid.ReplaceAllString(strings.ToLower(filepath.Base(dir)), "-")
+	name = strings.Trim(name, "._-")
+	if name == "" {
+		name = "ipocalypse-client"
+	}
+	return name + ":latest"
+}
+
+// checkBuildContext checks that dir is a directory with the Dockerfile at
+// dockerfile, a path within it.
+func checkBuildContext(dir, dockerfile string) error {
+	if info, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("build context %s: %v", dir, err)
+	} else if !info.IsDir() {
+		return fmt.Errorf("build context %s is not a directory", dir)
+	}
+	if filepath.IsAbs(dockerfile) || !filepath.IsLocal(dockerfile) {
+		return fmt.Errorf("Dockerfile %s must be a path within the build context %s", dockerfile, dir)
+	}
+	if _, err := os.Stat(filepath.Join(dir, dockerfile)); err != nil {
+		return fmt.Errorf("build context %s has no %s", dir, dockerfile)
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Image builders accepted by -builder.
+const (
+	builderAuto     = "auto"
+	builderBuildKit = "buildkit"
+	builderLegacy   = "legacy"
+)
+
+// imageBuilder picks how client images are built: with BuildKit through
+// `docker buildx build`, which brings cache mounts, build secrets and much
+// faster rebuilds, or with the engine API's legacy builder, which needs
+// nothing but the API and is what Podman gets.
+type imageBuilder struct {
+	buildKit bool
+	// dockerArgs are the docker CLI's global options reaching the same
+	// engine as the API client: -H and the -tls-* files.
+	dockerArgs []string
+	// secrets are -build-secrets in docker buildx's --secret form.
+	secrets []string
+}
+
+// newImageBuilder resolves -builder. auto uses BuildKit when the runtime is
+// Docker and the docker CLI has buildx, and the legacy builder otherwise.
+func newImageBuilder(cfg Config, runtimeName string) (*imageBuilder, error) {
+	b := &imageBuilder{}
+	for _, secret := range cfg.BuildSecrets {
+		id, file, ok := strings.Cut(secret, "=")
+		if !ok || id == "" || file == "" {
+			return nil, fmt.Errorf("invalid -build-secrets entry %q (use id=file)", secret)
+		}
+		if _, err := os.Stat(file); err != nil {
+			return nil, fmt.Errorf("build secret %s: %v", id, err)
+		}
+		b.secrets = append(b.secrets, "id="+id+",src="+file)
+	}
+	if cfg.Host != "" {
+		b.dockerArgs = append(b.dockerArgs, "-H", cfg.Host)
+	}
+	if cfg.TLSCA != "" || cfg.TLSCert != "" || cfg.TLSKey != "" {
+		b.dockerArgs = append(b.dockerArgs, "--tlsverify", "--tlscacert", cfg.TLSCA, "--tlscert", cfg.TLSCert, "--tlskey", cfg.TLSKey)
+	}
+	switch cfg.Builder {
+	case builderLegacy:
+	case builderBuildKit:
+		if runtimeName != runtimeDocker {
+			return nil, fmt.Errorf("-builder=buildkit needs the docker runtime; %s builds with the API", runtimeName)
+		}
+		if err := b.checkBuildx(); err != nil {
+			return nil, fmt.Errorf("-builder=buildkit: %v", err)
+		}
+		b.buildKit = true
+	case builderAuto:
+		b.buildKit = runtimeName == runtimeDocker && b.checkBuildx() == nil
+	default:
+		return nil, fmt.Errorf("unknown -builder %q (use auto, buildkit or legacy)", cfg.Builder)
+	}
+	if len(b.secrets) > 0 && !b.buildKit {
+		return nil, fmt.Errorf("-build-secrets needs the BuildKit builder, and -builder=%s builds without it", cfg.Builder)
+	}
+	return b, nil
+}
+
+func (b *imageBuilder) String() string {
+	if b.buildKit {
+		return "BuildKit (docker buildx)"
+	}
+	return "the legacy builder"
+}
+
+// checkBuildx reports whether the docker CLI and its buildx plugin run.
+func (b *imageBuilder) checkBuildx() error {
+	out, err := exec.Command("docker", append(append([]string(nil), b.dockerArgs...), "buildx", "version")...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("docker buildx is not available: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// build builds the image in dockerfileDir from the Dockerfile at dockerfile
+// within it with the chosen builder.
+func (b *imageBuilder) build(ctx context.Context, cli containerRuntime, dockerfileDir, dockerfile, imageName string, out io.Writer) error {
+	if !b.buildKit {
+		return buildImage(ctx, cli, dockerfileDir, dockerfile, imageName, out)
+	}
+	args := append(append([]string(nil), b.dockerArgs...), "buildx", "build",
+		"--progress=plain", "--load",
+		"-t", imageName,
+		"-f", filepath.Join(dockerfileDir, dockerfile))
+	if platform := platformString(clientPlatform); platform != "" {
+		args = append(args, "--platform", platform)
+	}
+	for key, value := range runLabels() {
+		args = append(args, "--label", key+"="+value)
+	}
+	for _, secret := range b.secrets {
+		args = append(args, "--secret", secret)
+	}
+	args = append(args, dockerfileDir)
+
+	cmd := exec.CommandContext(ctx, "docker", args...)
+	pr, pw := io.Pipe()
+	cmd.Stdout, cmd.Stderr = pw, pw
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to run docker buildx: %v", err)
+	}
+	go func() { pw.CloseWithError(cmd.Wait()) }()
+	buildErr, err := parseBuildKitProgress(pr, out)
+	if buildErr != "" {
+		return fmt.Errorf("%s", buildErr)
+	}
+	if err != nil {
+		return fmt.Errorf("docker buildx failed: %v", err)
+	}
+	fmt.Fprintf(out, "Successfully built %s\n", imageName)
+	return nil
+}
+
+// buildKitLine matches a line of BuildKit's plain progress: "#5 ..." for
+// build step 5.
+var buildKitLine = regexp.MustCompile(`^#(\d+) (.*)$`)
+
+// buildKitLog matches a step's log output, which starts with the seconds
+// since the step started.
+var buildKitLog = regexp.MustCompile(`^\d+\.\d+ (.*)$`)
+
+// parseBuildKitProgress turns BuildKit's plain progress into the build
+// output: a "Step" line per Dockerfile step as it finishes, with CACHED or
+// its time, and the steps' own output indented under it. It returns the
+// build's error message, if it failed, and the error reading the progress
+// ended with, which is the exit status of buildx.
+func parseBuildKitProgress(r io.Reader, out io.Writer) (string, error) {
+	names := make(map[string]string)
+	var buildErr, lastLine string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) != "" {
+			lastLine = strings.TrimSpace(line)
+		}
+		m := buildKitLine.FindStringSubmatch(line)
+		if m == nil {
+			// The summary of a failure: the failed step's last output
+			// lines, the Dockerfile excerpt, then "ERROR: failed to solve",
+			// which only says more than the failed step did when no step
+			// failed, e.g. for a missing secret.
+			if msg, ok := strings.CutPrefix(line, "ERROR: "); ok && buildErr == "" {
+				buildErr = strings.TrimPrefix(msg, "failed to solve: ")
+			}
+			if line != "" {
+				fmt.Fprintln(out, line)
+			}
+			continue
+		}
+		id, rest := m[1], m[2]
+		name, seen := names[id]
+		if !seen {
+			names[id] = rest
+			continue
+		}
+		// Only Dockerfile steps ("[2/4] RUN ...") get a line of their
+		// own; loading the context and exporting the image do not.
+		step := strings.HasPrefix(name, "[") && !strings.HasPrefix(name, "[internal]")
+		switch {
+		case rest == "CACHED":
+			if step {
+				fmt.Fprintf(out, "Step %s: CACHED\n", name)
+			}
+		case strings.HasPrefix(rest, "DONE "):
+			if step {
+				fmt.Fprintf(out, "Step %s: done in %s\n", name, strings.TrimPrefix(rest, "DONE "))
+			}
+		case strings.HasPrefix(rest, "ERROR: "):
+			fmt.Fprintf(out, "Step %s: %s\n", name, rest)
+			if buildErr == "" {
+				buildErr = name + ": " + strings.TrimPrefix(rest, "ERROR: ")
+			}
+		default:
+			if log := buildKitLog.FindStringSubmatch(rest); log != nil {
+				fmt.Fprintf(out, "  %s\n", log[1])
+			}
+		}
+	}
+	err := scanner.Err()
+	if err != nil && buildErr == "" {
+		buildErr = lastLine
+	}
+	return buildErr, err
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// clientChurn kills a random fraction of the run's clients every interval so
+// the workers launch replacements, keeping DISCOVER and RELEASE traffic
+// flowing instead of filling the pool once. This exercises lease reuse and
+// server logging far more than a one-way fill.
+type clientChurn struct {
+	fraction float64
+	interval time.Duration
+	leases   *leaseTable
+	budget   *leaseBudget
+	release  func(ctx context.Context, r leaseRecord) error
+
+	mu       sync.Mutex
+	rounds   int
+	released int
+	failed   int
+	// done is closed at the end of each round, waking the workers that
+	// wait for addresses to come free.
+	done chan struct{}
+}
+
+// newClientChurn returns a churn of fraction of the held leases every
+// interval, or nil when fraction is 0. Churned leases are given back to
+// budget, so replacements fit under a -max-leases cap.
+func newClientChurn(fraction float64, interval time.Duration, leases *leaseTable, budget *leaseBudget, release func(ctx context.Context, r leaseRecord) error) (*clientChurn, error) {
+	if fraction < 0 || fraction > 1 {
+		return nil, fmt.Errorf("-churn must be a fraction between 0 and 1")
+	}
+	if fraction == 0 {
+		return nil, nil
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("-churn-interval must be positive")
+	}
+	return &clientChurn{fraction: fraction, interval: interval, leases: leases, budget: budget, release: release, done: make(chan struct{})}, nil
+}
+
+// watch runs a churn round every interval until ctx is done. A nil churn
+// returns immediately.
+func (c *clientChurn) watch(ctx context.Context) {
+	if c == nil {
+		return
+	}
+	for {
+		select {
+		case <-clock.After(c.interval):
+		case <-ctx.Done():
+			return
+		}
+		c.round(ctx)
+	}
+}
+
+// round releases a random fraction of the held leases, at least one while
+// any are held.
+func (c *clientChurn) round(ctx context.Context) {
+	held := c.leases.held()
+	n := int(math.Ceil(c.fraction * float64(len(held))))
+	released, failed := 0, 0
+	for _, i := range rand.Perm(len(held))[:n] {
+		if ctx.Err() != nil {
+			break
+		}
+		lease := held[i]
+		if err := c.release(ctx, lease); err != nil {
+			slog.Warn("failed to release churned client", "ip", lease.IP, "mac", lease.MAC, "error", err)
+			failed++
+			continue
+		}
+		c.leases.markReleased(lease.IP)
+		c.budget.returned(lease.Network)
+		released++
+	}
+	slog.Info("churned clients", "released", released, "failed", failed, "held", len(held))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rounds++
+	c.released += released
+	c.failed += failed
+	close(c.done)
+	c.done = make(chan struct{})
+}
+
+// wait blocks until the next churn round has freed addresses, for workers
+// that found the pool exhausted or the lease cap met.
+func (c *clientChurn) wait(ctx context.Context) {
+	c.mu.Lock()
+	done := c.done
+	c.mu.Unlock()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// printSummary reports the churn rounds. A nil churn prints nothing.
+func (c *clientChurn) printSummary() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Printf("Churn:             %d rounds of %.0f%% every %s, %d clients killed and replaced, %d releases failed\n", c.rounds, c.fraction*100, c.interval, c.released, c.failed)
+}
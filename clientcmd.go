@@ -0,0 +1,105 @@
+package main
+
+import "fmt"
+
+// DHCP clients accepted by -dhcp-client and the manifest's dhcp_client.
+const (
+	dhcpClientAuto     = "auto"
+	dhcpClientDhclient = "dhclient"
+	dhcpClientUdhcpc   = "udhcpc"
+	dhcpClientDhcpcd   = "dhcpcd"
+)
+
+// checkDHCPClient reports whether client is one -dhcp-client accepts.
+func checkDHCPClient(client string) error {
+	switch client {
+	case dhcpClientAuto, dhcpClientDhclient, dhcpClientUdhcpc, dhcpClientDhcpcd:
+		return nil
+	}
+	return fmt.Errorf("unknown DHCP client %q: use auto, dhclient, udhcpc or dhcpcd", client)
+}
+
+// clientScript is the command of client containers whose manifest sets no
+// command of its own. It runs the DHCP client named by IPOCALYPSE_DHCP_CLIENT,
+// or the first one installed, on IPOCALYPSE_INTERFACE. udhcpc and dhcpcd get
+// a hook recording their lease in the dhclient lease file the controller
+// reads, so images need not ship ISC dhclient. Images with an ENTRYPOINT,
+// such as the built-in one, receive it as arguments and may ignore it.
+const clientScript = `IF=${IPOCALYPSE_INTERFACE:-eth0}
+CLIENT=${IPOCALYPSE_DHCP_CLIENT:-auto}
+if [ "$CLIENT" = auto ]; then
+    for c in dhclient udhcpc dhcpcd; do
+        if command -v $c >/dev/null 2>&1; then CLIENT=$c; break; fi
+    done
+fi
+mkdir -p /var/lib/dhcp
+cat > /tmp/ipocalypse-hook <<'HOOK'
+#!/bin/sh
+LEASES=/var/lib/dhcp/dhclient.leases
+case "$1$reason" in
+    deconfig)
+        ip addr flush dev "$interface"
+        ip link set "$interface" up
+        ;;
+    bound|renew)
+        if [ -n "$ipv6" ]; then
+            ip -6 addr add "$ipv6/128" dev "$interface" 2>/dev/null
+            printf 'lease6 {\n  ia-na {\n    iaaddr %s {\n    }\n  }\n}\n' "$ipv6" > $LEASES
+            exit 0
+        fi
+        ip addr flush dev "$interface"
+        ip addr add "$ip/$mask" dev "$interface"
+        for r in $router; do ip route add default via "$r" dev "$interface" 2>/dev/null; break; done
+        printf 'lease {\n  fixed-address %s;\n  option dhcp-lease-time %s;\n  option dhcp-server-identifier %s;\n  option domain-name-servers %s;\n}\n' "$ip" "$lease" "$serverid" "$(echo $dns | tr ' ' ,)" > $LEASES
+        ;;
+    BOUND|RENEW|REBIND|REBOOT)
+        printf 'lease {\n  fixed-address %s;\n  option dhcp-lease-time %s;\n  option dhcp-server-identifier %s;\n  option domain-name-servers %s;\n}\n' "$new_ip_address" "$new_dhcp_lease_time" "$new_dhcp_server_identifier" "$(echo $new_domain_name_servers | tr ' ' ,)" > $LEASES
+        ;;
+    BOUND6|RENEW6|REBIND6|REBOOT6)
+        printf 'lease6 {\n  ia-na {\n    iaaddr %s {\n    }\n  }\n}\n' "$new_dhcp6_ia_na1_ia_addr1" > $LEASES
+        ;;
+esac
+exit 0
+HOOK
+chmod +x /tmp/ipocalypse-hook
+ip link set "$IF" up
+UDHCPC_ID=${IPOCALYPSE_NO_CLIENT_ID:+-C}
+[ -n "$IPOCALYPSE_CLIENT_ID" ] && UDHCPC_ID="-x 0x3d:$(echo "$IPOCALYPSE_CLIENT_ID" | tr -d :)"
+case "$CLIENT" in
+    dhclient)
+        # The same settings the built-in image's entrypoint writes.
+        mkdir -p /etc/dhcp
+        CONF=/etc/dhcp/dhclient.conf
+        [ -n "$IPOCALYPSE_REQUESTED_IP" ] && echo "send dhcp-requested-address $IPOCALYPSE_REQUESTED_IP;" >> $CONF
+        [ -n "$IPOCALYPSE_CLIENT_ID" ] && echo "send dhcp-client-identifier $IPOCALYPSE_CLIENT_ID;" >> $CONF
+        [ -n "$IPOCALYPSE_HOSTNAME" ] && echo "send host-name \"$IPOCALYPSE_HOSTNAME\";" >> $CONF
+        [ -n "$IPOCALYPSE_VENDOR_CLASS" ] && echo "send vendor-class-identifier \"$IPOCALYPSE_VENDOR_CLASS\";" >> $CONF
+        [ -n "$IPOCALYPSE_PARAM_REQUEST" ] && echo "send dhcp-parameter-request-list $(echo "$IPOCALYPSE_PARAM_REQUEST" | sed 's/,/, /g');" >> $CONF
+        if [ -n "$IPOCALYPSE_DNS" ]; then
+            DNS_OPTION=domain-name-servers
+            [ -n "$IPOCALYPSE_DHCPV6" ] && DNS_OPTION=dhcp6.name-servers
+            echo "supersede $DNS_OPTION $(echo "$IPOCALYPSE_DNS" | sed 's/,/, /g');" >> $CONF
+        fi
+        [ -n "$IPOCALYPSE_NTP" ] && echo "supersede ntp-servers $(echo "$IPOCALYPSE_NTP" | sed 's/,/, /g');" >> $CONF
+        # Renewals stop and restart dhclient, so it cannot be the
+        # container's main process.
+        dhclient ${IPOCALYPSE_DHCPV6:+-6} "$IF"
+        exec sleep 2147483647 ;;
+    udhcpc)
+        [ -n "$IPOCALYPSE_DHCPV6" ] && CLIENT=udhcpc6
+        exec $CLIENT -f -i "$IF" -s /tmp/ipocalypse-hook ${IPOCALYPSE_REQUESTED_IP:+-r $IPOCALYPSE_REQUESTED_IP} ${IPOCALYPSE_HOSTNAME:+-x hostname:$IPOCALYPSE_HOSTNAME} $UDHCPC_ID ;;
+    dhcpcd)
+        exec dhcpcd -B ${IPOCALYPSE_DHCPV6:+-6} -c /tmp/ipocalypse-hook ${IPOCALYPSE_REQUESTED_IP:+-r $IPOCALYPSE_REQUESTED_IP} ${IPOCALYPSE_HOSTNAME:+-h $IPOCALYPSE_HOSTNAME} ${IPOCALYPSE_CLIENT_ID:+-I $IPOCALYPSE_CLIENT_ID} "$IF" ;;
+esac
+echo "no DHCP client found (looked for dhclient, udhcpc and dhcpcd)" >&2
+exit 1`
+
+// containerRelease releases the lease of the client in a container with
+// whichever DHCP client holds it.
+const containerRelease = `if pid=$(pidof udhcpc udhcpc6); then kill -USR2 $pid; elif pidof dhcpcd >/dev/null; then dhcpcd -k; else dhclient -r; fi`
+
+// containerRenew renews the lease of the client in a container: udhcpc, as
+// in the built-in image, renews on SIGUSR1 and dhcpcd on -n; ISC dhclient is
+// stopped without releasing and restarted, which requests the lease it
+// recorded.
+const containerRenew = `if pid=$(pidof udhcpc udhcpc6); then kill -USR1 $pid; elif pidof dhcpcd >/dev/null; then dhcpcd -n; else dhclient -x && dhclient -1 ${IPOCALYPSE_INTERFACE:-eth0}; fi`
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Client identifier modes accepted by -client-id. Any other value is a
+// template for a text identifier.
+const (
+	clientIDMAC  = "mac"
+	clientIDDUID = "duid"
+	clientIDNone = "none"
+)
+
+// clientIDGenerator builds the client identifier (option 61) each client
+// sends. Servers that key leases on it rather than on chaddr hand out one
+// lease per identifier, whatever the MAC.
+type clientIDGenerator struct {
+	mode string
+}
+
+func newClientIDGenerator(mode string) (*clientIDGenerator, error) {
+	if strings.TrimSpace(mode) == "" {
+		return nil, fmt.Errorf("-client-id must be mac, duid, none or a template")
+	}
+	return &clientIDGenerator{mode: mode}, nil
+}
+
+// next returns the identifier for a new client with mac, or nil when no
+// identifier is sent: type 1 followed by the MAC, an RFC 4361 identifier
+// with a random IAID and DUID-UUID, or type 0 followed by the expanded
+// template text.
+func (g *clientIDGenerator) next(mac net.HardwareAddr) []byte {
+	switch g.mode {
+	case clientIDNone:
+		return nil
+	case clientIDMAC:
+		return append([]byte{1}, mac...)
+	case clientIDDUID:
+		id := make([]byte, 1+4+2+16)
+		identityRand.Read(id)
+		id[0] = 0xff
+		// DUID type 4, a UUID.
+		id[5], id[6] = 0, 4
+		return id
+	}
+	return append([]byte{0}, expandHostname(g.mode)...)
+}
+
+// apply sets the spec's client identifier. The MAC identifier is left to
+// the client's own default, which it matches, unless the endpoint shares the
+// parent's MAC and needs it to be told apart.
+func (g *clientIDGenerator) apply(spec *launchSpec) {
+	switch {
+	case g.mode == clientIDNone:
+		spec.NoClientID = true
+	case g.mode != clientIDMAC || spec.SharedMAC:
+		spec.ClientID = g.next(spec.MAC)
+	}
+}
+
+// formatClientID writes an identifier as colon-separated hex, the form the
+// DHCP clients and lease exports take.
+func formatClientID(id []byte) string {
+	parts := make([]string, len(id))
+	for i, b := range id {
+		parts[i] = fmt.Sprintf("%02x", b)
+	}
+	return strings.Join(parts, ":")
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// Clock abstracts time access so launch timing can be driven by a virtual
+// clock instead of the wall clock.
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the Clock backed by the host's wall clock.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Since(t time.Time) time.Duration        { return time.Since(t) }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// clock is the time source used throughout the run.
+var clock Clock = realClock{}
+
+// manualClock is a Clock whose time only moves when told to, for driving
+// launch timing in virtual time: advance moves it forward and fires the
+// timers that came due, and Sleep advances it by the sleep instead of
+// blocking.
+type manualClock struct {
+	mu      sync.Mutex
+	changed *sync.Cond
+	now     time.Time
+	timers  []manualTimer
+}
+
+// manualTimer is a pending After of a manualClock.
+type manualTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newManualClock(now time.Time) *manualClock {
+	c := &manualClock{now: now}
+	c.changed = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *manualClock) Since(t time.Time) time.Duration { return c.Now().Sub(t) }
+
+func (c *manualClock) Sleep(d time.Duration) { c.advance(d) }
+
+func (c *manualClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.timers = append(c.timers, manualTimer{at: c.now.Add(d), ch: ch})
+	c.changed.Broadcast()
+	return ch
+}
+
+// advance moves the clock forward by d and fires the timers due by then.
+func (c *manualClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.ch <- c.now
+	}
+	c.timers = pending
+	c.changed.Broadcast()
+}
+
+// blockUntil waits until n timers are pending, i.e. the code driven by the
+// clock is waiting on it.
+func (c *manualClock) blockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.timers) < n {
+		c.changed.Wait()
+	}
+}
+
+// ntpEpochOffset is the number of seconds between the NTP epoch (1900) and the
+// Unix epoch (1970).
+const ntpEpochOffset = 2208988800
+
+// queryNTPOffset sends a single SNTP request to server and returns the
+// estimated offset of the local clock from the server's clock. A positive
+// offset means the local clock is behind. It measures the host clock itself,
+// not the run's clock, which may be virtual.
+func queryNTPOffset(server string, timeout time.Duration) (time.Duration, error) {
+	conn, err := net.DialTimeout("udp", net.JoinHostPort(server, "123"), timeout)
+	if err != nil {
+		return 0, fmt.Errorf("failed to contact NTP server %s: %v", server, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	req := make([]byte, 48)
+	req[0] = 0x1B // LI=0, VN=3, Mode=3 (client)
+	sent := time.Now()
+	if _, err := conn.Write(req); err != nil {
+		return 0, fmt.Errorf("failed to send NTP request: %v", err)
+	}
+	resp := make([]byte, 48)
+	if _, err := conn.Read(resp); err != nil {
+		return 0, fmt.Errorf("no NTP response from %s: %v", server, err)
+	}
+	received := time.Now()
+
+	serverRecv := ntpTime(resp[32:40])
+	serverSend := ntpTime(resp[40:48])
+	if serverSend.IsZero() {
+		return 0, fmt.Errorf("invalid NTP response from %s", server)
+	}
+	return (serverRecv.Sub(sent) + serverSend.Sub(received)) / 2, nil
+}
+
+// ntpTime converts a 64-bit NTP timestamp into a time.Time.
+func ntpTime(b []byte) time.Time {
+	secs := binary.BigEndian.Uint32(b[0:4])
+	frac := binary.BigEndian.Uint32(b[4:8])
+	if secs == 0 && frac == 0 {
+		return time.Time{}
+	}
+	nanos := (int64(frac) * 1e9) >> 32
+	return time.Unix(int64(secs)-ntpEpochOffset, nanos)
+}
+
+// checkClockSkew compares the host clock against an NTP server and warns when
+// the skew exceeds maxSkew, since a skewed host produces reports that cannot be
+// correlated with server logs. It never aborts the run.
+func checkClockSkew(server string, maxSkew time.Duration) {
+	offset, err := queryNTPOffset(server, 3*time.Second)
+	if err != nil {
+		slog.Warn("could not verify host clock", "error", err)
+		return
+	}
+	skew := offset
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > maxSkew {
+		slog.Warn("host clock is skewed; timestamps will not line up with server logs", "offset", offset.Round(time.Millisecond).String(), "server", server, "limit", maxSkew.String())
+		return
+	}
+	slog.Info("host clock verified", "skew", skew.Round(time.Millisecond).String(), "server", server)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// useManualClock makes the run's clock a manualClock for the test.
+func useManualClock(t *testing.T) *manualClock {
+	t.Helper()
+	c := newManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	saved := clock
+	clock = c
+	t.Cleanup(func() { clock = saved })
+	return c
+}
+
+func TestManualClock(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := newManualClock(start)
+
+	soon, later := c.After(time.Second), c.After(time.Minute)
+	c.advance(30 * time.Second)
+	select {
+	case at := <-soon:
+		if want := start.Add(30 * time.Second); !at.Equal(want) {
+			t.Errorf("timer fired at %v, want %v", at, want)
+		}
+	default:
+		t.Fatal("timer due after 1s did not fire after 30s")
+	}
+	select {
+	case <-later:
+		t.Fatal("timer due after 1m fired after 30s")
+	default:
+	}
+
+	c.Sleep(30 * time.Second)
+	select {
+	case <-later:
+	default:
+		t.Fatal("Sleep did not advance the clock to the 1m timer")
+	}
+	if got := c.Since(start); got != time.Minute {
+		t.Errorf("Since(start) = %v, want 1m", got)
+	}
+
+	select {
+	case <-c.After(0):
+	default:
+		t.Error("After(0) did not fire at once")
+	}
+}
+
+func TestManualClockBlockUntil(t *testing.T) {
+	c := newManualClock(time.Unix(0, 0))
+	done := make(chan struct{})
+	go func() {
+		<-c.After(time.Second)
+		close(done)
+	}()
+	c.blockUntil(1)
+	c.advance(time.Second)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiter was not released by advance")
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every run option that can be set from the command line or
+// from a -config file. Command-line flags always take precedence over values
+// loaded from the file.
+type Config struct {
+	// ConfigPath is the -config file the run was loaded from, re-read on
+	// SIGHUP.
+	ConfigPath string `yaml:"-" toml:"-"`
+
+	Scenario     string `yaml:"scenario" toml:"scenario"`
+	Mode         string `yaml:"mode" toml:"mode"`
+	WifiFallback string `yaml:"wifi_fallback" toml:"wifi_fallback"`
+	FuzzCases    int    `yaml:"fuzz_cases" toml:"fuzz_cases"`
+	PDLength     int    `yaml:"pd_length" toml:"pd_length"`
+
+	SimPool    string        `yaml:"sim_pool" toml:"sim_pool"`
+	SimLatency time.Duration `yaml:"sim_latency" toml:"sim_latency"`
+
+	Kubeconfig      string   `yaml:"kubeconfig" toml:"kubeconfig"`
+	K8sContext      string   `yaml:"k8s_context" toml:"k8s_context"`
+	K8sNamespace    string   `yaml:"k8s_namespace" toml:"k8s_namespace"`
+	K8sNetwork      string   `yaml:"k8s_network" toml:"k8s_network"`
+	K8sMaster       string   `yaml:"k8s_master" toml:"k8s_master"`
+	K8sNodeSelector []string `yaml:"k8s_node_selector" toml:"k8s_node_selector"`
+
+	Observe         bool          `yaml:"observe" toml:"observe"`
+	ObserveDuration time.Duration `yaml:"observe_duration" toml:"observe_duration"`
+	TrustedServers  []string      `yaml:"trusted_servers" toml:"trusted_servers"`
+	Force           bool          `yaml:"force" toml:"force"`
+	ARPSweep        bool          `yaml:"arp_sweep" toml:"arp_sweep"`
+	DryRun          bool          `yaml:"dry_run" toml:"dry_run"`
+	BaselineDir     string        `yaml:"baseline_dir" toml:"baseline_dir"`
+	Fingerprint     bool          `yaml:"fingerprint" toml:"fingerprint"`
+
+	Runtime          string        `yaml:"runtime" toml:"runtime"`
+	Host             string        `yaml:"host" toml:"host"`
+	HostSSH          string        `yaml:"host_ssh" toml:"host_ssh"`
+	TLSCA            string        `yaml:"tls_ca" toml:"tls_ca"`
+	TLSCert          string        `yaml:"tls_cert" toml:"tls_cert"`
+	TLSKey           string        `yaml:"tls_key" toml:"tls_key"`
+	Dockerfiles      []string      `yaml:"dockerfiles" toml:"dockerfiles"`
+	NoBuild          bool          `yaml:"no_build" toml:"no_build"`
+	Dockerfile       string        `yaml:"dockerfile" toml:"dockerfile"`
+	Images           []string      `yaml:"images" toml:"images"`
+	Strategy         string        `yaml:"strategy" toml:"strategy"`
+	Seed             int64         `yaml:"seed" toml:"seed"`
+	BuildWorkers     int           `yaml:"build_workers" toml:"build_workers"`
+	Platform         string        `yaml:"platform" toml:"platform"`
+	Builder          string        `yaml:"builder" toml:"builder"`
+	BuildSecrets     []string      `yaml:"build_secrets" toml:"build_secrets"`
+	Workers          int           `yaml:"workers" toml:"workers"`
+	Autoscale        bool          `yaml:"autoscale" toml:"autoscale"`
+	MaxWorkers       int           `yaml:"max_workers" toml:"max_workers"`
+	DHCPTimeout      time.Duration `yaml:"dhcp_timeout" toml:"dhcp_timeout"`
+	DHCPPollInterval time.Duration `yaml:"dhcp_poll_interval" toml:"dhcp_poll_interval"`
+	ExhaustAfter     int           `yaml:"exhaust_after" toml:"exhaust_after"`
+	MaxLeases        int           `yaml:"max_leases" toml:"max_leases"`
+	LaunchRate       float64       `yaml:"rate" toml:"rate"`
+	Ramp             string        `yaml:"ramp" toml:"ramp"`
+	ReserveFree      int           `yaml:"reserve_free" toml:"reserve_free"`
+	Churn            float64       `yaml:"churn" toml:"churn"`
+	ChurnInterval    time.Duration `yaml:"churn_interval" toml:"churn_interval"`
+	RenewInterval    time.Duration `yaml:"renew_interval" toml:"renew_interval"`
+	RenewWorkers     int           `yaml:"renew_workers" toml:"renew_workers"`
+	RenewRounds      int           `yaml:"renew_rounds" toml:"renew_rounds"`
+	RenewLeases      bool          `yaml:"renew_leases" toml:"renew_leases"`
+	LetExpire        float64       `yaml:"let_expire" toml:"let_expire"`
+	RetryInitial     time.Duration `yaml:"retry_initial" toml:"retry_initial"`
+	RetryMultiplier  float64       `yaml:"retry_multiplier" toml:"retry_multiplier"`
+	RetryMax         time.Duration `yaml:"retry_max" toml:"retry_max"`
+	RetryAttempts    int           `yaml:"retry_attempts" toml:"retry_attempts"`
+	RetryJitter      float64       `yaml:"retry_jitter" toml:"retry_jitter"`
+	LaunchInterval   time.Duration `yaml:"launch_interval" toml:"launch_interval"`
+	LaunchJitter     time.Duration `yaml:"launch_jitter" toml:"launch_jitter"`
+	LaunchStagger    time.Duration `yaml:"launch_stagger" toml:"launch_stagger"`
+
+	SpoofRelease        bool     `yaml:"spoof_release" toml:"spoof_release"`
+	SpoofReleaseExclude []string `yaml:"spoof_release_exclude" toml:"spoof_release_exclude"`
+
+	RogueServer    bool          `yaml:"rogue_server" toml:"rogue_server"`
+	RoguePool      string        `yaml:"rogue_pool" toml:"rogue_pool"`
+	RogueGateway   string        `yaml:"rogue_gateway" toml:"rogue_gateway"`
+	RogueDNS       []string      `yaml:"rogue_dns" toml:"rogue_dns"`
+	RogueLease     time.Duration `yaml:"rogue_lease" toml:"rogue_lease"`
+	RogueDuration  time.Duration `yaml:"rogue_duration" toml:"rogue_duration"`
+	IdentityChurn  int           `yaml:"identity_churn" toml:"identity_churn"`
+	ShrinkTest     bool          `yaml:"shrink_test" toml:"shrink_test"`
+	Internet       bool          `yaml:"internet" toml:"internet"`
+	Interface      string        `yaml:"interface" toml:"interface"`
+	Driver         string        `yaml:"driver" toml:"driver"`
+	DriverFallback string        `yaml:"driver_fallback" toml:"driver_fallback"`
+	NetworkName    string        `yaml:"network" toml:"network"`
+	VLAN           int           `yaml:"vlan" toml:"vlan"`
+	Networks       []string      `yaml:"networks" toml:"networks"`
+	IPv6           bool          `yaml:"ipv6" toml:"ipv6"`
+
+	ContainerMemory string  `yaml:"container_memory" toml:"container_memory"`
+	ContainerCPUs   float64 `yaml:"container_cpus" toml:"container_cpus"`
+	ReadOnly        bool    `yaml:"read_only" toml:"read_only"`
+
+	AddressOrder  string   `yaml:"address_order" toml:"address_order"`
+	MACPools      []string `yaml:"mac_pools" toml:"mac_pools"`
+	Profiles      []string `yaml:"profiles" toml:"profiles"`
+	Hostnames     []string `yaml:"hostnames" toml:"hostnames"`
+	HostnameWords string   `yaml:"hostname_words" toml:"hostname_words"`
+	ClientID      string   `yaml:"client_id" toml:"client_id"`
+
+	ClientDNS []string `yaml:"client_dns" toml:"client_dns"`
+	ClientNTP []string `yaml:"client_ntp" toml:"client_ntp"`
+
+	Traffic         []string      `yaml:"traffic" toml:"traffic"`
+	TrafficInterval time.Duration `yaml:"traffic_interval" toml:"traffic_interval"`
+
+	Announce         []string      `yaml:"announce" toml:"announce"`
+	AnnounceInterval time.Duration `yaml:"announce_interval" toml:"announce_interval"`
+	ARPKeepalive     time.Duration `yaml:"arp_keepalive" toml:"arp_keepalive"`
+
+	Server        string `yaml:"server" toml:"server"`
+	ServerUnicast bool   `yaml:"server_unicast" toml:"server_unicast"`
+
+	RelayServer    string `yaml:"relay_server" toml:"relay_server"`
+	RelayGIAddr    string `yaml:"relay_giaddr" toml:"relay_giaddr"`
+	RelayLink      string `yaml:"relay_link" toml:"relay_link"`
+	RelayCircuitID string `yaml:"relay_circuit_id" toml:"relay_circuit_id"`
+	RelayRemoteID  string `yaml:"relay_remote_id" toml:"relay_remote_id"`
+
+	DNSLoad       float64  `yaml:"dns_load" toml:"dns_load"`
+	DNSLoadNames  []string `yaml:"dns_load_names" toml:"dns_load_names"`
+	DNSLoadServer string   `yaml:"dns_load_server" toml:"dns_load_server"`
+
+	DHCPLatency     bool   `yaml:"dhcp_latency" toml:"dhcp_latency"`
+	DHCPLatencyFile string `yaml:"dhcp_latency_file" toml:"dhcp_latency_file"`
+	WatchServers    bool   `yaml:"watch_servers" toml:"watch_servers"`
+	DetectConflicts bool   `yaml:"detect_conflicts" toml:"detect_conflicts"`
+
+	SNMPSwitch    string        `yaml:"snmp_switch" toml:"snmp_switch"`
+	SNMPCommunity string        `yaml:"snmp_community" toml:"snmp_community"`
+	SNMPUser      string        `yaml:"snmp_user" toml:"snmp_user"`
+	SNMPAuthPass  string        `yaml:"snmp_auth_pass" toml:"snmp_auth_pass"`
+	SNMPPrivPass  string        `yaml:"snmp_priv_pass" toml:"snmp_priv_pass"`
+	SNMPPort      string        `yaml:"snmp_port" toml:"snmp_port"`
+	SNMPInterval  time.Duration `yaml:"snmp_interval" toml:"snmp_interval"`
+	SNMPCounters  []string      `yaml:"snmp_counters" toml:"snmp_counters"`
+	SNMPLog       string        `yaml:"snmp_log" toml:"snmp_log"`
+
+	DHCPClient      string `yaml:"dhcp_client" toml:"dhcp_client"`
+	ClientInterface string `yaml:"client_interface" toml:"client_interface"`
+
+	StatusInterval time.Duration `yaml:"status_interval" toml:"status_interval"`
+	MetricsAddr    string        `yaml:"metrics" toml:"metrics"`
+	ListenAddr     string        `yaml:"listen" toml:"listen"`
+	GRPCListen     string        `yaml:"grpc_listen" toml:"grpc_listen"`
+	GRPCTLSCert    string        `yaml:"grpc_tls_cert" toml:"grpc_tls_cert"`
+	GRPCTLSKey     string        `yaml:"grpc_tls_key" toml:"grpc_tls_key"`
+	GRPCClientCA   string        `yaml:"grpc_client_ca" toml:"grpc_client_ca"`
+	GRPCReflection bool          `yaml:"grpc_reflection" toml:"grpc_reflection"`
+	LeaseExport    string        `yaml:"lease_export" toml:"lease_export"`
+	Report         string        `yaml:"report" toml:"report"`
+	ResultsDB      string        `yaml:"results_db" toml:"results_db"`
+	ResultsLabel   string        `yaml:"results_label" toml:"results_label"`
+	ReleaseOnExit  bool          `yaml:"release_on_exit" toml:"release_on_exit"`
+	StateFile      string        `yaml:"state_file" toml:"state_file"`
+	ContainerLogs  string        `yaml:"container_logs" toml:"container_logs"`
+	Orphans        string        `yaml:"orphans" toml:"orphans"`
+	PruneImages    bool          `yaml:"prune_images" toml:"prune_images"`
+	Wait           bool          `yaml:"wait" toml:"wait"`
+	StartAt        string        `yaml:"start_at" toml:"start_at"`
+	Schedule       string        `yaml:"schedule" toml:"schedule"`
+	Window         time.Duration `yaml:"window" toml:"window"`
+	PCAP           string        `yaml:"pcap" toml:"pcap"`
+
+	EngagementID  string `yaml:"engagement_id" toml:"engagement_id"`
+	Operator      string `yaml:"operator" toml:"operator"`
+	IAmAuthorized bool   `yaml:"i_am_authorized" toml:"i_am_authorized"`
+	AuditLog      string `yaml:"audit_log" toml:"audit_log"`
+
+	NTPServer    string        `yaml:"ntp_server" toml:"ntp_server"`
+	MaxClockSkew time.Duration `yaml:"max_clock_skew" toml:"max_clock_skew"`
+
+	LogFormat    string   `yaml:"log_format" toml:"log_format"`
+	Output       string   `yaml:"output" toml:"output"`
+	Quiet        bool     `yaml:"quiet" toml:"quiet"`
+	LogSinks     []string `yaml:"log_sinks" toml:"log_sinks"`
+	OTLPEndpoint string   `yaml:"otlp_endpoint" toml:"otlp_endpoint"`
+	Verbose      bool     `yaml:"verbose" toml:"verbose"`
+	LogLevel     string   `yaml:"log_level" toml:"log_level"`
+	TUI          bool     `yaml:"tui" toml:"tui"`
+	Progress     bool     `yaml:"progress" toml:"progress"`
+}
+
+// defaultConfig returns the configuration used when neither flags nor a config
+// file override a setting.
+func defaultConfig() Config {
+	return Config{
+		Scenario:         scenarioStarvation,
+		Mode:             modeDocker,
+		WifiFallback:     modeRaw,
+		FuzzCases:        50,
+		SimPool:          "192.0.2.0/24",
+		SimLatency:       100 * time.Millisecond,
+		ObserveDuration:  time.Minute,
+		BaselineDir:      "baselines",
+		Fingerprint:      true,
+		Runtime:          runtimeAuto,
+		Driver:           driverMacvlan,
+		DriverFallback:   "refuse",
+		NetworkName:      "ipocalypse_net",
+		Workers:          5,
+		MaxWorkers:       50,
+		BuildWorkers:     4,
+		Dockerfile:       "Dockerfile",
+		Builder:          builderAuto,
+		Strategy:         strategyRandom,
+		DHCPClient:       dhcpClientAuto,
+		ClientID:         clientIDMAC,
+		ClientInterface:  "eth0",
+		DHCPTimeout:      30 * time.Second,
+		DHCPPollInterval: 500 * time.Millisecond,
+		ExhaustAfter:     3,
+		ChurnInterval:    time.Minute,
+		RenewWorkers:     20,
+		RenewRounds:      10,
+		RetryInitial:     2 * time.Second,
+		RetryMultiplier:  2,
+		RetryMax:         30 * time.Second,
+		RetryAttempts:    10,
+		RetryJitter:      0.2,
+		LaunchInterval:   time.Second,
+		RogueLease:       10 * time.Minute,
+		RogueDuration:    10 * time.Minute,
+		AddressOrder:     orderNone,
+		StatusInterval:   30 * time.Second,
+		LeaseExport:      "leases",
+		TrafficInterval:  30 * time.Second,
+		AnnounceInterval: time.Minute,
+		DHCPLatencyFile:  "dhcp-latency.csv",
+		WatchServers:     true,
+		DetectConflicts:  true,
+		SNMPCommunity:    "public",
+		SNMPInterval:     10 * time.Second,
+		StateFile:        "ipocalypse-state.json",
+		AuditLog:         "ipocalypse-audit.log",
+		Orphans:          orphansAsk,
+		MaxClockSkew:     time.Second,
+		LogFormat:        logFormatText,
+		Output:           outputText,
+		LogLevel:         "info",
+	}
+}
+
+// loadConfig reads a YAML or TOML config file into cfg. The format is chosen by
+// file extension; keys missing from the file leave the existing values intact.
+func loadConfig(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return fmt.Errorf("failed to parse YAML config %s: %v", path, err)
+		}
+	case ".toml":
+		if _, err := toml.Decode(string(data), cfg); err != nil {
+			return fmt.Errorf("failed to parse TOML config %s: %v", path, err)
+		}
+	default:
+		return fmt.Errorf("unsupported config file extension %q (use .yaml, .yml or .toml)", filepath.Ext(path))
+	}
+	return nil
+}
+
+// stringList is a flag.Value for comma-separated lists. Setting it replaces the
+// previous contents so a command-line flag overrides a list from the config file.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*s = append(*s, item)
+		}
+	}
+	return nil
+}
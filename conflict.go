@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timing of the ARP probes sent for each new lease, after RFC 5227: a few
+// probes a little apart, then a wait for any answer.
+const (
+	conflictProbes        = 3
+	conflictProbeInterval = 200 * time.Millisecond
+	conflictWait          = time.Second
+)
+
+// ipConflict is a leased address another host also claims.
+type ipConflict struct {
+	IP        string
+	ClientMAC string
+	// MACs are the other claimants: hosts answering ARP for the address,
+	// or clients of the run leased the same address.
+	MACs      []string
+	Duplicate bool
+}
+
+// conflictCheck ARP-probes every address the run leases and flags those
+// another host answers for. A DHCP server handing out addresses that are in
+// use, typically because it stops checking under pressure, is exactly the
+// failure a starvation test looks for. It also flags an address leased to
+// two of the run's clients at once.
+type conflictCheck struct {
+	conn   *packetConn
+	leases *leaseTable
+	// ignore are MACs whose answers are not conflicts: the host's own, which
+	// ipvlan clients share.
+	ignore []string
+
+	mu sync.Mutex
+	// probing maps the addresses being probed to the MACs answering.
+	probing   map[string][]string
+	conflicts []ipConflict
+	checked   int
+}
+
+// newConflictCheck opens the ARP capture on netCfg's parent interface. It
+// returns nil when disabled.
+func newConflictCheck(enabled bool, netCfg *NetworkConfig, leases *leaseTable) (*conflictCheck, error) {
+	if !enabled {
+		return nil, nil
+	}
+	conn, err := openPacketConn(netCfg.Parent, etherTypeARP)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.setReadTimeout(200 * time.Millisecond); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to set socket timeout: %v", err)
+	}
+	return &conflictCheck{conn: conn, leases: leases, ignore: []string{conn.iface.HardwareAddr.String()}, probing: make(map[string][]string)}, nil
+}
+
+// run collects the ARP answers for the addresses being probed until ctx is
+// done.
+func (c *conflictCheck) run(ctx context.Context) {
+	if c == nil {
+		return
+	}
+	defer c.conn.Close()
+	buf := make([]byte, 1514)
+	for ctx.Err() == nil {
+		n, err := c.conn.readFrame(buf)
+		if err != nil || n < 42 {
+			continue
+		}
+		arp := buf[14:n]
+		// Replies, and the probes and announcements of a host defending or
+		// claiming the address, all carry it as the sender.
+		sender := net.IP(arp[14:18]).String()
+		mac := net.HardwareAddr(arp[8:14]).String()
+		c.mu.Lock()
+		if macs, ok := c.probing[sender]; ok && !slices.Contains(macs, mac) {
+			c.probing[sender] = append(macs, mac)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// check probes ip, just leased by the client with clientMAC, in the
+// background. A nil check does nothing.
+func (c *conflictCheck) check(ctx context.Context, ip, clientMAC string) {
+	if c == nil {
+		return
+	}
+	addr := net.ParseIP(ip).To4()
+	if addr == nil {
+		return
+	}
+	go func() {
+		c.mu.Lock()
+		c.probing[ip] = nil
+		c.mu.Unlock()
+		// RFC 5227 probes come from 0.0.0.0, so they do not disturb the ARP
+		// caches of the hosts they reach.
+		probe := buildARPRequest(c.conn.iface.HardwareAddr, net.IPv4zero, addr)
+		for i := 0; i < conflictProbes && ctx.Err() == nil; i++ {
+			if err := c.conn.writeFrame(probe); err != nil {
+				slog.Warn("failed to send ARP probe", "ip", ip, "error", err)
+				break
+			}
+			clock.Sleep(conflictProbeInterval)
+		}
+		clock.Sleep(conflictWait)
+
+		c.mu.Lock()
+		answers := c.probing[ip]
+		delete(c.probing, ip)
+		c.mu.Unlock()
+		conflict := ipConflict{IP: ip, ClientMAC: clientMAC}
+		for _, mac := range answers {
+			if !strings.EqualFold(mac, clientMAC) && !slices.Contains(c.ignore, mac) {
+				conflict.MACs = append(conflict.MACs, mac)
+			}
+		}
+		for _, r := range c.leases.held() {
+			if r.IP == ip && !strings.EqualFold(r.MAC, clientMAC) {
+				conflict.MACs = append(conflict.MACs, r.MAC)
+				conflict.Duplicate = true
+			}
+		}
+		c.record(conflict)
+	}()
+}
+
+// record counts one probed lease and flags it when it conflicts.
+func (c *conflictCheck) record(conflict ipConflict) {
+	c.mu.Lock()
+	c.checked++
+	if len(conflict.MACs) == 0 {
+		c.mu.Unlock()
+		return
+	}
+	c.conflicts = append(c.conflicts, conflict)
+	c.mu.Unlock()
+	c.leases.markConflict(conflict.IP, conflict.ClientMAC, conflict.MACs)
+	slog.Warn("leased address is already in use", "ip", conflict.IP, "client_mac", conflict.ClientMAC, "claimed_by", strings.Join(conflict.MACs, ","), "duplicate_lease", conflict.Duplicate)
+	events.emit("ip_conflict", map[string]any{"ip": conflict.IP, "mac": conflict.ClientMAC, "claimed_by": conflict.MACs, "duplicate_lease": conflict.Duplicate})
+}
+
+// printSummary reports the conflicts found. A nil check prints nothing.
+func (c *conflictCheck) printSummary() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Printf("IP conflicts:      %d of %d leases probed were already in use\n", len(c.conflicts), c.checked)
+	for _, conflict := range c.conflicts {
+		kind := "answers ARP"
+		if conflict.Duplicate {
+			kind = "leased twice"
+		}
+		fmt.Printf("  %-15s leased to %s, also claimed by %s  [%s]\n", conflict.IP, conflict.ClientMAC, strings.Join(conflict.MACs, ","), kind)
+	}
+	if len(c.conflicts) > 0 {
+		fmt.Println("Warning: the DHCP server handed out addresses that were in use")
+	}
+}
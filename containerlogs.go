@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// containerLogs keeps the output of every client container, its DHCP
+// client's included, in a directory of the run with one file per container,
+// so a client that got no lease shows whether its DHCP client ran at all.
+type containerLogs struct {
+	cli containerRuntime
+	dir string
+}
+
+// newContainerLogs creates the run's directory under dir, named after the
+// run ID. It returns nil when dir is empty.
+func newContainerLogs(cli containerRuntime, dir string) (*containerLogs, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	dir = filepath.Join(dir, runID)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create container log directory: %v", err)
+	}
+	return &containerLogs{cli: cli, dir: dir}, nil
+}
+
+// path returns the log file of a container, or "" without log collection.
+func (l *containerLogs) path(containerID string) string {
+	if l == nil || containerID == "" {
+		return ""
+	}
+	return filepath.Join(l.dir, shortID(containerID)+".log")
+}
+
+// saved returns the log file of a container if one was written, or "".
+func (l *containerLogs) saved(containerID string) string {
+	path := l.path(containerID)
+	if path == "" {
+		return ""
+	}
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// follow streams a container's output to its file in the background, from
+// its start until the container stops or is removed.
+func (l *containerLogs) follow(containerID string) {
+	if l == nil {
+		return
+	}
+	go func() {
+		if err := l.copy(context.Background(), containerID, true); err != nil {
+			slog.Warn("container log collection failed", "container", shortID(containerID), "error", err)
+		}
+	}()
+}
+
+// collect writes what a container has output so far to its file, before a
+// failed launch removes it.
+func (l *containerLogs) collect(ctx context.Context, containerID string) {
+	if l == nil {
+		return
+	}
+	if err := l.copy(ctx, containerID, false); err != nil {
+		slog.Warn("container log collection failed", "container", shortID(containerID), "error", err)
+	}
+}
+
+func (l *containerLogs) copy(ctx context.Context, containerID string, follow bool) error {
+	rc, err := l.cli.ContainerLogs(ctx, containerID, container.LogsOptions{ShowStdout: true, ShowStderr: true, Timestamps: true, Follow: follow})
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	f, err := os.Create(l.path(containerID))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// Client containers run without a TTY, so stdout and stderr come
+	// multiplexed; both go to the one file, in order.
+	if _, err := stdcopy.StdCopy(f, f, rc); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// runControl owns a run's launch workers so they can be steered while the run
+// is in progress: paused, resumed, scaled and stopped.
+type runControl struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	worker func(ctx context.Context, workerID int)
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	paused  bool
+	resumed chan struct{}
+	target  int
+	active  map[int]bool
+
+	// teardown, when set, removes what the run created; it is only
+	// available in docker mode.
+	teardown func() []teardownResult
+	// budget is the run's lease cap and launch rate, adjustable while the
+	// run is in progress.
+	budget *leaseBudget
+}
+
+func newRunControl(ctx context.Context, cancel context.CancelFunc, worker func(ctx context.Context, workerID int)) *runControl {
+	return &runControl{ctx: ctx, cancel: cancel, worker: worker, active: make(map[int]bool)}
+}
+
+// setWorkers changes the number of launch workers. Missing workers start
+// immediately; surplus workers exit after their current launch.
+func (c *runControl) setWorkers(n int) error {
+	if n < 0 {
+		return fmt.Errorf("worker count must not be negative")
+	}
+	if c.ctx.Err() != nil {
+		return fmt.Errorf("run has stopped")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.target = n
+	for id := 0; id < n; id++ {
+		if c.active[id] {
+			continue
+		}
+		c.active[id] = true
+		c.wg.Add(1)
+		go func(id int) {
+			defer c.wg.Done()
+			defer c.exited(id)
+			c.worker(c.ctx, id)
+		}(id)
+	}
+	return nil
+}
+
+// workers returns the number of launch workers the run is set to.
+func (c *runControl) workers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.target
+}
+
+func (c *runControl) exited(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.active, id)
+}
+
+// retired reports whether a worker should exit because the worker count was
+// lowered below its id.
+func (c *runControl) retired(id int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return id >= c.target
+}
+
+// pause stops workers from starting new launches; resume lets them continue.
+func (c *runControl) pause() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.paused {
+		c.paused = true
+		c.resumed = make(chan struct{})
+	}
+}
+
+func (c *runControl) resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.paused {
+		c.paused = false
+		close(c.resumed)
+	}
+}
+
+// togglePause pauses launching if it is running and resumes it if it is
+// paused, and reports whether it is paused now.
+func (c *runControl) togglePause() bool {
+	c.mu.Lock()
+	paused := c.paused
+	c.mu.Unlock()
+	if paused {
+		c.resume()
+	} else {
+		c.pause()
+	}
+	return !paused
+}
+
+// pauseOnSignal pauses and resumes launching on SIGUSR1, so an operator asked
+// to hold the run where it is can do so from a shell without the control
+// API. Held leases and clients are left alone.
+func pauseOnSignal(ctl *runControl) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	go func() {
+		for range sigs {
+			if ctl.togglePause() {
+				slog.Info("launching paused via SIGUSR1, send it again to resume")
+			} else {
+				slog.Info("launching resumed via SIGUSR1")
+			}
+		}
+	}()
+}
+
+// wait blocks while launching is paused.
+func (c *runControl) wait(ctx context.Context) {
+	c.mu.Lock()
+	paused, resumed := c.paused, c.resumed
+	c.mu.Unlock()
+	if !paused {
+		return
+	}
+	select {
+	case <-resumed:
+	case <-ctx.Done():
+	}
+}
+
+// stop cancels the run and waits for every worker to exit.
+func (c *runControl) stop() {
+	c.cancel()
+	c.wg.Wait()
+}
+
+// setBudget changes the lease cap and launch rate. A cap the run has already
+// met stops it.
+func (c *runControl) setBudget(maxLeases int, rate float64) error {
+	reached, err := c.budget.set(maxLeases, rate)
+	if err != nil {
+		return err
+	}
+	if reached {
+		slog.Info("lease budget reached, stopping launches", "budget", c.budget.String())
+		c.cancel()
+	}
+	return nil
+}
+
+// state reports whether the run is running, paused or stopped, and how many
+// workers it has.
+func (c *runControl) state() (string, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case c.ctx.Err() != nil:
+		return "stopped", len(c.active)
+	case c.paused:
+		return "paused", len(c.active)
+	default:
+		return "running", len(c.active)
+	}
+}
+
+// serveControl exposes the HTTP control API on addr:
+//
+//	GET  /status    run state, worker count and counters
+//	POST /pause     stop starting new launches
+//	POST /resume    continue launching
+//	POST /stop      stop launching for good, keeping the leases held
+//	POST /workers   set the worker count (?count=N, at most maxWorkers)
+//	GET  /budget    lease cap and launch rate
+//	POST /budget    change them (?max_leases=N&rate=R, either may be omitted)
+//	GET  /leases    leases acquired so far (?format=csv for CSV)
+//	POST /leases/export  write the lease table files now
+//	GET  /notes     operator notes attached to the run
+//	POST /notes     attach a note ({"text": "..."})
+//	POST /teardown  stop the run and remove everything it created
+//
+// With IPOCALYPSE_CONTROL_TOKEN set, every request must carry it; without
+// it, requests that change the run must carry controlHeader.
+func serveControl(addr string, ctl *runControl, stats *runStats, leases *leaseTable, exportPrefix string, maxWorkers int) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		state, workers := ctl.state()
+		launched, leased, perMinute := stats.launchRate()
+		breakdown := stats.breakdown()
+		writeJSON(w, http.StatusOK, map[string]any{
+			"state":            state,
+			"workers":          workers,
+			"clients_launched": launched,
+			"leases_acquired":  leased,
+			"launches_per_min": perMinute,
+			"exhausted":        stats.isExhausted(),
+			"status":           stats.statusLine(),
+			"by_worker":        breakdown["by_worker"],
+			"by_image":         breakdown["by_image"],
+			"by_profile":       breakdown["by_profile"],
+		})
+	})
+	mux.HandleFunc("POST /pause", func(w http.ResponseWriter, r *http.Request) {
+		ctl.pause()
+		slog.Info("launching paused via control API")
+		writeJSON(w, http.StatusOK, map[string]string{"state": "paused"})
+	})
+	mux.HandleFunc("POST /resume", func(w http.ResponseWriter, r *http.Request) {
+		ctl.resume()
+		slog.Info("launching resumed via control API")
+		writeJSON(w, http.StatusOK, map[string]string{"state": "running"})
+	})
+	mux.HandleFunc("POST /stop", func(w http.ResponseWriter, r *http.Request) {
+		slog.Info("launching stopped via control API")
+		ctl.cancel()
+		writeJSON(w, http.StatusOK, map[string]string{"state": "stopped"})
+	})
+	mux.HandleFunc("POST /workers", func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(r.URL.Query().Get("count"))
+		if err == nil && n > maxWorkers {
+			err = fmt.Errorf("at most %d workers", maxWorkers)
+		}
+		if err == nil {
+			err = ctl.setWorkers(n)
+		}
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid worker count: %v", err)})
+			return
+		}
+		slog.Info("worker count changed via control API", "workers", n)
+		writeJSON(w, http.StatusOK, map[string]int{"workers": n})
+	})
+	mux.HandleFunc("GET /budget", func(w http.ResponseWriter, r *http.Request) {
+		maxLeases, rate := ctl.budget.limits()
+		writeJSON(w, http.StatusOK, map[string]any{"max_leases": maxLeases, "rate": rate})
+	})
+	mux.HandleFunc("POST /budget", func(w http.ResponseWriter, r *http.Request) {
+		maxLeases, rate := ctl.budget.limits()
+		var err error
+		if v := r.URL.Query().Get("max_leases"); v != "" {
+			maxLeases, err = strconv.Atoi(v)
+		}
+		if v := r.URL.Query().Get("rate"); v != "" && err == nil {
+			rate, err = strconv.ParseFloat(v, 64)
+		}
+		if err == nil {
+			err = ctl.setBudget(maxLeases, rate)
+		}
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid budget: %v", err)})
+			return
+		}
+		slog.Info("lease budget changed via control API", "budget", ctl.budget.String())
+		writeJSON(w, http.StatusOK, map[string]any{"max_leases": maxLeases, "rate": rate})
+	})
+	mux.HandleFunc("GET /leases", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("format") == "csv" {
+			w.Header().Set("Content-Type", "text/csv")
+			leases.writeCSV(w)
+			return
+		}
+		writeJSON(w, http.StatusOK, leases.snapshot())
+	})
+	mux.HandleFunc("POST /leases/export", func(w http.ResponseWriter, r *http.Request) {
+		if exportPrefix == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "lease export is disabled (-lease-export is empty)"})
+			return
+		}
+		if err := leases.export(exportPrefix); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"csv": exportPrefix + ".csv", "json": exportPrefix + ".json"})
+	})
+	mux.HandleFunc("GET /notes", func(w http.ResponseWriter, r *http.Request) {
+		stats.mu.Lock()
+		notes := append([]operatorNote{}, stats.notes...)
+		stats.mu.Unlock()
+		writeJSON(w, http.StatusOK, notes)
+	})
+	mux.HandleFunc("POST /notes", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Text string `json:"text"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxControlBody)).Decode(&req); err != nil || strings.TrimSpace(req.Text) == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "expected a JSON body with a non-empty text field"})
+			return
+		}
+		note := stats.recordNote(strings.TrimSpace(req.Text))
+		slog.Info("operator note", "note", note.Text)
+		writeJSON(w, http.StatusOK, note)
+	})
+	mux.HandleFunc("POST /teardown", func(w http.ResponseWriter, r *http.Request) {
+		if ctl.teardown == nil {
+			writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "teardown is only available in docker mode"})
+			return
+		}
+		slog.Info("teardown requested via control API")
+		ctl.stop()
+		type stepResult struct {
+			Step  string `json:"step"`
+			Note  string `json:"note,omitempty"`
+			Error string `json:"error,omitempty"`
+		}
+		var steps []stepResult
+		status := http.StatusOK
+		for _, res := range ctl.teardown() {
+			step := stepResult{Step: res.Step, Note: res.Note}
+			if res.Err != nil {
+				step.Error = res.Err.Error()
+				status = http.StatusInternalServerError
+			}
+			steps = append(steps, step)
+		}
+		writeJSON(w, status, steps)
+	})
+
+	fmt.Printf("Serving control API on http://%s\n", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, requireToken(mux)); err != nil {
+			slog.Error("control API stopped", "error", err)
+		}
+	}()
+}
+
+// controlTokenEnv names the variable holding the shared token the control
+// API, the service API and the gRPC control plane require, and that the
+// subcommands calling them send. It is read from the environment only, so
+// it stays out of process listings, config files and reports.
+const controlTokenEnv = "IPOCALYPSE_CONTROL_TOKEN"
+
+func controlToken() string {
+	return os.Getenv(controlTokenEnv)
+}
+
+// controlListenAddr resolves a -listen or -grpc-listen address. A bare port
+// such as :8080 binds the loopback interface; any other non-loopback
+// address needs the shared token, or clientCerts, as whoever reaches the
+// API can start, rescale and tear down runs.
+func controlListenAddr(addr string, clientCerts bool) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid listen address %q: %v", addr, err)
+	}
+	if host == "" {
+		return net.JoinHostPort("127.0.0.1", port), nil
+	}
+	if loopbackHost(host) {
+		return addr, nil
+	}
+	if controlToken() == "" && !clientCerts {
+		return "", fmt.Errorf("%s is not a loopback address; set %s to a shared token to serve the API on it", addr, controlTokenEnv)
+	}
+	return addr, nil
+}
+
+// controlHeader must be sent with requests that change a run when no shared
+// token is set. A web page cannot send it cross-site without a CORS
+// preflight, which the APIs do not answer, so it cannot drive a run through
+// an API on 127.0.0.1; the subcommands calling the APIs always send it.
+const controlHeader = "X-Ipocalypse-Control"
+
+// maxControlBody caps the request bodies the APIs read.
+const maxControlBody = 64 << 10
+
+// loopbackHost reports whether host, with or without a port, is localhost
+// or a loopback address.
+func loopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	return host == "localhost" || ip != nil && ip.IsLoopback()
+}
+
+// requireToken answers requests without the shared token as a bearer
+// token with 401, and passes the rest to h. Without a token set, the API
+// listens on loopback only: requests must then name a loopback host, which
+// pages that rebind their DNS name to 127.0.0.1 do not, and any request but
+// GET and HEAD must carry controlHeader.
+func requireToken(h http.Handler) http.Handler {
+	token := controlToken()
+	if token == "" {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !loopbackHost(r.Host) {
+				writeJSON(w, http.StatusForbidden, map[string]string{"error": fmt.Sprintf("without %s, requests must be made to a loopback address", controlTokenEnv)})
+				return
+			}
+			if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Header.Get(controlHeader) == "" {
+				writeJSON(w, http.StatusForbidden, map[string]string{"error": fmt.Sprintf("requests that change the run need the %s header", controlHeader)})
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "missing or wrong control token"})
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// newControlRequest is http.NewRequestWithContext for a control API,
+// adding the shared token when one is set.
+func newControlRequest(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if token := controlToken(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set(controlHeader, "1")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string
+		method string
+		host   string
+		header map[string]string
+		want   int
+	}{
+		{"read without header", "", http.MethodGet, "127.0.0.1:8080", nil, http.StatusOK},
+		{"change without header", "", http.MethodPost, "127.0.0.1:8080", nil, http.StatusForbidden},
+		{"form post from a page", "", http.MethodPost, "localhost:8080", map[string]string{"Content-Type": "text/plain"}, http.StatusForbidden},
+		{"change with header", "", http.MethodPost, "localhost:8080", map[string]string{controlHeader: "1"}, http.StatusOK},
+		{"rebound name", "", http.MethodGet, "attacker.example:8080", map[string]string{controlHeader: "1"}, http.StatusForbidden},
+		{"no token", "s3cret", http.MethodGet, "10.0.0.5:8080", nil, http.StatusUnauthorized},
+		{"wrong token", "s3cret", http.MethodPost, "10.0.0.5:8080", map[string]string{"Authorization": "Bearer guess"}, http.StatusUnauthorized},
+		{"token", "s3cret", http.MethodPost, "10.0.0.5:8080", map[string]string{"Authorization": "Bearer s3cret"}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(controlTokenEnv, tt.token)
+			h := requireToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			req := httptest.NewRequest(tt.method, "/stop", nil)
+			req.Host = tt.host
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("%s %s on %s = %d, want %d", tt.method, req.URL.Path, tt.host, rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestControlListenAddr(t *testing.T) {
+	tests := []struct {
+		addr        string
+		token       string
+		clientCerts bool
+		want        string
+		wantErr     bool
+	}{
+		{":8080", "", false, "127.0.0.1:8080", false},
+		{"localhost:8080", "", false, "localhost:8080", false},
+		{"[::1]:8080", "", false, "[::1]:8080", false},
+		{"10.0.0.5:8080", "", false, "", true},
+		{"0.0.0.0:8080", "", false, "", true},
+		{"10.0.0.5:8080", "s3cret", false, "10.0.0.5:8080", false},
+		{"10.0.0.5:9090", "", true, "10.0.0.5:9090", false},
+		{"8080", "", false, "", true},
+	}
+	for _, tt := range tests {
+		t.Setenv(controlTokenEnv, tt.token)
+		got, err := controlListenAddr(tt.addr, tt.clientCerts)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("controlListenAddr(%q, %v) with token %q = %q, %v; want %q, error %v", tt.addr, tt.clientCerts, tt.token, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// agentStatus is an agent's GET /status answer, or the error reaching it.
+type agentStatus struct {
+	Addr      string  `json:"-"`
+	State     string  `json:"state"`
+	Workers   int     `json:"workers"`
+	Launched  int     `json:"clients_launched"`
+	Leased    int     `json:"leases_acquired"`
+	PerMinute float64 `json:"launches_per_min"`
+	Exhausted bool    `json:"exhausted"`
+	Err       error   `json:"-"`
+}
+
+// agentLostPolls is how many polls in a row an agent that answered before
+// may miss before it is taken to have exited.
+const agentLostPolls = 3
+
+// coordinatorClient bounds every request to an agent so one unreachable host
+// does not stall the others.
+var coordinatorClient = &http.Client{Timeout: 5 * time.Second}
+
+// runCoordinate implements the coordinate subcommand. Agents are ordinary
+// runs started with -listen on hosts attached to different switch ports; the
+// coordinator polls their control APIs, prints the combined lease count and
+// stops every agent once one of them finds the pool exhausted, the combined
+// lease cap is met or the coordinator is interrupted.
+func runCoordinate(args []string) {
+	fs := flag.NewFlagSet("coordinate", flag.ExitOnError)
+	var agents stringList
+	fs.Var(&agents, "agents", "Comma-separated control API addresses (host:port) of the agents")
+	interval := fs.Duration("interval", 5*time.Second, "How often the agents are polled")
+	maxLeases := fs.Int("max-leases", 0, "Stop every agent once they hold this many leases together (0 runs until exhaustion)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage:
+  ./ipocalypse coordinate -agents host:port,... [-interval 5s] [-max-leases N]
+
+Orchestrates several ipocalypse runs (agents), each started with -listen on
+its own host, e.g. on 10.0.0.5 and 10.0.0.6:
+  sudo ./ipocalypse -listen 0.0.0.0:8080
+  ./ipocalypse coordinate -agents 10.0.0.5:8080,10.0.0.6:8080
+
+Options:
+`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if len(agents) == 0 || *interval <= 0 || *maxLeases < 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	fmt.Printf("Coordinating %d agents\n", len(agents))
+
+	// last keeps each agent's latest answer; an agent that stops answering
+	// for agentLostPolls polls in a row is taken to have exited, which
+	// raw-mode agents do once they stop.
+	last := make(map[string]agentStatus)
+	misses := make(map[string]int)
+	reason := ""
+	for reason == "" {
+		total, up, running := 0, 0, 0
+		var parts []string
+		for _, s := range pollAgents(agents) {
+			if s.Err != nil {
+				misses[s.Addr]++
+				prev, seen := last[s.Addr]
+				switch {
+				case seen && misses[s.Addr] >= agentLostPolls:
+					if prev.State != "exited" && reason == "" {
+						reason = s.Addr + " exited"
+					}
+					prev.State = "exited"
+					last[s.Addr] = prev
+					total += prev.Leased
+					parts = append(parts, fmt.Sprintf("%s %d (exited)", s.Addr, prev.Leased))
+				case seen:
+					total += prev.Leased
+					running++
+					parts = append(parts, fmt.Sprintf("%s %d (not answering)", s.Addr, prev.Leased))
+				default:
+					parts = append(parts, s.Addr+" unreachable")
+				}
+				continue
+			}
+			misses[s.Addr] = 0
+			last[s.Addr] = s
+			up++
+			total += s.Leased
+			if s.State != "stopped" {
+				running++
+			}
+			parts = append(parts, fmt.Sprintf("%s %d", s.Addr, s.Leased))
+			if s.Exhausted && reason == "" {
+				reason = "pool exhausted at " + s.Addr
+			}
+		}
+		fmt.Printf("[%s] %d/%d agents up, %d leases (%s)\n", clock.Now().Format("15:04:05"), up, len(agents), total, strings.Join(parts, ", "))
+		switch {
+		case reason != "":
+		case *maxLeases > 0 && total >= *maxLeases:
+			reason = fmt.Sprintf("lease budget of %d reached", *maxLeases)
+		case len(last) > 0 && running == 0:
+			reason = "every agent has stopped"
+		}
+		if reason != "" {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			reason = "interrupted"
+		case <-clock.After(*interval):
+		}
+	}
+
+	fmt.Printf("Stopping all agents: %s\n", reason)
+	for _, addr := range agents {
+		if s, ok := last[addr]; ok && s.State == "exited" {
+			continue
+		}
+		if err := stopAgent(addr); err != nil {
+			fmt.Printf("[ERROR] failed to stop %s: %v\n", addr, err)
+		}
+	}
+	// Agents that exit once stopped are reported from their last answer.
+	final := pollAgents(agents)
+	for i, s := range final {
+		if prev, ok := last[s.Addr]; ok && s.Err != nil {
+			prev.State = "exited"
+			final[i] = prev
+		}
+	}
+	printCoordinatorSummary(final)
+}
+
+// pollAgents fetches every agent's status concurrently, in the given order.
+func pollAgents(agents []string) []agentStatus {
+	statuses := make([]agentStatus, len(agents))
+	var wg sync.WaitGroup
+	for i, addr := range agents {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses[i] = fetchAgentStatus(addr)
+		}()
+	}
+	wg.Wait()
+	return statuses
+}
+
+func fetchAgentStatus(addr string) agentStatus {
+	status := agentStatus{Addr: addr}
+	req, err := newControlRequest(context.Background(), http.MethodGet, agentURL(addr, "/status"), nil)
+	if err != nil {
+		status.Err = err
+		return status
+	}
+	resp, err := coordinatorClient.Do(req)
+	if err != nil {
+		status.Err = err
+		return status
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		status.Err = fmt.Errorf("control API returned %s", resp.Status)
+		return status
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		status.Err = fmt.Errorf("unexpected response from the control API: %v", err)
+	}
+	return status
+}
+
+// stopAgent ends launching on one agent; its leases stay held.
+func stopAgent(addr string) error {
+	req, err := newControlRequest(context.Background(), http.MethodPost, agentURL(addr, "/stop"), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := coordinatorClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("control API returned %s", resp.Status)
+	}
+	return nil
+}
+
+func agentURL(addr, path string) string {
+	if strings.HasPrefix(addr, ":") {
+		addr = "localhost" + addr
+	}
+	return "http://" + addr + path
+}
+
+// printCoordinatorSummary writes the per-agent and combined results.
+func printCoordinatorSummary(statuses []agentStatus) {
+	fmt.Println("=== Coordinated Run Summary ===")
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "AGENT\tSTATE\tLEASES\tLAUNCHED\tEXHAUSTED")
+	leased, launched := 0, 0
+	for _, s := range statuses {
+		if s.Err != nil {
+			fmt.Fprintf(w, "%s\tunreachable: %v\t-\t-\t-\n", s.Addr, s.Err)
+			continue
+		}
+		leased += s.Leased
+		launched += s.Launched
+		exhausted := "no"
+		if s.Exhausted {
+			exhausted = "yes"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\n", s.Addr, s.State, s.Leased, s.Launched, exhausted)
+	}
+	w.Flush()
+	fmt.Printf("Total: %d leases from %d clients across %d agents\n", leased, launched, len(statuses))
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+)
+
+// daemonMonitor pauses launch workers while the Docker daemon is unreachable,
+// reconnects with backoff and reconciles container state once it returns.
+type daemonMonitor struct {
+	cli      containerRuntime
+	networks []*NetworkConfig
+	retry    *retryPolicy
+	// giveUp ends the run when the daemon stays unreachable.
+	giveUp func(error)
+
+	mu        sync.Mutex
+	down      bool
+	recovered chan struct{}
+	// networkMu serialises recreating deleted networks.
+	networkMu sync.Mutex
+}
+
+func newDaemonMonitor(cli containerRuntime, networks []*NetworkConfig, retry *retryPolicy, giveUp func(error)) *daemonMonitor {
+	return &daemonMonitor{cli: cli, networks: networks, retry: retry, giveUp: giveUp}
+}
+
+// check pings the daemon. If it is unreachable, recovery is started (once)
+// and check blocks until the daemon is back. It reports whether the daemon
+// was down, in which case the caller's failure was not the client's fault.
+func (m *daemonMonitor) check(ctx context.Context) bool {
+	pingCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	_, err := m.cli.Ping(pingCtx)
+	cancel()
+	if err == nil && !m.isDown() {
+		return false
+	}
+	if err != nil {
+		m.markDown(ctx, err)
+	}
+	m.wait(ctx)
+	return true
+}
+
+// wait blocks while the daemon is down.
+func (m *daemonMonitor) wait(ctx context.Context) {
+	m.mu.Lock()
+	recovered := m.recovered
+	down := m.down
+	m.mu.Unlock()
+	if !down {
+		return
+	}
+	select {
+	case <-recovered:
+	case <-ctx.Done():
+	}
+}
+
+func (m *daemonMonitor) isDown() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.down
+}
+
+// markDown pauses workers and starts the reconnect loop unless it is running.
+func (m *daemonMonitor) markDown(ctx context.Context, cause error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.down {
+		return
+	}
+	m.down = true
+	m.recovered = make(chan struct{})
+	slog.Warn("lost connection to the Docker daemon, pausing workers", "error", cause)
+	go m.reconnect(ctx)
+}
+
+// reconnect pings the daemon with the run's retry policy until it answers,
+// then reconciles state and resumes the workers. Once the policy's attempts
+// are used up the run is ended instead.
+func (m *daemonMonitor) reconnect(ctx context.Context) {
+	delay := m.retry.delay(1)
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-clock.After(delay):
+		}
+		pingCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		_, err := m.cli.Ping(pingCtx)
+		cancel()
+		if err == nil {
+			break
+		}
+		if m.retry.exhausted(attempt) {
+			slog.Error("Docker daemon did not come back, giving up", "attempts", attempt, "error", err)
+			m.giveUp(fmt.Errorf("%w after %d reconnect attempts: %w", ErrDaemonUnavailable, attempt, err))
+			return
+		}
+		delay = m.retry.delay(attempt + 1)
+		slog.Warn("Docker daemon still unreachable", "attempt", attempt, "retry_in", delay.Round(time.Millisecond).String(), "error", err)
+	}
+
+	slog.Info("Docker daemon is back, reconciling container state")
+	if err := m.reconcile(ctx); err != nil {
+		slog.Error("reconciliation after daemon restart failed", "error", err)
+	}
+
+	m.mu.Lock()
+	m.down = false
+	close(m.recovered)
+	m.mu.Unlock()
+	slog.Info("resuming container launches")
+}
+
+// reconcile makes sure the macvlan networks still exist and restarts client
+// containers the daemon restart left stopped, so they re-acquire their leases.
+func (m *daemonMonitor) reconcile(ctx context.Context) error {
+	var containers []types.Container
+	for _, netCfg := range m.networks {
+		if err := m.restoreNetwork(ctx, netCfg); err != nil {
+			return err
+		}
+
+		attached, err := m.cli.ContainerList(ctx, container.ListOptions{
+			All:     true,
+			Filters: filters.NewArgs(filters.Arg("network", netCfg.Name)),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to list containers: %v", err)
+		}
+		containers = append(containers, attached...)
+	}
+	running, restarted := 0, 0
+	for _, c := range containers {
+		if c.State == "running" {
+			running++
+			continue
+		}
+		if err := m.cli.ContainerStart(ctx, c.ID, container.StartOptions{}); err != nil {
+			slog.Warn("could not restart container", "container", shortID(c.ID), "error", err)
+			continue
+		}
+		restarted++
+	}
+	slog.Info("reconciled containers", "total", len(containers), "running", running, "restarted", restarted)
+	return nil
+}
+
+// restoreNetwork recreates netCfg's Docker network if it is gone, after a
+// daemon restart or when a launch found it deleted. Concurrent callers
+// recreate it once.
+func (m *daemonMonitor) restoreNetwork(ctx context.Context, netCfg *NetworkConfig) error {
+	m.networkMu.Lock()
+	defer m.networkMu.Unlock()
+	_, err := m.cli.NetworkInspect(ctx, netCfg.Name, network.InspectOptions{})
+	if err == nil {
+		return nil
+	}
+	if !client.IsErrNotFound(err) {
+		return fmt.Errorf("failed to inspect Docker network: %w", runtimeError(err))
+	}
+	slog.Warn("Docker network is gone, recreating it", "network", netCfg.Name)
+	return ensureDockerNetwork(ctx, m.cli, netCfg)
+}
+
+// watch pings the daemon periodically so an outage is noticed even while no
+// launch is in flight.
+func (m *daemonMonitor) watch(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-clock.After(interval):
+			if !m.isDown() {
+				m.check(ctx)
+			}
+		}
+	}
+}
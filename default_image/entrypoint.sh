@@ -0,0 +1,59 @@
+#!/bin/sh
+
+# Detect the network interface (strip @if* suffix)
+INTERFACE=$(ip -o link show | awk -F': ' '/^[0-9]+: (eth|macvlan)[0-9]*/ {sub(/@.*/, "", $2); print $2; exit}')
+if [ -z "$INTERFACE" ]; then
+    echo "No suitable network interface found!"
+    ip link show
+    exit 1
+fi
+echo "Bringing up network interface: $INTERFACE"
+ip link set "$INTERFACE" up
+
+CLIENT=udhcpc
+ARGS="-f -i $INTERFACE -t 5 -T 3 -A 5"
+if [ -n "$IPOCALYPSE_DHCPV6" ]; then
+    echo "Using DHCPv6"
+    CLIENT=udhcpc6
+fi
+
+# Ask for a specific address when the controller provides a hint (-address-order)
+if [ -n "$IPOCALYPSE_REQUESTED_IP" ]; then
+    echo "Requesting address $IPOCALYPSE_REQUESTED_IP"
+    ARGS="$ARGS -r $IPOCALYPSE_REQUESTED_IP"
+fi
+
+# Send the controller's client-id (-client-id; ipvlan clients share the
+# parent's MAC and are identified by it) and ask for broadcast replies
+if [ -n "$IPOCALYPSE_CLIENT_ID" ]; then
+    ARGS="$ARGS -x 0x3d:${IPOCALYPSE_CLIENT_ID//:/}"
+elif [ -n "$IPOCALYPSE_NO_CLIENT_ID" ]; then
+    ARGS="$ARGS -C"
+fi
+if [ -n "$IPOCALYPSE_BROADCAST" ]; then
+    ARGS="$ARGS -B"
+fi
+
+# Present the device profile's DHCP fingerprint (-profiles / manifest profile)
+if [ -n "$IPOCALYPSE_HOSTNAME" ]; then
+    ARGS="$ARGS -x hostname:$IPOCALYPSE_HOSTNAME"
+fi
+if [ -n "$IPOCALYPSE_PARAM_REQUEST" ]; then
+    ARGS="$ARGS -o"
+    for code in ${IPOCALYPSE_PARAM_REQUEST//,/ }; do
+        ARGS="$ARGS -O $code"
+    done
+fi
+
+# Release the lease when the container is stopped
+trap 'kill -USR2 $PID 2>/dev/null; sleep 1; kill $PID 2>/dev/null; exit 0' INT TERM
+
+echo "Attempting DHCP lease on $INTERFACE with $CLIENT..."
+if [ -n "$IPOCALYPSE_VENDOR_CLASS" ]; then
+    $CLIENT $ARGS -V "$IPOCALYPSE_VENDOR_CLASS" &
+else
+    $CLIENT $ARGS &
+fi
+PID=$!
+wait $PID
+echo "$CLIENT exited"
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// defaultImageFiles is the build context of the built-in BusyBox/udhcpc
+// client image, used when no ipocalypse_* directories exist.
+//
+//go:embed default_image
+var defaultImageFiles embed.FS
+
+// defaultImageDir is the directory name, and so the image name, the built-in
+// image is built under.
+const defaultImageDir = "ipocalypse_default"
+
+// writeDefaultImage extracts the built-in image's build context into a
+// temporary directory and returns its path. The caller removes it.
+func writeDefaultImage() (string, error) {
+	return writeBuildContext(defaultImageFiles, "default_image", defaultImageDir)
+}
+
+// writeBuildContext extracts the embedded directory root into a temporary
+// directory named name, and returns its path. The caller removes it.
+func writeBuildContext(embedded embed.FS, root, name string) (string, error) {
+	tmp, err := os.MkdirTemp("", "ipocalypse")
+	if err != nil {
+		return "", fmt.Errorf("failed to create build directory: %v", err)
+	}
+	dir := filepath.Join(tmp, name)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create build directory: %v", err)
+	}
+	files, err := fs.Sub(embedded, root)
+	if err != nil {
+		return "", err
+	}
+	err = fs.WalkDir(files, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(files, path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(dir, path), data, 0644)
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to write the %s build context: %v", name, err)
+	}
+	return dir, nil
+}
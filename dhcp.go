@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// DHCP message types (option 53).
+const (
+	dhcpDiscover byte = 1
+	dhcpOffer    byte = 2
+	dhcpRequest  byte = 3
+	dhcpDecline  byte = 4
+	dhcpAck      byte = 5
+	dhcpNak      byte = 6
+	dhcpRelease  byte = 7
+	dhcpInform   byte = 8
+)
+
+// DHCP option codes used by the tool.
+const (
+	optSubnetMask   byte = 1
+	optRouter       byte = 3
+	optDNS          byte = 6
+	optHostname     byte = 12
+	optRequestedIP  byte = 50
+	optLeaseTime    byte = 51
+	optMessageType  byte = 53
+	optServerID     byte = 54
+	optParamRequest byte = 55
+	optMessage      byte = 56
+	optRenewalTime  byte = 58
+	optVendorClass  byte = 60
+	optClientID     byte = 61
+	optEnd          byte = 255
+	optPad          byte = 0
+)
+
+const (
+	bootRequest = 1
+	bootReply   = 2
+
+	dhcpServerPort = 67
+	dhcpClientPort = 68
+
+	// dhcpFixedLen is the BOOTP header length up to the magic cookie.
+	dhcpFixedLen = 236
+	// dhcpMinLen is the minimum BOOTP message size some servers insist on.
+	dhcpMinLen = 300
+)
+
+var dhcpMagicCookie = []byte{99, 130, 83, 99}
+
+// dhcpOption is a single TLV option. Options are kept in order because the
+// order itself is part of a client's fingerprint.
+type dhcpOption struct {
+	Code byte
+	Data []byte
+}
+
+// dhcpMessage is a decoded DHCPv4 message.
+type dhcpMessage struct {
+	Op      byte
+	Hops    byte
+	XID     uint32
+	Secs    uint16
+	Flags   uint16
+	CIAddr  net.IP
+	YIAddr  net.IP
+	SIAddr  net.IP
+	GIAddr  net.IP
+	CHAddr  net.HardwareAddr
+	Options []dhcpOption
+}
+
+// newDHCPRequest returns a client message of the given type with the
+// broadcast flag set, so replies reach spoofed MACs without promiscuous mode.
+func newDHCPRequest(msgType byte, xid uint32, mac net.HardwareAddr) *dhcpMessage {
+	return &dhcpMessage{
+		Op:      bootRequest,
+		XID:     xid,
+		Flags:   0x8000,
+		CHAddr:  mac,
+		Options: []dhcpOption{{Code: optMessageType, Data: []byte{msgType}}},
+	}
+}
+
+// addOption appends an option to the message.
+func (m *dhcpMessage) addOption(code byte, data []byte) {
+	m.Options = append(m.Options, dhcpOption{Code: code, Data: data})
+}
+
+// option returns the data of the first option with the given code.
+func (m *dhcpMessage) option(code byte) []byte {
+	for _, opt := range m.Options {
+		if opt.Code == code {
+			return opt.Data
+		}
+	}
+	return nil
+}
+
+// msgType returns the DHCP message type, or 0 for plain BOOTP.
+func (m *dhcpMessage) msgType() byte {
+	if data := m.option(optMessageType); len(data) == 1 {
+		return data[0]
+	}
+	return 0
+}
+
+// serverID returns the server identifier option as an IP.
+func (m *dhcpMessage) serverID() net.IP {
+	if data := m.option(optServerID); len(data) == 4 {
+		return net.IP(data)
+	}
+	return nil
+}
+
+// dnsServers returns the DNS servers offered by the server (option 6).
+func (m *dhcpMessage) dnsServers() []net.IP {
+	data := m.option(optDNS)
+	var servers []net.IP
+	for i := 0; i+4 <= len(data); i += 4 {
+		servers = append(servers, net.IP(data[i:i+4]))
+	}
+	return servers
+}
+
+// leaseTime returns the lease duration offered by the server.
+func (m *dhcpMessage) leaseTime() time.Duration {
+	if data := m.option(optLeaseTime); len(data) == 4 {
+		return time.Duration(binary.BigEndian.Uint32(data)) * time.Second
+	}
+	return 0
+}
+
+// marshal encodes the message in wire format.
+func (m *dhcpMessage) marshal() []byte {
+	b := make([]byte, dhcpFixedLen, dhcpMinLen)
+	b[0] = m.Op
+	b[1] = 1 // htype: Ethernet
+	b[2] = 6 // hlen
+	b[3] = m.Hops
+	binary.BigEndian.PutUint32(b[4:8], m.XID)
+	binary.BigEndian.PutUint16(b[8:10], m.Secs)
+	binary.BigEndian.PutUint16(b[10:12], m.Flags)
+	copy(b[12:16], m.CIAddr.To4())
+	copy(b[16:20], m.YIAddr.To4())
+	copy(b[20:24], m.SIAddr.To4())
+	copy(b[24:28], m.GIAddr.To4())
+	copy(b[28:44], m.CHAddr)
+	b = append(b, dhcpMagicCookie...)
+	for _, opt := range m.Options {
+		b = append(b, opt.Code, byte(len(opt.Data)))
+		b = append(b, opt.Data...)
+	}
+	b = append(b, optEnd)
+	for len(b) < dhcpMinLen {
+		b = append(b, optPad)
+	}
+	return b
+}
+
+// parseDHCP decodes a DHCPv4 message.
+func parseDHCP(b []byte) (*dhcpMessage, error) {
+	if len(b) < dhcpFixedLen+len(dhcpMagicCookie) {
+		return nil, fmt.Errorf("DHCP message too short (%d bytes)", len(b))
+	}
+	hlen := int(b[2])
+	if hlen > 16 {
+		hlen = 16
+	}
+	m := &dhcpMessage{
+		Op:     b[0],
+		Hops:   b[3],
+		XID:    binary.BigEndian.Uint32(b[4:8]),
+		Secs:   binary.BigEndian.Uint16(b[8:10]),
+		Flags:  binary.BigEndian.Uint16(b[10:12]),
+		CIAddr: net.IP(append([]byte(nil), b[12:16]...)),
+		YIAddr: net.IP(append([]byte(nil), b[16:20]...)),
+		SIAddr: net.IP(append([]byte(nil), b[20:24]...)),
+		GIAddr: net.IP(append([]byte(nil), b[24:28]...)),
+		CHAddr: net.HardwareAddr(append([]byte(nil), b[28:28+hlen]...)),
+	}
+	if string(b[dhcpFixedLen:dhcpFixedLen+4]) != string(dhcpMagicCookie) {
+		return nil, fmt.Errorf("missing DHCP magic cookie")
+	}
+	opts := b[dhcpFixedLen+4:]
+	for i := 0; i < len(opts); {
+		code := opts[i]
+		if code == optEnd {
+			break
+		}
+		if code == optPad {
+			i++
+			continue
+		}
+		if i+1 >= len(opts) || i+2+int(opts[i+1]) > len(opts) {
+			return nil, fmt.Errorf("truncated DHCP option %d", code)
+		}
+		length := int(opts[i+1])
+		m.addOption(code, append([]byte(nil), opts[i+2:i+2+length]...))
+		i += 2 + length
+	}
+	return m, nil
+}
+
+// dhcpTypeName returns a readable name for a DHCP message type.
+func dhcpTypeName(t byte) string {
+	names := map[byte]string{
+		dhcpDiscover: "DISCOVER",
+		dhcpOffer:    "OFFER",
+		dhcpRequest:  "REQUEST",
+		dhcpDecline:  "DECLINE",
+		dhcpAck:      "ACK",
+		dhcpNak:      "NAK",
+		dhcpRelease:  "RELEASE",
+		dhcpInform:   "INFORM",
+	}
+	if name, ok := names[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", t)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// dhcpTimingStale is how long an unanswered DISCOVER or REQUEST is kept for
+// matching before it is dropped.
+const dhcpTimingStale = time.Minute
+
+// Exchanges timed by -dhcp-latency.
+const (
+	exchangeOffer = "offer"
+	exchangeAck   = "ack"
+	exchangeNak   = "nak"
+)
+
+// dhcpTiming is one timed exchange: the server's answer to a DISCOVER
+// (offer) or a REQUEST (ack or nak), and how many leases the run held when it
+// arrived.
+type dhcpTiming struct {
+	At       time.Time
+	MAC      string
+	XID      uint32
+	Exchange string
+	Latency  time.Duration
+	Leases   int
+}
+
+// transactionTimer times the DHCP exchanges on the parent interface from a
+// capture of both directions, matching the server's answers to the clients'
+// messages by transaction ID. It sees the frames of every engine, the raw
+// engine's own included, and of any other client on the segment.
+type transactionTimer struct {
+	conn  *packetConn
+	stats *runStats
+
+	mu        sync.Mutex
+	discovers map[uint32]time.Time
+	requests  map[uint32]time.Time
+	timings   []dhcpTiming
+	file      *os.File
+	csv       *csv.Writer
+}
+
+// newTransactionTimer starts timing on netCfg's parent interface, writing
+// every exchange to path as CSV when path is set. It returns nil when
+// disabled.
+func newTransactionTimer(enabled bool, path string, netCfg *NetworkConfig, stats *runStats) (*transactionTimer, error) {
+	if !enabled {
+		return nil, nil
+	}
+	// ETH_P_ALL so the clients' own outgoing frames are seen as well.
+	conn, err := openPacketConn(netCfg.Parent, etherTypeAll)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.setReadTimeout(500 * time.Millisecond); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to set socket timeout: %v", err)
+	}
+	t := &transactionTimer{conn: conn, stats: stats, discovers: make(map[uint32]time.Time), requests: make(map[uint32]time.Time)}
+	if path != "" {
+		if t.file, err = os.Create(path); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to create DHCP latency file: %v", err)
+		}
+		t.csv = csv.NewWriter(t.file)
+		t.csv.Write([]string{"time", "mac", "xid", "exchange", "latency_ms", "leases"})
+	}
+	return t, nil
+}
+
+// run times the exchanges until ctx is done.
+func (t *transactionTimer) run(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	defer t.conn.Close()
+	buf := make([]byte, 65536)
+	lastPrune := clock.Now()
+	for ctx.Err() == nil {
+		n, err := t.conn.readFrame(buf)
+		if err != nil || n == 0 {
+			continue
+		}
+		frame, ok := parseUDPFrame(buf[:n])
+		if !ok || (frame.DstPort != dhcpServerPort && frame.DstPort != dhcpClientPort) {
+			continue
+		}
+		msg, err := parseDHCP(frame.Payload)
+		if err != nil {
+			continue
+		}
+		t.record(clock.Now(), msg)
+		if clock.Since(lastPrune) > dhcpTimingStale {
+			t.prune()
+			lastPrune = clock.Now()
+		}
+	}
+}
+
+// record accounts for one DHCP message seen at the given time. Retransmitted
+// DISCOVERs and REQUESTs keep the time of the first, so the latency includes
+// the client's wait for an answer that never came.
+func (t *transactionTimer) record(at time.Time, msg *dhcpMessage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var sent time.Time
+	var exchange string
+	switch msg.msgType() {
+	case dhcpDiscover:
+		if _, ok := t.discovers[msg.XID]; !ok {
+			t.discovers[msg.XID] = at
+		}
+		return
+	case dhcpRequest:
+		if _, ok := t.requests[msg.XID]; !ok {
+			t.requests[msg.XID] = at
+		}
+		return
+	case dhcpDecline:
+		t.stats.recordDecline()
+		return
+	case dhcpOffer:
+		sent, exchange = t.discovers[msg.XID], exchangeOffer
+		delete(t.discovers, msg.XID)
+	case dhcpAck, dhcpNak:
+		sent, exchange = t.requests[msg.XID], exchangeAck
+		if msg.msgType() == dhcpNak {
+			exchange = exchangeNak
+			if message := msg.option(optMessage); len(message) > 0 {
+				t.stats.recordNAKReason(string(message))
+			}
+		}
+		delete(t.requests, msg.XID)
+	default:
+		return
+	}
+	if sent.IsZero() {
+		return
+	}
+	_, leased, _ := t.stats.launchRate()
+	timing := dhcpTiming{At: at, MAC: msg.CHAddr.String(), XID: msg.XID, Exchange: exchange, Latency: at.Sub(sent), Leases: leased}
+	t.timings = append(t.timings, timing)
+	if t.csv != nil {
+		t.csv.Write([]string{timing.At.UTC().Format(time.RFC3339Nano), timing.MAC, fmt.Sprintf("%08x", timing.XID), timing.Exchange,
+			strconv.FormatFloat(float64(timing.Latency.Microseconds())/1000, 'f', 3, 64), strconv.Itoa(timing.Leases)})
+		t.csv.Flush()
+	}
+}
+
+// prune drops the messages that were never answered.
+func (t *transactionTimer) prune() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, pending := range []map[uint32]time.Time{t.discovers, t.requests} {
+		for xid, sent := range pending {
+			if clock.Since(sent) > dhcpTimingStale {
+				delete(pending, xid)
+			}
+		}
+	}
+}
+
+// printSummary reports the latency percentiles of both exchanges over the
+// whole run and over each quarter of it, labelled with the leases held then,
+// so a server slowing down as its pool fills stands out. A nil timer prints
+// nothing.
+func (t *transactionTimer) printSummary() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.file != nil {
+		t.file.Close()
+	}
+	if len(t.timings) == 0 {
+		fmt.Println("DHCP latency:      no exchanges timed")
+		return
+	}
+	fmt.Printf("DHCP latency:      %s\n", describeTimings(t.timings))
+	if len(t.timings) < 8 {
+		return
+	}
+	for q := range 4 {
+		part := t.timings[q*len(t.timings)/4 : (q+1)*len(t.timings)/4]
+		fmt.Printf("  at %d-%d leases: %s\n", part[0].Leases, part[len(part)-1].Leases, describeTimings(part))
+	}
+}
+
+// describeTimings summarises the DISCOVER-to-OFFER and REQUEST-to-ACK
+// latencies of timings.
+func describeTimings(timings []dhcpTiming) string {
+	var offers, acks []time.Duration
+	naks := 0
+	for _, timing := range timings {
+		switch timing.Exchange {
+		case exchangeOffer:
+			offers = append(offers, timing.Latency)
+		case exchangeNak:
+			naks++
+			fallthrough
+		default:
+			acks = append(acks, timing.Latency)
+		}
+	}
+	describe := func(latencies []time.Duration) string {
+		if len(latencies) == 0 {
+			return "none"
+		}
+		return fmt.Sprintf("p50 %v, p95 %v, p99 %v (%d)", percentile(latencies, 50).Round(time.Microsecond), percentile(latencies, 95).Round(time.Microsecond), percentile(latencies, 99).Round(time.Microsecond), len(latencies))
+	}
+	line := fmt.Sprintf("DISCOVER->OFFER %s; REQUEST->ACK %s", describe(offers), describe(acks))
+	if naks > 0 {
+		line += fmt.Sprintf(", %d NAKs", naks)
+	}
+	return line
+}
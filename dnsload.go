@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dnsLoadTick is how often the DNS load sends the queries due.
+const dnsLoadTick = 50 * time.Millisecond
+
+// dnsLoadTimeout is how long a query may go unanswered before it counts as
+// timed out.
+const dnsLoadTimeout = 5 * time.Second
+
+// defaultDNSLoadNames are queried when -dns-load-names is not given: common
+// names an office client resolves all day.
+var defaultDNSLoadNames = []string{
+	"www.google.com", "www.microsoft.com", "login.microsoftonline.com",
+	"outlook.office365.com", "www.apple.com", "time.windows.com",
+	"update.googleapis.com", "www.youtube.com", "slack.com", "zoom.us",
+}
+
+// dnsLoadClient is a leased client the load queries from.
+type dnsLoadClient struct {
+	mac    string
+	server net.IP
+}
+
+// dnsQueryKey identifies an outstanding query by the client it was sent from
+// and its transaction ID.
+type dnsQueryKey struct {
+	ip string
+	id uint16
+}
+
+// dnsLoad has every leased client query the DNS server its lease offers at a
+// steady rate, so the DHCP pressure comes with DNS pressure on all-in-one
+// appliances that serve both. Queries are sent from the host on the parent
+// interface with each client's MAC and IP, as -announce does, and the
+// answers are picked up there too, so it works for every engine.
+type dnsLoad struct {
+	conn      *packetConn
+	rate      float64
+	names     []string
+	server    net.IP
+	sharedMAC bool
+	netCfg    *NetworkConfig
+
+	mu        sync.Mutex
+	clients   map[string]dnsLoadClient
+	pending   map[dnsQueryKey]time.Time
+	servers   map[string]net.HardwareAddr
+	noServer  int
+	sent      int
+	answered  int
+	errors    int
+	timedOut  int
+	latencies []time.Duration
+}
+
+// newDNSLoad opens a packet socket on netCfg's parent interface. rate is the
+// queries per second each client sends; 0 returns nil. server, when set,
+// replaces the servers the leases offer.
+func newDNSLoad(rate float64, names []string, server string, netCfg *NetworkConfig) (*dnsLoad, error) {
+	if rate == 0 {
+		return nil, nil
+	}
+	if rate < 0 {
+		return nil, fmt.Errorf("-dns-load must be positive")
+	}
+	if len(names) == 0 {
+		names = defaultDNSLoadNames
+	}
+	l := &dnsLoad{rate: rate, names: names, sharedMAC: netCfg.Driver == driverIpvlan, netCfg: netCfg, clients: make(map[string]dnsLoadClient), pending: make(map[dnsQueryKey]time.Time), servers: make(map[string]net.HardwareAddr)}
+	if server != "" {
+		if l.server = net.ParseIP(server).To4(); l.server == nil {
+			return nil, fmt.Errorf("-dns-load-server: %q is not an IPv4 address", server)
+		}
+	}
+	conn, err := openPacketConn(netCfg.Parent, etherTypeIPv4)
+	if err != nil {
+		return nil, err
+	}
+	l.conn = conn
+	return l, nil
+}
+
+func (l *dnsLoad) String() string {
+	target := "the DNS server each lease offers"
+	if l.server != nil {
+		target = l.server.String()
+	}
+	return fmt.Sprintf("%g queries/s per client to %s", l.rate, target)
+}
+
+// add starts the load from a client that just obtained a lease, against the
+// first DNS server the lease offers. A nil load does nothing.
+func (l *dnsLoad) add(mac, ip string, offered []string) {
+	if l == nil {
+		return
+	}
+	server := l.server
+	if server == nil && len(offered) > 0 {
+		server = net.ParseIP(offered[0]).To4()
+	}
+	if server == nil {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.noServer++; l.noServer == 1 {
+			slog.Warn("lease offers no DNS server; the client sends no DNS load (set -dns-load-server)", "ip", ip)
+		}
+		return
+	}
+	l.mu.Lock()
+	hopMAC, known := l.servers[server.String()]
+	l.mu.Unlock()
+	if !known {
+		// Resolved without the lock, which the sender needs.
+		hopMAC = l.nextHopMAC(server)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.servers[server.String()] = hopMAC
+	l.clients[ip] = dnsLoadClient{mac: mac, server: server}
+}
+
+// nextHopMAC ARPs for the MAC queries to server are sent to: the server's own
+// on the subnet, the gateway's otherwise. When nothing answers, queries go
+// out as Ethernet broadcasts, as raw-mode releases do, and the IP layer still
+// addresses them.
+func (l *dnsLoad) nextHopMAC(server net.IP) net.HardwareAddr {
+	hop := server
+	if l.netCfg.Subnet != nil && !l.netCfg.Subnet.Contains(server) && l.netCfg.Gateway != nil {
+		hop = l.netCfg.Gateway
+	}
+	mac, err := resolveMAC(l.netCfg, hop, 2*time.Second)
+	if err != nil {
+		slog.Warn("could not resolve the DNS server's next hop; broadcasting queries", "server", server, "next_hop", hop, "error", err)
+		return broadcastMAC
+	}
+	return mac
+}
+
+// resolveMAC sends an ARP request for target from the host on netCfg's parent
+// interface and waits up to timeout for the answer.
+func resolveMAC(netCfg *NetworkConfig, target net.IP, timeout time.Duration) (net.HardwareAddr, error) {
+	conn, err := openPacketConn(netCfg.Parent, etherTypeARP)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.setReadTimeout(200 * time.Millisecond); err != nil {
+		return nil, err
+	}
+	// Without an address on the segment the request goes out as an ARP
+	// probe from 0.0.0.0, as the sweep's do.
+	srcIP := netCfg.HostIP
+	if srcIP == nil {
+		srcIP = net.IPv4zero
+	}
+	if err := conn.writeFrame(buildARPRequest(conn.iface.HardwareAddr, srcIP, target)); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1514)
+	for deadline := clock.Now().Add(timeout); clock.Now().Before(deadline); {
+		n, err := conn.readFrame(buf)
+		if err != nil || n < 42 {
+			continue
+		}
+		arp := buf[14:n]
+		if binary.BigEndian.Uint16(arp[6:8]) == 2 && net.IP(arp[14:18]).Equal(target) {
+			return append(net.HardwareAddr(nil), arp[8:14]...), nil
+		}
+	}
+	return nil, fmt.Errorf("no ARP reply from %s", target)
+}
+
+// run sends the queries and collects the answers until ctx is done. Clients
+// that gave their lease back stop querying.
+func (l *dnsLoad) run(ctx context.Context, leases *leaseTable) {
+	if l == nil {
+		return
+	}
+	go l.receive(ctx)
+	var due float64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-clock.After(dnsLoadTick):
+		}
+		var clients []string
+		l.mu.Lock()
+		for _, r := range leases.held() {
+			if _, ok := l.clients[r.IP]; ok {
+				clients = append(clients, r.IP)
+			}
+		}
+		l.expire()
+		l.mu.Unlock()
+		// Queries are spread over the clients at random, at the combined
+		// rate of all of them.
+		due += l.rate * float64(len(clients)) * dnsLoadTick.Seconds()
+		for ; due >= 1 && len(clients) > 0; due-- {
+			l.query(clients[rand.Intn(len(clients))])
+		}
+		if len(clients) == 0 {
+			due = 0
+		}
+	}
+}
+
+// query sends one A query from the client with IP ip.
+func (l *dnsLoad) query(ip string) {
+	l.mu.Lock()
+	client := l.clients[ip]
+	dstMAC := l.servers[client.server.String()]
+	id := uint16(rand.Intn(1 << 16))
+	l.pending[dnsQueryKey{ip, id}] = clock.Now()
+	l.sent++
+	l.mu.Unlock()
+
+	srcMAC, err := net.ParseMAC(client.mac)
+	if err != nil || l.sharedMAC {
+		srcMAC = l.conn.iface.HardwareAddr
+	}
+	frame := buildUDPFrame(udpFrame{
+		SrcMAC: srcMAC, DstMAC: dstMAC,
+		SrcIP: net.ParseIP(ip), DstIP: client.server,
+		SrcPort: ephemeralPort(), DstPort: 53,
+		Payload: dnsQuery(id, l.pickName()),
+	})
+	if err := l.conn.writeFrame(frame); err != nil {
+		slog.Debug("DNS load query failed", "ip", ip, "error", err)
+	}
+}
+
+// pickName returns a name to query. Names starting with "*." get a random
+// label in its place, so every query misses the server's cache.
+func (l *dnsLoad) pickName() string {
+	name := l.names[rand.Intn(len(l.names))]
+	if rest, ok := strings.CutPrefix(name, "*."); ok {
+		return fmt.Sprintf("%08x.%s", rand.Uint32(), rest)
+	}
+	return name
+}
+
+// receive matches the answers arriving for the clients to their queries.
+func (l *dnsLoad) receive(ctx context.Context) {
+	defer l.conn.Close()
+	l.conn.setReadTimeout(500 * time.Millisecond)
+	buf := make([]byte, 1600)
+	for ctx.Err() == nil {
+		n, err := l.conn.readFrame(buf)
+		if err != nil || n == 0 {
+			continue
+		}
+		frame, ok := parseUDPFrame(buf[:n])
+		if !ok || frame.SrcPort != 53 || len(frame.Payload) < 12 {
+			continue
+		}
+		key := dnsQueryKey{frame.DstIP.String(), binary.BigEndian.Uint16(frame.Payload[0:2])}
+		rcode := frame.Payload[3] & 0x0f
+		l.mu.Lock()
+		if sent, ok := l.pending[key]; ok {
+			delete(l.pending, key)
+			l.answered++
+			l.latencies = append(l.latencies, clock.Since(sent))
+			// NXDOMAIN is a valid answer to the random names.
+			if rcode != 0 && rcode != 3 {
+				l.errors++
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// expire counts the queries unanswered for dnsLoadTimeout as timed out. The
+// caller holds l.mu.
+func (l *dnsLoad) expire() {
+	for key, sent := range l.pending {
+		if clock.Since(sent) > dnsLoadTimeout {
+			delete(l.pending, key)
+			l.timedOut++
+		}
+	}
+}
+
+// printSummary reports the queries and how the servers coped. A nil load
+// prints nothing.
+func (l *dnsLoad) printSummary() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	servers := make([]string, 0, len(l.servers))
+	for s := range l.servers {
+		servers = append(servers, s)
+	}
+	var total, avg time.Duration
+	for _, d := range l.latencies {
+		total += d
+	}
+	if len(l.latencies) > 0 {
+		avg = total / time.Duration(len(l.latencies))
+	}
+	fmt.Printf("DNS load:          %d queries to %s, %d answered (%.1f%%), %d server failures, %d timed out, latency avg %v, p95 %v\n",
+		l.sent, strings.Join(servers, ", "), l.answered, percentOf(l.answered, l.sent), l.errors, l.timedOut,
+		avg.Round(time.Millisecond), percentile(l.latencies, 95).Round(time.Millisecond))
+}
+
+// dnsQuery is a recursive A query for name.
+func dnsQuery(id uint16, name string) []byte {
+	msg := make([]byte, 12, 64)
+	binary.BigEndian.PutUint16(msg[0:2], id)
+	binary.BigEndian.PutUint16(msg[2:4], 0x0100) // recursion desired
+	binary.BigEndian.PutUint16(msg[4:6], 1)      // one question
+	msg = append(msg, dnsName(name)...)
+	msg = binary.BigEndian.AppendUint16(msg, 1) // A
+	return binary.BigEndian.AppendUint16(msg, 1)
+}
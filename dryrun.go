@@ -0,0 +1,270 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// runDryRun prints what a run with cfg would do: the detected network, the
+// engine's readiness, the images and Docker networks a docker run would
+// create and the worker plan. It only reads state; no interface, network,
+// image or container is created and no DHCP traffic is sent. Problems a real
+// run would stop on are collected and returned together.
+func runDryRun(cfg Config, host *hostShell, targets []networkTarget) error {
+	fmt.Println("=== Dry Run ===")
+	var problems []error
+
+	fmt.Printf("Scenario:          %s on the %s engine\n", cfg.Scenario, cfg.Mode)
+	for _, e := range engines {
+		if e.Name != cfg.Mode {
+			continue
+		}
+		if err := e.check(cfg); err != nil {
+			problems = append(problems, fmt.Errorf("the %s engine cannot run: %v", e.Name, err))
+			fmt.Printf("Engine:            unavailable: %v\n", err)
+		} else {
+			fmt.Println("Engine:            available")
+		}
+	}
+
+	if cfg.Mode == modeDocker {
+		switch {
+		case kernelSupports(host, cfg.Driver):
+			fmt.Printf("Driver:            %s\n", cfg.Driver)
+		case cfg.Driver == driverMacvlan && cfg.DriverFallback != "refuse" && kernelSupports(host, cfg.DriverFallback):
+			fmt.Printf("Driver:            %s, as the kernel has no macvlan support (-driver-fallback=%s)\n", cfg.DriverFallback, cfg.DriverFallback)
+			cfg.Driver = cfg.DriverFallback
+		default:
+			problems = append(problems, fmt.Errorf("the kernel on %s has no %s support", host, cfg.Driver))
+			fmt.Printf("Driver:            unavailable: the kernel has no %s support\n", cfg.Driver)
+		}
+	}
+
+	fmt.Println("Networks:")
+	for i, target := range targets {
+		parent := targetParent(host, target)
+		if target.VLAN != 0 && cfg.Mode == modeDocker && cfg.Driver == driverBridge {
+			problems = append(problems, fmt.Errorf("-driver=bridge cannot tag VLAN %d on %s", target.VLAN, parent))
+		}
+		if target.VLAN != 0 {
+			// The subinterface does not exist yet, so its subnet is only
+			// learned once a real run creates it.
+			fmt.Printf("  would create VLAN interface %s (802.1Q ID %d on %s)\n", vlanInterfaceName(parent, target.VLAN), target.VLAN, parent)
+			continue
+		}
+		netCfg, err := detectNetwork(host, target.Interface, false)
+		if err != nil {
+			problems = append(problems, err)
+			continue
+		}
+		fmt.Printf("  %s: subnet %s, gateway %s, host %s, about %d leases\n", netCfg.Parent, netCfg.Subnet, netCfg.Gateway, netCfg.HostIP, poolCapacity(netCfg))
+		if cfg.Mode == modeDocker {
+			name, link := networkNames(cfg.NetworkName, i, len(targets), netCfg.Parent)
+			if cfg.Driver == driverBridge {
+				fmt.Printf("  would create Docker bridge network %s on the existing bridge\n", name)
+				if !isBridge(host, netCfg.Parent) {
+					problems = append(problems, fmt.Errorf("%s is not a Linux bridge, which -driver=bridge needs", netCfg.Parent))
+				}
+			} else {
+				fmt.Printf("  would create Docker %s network %s and host interface %s\n", cfg.Driver, name, link)
+			}
+			if cfg.Driver == driverMacvlan && isWireless(host, netCfg.Parent) {
+				switch {
+				case cfg.WifiFallback == driverIpvlan:
+					fmt.Printf("  %s is wireless: would use the ipvlan driver instead of macvlan (-wifi-fallback=ipvlan)\n", netCfg.Parent)
+				case cfg.WifiFallback == modeRaw && len(targets) == 1:
+					fmt.Printf("  %s is wireless: would switch to raw mode, with no containers (-wifi-fallback=raw)\n", netCfg.Parent)
+				default:
+					problems = append(problems, fmt.Errorf("%s is wireless and macvlan containers cannot obtain leases over Wi-Fi", netCfg.Parent))
+				}
+			}
+		}
+	}
+	if cfg.Mode == modeDocker && cfg.Internet {
+		fmt.Println("  would add a NAT rule giving the containers internet access")
+	}
+
+	if cfg.Mode == modeDocker {
+		dirs, err := dryRunImages(cfg)
+		if err != nil {
+			problems = append(problems, err)
+		}
+		fmt.Println("Images:")
+		switch {
+		case len(cfg.Images) > 0:
+			refs, weights, _ := parseImageSpecs(cfg.Images, true)
+			for i, ref := range refs {
+				fmt.Printf("  would pull %s (weight %d)\n", ref, weights[i])
+			}
+		case len(dirs) == 0:
+			fmt.Println("  would build the built-in BusyBox client image")
+		default:
+			_, weights, _ := parseImageSpecs(cfg.Dockerfiles, false)
+			for i, dir := range dirs {
+				weight := 1
+				if i < len(weights) {
+					weight = weights[i]
+				}
+				fmt.Printf("  would build %s:latest from %s (weight %d)\n", filepath.Base(dir), dir, weight)
+			}
+		}
+		if err := checkDHCPClient(cfg.DHCPClient); err != nil {
+			problems = append(problems, fmt.Errorf("-dhcp-client: %v", err))
+		} else {
+			fmt.Printf("  clients run %s DHCP on %s unless their manifest says otherwise\n", cfg.DHCPClient, cfg.ClientInterface)
+		}
+		if err := checkStrategy(cfg.Strategy); err != nil {
+			problems = append(problems, err)
+		} else {
+			fmt.Printf("  picked %s\n", cfg.Strategy)
+		}
+		if limits, err := parseContainerLimits(cfg); err != nil {
+			problems = append(problems, err)
+		} else if limits.set() {
+			fmt.Printf("  containers limited to %s\n", limits)
+		}
+	}
+
+	if cfg.Mode == modeK8s {
+		fmt.Println("Pods:")
+		if cfg.K8sNetwork != "" {
+			fmt.Printf("  would attach with NetworkAttachmentDefinition %s\n", cfg.K8sNetwork)
+		} else {
+			master := cfg.K8sMaster
+			if master == "" {
+				master = "the parent interface's name"
+			}
+			fmt.Printf("  would create NetworkAttachmentDefinition %s (%s on the nodes' %s)\n", k8sNetwork, cfg.Driver, master)
+		}
+		if _, err := parseNodeSelector(cfg.K8sNodeSelector); err != nil {
+			problems = append(problems, err)
+		} else if len(cfg.K8sNodeSelector) > 0 {
+			fmt.Printf("  scheduled on nodes labelled %s\n", strings.Join(cfg.K8sNodeSelector, ", "))
+		}
+		refs, weights, err := parseImageSpecs(cfg.Images, true)
+		if err != nil {
+			problems = append(problems, err)
+		}
+		for i, ref := range refs {
+			fmt.Printf("  would run %s (weight %d)\n", ref, weights[i])
+		}
+		if err := checkStrategy(cfg.Strategy); err != nil {
+			problems = append(problems, err)
+		} else {
+			fmt.Printf("  picked %s\n", cfg.Strategy)
+		}
+	}
+
+	budget, err := newLeaseBudget(cfg.MaxLeases, cfg.LaunchRate)
+	if err != nil {
+		problems = append(problems, err)
+	} else {
+		if budget.ramp, err = parseRamp(cfg.Ramp); err != nil {
+			problems = append(problems, err)
+		}
+		fmt.Printf("Workers:           %d, launching %s\n", cfg.Workers, budget)
+	}
+	if retry, err := newRetryPolicy(cfg); err != nil {
+		problems = append(problems, err)
+	} else {
+		fmt.Printf("Retries:           %s\n", retry)
+	}
+	if pacing, err := newLaunchPacing(cfg); err != nil {
+		problems = append(problems, err)
+	} else if cfg.Mode == modeDocker {
+		fmt.Printf("Pacing:            %s\n", pacing)
+	} else if cfg.LaunchStagger > 0 {
+		fmt.Printf("Pacing:            first launches staggered over %s\n", cfg.LaunchStagger)
+	}
+	fmt.Printf("Exhaustion:        after %d launches in a row without a lease\n", cfg.ExhaustAfter)
+	if cfg.ReserveFree > 0 {
+		fmt.Printf("Free reserve:      %d addresses\n", cfg.ReserveFree)
+	}
+	if cfg.Churn > 0 {
+		fmt.Printf("Churn:             %.0f%% of the clients every %s\n", cfg.Churn*100, cfg.ChurnInterval)
+	}
+	if cfg.RenewInterval > 0 {
+		fmt.Printf("Renewal storm:     %d rounds every %s with %d in flight\n", cfg.RenewRounds, cfg.RenewInterval, cfg.RenewWorkers)
+	}
+	if renewer, err := newLeaseRenewer(cfg, cfg.Mode != modeRaw && cfg.Mode != modePD, nil, nil); err != nil {
+		problems = append(problems, err)
+	} else if renewer != nil {
+		fmt.Printf("Lease renewals:    %s\n", renewer)
+	}
+	if cfg.SpoofRelease {
+		fmt.Println("Spoofed releases:  every device an ARP sweep finds, before launching")
+	}
+	if cfg.RogueServer {
+		fmt.Printf("Rogue server:      %s for %s\n", cfg.RoguePool, cfg.RogueDuration)
+	}
+	if cfg.ReleaseOnExit {
+		fmt.Println("Release on exit:   every held lease")
+	}
+	switch {
+	case cfg.EngagementID != "" && cfg.Operator != "":
+		fmt.Printf("Engagement:        %s, run by %s\n", cfg.EngagementID, cfg.Operator)
+	case cfg.IAmAuthorized:
+		fmt.Println("Engagement:        authorization confirmed on the terminal at the start (-i-am-authorized)")
+	case cfg.EngagementID != "":
+		problems = append(problems, fmt.Errorf("-engagement-id needs -operator, the name of whoever runs the test"))
+	default:
+		problems = append(problems, fmt.Errorf("no engagement: give -engagement-id and -operator, or -i-am-authorized"))
+	}
+	switch _, err := readAuditLog(cfg.AuditLog); {
+	case cfg.AuditLog == "":
+		problems = append(problems, fmt.Errorf("-audit-log cannot be empty: every run that acts on the network is recorded"))
+	case err != nil && !errors.Is(err, os.ErrNotExist):
+		problems = append(problems, fmt.Errorf("audit log %s: %v", cfg.AuditLog, err))
+	default:
+		fmt.Printf("Audit log:         %s\n", cfg.AuditLog)
+	}
+
+	if err := errors.Join(problems...); err != nil {
+		return err
+	}
+	fmt.Println("Nothing was changed; drop -dry-run to start the run.")
+	return nil
+}
+
+// dryRunImages validates the Dockerfile directories a docker run would build
+// and returns them, or none when the built-in image or -images would be used.
+func dryRunImages(cfg Config) ([]string, error) {
+	if len(cfg.Images) > 0 {
+		if len(cfg.Dockerfiles) > 0 {
+			return nil, fmt.Errorf("use either -images or -dockerfiles, not both")
+		}
+		if _, _, err := parseImageSpecs(cfg.Images, true); err != nil {
+			return nil, fmt.Errorf("-images: %v", err)
+		}
+		return nil, nil
+	}
+	dirs, _, err := parseImageSpecs(cfg.Dockerfiles, false)
+	if err != nil {
+		return nil, fmt.Errorf("-dockerfiles: %v", err)
+	}
+	if len(dirs) == 0 {
+		found, err := getIpocalypseDirs()
+		if err != nil {
+			return nil, nil
+		}
+		dirs = found
+	}
+	var problems []error
+	for _, dir := range dirs {
+		if !strings.HasPrefix(filepath.Base(dir), "ipocalypse") {
+			problems = append(problems, fmt.Errorf("directory '%s' must start with 'ipocalypse'", dir))
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, "Dockerfile")); err != nil {
+			problems = append(problems, fmt.Errorf("%s has no Dockerfile", dir))
+			continue
+		}
+		if _, err := loadManifest(dir); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	return dirs, errors.Join(problems...)
+}
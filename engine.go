@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// Engine stands up DHCP clients on the target LAN. The run loops launch,
+// release and verify clients only through it, so what an engine can and
+// cannot do is stated by its capabilities rather than assumed.
+type Engine interface {
+	Name() string
+	// Launch brings up one client and returns once it holds a lease.
+	Launch(ctx context.Context, spec launchSpec) (launchResult, error)
+	// Release gives a lease taken by Launch back to the server.
+	Release(ctx context.Context, r leaseRecord) error
+	// Verify checks that a client still holds its lease.
+	Verify(ctx context.Context, r leaseRecord) error
+	// Renew has a client renew its lease with the server now.
+	Renew(ctx context.Context, r leaseRecord) error
+	Capabilities() engineCapabilities
+}
+
+// engineCapabilities lists the optional features an engine supports.
+type engineCapabilities struct {
+	// IPv6 means clients can request DHCPv6 IA_NA addresses.
+	IPv6 bool
+	// Payloads means clients run image workloads, with manifests and health
+	// probes.
+	Payloads bool
+	// ClientOverrides means clients honour -client-dns and -client-ntp.
+	ClientOverrides bool
+	// Wireless means the engine works over a Wi-Fi parent interface.
+	Wireless bool
+	// Remote means the engine can run on another host with -host.
+	Remote bool
+	// Images means clients run the -images, picked by -strategy.
+	Images bool
+}
+
+// names returns the supported capabilities as short names.
+func (c engineCapabilities) names() []string {
+	var names []string
+	for _, capability := range []struct {
+		name string
+		ok   bool
+	}{
+		{"ipv6", c.IPv6},
+		{"payloads", c.Payloads},
+		{"client-overrides", c.ClientOverrides},
+		{"wireless", c.Wireless},
+		{"remote", c.Remote},
+		{"images", c.Images},
+	} {
+		if capability.ok {
+			names = append(names, capability.name)
+		}
+	}
+	return names
+}
+
+// dockerEngine runs each client as a container on the run's macvlan or
+// ipvlan network.
+type dockerEngine struct {
+	cli containerRuntime
+}
+
+var dockerCapabilities = engineCapabilities{IPv6: true, Payloads: true, ClientOverrides: true, Remote: true, Images: true}
+
+func (e *dockerEngine) Name() string                     { return modeDocker }
+func (e *dockerEngine) Capabilities() engineCapabilities { return dockerCapabilities }
+
+func (e *dockerEngine) Launch(ctx context.Context, spec launchSpec) (launchResult, error) {
+	// A launch under way finishes even when the run stops, so no container
+	// is left half set up; the context still carries the launch's span.
+	return launchContainer(context.WithoutCancel(ctx), e.cli, spec)
+}
+
+// Release has the container's DHCP client release its lease and removes it.
+func (e *dockerEngine) Release(ctx context.Context, r leaseRecord) error {
+	if _, err := containerExec(ctx, e.cli, r.Container, []string{"sh", "-c", containerRelease}); err != nil {
+		return err
+	}
+	return e.cli.ContainerRemove(ctx, r.Container, container.RemoveOptions{Force: true})
+}
+
+// Verify checks that the container is running and its DHCP client still
+// records a lease.
+func (e *dockerEngine) Verify(ctx context.Context, r leaseRecord) error {
+	inspect, err := e.cli.ContainerInspect(ctx, r.Container)
+	if err != nil {
+		return err
+	}
+	if inspect.State == nil || !inspect.State.Running {
+		return fmt.Errorf("container %s is not running", r.Container)
+	}
+	if !containerHasLease(ctx, e.cli, r.Container) {
+		return fmt.Errorf("container %s holds no lease", r.Container)
+	}
+	return nil
+}
+
+// Renew has the container's DHCP client renew its lease.
+func (e *dockerEngine) Renew(ctx context.Context, r leaseRecord) error {
+	_, err := containerExec(ctx, e.cli, r.Container, []string{"sh", "-c", containerRenew})
+	return err
+}
+
+var rawCapabilities = engineCapabilities{Wireless: true}
+
+func (e *rawEngine) Name() string                     { return modeRaw }
+func (e *rawEngine) Capabilities() engineCapabilities { return rawCapabilities }
+
+// Launch acquires a lease for the spec's MAC, profile and client identifier,
+// which defaults to the MAC one. Images, DHCPv6 and client overrides do not
+// apply to packet-only clients.
+func (e *rawEngine) Launch(ctx context.Context, spec launchSpec) (launchResult, error) {
+	clientID := spec.ClientID
+	if clientID == nil && !spec.NoClientID {
+		clientID = append([]byte{1}, spec.MAC...)
+	}
+	lease, err := e.acquire(ctx, rawClient{MAC: spec.MAC, Profile: spec.Profile, Hostname: spec.Hostname, ClientID: clientID})
+	if err != nil {
+		return launchResult{}, err
+	}
+	result := launchResult{
+		MAC:       lease.MAC.String(),
+		IP:        lease.IP.String(),
+		LeaseTime: lease.LeaseTime,
+		Server:    lease.Server.String(),
+		ClientID:  formatClientID(lease.ClientID),
+	}
+	for _, server := range lease.DNS {
+		result.DNS = append(result.DNS, server.String())
+	}
+	return result, nil
+}
+
+func (e *rawEngine) Release(ctx context.Context, r leaseRecord) error {
+	mac, err := net.ParseMAC(r.MAC)
+	if err != nil {
+		return err
+	}
+	return e.release(mac)
+}
+
+// Verify reconfirms the lease with an INIT-REBOOT REQUEST under the client's
+// own identity.
+func (e *rawEngine) Verify(ctx context.Context, r leaseRecord) error {
+	mac, err := net.ParseMAC(r.MAC)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(r.IP)
+	if ip == nil {
+		return fmt.Errorf("invalid lease address %q", r.IP)
+	}
+	hostname, clientID := e.identity(mac)
+	reply, err := e.reconfirm(ctx, mac, ip, clientID, hostname)
+	switch {
+	case err != nil:
+		return err
+	case reply == nil:
+		return fmt.Errorf("no reply reconfirming %s for %s", ip, mac)
+	case reply.msgType() == dhcpNak:
+		return fmt.Errorf("server %w %s for %s", ErrNAK, ip, mac)
+	}
+	return nil
+}
+
+// Renew sends a RENEWING REQUEST for the lease under the client's own
+// identity.
+func (e *rawEngine) Renew(ctx context.Context, r leaseRecord) error {
+	mac, err := net.ParseMAC(r.MAC)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(r.IP)
+	if ip == nil {
+		return fmt.Errorf("invalid lease address %q", r.IP)
+	}
+	hostname, clientID := e.identity(mac)
+	reply, err := e.renew(ctx, mac, ip, clientID, hostname)
+	switch {
+	case err != nil:
+		return err
+	case reply == nil:
+		return fmt.Errorf("no reply renewing %s for %s", ip, mac)
+	case reply.msgType() == dhcpNak:
+		return fmt.Errorf("server %w renewal of %s for %s", ErrNAK, ip, mac)
+	}
+	return nil
+}
+
+// checkCapabilities refuses options the engine cannot honour and warns about
+// client options it will ignore.
+func checkCapabilities(e Engine, cfg Config) error {
+	caps := e.Capabilities()
+	if cfg.IPv6 && !caps.IPv6 {
+		return fmt.Errorf("the %s engine does not support -ipv6", e.Name())
+	}
+	if cfg.Host != "" && !caps.Remote {
+		return fmt.Errorf("the %s engine does not support -host", e.Name())
+	}
+	if (len(cfg.ClientDNS) > 0 || len(cfg.ClientNTP) > 0) && !caps.ClientOverrides {
+		slog.Warn("-client-dns and -client-ntp are ignored by this engine", "engine", e.Name())
+	}
+	if (len(cfg.Images) > 0 || cfg.Strategy != strategyRandom) && !caps.Images {
+		slog.Warn("-images and -strategy are ignored by this engine", "engine", e.Name())
+	}
+	if len(cfg.Dockerfiles) > 0 && !caps.Payloads {
+		slog.Warn("-dockerfiles is ignored by this engine", "engine", e.Name())
+	}
+	if cfg.DHCPClient != dhcpClientAuto && !caps.Images {
+		slog.Warn("-dhcp-client is ignored by this engine", "engine", e.Name())
+	}
+	if cfg.ClientInterface != defaultConfig().ClientInterface && !caps.Payloads {
+		slog.Warn("-client-interface is ignored by this engine", "engine", e.Name())
+	}
+	if (cfg.ContainerMemory != "" || cfg.ContainerCPUs > 0 || cfg.ReadOnly) && !caps.Payloads {
+		slog.Warn("-container-memory, -container-cpus and -read-only are ignored by this engine", "engine", e.Name())
+	}
+	if len(cfg.Traffic) > 0 && !caps.Payloads {
+		slog.Warn("-traffic is ignored by this engine", "engine", e.Name())
+	}
+	return nil
+}
+
+// engineInfo describes a known engine for the engines subcommand.
+type engineInfo struct {
+	Name         string
+	Description  string
+	Capabilities engineCapabilities
+	// check reports why the engine cannot run on this host, or nil.
+	check func(cfg Config) error
+}
+
+var engines = []engineInfo{
+	{modeDocker, "one container per lease on a macvlan network", dockerCapabilities, checkDockerEngine},
+	{modeRaw, "spoofed DHCP packets from a packet socket", rawCapabilities, checkRawEngine},
+	{modeNetns, "one network namespace with a macvlan interface and dhclient per lease", netnsCapabilities, checkNetnsEngine},
+	{modePD, "DHCPv6 prefix delegation (IA_PD) solicits under a DUID per client", pdCapabilities, checkPDEngine},
+	{modeK8s, "one pod per lease on a Kubernetes cluster, attached with a Multus macvlan or ipvlan network", k8sCapabilities, checkK8sEngine},
+	{modeSim, "simulated clients leasing from an in-memory pool, for rehearsing a run without touching a network", simCapabilities, checkSimEngine},
+}
+
+func checkDockerEngine(cfg Config) error {
+	cli, name, err := newContainerRuntime(cfg)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ping, err := cli.Ping(ctx)
+	if err != nil {
+		return fmt.Errorf("%s engine unreachable: %v", name, err)
+	}
+	if ping.APIVersion == "" {
+		return fmt.Errorf("%s engine did not report an API version", name)
+	}
+	return nil
+}
+
+func checkRawEngine(cfg Config) error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("needs root for a packet socket")
+	}
+	netCfg, err := detectNetwork(localHost, cfg.Interface, false)
+	if err != nil {
+		return err
+	}
+	conn, err := openPacketConn(netCfg.Parent, etherTypeIPv4)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// runEngines implements the engines subcommand: it lists the engines, their
+// capabilities and whether each can run on this host.
+func runEngines(args []string) {
+	cfg := defaultConfig()
+	fs := flag.NewFlagSet("engines", flag.ExitOnError)
+	fs.StringVar(&cfg.Interface, "interface", "", "Parent interface the raw engine is checked on (default: the default route's)")
+	fs.StringVar(&cfg.Runtime, "runtime", cfg.Runtime, "Container runtime the docker engine is checked with: docker, podman or auto")
+	fs.StringVar(&cfg.Host, "host", "", "Remote container engine to check, as for a run")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage:
+  ./ipocalypse engines [-interface name] [-runtime name] [-host url]
+
+Lists the client engines (-mode), what each supports and whether it can run
+on this host.
+
+Options:
+`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ENGINE\tSTATUS\tCAPABILITIES\tDESCRIPTION")
+	for _, e := range engines {
+		status := "available"
+		if err := e.check(cfg); err != nil {
+			status = "unavailable: " + err.Error()
+		}
+		caps := strings.Join(e.Capabilities.names(), ",")
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", e.Name, status, orDash(caps), e.Description)
+	}
+	w.Flush()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+)
+
+// Error classes of the build and launch paths. Errors are wrapped with %w so
+// callers decide with errors.Is instead of matching messages, and the
+// sentinels' texts keep the messages readable.
+var (
+	// ErrNoLease means a client got no address, which the workers take as
+	// an exhausted pool.
+	ErrNoLease = errors.New("did not receive an IP address")
+	// ErrAPIPA marks an ErrNoLease client that self-assigned a link-local
+	// address.
+	ErrAPIPA = errors.New("fell back to APIPA")
+	// ErrNAK means the server refused a REQUEST.
+	ErrNAK = errors.New("NAKed")
+	// ErrNoACK means the server made an offer but never acknowledged the
+	// REQUEST for it.
+	ErrNoACK = errors.New("no ACK")
+
+	// ErrContainerCreate and ErrContainerStart name the step a container
+	// launch failed in.
+	ErrContainerCreate = errors.New("failed to create container")
+	ErrContainerStart  = errors.New("failed to start container")
+	// ErrBuildFailed means a client image could not be built.
+	ErrBuildFailed = errors.New("image build failed")
+	// ErrNetworkMissing means the run's Docker network was deleted under it.
+	ErrNetworkMissing = errors.New("Docker network missing")
+	// ErrDaemonUnavailable means the container runtime could not be reached.
+	ErrDaemonUnavailable = errors.New("container daemon unavailable")
+)
+
+// runtimeError classifies an error returned by the container runtime,
+// marking connection failures with ErrDaemonUnavailable.
+func runtimeError(err error) error {
+	if err != nil && client.IsErrConnectionFailed(err) {
+		return fmt.Errorf("%w: %w", ErrDaemonUnavailable, err)
+	}
+	return err
+}
+
+// createError classifies a failure to create a client container: a run
+// network deleted under the run is ErrNetworkMissing, which the workers
+// repair.
+func createError(ctx context.Context, cli containerRuntime, networkName string, err error) error {
+	if client.IsErrNotFound(err) {
+		if _, inspectErr := cli.NetworkInspect(ctx, networkName, network.InspectOptions{}); client.IsErrNotFound(inspectErr) {
+			return fmt.Errorf("%w: %s: %w", ErrNetworkMissing, networkName, err)
+		}
+	}
+	return runtimeError(err)
+}
+
+// isDHCPOutcome reports whether err is the DHCP server's answer, or lack of
+// one, rather than a failure of the machinery around the client.
+func isDHCPOutcome(err error) bool {
+	return errors.Is(err, ErrNoLease) || errors.Is(err, ErrNAK) || errors.Is(err, ErrNoACK)
+}
+
+// failureKinds maps error classes to the kinds launch failures are counted
+// under, most specific first: an APIPA client also got no lease.
+var failureKinds = []struct {
+	err  error
+	kind string
+}{
+	{ErrAPIPA, "apipa"},
+	{ErrNoLease, "no_lease"},
+	{ErrNAK, "nak"},
+	{ErrNoACK, "no_ack"},
+	{ErrDaemonUnavailable, "daemon"},
+	{ErrNetworkMissing, "network"},
+	{ErrContainerCreate, "create"},
+	{ErrContainerStart, "start"},
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+)
+
+// etaWindow is how much recent lease history the exhaustion estimate is fitted
+// to; older samples describe a server that may have behaved differently.
+const etaWindow = 5 * time.Minute
+
+// etaEstimate is a time-to-exhaustion estimate.
+type etaEstimate struct {
+	Remaining  int
+	Rate       float64 // leases per minute
+	ETA        time.Duration
+	Confidence float64 // 0..1
+}
+
+// estimateExhaustion fits a line to the cumulative lease count over the recent
+// window and extrapolates it to the pool capacity. Confidence combines the fit
+// quality (R²) with how many samples back it. ok is false until enough leases
+// have been seen or when capacity is unknown.
+func estimateExhaustion(leases []time.Time, capacity int, now time.Time) (etaEstimate, bool) {
+	if capacity <= 0 || len(leases) < 3 {
+		return etaEstimate{}, false
+	}
+	remaining := capacity - len(leases)
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	// Only fit the recent part of the curve.
+	first := 0
+	for first < len(leases)-3 && now.Sub(leases[first]) > etaWindow {
+		first++
+	}
+	window := leases[first:]
+
+	// Least squares of cumulative count (y) against seconds since the
+	// window start (x). The current time is included at the last count so
+	// a stalled server drags the rate down instead of freezing the estimate.
+	var sumX, sumY, sumXY, sumXX, sumYY float64
+	addPoint := func(t time.Time, count int) {
+		x := t.Sub(window[0]).Seconds()
+		y := float64(count)
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+		sumYY += y * y
+	}
+	for i, t := range window {
+		addPoint(t, i+1)
+	}
+	addPoint(now, len(window))
+	n := float64(len(window) + 1)
+
+	denom := n*sumXX - sumX*sumX
+	if denom <= 0 {
+		return etaEstimate{}, false
+	}
+	slope := (n*sumXY - sumX*sumY) / denom
+	if slope <= 0 {
+		return etaEstimate{}, false
+	}
+	r := (n*sumXY - sumX*sumY) / math.Sqrt(denom*(n*sumYY-sumY*sumY))
+
+	est := etaEstimate{
+		Remaining:  remaining,
+		Rate:       slope * 60,
+		ETA:        time.Duration(float64(remaining)/slope) * time.Second,
+		Confidence: r * r * n / (n + 20),
+	}
+	return est, true
+}
+
+// String renders the estimate for status output.
+func (e etaEstimate) String() string {
+	return fmt.Sprintf("ETA to exhaustion ~%v (%d addresses left at %.1f leases/min, confidence %.0f%%)",
+		e.ETA.Round(time.Second), e.Remaining, e.Rate, e.Confidence*100)
+}
+
+// poolCapacity returns the number of leasable addresses in subnet, excluding
+// the network, broadcast, gateway and host addresses.
+func poolCapacity(netCfg *NetworkConfig) int {
+	ones, bits := netCfg.Subnet.Mask.Size()
+	if bits != 32 {
+		return 0
+	}
+	size := 1 << uint(bits-ones)
+	if size < 4 {
+		return 0
+	}
+	return size - 4
+}
+
+// reportStatus periodically prints a status line with the live exhaustion
+// estimate until ctx is cancelled.
+func reportStatus(ctx context.Context, stats *runStats, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-clock.After(interval):
+			slog.Info("status", "summary", stats.statusLine())
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import "errors"
+
+// Exit statuses of a run, so scripts can tell a run that did its job from
+// one that could not.
+const (
+	// exitOK: the run ended as intended, with the pool exhausted, the lease
+	// budget reached or launching stopped on request.
+	exitOK = 0
+	// exitFailed: the run stopped before it could do its job, e.g. after
+	// too many failed launches or a failed build.
+	exitFailed = 1
+	// exitConfig: the flags or configuration are invalid; nothing was
+	// started.
+	exitConfig = 2
+	// exitRuntime: the container engine could not be reached, at start-up
+	// or for good during the run.
+	exitRuntime = 3
+	// exitSignal: the run was interrupted by SIGINT or SIGTERM.
+	exitSignal = 130
+)
+
+// runError is the outcome of a run that stopped launching: nil when it ended
+// as intended, with the pool exhausted or the lease budget reached, or
+// stopped on request without an error; otherwise stopErr, the error that
+// stopped it.
+func runError(stats *runStats, budget *leaseBudget, stopErr error) error {
+	if stats.isExhausted() || budget.reached() {
+		return nil
+	}
+	return stopErr
+}
+
+// exitCode returns the exit status for the outcome of a run.
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, ErrDaemonUnavailable):
+		return exitRuntime
+	}
+	return exitFailed
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// renewScanInterval is how often the renewal schedule looks for leases
+	// due a renewal or past their expiry.
+	renewScanInterval = time.Second
+	// renewRetryMin is the shortest wait before a failed renewal is tried
+	// again; otherwise it is half the time left to expiry, as RFC 2131
+	// clients retransmit.
+	renewRetryMin = 10 * time.Second
+)
+
+// leaseRenewer keeps the run's leases held for as long as the run lasts, for
+// -renew-leases: each held lease is renewed at T1, half its lease time after
+// it was acquired or last renewed, as a real client would. Raw and pd clients
+// have no DHCP client process of their own, so without it their leases
+// quietly run out one lease time into a long engagement. A -let-expire share
+// of the clients is deliberately never renewed, to watch the server reclaim
+// their addresses. Either way, leases that pass their expiry are counted.
+type leaseRenewer struct {
+	renew   bool
+	lapse   float64
+	workers int
+	leases  *leaseTable
+	renewFn func(ctx context.Context, r leaseRecord) error
+
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu sync.Mutex
+	// clients tracks each lease seen, by IP and MAC.
+	clients  map[string]*renewalState
+	seen     int
+	renewed  int
+	failed   int
+	lapsing  int
+	expired  int
+	failures map[string]int
+}
+
+// renewalState is what the renewer knows of one lease.
+type renewalState struct {
+	// next is when the lease is next due a renewal attempt.
+	next     time.Time
+	inFlight bool
+	lapsing  bool
+	expired  bool
+}
+
+// newLeaseRenewer returns the renewer of -renew-leases and -let-expire, or
+// nil when neither is set. ownRenewals says whether the engine's clients
+// renew their leases on their own, which -let-expire cannot stop.
+func newLeaseRenewer(cfg Config, ownRenewals bool, leases *leaseTable, renew func(ctx context.Context, r leaseRecord) error) (*leaseRenewer, error) {
+	switch {
+	case cfg.LetExpire < 0 || cfg.LetExpire > 1:
+		return nil, fmt.Errorf("-let-expire must be between 0 and 1")
+	case cfg.LetExpire > 0 && !cfg.RenewLeases:
+		return nil, fmt.Errorf("-let-expire picks the clients -renew-leases leaves out; add -renew-leases")
+	case cfg.LetExpire > 0 && ownRenewals:
+		return nil, fmt.Errorf("-let-expire needs raw or pd mode; %s clients renew their leases on their own", cfg.Mode)
+	case !cfg.RenewLeases:
+		return nil, nil
+	case cfg.RenewWorkers < 1:
+		return nil, fmt.Errorf("-renew-workers must be at least 1")
+	}
+	return &leaseRenewer{
+		renew:    cfg.RenewLeases,
+		lapse:    cfg.LetExpire,
+		workers:  cfg.RenewWorkers,
+		leases:   leases,
+		renewFn:  renew,
+		clients:  make(map[string]*renewalState),
+		failures: make(map[string]int),
+	}, nil
+}
+
+// String describes the schedule for the run banner.
+func (s *leaseRenewer) String() string {
+	if s.lapse > 0 {
+		return fmt.Sprintf("at half their lease time, except %.0f%% of the clients left to expire", s.lapse*100)
+	}
+	return "at half their lease time"
+}
+
+// start runs the schedule in the background until ctx is done or stop is
+// called. A nil renewer does nothing.
+func (s *leaseRenewer) start(ctx context.Context) {
+	if s == nil {
+		return
+	}
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		sem := make(chan struct{}, s.workers)
+		var wg sync.WaitGroup
+		defer wg.Wait()
+		for ctx.Err() == nil {
+			for _, r := range s.due(clock.Now()) {
+				select {
+				case sem <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+				wg.Add(1)
+				go func(r leaseRecord) {
+					defer wg.Done()
+					defer func() { <-sem }()
+					s.renewLease(ctx, r)
+				}(r)
+			}
+			select {
+			case <-ctx.Done():
+			case <-clock.After(renewScanInterval):
+			}
+		}
+	}()
+}
+
+// stop ends the schedule and waits for the renewals in flight, so nothing
+// is renewed after the run starts releasing its leases. A nil renewer does
+// nothing.
+func (s *leaseRenewer) stop() {
+	if s == nil || s.cancel == nil {
+		return
+	}
+	s.cancel()
+	<-s.done
+}
+
+// due returns the held leases due a renewal at now. Leases seen for the
+// first time are scheduled, or picked to lapse, and leases past their expiry
+// are counted once.
+func (s *leaseRenewer) due(now time.Time) []leaseRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due []leaseRecord
+	for _, r := range s.leases.held() {
+		if r.ExpiresAt == nil {
+			continue
+		}
+		key := r.IP + "/" + r.MAC
+		state, ok := s.clients[key]
+		if !ok {
+			state = &renewalState{next: r.AcquiredAt.Add(time.Duration(r.LeaseSeconds) * time.Second / 2)}
+			s.clients[key] = state
+			s.seen++
+			// Every 1/lapse-th client lapses, so the share is exact and
+			// spread over the run.
+			if int(float64(s.seen)*s.lapse) > int(float64(s.seen-1)*s.lapse) {
+				state.lapsing = true
+				s.lapsing++
+				s.leases.markLapsing(r.IP, r.MAC)
+			}
+		}
+		if state.expired {
+			continue
+		}
+		if !now.Before(*r.ExpiresAt) {
+			state.expired = true
+			s.expired++
+			events.emit("lease_expired", map[string]any{"mac": r.MAC, "ip": r.IP, "lapsing": state.lapsing})
+			if !state.lapsing {
+				slog.Warn("lease expired before it could be renewed", "ip", r.IP, "mac", r.MAC)
+			}
+			continue
+		}
+		if state.lapsing || state.inFlight || now.Before(state.next) {
+			continue
+		}
+		state.inFlight = true
+		due = append(due, r)
+	}
+	return due
+}
+
+// renewLease renews one lease and schedules its next renewal: at T1 of the
+// renewed lease, or, after a failure, half the time left to expiry later.
+func (s *leaseRenewer) renewLease(ctx context.Context, r leaseRecord) {
+	err := s.renewFn(ctx, r)
+	if err == nil {
+		s.leases.markRenewed(r.IP, r.MAC)
+		events.emit("lease_renewed", map[string]any{"mac": r.MAC, "ip": r.IP, "lease_seconds": r.LeaseSeconds})
+	} else if ctx.Err() == nil {
+		slog.Warn("lease renewal failed", "ip", r.IP, "mac", r.MAC, "error", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.clients[r.IP+"/"+r.MAC]
+	state.inFlight = false
+	now := clock.Now()
+	switch {
+	case err == nil:
+		s.renewed++
+		state.next = now.Add(time.Duration(r.LeaseSeconds) * time.Second / 2)
+	case ctx.Err() != nil:
+	default:
+		s.failed++
+		s.failures[failureKind(err)]++
+		state.next = now.Add(max(r.ExpiresAt.Sub(now)/2, renewRetryMin))
+	}
+}
+
+// printSummary reports the schedule's renewals and the leases that expired.
+// A nil renewer prints nothing.
+func (s *leaseRenewer) printSummary() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Println("=== Lease Renewals ===")
+	fmt.Printf("Renewals:          %d succeeded, %d failed, of %d leases\n", s.renewed, s.failed, s.seen)
+	if s.lapse > 0 {
+		fmt.Printf("Left to expire:    %d clients\n", s.lapsing)
+	}
+	fmt.Printf("Expired:           %d leases\n", s.expired)
+	kinds := make([]string, 0, len(s.failures))
+	for kind := range s.failures {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Printf("  %-24s %d\n", kind, s.failures[kind])
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/stdcopy"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// fakeContainer is a client container of a fakeRuntime, whose DHCP client
+// gets its lease, or exits, at set times on the fake's clock.
+type fakeContainer struct {
+	// endpointIP and endpointIPv6 are Docker's IPAM addresses of the
+	// endpoint, which are not the leased ones.
+	endpointIP   string
+	endpointIPv6 string
+	// lease is the dhclient lease file, which appears leaseAfter after the
+	// container starts; empty for a client that never gets a lease.
+	lease      string
+	leaseAfter time.Duration
+	// exitAfter, when set, is when the container exits with exitCode.
+	exitAfter time.Duration
+	exitCode  int
+	// addrs is the output of `ip -4 -o addr show` in the container.
+	addrs string
+
+	id      string
+	config  *container.Config
+	created time.Time
+	started time.Time
+	removed bool
+}
+
+// fakeExec is a command run in a container of a fakeRuntime.
+type fakeExec struct {
+	container *fakeContainer
+	cmd       []string
+}
+
+// fakeRuntime is an in-memory containerRuntime covering what launching and
+// adopting clients needs: creating, starting, inspecting, listing and
+// removing containers, running commands in them and pinging the daemon.
+// Calls fail with ctx's error once it ends, as the Docker client's do. The
+// other methods of containerRuntime panic.
+type fakeRuntime struct {
+	containerRuntime
+
+	clock Clock
+	// network is the one network that exists.
+	network string
+	// newContainer returns the next container to create.
+	newContainer func() *fakeContainer
+	createErr    error
+	startErr     error
+
+	mu         sync.Mutex
+	containers map[string]*fakeContainer
+	execs      map[string]fakeExec
+}
+
+func newFakeRuntime(clock Clock, network string, newContainer func() *fakeContainer) *fakeRuntime {
+	return &fakeRuntime{
+		clock:        clock,
+		network:      network,
+		newContainer: newContainer,
+		containers:   make(map[string]*fakeContainer),
+		execs:        make(map[string]fakeExec),
+	}
+}
+
+func (f *fakeRuntime) lookup(ctx context.Context, id string) (*fakeContainer, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, ok := f.containers[id]
+	if !ok || c.removed {
+		return nil, errdefs.NotFound(fmt.Errorf("no such container: %s", id))
+	}
+	return c, nil
+}
+
+func (f *fakeRuntime) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *ocispec.Platform, containerName string) (container.CreateResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return container.CreateResponse{}, err
+	}
+	if f.createErr != nil {
+		return container.CreateResponse{}, f.createErr
+	}
+	for name := range networkingConfig.EndpointsConfig {
+		if name != f.network {
+			return container.CreateResponse{}, errdefs.NotFound(fmt.Errorf("network %s not found", name))
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := f.newContainer()
+	// IDs differ in their short form, as Docker's do.
+	c.id = fmt.Sprintf("%012x%052x", len(f.containers)+1, 0)
+	c.config = config
+	c.created = f.clock.Now()
+	f.containers[c.id] = c
+	return container.CreateResponse{ID: c.id}, nil
+}
+
+func (f *fakeRuntime) ContainerStart(ctx context.Context, containerID string, options container.StartOptions) error {
+	c, err := f.lookup(ctx, containerID)
+	if err != nil {
+		return err
+	}
+	if f.startErr != nil {
+		return f.startErr
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c.started = f.clock.Now()
+	return nil
+}
+
+func (f *fakeRuntime) ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
+	c, err := f.lookup(ctx, containerID)
+	if err != nil {
+		return types.ContainerJSON{}, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	state := &types.ContainerState{Running: !c.started.IsZero()}
+	if c.exitAfter > 0 && state.Running && f.clock.Since(c.started) >= c.exitAfter {
+		state.Running, state.ExitCode = false, c.exitCode
+	}
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{ID: c.id, Created: c.created.Format(time.RFC3339Nano), State: state},
+		Config:            c.config,
+		NetworkSettings: &types.NetworkSettings{Networks: map[string]*network.EndpointSettings{
+			f.network: {IPAddress: c.endpointIP, GlobalIPv6Address: c.endpointIPv6, MacAddress: "02:42:ac:11:00:02"},
+		}},
+	}, nil
+}
+
+// ContainerList lists the containers not removed, filtered by their labels
+// as the label filters of options ask.
+func (f *fakeRuntime) ContainerList(ctx context.Context, options container.ListOptions) ([]types.Container, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var list []types.Container
+	for _, c := range f.containers {
+		if c.removed || !options.Filters.MatchKVList("label", c.config.Labels) {
+			continue
+		}
+		state := "created"
+		if !c.started.IsZero() {
+			state = "running"
+		}
+		list = append(list, types.Container{ID: c.id, Labels: c.config.Labels, State: state})
+	}
+	return list, nil
+}
+
+func (f *fakeRuntime) ContainerRemove(ctx context.Context, containerID string, options container.RemoveOptions) error {
+	c, err := f.lookup(ctx, containerID)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c.removed = true
+	return nil
+}
+
+// Ping answers as a reachable daemon.
+func (f *fakeRuntime) Ping(ctx context.Context) (types.Ping, error) {
+	return types.Ping{}, ctx.Err()
+}
+
+func (f *fakeRuntime) NetworkInspect(ctx context.Context, networkID string, options network.InspectOptions) (network.Inspect, error) {
+	if networkID != f.network {
+		return network.Inspect{}, errdefs.NotFound(fmt.Errorf("network %s not found", networkID))
+	}
+	return network.Inspect{Name: f.network}, nil
+}
+
+func (f *fakeRuntime) ContainerExecCreate(ctx context.Context, containerID string, options container.ExecOptions) (types.IDResponse, error) {
+	c, err := f.lookup(ctx, containerID)
+	if err != nil {
+		return types.IDResponse{}, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := fmt.Sprintf("exec-%d", len(f.execs)+1)
+	f.execs[id] = fakeExec{container: c, cmd: options.Cmd}
+	return types.IDResponse{ID: id}, nil
+}
+
+// run returns what the command of exec prints and its exit code.
+func (f *fakeRuntime) run(exec fakeExec) (stdout, stderr string, exitCode int) {
+	c, cmd := exec.container, strings.Join(exec.cmd, " ")
+	switch {
+	case strings.Contains(cmd, "/var/lib/dhcp/dhclient*.leases"):
+		if c.lease == "" || f.clock.Since(c.started) < c.leaseAfter {
+			return "", "cat: can't open '/var/lib/dhcp/dhclient*.leases': No such file or directory\n", 1
+		}
+		return c.lease, "", 0
+	case strings.HasPrefix(cmd, "ip -4 -o addr show"):
+		return c.addrs, "", 0
+	}
+	return "", "", 0
+}
+
+func (f *fakeRuntime) ContainerExecAttach(ctx context.Context, execID string, config container.ExecAttachOptions) (types.HijackedResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return types.HijackedResponse{}, err
+	}
+	f.mu.Lock()
+	stdout, stderr, _ := f.run(f.execs[execID])
+	f.mu.Unlock()
+	var out bytes.Buffer
+	stdcopy.NewStdWriter(&out, stdcopy.Stdout).Write([]byte(stdout))
+	stdcopy.NewStdWriter(&out, stdcopy.Stderr).Write([]byte(stderr))
+	conn, peer := net.Pipe()
+	peer.Close()
+	return types.HijackedResponse{Conn: conn, Reader: bufio.NewReader(&out)}, nil
+}
+
+func (f *fakeRuntime) ContainerExecInspect(ctx context.Context, execID string) (container.ExecInspect, error) {
+	if err := ctx.Err(); err != nil {
+		return container.ExecInspect{}, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, _, exitCode := f.run(f.execs[execID])
+	return container.ExecInspect{ExecID: execID, ExitCode: exitCode}, nil
+}
+
+// removed reports whether the container with id was removed.
+func (f *fakeRuntime) removed(id string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, ok := f.containers[id]
+	return ok && c.removed
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxHostnameSamples bounds how many example hostnames a fingerprint keeps.
+const maxHostnameSamples = 3
+
+// clientFingerprint groups the real clients that present the same parameter
+// request list (option 55, in order) and vendor class (option 60), the two
+// fields DHCP fingerprinting engines key on.
+type clientFingerprint struct {
+	ParamRequest string `json:"param_request"`
+	VendorClass  string `json:"vendor_class,omitempty"`
+	// Profile is the built-in -profiles entry the fingerprint matches, or
+	// empty when none does.
+	Profile   string    `json:"profile,omitempty"`
+	MACs      []string  `json:"macs"`
+	Hostnames []string  `json:"hostnames,omitempty"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// fingerprintDB is the file of fingerprints seen on a subnet, added to by
+// every -observe and run so the picture of the legitimate device mix grows
+// across an engagement.
+type fingerprintDB struct {
+	Subnet       string               `json:"subnet"`
+	Fingerprints []*clientFingerprint `json:"fingerprints"`
+}
+
+// fingerprinter passively collects the fingerprints of clients requesting
+// leases. ours, when set, recognises the run's own clients, which are left
+// out of the report and the database.
+type fingerprinter struct {
+	ours func(mac net.HardwareAddr) bool
+
+	mu    sync.Mutex
+	byKey map[string]*clientFingerprint
+}
+
+func newFingerprinter(ours func(mac net.HardwareAddr) bool) *fingerprinter {
+	return &fingerprinter{ours: ours, byKey: make(map[string]*clientFingerprint)}
+}
+
+// record adds the sender of a client message seen at the given time to its
+// fingerprint. Messages without a parameter request list carry nothing to
+// fingerprint. A nil fingerprinter records nothing.
+func (f *fingerprinter) record(at time.Time, msg *dhcpMessage) {
+	if f == nil || msg.Op == bootReply {
+		return
+	}
+	if t := msg.msgType(); t != dhcpDiscover && t != dhcpRequest && t != dhcpInform {
+		return
+	}
+	params := msg.option(optParamRequest)
+	if len(params) == 0 {
+		return
+	}
+	vendor := string(msg.option(optVendorClass))
+	key := string(params) + "\x00" + vendor
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fp, ok := f.byKey[key]
+	if !ok {
+		fp = &clientFingerprint{
+			ParamRequest: paramList(params),
+			VendorClass:  vendor,
+			Profile:      matchProfile(params, vendor),
+			FirstSeen:    at,
+		}
+		f.byKey[key] = fp
+	}
+	fp.LastSeen = at
+	if mac := msg.CHAddr.String(); !slices.Contains(fp.MACs, mac) {
+		fp.MACs = append(fp.MACs, mac)
+	}
+	if hostname := string(msg.option(optHostname)); hostname != "" && len(fp.Hostnames) < maxHostnameSamples && !slices.Contains(fp.Hostnames, hostname) {
+		fp.Hostnames = append(fp.Hostnames, hostname)
+	}
+}
+
+// sniff records the client messages seen on iface until ctx is done.
+func (f *fingerprinter) sniff(ctx context.Context, iface string) error {
+	conn, err := openPacketConn(iface, etherTypeAll)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.setReadTimeout(500 * time.Millisecond); err != nil {
+		return fmt.Errorf("failed to set socket timeout: %v", err)
+	}
+	buf := make([]byte, 65536)
+	for ctx.Err() == nil {
+		n, err := conn.readFrame(buf)
+		if err != nil || n == 0 {
+			continue
+		}
+		frame, ok := parseUDPFrame(buf[:n])
+		if !ok || frame.DstPort != dhcpServerPort {
+			continue
+		}
+		if msg, err := parseDHCP(frame.Payload); err == nil {
+			f.record(clock.Now(), msg)
+		}
+	}
+	return nil
+}
+
+// watch fingerprints the clients on iface in the background for the rest of
+// the run.
+func (f *fingerprinter) watch(ctx context.Context, iface string) {
+	go func() {
+		if err := f.sniff(ctx, iface); err != nil {
+			slog.Warn("passive client fingerprinting disabled", "interface", iface, "error", err)
+		}
+	}()
+}
+
+// finish prints the device mix seen during a run and adds it to the
+// fingerprint database in dir, unless dir is empty.
+func (f *fingerprinter) finish(dir, subnet string) {
+	f.printReport()
+	if dir == "" {
+		return
+	}
+	path, err := f.save(dir, subnet)
+	if err != nil {
+		slog.Warn("fingerprint database not updated", "error", err)
+		return
+	}
+	fmt.Printf("Client fingerprints added to %s\n", path)
+}
+
+// real returns the fingerprints of real clients, most common first. The
+// run's own clients are filtered out here rather than when they are seen,
+// since a launch is only known to be ours once it has finished.
+func (f *fingerprinter) real() []*clientFingerprint {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var fps []*clientFingerprint
+	for _, fp := range f.byKey {
+		copied := *fp
+		copied.MACs = nil
+		for _, s := range fp.MACs {
+			if mac, err := net.ParseMAC(s); err == nil && f.ours != nil && f.ours(mac) {
+				continue
+			}
+			copied.MACs = append(copied.MACs, s)
+		}
+		if len(copied.MACs) > 0 {
+			fps = append(fps, &copied)
+		}
+	}
+	sortFingerprints(fps)
+	return fps
+}
+
+// sortFingerprints orders fingerprints by client count, most common first.
+func sortFingerprints(fps []*clientFingerprint) {
+	sort.Slice(fps, func(i, j int) bool {
+		if len(fps[i].MACs) != len(fps[j].MACs) {
+			return len(fps[i].MACs) > len(fps[j].MACs)
+		}
+		return fps[i].ParamRequest < fps[j].ParamRequest
+	})
+}
+
+// printReport writes the legitimate device mix and a -profiles value that
+// reproduces it with the built-in profiles. A nil fingerprinter prints
+// nothing.
+func (f *fingerprinter) printReport() {
+	if f == nil {
+		return
+	}
+	fps := f.real()
+	fmt.Println("=== Legitimate Device Mix ===")
+	if len(fps) == 0 {
+		fmt.Println("No real clients requested leases")
+		return
+	}
+	total := 0
+	for _, fp := range fps {
+		total += len(fp.MACs)
+	}
+	fmt.Printf("Real clients:      %d with %d distinct fingerprints\n", total, len(fps))
+	weights := make(map[string]int)
+	for _, fp := range fps {
+		profile := fp.Profile
+		if profile == "" {
+			profile = "unknown"
+		} else {
+			weights[fp.Profile] += len(fp.MACs)
+		}
+		fmt.Printf("  %4d (%5.1f%%)  %-14s option 55 %s", len(fp.MACs), float64(len(fp.MACs))/float64(total)*100, profile, fp.ParamRequest)
+		if fp.VendorClass != "" {
+			fmt.Printf("  vendor %q", fp.VendorClass)
+		}
+		if len(fp.Hostnames) > 0 {
+			fmt.Printf("  e.g. %s", strings.Join(fp.Hostnames, ", "))
+		}
+		fmt.Println()
+	}
+	if len(weights) == 0 {
+		fmt.Println("No fingerprint matches a built-in profile")
+		return
+	}
+	names := make([]string, 0, len(weights))
+	for name := range weights {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if weights[names[i]] != weights[names[j]] {
+			return weights[names[i]] > weights[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	specs := make([]string, len(names))
+	for i, name := range names {
+		specs[i] = fmt.Sprintf("%s:%d", name, weights[name])
+	}
+	fmt.Printf("Matching profiles: -profiles=%s\n", strings.Join(specs, ","))
+}
+
+// save merges the real clients' fingerprints into the database for subnet in
+// dir and returns the file path.
+func (f *fingerprinter) save(dir, subnet string) (string, error) {
+	path := subnetFile(dir, "fingerprints", subnet)
+	db := &fingerprintDB{Subnet: subnet}
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, db); err != nil {
+			return "", fmt.Errorf("failed to parse fingerprint database %s: %v", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read fingerprint database: %v", err)
+	}
+	for _, fp := range f.real() {
+		var known *clientFingerprint
+		for _, old := range db.Fingerprints {
+			if old.ParamRequest == fp.ParamRequest && old.VendorClass == fp.VendorClass {
+				known = old
+				break
+			}
+		}
+		if known == nil {
+			db.Fingerprints = append(db.Fingerprints, fp)
+			continue
+		}
+		known.Profile = fp.Profile
+		known.LastSeen = fp.LastSeen
+		for _, mac := range fp.MACs {
+			if !slices.Contains(known.MACs, mac) {
+				known.MACs = append(known.MACs, mac)
+			}
+		}
+		for _, hostname := range fp.Hostnames {
+			if len(known.Hostnames) < maxHostnameSamples && !slices.Contains(known.Hostnames, hostname) {
+				known.Hostnames = append(known.Hostnames, hostname)
+			}
+		}
+	}
+	sortFingerprints(db.Fingerprints)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create baseline directory: %v", err)
+	}
+	data, err := json.MarshalIndent(db, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return "", fmt.Errorf("failed to write fingerprint database: %v", err)
+	}
+	return path, nil
+}
+
+// vendorClassProfiles maps vendor class prefixes to the built-in profile of
+// the same device class, for clients whose parameter list differs from the
+// profile's, e.g. another OS release.
+var vendorClassProfiles = []struct {
+	prefix  string
+	profile string
+}{
+	{"MSFT", "windows"},
+	{"android-dhcp", "android"},
+	{"Hewlett-Packard", "hp-printer"},
+	{"Polycom", "polycom-phone"},
+	{"udhcp", "iot"},
+}
+
+// matchProfile returns the built-in profile a fingerprint matches: the one
+// with the same parameter request list, else the one its vendor class
+// belongs to, else "".
+func matchProfile(params []byte, vendor string) string {
+	for name, profile := range deviceProfiles {
+		if bytes.Equal(profile.ParamRequest, params) && (profile.VendorClass == "" || profile.VendorClass == vendor) {
+			return name
+		}
+	}
+	for _, v := range vendorClassProfiles {
+		if strings.HasPrefix(vendor, v.prefix) {
+			return v.profile
+		}
+	}
+	return ""
+}
+
+// paramList formats a parameter request list as comma-separated codes.
+func paramList(params []byte) string {
+	codes := make([]string, len(params))
+	for i, code := range params {
+		codes[i] = strconv.Itoa(int(code))
+	}
+	return strings.Join(codes, ",")
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Firewall frameworks the -internet NAT rule can be managed through.
+const (
+	firewallFirewalld = "firewalld"
+	firewallNftables  = "nftables"
+	firewallIptables  = "iptables"
+)
+
+// nftTable is the nftables table holding the run's NAT rule, so it can be
+// removed in one step without touching the host's own ruleset.
+const nftTable = "ipocalypse"
+
+// natStatePath records on the engine's host how -internet set up NAT, so
+// cleanup, often in a later process, undoes exactly that. /run is cleared on
+// reboot, as are the runtime rules it describes.
+const natStatePath = "/run/ipocalypse-nat.json"
+
+// natState is what enableNAT changed on the host.
+type natState struct {
+	Firewall string `json:"firewall"`
+	Subnet   string `json:"subnet"`
+	// Zone is the firewalld zone the masquerade rule was added to.
+	Zone string `json:"zone,omitempty"`
+	// IPForward is net.ipv4.ip_forward before the run turned it on.
+	IPForward string `json:"ip_forward"`
+}
+
+// detectFirewall reports which framework manages the host's firewall.
+// firewalld reverts rules added behind its back on reload and nftables-only
+// hosts may lack iptables, so the NAT rule goes through whichever is active.
+func detectFirewall(host *hostShell) string {
+	if out, err := host.command("firewall-cmd", "--state").Output(); err == nil && strings.TrimSpace(string(out)) == "running" {
+		return firewallFirewalld
+	}
+	if host.command("iptables", "-V").Run() != nil && host.command("nft", "--version").Run() == nil {
+		return firewallNftables
+	}
+	if out, err := host.command("nft", "list", "ruleset").Output(); err == nil && len(strings.TrimSpace(string(out))) > 0 {
+		// Adding legacy iptables rules next to an nftables ruleset leaves
+		// two firewalls evaluating the same packets.
+		if v, err := host.command("iptables", "-V").Output(); err == nil && strings.Contains(string(v), "legacy") {
+			return firewallNftables
+		}
+	}
+	return firewallIptables
+}
+
+// enableNAT turns on IPv4 forwarding and masquerades traffic from the container
+// subnet leaving through parent, using the host's active firewall framework.
+// The rule is only added if it is not already present, and the previous
+// forwarding setting is recorded for cleanup.
+func enableNAT(host *hostShell, parent, subnet string) error {
+	state := &natState{Firewall: detectFirewall(host), Subnet: subnet}
+	if prev, err := loadNATState(host); err == nil && prev != nil && prev.Subnet == subnet {
+		// A previous run was not cleaned up; keep its original setting.
+		state.IPForward = prev.IPForward
+	} else if data, err := host.readFile("/proc/sys/net/ipv4/ip_forward"); err == nil {
+		state.IPForward = strings.TrimSpace(string(data))
+	}
+	if err := host.writeFile("/proc/sys/net/ipv4/ip_forward", []byte("1")); err != nil {
+		return fmt.Errorf("failed to enable IP forwarding: %v", err)
+	}
+
+	var present bool
+	var err error
+	switch state.Firewall {
+	case firewallFirewalld:
+		if state.Zone, err = firewalldZone(host, parent); err != nil {
+			return err
+		}
+		rule := firewalldRule(subnet)
+		present = host.command("firewall-cmd", "--zone="+state.Zone, "--query-rich-rule="+rule).Run() == nil
+		if !present {
+			// Runtime only: firewalld drops it on reload or restart rather
+			// than keeping it in the permanent configuration.
+			err = runFirewall(host, "firewall-cmd", "--zone="+state.Zone, "--add-rich-rule="+rule)
+		}
+	case firewallNftables:
+		present = host.command("nft", "list", "table", "ip", nftTable).Run() == nil
+		if !present {
+			cmd := host.command("nft", "-f", "-")
+			cmd.Stdin = strings.NewReader(nftRuleset(subnet))
+			if out, cmdErr := cmd.CombinedOutput(); cmdErr != nil {
+				err = fmt.Errorf("%v: %s", cmdErr, strings.TrimSpace(string(out)))
+			}
+		}
+	default:
+		present = host.command("iptables", natRule("-C", subnet)...).Run() == nil
+		if !present {
+			err = runFirewall(host, "iptables", natRule("-A", subnet)...)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to add NAT rule with %s: %v", state.Firewall, err)
+	}
+	if err := saveNATState(host, state); err != nil {
+		return err
+	}
+	how := state.Firewall
+	if state.Zone != "" {
+		how += " zone " + state.Zone
+	}
+	if present {
+		fmt.Printf("Internet access enabled (NAT rule already present, %s)\n", how)
+	} else {
+		fmt.Printf("Internet access enabled (%s)\n", how)
+	}
+	return nil
+}
+
+// disableNAT removes the NAT rule enableNAT added and restores IP forwarding.
+// Without a recorded state, e.g. after a run that predates it, the iptables
+// rule for subnet is removed if present.
+func disableNAT(host *hostShell, subnet string) (string, error) {
+	state, err := loadNATState(host)
+	if err != nil {
+		return "", err
+	}
+	if state == nil {
+		if subnet == "" {
+			return "container subnet unknown, NAT rules not checked", nil
+		}
+		if host.command("iptables", natRule("-C", subnet)...).Run() != nil {
+			return "no NAT rule for " + subnet, nil
+		}
+		if err := runFirewall(host, "iptables", natRule("-D", subnet)...); err != nil {
+			return "", fmt.Errorf("failed to remove NAT rule: %v", err)
+		}
+		return "NAT rule for " + subnet + " removed", nil
+	}
+
+	var notes []string
+	switch state.Firewall {
+	case firewallFirewalld:
+		rule := firewalldRule(state.Subnet)
+		if host.command("firewall-cmd", "--zone="+state.Zone, "--query-rich-rule="+rule).Run() == nil {
+			err = runFirewall(host, "firewall-cmd", "--zone="+state.Zone, "--remove-rich-rule="+rule)
+		}
+		notes = append(notes, fmt.Sprintf("firewalld masquerade rule for %s removed from zone %s", state.Subnet, state.Zone))
+	case firewallNftables:
+		if host.command("nft", "list", "table", "ip", nftTable).Run() == nil {
+			err = runFirewall(host, "nft", "delete", "table", "ip", nftTable)
+		}
+		notes = append(notes, fmt.Sprintf("nftables table %s removed", nftTable))
+	default:
+		if host.command("iptables", natRule("-C", state.Subnet)...).Run() == nil {
+			err = runFirewall(host, "iptables", natRule("-D", state.Subnet)...)
+		}
+		notes = append(notes, "NAT rule for "+state.Subnet+" removed")
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to remove NAT rule with %s: %v", state.Firewall, err)
+	}
+	if state.IPForward != "" && state.IPForward != "1" {
+		if err := host.writeFile("/proc/sys/net/ipv4/ip_forward", []byte(state.IPForward)); err != nil {
+			return "", fmt.Errorf("failed to restore IP forwarding: %v", err)
+		}
+		notes = append(notes, "IP forwarding restored to "+state.IPForward)
+	}
+	if out, err := host.command("rm", "-f", natStatePath).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("failed to remove %s: %v: %s", natStatePath, err, strings.TrimSpace(string(out)))
+	}
+	return strings.Join(notes, ", "), nil
+}
+
+// firewalldZone returns the zone of the parent interface, or the default zone
+// it falls into when it has none.
+func firewalldZone(host *hostShell, parent string) (string, error) {
+	if out, err := host.command("firewall-cmd", "--get-zone-of-interface="+parent).Output(); err == nil {
+		if zone := strings.TrimSpace(string(out)); zone != "" {
+			return zone, nil
+		}
+	}
+	out, err := host.command("firewall-cmd", "--get-default-zone").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to find the firewalld zone of %s: %v", parent, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// firewalldRule is the rich rule masquerading the container subnet.
+func firewalldRule(subnet string) string {
+	return fmt.Sprintf(`rule family="ipv4" source address="%s" masquerade`, subnet)
+}
+
+// nftRuleset is the nftables table masquerading the container subnet.
+func nftRuleset(subnet string) string {
+	return fmt.Sprintf(`table ip %s {
+	chain postrouting {
+		type nat hook postrouting priority 100; policy accept;
+		ip saddr %s masquerade
+	}
+}
+`, nftTable, subnet)
+}
+
+// natRule returns the iptables arguments that apply op (-A, -C or -D) to the
+// masquerade rule for the container subnet.
+func natRule(op, subnet string) []string {
+	return []string{"-t", "nat", op, "POSTROUTING", "-s", subnet, "-j", "MASQUERADE"}
+}
+
+// runFirewall runs a firewall command, returning its output on failure.
+func runFirewall(host *hostShell, name string, args ...string) error {
+	if out, err := host.command(name, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func loadNATState(host *hostShell) (*natState, error) {
+	if !host.exists(natStatePath) {
+		return nil, nil
+	}
+	data, err := host.readFile(natStatePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read NAT state: %v", err)
+	}
+	var state natState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse NAT state %s: %v", natStatePath, err)
+	}
+	return &state, nil
+}
+
+func saveNATState(host *hostShell, state *natState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := host.writeFile(natStatePath, data); err != nil {
+		return fmt.Errorf("failed to record NAT state: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const (
+	// fuzzRecheck is how often an unresponsive server is probed again.
+	fuzzRecheck = 5 * time.Second
+	// fuzzRecovery is how long an unresponsive server is given to come back
+	// before the fuzz run stops.
+	fuzzRecovery = time.Minute
+)
+
+// fuzzCase builds one malformed client message.
+type fuzzCase struct {
+	Name  string
+	build func(xid uint32, mac net.HardwareAddr) []byte
+}
+
+// fuzzFinding is a case after which the server stopped answering.
+type fuzzFinding struct {
+	Case string
+	// Recovered is how long the server took to answer again, or 0 when it
+	// never did.
+	Recovered time.Duration
+}
+
+// fuzzHeader returns the BOOTP header and magic cookie of a DISCOVER from mac,
+// without any options.
+func fuzzHeader(xid uint32, mac net.HardwareAddr) []byte {
+	msg := newDHCPRequest(dhcpDiscover, xid, mac)
+	msg.Options = nil
+	return msg.marshal()[:dhcpFixedLen+len(dhcpMagicCookie)]
+}
+
+// fuzzDiscover returns a DISCOVER from mac whose options are the given raw
+// bytes, followed by nothing: no end option and no padding unless included.
+func fuzzDiscover(xid uint32, mac net.HardwareAddr, options ...byte) []byte {
+	return append(fuzzHeader(xid, mac), options...)
+}
+
+// fuzzCases are the fixed malformations every fuzz run sends, aimed at the
+// option parsing of common servers.
+var fuzzCases = []fuzzCase{
+	{"option length past the end of the packet", func(xid uint32, mac net.HardwareAddr) []byte {
+		return fuzzDiscover(xid, mac, optMessageType, 1, dhcpDiscover, optHostname, 200, 'h', 'o', 's', 't')
+	}},
+	{"empty message type", func(xid uint32, mac net.HardwareAddr) []byte {
+		return fuzzDiscover(xid, mac, optMessageType, 0, optEnd)
+	}},
+	{"unknown message type", func(xid uint32, mac net.HardwareAddr) []byte {
+		return fuzzDiscover(xid, mac, optMessageType, 1, 0xff, optEnd)
+	}},
+	{"conflicting message types", func(xid uint32, mac net.HardwareAddr) []byte {
+		return fuzzDiscover(xid, mac, optMessageType, 1, dhcpDiscover, optMessageType, 1, dhcpRequest, optEnd)
+	}},
+	{"missing end option", func(xid uint32, mac net.HardwareAddr) []byte {
+		return fuzzDiscover(xid, mac, optMessageType, 1, dhcpDiscover, optClientID, 7, 1, mac[0], mac[1], mac[2], mac[3], mac[4], mac[5])
+	}},
+	{"header without magic cookie", func(xid uint32, mac net.HardwareAddr) []byte {
+		return fuzzHeader(xid, mac)[:dhcpFixedLen]
+	}},
+	{"oversized hardware address length", func(xid uint32, mac net.HardwareAddr) []byte {
+		b := fuzzDiscover(xid, mac, optMessageType, 1, dhcpDiscover, optEnd)
+		b[2] = 0xff
+		return b
+	}},
+	{"empty client identifier", func(xid uint32, mac net.HardwareAddr) []byte {
+		return fuzzDiscover(xid, mac, optMessageType, 1, dhcpDiscover, optClientID, 0, optEnd)
+	}},
+	{"full parameter request list", func(xid uint32, mac net.HardwareAddr) []byte {
+		options := []byte{optMessageType, 1, dhcpDiscover, optParamRequest, 255}
+		for code := 0; code < 255; code++ {
+			options = append(options, byte(code))
+		}
+		return fuzzDiscover(xid, mac, append(options, optEnd)...)
+	}},
+	{"format string hostname", func(xid uint32, mac net.HardwareAddr) []byte {
+		hostname := []byte("%s%s%s%n%x%x")
+		options := append([]byte{optMessageType, 1, dhcpDiscover, optHostname, byte(len(hostname))}, hostname...)
+		return fuzzDiscover(xid, mac, append(options, optEnd)...)
+	}},
+	{"option overload into garbage sname and file", func(xid uint32, mac net.HardwareAddr) []byte {
+		b := fuzzDiscover(xid, mac, optMessageType, 1, dhcpDiscover, 52, 1, 3, optEnd)
+		for i := 44; i < dhcpFixedLen; i++ {
+			b[i] = 0xfe
+		}
+		return b
+	}},
+}
+
+// randomFuzzCase returns a DISCOVER with random option codes and contents,
+// whose declared lengths may not match the data that follows.
+func randomFuzzCase(n int) fuzzCase {
+	return fuzzCase{fmt.Sprintf("random options #%d", n), func(xid uint32, mac net.HardwareAddr) []byte {
+		options := []byte{optMessageType, 1, dhcpDiscover}
+		for i := rand.Intn(16) + 1; i > 0; i-- {
+			length := rand.Intn(64)
+			options = append(options, byte(rand.Intn(254)+1), byte(length))
+			if rand.Intn(4) == 0 {
+				length = rand.Intn(64)
+			}
+			for j := 0; j < length; j++ {
+				options = append(options, byte(rand.Intn(256)))
+			}
+		}
+		return fuzzDiscover(xid, mac, append(options, optEnd)...)
+	}}
+}
+
+// runFuzz sends the fixed malformed messages and cfg.FuzzCases random ones,
+// each followed by a well-formed canary DISCOVER, and reports every case
+// after which the server stopped offering addresses. A server that does not
+// recover within fuzzRecovery ends the run.
+func runFuzz(cfg Config) error {
+	netCfg, err := detectNetwork(localHost, cfg.Interface, cfg.VLAN > 0)
+	if err != nil {
+		return err
+	}
+	macs, err := newMACGenerator(cfg.MACPools)
+	if err != nil {
+		return err
+	}
+	engine, err := newRawEngine(netCfg.Parent)
+	if err != nil {
+		return err
+	}
+	defer engine.conn.Close()
+	if err := checkCapabilities(engine, cfg); err != nil {
+		return err
+	}
+	if isWireless(localHost, netCfg.Parent) {
+		engine.srcMAC = engine.conn.iface.HardwareAddr
+		fmt.Printf("Wireless parent detected: sending every frame from the adapter's own MAC %s\n", engine.srcMAC)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go engine.receive(ctx)
+
+	cases := append([]fuzzCase(nil), fuzzCases...)
+	for i := 1; i <= cfg.FuzzCases; i++ {
+		cases = append(cases, randomFuzzCase(i))
+	}
+	fmt.Printf("Fuzzing the DHCP server on %s (subnet %s) with %d malformed DISCOVERs\n", netCfg.Parent, netCfg.Subnet, len(cases))
+	// A server that does not answer a canary before any fuzzing says nothing
+	// about the cases.
+	if ok, err := engine.canary(ctx, macs.Next()); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("no offer for a well-formed DISCOVER before fuzzing; check the interface and DHCP server")
+	}
+
+	var findings []fuzzFinding
+	sent := 0
+	for _, c := range cases {
+		mac := macs.Next()
+		if err := engine.sendPayload(mac, c.build(rand.Uint32(), mac)); err != nil {
+			return fmt.Errorf("failed to send %s: %v", c.Name, err)
+		}
+		sent++
+		ok, err := engine.canary(ctx, macs.Next())
+		if err != nil {
+			break
+		}
+		if ok {
+			continue
+		}
+		fmt.Printf("Server stopped answering after case %d: %s\n", sent, c.Name)
+		finding := fuzzFinding{Case: c.Name}
+		start := clock.Now()
+		for !ok && clock.Since(start) < fuzzRecovery && ctx.Err() == nil {
+			clock.Sleep(fuzzRecheck)
+			ok, _ = engine.canary(ctx, macs.Next())
+		}
+		if ok {
+			finding.Recovered = clock.Since(start)
+			fmt.Printf("Server answering again after %s\n", finding.Recovered.Round(time.Second))
+		}
+		findings = append(findings, finding)
+		if !ok {
+			break
+		}
+	}
+	printFuzzReport(sent, len(cases), findings)
+	return nil
+}
+
+// canary reports whether the server offers an address to a well-formed
+// DISCOVER from mac. The offer is not taken, so no lease is consumed.
+func (e *rawEngine) canary(ctx context.Context, mac net.HardwareAddr) (bool, error) {
+	discover := newDHCPRequest(dhcpDiscover, rand.Uint32(), mac)
+	discover.addOption(optClientID, append([]byte{1}, mac...))
+	discover.addOption(optParamRequest, []byte{optSubnetMask, optRouter, optDNS, optLeaseTime, optServerID})
+	offer, err := e.transact(ctx, discover, 2, 3*time.Second, dhcpOffer)
+	return offer != nil, err
+}
+
+// printFuzzReport writes how many cases were sent and the ones the server did
+// not survive unharmed.
+func printFuzzReport(sent, total int, findings []fuzzFinding) {
+	fmt.Println("=== Fuzz Results ===")
+	fmt.Printf("Cases sent:        %d of %d\n", sent, total)
+	if len(findings) == 0 {
+		fmt.Println("The server answered a canary DISCOVER after every case")
+		return
+	}
+	for _, f := range findings {
+		outcome := "did not recover"
+		if f.Recovered > 0 {
+			outcome = "recovered after " + f.Recovered.Round(time.Second).String()
+		}
+		fmt.Printf("  %-45s server stopped answering, %s\n", f.Case, outcome)
+	}
+}
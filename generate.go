@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// templateFiles holds the layers image templates are rendered from: the
+// templates directory, and the client scripts of the built-in and basic
+// images, so generated images keep up with them.
+//
+//go:embed templates default_image ipocalypse_basic_image/entrypoint.sh
+var templateFiles embed.FS
+
+// imageTemplate is a build context `generate` writes out.
+type imageTemplate struct {
+	Name        string
+	Description string
+	// layers are the embedded directories the context is made of, a later
+	// layer's file replacing an earlier one of the same name. Files ending
+	// in .tmpl are rendered with the parameters and lose the suffix; a
+	// rendered file left empty is not written.
+	layers []string
+	params []templateParam
+}
+
+// templateParam is a value a template is rendered with, set with -set.
+type templateParam struct {
+	Name, Default, Help string
+	check               func(string) error
+}
+
+// Parameters the templates share.
+var (
+	paramPackages  = templateParam{Name: "packages", Help: "Extra packages to install, space-separated"}
+	paramInterface = templateParam{Name: "interface", Help: "Manifest interface the client runs on, if not -client-interface"}
+)
+
+func paramBase(image string) templateParam {
+	return templateParam{Name: "base", Default: image, Help: "Base image"}
+}
+
+func paramProfile(profile string) templateParam {
+	return templateParam{Name: "profile", Default: profile, Help: "Device profile the manifest pins (see -profiles)", check: checkTemplateProfile}
+}
+
+func paramPort(port, help string) templateParam {
+	return templateParam{Name: "port", Default: port, Help: help, check: checkTemplatePort}
+}
+
+// imageTemplates are the built-in templates, in the order `generate -list`
+// shows them.
+var imageTemplates = []imageTemplate{
+	{
+		Name:        "debian-dhclient",
+		Description: "Debian with ISC dhclient, like ipocalypse_basic_image",
+		layers:      []string{"ipocalypse_basic_image", "templates/common", "templates/debian-dhclient"},
+		params:      []templateParam{paramBase("debian:bookworm-slim"), paramPackages, paramProfile(""), paramInterface},
+	},
+	{
+		Name:        "alpine-udhcpc",
+		Description: "Alpine with BusyBox udhcpc, like the built-in image",
+		layers:      []string{"default_image", "templates/common", "templates/alpine-udhcpc"},
+		params:      []templateParam{paramBase("alpine:3.20"), paramPackages, paramProfile(""), paramInterface},
+	},
+	{
+		Name:        "printer-profile",
+		Description: "Network printer: printer fingerprint, raw print port open and probed",
+		layers:      []string{"default_image", "templates/device", "templates/printer-profile"},
+		params:      []templateParam{paramBase("alpine:3.20"), paramPackages, paramProfile("hp-printer"), paramInterface, paramPort("9100", "TCP port print jobs are accepted on")},
+	},
+	{
+		Name:        "voip-profile",
+		Description: "Desk phone: VoIP fingerprint, SIP port open",
+		layers:      []string{"default_image", "templates/device", "templates/voip-profile"},
+		params:      []templateParam{paramBase("alpine:3.20"), paramPackages, paramProfile("polycom-phone"), paramInterface, paramPort("5060", "UDP port SIP is received on")},
+	},
+}
+
+// lookupTemplate returns the named template.
+func lookupTemplate(name string) (*imageTemplate, error) {
+	var names []string
+	for i := range imageTemplates {
+		if imageTemplates[i].Name == name {
+			return &imageTemplates[i], nil
+		}
+		names = append(names, imageTemplates[i].Name)
+	}
+	return nil, fmt.Errorf("unknown template %q (available: %s)", name, strings.Join(names, ", "))
+}
+
+func checkTemplateProfile(name string) error {
+	if name == "" {
+		return nil
+	}
+	_, err := lookupProfile(name)
+	return err
+}
+
+func checkTemplatePort(s string) error {
+	if port, err := strconv.Atoi(s); err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("invalid port '%s'", s)
+	}
+	return nil
+}
+
+// values returns the template's parameters with set applied over the
+// defaults.
+func (t *imageTemplate) values(set map[string]string) (map[string]string, error) {
+	values := make(map[string]string, len(t.params))
+	for _, p := range t.params {
+		values[p.Name] = p.Default
+	}
+	for name, value := range set {
+		if _, ok := values[name]; !ok {
+			return nil, fmt.Errorf("template %s has no parameter %q (see generate -list)", t.Name, name)
+		}
+		values[name] = value
+	}
+	for _, p := range t.params {
+		if p.check == nil {
+			continue
+		}
+		if err := p.check(values[p.Name]); err != nil {
+			return nil, fmt.Errorf("%s: %v", p.Name, err)
+		}
+	}
+	return values, nil
+}
+
+// render returns the files of the template's build context by name.
+func (t *imageTemplate) render(values map[string]string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	for _, layer := range t.layers {
+		entries, err := fs.ReadDir(templateFiles, layer)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			data, err := fs.ReadFile(templateFiles, path.Join(layer, entry.Name()))
+			if err != nil {
+				return nil, err
+			}
+			name, isTemplate := strings.CutSuffix(entry.Name(), ".tmpl")
+			if isTemplate {
+				tmpl, err := template.New(name).Option("missingkey=error").Parse(string(data))
+				if err != nil {
+					return nil, fmt.Errorf("template %s: %v", path.Join(layer, entry.Name()), err)
+				}
+				var out bytes.Buffer
+				if err := tmpl.Execute(&out, values); err != nil {
+					return nil, fmt.Errorf("template %s: %v", path.Join(layer, entry.Name()), err)
+				}
+				data = out.Bytes()
+			}
+			if len(bytes.TrimSpace(data)) == 0 {
+				delete(files, name)
+				continue
+			}
+			files[name] = data
+		}
+	}
+	return files, nil
+}
+
+// writeTemplate writes the rendered files into dir, creating it. Scripts are
+// made executable.
+func writeTemplate(dir string, files map[string][]byte, force bool) ([]string, error) {
+	if _, err := os.Stat(dir); err == nil && !force {
+		return nil, fmt.Errorf("%s already exists; choose another -name or overwrite its files with -force", dir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", dir, err)
+	}
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		mode := os.FileMode(0644)
+		if bytes.HasPrefix(files[name], []byte("#!")) {
+			mode = 0755
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), files[name], mode); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %v", name, err)
+		}
+	}
+	return names, nil
+}
+
+// runGenerate writes an ipocalypse_* build context from a built-in template.
+func runGenerate(args []string) {
+	fs := flag.NewFlagSet("generate", flag.ExitOnError)
+	dir := fs.String("dir", ".", "Directory to create the build context in")
+	name := fs.String("name", "", "Name of the build context directory (default: ipocalypse_<template>)")
+	force := fs.Bool("force", false, "Overwrite the files of an existing directory")
+	list := fs.Bool("list", false, "List the templates and their parameters")
+	set := make(map[string]string)
+	fs.Func("set", "Template parameter as key=value; repeatable", func(s string) error {
+		key, value, ok := strings.Cut(s, "=")
+		if !ok || key == "" {
+			return fmt.Errorf("expected key=value")
+		}
+		set[key] = value
+		return nil
+	})
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage:
+  ./ipocalypse generate [-dir path] [-name name] [-set key=value ...] [-force] <template>
+  ./ipocalypse generate -list
+
+Writes a client image build context (Dockerfile, scripts and ipocalypse.yaml
+manifest) from a built-in template, ready to be discovered by a run in the
+same directory or named with -dockerfiles.
+
+Options:
+  -dir string
+        Directory to create the build context in (default: .)
+
+  -name string
+        Name of the build context directory; names starting with
+        "ipocalypse" are discovered without -dockerfiles
+        (default: ipocalypse_<template>, dashes made underscores)
+
+  -set key=value
+        Template parameter, repeatable, e.g. -set base=debian:trixie-slim
+        -set packages="curl iperf3"; see -list for each template's
+
+  -force
+        Overwrite the files of an existing directory (default: false)
+
+  -list
+        List the templates and their parameters
+`)
+	}
+	fs.Parse(args)
+	if *list {
+		printTemplates()
+		return
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	tmpl, err := lookupTemplate(fs.Arg(0))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(2)
+	}
+	values, err := tmpl.values(set)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(2)
+	}
+	if *name == "" {
+		*name = "ipocalypse_" + strings.ReplaceAll(tmpl.Name, "-", "_")
+	}
+	if *name != filepath.Base(*name) || *name == "." || *name == ".." {
+		fmt.Printf("Error: -name must be a directory name, not a path; use -dir for where it goes\n")
+		os.Exit(2)
+	}
+	files, err := tmpl.render(values)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	out := filepath.Join(*dir, *name)
+	names, err := writeTemplate(out, files, *force)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Generated %s from template %s: %s\n", out, tmpl.Name, strings.Join(names, ", "))
+	if strings.HasPrefix(*name, "ipocalypse") {
+		fmt.Printf("Runs started in %s build it automatically, or name it with -dockerfiles=%s\n", *dir, out)
+	} else {
+		fmt.Printf("Name it with -dockerfiles=%s to build it in a run\n", out)
+	}
+}
+
+// printTemplates lists the templates with their parameters and defaults.
+func printTemplates() {
+	for _, t := range imageTemplates {
+		fmt.Printf("%s\n    %s\n", t.Name, t.Description)
+		for _, p := range t.params {
+			def := p.Default
+			if def == "" {
+				def = "none"
+			}
+			fmt.Printf("    %-10s %s (default: %s)\n", p.Name, p.Help, def)
+		}
+		fmt.Println()
+	}
+}
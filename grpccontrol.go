@@ -0,0 +1,380 @@
+package main
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative controlpb/control.proto
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipocalypse/controlpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcControl is the gRPC control plane of -daemon (-grpc-listen): the run
+// lifecycle of the service API, with status streamed instead of polled,
+// for orchestration platforms that drive runs programmatically. The
+// service is published in controlpb/control.proto. Like the HTTP API it
+// works on the current run's loopback control API.
+type grpcControl struct {
+	controlpb.UnimplementedControlServer
+	s *service
+
+	mu sync.Mutex
+	// configured are the flags Configure accepted, for a StartRun without
+	// flags of its own.
+	configured []string
+}
+
+// serveGRPC serves the control plane on addr. The server is returned for
+// the service to stop on its way out.
+func serveGRPC(addr string, s *service) (*grpc.Server, error) {
+	opts, err := grpcServerOptions(s.cfg)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+	srv := grpc.NewServer(opts...)
+	controlpb.RegisterControlServer(srv, &grpcControl{s: s})
+	if s.cfg.GRPCReflection {
+		// Reflection lets grpcurl and similar tools list and call the
+		// service without the .proto.
+		reflection.Register(srv)
+	}
+	go func() {
+		if err := srv.Serve(ln); err != nil {
+			slog.Error("gRPC control plane stopped", "error", err)
+		}
+	}()
+	fmt.Printf("ipocalypse gRPC control plane listening on %s\n", ln.Addr())
+	return srv, nil
+}
+
+// grpcServerOptions secures the control plane as cfg asks: TLS with
+// -grpc-tls-cert, client certificates signed by -grpc-client-ca, and the
+// shared token of the HTTP APIs, sent as "authorization: Bearer <token>"
+// metadata, when IPOCALYPSE_CONTROL_TOKEN is set.
+func grpcServerOptions(cfg Config) ([]grpc.ServerOption, error) {
+	var opts []grpc.ServerOption
+	if cfg.GRPCTLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.GRPCTLSCert, cfg.GRPCTLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the gRPC certificate: %v", err)
+		}
+		tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+		if cfg.GRPCClientCA != "" {
+			pem, err := os.ReadFile(cfg.GRPCClientCA)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read the gRPC client CA: %v", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates in %s", cfg.GRPCClientCA)
+			}
+			tlsConfig.ClientCAs, tlsConfig.ClientAuth = pool, tls.RequireAndVerifyClientCert
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	if token := controlToken(); token != "" {
+		check := func(ctx context.Context) error {
+			md, _ := metadata.FromIncomingContext(ctx)
+			for _, v := range md.Get("authorization") {
+				if got, ok := strings.CutPrefix(v, "Bearer "); ok && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1 {
+					return nil
+				}
+			}
+			return status.Error(codes.Unauthenticated, "missing or wrong control token")
+		}
+		opts = append(opts,
+			grpc.UnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+				if err := check(ctx); err != nil {
+					return nil, err
+				}
+				return handler(ctx, req)
+			}),
+			grpc.StreamInterceptor(func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+				if err := check(ss.Context()); err != nil {
+					return err
+				}
+				return handler(srv, ss)
+			}),
+		)
+	}
+	return opts, nil
+}
+
+func (g *grpcControl) Configure(ctx context.Context, req *controlpb.ConfigureRequest) (*controlpb.ConfigureResponse, error) {
+	if err := checkRunArgs(req.Args); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	// -dry-run goes first so no argument can keep it from being parsed.
+	out, err := exec.CommandContext(ctx, exe, append([]string{"-dry-run"}, req.Args...)...).CombinedOutput()
+	resp := &controlpb.ConfigureResponse{Plan: string(out)}
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		resp.ExitCode = int32(exitErr.ExitCode())
+	case err != nil:
+		return nil, status.Errorf(codes.Internal, "dry run failed: %v", err)
+	}
+	resp.Valid = resp.ExitCode == exitOK
+	if resp.Valid {
+		g.mu.Lock()
+		g.configured = append([]string(nil), req.Args...)
+		g.mu.Unlock()
+		slog.Info("run configured via gRPC", "args", req.Args)
+	}
+	return resp, nil
+}
+
+func (g *grpcControl) StartRun(ctx context.Context, req *controlpb.StartRunRequest) (*controlpb.Run, error) {
+	args := req.Args
+	if len(args) == 0 {
+		g.mu.Lock()
+		args = g.configured
+		g.mu.Unlock()
+	}
+	if err := checkRunArgs(args); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if run := g.s.current(); run != nil && run.State == "running" {
+		return nil, status.Errorf(codes.FailedPrecondition, "run %d is still in progress", run.ID)
+	}
+	run, err := g.s.start(args)
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return runProto(run), nil
+}
+
+func (g *grpcControl) GetRun(ctx context.Context, req *controlpb.GetRunRequest) (*controlpb.Run, error) {
+	run := g.s.current()
+	if run == nil {
+		return nil, status.Error(codes.NotFound, "no run has been started")
+	}
+	return runProto(run), nil
+}
+
+func (g *grpcControl) PauseRun(ctx context.Context, req *controlpb.PauseRunRequest) (*controlpb.RunStatus, error) {
+	return g.control(ctx, "/pause", "launching paused via gRPC")
+}
+
+func (g *grpcControl) ResumeRun(ctx context.Context, req *controlpb.ResumeRunRequest) (*controlpb.RunStatus, error) {
+	return g.control(ctx, "/resume", "launching resumed via gRPC")
+}
+
+func (g *grpcControl) StopRun(ctx context.Context, req *controlpb.StopRunRequest) (*controlpb.RunStatus, error) {
+	if !req.Terminate {
+		return g.control(ctx, "/stop", "launching stopped via gRPC")
+	}
+	run, err := g.running()
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("run stopped via gRPC", "run", run.ID)
+	run.stop()
+	return finishedStatus(g.s.current()), nil
+}
+
+func (g *grpcControl) Teardown(ctx context.Context, req *controlpb.TeardownRequest) (*controlpb.TeardownResponse, error) {
+	run, err := g.running()
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("teardown requested via gRPC", "run", run.ID)
+	var steps []struct {
+		Step  string `json:"step"`
+		Note  string `json:"note"`
+		Error string `json:"error"`
+	}
+	// A failed step is reported in the steps, with 500 for the request.
+	if err := run.call(ctx, http.MethodPost, "/teardown", &steps); err != nil && len(steps) == 0 {
+		var apiErr *controlAPIError
+		if errors.As(err, &apiErr) && apiErr.code == http.StatusNotImplemented {
+			return nil, status.Error(codes.Unimplemented, apiErr.msg)
+		}
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	resp := &controlpb.TeardownResponse{}
+	for _, step := range steps {
+		resp.Steps = append(resp.Steps, &controlpb.TeardownStep{Step: step.Step, Note: step.Note, Error: step.Error})
+	}
+	return resp, nil
+}
+
+func (g *grpcControl) StreamStatus(req *controlpb.StreamStatusRequest, stream controlpb.Control_StreamStatusServer) error {
+	interval := time.Duration(req.IntervalMs) * time.Millisecond
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ctx := stream.Context()
+	for {
+		run := g.s.current()
+		if run == nil {
+			return status.Error(codes.NotFound, "no run has been started")
+		}
+		if run.State != "running" {
+			return stream.Send(finishedStatus(run))
+		}
+		// The run's control API is not up yet right after the start, nor
+		// any more while it exits; those updates are skipped.
+		if st, err := run.status(ctx); err == nil {
+			if err := stream.Send(st); err != nil {
+				return err
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-run.done:
+		case <-time.After(interval):
+		}
+	}
+}
+
+// running returns the run in progress.
+func (g *grpcControl) running() (*serviceRun, error) {
+	run := g.s.current()
+	if run == nil || run.State != "running" {
+		return nil, status.Error(codes.FailedPrecondition, "no run is in progress")
+	}
+	return run, nil
+}
+
+// control posts to path on the current run's control API and returns the
+// run's status after it.
+func (g *grpcControl) control(ctx context.Context, path, msg string) (*controlpb.RunStatus, error) {
+	run, err := g.running()
+	if err != nil {
+		return nil, err
+	}
+	if err := run.call(ctx, http.MethodPost, path, nil); err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	slog.Info(msg, "run", run.ID)
+	st, err := run.status(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return st, nil
+}
+
+// controlAPIError is an error answer of a run's control API.
+type controlAPIError struct {
+	code int
+	msg  string
+}
+
+func (e *controlAPIError) Error() string {
+	return fmt.Sprintf("run control API: %s (%d)", e.msg, e.code)
+}
+
+// call sends a request to the run's control API and decodes the answer
+// into out, when given, even when the answer is an error.
+func (r *serviceRun) call(ctx context.Context, method, path string, out any) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := newControlRequest(ctx, method, "http://"+r.controlAddr+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("run control API not answering: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		var body json.RawMessage
+		json.NewDecoder(resp.Body).Decode(&body)
+		if out != nil {
+			json.Unmarshal(body, out)
+		}
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(body, &e)
+		return &controlAPIError{code: resp.StatusCode, msg: orDash(e.Error)}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// status reads the run's status from its control API.
+func (r *serviceRun) status(ctx context.Context) (*controlpb.RunStatus, error) {
+	var st struct {
+		State     string  `json:"state"`
+		Workers   int32   `json:"workers"`
+		Launched  int64   `json:"clients_launched"`
+		Leased    int64   `json:"leases_acquired"`
+		PerMinute float64 `json:"launches_per_min"`
+		Exhausted bool    `json:"exhausted"`
+		Status    string  `json:"status"`
+	}
+	if err := r.call(ctx, http.MethodGet, "/status", &st); err != nil {
+		return nil, err
+	}
+	return &controlpb.RunStatus{
+		RunId:           int32(r.ID),
+		State:           st.State,
+		Workers:         st.Workers,
+		ClientsLaunched: st.Launched,
+		LeasesAcquired:  st.Leased,
+		LaunchesPerMin:  st.PerMinute,
+		Exhausted:       st.Exhausted,
+		Status:          st.Status,
+		At:              timestamppb.New(clock.Now()),
+	}, nil
+}
+
+// finishedStatus is the last status of a run whose process exited.
+func finishedStatus(run *serviceRun) *controlpb.RunStatus {
+	return &controlpb.RunStatus{
+		RunId:    int32(run.ID),
+		State:    "finished",
+		Status:   fmt.Sprintf("run %d exited with %d", run.ID, run.ExitCode),
+		At:       timestamppb.New(clock.Now()),
+		ExitCode: int32(run.ExitCode),
+	}
+}
+
+func runProto(run *serviceRun) *controlpb.Run {
+	r := &controlpb.Run{
+		Id:        int32(run.ID),
+		Args:      run.Args,
+		Pid:       int32(run.PID),
+		StartedAt: timestamppb.New(run.StartedAt),
+		State:     run.State,
+		ExitCode:  int32(run.ExitCode),
+	}
+	if run.EndedAt != nil {
+		r.EndedAt = timestamppb.New(*run.EndedAt)
+	}
+	return r
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/ipocalypse/controlpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestServeGRPCReflection(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		cfg := defaultConfig()
+		cfg.GRPCReflection = enabled
+		srv, err := serveGRPC("127.0.0.1:0", &service{cfg: cfg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		services := srv.GetServiceInfo()
+		srv.Stop()
+		if _, ok := services["ipocalypse.v1.Control"]; !ok {
+			t.Fatalf("control service not registered: %v", services)
+		}
+		if _, ok := services["grpc.reflection.v1.ServerReflection"]; ok != enabled {
+			t.Errorf("reflection served = %v with -grpc-reflection=%v", ok, enabled)
+		}
+	}
+}
+
+func TestGRPCServerOptionsToken(t *testing.T) {
+	t.Setenv(controlTokenEnv, "s3cret")
+	opts, err := grpcServerOptions(defaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer(opts...)
+	controlpb.RegisterControlServer(srv, &grpcControl{s: &service{}})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	defer srv.Stop()
+
+	conn, err := grpc.NewClient(ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := controlpb.NewControlClient(conn)
+
+	tests := []struct {
+		name  string
+		token string
+		want  codes.Code
+	}{
+		{"no token", "", codes.Unauthenticated},
+		{"wrong token", "guess", codes.Unauthenticated},
+		// Past the token check, there is no run yet.
+		{"token", "s3cret", codes.NotFound},
+	}
+	for _, tt := range tests {
+		ctx := context.Background()
+		if tt.token != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+tt.token)
+		}
+		_, err := client.GetRun(ctx, &controlpb.GetRunRequest{})
+		if got := status.Code(err); got != tt.want {
+			t.Errorf("%s: GetRun() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestConfigureRejectsPositional(t *testing.T) {
+	srv := grpc.NewServer()
+	controlpb.RegisterControlServer(srv, &grpcControl{s: &service{}})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	defer srv.Stop()
+
+	conn, err := grpc.NewClient(ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := controlpb.NewControlClient(conn)
+
+	// A positional would end flag parsing in the dry run, and any -dry-run
+	// after it would go unparsed.
+	for _, args := range [][]string{{"-force", "true"}, {"report"}, {"-max-leases=5", "x", "-dry-run"}} {
+		_, err := client.Configure(context.Background(), &controlpb.ConfigureRequest{Args: args})
+		if got := status.Code(err); got != codes.InvalidArgument {
+			t.Errorf("Configure(%q) = %v, want %v", args, got, codes.InvalidArgument)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/go-units"
+)
+
+// Docker API versions the host checks hold the engine to.
+const (
+	// minAPIVersion is the oldest API that takes a platform with each
+	// created container and build.
+	minAPIVersion = "1.41"
+	// macAPIVersion is the first API that sets a MAC per network endpoint;
+	// older engines give macvlan and bridge clients random MACs instead of
+	// the generated ones.
+	macAPIVersion = "1.44"
+)
+
+// minFreeSpace is the free space the engine's data root needs for a run's
+// image builds and pulls.
+const minFreeSpace = 1 << 30
+
+// Linux capability bits, as in the CapEff mask of /proc/<pid>/status.
+const (
+	capNetAdmin = 12
+	capNetRaw   = 13
+)
+
+// hostCheck is one line of the pre-flight report: something a run needs of
+// the host, checked before it changes anything.
+type hostCheck struct {
+	Name   string
+	Detail string
+	// Err is why the run cannot go ahead; Warn says it can, but not as
+	// intended. Hint says what to do about either.
+	Err  error
+	Warn bool
+	Hint string
+}
+
+// runHostChecks checks everything the run needs of the host up front, so it
+// stops with every problem listed instead of at the first one, halfway
+// through network setup or the first build: privileges, the parent
+// interfaces, the engine and, in docker mode, the engine's disk space.
+func runHostChecks(cfg Config, host *hostShell, targets []networkTarget) []hostCheck {
+	checks := []hostCheck{checkPrivileges(host)}
+	for _, target := range targets {
+		checks = append(checks, checkParent(host, target))
+	}
+	if cfg.Mode != modeDocker || cfg.Observe {
+		for _, e := range engines {
+			if e.Name == cfg.Mode && !cfg.Observe {
+				checks = append(checks, checkEngine(e, cfg))
+			}
+		}
+		return checks
+	}
+	cli, name, err := newContainerRuntime(cfg)
+	if err != nil {
+		return append(checks, hostCheck{Name: "container engine", Err: err, Hint: "use -runtime=docker or -runtime=podman"})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	runtime := checkRuntime(ctx, cli, name, cfg)
+	checks = append(checks, runtime)
+	if runtime.Err == nil {
+		checks = append(checks, checkDiskSpace(ctx, cli, host))
+	}
+	return checks
+}
+
+// checkPrivileges checks that commands on the host run as root, with the
+// capabilities to configure interfaces and, on this machine, to open the
+// packet sockets of the DHCP pre-flight and raw clients. Root in a container
+// or user namespace may lack them.
+func checkPrivileges(host *hostShell) hostCheck {
+	c := hostCheck{Name: "privileges", Detail: "root"}
+	if host.remote() {
+		c.Detail = "root on " + host.String()
+	}
+	if err := host.requireRoot(); err != nil {
+		c.Err = err
+		return c
+	}
+	caps, err := effectiveCaps(host)
+	if err != nil {
+		c.Warn = true
+		c.Detail += ", capabilities unknown: " + err.Error()
+		return c
+	}
+	var missing []string
+	if caps&(1<<capNetAdmin) == 0 {
+		missing = append(missing, "CAP_NET_ADMIN")
+	}
+	if !host.remote() && caps&(1<<capNetRaw) == 0 {
+		missing = append(missing, "CAP_NET_RAW")
+	}
+	if len(missing) > 0 {
+		c.Err = fmt.Errorf("root without %s", strings.Join(missing, " and "))
+		c.Hint = "in a container, start it with --cap-add=NET_ADMIN --cap-add=NET_RAW, or --privileged"
+		return c
+	}
+	c.Detail += " with CAP_NET_ADMIN"
+	return c
+}
+
+// effectiveCaps returns the effective capabilities of commands on the host.
+func effectiveCaps(host *hostShell) (uint64, error) {
+	status, err := host.readFile("/proc/self/status")
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if mask, ok := strings.CutPrefix(line, "CapEff:"); ok {
+			return strconv.ParseUint(strings.TrimSpace(mask), 16, 64)
+		}
+	}
+	return 0, errors.New("no CapEff in /proc/self/status")
+}
+
+// checkParent checks that a target's parent interface exists and is up. The
+// interface a VLAN is tagged on only needs to exist, as tagging brings it up.
+func checkParent(host *hostShell, target networkTarget) hostCheck {
+	parent := targetParent(host, target)
+	c := hostCheck{Name: "interface " + orDash(parent)}
+	if parent == "" {
+		c.Err = errors.New("no default route to take the parent interface from")
+		c.Hint = "name it with -interface"
+		return c
+	}
+	if !host.exists(filepath.Join("/sys/class/net", parent)) {
+		c.Err = fmt.Errorf("%s does not exist", parent)
+		c.Hint = "list the interfaces with `ip link` and name one with -interface"
+		return c
+	}
+	data, _ := host.readFile(filepath.Join("/sys/class/net", parent, "operstate"))
+	state := strings.TrimSpace(string(data))
+	c.Detail = state
+	if target.VLAN != 0 {
+		c.Detail = fmt.Sprintf("%s, VLAN %d to be tagged on it", state, target.VLAN)
+		return c
+	}
+	switch state {
+	case "down":
+		c.Err = fmt.Errorf("%s is down", parent)
+		c.Hint = "bring it up with `ip link set " + parent + " up`"
+	case "lowerlayerdown", "notpresent":
+		c.Err = fmt.Errorf("%s has no link (%s)", parent, state)
+		c.Hint = "check its cable or the interface it sits on"
+	}
+	return c
+}
+
+// checkEngine runs the check of an engine other than docker.
+func checkEngine(e engineInfo, cfg Config) hostCheck {
+	c := hostCheck{Name: e.Name + " engine", Detail: "available"}
+	if err := e.check(cfg); err != nil {
+		c.Detail = ""
+		c.Err = err
+	}
+	return c
+}
+
+// checkRuntime checks that the container engine answers with an API this
+// run can drive.
+func checkRuntime(ctx context.Context, cli containerRuntime, name string, cfg Config) hostCheck {
+	c := hostCheck{Name: name + " engine"}
+	if _, err := cli.Ping(ctx); err != nil {
+		c.Err = fmt.Errorf("%w: %v", ErrDaemonUnavailable, err)
+		switch {
+		case cfg.Host != "":
+			c.Hint = "check that the engine runs on " + cfg.Host + " and that -host reaches it"
+		case name == runtimePodman:
+			c.Hint = "start its API with `systemctl start podman.socket`"
+		default:
+			c.Hint = "start it with `systemctl start docker`, or point DOCKER_HOST at a running one"
+		}
+		return c
+	}
+	v, err := cli.ServerVersion(ctx)
+	if err != nil {
+		c.Err = fmt.Errorf("%w: %v", ErrDaemonUnavailable, err)
+		return c
+	}
+	c.Detail = fmt.Sprintf("%s, API %s", v.Version, v.APIVersion)
+	switch {
+	case versionBefore(v.APIVersion, minAPIVersion):
+		c.Err = fmt.Errorf("API %s is older than %s, the oldest this run drives", v.APIVersion, minAPIVersion)
+		c.Hint = "upgrade to Docker 20.10 or later"
+	case name == runtimeDocker && cfg.Driver != driverIpvlan && versionBefore(v.APIVersion, macAPIVersion):
+		c.Warn = true
+		c.Hint = fmt.Sprintf("API %s sets no per-client MAC, so clients get random MACs and -mac-pools is ignored; upgrade to Docker 25 or later", v.APIVersion)
+	}
+	return c
+}
+
+// versionBefore reports whether API version v is older than oldest. Both
+// are major.minor.
+func versionBefore(v, oldest string) bool {
+	parse := func(s string) (int, int) {
+		major, minor, _ := strings.Cut(s, ".")
+		a, _ := strconv.Atoi(major)
+		b, _ := strconv.Atoi(minor)
+		return a, b
+	}
+	vMajor, vMinor := parse(v)
+	oldMajor, oldMinor := parse(oldest)
+	return vMajor < oldMajor || vMajor == oldMajor && vMinor < oldMinor
+}
+
+// checkDiskSpace checks that the engine's data root has room for the run's
+// image builds and pulls.
+func checkDiskSpace(ctx context.Context, cli containerRuntime, host *hostShell) hostCheck {
+	c := hostCheck{Name: "disk space"}
+	info, err := cli.Info(ctx)
+	if err != nil || info.DockerRootDir == "" {
+		c.Warn = true
+		c.Detail = "the engine did not report its data root"
+		return c
+	}
+	free, err := freeSpace(host, info.DockerRootDir)
+	if err != nil {
+		c.Warn = true
+		c.Detail = fmt.Sprintf("%s: %v", info.DockerRootDir, err)
+		return c
+	}
+	c.Detail = fmt.Sprintf("%s free in %s", units.BytesSize(float64(free)), info.DockerRootDir)
+	if free < minFreeSpace {
+		c.Err = fmt.Errorf("%s has %s free, less than the %s builds need", info.DockerRootDir, units.BytesSize(float64(free)), units.BytesSize(minFreeSpace))
+		c.Hint = "free some with `docker system prune`, or run with -cleanup -prune-images"
+	}
+	return c
+}
+
+// freeSpace returns the bytes available to unprivileged users in the file
+// system holding dir on the host.
+func freeSpace(host *hostShell, dir string) (uint64, error) {
+	if !host.remote() {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(dir, &st); err != nil {
+			return 0, err
+		}
+		return st.Bavail * uint64(st.Bsize), nil
+	}
+	out, err := host.command("df", "-Pk", dir).Output()
+	if err != nil {
+		return 0, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if fields := strings.Fields(lines[len(lines)-1]); len(fields) >= 4 {
+		if kb, err := strconv.ParseUint(fields[3], 10, 64); err == nil {
+			return kb << 10, nil
+		}
+	}
+	return 0, fmt.Errorf("unexpected df output %q", strings.TrimSpace(string(out)))
+}
+
+// printHostChecks prints the pre-flight report and returns the failed
+// checks' errors joined, nil when the run can go ahead.
+func printHostChecks(checks []hostCheck) error {
+	fmt.Println("=== Pre-flight Checks ===")
+	var errs []error
+	for _, c := range checks {
+		switch {
+		case c.Err != nil:
+			errs = append(errs, fmt.Errorf("%s: %w", c.Name, c.Err))
+			fmt.Printf("  %-24s FAILED %v\n", c.Name, c.Err)
+		case c.Warn:
+			fmt.Printf("  %-24s warn   %s\n", c.Name, c.Detail)
+		default:
+			fmt.Printf("  %-24s ok     %s\n", c.Name, c.Detail)
+		}
+		if c.Hint != "" && (c.Err != nil || c.Warn) {
+			fmt.Printf("  %-24s        -> %s\n", "", c.Hint)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// hostnamesRealistic selects the built-in hostname templates.
+const hostnamesRealistic = "realistic"
+
+// realisticHostnames mimic the names a mixed office network's clients send,
+// weighted roughly by how common each device class is.
+var realisticHostnames = []string{
+	"DESKTOP-{ALNUM:7}:6",
+	"LAPTOP-{ALNUM:7}:3",
+	"{Name}s-iPhone:4",
+	"{Name}s-MacBook-Pro:2",
+	"{Name}s-iPad:1",
+	"Galaxy-S{n}:2",
+	"android-{hex:16}:2",
+	"HP-LaserJet-{HEX:6}:1",
+	"BRW{HEX:12}:1",
+	"SEP{HEX:12}:1",
+	"ESP_{HEX:6}:1",
+	"Chromecast:1",
+}
+
+// hostnameWords are the names {name} and {Name} are filled from when no
+// -hostname-words list is given.
+var hostnameWords = []string{
+	"john", "mary", "james", "linda", "michael", "sarah", "david", "emma",
+	"robert", "olivia", "daniel", "sophia", "chris", "anna", "mark", "laura",
+	"paul", "julia", "kevin", "grace", "brian", "chloe", "steve", "hannah",
+	"alex", "maria", "tom", "lucy", "peter", "nina", "ryan", "kate",
+}
+
+// wordPlaceholder matches {name} and {Name}.
+var wordPlaceholder = regexp.MustCompile(`\{(name|Name)\}`)
+
+// invalidHostnameChars are removed from generated hostnames.
+var invalidHostnameChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// hostnameGenerator gives every client its own hostname (option 12) from
+// weighted templates, so the server's lease table looks like a real client
+// population.
+type hostnameGenerator struct {
+	templates weightedSet[string]
+	words     []string
+}
+
+// newHostnameGenerator parses "template[:weight]" specs, or "realistic" for
+// the built-in set. Templates take the profile placeholders (see
+// expandHostname) plus {name} and {Name}, a word from wordsFile, one per
+// line, or from a built-in list of first names. It returns nil when specs is
+// empty, leaving hostnames to the device profiles.
+func newHostnameGenerator(specs []string, wordsFile string) (*hostnameGenerator, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	g := &hostnameGenerator{words: hostnameWords}
+	for _, spec := range specs {
+		if spec == hostnamesRealistic {
+			for _, template := range realisticHostnames {
+				name, weight := parseTemplateWeight(template)
+				g.templates.add(name, weight)
+			}
+			continue
+		}
+		name, weight := parseTemplateWeight(spec)
+		if name == "" {
+			return nil, fmt.Errorf("empty hostname template in %q", spec)
+		}
+		g.templates.add(name, weight)
+	}
+	if wordsFile != "" {
+		words, err := readWords(wordsFile)
+		if err != nil {
+			return nil, err
+		}
+		g.words = words
+	}
+	return g, nil
+}
+
+// parseTemplateWeight splits a "template[:weight]" spec. Placeholders such as
+// {HEX:6} contain colons of their own, so only a number after the last colon
+// is a weight, defaulting to 1.
+func parseTemplateWeight(spec string) (string, int) {
+	i := strings.LastIndex(spec, ":")
+	if i < 0 {
+		return spec, 1
+	}
+	weight, err := strconv.Atoi(spec[i+1:])
+	if err != nil || weight <= 0 {
+		return spec, 1
+	}
+	return spec[:i], weight
+}
+
+// readWords reads a wordlist with one word per line, skipping blank lines and
+// # comments.
+func readWords(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hostname words: %v", err)
+	}
+	defer f.Close()
+	var words []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		word := strings.TrimSpace(scanner.Text())
+		if word != "" && !strings.HasPrefix(word, "#") {
+			words = append(words, word)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read hostname words: %v", err)
+	}
+	if len(words) == 0 {
+		return nil, fmt.Errorf("%s contains no words", path)
+	}
+	return words, nil
+}
+
+// next returns a hostname for a new client. A nil generator returns "".
+func (g *hostnameGenerator) next() string {
+	if g == nil {
+		return ""
+	}
+	hostname := wordPlaceholder.ReplaceAllStringFunc(g.templates.pick(), func(m string) string {
+		word := strings.ToLower(g.words[identityRand.Intn(len(g.words))])
+		if m == "{Name}" {
+			word = strings.ToUpper(word[:1]) + word[1:]
+		}
+		return word
+	})
+	hostname = invalidHostnameChars.ReplaceAllString(expandHostname(hostname), "")
+	if len(hostname) > 63 {
+		hostname = hostname[:63]
+	}
+	return hostname
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"time"
+)
+
+// Identity churn variants: a held client comes back under the same MAC with a
+// new hostname and client-id, or under a new MAC with its old ones.
+const (
+	churnNewIdentity = "same MAC, new hostname and client-id"
+	churnNewMAC      = "new MAC, same hostname and client-id"
+)
+
+// Identity churn outcomes, by how the server answered the reconfirmation.
+const (
+	churnKept    = "kept the address"
+	churnMoved   = "got a different address"
+	churnRefused = "NAKed"
+	churnIgnored = "no reply"
+)
+
+// churnResult is the server's answer to one reconfirmation.
+type churnResult struct {
+	Variant string
+	Outcome string
+}
+
+// reconfirm asks the server to confirm ip for the given identity with an
+// INIT-REBOOT REQUEST, as a client does when it comes back on the network.
+// It is broadcast so the answer reaches a spoofed MAC.
+func (e *rawEngine) reconfirm(ctx context.Context, mac net.HardwareAddr, ip net.IP, clientID []byte, hostname string) (*dhcpMessage, error) {
+	request := newDHCPRequest(dhcpRequest, rand.Uint32(), mac)
+	request.addOption(optRequestedIP, ip.To4())
+	addClientID(request, clientID)
+	if hostname != "" {
+		request.addOption(optHostname, []byte(hostname))
+	}
+	request.addOption(optParamRequest, []byte{optSubnetMask, optRouter, optDNS, optLeaseTime, optServerID})
+	return e.transact(ctx, request, 2, 3*time.Second, dhcpAck, dhcpNak)
+}
+
+// identityChurn reconfirms up to n held leases with altered identities,
+// alternating between the two variants so each client is probed once, and
+// reports how the server reconciled each change.
+func (e *rawEngine) identityChurn(ctx context.Context, macs *macGenerator, n int) []churnResult {
+	e.mu.Lock()
+	held := make([]*rawLease, 0, len(e.leases))
+	for _, lease := range e.leases {
+		held = append(held, lease)
+	}
+	e.mu.Unlock()
+	sort.Slice(held, func(i, j int) bool { return held[i].Acquired.Before(held[j].Acquired) })
+	if len(held) > n {
+		held = held[:n]
+	}
+
+	var results []churnResult
+	for i, lease := range held {
+		if ctx.Err() != nil {
+			break
+		}
+		var reply *dhcpMessage
+		var err error
+		variant := churnNewIdentity
+		if i%2 == 0 {
+			clientID := make([]byte, 9) // type 0: opaque identifier
+			rand.Read(clientID[1:])
+			reply, err = e.reconfirm(ctx, lease.MAC, lease.IP, clientID, fmt.Sprintf("churn-%04x", rand.Intn(0x10000)))
+		} else {
+			variant = churnNewMAC
+			reply, err = e.reconfirm(ctx, macs.Next(), lease.IP, append([]byte{1}, lease.MAC...), lease.Hostname)
+		}
+		result := churnResult{Variant: variant}
+		switch {
+		case err != nil || reply == nil:
+			result.Outcome = churnIgnored
+		case reply.msgType() == dhcpNak:
+			result.Outcome = churnRefused
+		case reply.YIAddr.Equal(lease.IP):
+			result.Outcome = churnKept
+		default:
+			result.Outcome = churnMoved
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// printChurnReport summarises the identity churn phase per variant.
+func printChurnReport(results []churnResult) {
+	fmt.Println("=== Identity Churn ===")
+	if len(results) == 0 {
+		fmt.Println("No held leases to reconfirm")
+		return
+	}
+	for _, variant := range []string{churnNewIdentity, churnNewMAC} {
+		counts := make(map[string]int)
+		total := 0
+		for _, r := range results {
+			if r.Variant == variant {
+				counts[r.Outcome]++
+				total++
+			}
+		}
+		if total == 0 {
+			continue
+		}
+		fmt.Printf("%s (%d clients):\n", variant, total)
+		for _, outcome := range []string{churnKept, churnMoved, churnRefused, churnIgnored} {
+			if counts[outcome] > 0 {
+				fmt.Printf("  %-24s %d\n", outcome+":", counts[outcome])
+			}
+		}
+	}
+}
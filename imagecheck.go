@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// imageCheckTimeout bounds the validation of one image.
+const imageCheckTimeout = 30 * time.Second
+
+// clientBinaries returns the programs an image must have for its clients to
+// get a lease, as alternatives: any one of them will do.
+func clientBinaries(client string, manifest *imageManifest, ipv6 bool) []string {
+	if len(manifest.Command) > 0 {
+		return manifest.Command[:1]
+	}
+	if manifest.DHCPClient != "" {
+		client = manifest.DHCPClient
+	}
+	switch client {
+	case dhcpClientAuto:
+		return []string{dhcpClientDhclient, dhcpClientUdhcpc, dhcpClientDhcpcd}
+	case dhcpClientUdhcpc:
+		if ipv6 {
+			return []string{"udhcpc6"}
+		}
+	}
+	return []string{client}
+}
+
+// validateImages starts one throwaway container per image, without a network,
+// and checks that it has a DHCP client its launches can run, so a broken
+// image fails the run up front rather than every launch at scale.
+func validateImages(cli containerRuntime, images []string, manifests map[string]*imageManifest, client string, ipv6 bool) error {
+	fmt.Printf("Checking %d images for a DHCP client...\n", len(images))
+	var errs []error
+	for _, image := range images {
+		binaries := clientBinaries(client, manifests[image], ipv6)
+		if err := checkImage(cli, image, binaries); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkImage looks for any of binaries in a container of image.
+func checkImage(cli containerRuntime, image string, binaries []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), imageCheckTimeout)
+	defer cancel()
+	resp, err := cli.ContainerCreate(ctx, &container.Config{
+		Image:      image,
+		Entrypoint: []string{"sh", "-c", "sleep 30"},
+		Labels:     runLabels(labelImage, image),
+	}, &container.HostConfig{NetworkMode: "none"}, nil, clientPlatform, "")
+	if err != nil {
+		return fmt.Errorf("image %s could not be checked: %w", image, runtimeError(err))
+	}
+	defer cli.ContainerRemove(context.Background(), resp.ID, container.RemoveOptions{Force: true})
+	if err := cli.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
+		return fmt.Errorf("image %s has no usable shell: %w", image, runtimeError(err))
+	}
+	var tests []string
+	for _, binary := range binaries {
+		tests = append(tests, "command -v "+binary)
+	}
+	if _, err := containerExec(ctx, cli, resp.ID, []string{"sh", "-c", strings.Join(tests, " || ")}); err != nil {
+		return fmt.Errorf("image %s has no %s", image, strings.Join(binaries, "/"))
+	}
+	return nil
+}
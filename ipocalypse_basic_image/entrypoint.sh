@@ -19,8 +19,12 @@ echo "======================================"
 # Wait a moment for network interface to be ready
 sleep 2
 
-# Detect the network interface dynamically (strip @if* suffix)
-INTERFACE=$(ip -o link show | awk -F': ' '/^[0-9]+: (eth|macvlan)[0-9]*@/ {gsub(/@.*/, "", $2); print $2; exit}')
+# Use the interface the controller names (-client-interface, net1 for
+# Kubernetes pods), or detect it dynamically (strip @if* suffix)
+INTERFACE=$IPOCALYPSE_INTERFACE
+if [ -z "$INTERFACE" ]; then
+    INTERFACE=$(ip -o link show | awk -F': ' '/^[0-9]+: (eth|macvlan)[0-9]*@/ {gsub(/@.*/, "", $2); print $2; exit}')
+fi
 if [ -z "$INTERFACE" ]; then
     # Fallback to interfaces without @if suffix
     INTERFACE=$(ip -o link show | awk -F': ' '/^[0-9]+: (eth|macvlan)[0-9]*[^@]/ {print $2; exit}')
@@ -33,6 +37,26 @@ if [ -z "$INTERFACE" ]; then
     exit 1
 fi
 
+# Another DHCP client (-dhcp-client) runs through the controller's client
+# script, passed as arguments, which records its lease for the controller
+case "${IPOCALYPSE_DHCP_CLIENT:-dhclient}" in
+    dhclient|auto)
+        ;;
+    *)
+        if ! command -v "$IPOCALYPSE_DHCP_CLIENT" >/dev/null 2>&1; then
+            echo "DHCP client $IPOCALYPSE_DHCP_CLIENT is not installed in this image"
+            exit 1
+        fi
+        if [ $# -eq 0 ]; then
+            echo "No client script given to run $IPOCALYPSE_DHCP_CLIENT with"
+            exit 1
+        fi
+        echo "Handing over to $IPOCALYPSE_DHCP_CLIENT on $INTERFACE"
+        export IPOCALYPSE_INTERFACE=$INTERFACE
+        exec "$@"
+        ;;
+esac
+
 echo "Bringing up network interface: $INTERFACE"
 ip link set $INTERFACE up
 
@@ -42,6 +66,49 @@ ip link show $INTERFACE
 ip addr show $INTERFACE
 echo "=============================="
 
+# Ask for a specific address when the controller provides a hint (-address-order)
+if [ -n "$IPOCALYPSE_REQUESTED_IP" ]; then
+    echo "Requesting address $IPOCALYPSE_REQUESTED_IP"
+    echo "send dhcp-requested-address $IPOCALYPSE_REQUESTED_IP;" >> /etc/dhcp/dhclient.conf
+fi
+
+# ipvlan clients share the parent's MAC (-driver=ipvlan): identify by client-id
+if [ -n "$IPOCALYPSE_CLIENT_ID" ]; then
+    echo "send dhcp-client-identifier $IPOCALYPSE_CLIENT_ID;" >> /etc/dhcp/dhclient.conf
+fi
+
+# Present the device profile's DHCP fingerprint (-profiles / manifest profile)
+if [ -n "$IPOCALYPSE_HOSTNAME" ]; then
+    echo "send host-name \"$IPOCALYPSE_HOSTNAME\";" >> /etc/dhcp/dhclient.conf
+fi
+if [ -n "$IPOCALYPSE_VENDOR_CLASS" ]; then
+    echo "send vendor-class-identifier \"$IPOCALYPSE_VENDOR_CLASS\";" >> /etc/dhcp/dhclient.conf
+fi
+if [ -n "$IPOCALYPSE_PARAM_REQUEST" ]; then
+    echo "send dhcp-parameter-request-list ${IPOCALYPSE_PARAM_REQUEST//,/, };" >> /etc/dhcp/dhclient.conf
+fi
+
+# Keep fixed DNS/NTP servers (-client-dns / -client-ntp) whatever DHCP offers
+if [ -n "$IPOCALYPSE_DNS" ]; then
+    echo "Forcing DNS servers $IPOCALYPSE_DNS"
+    if [ -n "$IPOCALYPSE_DHCPV6" ]; then
+        echo "supersede dhcp6.name-servers ${IPOCALYPSE_DNS//,/, };" >> /etc/dhcp/dhclient.conf
+    else
+        echo "supersede domain-name-servers ${IPOCALYPSE_DNS//,/, };" >> /etc/dhcp/dhclient.conf
+    fi
+fi
+if [ -n "$IPOCALYPSE_NTP" ]; then
+    echo "Forcing NTP servers $IPOCALYPSE_NTP"
+    echo "supersede ntp-servers ${IPOCALYPSE_NTP//,/, };" >> /etc/dhcp/dhclient.conf
+fi
+
+# DHCPv6 mode (-ipv6) requests an IA_NA address instead of an IPv4 lease
+DHCLIENT_ARGS="-v"
+if [ -n "$IPOCALYPSE_DHCPV6" ]; then
+    echo "Using DHCPv6"
+    DHCLIENT_ARGS="-6 -v"
+fi
+
 # Try DHCP multiple times
 max_attempts=3
 attempt=1
@@ -56,11 +123,12 @@ while [ $attempt -le $max_attempts ]; do
     pkill dhclient 2>/dev/null || true
     
     # Run dhclient with verbose output
-    if dhclient -v $INTERFACE; then
+    if dhclient $DHCLIENT_ARGS $INTERFACE; then
         echo "DHCP lease obtained successfully!"
         echo "=== Network Status After DHCP ==="
         ip addr show $INTERFACE
         ip route show
+        [ -n "$IPOCALYPSE_DHCPV6" ] && ip -6 route show
         echo "==============================="
         break
     else
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// k8sNetwork names the NetworkAttachmentDefinition a run creates when
+	// -k8s-network names none.
+	k8sNetwork = "ipocalypse-net"
+	// k8sPodInterface is the pods' interface on the attachment network.
+	k8sPodInterface = "net1"
+	// k8sStartTimeout bounds how long a pod may take to be scheduled, pull
+	// its image and start, before -dhcp-timeout starts counting.
+	k8sStartTimeout = 3 * time.Minute
+)
+
+// kubectl runs kubectl against the cluster and namespace of -kubeconfig,
+// -k8s-context and -k8s-namespace.
+type kubectl struct {
+	args []string
+}
+
+func newKubectl(cfg Config) (*kubectl, error) {
+	if _, err := exec.LookPath("kubectl"); err != nil {
+		return nil, fmt.Errorf("the k8s engine drives the cluster with kubectl, which was not found")
+	}
+	k := &kubectl{}
+	if cfg.Kubeconfig != "" {
+		k.args = append(k.args, "--kubeconfig", cfg.Kubeconfig)
+	}
+	if cfg.K8sContext != "" {
+		k.args = append(k.args, "--context", cfg.K8sContext)
+	}
+	if cfg.K8sNamespace != "" {
+		k.args = append(k.args, "--namespace", cfg.K8sNamespace)
+	}
+	return k, nil
+}
+
+// run runs kubectl with args, feeding it stdin, and returns its output. A
+// failure carries kubectl's error output.
+func (k *kubectl) run(ctx context.Context, stdin []byte, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "kubectl", append(append([]string(nil), k.args...), args...)...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return string(out), fmt.Errorf("kubectl %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// exec runs a shell script in a pod's client container.
+func (k *kubectl) exec(ctx context.Context, pod, script string) (string, error) {
+	return k.run(ctx, nil, "exec", pod, "-c", "client", "--", "sh", "-c", script)
+}
+
+// apply creates or updates the object described by manifest.
+func (k *kubectl) apply(ctx context.Context, manifest map[string]any) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	_, err = k.run(ctx, data, "apply", "-f", "-")
+	return err
+}
+
+// k8sEngine runs each client as a pod on a Kubernetes cluster, attached to
+// the target segment by a Multus macvlan or ipvlan network, so the clients
+// spread over the cluster's nodes instead of one host's container engine.
+// The pods run the -images with the same client script and IPOCALYPSE_*
+// variables as containers do.
+type k8sEngine struct {
+	kube      *kubectl
+	network   string
+	sharedMAC bool
+	// nodeSelector restricts the pods to the nodes with these labels.
+	nodeSelector map[string]string
+	dhcpClient   string
+	timeout      time.Duration
+	poll         time.Duration
+
+	mu       sync.Mutex
+	acks     int
+	failures int
+	held     int
+}
+
+var k8sCapabilities = engineCapabilities{Images: true}
+
+// newK8sEngine checks that the cluster takes pods and sets up the
+// attachment network: the -k8s-network given, or one the run creates on
+// -k8s-master, the parent interface by default.
+func newK8sEngine(ctx context.Context, cfg Config, parent string) (*k8sEngine, error) {
+	kube, err := newKubectl(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Driver != driverMacvlan && cfg.Driver != driverIpvlan {
+		return nil, fmt.Errorf("the k8s engine attaches pods with macvlan or ipvlan, not -driver=%s", cfg.Driver)
+	}
+	if err := checkKubeAccess(ctx, kube); err != nil {
+		return nil, err
+	}
+	selector, err := parseNodeSelector(cfg.K8sNodeSelector)
+	if err != nil {
+		return nil, err
+	}
+	e := &k8sEngine{
+		kube:         kube,
+		network:      cfg.K8sNetwork,
+		sharedMAC:    cfg.Driver == driverIpvlan,
+		nodeSelector: selector,
+		dhcpClient:   cfg.DHCPClient,
+		timeout:      cfg.DHCPTimeout,
+		poll:         cfg.DHCPPollInterval,
+	}
+	if e.network != "" {
+		if _, err := kube.run(ctx, nil, "get", "network-attachment-definitions", e.network); err != nil {
+			return nil, fmt.Errorf("-k8s-network %s: %v", e.network, err)
+		}
+		return e, nil
+	}
+	master := cmp.Or(cfg.K8sMaster, parent)
+	e.network = k8sNetwork
+	if err := kube.apply(ctx, attachmentManifest(e.network, cfg.Driver, master)); err != nil {
+		return nil, fmt.Errorf("failed to create the pods' %s network on %s: %v", cfg.Driver, master, err)
+	}
+	audit.record("k8s_network", map[string]any{"name": e.network, "driver": cfg.Driver, "master": master})
+	fmt.Printf("Attaching pods with NetworkAttachmentDefinition %s (%s on the nodes' %s)\n", e.network, cfg.Driver, master)
+	return e, nil
+}
+
+// checkKubeAccess checks that the cluster answers and lets this user create
+// pods.
+func checkKubeAccess(ctx context.Context, kube *kubectl) error {
+	out, err := kube.run(ctx, nil, "auth", "can-i", "create", "pods")
+	if strings.TrimSpace(out) == "no" {
+		return fmt.Errorf("the Kubernetes user may not create pods in this namespace")
+	}
+	return err
+}
+
+// parseNodeSelector parses -k8s-node-selector's key=value labels.
+func parseNodeSelector(specs []string) (map[string]string, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	selector := make(map[string]string)
+	for _, spec := range specs {
+		key, value, ok := strings.Cut(spec, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid -k8s-node-selector '%s': use key=value", spec)
+		}
+		selector[key] = value
+	}
+	return selector, nil
+}
+
+// attachmentManifest returns the NetworkAttachmentDefinition putting pods
+// on master's segment with no IPAM, so the pods' own DHCP clients address
+// them. macvlan takes each pod's MAC from its network annotation.
+func attachmentManifest(name, driver, master string) map[string]any {
+	config := map[string]any{"cniVersion": "0.3.1", "type": driver, "master": master, "ipam": map[string]any{}}
+	if driver == driverMacvlan {
+		config["mode"] = "bridge"
+		config["capabilities"] = map[string]bool{"mac": true}
+	} else {
+		config["mode"] = "l2"
+	}
+	data, _ := json.Marshal(config)
+	return map[string]any{
+		"apiVersion": "k8s.cni.cncf.io/v1",
+		"kind":       "NetworkAttachmentDefinition",
+		"metadata":   map[string]any{"name": name, "labels": runLabels()},
+		"spec":       map[string]any{"config": string(data)},
+	}
+}
+
+func (e *k8sEngine) Name() string                     { return modeK8s }
+func (e *k8sEngine) Capabilities() engineCapabilities { return k8sCapabilities }
+
+// k8sPodName returns the name of the client pod with mac.
+func k8sPodName(mac net.HardwareAddr) string {
+	return "ipocalypse-" + strings.ReplaceAll(mac.String(), ":", "")
+}
+
+// podManifest returns the client pod for spec: the image's entrypoint runs
+// with the client script as its arguments, as in a container, with the
+// capabilities it needs to configure the attachment interface.
+func (e *k8sEngine) podManifest(name string, spec launchSpec) map[string]any {
+	selection := map[string]any{"name": e.network, "interface": k8sPodInterface}
+	if !spec.SharedMAC {
+		selection["mac"] = spec.MAC.String()
+	}
+	networks, _ := json.Marshal([]map[string]any{selection})
+	var env []map[string]string
+	for _, kv := range spec.env() {
+		key, value, _ := strings.Cut(kv, "=")
+		env = append(env, map[string]string{"name": key, "value": value})
+	}
+	podSpec := map[string]any{
+		"restartPolicy":                 "Never",
+		"terminationGracePeriodSeconds": 10,
+		"containers": []map[string]any{{
+			"name":            "client",
+			"image":           spec.Image,
+			"args":            []string{"sh", "-c", clientScript},
+			"env":             env,
+			"securityContext": map[string]any{"capabilities": map[string]any{"add": []string{"NET_ADMIN", "NET_RAW"}}},
+		}},
+	}
+	if e.nodeSelector != nil {
+		podSpec["nodeSelector"] = e.nodeSelector
+	}
+	return map[string]any{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata": map[string]any{
+			"name":   name,
+			"labels": runLabels(),
+			// Image references are not valid label values.
+			"annotations": map[string]string{
+				"k8s.v1.cni.cncf.io/networks": string(networks),
+				labelImage:                    spec.Image,
+			},
+		},
+		"spec": podSpec,
+	}
+}
+
+// Launch creates the client's pod and waits for its DHCP client to record a
+// lease. The pod stays behind holding and renewing it.
+func (e *k8sEngine) Launch(ctx context.Context, spec launchSpec) (launchResult, error) {
+	name := k8sPodName(spec.MAC)
+	spec.Interface = k8sPodInterface
+	spec.DHCPClient = e.dhcpClient
+	if e.sharedMAC {
+		// ipvlan pods share the node's MAC; the server tells them apart
+		// by client identifier.
+		spec.SharedMAC = true
+		if spec.ClientID == nil && !spec.NoClientID {
+			spec.ClientID = append([]byte{1}, spec.MAC...)
+		}
+	}
+	result, err := e.launch(ctx, name, spec)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err != nil {
+		e.failures++
+		return result, err
+	}
+	e.acks++
+	e.held++
+	return result, nil
+}
+
+func (e *k8sEngine) launch(ctx context.Context, name string, spec launchSpec) (launchResult, error) {
+	// A launch under way finishes even when the run stops, so no pod is
+	// left half set up.
+	ctx = context.WithoutCancel(ctx)
+	data, err := json.Marshal(e.podManifest(name, spec))
+	if err != nil {
+		return launchResult{}, err
+	}
+	if _, err := e.kube.run(ctx, data, "create", "-f", "-"); err != nil {
+		return launchResult{}, fmt.Errorf("%w: %v", ErrContainerCreate, err)
+	}
+	events.emit("pod_launched", map[string]any{"pod": name, "image": spec.Image, "network": e.network, "mac": spec.MAC.String(), "hostname": spec.Hostname})
+	if _, err := e.kube.run(ctx, nil, "wait", "--for=condition=Ready", "pod/"+name, "--timeout="+k8sStartTimeout.String()); err != nil {
+		e.delete(ctx, name)
+		return launchResult{ID: name}, fmt.Errorf("%w: pod %s: %v", ErrContainerStart, name, err)
+	}
+	lease, err := e.waitForLease(ctx, name)
+	if err != nil || lease == "" {
+		e.delete(ctx, name)
+		if err != nil {
+			return launchResult{ID: name}, err
+		}
+		return launchResult{ID: name}, fmt.Errorf("pod %s %w", name, ErrNoLease)
+	}
+	ip, leaseTime, server := parseDHClientLease(lease)
+	return launchResult{ID: name, MAC: spec.MAC.String(), IP: ip, LeaseTime: leaseTime, Server: server, DNS: parseDHClientDNS(lease), ClientID: formatClientID(spec.ClientID)}, nil
+}
+
+// waitForLease returns the pod's lease file once it records an IPv4 lease,
+// checking every poll, or "" once the DHCP timeout passes without one. A
+// pod that stops running while waiting is an error of its own.
+func (e *k8sEngine) waitForLease(ctx context.Context, name string) (string, error) {
+	deadline := clock.After(e.timeout)
+	for {
+		out, _ := e.kube.exec(ctx, name, "cat /var/lib/dhcp/dhclient*.leases 2>/dev/null")
+		if strings.Contains(out, "fixed-address") {
+			return out, nil
+		}
+		phase, err := e.kube.run(ctx, nil, "get", "pod", name, "-o", "jsonpath={.status.phase}")
+		if err != nil {
+			return "", err
+		}
+		if phase != "Running" {
+			return "", fmt.Errorf("pod %s is %s before DHCP completed", name, orDash(phase))
+		}
+		select {
+		case <-deadline:
+			return "", nil
+		case <-clock.After(e.poll):
+		}
+	}
+}
+
+// delete removes a pod without waiting for it to go.
+func (e *k8sEngine) delete(ctx context.Context, name string) error {
+	_, err := e.kube.run(ctx, nil, "delete", "pod", name, "--wait=false", "--ignore-not-found")
+	return err
+}
+
+// Release has the pod's DHCP client release its lease and deletes the pod.
+func (e *k8sEngine) Release(ctx context.Context, r leaseRecord) error {
+	mac, err := net.ParseMAC(r.MAC)
+	if err != nil {
+		return err
+	}
+	name := k8sPodName(mac)
+	_, err = e.kube.exec(ctx, name, containerRelease)
+	err = errors.Join(err, e.delete(ctx, name))
+	e.mu.Lock()
+	e.held--
+	e.mu.Unlock()
+	return err
+}
+
+// Verify checks that the pod's attachment interface still carries its
+// address.
+func (e *k8sEngine) Verify(ctx context.Context, r leaseRecord) error {
+	mac, err := net.ParseMAC(r.MAC)
+	if err != nil {
+		return err
+	}
+	name := k8sPodName(mac)
+	out, err := e.kube.exec(ctx, name, "ip -4 -o addr show dev "+k8sPodInterface)
+	if err != nil {
+		return fmt.Errorf("pod %s is gone: %v", name, err)
+	}
+	if !strings.Contains(out, " "+r.IP+"/") {
+		return fmt.Errorf("pod %s no longer holds %s", name, r.IP)
+	}
+	return nil
+}
+
+// Renew has the pod's DHCP client renew its lease, as in a container.
+func (e *k8sEngine) Renew(ctx context.Context, r leaseRecord) error {
+	mac, err := net.ParseMAC(r.MAC)
+	if err != nil {
+		return err
+	}
+	_, err = e.kube.exec(ctx, k8sPodName(mac), containerRenew)
+	return err
+}
+
+// printSummary reports the engine's lease counters.
+func (e *k8sEngine) printSummary() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	fmt.Printf("Leases obtained:   %d\n", e.acks)
+	fmt.Printf("Failed attempts:   %d\n", e.failures)
+	fmt.Printf("Pods held:         %d\n", e.held)
+}
+
+func checkK8sEngine(cfg Config) error {
+	kube, err := newKubectl(cfg)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return checkKubeAccess(ctx, kube)
+}
+
+// runPods returns the names and phases of the pods labelled by any run.
+func runPods(ctx context.Context, kube *kubectl) (map[string]string, error) {
+	out, err := kube.run(ctx, nil, "get", "pods", "-l", labelRun, "-o", `jsonpath={range .items[*]}{.metadata.name} {.status.phase}{"\n"}{end}`)
+	if err != nil {
+		return nil, err
+	}
+	pods := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			pods[fields[0]] = fields[1]
+		}
+	}
+	return pods, nil
+}
+
+// releasePods has every running client pod release its lease.
+func (t *teardown) releasePods(ctx context.Context) (string, error) {
+	if t.discoverErr != nil {
+		return "", t.discoverErr
+	}
+	var errs []error
+	released := 0
+	for name, phase := range t.pods {
+		if phase != "Running" {
+			continue
+		}
+		if _, err := t.kube.exec(ctx, name, containerRelease); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", name, err))
+			continue
+		}
+		released++
+	}
+	return fmt.Sprintf("%d leases released", released), errors.Join(errs...)
+}
+
+// deletePods deletes the client pods of every run.
+func (t *teardown) deletePods(ctx context.Context) (string, error) {
+	if t.discoverErr != nil {
+		return "", t.discoverErr
+	}
+	if len(t.pods) == 0 {
+		return "no pods found", nil
+	}
+	if _, err := t.kube.run(ctx, nil, "delete", "pods", "-l", labelRun, "--ignore-not-found"); err != nil {
+		return "", err
+	}
+	return strconv.Itoa(len(t.pods)) + " pods deleted", nil
+}
+
+// deleteAttachments deletes the NetworkAttachmentDefinitions runs created;
+// those named with -k8s-network are the operator's and stay.
+func (t *teardown) deleteAttachments(ctx context.Context) (string, error) {
+	out, err := t.kube.run(ctx, nil, "delete", "network-attachment-definitions", "-l", labelRun, "--ignore-not-found", "-o", "name")
+	if err != nil {
+		return "", err
+	}
+	if n := len(strings.Fields(out)); n > 0 {
+		return fmt.Sprintf("%d deleted", n), nil
+	}
+	return "none found", nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+)
+
+// Labels put on the containers, images and networks a run creates, so they
+// can be found again by cleanup, status queries and later runs without
+// relying on names alone.
+const (
+	labelRun    = "ipocalypse.run-id"
+	labelImage  = "ipocalypse.image"
+	labelWorker = "ipocalypse.worker"
+	labelRole   = "ipocalypse.role"
+)
+
+// runID identifies this process's run in the labels of what it creates.
+var runID = newRunID()
+
+// newRunID returns a run ID that sorts by start time, e.g.
+// 20261016-153000-1a2b.
+func newRunID() string {
+	b := make([]byte, 2)
+	rand.Read(b)
+	return time.Now().UTC().Format("20060102-150405") + "-" + hex.EncodeToString(b)
+}
+
+// runLabels returns this run's labels plus the given key/value pairs.
+func runLabels(pairs ...string) map[string]string {
+	labels := map[string]string{labelRun: runID}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		labels[pairs[i]] = pairs[i+1]
+	}
+	return labels
+}
+
+// labelledFilter matches resources labelled by any run.
+func labelledFilter() filters.Args {
+	return filters.NewArgs(filters.Arg("label", labelRun))
+}
+
+// earlierRunContainers counts the labelled containers left by other runs, by
+// run ID.
+func earlierRunContainers(ctx context.Context, cli containerRuntime) (map[string]int, error) {
+	containers, err := cli.ContainerList(ctx, container.ListOptions{All: true, Filters: labelledFilter()})
+	if err != nil {
+		return nil, err
+	}
+	runs := make(map[string]int)
+	for _, c := range containers {
+		if id := c.Labels[labelRun]; id != runID {
+			runs[id]++
+		}
+	}
+	return runs, nil
+}
+
+// runStatus is one run's labelled resources.
+type runStatus struct {
+	ID         string
+	Running    int
+	Containers int
+	Images     []string
+	Networks   []string
+}
+
+// runStatuses groups the labelled containers, images and networks by run.
+func runStatuses(ctx context.Context, cli containerRuntime) ([]*runStatus, error) {
+	byRun := make(map[string]*runStatus)
+	get := func(id string) *runStatus {
+		if byRun[id] == nil {
+			byRun[id] = &runStatus{ID: id}
+		}
+		return byRun[id]
+	}
+	containers, err := cli.ContainerList(ctx, container.ListOptions{All: true, Filters: labelledFilter()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %v", err)
+	}
+	for _, c := range containers {
+		s := get(c.Labels[labelRun])
+		s.Containers++
+		if c.State == "running" {
+			s.Running++
+		}
+	}
+	images, err := cli.ImageList(ctx, image.ListOptions{Filters: labelledFilter()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list images: %v", err)
+	}
+	for _, img := range images {
+		s := get(img.Labels[labelRun])
+		s.Images = append(s.Images, strings.Join(img.RepoTags, ","))
+	}
+	networks, err := cli.NetworkList(ctx, network.ListOptions{Filters: labelledFilter()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list networks: %v", err)
+	}
+	for _, n := range networks {
+		s := get(n.Labels[labelRun])
+		s.Networks = append(s.Networks, n.Name)
+	}
+	statuses := make([]*runStatus, 0, len(byRun))
+	for _, s := range byRun {
+		statuses = append(statuses, s)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+	return statuses, nil
+}
+
+// runStatusCommand lists the resources of every run still present on the
+// container engine, found by their labels.
+func runStatusCommand(args []string) {
+	cfg := defaultConfig()
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	fs.StringVar(&cfg.Runtime, "runtime", cfg.Runtime, "Container runtime to query: docker, podman or auto")
+	fs.StringVar(&cfg.Host, "host", "", "Remote container engine to query, as for a run")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage:
+  ./ipocalypse status [-runtime name] [-host url]
+
+Lists the containers, images and networks that ipocalypse runs left on the
+container engine, by run ID.
+
+Options:
+`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	cli, _, err := newContainerRuntime(cfg)
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		os.Exit(1)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	statuses, err := runStatuses(ctx, cli)
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		os.Exit(1)
+	}
+	if len(statuses) == 0 {
+		fmt.Println("No ipocalypse resources found")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "RUN\tCONTAINERS\tNETWORKS\tIMAGES")
+	for _, s := range statuses {
+		fmt.Fprintf(w, "%s\t%d (%d running)\t%s\t%s\n", orDash(s.ID), s.Containers, s.Running, orDash(strings.Join(s.Networks, ",")), orDash(strings.Join(s.Images, ",")))
+	}
+	w.Flush()
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/errdefs"
+)
+
+const testLease = `lease {
+  interface "eth0";
+  fixed-address 192.168.1.57;
+  option dhcp-lease-time 3600;
+  option dhcp-server-identifier 192.168.1.1;
+  option domain-name-servers 192.168.1.1,9.9.9.9;
+}
+`
+
+// testLease6 is the lease file of dhclient -6.
+const testLease6 = `lease6 {
+  interface "eth0";
+  ia-na 11:00:02:00 {
+    starts 1704067200;
+    renew 1800;
+    rebind 2880;
+    iaaddr 2001:db8:40::57 {
+      starts 1704067200;
+      preferred-life 3600;
+      max-life 7200;
+    }
+  }
+  option dhcp6.client-id 0:3:0:1:2:42:ac:11:0:2;
+  option dhcp6.server-id 0:1:0:1:2d:1f:3a:4b:0:c:29:aa:bb:cc;
+  option dhcp6.name-servers 2001:db8:40::53;
+}
+`
+
+const testNetwork = "ipocalypse_test"
+
+func testSpec() launchSpec {
+	return launchSpec{
+		Image:            "ipocalypse_basic_image:latest",
+		Network:          testNetwork,
+		MAC:              net.HardwareAddr{0x02, 0x42, 0xac, 0x11, 0x00, 0x02},
+		DHCPTimeout:      10 * time.Second,
+		DHCPPollInterval: time.Second,
+	}
+}
+
+// launchInVirtualTime runs launchContainer, letting polls pass on c while
+// it waits for the lease: each waits until the launch is blocked on its
+// deadline and poll timers, then moves the clock on by one poll interval.
+func launchInVirtualTime(t *testing.T, c *manualClock, cli containerRuntime, spec launchSpec, polls int) (launchResult, error) {
+	t.Helper()
+	type outcome struct {
+		result launchResult
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		result, err := launchContainer(context.Background(), cli, spec)
+		done <- outcome{result, err}
+	}()
+	for range polls {
+		c.blockUntil(2)
+		c.advance(spec.DHCPPollInterval)
+	}
+	select {
+	case o := <-done:
+		return o.result, o.err
+	case <-time.After(5 * time.Second):
+		t.Fatal("launch did not return")
+		return launchResult{}, nil
+	}
+}
+
+func TestLaunchContainer(t *testing.T) {
+	tests := []struct {
+		name      string
+		container fakeContainer
+		polls     int
+		wantIP    string
+		wantErr   error
+		wantGone  bool
+	}{
+		{
+			name:      "leased at once",
+			container: fakeContainer{endpointIP: "172.18.0.2", lease: testLease},
+			wantIP:    "192.168.1.57",
+		},
+		{
+			name:      "leased after three polls",
+			container: fakeContainer{endpointIP: "172.18.0.2", lease: testLease, leaseAfter: 3 * time.Second},
+			polls:     3,
+			wantIP:    "192.168.1.57",
+		},
+		{
+			name:      "no lease within the timeout",
+			container: fakeContainer{endpointIP: "172.18.0.2"},
+			polls:     10,
+			wantErr:   ErrNoLease,
+			wantGone:  true,
+		},
+		{
+			name:      "self-assigned address",
+			container: fakeContainer{endpointIP: "172.18.0.2", addrs: "2: eth0    inet 169.254.12.34/16 brd 169.254.255.255 scope link eth0\n"},
+			polls:     10,
+			wantErr:   ErrAPIPA,
+			wantGone:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := useManualClock(t)
+			cli := newFakeRuntime(c, testNetwork, func() *fakeContainer {
+				ctr := tt.container
+				return &ctr
+			})
+			result, err := launchInVirtualTime(t, c, cli, testSpec(), tt.polls)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("launchContainer() error = %v, want %v", err, tt.wantErr)
+			}
+			if result.IP != tt.wantIP {
+				t.Errorf("IP = %q, want %q", result.IP, tt.wantIP)
+			}
+			if tt.wantErr == nil {
+				if result.LeaseTime != time.Hour || result.Server != "192.168.1.1" {
+					t.Errorf("lease time %v from %q, want 1h from 192.168.1.1", result.LeaseTime, result.Server)
+				}
+			}
+			if gone := cli.removed(result.ID); gone != tt.wantGone {
+				t.Errorf("container removed = %v, want %v", gone, tt.wantGone)
+			}
+		})
+	}
+}
+
+func TestLaunchContainerDHCPv6(t *testing.T) {
+	c := useManualClock(t)
+	cli := newFakeRuntime(c, testNetwork, func() *fakeContainer {
+		return &fakeContainer{endpointIP: "172.18.0.2", endpointIPv6: "2001:db8:40::2", lease: testLease6}
+	})
+	spec := testSpec()
+	spec.DHCPv6 = true
+	result, err := launchInVirtualTime(t, c, cli, spec, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.IP != "2001:db8:40::57" || result.LeaseTime != 2*time.Hour {
+		t.Errorf("leased %s for %v, want 2001:db8:40::57 for 2h", result.IP, result.LeaseTime)
+	}
+	if len(result.DNS) != 1 || result.DNS[0] != "2001:db8:40::53" {
+		t.Errorf("DNS = %v, want 2001:db8:40::53", result.DNS)
+	}
+}
+
+func TestParseDHClientLease(t *testing.T) {
+	tests := []struct {
+		name      string
+		leases    string
+		wantIP    string
+		wantLease time.Duration
+		wantDNS   []string
+	}{
+		{"dhcpv4", testLease, "192.168.1.57", time.Hour, []string{"192.168.1.1", "9.9.9.9"}},
+		{"dhcpv6", testLease6, "2001:db8:40::57", 2 * time.Hour, []string{"2001:db8:40::53"}},
+		// The client script's hook writes only the address.
+		{"dhcpv6 from the hook", "lease6 {\n  ia-na {\n    iaaddr 2001:db8:40::58 {\n    }\n  }\n}\n", "2001:db8:40::58", 0, nil},
+		{"renewed", testLease + strings.Replace(testLease, "192.168.1.57", "192.168.1.60", 1), "192.168.1.60", time.Hour, []string{"192.168.1.1", "9.9.9.9"}},
+		{"none", "", "", 0, nil},
+	}
+	for _, tt := range tests {
+		ip, leaseTime, _ := parseDHClientLease(tt.leases)
+		dns := parseDHClientDNS(tt.leases)
+		if ip != tt.wantIP || leaseTime != tt.wantLease || strings.Join(dns, ",") != strings.Join(tt.wantDNS, ",") {
+			t.Errorf("%s: %s for %v with DNS %v, want %s for %v with DNS %v", tt.name, ip, leaseTime, dns, tt.wantIP, tt.wantLease, tt.wantDNS)
+		}
+	}
+}
+
+func TestWaitForLease(t *testing.T) {
+	tests := []struct {
+		name      string
+		container fakeContainer
+		polls     int
+		wantErr   string
+	}{
+		{
+			name:      "lease recorded",
+			container: fakeContainer{lease: testLease, leaseAfter: 2 * time.Second},
+			polls:     2,
+		},
+		{
+			// The caller finds the missing lease when it inspects the
+			// container.
+			name:  "timeout",
+			polls: 10,
+		},
+		{
+			name:      "client exits",
+			container: fakeContainer{exitAfter: 4 * time.Second, exitCode: 1},
+			polls:     4,
+			wantErr:   "container exited with code 1 before DHCP completed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := useManualClock(t)
+			ctr := tt.container
+			cli := newFakeRuntime(c, testNetwork, func() *fakeContainer { return &ctr })
+			ctx := context.Background()
+			id := startFakeContainer(t, ctx, cli)
+
+			done := make(chan error, 1)
+			go func() { done <- waitForLease(ctx, cli, id, 10*time.Second, time.Second) }()
+			for range tt.polls {
+				c.blockUntil(2)
+				c.advance(time.Second)
+			}
+			var err error
+			select {
+			case err = <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("waitForLease did not return")
+			}
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Errorf("waitForLease() error = %v, want %q", err, tt.wantErr)
+			}
+			if got, want := c.Since(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)), time.Duration(tt.polls)*time.Second; got != want {
+				t.Errorf("waited %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func startFakeContainer(t *testing.T, ctx context.Context, cli *fakeRuntime) string {
+	t.Helper()
+	endpoints := &network.NetworkingConfig{EndpointsConfig: map[string]*network.EndpointSettings{testNetwork: {}}}
+	resp, err := cli.ContainerCreate(ctx, &container.Config{}, nil, endpoints, nil, "")
+	if err == nil {
+		err = cli.ContainerStart(ctx, resp.ID, container.StartOptions{})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.ID
+}
+
+func TestLaunchContainerCanceled(t *testing.T) {
+	c := useManualClock(t)
+	cli := newFakeRuntime(c, testNetwork, func() *fakeContainer { return &fakeContainer{endpointIP: "172.18.0.2"} })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type outcome struct {
+		result launchResult
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		result, err := launchContainer(ctx, cli, testSpec())
+		done <- outcome{result, err}
+	}()
+	// Two polls in, with the lease still outstanding.
+	for range 2 {
+		c.blockUntil(2)
+		c.advance(time.Second)
+	}
+	c.blockUntil(2)
+	cancel()
+
+	var o outcome
+	select {
+	case o = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("launch did not return once its context was canceled")
+	}
+	if !errors.Is(o.err, context.Canceled) {
+		t.Errorf("launchContainer() error = %v, want %v", o.err, context.Canceled)
+	}
+	if isDHCPOutcome(o.err) {
+		t.Errorf("a canceled launch counted as the DHCP server's answer: %v", o.err)
+	}
+	if !cli.removed(o.result.ID) {
+		t.Error("container of the canceled launch was not removed")
+	}
+	if got := c.Since(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)); got != 2*time.Second {
+		t.Errorf("launch waited %v of virtual time, want 2s", got)
+	}
+}
+
+// TestLaunchRetryable checks how the retry policy treats launch failures:
+// requests the runtime rejects outright fail the worker at once, the rest
+// are retried.
+func TestLaunchRetryable(t *testing.T) {
+	tests := []struct {
+		name          string
+		network       string
+		createErr     error
+		startErr      error
+		wantErr       error
+		wantRetryable bool
+	}{
+		{
+			name:          "no lease",
+			wantErr:       ErrNoLease,
+			wantRetryable: true,
+		},
+		{
+			name:          "image missing",
+			createErr:     errdefs.NotFound(errors.New("No such image: ipocalypse_basic_image:latest")),
+			wantErr:       ErrContainerCreate,
+			wantRetryable: false,
+		},
+		{
+			name:          "network deleted under the run",
+			network:       "other",
+			wantErr:       ErrNetworkMissing,
+			wantRetryable: true,
+		},
+		{
+			name:          "invalid configuration",
+			startErr:      errdefs.InvalidParameter(errors.New("invalid mac address")),
+			wantErr:       ErrContainerStart,
+			wantRetryable: false,
+		},
+		{
+			name:          "transient start failure",
+			startErr:      errors.New("driver failed programming external connectivity"),
+			wantErr:       ErrContainerStart,
+			wantRetryable: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := useManualClock(t)
+			network := testNetwork
+			if tt.network != "" {
+				network = tt.network
+			}
+			cli := newFakeRuntime(c, network, func() *fakeContainer { return &fakeContainer{endpointIP: "172.18.0.2"} })
+			cli.createErr, cli.startErr = tt.createErr, tt.startErr
+			spec := testSpec()
+			// Without a DHCP timeout the lease is looked for once.
+			spec.DHCPTimeout = 0
+			_, err := launchContainer(context.Background(), cli, spec)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("launchContainer() error = %v, want %v", err, tt.wantErr)
+			}
+			if got := retryable(err); got != tt.wantRetryable {
+				t.Errorf("retryable(%v) = %v, want %v", err, got, tt.wantRetryable)
+			}
+		})
+	}
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// leaseRecord is one address the run consumed.
+type leaseRecord struct {
+	IP           string    `json:"ip"`
+	MAC          string    `json:"mac"`
+	LeaseSeconds int       `json:"lease_seconds,omitempty"`
+	Server       string    `json:"server,omitempty"`
+	Container    string    `json:"container,omitempty"`
+	Image        string    `json:"image,omitempty"`
+	Network      string    `json:"network,omitempty"`
+	ClientID     string    `json:"client_id,omitempty"`
+	Worker       int       `json:"worker"`
+	AcquiredAt   time.Time `json:"acquired_at"`
+	// ExpiresAt is when the lease runs out unless renewed: LeaseSeconds
+	// after it was acquired or the run last renewed it. Clients that renew
+	// on their own move it without the run seeing.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// RenewedAt is when the run last renewed the lease (see -renew-leases
+	// and -renew-interval).
+	RenewedAt *time.Time `json:"renewed_at,omitempty"`
+	// Lapsing means the run deliberately lets the lease expire (see
+	// -let-expire).
+	Lapsing bool `json:"lapsing,omitempty"`
+	// ReleasedAt is set when the run gave the address back before it
+	// ended, e.g. to keep a reserve of free addresses.
+	ReleasedAt *time.Time `json:"released_at,omitempty"`
+	// ConflictMACs are the other hosts found claiming the address after
+	// it was leased (see -detect-conflicts).
+	ConflictMACs []string `json:"conflict_macs,omitempty"`
+}
+
+// leaseTable records every lease acquired during the run. It is the run's
+// record of which addresses were consumed, exported as CSV and JSON.
+type leaseTable struct {
+	mu      sync.Mutex
+	records []leaseRecord
+}
+
+// add records a lease, stamping it with the current time and, when the
+// lease time is known, when it expires.
+func (t *leaseTable) add(r leaseRecord) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r.AcquiredAt = clock.Now()
+	if r.LeaseSeconds > 0 {
+		expires := r.AcquiredAt.Add(time.Duration(r.LeaseSeconds) * time.Second)
+		r.ExpiresAt = &expires
+	}
+	t.records = append(t.records, r)
+}
+
+// restore puts back the records of a resumed run, keeping their times.
+func (t *leaseTable) restore(records []leaseRecord) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.records = append(t.records, records...)
+	sort.SliceStable(t.records, func(i, j int) bool { return t.records[i].AcquiredAt.Before(t.records[j].AcquiredAt) })
+}
+
+// markReleased stamps the lease on ip as released by the run.
+func (t *leaseTable) markReleased(ip string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.records {
+		if t.records[i].IP == ip && t.records[i].ReleasedAt == nil {
+			now := clock.Now()
+			t.records[i].ReleasedAt = &now
+			audit.record("lease_released", map[string]any{"ip": ip, "mac": t.records[i].MAC})
+		}
+	}
+}
+
+// markRenewed stamps the held lease on ip for mac as renewed now, moving its
+// expiry a lease time on.
+func (t *leaseTable) markRenewed(ip, mac string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.records {
+		r := &t.records[i]
+		if r.IP == ip && strings.EqualFold(r.MAC, mac) && r.ReleasedAt == nil {
+			now := clock.Now()
+			r.RenewedAt = &now
+			if r.LeaseSeconds > 0 {
+				expires := now.Add(time.Duration(r.LeaseSeconds) * time.Second)
+				r.ExpiresAt = &expires
+			}
+		}
+	}
+}
+
+// markLapsing records that the run lets the held lease on ip for mac
+// expire.
+func (t *leaseTable) markLapsing(ip, mac string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.records {
+		if t.records[i].IP == ip && strings.EqualFold(t.records[i].MAC, mac) && t.records[i].ReleasedAt == nil {
+			t.records[i].Lapsing = true
+		}
+	}
+}
+
+// markConflict records the other claimants of the lease on ip held by mac.
+func (t *leaseTable) markConflict(ip, mac string, claimants []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.records {
+		if t.records[i].IP == ip && strings.EqualFold(t.records[i].MAC, mac) && t.records[i].ReleasedAt == nil {
+			t.records[i].ConflictMACs = claimants
+		}
+	}
+}
+
+// hasMAC reports whether a lease was taken for mac.
+func (t *leaseTable) hasMAC(mac string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, r := range t.records {
+		if strings.EqualFold(r.MAC, mac) {
+			return true
+		}
+	}
+	return false
+}
+
+// held returns the leases the run has not released, oldest first.
+func (t *leaseTable) held() []leaseRecord {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var held []leaseRecord
+	for _, r := range t.records {
+		if r.ReleasedAt == nil {
+			held = append(held, r)
+		}
+	}
+	return held
+}
+
+// snapshot returns a copy of the records in acquisition order.
+func (t *leaseTable) snapshot() []leaseRecord {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]leaseRecord(nil), t.records...)
+}
+
+// onNetwork returns a table of the records taken on the named Docker network.
+func (t *leaseTable) onNetwork(name string) *leaseTable {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	filtered := &leaseTable{}
+	for _, r := range t.records {
+		if r.Network == name {
+			filtered.records = append(filtered.records, r)
+		}
+	}
+	return filtered
+}
+
+// writeCSV writes the table as CSV with a header row.
+func (t *leaseTable) writeCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"acquired_at", "ip", "mac", "lease_seconds", "server", "container", "image", "worker", "released_at", "network", "client_id", "conflict_macs", "expires_at", "renewed_at", "lapsing"})
+	for _, r := range t.snapshot() {
+		lease := ""
+		if r.LeaseSeconds > 0 {
+			lease = strconv.Itoa(r.LeaseSeconds)
+		}
+		released, expires, renewed := "", "", ""
+		if r.ReleasedAt != nil {
+			released = r.ReleasedAt.Format(time.RFC3339)
+		}
+		if r.ExpiresAt != nil {
+			expires = r.ExpiresAt.Format(time.RFC3339)
+		}
+		if r.RenewedAt != nil {
+			renewed = r.RenewedAt.Format(time.RFC3339)
+		}
+		cw.Write([]string{r.AcquiredAt.Format(time.RFC3339), r.IP, r.MAC, lease, r.Server, r.Container, r.Image, strconv.Itoa(r.Worker), released, r.Network, r.ClientID, strings.Join(r.ConflictMACs, " "), expires, renewed, strconv.FormatBool(r.Lapsing)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeJSON writes the table as an indented JSON array.
+func (t *leaseTable) writeJSON(w io.Writer) error {
+	records := t.snapshot()
+	if records == nil {
+		records = []leaseRecord{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(records)
+}
+
+// export writes the table to <prefix>.csv and <prefix>.json.
+func (t *leaseTable) export(prefix string) error {
+	for ext, write := range map[string]func(io.Writer) error{".csv": t.writeCSV, ".json": t.writeJSON} {
+		f, err := os.Create(prefix + ext)
+		if err != nil {
+			return fmt.Errorf("failed to export leases: %v", err)
+		}
+		err = write(f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write %s: %v", prefix+ext, err)
+		}
+	}
+	fmt.Printf("Lease table written to %s.csv and %s.json (%d leases)\n", prefix, prefix, len(t.snapshot()))
+	return nil
+}
+
+// releaseHeld gives every lease the run still holds back to its server with
+// release, stamping each one released, and returns how many were.
+func (t *leaseTable) releaseHeld(ctx context.Context, release func(ctx context.Context, r leaseRecord) error) (int, error) {
+	var errs []error
+	released := 0
+	for _, r := range t.held() {
+		if err := release(ctx, r); err != nil {
+			errs = append(errs, fmt.Errorf("%s (%s): %v", r.IP, r.MAC, err))
+			continue
+		}
+		t.markReleased(r.IP)
+		released++
+	}
+	return released, errors.Join(errs...)
+}
+
+// releaseOnExit returns the run's held leases to the pool for
+// -release-on-exit, so they do not linger on the server until they expire.
+func releaseOnExit(leases *leaseTable, release func(ctx context.Context, r leaseRecord) error) {
+	held := len(leases.held())
+	if held == 0 {
+		return
+	}
+	fmt.Printf("Releasing %d held leases...\n", held)
+	released, err := leases.releaseHeld(context.Background(), release)
+	if err != nil {
+		slog.Warn("some leases could not be released", "error", err)
+	}
+	fmt.Printf("Released %d of %d leases\n", released, held)
+}
+
+// exportOnSignal writes the lease table before the process is interrupted, so
+// stopping a run with Ctrl-C still leaves a record of the consumed addresses.
+// A non-nil release gives the held leases back first, for -release-on-exit.
+// An empty prefix disables the export.
+func exportOnSignal(leases *leaseTable, prefix string, release func(ctx context.Context, r leaseRecord) error) {
+	if prefix == "" && release == nil {
+		return
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		fmt.Printf("\nReceived %v, cleaning up before exit\n", sig)
+		if release != nil {
+			releaseOnExit(leases, release)
+		}
+		if prefix == "" {
+			os.Exit(exitSignal)
+		}
+		if err := leases.export(prefix); err != nil {
+			slog.Error("lease export failed", "error", err)
+		}
+		os.Exit(exitSignal)
+	}()
+}
+
+// containerHasLease reports whether the DHCP client inside a container has
+// recorded a bound IPv4 or DHCPv6 lease.
+func containerHasLease(ctx context.Context, cli containerRuntime, containerID string) bool {
+	out, err := containerExec(ctx, cli, containerID, []string{"sh", "-c", "cat /var/lib/dhcp/dhclient*.leases 2>/dev/null"})
+	if err != nil {
+		return false
+	}
+	return strings.Contains(out, "fixed-address") || strings.Contains(out, "iaaddr")
+}
+
+// containerLease reads the address, lease duration, server and DNS servers
+// dhclient recorded inside a container, from its DHCPv4 or DHCPv6 lease. Values that cannot be read
+// are left zero.
+func containerLease(ctx context.Context, cli containerRuntime, containerID string) (ip string, leaseTime time.Duration, server string, dns []string) {
+	out, err := containerExec(ctx, cli, containerID, []string{"sh", "-c", "cat /var/lib/dhcp/dhclient*.leases"})
+	if err != nil {
+		return "", 0, "", nil
+	}
+	ip, leaseTime, server = parseDHClientLease(out)
+	return ip, leaseTime, server, parseDHClientDNS(out)
+}
+
+// parseDHClientLease returns the address, lease duration and server of the
+// newest lease in a dhclient lease file. For a DHCPv6 lease (lease6) these
+// are the IA_NA address and its valid lifetime; the server, known by its
+// DUID, is left empty. Values that cannot be read are left zero.
+func parseDHClientLease(leases string) (ip string, leaseTime time.Duration, server string) {
+	// The newest lease is last in the file.
+	var seconds int
+	scanner := bufio.NewScanner(strings.NewReader(leases))
+	for scanner.Scan() {
+		fields := strings.Fields(strings.TrimSuffix(strings.TrimSpace(scanner.Text()), ";"))
+		switch {
+		case len(fields) == 2 && fields[0] == "lease6", len(fields) == 2 && fields[0] == "lease":
+			ip, seconds, server = "", 0, ""
+		case len(fields) == 2 && fields[0] == "fixed-address":
+			ip = fields[1]
+		case len(fields) == 3 && fields[0] == "iaaddr" && fields[2] == "{":
+			ip = fields[1]
+		case len(fields) == 2 && fields[0] == "max-life":
+			seconds, _ = strconv.Atoi(fields[1])
+		case len(fields) == 3 && fields[0] == "option" && fields[1] == "dhcp-lease-time":
+			seconds, _ = strconv.Atoi(fields[2])
+		case len(fields) == 3 && fields[0] == "option" && fields[1] == "dhcp-server-identifier":
+			server = fields[2]
+		}
+	}
+	return ip, time.Duration(seconds) * time.Second, server
+}
+
+// parseDHClientDNS returns the DNS servers of the newest lease in a dhclient
+// lease file, from its domain-name-servers or dhcp6.name-servers option.
+func parseDHClientDNS(leases string) []string {
+	var servers []string
+	scanner := bufio.NewScanner(strings.NewReader(leases))
+	for scanner.Scan() {
+		fields := strings.Fields(strings.TrimSuffix(strings.TrimSpace(scanner.Text()), ";"))
+		if len(fields) == 3 && fields[0] == "option" && (fields[1] == "domain-name-servers" || fields[1] == "dhcp6.name-servers") {
+			servers = strings.Split(fields[2], ",")
+		}
+	}
+	return servers
+}
+
+// runLeases implements the leases subcommand, which lists the leases of a
+// running ipocalypse through its control API, or of a finished run from its
+// exported JSON ledger, optionally filtered.
+func runLeases(args []string) {
+	fs := flag.NewFlagSet("leases", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:8080", "Control API address of the running ipocalypse (its -listen value)")
+	file := fs.String("file", "", "Read a stored ledger (<-lease-export>.json) instead of the live run")
+	grep := fs.String("grep", "", "Only leases with this text in their IP, MAC, server, container or image")
+	macPattern := fs.String("mac", "", "Only leases whose MAC matches this pattern, e.g. aa:bb:*")
+	asJSON := fs.Bool("json", false, "Print the matching leases as JSON instead of a table (same as -format json)")
+	format := fs.String("format", leaseFormatTable, "Output format: table, json, isc (dhcpd host declarations) or kea (reservations JSON)")
+	deny := fs.Bool("deny", false, "With -format isc or kea, write entries that refuse the identities instead of reserving their addresses")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage:
+  ./ipocalypse leases [-addr host:port | -file leases.json] [-grep text] [-mac pattern]
+                     [-json | -format table|json|isc|kea] [-deny]
+
+Finds leases in a live run started with -listen or in a stored ledger, e.g.
+  ./ipocalypse leases -grep 192.168.1.57
+  ./ipocalypse leases -file leases.json -mac 'aa:bb:*'
+
+-format isc and kea turn the held test identities into DHCP server
+reservations, or deny entries with -deny, e.g.
+  ./ipocalypse leases -file leases.json -format kea -deny > deny.json
+
+Options:
+`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *asJSON {
+		*format = leaseFormatJSON
+	}
+	switch *format {
+	case leaseFormatTable, leaseFormatJSON, leaseFormatISC, leaseFormatKea:
+	default:
+		fmt.Printf("Error: unknown -format %q (use table, json, isc or kea)\n", *format)
+		os.Exit(2)
+	}
+	if *macPattern != "" {
+		if _, err := path.Match(*macPattern, ""); err != nil {
+			fmt.Printf("Error: invalid -mac pattern %q: %v\n", *macPattern, err)
+			os.Exit(2)
+		}
+	}
+
+	var records []leaseRecord
+	var err error
+	if *file != "" {
+		records, err = readLedger(*file)
+	} else {
+		records, err = fetchLeases(*addr)
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	var matched []leaseRecord
+	for _, r := range records {
+		if *grep != "" && !strings.Contains(strings.Join([]string{r.IP, r.MAC, r.Server, r.Container, r.Image}, " "), *grep) {
+			continue
+		}
+		if *macPattern != "" {
+			if ok, _ := path.Match(strings.ToLower(*macPattern), strings.ToLower(r.MAC)); !ok {
+				continue
+			}
+		}
+		matched = append(matched, r)
+	}
+
+	switch *format {
+	case leaseFormatJSON:
+		if matched == nil {
+			matched = []leaseRecord{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(matched)
+	case leaseFormatISC:
+		writeISCHosts(os.Stdout, matched, *deny)
+	case leaseFormatKea:
+		writeKeaReservations(os.Stdout, matched, *deny)
+	default:
+		printLeaseTable(os.Stdout, matched)
+	}
+	if len(matched) == 0 {
+		os.Exit(1)
+	}
+}
+
+// fetchLeases reads the lease table of a running ipocalypse.
+func fetchLeases(addr string) ([]leaseRecord, error) {
+	if strings.HasPrefix(addr, ":") {
+		addr = "localhost" + addr
+	}
+	req, err := newControlRequest(context.Background(), http.MethodGet, "http://"+addr+"/leases", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not reach the control API at %s: %v", addr, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("control API returned %s", resp.Status)
+	}
+	var records []leaseRecord
+	if err := json.NewDecoder(resp.Body).Decode(&records); err != nil {
+		return nil, fmt.Errorf("unexpected response from the control API: %v", err)
+	}
+	return records, nil
+}
+
+// readLedger reads a lease table exported as JSON.
+func readLedger(path string) ([]leaseRecord, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ledger: %v", err)
+	}
+	var records []leaseRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("failed to parse ledger %s: %v", path, err)
+	}
+	return records, nil
+}
+
+// printLeaseTable writes records as an aligned table.
+func printLeaseTable(w io.Writer, records []leaseRecord) {
+	if len(records) == 0 {
+		fmt.Fprintln(w, "No matching leases")
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "IP\tMAC\tSERVER\tLEASE\tCONTAINER\tIMAGE\tWORKER\tACQUIRED\tCONFLICT")
+	for _, r := range records {
+		lease := "-"
+		if r.LeaseSeconds > 0 {
+			lease = (time.Duration(r.LeaseSeconds) * time.Second).String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n", r.IP, r.MAC, orDash(r.Server), lease, orDash(r.Container), orDash(r.Image), r.Worker, r.AcquiredAt.Format("15:04:05"), orDash(strings.Join(r.ConflictMACs, ",")))
+	}
+	tw.Flush()
+	if len(records) == 1 {
+		fmt.Fprintln(w, "1 lease")
+	} else {
+		fmt.Fprintf(w, "%d leases\n", len(records))
+	}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-units"
+)
+
+// readOnlyWritable are the paths a DHCP client writes to, kept writable on
+// a read-only root filesystem. /etc/resolv.conf and /etc/hosts are bind
+// mounts Docker keeps writable anyway.
+var readOnlyWritable = []string{"/var/lib/dhcp", "/run", "/var/run", "/tmp"}
+
+// containerLimits caps what each client container may use, so a run of a
+// thousand containers does not exhaust the host before it exhausts the pool.
+type containerLimits struct {
+	// Memory is the memory limit in bytes, or 0 for none.
+	Memory int64
+	// NanoCPUs is the CPU limit in billionths of a CPU, or 0 for none.
+	NanoCPUs int64
+	// ReadOnly mounts the image's root filesystem read-only, with small
+	// size-capped tmpfs mounts for the paths in readOnlyWritable.
+	ReadOnly bool
+}
+
+// parseContainerLimits validates -container-memory, -container-cpus and
+// -read-only.
+func parseContainerLimits(cfg Config) (containerLimits, error) {
+	limits := containerLimits{ReadOnly: cfg.ReadOnly}
+	if cfg.ContainerMemory != "" {
+		memory, err := units.RAMInBytes(cfg.ContainerMemory)
+		if err != nil {
+			return limits, fmt.Errorf("invalid -container-memory %q: %v", cfg.ContainerMemory, err)
+		}
+		// Docker refuses limits below 6MB at container creation; say so
+		// before anything is built.
+		if memory < 6*units.MiB {
+			return limits, fmt.Errorf("-container-memory must be at least 6m")
+		}
+		limits.Memory = memory
+	}
+	if cfg.ContainerCPUs < 0 {
+		return limits, fmt.Errorf("-container-cpus must not be negative")
+	}
+	limits.NanoCPUs = int64(math.Round(cfg.ContainerCPUs * 1e9))
+	return limits, nil
+}
+
+// set reports whether any limit is configured.
+func (l containerLimits) set() bool {
+	return l.Memory > 0 || l.NanoCPUs > 0 || l.ReadOnly
+}
+
+// apply adds the limits to a container's host configuration.
+func (l containerLimits) apply(hostConfig *container.HostConfig) {
+	hostConfig.Memory = l.Memory
+	if l.Memory > 0 {
+		// Without swap the limit is a hard cap rather than an invitation
+		// to page out.
+		hostConfig.MemorySwap = l.Memory
+	}
+	hostConfig.NanoCPUs = l.NanoCPUs
+	if l.ReadOnly {
+		hostConfig.ReadonlyRootfs = true
+		hostConfig.Tmpfs = make(map[string]string, len(readOnlyWritable))
+		for _, path := range readOnlyWritable {
+			hostConfig.Tmpfs[path] = "rw,size=1m"
+		}
+	}
+}
+
+// String describes the limits for the run banner.
+func (l containerLimits) String() string {
+	s := "memory unlimited"
+	if l.Memory > 0 {
+		s = "memory " + units.BytesSize(float64(l.Memory))
+	}
+	if l.NanoCPUs > 0 {
+		s += fmt.Sprintf(", %g CPUs", float64(l.NanoCPUs)/1e9)
+	} else {
+		s += ", CPUs unlimited"
+	}
+	if l.ReadOnly {
+		s += ", read-only root filesystem"
+	}
+	return s
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Log formats selectable with -log-format.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// setupLogging installs the default structured logger for run events, writing
+// to w. JSON output carries one object per line, ready for ELK-style
+// ingestion. minLevel raises the configured level, e.g. so the -tui dashboard
+// only receives warnings and errors.
+func setupLogging(w io.Writer, format, level string, minLevel slog.Level) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q (use debug, info, warn or error)", level)
+	}
+	opts := &slog.HandlerOptions{Level: max(lvl, minLevel)}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case logFormatText:
+		handler = slog.NewTextHandler(w, opts)
+	case logFormatJSON:
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("invalid log format %q (use text or json)", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// workerLogger returns a logger that tags every record with the worker id.
+func workerLogger(workerID int) *slog.Logger {
+	return slog.Default().With("worker", workerID)
+}
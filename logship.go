@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logSinkQueue is how many records may wait for a slow sink before new ones
+// are dropped; shipping never holds up the run.
+const logSinkQueue = 4096
+
+// syslogFacility is local0, where the records of tools without a facility of
+// their own usually go.
+const syslogFacility = 16
+
+// syslogEnterpriseID tags the structured data of shipped records; 32473 is
+// reserved for documentation (RFC 5612).
+const syslogEnterpriseID = "ipocalypse@32473"
+
+// logSink delivers formatted records to one remote collector.
+type logSink interface {
+	send(records []shippedRecord) error
+	String() string
+}
+
+// shippedRecord is a log record copied off the logging path.
+type shippedRecord struct {
+	Time    time.Time
+	Level   slog.Level
+	Message string
+	Attrs   []slog.Attr
+}
+
+// parseLogSink parses a -log-sink URL: udp://, tcp:// or tls://host:port for
+// an RFC 5424 syslog server, or an http:// or https:// URL to POST records
+// to as JSON lines.
+func parseLogSink(raw string) (logSink, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid log sink %q (use udp://, tcp:// or tls://host:port, or an http(s) URL)", raw)
+	}
+	switch u.Scheme {
+	case "udp", "tcp", "tls":
+		host := u.Host
+		if u.Port() == "" {
+			port := "514"
+			if u.Scheme == "tls" {
+				port = "6514"
+			}
+			host = net.JoinHostPort(u.Hostname(), port)
+		}
+		return &syslogSink{network: u.Scheme, addr: host}, nil
+	case "http", "https":
+		return &httpSink{url: raw, client: &http.Client{Timeout: 10 * time.Second}}, nil
+	}
+	return nil, fmt.Errorf("invalid log sink %q: unknown scheme %q", raw, u.Scheme)
+}
+
+// syslogSink sends RFC 5424 messages over UDP, one per datagram, or over TCP
+// or TLS with octet-counting framing (RFC 6587, RFC 5425).
+type syslogSink struct {
+	network string
+	addr    string
+	conn    net.Conn
+}
+
+func (s *syslogSink) String() string {
+	return s.network + "://" + s.addr
+}
+
+func (s *syslogSink) send(records []shippedRecord) error {
+	if s.conn == nil {
+		var err error
+		switch s.network {
+		case "tls":
+			s.conn, err = tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", s.addr, &tls.Config{})
+		default:
+			s.conn, err = net.DialTimeout(s.network, s.addr, 10*time.Second)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, r := range records {
+		msg := formatSyslog(r)
+		if s.network != "udp" {
+			msg = fmt.Sprintf("%d %s", len(msg), msg)
+		}
+		s.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if _, err := s.conn.Write([]byte(msg)); err != nil {
+			// Reconnect on the next batch.
+			s.conn.Close()
+			s.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+// syslogHostname fills the HOSTNAME field of shipped messages.
+var syslogHostname = func() string {
+	name, err := os.Hostname()
+	if err != nil || name == "" {
+		return "-"
+	}
+	return name
+}()
+
+// formatSyslog writes a record as an RFC 5424 message, with its attributes
+// as structured data.
+func formatSyslog(r shippedRecord) string {
+	severity := 6 // informational
+	switch {
+	case r.Level >= slog.LevelError:
+		severity = 3
+	case r.Level >= slog.LevelWarn:
+		severity = 4
+	case r.Level < slog.LevelInfo:
+		severity = 7
+	}
+	sd := "-"
+	if len(r.Attrs) > 0 {
+		var b strings.Builder
+		b.WriteString("[" + syslogEnterpriseID)
+		for _, a := range r.Attrs {
+			fmt.Fprintf(&b, ` %s="%s"`, syslogParamName(a.Key), syslogEscape.Replace(a.Value.String()))
+		}
+		b.WriteString("]")
+		sd = b.String()
+	}
+	return fmt.Sprintf("<%d>1 %s %s ipocalypse %d - %s %s", syslogFacility*8+severity, r.Time.UTC().Format(time.RFC3339Nano), syslogHostname, os.Getpid(), sd, r.Message)
+}
+
+// syslogEscape escapes structured data parameter values.
+var syslogEscape = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// syslogParamName drops the characters RFC 5424 forbids in parameter names.
+func syslogParamName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' || r == '=' || r == ']' || r == '"' {
+			return -1
+		}
+		return r
+	}, key)
+	if len(name) > 32 {
+		name = name[:32]
+	}
+	return name
+}
+
+// httpSink POSTs batches of records as JSON lines, the format most log
+// collectors' HTTP inputs accept.
+type httpSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpSink) String() string {
+	return s.url
+}
+
+func (s *httpSink) send(records []shippedRecord) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, r := range records {
+		record := map[string]any{"time": r.Time.UTC(), "level": r.Level.String(), "msg": r.Message, "host": syslogHostname, "app": "ipocalypse"}
+		for _, a := range r.Attrs {
+			record[a.Key] = a.Value.Any()
+		}
+		if err := enc.Encode(record); err != nil {
+			return err
+		}
+	}
+	resp, err := s.client.Post(s.url, "application/x-ndjson", &body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", s.url, resp.Status)
+	}
+	return nil
+}
+
+// shipper queues records for one sink and delivers them in the background.
+type shipper struct {
+	sink    logSink
+	queue   chan shippedRecord
+	mu      sync.Mutex
+	dropped int
+	failing bool
+}
+
+func newShipper(sink logSink) *shipper {
+	s := &shipper{sink: sink, queue: make(chan shippedRecord, logSinkQueue)}
+	go s.run()
+	return s
+}
+
+// enqueue adds a record without blocking, dropping it if the queue is full.
+func (s *shipper) enqueue(r shippedRecord) {
+	select {
+	case s.queue <- r:
+	default:
+		s.mu.Lock()
+		s.dropped++
+		if s.dropped == 1 {
+			fmt.Fprintf(os.Stderr, "Warning: log sink %s is falling behind; dropping records\n", s.sink)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// run sends what is queued in batches. A failed batch is retried after a
+// pause; meanwhile new records queue up, or are dropped once the queue fills.
+func (s *shipper) run() {
+	for r := range s.queue {
+		batch := []shippedRecord{r}
+	fill:
+		for len(batch) < 100 {
+			select {
+			case r := <-s.queue:
+				batch = append(batch, r)
+			default:
+				break fill
+			}
+		}
+		for {
+			err := s.sink.send(batch)
+			if err == nil {
+				if s.failing {
+					fmt.Fprintf(os.Stderr, "Log sink %s is reachable again\n", s.sink)
+					s.failing = false
+				}
+				break
+			}
+			if !s.failing {
+				fmt.Fprintf(os.Stderr, "Warning: log sink %s failed: %v; retrying\n", s.sink, err)
+				s.failing = true
+			}
+			time.Sleep(5 * time.Second)
+		}
+	}
+}
+
+// shipHandler passes records on to the run's own handler and copies them to
+// every sink.
+type shipHandler struct {
+	next     slog.Handler
+	shippers []*shipper
+	attrs    []slog.Attr
+	group    string
+}
+
+func (h *shipHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *shipHandler) Handle(ctx context.Context, r slog.Record) error {
+	shipped := shippedRecord{Time: r.Time, Level: r.Level, Message: r.Message, Attrs: append([]slog.Attr(nil), h.attrs...)}
+	r.Attrs(func(a slog.Attr) bool {
+		if h.group != "" {
+			a.Key = h.group + "." + a.Key
+		}
+		shipped.Attrs = append(shipped.Attrs, a)
+		return true
+	})
+	for _, s := range h.shippers {
+		s.enqueue(shipped)
+	}
+	return h.next.Handle(ctx, r)
+}
+
+func (h *shipHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := *h
+	clone.next = h.next.WithAttrs(attrs)
+	clone.attrs = append([]slog.Attr(nil), h.attrs...)
+	for _, a := range attrs {
+		if h.group != "" {
+			a.Key = h.group + "." + a.Key
+		}
+		clone.attrs = append(clone.attrs, a)
+	}
+	return &clone
+}
+
+func (h *shipHandler) WithGroup(name string) slog.Handler {
+	clone := *h
+	clone.next = h.next.WithGroup(name)
+	if h.group != "" {
+		name = h.group + "." + name
+	}
+	clone.group = name
+	return &clone
+}
+
+// shipLogs copies the run's log records to each -log-sink on top of the
+// logger setupLogging installed. It does nothing without sinks.
+func shipLogs(sinks []string) error {
+	if len(sinks) == 0 {
+		return nil
+	}
+	h := &shipHandler{next: slog.Default().Handler()}
+	for _, raw := range sinks {
+		sink, err := parseLogSink(raw)
+		if err != nil {
+			return err
+		}
+		h.shippers = append(h.shippers, newShipper(sink))
+		fmt.Printf("Shipping run logs to %s\n", sink)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MAC pool names accepted by -mac-pools besides vendor names and raw OUIs.
+const (
+	poolRandom              = "random"
+	poolLocallyAdministered = "locally-administered"
+)
+
+// vendorOUIs are real OUIs registered to common client vendors, so generated
+// MACs fingerprint as that vendor's devices.
+var vendorOUIs = map[string][]string{
+	"apple":   {"3c:22:fb", "a4:83:e7", "f0:18:98", "88:66:5a", "ac:bc:32", "dc:a9:04"},
+	"cisco":   {"00:1b:54", "00:26:cb", "58:97:bd", "f4:cf:e2", "70:10:5c"},
+	"samsung": {"8c:77:12", "5c:0a:5b", "a0:82:1f", "e8:50:8b", "cc:07:ab"},
+	"intel":   {"3c:a9:f4", "8c:8d:28", "a4:c3:f0", "f8:63:3f", "b4:6b:fc"},
+	"dell":    {"18:db:f2", "b8:ca:3a", "d4:be:d9", "f8:bc:12", "54:bf:64"},
+	"hp":      {"3c:d9:2b", "9c:8e:99", "a0:d3:c1", "ec:b1:d7", "10:1f:74"},
+	"lenovo":  {"54:ee:75", "98:fa:9b", "e8:6a:64", "8c:16:45", "50:7b:9d"},
+}
+
+// macPool generates MACs from one source.
+type macPool struct {
+	name string
+	ouis [][]byte
+}
+
+// macGenerator draws unique MACs from weighted pools.
+type macGenerator struct {
+	mu    sync.Mutex
+	pools weightedSet[macPool]
+	used  map[string]bool
+}
+
+// newMACGenerator parses pool specs of the form "name[:weight]", where name is
+// a vendor, "random", "locally-administered" or an explicit OUI like
+// "oui=00:11:22". No specs means every MAC is locally administered.
+func newMACGenerator(specs []string) (*macGenerator, error) {
+	g := &macGenerator{used: make(map[string]bool)}
+	if len(specs) == 0 {
+		specs = []string{poolLocallyAdministered}
+	}
+	for _, spec := range specs {
+		name, weight := spec, 1
+		// An OUI contains two colons of its own before any weight.
+		if !strings.HasPrefix(spec, "oui=") || strings.Count(spec, ":") > 2 {
+			var err error
+			if name, weight, err = parseWeight(spec); err != nil {
+				return nil, fmt.Errorf("invalid MAC pool: %v", err)
+			}
+		}
+		pool := macPool{name: strings.ToLower(name)}
+		switch {
+		case pool.name == poolRandom || pool.name == poolLocallyAdministered:
+		case strings.HasPrefix(pool.name, "oui="):
+			oui, err := parseOUI(strings.TrimPrefix(pool.name, "oui="))
+			if err != nil {
+				return nil, err
+			}
+			pool.ouis = [][]byte{oui}
+		default:
+			ouis, ok := vendorOUIs[pool.name]
+			if !ok {
+				return nil, fmt.Errorf("unknown MAC pool %q (vendors: %s; or random, locally-administered, oui=xx:xx:xx)", name, strings.Join(vendorNames(), ", "))
+			}
+			for _, s := range ouis {
+				oui, _ := parseOUI(s)
+				pool.ouis = append(pool.ouis, oui)
+			}
+		}
+		g.pools.add(pool, weight)
+	}
+	return g, nil
+}
+
+// Next returns a MAC not handed out before in this run.
+func (g *macGenerator) Next() net.HardwareAddr {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for {
+		mac := g.pools.pick().generate()
+		if !g.used[mac.String()] {
+			g.used[mac.String()] = true
+			return mac
+		}
+	}
+}
+
+// issued reports whether mac was handed out by Next.
+func (g *macGenerator) issued(mac net.HardwareAddr) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.used[mac.String()]
+}
+
+// isDockerMAC reports whether mac has the 02:42 prefix Docker assigns
+// container endpoints when no MAC is given.
+func isDockerMAC(mac net.HardwareAddr) bool {
+	return len(mac) == 6 && mac[0] == 0x02 && mac[1] == 0x42
+}
+
+// generate creates a unicast MAC from the pool.
+func (p macPool) generate() net.HardwareAddr {
+	mac := make(net.HardwareAddr, 6)
+	identityRand.Read(mac)
+	switch {
+	case len(p.ouis) > 0:
+		copy(mac, p.ouis[identityRand.Intn(len(p.ouis))])
+	case p.name == poolLocallyAdministered:
+		mac[0] |= 0x02
+	default:
+		mac[0] &^= 0x02
+	}
+	mac[0] &^= 0x01 // unicast
+	return mac
+}
+
+func parseOUI(s string) ([]byte, error) {
+	mac, err := net.ParseMAC(s + ":00:00:00")
+	if err != nil {
+		return nil, fmt.Errorf("invalid OUI %q: %v", s, err)
+	}
+	return mac[:3], nil
+}
+
+func vendorNames() []string {
+	var names []string
+	for name := range vendorOUIs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -1,26 +1,72 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"flag"
 	"fmt"
 	"io"
-	"math/rand"
+	"log/slog"
+	"net"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/network"
-	"github.com/docker/docker/client"
-	"github.com/docker/docker/pkg/archive"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "preload" {
+		runPreload(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "annotate" {
+		runAnnotate(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "leases" {
+		runLeases(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "coordinate" {
+		runCoordinate(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "engines" {
+		runEngines(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "scenarios" {
+		runScenarios(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "status" {
+		runStatusCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "analyze" {
+		runAnalyze(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "compare" {
+		runCompare(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		runAudit(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "generate" {
+		runGenerate(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "selftest" {
+		runSelftest(os.Args[2:])
+		return
+	}
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, `
 ipocalypse - A tool for testing network behavior by deploying 
@@ -28,260 +74,2639 @@ multiple containers with DHCP-assigned IP addresses to a local network.
 
 Usage:
   sudo ./ipocalypse [options]
+  ./ipocalypse preload -engines tcp://host:port,... [-dockerfiles dir,...] [-build-workers N]
+  ./ipocalypse annotate [-addr host:port] <note text>
+  ./ipocalypse leases [-addr host:port | -file leases.json] [-grep text] [-mac pattern] [-format table|json|isc|kea] [-deny]
+  ./ipocalypse analyze [-trusted-servers ip,...] capture.pcap
+  ./ipocalypse compare [-db ipocalypse.db] [-list] [before after]
+  sudo ./ipocalypse selftest [-subnet cidr] [-pool N] [-keep] [-- run flags]
+  ./ipocalypse audit [audit-log]
+  ./ipocalypse generate [-dir path] [-name name] [-set key=value ...] <template>
+  ./ipocalypse engines [-interface name] [-runtime name] [-host url]
+  ./ipocalypse status [-runtime name] [-host url]
+  ./ipocalypse scenarios
+  ./ipocalypse coordinate -agents host:port,... [-interval 5s] [-max-leases N]
 
 Options:
+  -config string
+        YAML (.yaml/.yml) or TOML (.toml) file with run settings
+        Flags given on the command line override values from the file
+
+  -wait
+        Keep the process running once the run has finished, with the
+        control API and metrics still served, until Ctrl-C; otherwise it
+        exits with a status telling how the run went (default: false)
+
+  -start-at string
+        Arm the run and start launching at this time: 15:04 for the next
+        time the clock shows it, "2006-01-02 15:04" local time, or RFC 3339
+        (default: start now)
+
+  -schedule string
+        Arm the run and start launching the next time this five-field cron
+        expression matches, e.g. "0 22 * * 6" for 22:00 on Saturday;
+        cannot be combined with -start-at (default: none)
+
+  -window duration
+        Length of the approved change window from the start. Launching,
+        renewal storms and -rogue-server stop when it closes, the leases
+        are held until then even if the pool ran out earlier, and the run
+        is torn down as -cleanup does, or its leases released in raw and
+        netns mode (default: 0, no window)
+
+  -daemon
+        Run as a long-lived service, e.g. on a drop box, that starts runs
+        when asked through its API on -listen or -grpc-listen and reports
+        to systemd (Type=notify, watchdog); see the README (default: false)
+
+  -pid-file string
+        With -daemon, write the process ID to this file (default: none)
+
+  -grpc-listen string
+        With -daemon, serve the gRPC control plane on this address, e.g.
+        :9090: configure, start, pause, resume, stop and tear down runs
+        and stream their status. The service is published in
+        controlpb/control.proto. A bare port binds 127.0.0.1; other
+        addresses need IPOCALYPSE_CONTROL_TOKEN or -grpc-client-ca
+        (default: disabled)
+
+  -grpc-tls-cert, -grpc-tls-key string
+        Certificate and private key to serve the gRPC control plane over
+        TLS with (default: plaintext)
+
+  -grpc-client-ca string
+        Require gRPC clients to present a certificate signed by this CA
+        (mutual TLS) (default: none)
+
+  -grpc-reflection
+        Serve gRPC server reflection, so grpcurl and similar tools work
+        without the .proto (default: false)
+
+  -cleanup
+        Tear down a previous run in dependency order and exit: stop
+        traffic generators, release leases, remove containers, delete
+        the Docker network, delete macvlan0 and VLAN interfaces, remove
+        NAT rules. With -mode=k8s: release leases, delete the client pods
+        and the network attachments runs created
+
+  -prune-images
+        Have -cleanup, and the control API's and -window's teardowns,
+        also remove the images runs built and the dangling layers they
+        left; pulled -images are kept (default: false)
+
+  -scenario string
+        What kind of run to do, each with its engine and settings
+        preselected (default: starvation); ./ipocalypse scenarios lists them
+          starvation  launch clients until the pool is exhausted
+          churn       keep killing a fraction of the clients and
+                      launching replacements, as -churn
+          renewal-storm  fill the pool, then renew every lease over and
+                      over, as -renew-interval
+          observe     passive baseline of the segment, as -observe
+          threshold   smallest population that denies a canary a lease,
+                      as -shrink-test (raw engine)
+          fuzz        send malformed DISCOVERs (bad option lengths,
+                      conflicting types, random options), each followed
+                      by a well-formed canary DISCOVER, and report the
+                      cases after which the server stopped answering
+                      (raw engine)
+
+  -fuzz-cases int
+        Number of random-option DISCOVERs the fuzz scenario sends after
+        its fixed cases (default: 50)
+
+  -mode string
+        How DHCP clients are simulated (default: docker)
+          docker  one container per lease on a macvlan network
+          raw     craft DISCOVER/REQUEST packets from spoofed MACs on the
+                  parent interface, tracking leases in-process (no Docker)
+          netns   one network namespace per lease with a macvlan
+                  interface, running the host's dhclient (no Docker)
+          pd      solicit DHCPv6 delegated prefixes (IA_PD) under a new
+                  DUID per client, to exhaust prefix delegation pools
+          k8s     one pod per lease on a Kubernetes cluster, attached to
+                  the segment with a Multus macvlan or ipvlan network
+          sim     lease from an in-memory pool standing in for the server,
+                  to rehearse a run without touching a network
+
+  -pd-length int
+        Prefix length -mode=pd hints in every SOLICIT, e.g. 56; servers
+        may delegate another (default: 0, the server's choice)
+
+  -sim-pool string
+        -mode=sim: subnet the simulated server leases from, /29 or larger
+        (default: 192.0.2.0/24)
+
+  -sim-latency duration
+        -mode=sim: time the simulated server takes to grant each lease
+        (default: 100ms)
+
+  -kubeconfig string
+        -mode=k8s: kubeconfig file of the cluster (default: kubectl's)
+
+  -k8s-context string
+        -mode=k8s: kubeconfig context to use (default: the current one)
+
+  -k8s-namespace string
+        -mode=k8s: namespace the client pods run in (default: the
+        context's)
+
+  -k8s-network string
+        -mode=k8s: existing Multus NetworkAttachmentDefinition to attach
+        the pods with; otherwise the run creates ipocalypse-net, a
+        -driver network on -k8s-master without IPAM
+
+  -k8s-master string
+        -mode=k8s: node interface on the target segment the created
+        network sits on, VLAN subinterface included, e.g. eth1.100
+        (default: the parent interface's name on this host)
+
+  -k8s-node-selector string
+        -mode=k8s: comma-separated key=value node labels the pods are
+        scheduled on, e.g. ipocalypse=client
+
+  -wifi-fallback string
+        What to do when docker mode finds a wireless parent interface,
+        where macvlan silently fails: raw switches to raw mode, ipvlan
+        keeps the containers on the ipvlan driver, refuse exits with
+        guidance (default: raw)
+
+  -observe
+        Read-only baseline of the segment: capture DHCP traffic, list the
+        servers answering, flag rogue servers and estimate pool usage with
+        an ARP sweep, then print a report. Nothing is launched.
+
+  -observe-duration duration
+        How long -observe captures traffic (default: 1m)
+
+  -trusted-servers string
+        Comma-separated DHCP server IPs expected on the segment; any other
+        server seen is reported as a possible rogue (default: the first
+        server seen is assumed legitimate)
+
+  -force
+        Launch even when more than one DHCP server answers the pre-flight
+        DISCOVER sent before anything is launched (default: false)
+
+  -arp-sweep
+        ARP-sweep the target subnet before launching and again when
+        launching stops, and report how many addresses were in use
+        before and after and how many leases were left in theory
+        (default: false)
+
+  -dry-run
+        Detect the network, check the engine (Docker connectivity for
+        docker mode), validate the Dockerfile directories and print the
+        networks, images and worker plan a run would create, then exit
+        without touching the network or creating anything (default: false)
+
+  -engagement-id string
+        Engagement the run is part of, e.g. a contract or ticket number.
+        Runs that act on the network need it with -operator, or
+        -i-am-authorized; it is recorded in -audit-log (default: none)
+
+  -operator string
+        Name of whoever runs the test, recorded in -audit-log; asked for
+        with -i-am-authorized when not given (default: none)
+
+  -i-am-authorized
+        Confirm on a terminal, by typing the interface name, that you are
+        authorized to test the network, instead of naming the engagement
+        with -engagement-id (default: false)
+
+  -audit-log string
+        Append-only log of every network-affecting action of the run, each
+        entry timestamped and hash-chained to the one before; verify it
+        with "ipocalypse audit" (default: ipocalypse-audit.log)
+
+  -baseline-dir string
+        Where -observe saves a baseline per subnet; runs on a subnet with a
+        baseline compare latency, NAK rate and servers against it in the
+        run summary (default: baselines, empty to disable)
+
+  -fingerprint
+        Passively fingerprint the real clients requesting leases during
+        -observe and runs (parameter request list, vendor class), report
+        the legitimate device mix with matching -profiles, and add it to
+        a per-subnet database in -baseline-dir (default: true)
+
   -dockerfiles string
-        Comma-separated list of directories containing Dockerfiles
-        Auto-discovers all ipocalypse_* directories if not specified
+        Comma-separated list of directories containing Dockerfiles, with
+        optional weights, e.g. ipocalypse_basic:7,ipocalypse_phone:1
+        Any directory will do; auto-discovers all ipocalypse_* directories
+        if not specified, and uses a built-in BusyBox/udhcpc image if there
+        are none
+
+  -dockerfile string
+        Dockerfile path within each -dockerfiles directory, e.g.
+        Dockerfile.client; an image manifest's dockerfile key overrides it
+        for its directory (default: Dockerfile)
+
+  -no-build
+        Use the images of the Dockerfile directories as they are on the
+        engine, e.g. loaded by the preload subcommand, instead of building
+        them (default: false)
+
+  -runtime string
+        Container runtime: docker, podman (its Docker-compatible API
+        socket) or auto (default: auto, Docker unless only Podman's
+        socket exists)
+
+  -host string
+        Remote container engine attached to the target LAN, e.g.
+        ssh://root@10.0.0.5 or tcp://10.0.0.5:2376. The macvlan0
+        interface and NAT rules are set up on that host over ssh
+
+  -host-ssh string
+        ssh destination (user@host) for the network setup of a
+        tcp:// -host
+
+  -tls-ca, -tls-cert, -tls-key string
+        CA certificate, client certificate and key for a TLS tcp:// -host
+
+  -images string
+        Comma-separated registry images to pull and launch instead of
+        building ipocalypse_* directories, e.g. repo/ipocalypse-basic:latest
+        Weighted like -dockerfiles once tagged: repo/basic:latest:7
+        Credentials come from IPOCALYPSE_REGISTRY_USER and
+        IPOCALYPSE_REGISTRY_PASSWORD, or from docker login
+
+  -strategy string
+        How workers pick client images: random by weight, roundrobin
+        (interleaved in listed order) or sequential (each image's weight
+        in launches, then the next), or counts (the weights are exact
+        container counts, launched from a queue shared by the workers until
+        each image has its count of leases) (default: random)
+
+  -seed int
+        Seed for the random image picks, MACs, hostnames and profiles of
+        the clients; the seed used is printed at startup, so passing it
+        back launches the same clients in the same order (default: 0,
+        pick one)
+
+  -build-workers int
+        Number of images built concurrently (default: 4)
+
+  -platform string
+        Platform client images are built, pulled and run for, as
+        os/arch[/variant], e.g. linux/arm64 or linux/arm/v7. Another
+        architecture than the engine's needs emulation (binfmt_misc/QEMU) on
+        the engine host (default: the engine's own platform)
+
+  -builder string
+        Image builder: auto, buildkit or legacy. BuildKit runs docker buildx
+        build, for cache mounts, build secrets and faster rebuilds; auto uses
+        it when the runtime is docker and buildx is installed (default: auto)
+
+  -build-secrets value
+        Comma-separated BuildKit build secrets as id=file, mounted by RUN
+        --mount=type=secret,id=<id> steps and kept out of the image (default: none)
 
   -workers int
-        Number of concurrent container launch workers (default: 5)
+        Number of concurrent container launch workers; with -autoscale,
+        the number to start with (default: 5)
+
+  -autoscale
+        Adjust the worker count every 30s: add a quarter more while
+        launches succeed quickly, halve it when over 10%% fail or the
+        median lease latency doubles, and step back when more workers
+        stop leasing faster, converging on the highest sustainable launch
+        rate (default: false)
+
+  -max-workers int
+        Most workers -autoscale runs (default: 50)
+
+  -max-leases int
+        Stop once this many leases are held, leaving the rest of the pool
+        for legitimate devices (default: 0, run until exhaustion)
+
+  -reserve-free int
+        Keep at least this many addresses free for legitimate devices:
+        launches pause and the run releases its own leases when the free
+        estimate drops below it; the run continues until stopped
+        (default: 0, disabled)
+
+  -churn float
+        Kill this fraction of the running clients every -churn-interval,
+        releasing their leases, and launch replacements, for constant
+        DISCOVER/RELEASE traffic; running out of addresses then waits for
+        the next round instead of ending the run (default: 0, disabled;
+        0.1 with -scenario=churn)
+
+  -churn-interval duration
+        How often -churn kills clients (default: 1m)
+
+  -renew-interval duration
+        When launching stops, have every client renew its held lease this
+        often, stressing the server's renewal path and log volume; docker
+        and netns clients restart their DHCP client, raw mode sends
+        RENEWING-state REQUESTs (default: 0, disabled; 10s with
+        -scenario=renewal-storm)
+
+  -renew-workers int
+        Renewals in flight at once during a -renew-interval round or for
+        -renew-leases (default: 20)
+
+  -renew-rounds int
+        Number of -renew-interval rounds before the run ends (default: 10)
+
+  -renew-leases
+        Renew every held lease at half its lease time for as long as the
+        run lasts, including -window holds and -wait, as a real client
+        would; raw and pd clients otherwise lose their leases one lease
+        time into a long run. The lease table tracks each lease's expiry
+        (default: false)
+
+  -let-expire float
+        Raw and pd mode with -renew-leases: share of the clients, 0 to 1,
+        deliberately never renewed, to watch the server reclaim their
+        addresses, e.g. 0.2 (default: 0)
+
+  -spoof-release
+        Raw mode: before launching, ARP-sweep the subnet and send every
+        device that answers a spoofed DHCPRELEASE of its address, so the
+        run takes the leases legitimate clients pin too; asks you to type
+        the interface name first (default: false)
+
+  -spoof-release-exclude string
+        Comma-separated IPs or MACs of devices -spoof-release leaves alone,
+        besides the gateway, this host and the DHCP server (default: none)
+
+  -rogue-server
+        When launching stops, answer new DHCP clients on the segment from
+        this host, handing out -rogue-pool addresses with an
+        attacker-controlled gateway and DNS; asks you to type the interface
+        name before launching anything (default: false)
+
+  -rogue-pool string
+        Address range the rogue server leases, e.g.
+        192.168.1.200-192.168.1.250; required with -rogue-server
+
+  -rogue-gateway string
+        Gateway the rogue server hands out (default: this host's address)
+
+  -rogue-dns string
+        Comma-separated DNS servers the rogue server hands out (default:
+        this host's address)
+
+  -rogue-lease duration
+        Lease time the rogue server grants (default: 10m)
+
+  -rogue-duration duration
+        How long the rogue server answers clients (default: 10m)
+
+  -identity-churn int
+        Raw mode: when launching stops, reconfirm up to this many held
+        leases with altered identities (same MAC with a new hostname and
+        client-id, or a new MAC with the old ones) and report how the
+        server reconciled them (default: 0, disabled)
+
+  -shrink-test
+        Raw mode: repeat short trials with a bisected number of clients,
+        each followed by a canary client, to find the smallest population
+        that still denies the canary a lease (up to -max-leases, or the
+        subnet size) (default: false)
+
+  -rate float
+        Launch at most this many clients per minute across all workers
+        (default: 0, no limit)
+
+  -ramp string
+        Ramp the launch rate up in steps as start:factor:interval, e.g.
+        5:2:2m starts at 5 launches per minute and doubles every 2
+        minutes, up to -rate if set. The summary reports each step and
+        the rate at which the server started failing (default: no ramp)
+
+  -dhcp-timeout duration
+        How long a container may take to obtain a lease before the launch
+        counts as failed; launches succeed as soon as the lease is bound
+        (default: 30s)
+
+  -dhcp-poll-interval duration
+        How often a starting container is checked for a lease within
+        -dhcp-timeout (default: 500ms)
+
+  -exhaust-after int
+        Launches in a row that get no lease before the pool counts as
+        exhausted, so a briefly slow server does not end the run; a
+        lease in between starts the count over (default: 3)
+
+  -retry-initial duration
+        Delay before retrying a failed launch; it grows with every
+        consecutive failure (default: 2s)
+
+  -retry-multiplier float
+        Factor the retry delay grows by per consecutive failure (default: 2)
+
+  -retry-max duration
+        Longest delay between retries (default: 30s)
+
+  -retry-attempts int
+        Consecutive failed launches, or reconnects to a lost Docker daemon,
+        after which the run gives up; 0 retries forever (default: 10)
+
+  -retry-jitter float
+        Spread each retry delay by up to this fraction either way, so
+        workers do not retry in lockstep (default: 0.2)
+
+  -launch-interval duration
+        Docker mode: pause between a worker's launches when no -rate or
+        -ramp paces them (default: 1s)
+
+  -launch-jitter duration
+        Docker mode: add a random part of this to each -launch-interval
+        pause, so launches do not arrive in bursts (default: 0)
+
+  -launch-stagger duration
+        Hold each worker's first launch back a random part of this, so
+        the workers do not start in lockstep (default: 0)
 
   -internet
         Enable internet access for containers (default: false)
 
+  -interface string
+        Parent interface for the macvlan network, e.g. eth1
+        Auto-detects the default-route interface if not specified
+
+  -vlan int
+        802.1Q VLAN ID to launch clients into from a trunk port. A
+        tagged subinterface of the parent (e.g. eth0.120) is created if
+        missing and used as the parent; without an address on it, the
+        subnet is learned from a DHCP offer (default: 0, untagged)
+
+  -networks string
+        Comma-separated networks to attack in one run instead of
+        -interface/-vlan, each a parent interface with an optional VLAN
+        ID, e.g. eth1,eth0:120,eth0:130. Each gets its own Docker
+        network and host interface. =max caps a network's leases and
+        =max@rate also limits its launches per minute, e.g.
+        eth0:120=50@30; 0 is no cap. Workers spread launches across the
+        networks that still have addresses and are below their cap, and
+        the run ends when all of them are exhausted or at their cap
+        (default: a single network)
+
+  -network string
+        Docker network the clients attach to. It is created on the
+        parent interface if missing; an existing one is reused only if
+        its driver, parent and subnet match (default: ipocalypse_net)
+
+  -driver string
+        Docker network driver: macvlan, or ipvlan (l2 mode) where every
+        client shares the parent's MAC and is told apart by its DHCP
+        client identifier, for ports with MAC limits, or bridge, which
+        attaches the clients to an existing Linux bridge named by
+        -interface that has the NIC as a port (default: macvlan)
+
+  -driver-fallback string
+        What to do when the kernel has no macvlan support, as on some VM
+        and cloud kernels: ipvlan or bridge switch to that driver,
+        refuse exits with guidance (default: refuse)
+
+  -ipv6
+        DHCPv6 exhaustion mode: containers request IA_NA addresses with
+        DHCPv6 on a dual-stack network (default: false)
+
+  -container-memory string
+        Memory limit per client container, e.g. 32m, so a large run
+        cannot run the host out of memory (default: unlimited)
+
+  -container-cpus float
+        CPU limit per client container, e.g. 0.05 (default: 0, unlimited)
+
+  -read-only
+        Run client containers with a read-only root filesystem; only the
+        DHCP client's state directories are writable (default: false)
+
+  -address-order string
+        Ask the DHCP server for addresses in a chosen order using the
+        requested-IP option: none, ascending, descending or top-half
+        (default: none). top-half drains the upper half of the range
+        first, leaving low, operationally critical addresses untouched
+        for as long as possible.
+
+  -mac-pools string
+        Comma-separated pools to generate client MACs from, each with an
+        optional weight: apple, cisco, samsung, intel, dell, hp, lenovo,
+        random, locally-administered or oui=xx:xx:xx
+        e.g. apple:5,samsung:3,intel:2 (default: Docker-assigned MACs in
+        docker mode, locally-administered in raw mode)
+
+  -profiles string
+        Comma-separated DHCP fingerprint profiles with optional weights,
+        picked at random per client unless the image's manifest sets one:
+        windows, macos, iphone, android, hp-printer, polycom-phone, iot
+        e.g. windows:6,iphone:3,hp-printer:1
+
+  -hostnames string
+        Comma-separated hostname templates with optional weights, sent as
+        each client's hostname instead of its profile's, e.g.
+        DESKTOP-{ALNUM:7}:6,{Name}s-iPhone:3, or realistic for a built-in
+        office mix (default: profile hostnames)
+
+  -hostname-words string
+        File with one word per line for the {name} and {Name} hostname
+        placeholders (default: built-in first names)
+
+  -client-id string
+        Client identifier (option 61) each client sends: mac (type 1 and
+        the MAC), duid (a random RFC 4361 DUID per client), none, or a
+        template for a text identifier, e.g. client-{hex:8} (default: mac)
+
+  -client-dns string
+        Comma-separated DNS servers forced into every client container,
+        overriding the resolvers offered by DHCP (default: use DHCP's)
+
+  -client-ntp string
+        Comma-separated NTP servers forced into every client container,
+        overriding the servers offered by DHCP (default: use DHCP's)
+
+  -traffic string
+        Comma-separated targets each client container reaches in the
+        background once it has a lease, e.g. ping:10.0.0.1,dns:intranet.corp,
+        https://intranet.corp/: ping:<host>, dns:<name> or an http(s) URL
+        (default: none)
+
+  -traffic-interval duration
+        How often each client reaches the -traffic targets (default: 30s)
+
+  -announce string
+        Comma-separated name services to advertise each leased client's
+        hostname over, from its own MAC and IP, for discovery tooling to
+        see: mdns, llmnr, netbios or all (default: none)
+
+  -announce-interval duration
+        How often -announce repeats each client's announcements
+        (default: 1m)
+
+  -server string
+        Raw mode: the one DHCP server to test on a segment with several.
+        Replies from other servers are ignored, so every REQUEST names it,
+        and renewals and releases are sent to it unicast (default: none)
+
+  -server-unicast
+        Send DISCOVERs and REQUESTs to -server unicast too, so the other
+        servers never see the run (default: false)
+
+  -relay-server string
+        Raw mode: act as a DHCP relay agent on another segment, sending
+        every request unicast to this server with a giaddr and relay agent
+        information (option 82), to exhaust remote scopes (default: none)
+
+  -relay-giaddr string
+        Relay agent address the server picks the scope by and sends its
+        replies to; another address than this host's needs the replies
+        routed back here (default: this host's address)
+
+  -relay-link string
+        Address on the remote segment whose scope to use, sent as the
+        option 82 link selection sub-option so giaddr can stay this host's
+        address (default: none)
+
+  -relay-circuit-id string
+        Option 82 circuit ID, e.g. Gi1/0/{MAC}; {MAC} becomes the client's
+        MAC (default: none)
+
+  -relay-remote-id string
+        Option 82 remote ID, with {MAC} as for -relay-circuit-id (default: none)
+
+  -arp-keepalive duration
+        Send a gratuitous ARP from each client for its leased address this
+        often, and in raw mode answer ARP requests and probes for the
+        clients, so servers that check an address before reallocating it
+        find it in use (default: 0, disabled)
+
+  -dns-load float
+        DNS queries per second each leased client sends to the DNS server
+        its lease offers, for combined DHCP and DNS pressure on appliances
+        serving both (default: 0, disabled)
+
+  -dns-load-names string
+        Comma-separated names -dns-load queries; *.<domain> queries a random
+        name under the domain, missing the server's cache
+        (default: common office names)
+
+  -dns-load-server string
+        DNS server -dns-load queries instead of the one each lease offers
+        (default: the offered server)
+
+  -dhcp-latency
+        Time every DISCOVER->OFFER and REQUEST->ACK exchange seen on the
+        parent interface and report percentiles for each quarter of the
+        run, showing how the server slows as the pool fills (default: false)
+
+  -dhcp-latency-file string
+        CSV file -dhcp-latency records every timed exchange in
+        (default: dhcp-latency.csv, empty to disable)
+
+  -watch-servers
+        Warn as soon as a competing DHCP server, or a known server on a
+        second MAC, answers during the run, and list the servers that
+        answered in the summary; -trusted-servers names the target
+        servers, otherwise the first to answer is (default: true)
+
+  -snmp-switch string
+        Poll the access switch over SNMP during the run, as host[:port]:
+        its MAC address table size, the -snmp-port status and err-disable
+        cause, and -snmp-counters. Changes are logged with the leases
+        acquired at the time and listed in the summary (default: disabled)
+
+  -snmp-community string
+        SNMPv2c community of -snmp-switch (default: public)
+
+  -snmp-user string
+        Poll with SNMPv3 as this user instead of SNMPv2c; with
+        -snmp-auth-pass (SHA) and -snmp-priv-pass (AES) (default: none)
+
+  -snmp-port string
+        Switch port the host is on, by name (e.g. Gi1/0/5) or ifIndex:
+        its learnt MACs and status are watched (default: none)
+
+  -snmp-interval duration
+        How often to poll -snmp-switch (default: 10s)
+
+  -snmp-counters string
+        Extra counters to poll as name=oid, comma-separated, e.g. the
+        switch's DHCP snooping drop counters (default: none)
+
+  -snmp-log string
+        Write every poll of -snmp-switch with the run's launches and
+        leases to this CSV file (default: disabled)
+
+  -detect-conflicts
+        ARP-probe every address right after it is leased and flag those
+        another host answers for, or that two clients were leased, in the
+        lease table and summary (default: true)
+
+  -dhcp-client string
+        DHCP client the client containers run: auto (the first of
+        dhclient, udhcpc and dhcpcd installed in the image), dhclient,
+        udhcpc or dhcpcd; image manifests may override it (default: auto)
+
+  -client-interface string
+        Interface the client containers run DHCP on; image manifests may
+        override it (default: eth0)
+
+  -status-interval duration
+        How often to print a status line with the live time-to-exhaustion
+        estimate and its confidence (default: 30s, 0 to disable)
+
+  -metrics string
+        Serve Prometheus metrics at http://<addr>/metrics, e.g. :9100
+        (default: disabled)
+
+  -lease-export string
+        Path prefix of the lease table written when the run ends or is
+        interrupted: <prefix>.csv and <prefix>.json with every MAC, IP,
+        lease time and acquisition time (default: leases, empty to disable)
+
+  -report string
+        Write a self-contained HTML report to this file when the run ends:
+        summary, exhaustion timeline, latency percentiles, DHCP servers,
+        lease table and the options used (default: disabled)
+
+  -results-db string
+        Save the run's options, leases, latencies, failures and outcome to
+        this SQLite database when it ends, to compare runs with
+        "ipocalypse compare" (default: disabled)
+
+  -results-label string
+        Label the run in -results-db, e.g. before-snooping, to name it in
+        compare (default: none)
+
+  -container-logs string
+        Docker mode: directory to keep the output of each client container,
+        DHCP client included, in, one <container>.log file per container
+        under a subdirectory named after the run ID (default: none)
+
+  -state-file string
+        Docker mode: file the run ID, configuration, containers and lease
+        table are saved to every 10s, for -resume
+        (default: ipocalypse-state.json, empty to disable)
+
+  -orphans string
+        Docker mode: what to do at startup with the labelled containers
+        and networks of earlier runs: adopt their clients that hold a lease
+        into this run's accounting, remove everything as -cleanup does,
+        keep them uncounted, or ask on a terminal (default: ask)
+
+  -resume
+        Continue the run recorded in -state-file: reuse its run ID and
+        configuration (flags given now still win), adopt its running
+        client containers and their leases, and launch from there
+        (default: false)
+
+  -attach string
+        Docker mode: continue the run with this ID, as listed by
+        ipocalypse status, when its -state-file is gone. Its labelled
+        client containers are adopted and their lease records rebuilt
+        from their lease files, so the statistics, metrics and report
+        include the leases taken before the restart; the configuration
+        comes from the flags given now (default: none)
+
+  -release-on-exit
+        When the run ends or is interrupted, release every lease it still
+        holds (dhclient -r and removal in docker and netns mode,
+        DHCPRELEASE in raw mode) instead of leaving the addresses held
+        until their leases expire (default: false)
+
+  -pcap string
+        Capture DHCP and DHCPv6 traffic (ports 67/68 and 546/547) on the
+        parent interface for the duration of the run, e.g. run.pcap
+        (default: disabled)
+
+  -listen string
+        Serve the HTTP control API on this address, e.g. :8080, to pause,
+        resume, rescale, list leases and tear down a run; SIGUSR1 pauses
+        and resumes launching without it. A bare port binds 127.0.0.1;
+        other addresses need IPOCALYPSE_CONTROL_TOKEN, a shared token
+        every request must carry as a bearer token (default: disabled)
+
+  -ntp-server string
+        NTP server to sanity-check the host clock against before the run,
+        e.g. pool.ntp.org; the query leaves the host, so it is opt-in
+        (default: none, no check)
+
+  -max-clock-skew duration
+        Warn when the host clock is off by more than this (default: 1s)
+
+  -log-format string
+        Format of run event logs: text (key=value) or json, one object
+        per line for log pipelines such as ELK (default: text)
+
+  -output string
+        What stdout carries: text, or json for one event object per line
+        (build_complete, container_launched, lease_acquired,
+        launch_failed, lease_renewed, lease_expired, exhaustion_detected,
+        rogue_server_detected, ip_conflict, summary) with every other line moved to stderr (default: text)
+
+  -log-level string
+        Minimum level of run event logs: debug, info, warn or error
+        (default: info)
+
+  -log-sink list
+        Comma-separated collectors to copy run logs to, e.g. for a blue
+        team's SIEM: udp://, tcp:// or tls://host[:port] for an RFC 5424
+        syslog server (default ports 514 and 6514 for tls), or an http(s)
+        URL that is POSTed batches of JSON lines (default: none)
+
+  -otlp-endpoint string
+        Export OpenTelemetry spans of image builds and client launches
+        (container create and start, DHCP wait, inspection, backoff and
+        pauses) to this OTLP/HTTP collector, e.g. http://localhost:4318
+        (default: disabled)
+
+  -quiet
+        Leave out build output and info-level logs (launches, leases,
+        status lines); warnings, errors, setup banners and the run
+        summary remain (default: false)
+
+  -v
+        Verbose: print the full output of every build step and debug
+        logs, unless -log-level says otherwise (default: false)
+
+  -progress
+        Show a one-line summary (leases, lease rate, failures, elapsed
+        time, ETA to exhaustion) redrawn every second below the log lines;
+        without a terminal it is printed every -status-interval instead
+        (default: false)
+
+  -tui
+        Show a live dashboard (worker status, leases, launch rate, recent
+        errors, IP/MAC table) that updates in place instead of scrolling
+        log lines; only warnings and errors are logged (default: false)
+
 Examples:
   Auto-discover and use all ipocalypse directories:
     sudo ./ipocalypse
 
-  Use specific directories with internet access:
-    sudo ./ipocalypse -dockerfiles=ipocalypse_basic_image,ipocalypse_custom -internet
+  Use specific directories with internet access:
+    sudo ./ipocalypse -dockerfiles=ipocalypse_basic_image,ipocalypse_custom -internet
+
+  Check that the DHCP server survives malformed requests:
+    sudo ./ipocalypse -scenario=fuzz -fuzz-cases=200
+
+  Exhaust the pool without Docker using raw DHCP packets:
+    sudo ./ipocalypse -mode=raw -workers=20
+
+  Run thousands of real DHCP clients in network namespaces:
+    sudo ./ipocalypse -mode=netns -workers=20
+
+  Attach containers to a second NIC:
+    sudo ./ipocalypse -interface=eth1
+
+  Launch with more workers:
+    sudo ./ipocalypse -workers=8
+
+  Load a saved test profile, overriding its worker count:
+    sudo ./ipocalypse -config=profiles/office.yaml -workers=3
+
+  Build the images once and run them on two hosts:
+    ./ipocalypse preload -engines tcp://10.0.0.5:2376,ssh://root@10.0.0.6
+    sudo ./ipocalypse -no-build          # on each of the two hosts
+
+  Note an event in a run started with -listen=:8080:
+    ./ipocalypse annotate "customer rebooted DHCP server"
+`)
+	}
+	// Flags for Docker image building and container launching
+	cfg := defaultConfig()
+	var configPath string
+	var cleanup bool
+	var resume bool
+	var attach string
+	var daemonMode bool
+	var pidFile string
+
+	flag.StringVar(&configPath, "config", "", "Optional: YAML or TOML config file; command-line flags override its values")
+	flag.BoolVar(&cleanup, "cleanup", false, "Tear down containers, network, macvlan0, VLAN interfaces and NAT rules from a previous run, then exit")
+	flag.BoolVar(&cfg.PruneImages, "prune-images", cfg.PruneImages, "Have cleanup also remove the images runs built and their dangling layers")
+	flag.StringVar(&cfg.Scenario, "scenario", cfg.Scenario, "Kind of run: starvation, churn, renewal-storm, observe, threshold or fuzz")
+	flag.IntVar(&cfg.FuzzCases, "fuzz-cases", cfg.FuzzCases, "Number of random-option DISCOVERs the fuzz scenario sends")
+	flag.StringVar(&cfg.Mode, "mode", cfg.Mode, "Client engine: docker (one container per lease), raw (spoofed DHCP packets), netns (a network namespace per lease), pd (DHCPv6 prefix delegation), k8s (a Kubernetes pod per lease) or sim (an in-memory pool, touching no network)")
+	flag.IntVar(&cfg.PDLength, "pd-length", cfg.PDLength, "Prefix length -mode=pd hints in its solicits, e.g. 56 (0 for the server's choice)")
+	flag.StringVar(&cfg.SimPool, "sim-pool", cfg.SimPool, "-mode=sim: subnet the simulated server leases from, /29 or larger")
+	flag.DurationVar(&cfg.SimLatency, "sim-latency", cfg.SimLatency, "-mode=sim: time the simulated server takes to grant each lease")
+	flag.StringVar(&cfg.Kubeconfig, "kubeconfig", cfg.Kubeconfig, "-mode=k8s: kubeconfig file of the cluster")
+	flag.StringVar(&cfg.K8sContext, "k8s-context", cfg.K8sContext, "-mode=k8s: kubeconfig context to use")
+	flag.StringVar(&cfg.K8sNamespace, "k8s-namespace", cfg.K8sNamespace, "-mode=k8s: namespace the client pods run in")
+	flag.StringVar(&cfg.K8sNetwork, "k8s-network", cfg.K8sNetwork, "-mode=k8s: existing NetworkAttachmentDefinition to attach the pods with")
+	flag.StringVar(&cfg.K8sMaster, "k8s-master", cfg.K8sMaster, "-mode=k8s: node interface the created attachment network sits on")
+	flag.Var((*stringList)(&cfg.K8sNodeSelector), "k8s-node-selector", "-mode=k8s: comma-separated key=value node labels the pods are scheduled on")
+	flag.StringVar(&cfg.WifiFallback, "wifi-fallback", cfg.WifiFallback, "What docker mode does on a wireless parent with macvlan: raw (switch to raw mode), ipvlan (switch to the ipvlan driver) or refuse")
+	flag.BoolVar(&cfg.Observe, "observe", cfg.Observe, "Only observe the segment (DHCP capture, server discovery, rogue detection, ARP pool estimate) and report")
+	flag.DurationVar(&cfg.ObserveDuration, "observe-duration", cfg.ObserveDuration, "How long -observe captures traffic")
+	flag.Var((*stringList)(&cfg.TrustedServers), "trusted-servers", "Comma-separated legitimate DHCP server IPs; others are reported as rogue")
+	flag.BoolVar(&cfg.Force, "force", cfg.Force, "Launch even when more than one DHCP server answers the pre-flight DISCOVER")
+	flag.BoolVar(&cfg.ARPSweep, "arp-sweep", cfg.ARPSweep, "ARP-sweep the subnet before and after the run and report its occupancy")
+	flag.BoolVar(&cfg.DryRun, "dry-run", cfg.DryRun, "Show the detected network and planned actions without changing anything")
+	flag.StringVar(&cfg.BaselineDir, "baseline-dir", cfg.BaselineDir, "Directory for -observe baselines that later runs are compared against (empty to disable)")
+	flag.BoolVar(&cfg.Fingerprint, "fingerprint", cfg.Fingerprint, "Passively fingerprint real clients and report the legitimate device mix")
+	flag.Var((*stringList)(&cfg.Dockerfiles), "dockerfiles", "Optional: Comma-separated list of build context directories, with optional weights, e.g. ipocalypse_basic:7")
+	flag.StringVar(&cfg.Dockerfile, "dockerfile", cfg.Dockerfile, "Dockerfile path within each build context directory")
+	flag.BoolVar(&cfg.NoBuild, "no-build", cfg.NoBuild, "Use the images already on the engine, e.g. loaded by preload, instead of building them")
+	flag.StringVar(&cfg.Runtime, "runtime", cfg.Runtime, "Container runtime: docker, podman or auto")
+	flag.StringVar(&cfg.Host, "host", cfg.Host, "Remote container engine, e.g. ssh://root@10.0.0.5 or tcp://10.0.0.5:2376")
+	flag.StringVar(&cfg.HostSSH, "host-ssh", cfg.HostSSH, "ssh destination used for network setup on a tcp:// -host, e.g. root@10.0.0.5")
+	flag.StringVar(&cfg.TLSCA, "tls-ca", cfg.TLSCA, "CA certificate that signed a tcp:// -host's certificate")
+	flag.StringVar(&cfg.TLSCert, "tls-cert", cfg.TLSCert, "Client certificate for a tcp:// -host")
+	flag.StringVar(&cfg.TLSKey, "tls-key", cfg.TLSKey, "Client key for a tcp:// -host")
+	flag.Var((*stringList)(&cfg.Images), "images", "Comma-separated registry images to pull instead of building ipocalypse_* directories, with optional weights after the tag, e.g. repo/basic:latest:7")
+	flag.StringVar(&cfg.Strategy, "strategy", cfg.Strategy, "How workers pick client images: random (by weight), roundrobin or sequential")
+	flag.Int64Var(&cfg.Seed, "seed", cfg.Seed, "Seed for the clients' images, MACs, hostnames and profiles, to repeat a run (0 picks one and prints it)")
+	flag.IntVar(&cfg.BuildWorkers, "build-workers", cfg.BuildWorkers, "Number of images built concurrently")
+	flag.StringVar(&cfg.Platform, "platform", cfg.Platform, "Platform client images are built, pulled and run for, e.g. linux/arm64 (default: the engine's)")
+	flag.StringVar(&cfg.Builder, "builder", cfg.Builder, "Image builder: auto, buildkit or legacy")
+	flag.Var((*stringList)(&cfg.BuildSecrets), "build-secrets", "Comma-separated BuildKit build secrets as id=file, e.g. npmrc=$HOME/.npmrc")
+	flag.IntVar(&cfg.Workers, "workers", cfg.Workers, "Number of concurrent container launch workers")
+	flag.BoolVar(&cfg.Autoscale, "autoscale", cfg.Autoscale, "Start with -workers and add workers while launches stay fast and succeed, backing off when they struggle")
+	flag.IntVar(&cfg.MaxWorkers, "max-workers", cfg.MaxWorkers, "Most workers -autoscale runs")
+	flag.IntVar(&cfg.MaxLeases, "max-leases", cfg.MaxLeases, "Stop once this many leases are held (0 runs until exhaustion)")
+	flag.IntVar(&cfg.ReserveFree, "reserve-free", cfg.ReserveFree, "Keep at least this many addresses free for legitimate devices (0 to disable)")
+	flag.Float64Var(&cfg.Churn, "churn", cfg.Churn, "Fraction of running clients to kill and replace every -churn-interval, e.g. 0.1 (0 to disable)")
+	flag.DurationVar(&cfg.ChurnInterval, "churn-interval", cfg.ChurnInterval, "How often -churn kills clients")
+	flag.DurationVar(&cfg.RenewInterval, "renew-interval", cfg.RenewInterval, "When launching stops, renew every held lease this often (0 to disable)")
+	flag.IntVar(&cfg.RenewWorkers, "renew-workers", cfg.RenewWorkers, "Renewals in flight at once during -renew-interval rounds")
+	flag.IntVar(&cfg.RenewRounds, "renew-rounds", cfg.RenewRounds, "Number of -renew-interval rounds")
+	flag.BoolVar(&cfg.RenewLeases, "renew-leases", cfg.RenewLeases, "Renew every held lease at half its lease time for as long as the run lasts")
+	flag.Float64Var(&cfg.LetExpire, "let-expire", cfg.LetExpire, "Raw and pd mode: share of the clients -renew-leases deliberately never renews (0 to 1)")
+	flag.BoolVar(&cfg.SpoofRelease, "spoof-release", cfg.SpoofRelease, "Raw mode: before launching, send the devices found by an ARP sweep spoofed DHCPRELEASEs of their leases (asks for confirmation)")
+	flag.Var((*stringList)(&cfg.SpoofReleaseExclude), "spoof-release-exclude", "Comma-separated IPs or MACs of devices -spoof-release leaves alone")
+	flag.BoolVar(&cfg.RogueServer, "rogue-server", cfg.RogueServer, "When launching stops, serve DHCP on the segment with an attacker-controlled gateway and DNS (asks for confirmation)")
+	flag.StringVar(&cfg.RoguePool, "rogue-pool", cfg.RoguePool, "Address range the rogue server leases, e.g. 192.168.1.200-192.168.1.250")
+	flag.StringVar(&cfg.RogueGateway, "rogue-gateway", cfg.RogueGateway, "Gateway the rogue server hands out (default: this host)")
+	flag.Var((*stringList)(&cfg.RogueDNS), "rogue-dns", "Comma-separated DNS servers the rogue server hands out (default: this host)")
+	flag.DurationVar(&cfg.RogueLease, "rogue-lease", cfg.RogueLease, "Lease time the rogue server grants")
+	flag.DurationVar(&cfg.RogueDuration, "rogue-duration", cfg.RogueDuration, "How long the rogue server answers clients")
+	flag.IntVar(&cfg.IdentityChurn, "identity-churn", cfg.IdentityChurn, "Raw mode: reconfirm this many held leases with altered identities when launching stops")
+	flag.BoolVar(&cfg.ShrinkTest, "shrink-test", cfg.ShrinkTest, "Raw mode: bisect the client population to find the smallest one that makes a canary client fail")
+	flag.Float64Var(&cfg.LaunchRate, "rate", cfg.LaunchRate, "Maximum client launches per minute (0 for no limit)")
+	flag.StringVar(&cfg.Ramp, "ramp", cfg.Ramp, "Raise the launch rate in steps as start:factor:interval, e.g. 5:2:2m, up to -rate if set")
+	flag.DurationVar(&cfg.DHCPTimeout, "dhcp-timeout", cfg.DHCPTimeout, "How long a container may take to obtain a lease")
+	flag.DurationVar(&cfg.DHCPPollInterval, "dhcp-poll-interval", cfg.DHCPPollInterval, "How often a starting container is checked for a lease")
+	flag.IntVar(&cfg.ExhaustAfter, "exhaust-after", cfg.ExhaustAfter, "Launches in a row without a lease after which the pool counts as exhausted")
+	flag.DurationVar(&cfg.RetryInitial, "retry-initial", cfg.RetryInitial, "Delay before retrying a failed launch, growing with every consecutive failure")
+	flag.Float64Var(&cfg.RetryMultiplier, "retry-multiplier", cfg.RetryMultiplier, "Factor the retry delay grows by per consecutive failure")
+	flag.DurationVar(&cfg.RetryMax, "retry-max", cfg.RetryMax, "Longest delay between retries")
+	flag.IntVar(&cfg.RetryAttempts, "retry-attempts", cfg.RetryAttempts, "Consecutive failures after which the run gives up (0 retries forever)")
+	flag.Float64Var(&cfg.RetryJitter, "retry-jitter", cfg.RetryJitter, "Spread each retry delay by up to this fraction either way")
+	flag.DurationVar(&cfg.LaunchInterval, "launch-interval", cfg.LaunchInterval, "Docker mode: pause between a worker's launches when no -rate or -ramp paces them")
+	flag.DurationVar(&cfg.LaunchJitter, "launch-jitter", cfg.LaunchJitter, "Docker mode: add a random part of this to each -launch-interval pause")
+	flag.DurationVar(&cfg.LaunchStagger, "launch-stagger", cfg.LaunchStagger, "Hold each worker's first launch back a random part of this")
+	flag.BoolVar(&cfg.Internet, "internet", cfg.Internet, "Enable internet access for containers")
+	flag.StringVar(&cfg.Interface, "interface", cfg.Interface, "Parent interface for the macvlan network (default: default-route interface)")
+	flag.IntVar(&cfg.VLAN, "vlan", cfg.VLAN, "802.1Q VLAN ID: launch clients on a tagged subinterface of the parent, e.g. eth0.120 (0 for untagged)")
+	flag.Var((*stringList)(&cfg.Networks), "networks", "Comma-separated networks to attack at once as iface or iface:vlan, each optionally with =max or =max@rate for a lease cap and launches per minute of its own, e.g. eth1,eth0:120=50@30")
+	flag.StringVar(&cfg.NetworkName, "network", cfg.NetworkName, "Docker network to attach clients to, created if missing and verified if it exists")
+	flag.StringVar(&cfg.Driver, "driver", cfg.Driver, "Docker network driver: macvlan, ipvlan (l2 mode, clients share the parent's MAC) or bridge (an existing Linux bridge named by -interface)")
+	flag.StringVar(&cfg.DriverFallback, "driver-fallback", cfg.DriverFallback, "What docker mode does when the kernel has no macvlan support: ipvlan, bridge (-interface names a Linux bridge) or refuse")
+	flag.BoolVar(&cfg.IPv6, "ipv6", cfg.IPv6, "Exhaust the DHCPv6 IA_NA pool instead of the IPv4 pool")
+	flag.StringVar(&cfg.ContainerMemory, "container-memory", cfg.ContainerMemory, "Memory limit per client container, e.g. 32m (default: unlimited)")
+	flag.Float64Var(&cfg.ContainerCPUs, "container-cpus", cfg.ContainerCPUs, "CPU limit per client container, e.g. 0.05 (0 for unlimited)")
+	flag.BoolVar(&cfg.ReadOnly, "read-only", cfg.ReadOnly, "Run client containers with a read-only root filesystem")
+	flag.StringVar(&cfg.AddressOrder, "address-order", cfg.AddressOrder, "Order in which to request addresses: none, ascending, descending or top-half")
+	flag.Var((*stringList)(&cfg.MACPools), "mac-pools", "Comma-separated MAC pools with optional weights, e.g. apple:3,cisco:1,random:1")
+	flag.Var((*stringList)(&cfg.Hostnames), "hostnames", "Comma-separated hostname templates with optional weights, e.g. DESKTOP-{ALNUM:7}:6,{Name}s-iPhone:3, or realistic")
+	flag.StringVar(&cfg.ClientID, "client-id", cfg.ClientID, "Client identifier (option 61) per client: mac, duid, none or a template such as client-{hex:8}")
+	flag.StringVar(&cfg.HostnameWords, "hostname-words", cfg.HostnameWords, "File with one word per line for the {name} and {Name} hostname placeholders")
+	flag.Var((*stringList)(&cfg.Profiles), "profiles", "Comma-separated device profiles with optional weights, e.g. windows:6,iphone:3,hp-printer:1")
+	flag.Var((*stringList)(&cfg.ClientDNS), "client-dns", "Comma-separated DNS servers forced into client containers regardless of DHCP")
+	flag.Var((*stringList)(&cfg.ClientNTP), "client-ntp", "Comma-separated NTP servers forced into client containers regardless of DHCP")
+	flag.Var((*stringList)(&cfg.Traffic), "traffic", "Comma-separated targets each client reaches after getting a lease: ping:<host>, dns:<name> or an http(s) URL")
+	flag.DurationVar(&cfg.TrafficInterval, "traffic-interval", cfg.TrafficInterval, "How often each client reaches the -traffic targets")
+	flag.Var((*stringList)(&cfg.Announce), "announce", "Comma-separated name services to advertise client hostnames over: mdns, llmnr, netbios or all")
+	flag.DurationVar(&cfg.AnnounceInterval, "announce-interval", cfg.AnnounceInterval, "How often -announce repeats each client's announcements")
+	flag.StringVar(&cfg.Server, "server", cfg.Server, "Raw mode: DHCP server to test on a segment with several; replies from others are ignored and renewals are sent to it unicast")
+	flag.BoolVar(&cfg.ServerUnicast, "server-unicast", cfg.ServerUnicast, "Send every message to -server unicast instead of broadcasting DISCOVERs and REQUESTs")
+	flag.StringVar(&cfg.RelayServer, "relay-server", cfg.RelayServer, "Raw mode: act as a DHCP relay agent and send every request unicast to this server")
+	flag.StringVar(&cfg.RelayGIAddr, "relay-giaddr", cfg.RelayGIAddr, "Relay agent address (giaddr) the server picks the scope by (default: this host)")
+	flag.StringVar(&cfg.RelayLink, "relay-link", cfg.RelayLink, "Address on the remote segment to select its scope by, with giaddr left as this host (option 82 link selection)")
+	flag.StringVar(&cfg.RelayCircuitID, "relay-circuit-id", cfg.RelayCircuitID, "Option 82 circuit ID; {MAC} becomes the client's MAC")
+	flag.StringVar(&cfg.RelayRemoteID, "relay-remote-id", cfg.RelayRemoteID, "Option 82 remote ID; {MAC} becomes the client's MAC")
+	flag.DurationVar(&cfg.ARPKeepalive, "arp-keepalive", cfg.ARPKeepalive, "Send a gratuitous ARP for every held lease this often, and answer ARP for raw-mode clients (0 to disable)")
+	flag.Float64Var(&cfg.DNSLoad, "dns-load", cfg.DNSLoad, "DNS queries per second each leased client sends to the DNS server its lease offers (0 disables)")
+	flag.Var((*stringList)(&cfg.DNSLoadNames), "dns-load-names", "Comma-separated names -dns-load queries; *.<domain> queries a random name under it")
+	flag.StringVar(&cfg.DNSLoadServer, "dns-load-server", cfg.DNSLoadServer, "DNS server -dns-load queries instead of the one the leases offer")
+	flag.BoolVar(&cfg.DHCPLatency, "dhcp-latency", cfg.DHCPLatency, "Time every DISCOVER->OFFER and REQUEST->ACK exchange on the parent interface and report percentiles as the pool fills")
+	flag.StringVar(&cfg.DHCPLatencyFile, "dhcp-latency-file", cfg.DHCPLatencyFile, "CSV file -dhcp-latency records every timed exchange in (empty to disable)")
+	flag.BoolVar(&cfg.WatchServers, "watch-servers", cfg.WatchServers, "Warn as soon as a competing DHCP server answers during the run and list the servers in the summary")
+	flag.StringVar(&cfg.SNMPSwitch, "snmp-switch", cfg.SNMPSwitch, "Poll this access switch over SNMP during the run, host[:port] (default: disabled)")
+	flag.StringVar(&cfg.SNMPCommunity, "snmp-community", cfg.SNMPCommunity, "SNMPv2c community of -snmp-switch")
+	flag.StringVar(&cfg.SNMPUser, "snmp-user", cfg.SNMPUser, "Poll -snmp-switch with SNMPv3 as this user instead of SNMPv2c")
+	flag.StringVar(&cfg.SNMPAuthPass, "snmp-auth-pass", cfg.SNMPAuthPass, "SNMPv3 SHA authentication passphrase of -snmp-user")
+	flag.StringVar(&cfg.SNMPPrivPass, "snmp-priv-pass", cfg.SNMPPrivPass, "SNMPv3 AES privacy passphrase of -snmp-user")
+	flag.StringVar(&cfg.SNMPPort, "snmp-port", cfg.SNMPPort, "Switch port the host is on, by name (e.g. Gi1/0/5) or ifIndex, to watch its MAC count and status")
+	flag.DurationVar(&cfg.SNMPInterval, "snmp-interval", cfg.SNMPInterval, "How often to poll -snmp-switch")
+	flag.Var((*stringList)(&cfg.SNMPCounters), "snmp-counters", "Extra counters to poll on -snmp-switch as name=oid, comma-separated, e.g. DHCP snooping drops")
+	flag.StringVar(&cfg.SNMPLog, "snmp-log", cfg.SNMPLog, "Write every -snmp-switch poll with the run's counts to this CSV file (default: disabled)")
+	flag.BoolVar(&cfg.DetectConflicts, "detect-conflicts", cfg.DetectConflicts, "ARP-probe every leased address and flag those another host already claims")
+	flag.StringVar(&cfg.DHCPClient, "dhcp-client", cfg.DHCPClient, "DHCP client in client containers: auto, dhclient, udhcpc or dhcpcd")
+	flag.StringVar(&cfg.ClientInterface, "client-interface", cfg.ClientInterface, "Interface client containers run DHCP on")
+	flag.DurationVar(&cfg.StatusInterval, "status-interval", cfg.StatusInterval, "How often to print a status line with the time-to-exhaustion estimate (0 to disable)")
+	flag.StringVar(&cfg.MetricsAddr, "metrics", cfg.MetricsAddr, "Address to serve Prometheus metrics on, e.g. :9100 (default: disabled)")
+	flag.StringVar(&cfg.LeaseExport, "lease-export", cfg.LeaseExport, "Path prefix for the lease table export (<prefix>.csv, <prefix>.json; empty to disable)")
+	flag.StringVar(&cfg.Report, "report", cfg.Report, "Write a self-contained HTML report of the run to this file when it ends (default: disabled)")
+	flag.StringVar(&cfg.ResultsDB, "results-db", cfg.ResultsDB, "Save the run's results to this SQLite database when it ends, for the compare subcommand (default: disabled)")
+	flag.StringVar(&cfg.ResultsLabel, "results-label", cfg.ResultsLabel, "Label the run's results in -results-db, e.g. before-snooping (default: none)")
+	flag.StringVar(&cfg.ContainerLogs, "container-logs", cfg.ContainerLogs, "Docker mode: directory to keep each client container's output in, under a subdirectory named after the run ID")
+	flag.StringVar(&cfg.StateFile, "state-file", cfg.StateFile, "File a docker-mode run saves its state to, for -resume (empty to disable)")
+	flag.StringVar(&cfg.Orphans, "orphans", cfg.Orphans, "What to do with the containers and networks earlier runs left: ask, adopt, remove or keep")
+	flag.StringVar(&cfg.EngagementID, "engagement-id", cfg.EngagementID, "Engagement the run is part of, e.g. a contract or ticket number, recorded in the audit log")
+	flag.StringVar(&cfg.Operator, "operator", cfg.Operator, "Name of whoever runs the test, recorded in the audit log")
+	flag.BoolVar(&cfg.IAmAuthorized, "i-am-authorized", cfg.IAmAuthorized, "Confirm authorization to test the network on a terminal instead of naming the engagement")
+	flag.StringVar(&cfg.AuditLog, "audit-log", cfg.AuditLog, "Append-only, hash-chained log of every network-affecting action of the run")
+	flag.BoolVar(&cfg.Wait, "wait", cfg.Wait, "Keep running after the run finishes, e.g. to keep the control API up, until Ctrl-C")
+	flag.StringVar(&cfg.StartAt, "start-at", cfg.StartAt, "Arm the run and start it at this time: 15:04, \"2006-01-02 15:04\" or RFC 3339")
+	flag.StringVar(&cfg.Schedule, "schedule", cfg.Schedule, "Arm the run and start it at the next time this cron expression matches, e.g. \"0 22 * * 6\"")
+	flag.DurationVar(&cfg.Window, "window", cfg.Window, "Length of the change window from the start; the run is torn down when it closes (0 for none)")
+	flag.BoolVar(&daemonMode, "daemon", false, "Run as a long-lived service that starts runs on request through its API on -listen or -grpc-listen")
+	flag.StringVar(&pidFile, "pid-file", "", "With -daemon, write the process ID to this file")
+	flag.StringVar(&cfg.GRPCListen, "grpc-listen", cfg.GRPCListen, "With -daemon, address to serve the gRPC control plane on, e.g. :9090 for loopback only (default: disabled)")
+	flag.StringVar(&cfg.GRPCTLSCert, "grpc-tls-cert", cfg.GRPCTLSCert, "Certificate the gRPC control plane serves TLS with (default: plaintext)")
+	flag.StringVar(&cfg.GRPCTLSKey, "grpc-tls-key", cfg.GRPCTLSKey, "Private key of -grpc-tls-cert")
+	flag.StringVar(&cfg.GRPCClientCA, "grpc-client-ca", cfg.GRPCClientCA, "CA the gRPC control plane requires client certificates from (mutual TLS)")
+	flag.BoolVar(&cfg.GRPCReflection, "grpc-reflection", cfg.GRPCReflection, "Serve gRPC server reflection, for grpcurl and similar tools")
+	flag.BoolVar(&resume, "resume", false, "Continue the run recorded in -state-file, adopting its containers and leases")
+	flag.StringVar(&attach, "attach", "", "Continue the run with this ID from its labelled containers alone, rebuilding its lease table from their lease files (for a run whose -state-file is gone)")
+	flag.BoolVar(&cfg.ReleaseOnExit, "release-on-exit", cfg.ReleaseOnExit, "Release every held lease when the run ends or is interrupted")
+	flag.StringVar(&cfg.PCAP, "pcap", cfg.PCAP, "Write DHCP and DHCPv6 traffic on the parent interface to this pcap file (default: disabled)")
+	flag.StringVar(&cfg.ListenAddr, "listen", cfg.ListenAddr, "Address to serve the HTTP control API on, e.g. :8080 for loopback only (default: disabled)")
+	flag.StringVar(&cfg.NTPServer, "ntp-server", cfg.NTPServer, "NTP server to sanity-check the host clock against (empty to skip)")
+	flag.DurationVar(&cfg.MaxClockSkew, "max-clock-skew", cfg.MaxClockSkew, "Warn when the host clock differs from the NTP server by more than this")
+	flag.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "Format of run event logs: text or json")
+	flag.StringVar(&cfg.Output, "output", cfg.Output, "What stdout carries: text, or json events with everything else on stderr")
+	flag.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Minimum level of run event logs: debug, info, warn or error")
+	flag.Var((*stringList)(&cfg.LogSinks), "log-sink", "Comma-separated syslog (udp://, tcp://, tls://host:port) or http(s) URLs to copy run logs to")
+	flag.StringVar(&cfg.OTLPEndpoint, "otlp-endpoint", cfg.OTLPEndpoint, "OTLP/HTTP collector URL to export build and launch traces to, e.g. http://localhost:4318 (default: disabled)")
+	flag.BoolVar(&cfg.Quiet, "quiet", cfg.Quiet, "Leave out build output and info-level logs such as launches and status lines")
+	flag.BoolVar(&cfg.Verbose, "v", cfg.Verbose, "Print full build output and debug logs")
+	flag.BoolVar(&cfg.Progress, "progress", cfg.Progress, "Show a one-line progress summary, redrawn in place, below the log lines")
+	flag.BoolVar(&cfg.TUI, "tui", cfg.TUI, "Show a live dashboard instead of scrolling log lines")
+	flag.Parse()
+	// Flag parsing stops at the first argument that is not a flag, so any
+	// flags after it would be silently ignored.
+	if flag.NArg() > 0 {
+		fmt.Printf("Error: unexpected argument %q; all options are flags\n", flag.Arg(0))
+		os.Exit(exitConfig)
+	}
+
+	if configPath != "" {
+		if err := loadConfig(configPath, &cfg); err != nil {
+			fmt.Printf("Error loading config: %v\n", err)
+			os.Exit(exitConfig)
+		}
+		// Parse again so flags given on the command line win over the file.
+		flag.Parse()
+		cfg.ConfigPath = configPath
+		fmt.Printf("Loaded configuration from %s\n", configPath)
+	}
+	// A resumed run starts from the configuration it was saved with.
+	var resumed *runState
+	if resume {
+		st, err := readRunState(cfg.StateFile)
+		if err != nil {
+			fmt.Printf("Error: -resume: %v\n", err)
+			os.Exit(exitConfig)
+		}
+		cfg = st.Config
+		flag.Parse()
+		cfg.ConfigPath = configPath
+		runID, resumed = st.RunID, st
+		fmt.Printf("Resuming run %s saved at %s\n", st.RunID, st.SavedAt.Format(time.RFC3339))
+	}
+	// An attached run has no saved state: every lease record is rebuilt
+	// from its containers.
+	if attach != "" {
+		if resume {
+			fmt.Println("Error: -attach and -resume both continue a run; -resume reads -state-file, -attach only needs the run ID")
+			os.Exit(exitConfig)
+		}
+		runID, resumed = attach, &runState{RunID: attach}
+		fmt.Printf("Attaching to run %s\n", attach)
+	}
+	if cfg.TUI && cfg.Output == outputJSON {
+		fmt.Println("Error: -tui draws on the terminal; -output=json is for scripts")
+		os.Exit(exitConfig)
+	}
+	if err := setupOutput(cfg.Output); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(exitConfig)
+	}
+	if cfg.Progress && cfg.TUI {
+		fmt.Println("Error: -progress and -tui both draw the run's status; use one of them")
+		os.Exit(exitConfig)
+	}
+	if cfg.Quiet && cfg.Verbose {
+		fmt.Println("Error: -quiet and -v contradict each other; use one of them")
+		os.Exit(exitConfig)
+	}
+	// In -tui mode log records feed the dashboard's recent-errors pane.
+	var dash *dashboard
+	var logOut io.Writer = os.Stdout
+	minLevel := slog.LevelDebug
+	switch {
+	case cfg.Quiet:
+		verbosity, minLevel = verbosityQuiet, slog.LevelWarn
+	case cfg.Verbose:
+		verbosity = verbosityVerbose
+		if !flagSet("log-level") {
+			cfg.LogLevel = "debug"
+		}
+	}
+	if cfg.TUI {
+		dash = newDashboard()
+		logOut, minLevel = dash, slog.LevelWarn
+	}
+	var progress *progressLine
+	if cfg.Progress {
+		progress = newProgressLine(os.Stdout)
+		logOut = progress
+	}
+	if err := setupLogging(logOut, cfg.LogFormat, cfg.LogLevel, minLevel); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(exitConfig)
+	}
+	if err := shipLogs(cfg.LogSinks); err != nil {
+		fmt.Printf("Error: -log-sink: %v\n", err)
+		os.Exit(exitConfig)
+	}
+	flushTraces, err := setupTracing(cfg.OTLPEndpoint)
+	if err != nil {
+		fmt.Printf("Error: -otlp-endpoint: %v\n", err)
+		os.Exit(exitConfig)
+	}
+	host, err := newHostShell(cfg.Host, cfg.HostSSH)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(exitConfig)
+	}
+	if cleanup {
+		runCleanup(cfg, host)
+		return
+	}
+	if cfg.GRPCListen != "" && !daemonMode {
+		fmt.Println("Error: -grpc-listen serves the -daemon control plane; use -listen for a single run's control API")
+		os.Exit(exitConfig)
+	}
+	if cfg.ListenAddr != "" {
+		if cfg.ListenAddr, err = controlListenAddr(cfg.ListenAddr, false); err != nil {
+			fmt.Printf("Error: -listen: %v\n", err)
+			os.Exit(exitConfig)
+		}
+	}
+	if (cfg.GRPCTLSCert == "") != (cfg.GRPCTLSKey == "") {
+		fmt.Println("Error: -grpc-tls-cert and -grpc-tls-key go together")
+		os.Exit(exitConfig)
+	}
+	if cfg.GRPCClientCA != "" && cfg.GRPCTLSCert == "" {
+		fmt.Println("Error: -grpc-client-ca needs -grpc-tls-cert and -grpc-tls-key")
+		os.Exit(exitConfig)
+	}
+	if cfg.GRPCListen != "" {
+		if cfg.GRPCListen, err = controlListenAddr(cfg.GRPCListen, cfg.GRPCClientCA != ""); err != nil {
+			fmt.Printf("Error: -grpc-listen: %v, or require client certificates with -grpc-client-ca\n", err)
+			os.Exit(exitConfig)
+		}
+	}
+	if daemonMode {
+		if err := runService(cfg, pidFile); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(exitFailed)
+		}
+		return
+	}
+	if err := applyScenario(&cfg, flagSet("mode")); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(exitConfig)
+	}
+	if cfg.Churn > 0 && cfg.ReserveFree > 0 {
+		fmt.Println("Error: -churn and -reserve-free both release the run's leases; use one of them")
+		os.Exit(exitConfig)
+	}
+	if cfg.Host != "" && (cfg.Observe || cfg.Mode != modeDocker || cfg.PCAP != "" || cfg.RogueServer || cfg.ARPSweep || len(cfg.Announce) > 0 || cfg.ARPKeepalive > 0 || cfg.DNSLoad > 0 || cfg.DHCPLatency) {
+		fmt.Println("Error: -host runs docker mode on a remote engine; -observe, raw, netns, pd, k8s and sim mode, -pcap, -rogue-server, -arp-sweep, -announce, -arp-keepalive, -dns-load and -dhcp-latency work on this machine's interfaces")
+		os.Exit(exitConfig)
+	}
+	if cfg.RelayServer != "" && cfg.Mode != modeRaw {
+		fmt.Println("Error: -relay-server relays raw-mode clients; add -mode=raw")
+		os.Exit(exitConfig)
+	}
+	if cfg.RelayServer == "" && (cfg.RelayGIAddr != "" || cfg.RelayLink != "" || cfg.RelayCircuitID != "" || cfg.RelayRemoteID != "") {
+		fmt.Println("Error: -relay-giaddr, -relay-link, -relay-circuit-id and -relay-remote-id need -relay-server")
+		os.Exit(exitConfig)
+	}
+	if cfg.RelayServer != "" && cfg.ARPKeepalive > 0 {
+		fmt.Println("Error: -arp-keepalive holds addresses on this segment, and relayed leases are on another")
+		os.Exit(exitConfig)
+	}
+	if cfg.Server != "" && cfg.Mode != modeRaw {
+		fmt.Println("Error: -server targets raw-mode clients at one server; add -mode=raw")
+		os.Exit(exitConfig)
+	}
+	if cfg.Server != "" && (cfg.Scenario == scenarioFuzz || cfg.ShrinkTest) {
+		fmt.Println("Error: the fuzz and threshold scenarios talk to every server on the segment; -server does not apply to them")
+		os.Exit(exitConfig)
+	}
+	if cfg.SpoofRelease && cfg.Mode != modeRaw {
+		fmt.Println("Error: -spoof-release sends raw frames in the devices' names; add -mode=raw")
+		os.Exit(exitConfig)
+	}
+	if cfg.SpoofRelease && (cfg.Scenario == scenarioObserve || cfg.Scenario == scenarioThreshold || cfg.Scenario == scenarioFuzz) {
+		fmt.Printf("Error: -spoof-release frees leases for a run that exhausts the pool, not the %s scenario\n", cfg.Scenario)
+		os.Exit(exitConfig)
+	}
+	if cfg.SpoofRelease && cfg.RelayServer != "" {
+		fmt.Println("Error: -spoof-release releases the leases of devices on this segment; -relay-server exhausts another")
+		os.Exit(exitConfig)
+	}
+	if cfg.SpoofRelease && cfg.ReserveFree > 0 {
+		fmt.Println("Error: -reserve-free keeps addresses for legitimate devices, which -spoof-release takes theirs from")
+		os.Exit(exitConfig)
+	}
+	if len(cfg.SpoofReleaseExclude) > 0 && !cfg.SpoofRelease {
+		fmt.Println("Error: -spoof-release-exclude needs -spoof-release")
+		os.Exit(exitConfig)
+	}
+	if cfg.ServerUnicast && cfg.Server == "" {
+		fmt.Println("Error: -server-unicast needs -server")
+		os.Exit(exitConfig)
+	}
+	if cfg.Server != "" && cfg.RelayServer != "" {
+		fmt.Println("Error: -relay-server already sends every message to one server; drop -server")
+		os.Exit(exitConfig)
+	}
+	if cfg.Mode == modeK8s && len(cfg.Images) == 0 {
+		fmt.Println("Error: -mode=k8s runs registry images on the cluster's nodes; name them with -images")
+		os.Exit(exitConfig)
+	}
+	if cfg.Mode == modeK8s && cfg.Driver == driverBridge {
+		fmt.Println("Error: -mode=k8s attaches the pods with macvlan or ipvlan; -driver=bridge is for docker mode")
+		os.Exit(exitConfig)
+	}
+	if cfg.Mode != modeK8s && (cfg.Kubeconfig != "" || cfg.K8sContext != "" || cfg.K8sNamespace != "" || cfg.K8sNetwork != "" || cfg.K8sMaster != "" || len(cfg.K8sNodeSelector) > 0) {
+		fmt.Println("Error: -kubeconfig and the -k8s-* options configure -mode=k8s; add it")
+		os.Exit(exitConfig)
+	}
+	if cfg.K8sNetwork != "" && cfg.K8sMaster != "" {
+		fmt.Println("Error: -k8s-master places the network the run creates; -k8s-network names an existing one")
+		os.Exit(exitConfig)
+	}
+	if cfg.PDLength != 0 && cfg.Mode != modePD {
+		fmt.Println("Error: -pd-length hints the prefix length of -mode=pd solicits; add -mode=pd")
+		os.Exit(exitConfig)
+	}
+	if (flagSet("sim-pool") || flagSet("sim-latency")) && cfg.Mode != modeSim {
+		fmt.Println("Error: -sim-pool and -sim-latency configure the simulated server of -mode=sim; add -mode=sim")
+		os.Exit(exitConfig)
+	}
+	if cfg.Mode == modeSim && (cfg.Interface != "" || cfg.VLAN != 0 || len(cfg.Networks) > 0 || cfg.ARPSweep || len(cfg.Announce) > 0 || cfg.ARPKeepalive > 0 || cfg.DNSLoad > 0 || cfg.RogueServer || cfg.PCAP != "" || cfg.DHCPLatency || cfg.IdentityChurn > 0) {
+		fmt.Println("Error: -mode=sim leases from -sim-pool and touches no network; -interface, -vlan, -networks, -arp-sweep, -announce, -arp-keepalive, -dns-load, -rogue-server, -pcap, -dhcp-latency and -identity-churn need a real one")
+		os.Exit(exitConfig)
+	}
+	if cfg.Mode == modeSim && (cfg.DryRun || cfg.Observe) {
+		fmt.Println("Error: -mode=sim is itself a rehearsal that changes nothing; -dry-run and -observe do not apply")
+		os.Exit(exitConfig)
+	}
+	if cfg.Mode == modePD && (cfg.ARPSweep || cfg.ReserveFree > 0 || len(cfg.Announce) > 0 || cfg.ARPKeepalive > 0 || cfg.DNSLoad > 0 || cfg.RogueServer) {
+		fmt.Println("Error: -arp-sweep, -reserve-free, -announce, -arp-keepalive, -dns-load and -rogue-server work with IPv4 addresses, not delegated prefixes")
+		os.Exit(exitConfig)
+	}
+	schedule, err := newRunSchedule(cfg.StartAt, cfg.Schedule, cfg.Window)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(exitConfig)
+	}
+	if err := checkOrphansMode(cfg.Orphans); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(exitConfig)
+	}
+	if schedule != nil && cfg.Observe {
+		fmt.Println("Error: -start-at, -schedule and -window arm a run that launches clients, not -observe")
+		os.Exit(exitConfig)
+	}
+	if cfg.RogueServer && (cfg.Scenario == scenarioObserve || cfg.Scenario == scenarioThreshold || cfg.Scenario == scenarioFuzz) {
+		fmt.Printf("Error: -rogue-server follows a run that exhausts the pool, not the %s scenario\n", cfg.Scenario)
+		os.Exit(exitConfig)
+	}
+	if cfg.WifiFallback != modeRaw && cfg.WifiFallback != driverIpvlan && cfg.WifiFallback != "refuse" {
+		fmt.Printf("Error: unknown -wifi-fallback '%s' (use raw, ipvlan or refuse)\n", cfg.WifiFallback)
+		os.Exit(exitConfig)
+	}
+	if cfg.Driver != driverMacvlan && cfg.Driver != driverIpvlan && cfg.Driver != driverBridge {
+		fmt.Printf("Error: unknown -driver '%s' (use macvlan, ipvlan or bridge)\n", cfg.Driver)
+		os.Exit(exitConfig)
+	}
+	if cfg.DriverFallback != driverIpvlan && cfg.DriverFallback != driverBridge && cfg.DriverFallback != "refuse" {
+		fmt.Printf("Error: unknown -driver-fallback '%s' (use ipvlan, bridge or refuse)\n", cfg.DriverFallback)
+		os.Exit(exitConfig)
+	}
+	if cfg.NetworkName == "" {
+		fmt.Println("Error: -network must name a Docker network")
+		os.Exit(exitConfig)
+	}
+	if cfg.Driver == driverIpvlan && cfg.IPv6 {
+		fmt.Println("Error: -driver=ipvlan does not support -ipv6: DHCPv6 clients derive their DUID from the shared MAC")
+		os.Exit(exitConfig)
+	}
+	if cfg.Driver == driverBridge && cfg.IPv6 {
+		fmt.Println("Error: -driver=bridge does not support -ipv6: Docker would put its own IPv6 gateway address on the bridge")
+		os.Exit(exitConfig)
+	}
+	if len(cfg.Announce) > 0 {
+		if cfg.IPv6 {
+			fmt.Println("Error: -announce advertises IPv4 addresses and cannot be combined with -ipv6")
+			os.Exit(exitConfig)
+		}
+		if cfg.AnnounceInterval <= 0 {
+			fmt.Println("Error: -announce-interval must be positive")
+			os.Exit(exitConfig)
+		}
+		if len(cfg.Hostnames) == 0 && len(cfg.Profiles) == 0 {
+			fmt.Println("Warning: -announce advertises client hostnames, but without -hostnames or -profiles clients have none")
+		}
+	}
+	if cfg.DNSLoad > 0 && cfg.IPv6 {
+		fmt.Println("Error: -dns-load queries from the clients' IPv4 addresses and cannot be combined with -ipv6")
+		os.Exit(exitConfig)
+	}
+	targets := []networkTarget{{Interface: cfg.Interface, VLAN: cfg.VLAN}}
+	if len(cfg.Networks) > 0 {
+		switch {
+		case cfg.Interface != "" || cfg.VLAN != 0:
+			fmt.Println("Error: -networks names every parent interface and VLAN; drop -interface and -vlan")
+			os.Exit(exitConfig)
+		case cfg.Mode != modeDocker || cfg.Scenario != scenarioStarvation:
+			fmt.Println("Error: -networks runs the starvation scenario in docker mode; other scenarios and raw mode work on a single interface")
+			os.Exit(exitConfig)
+		case cfg.Internet || cfg.ReserveFree > 0 || cfg.PCAP != "" || cfg.RogueServer || cfg.ARPSweep:
+			fmt.Println("Error: -internet, -reserve-free, -pcap, -rogue-server and -arp-sweep work on a single network and cannot be combined with -networks")
+			os.Exit(exitConfig)
+		}
+		if targets, err = parseNetworkTargets(cfg.Networks); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(exitConfig)
+		}
+	}
+	workers := cfg.Workers
+	if cfg.DHCPTimeout <= 0 {
+		fmt.Println("Error: -dhcp-timeout must be positive")
+		os.Exit(exitConfig)
+	}
+	if cfg.DHCPPollInterval <= 0 || cfg.DHCPPollInterval > cfg.DHCPTimeout {
+		fmt.Println("Error: -dhcp-poll-interval must be positive and no longer than -dhcp-timeout")
+		os.Exit(exitConfig)
+	}
+	if cfg.ExhaustAfter < 1 {
+		fmt.Println("Error: -exhaust-after must be at least 1")
+		os.Exit(exitConfig)
+	}
+	retry, err := newRetryPolicy(cfg)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(exitConfig)
+	}
+	pacing, err := newLaunchPacing(cfg)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(exitConfig)
+	}
+	if err := checkStrategy(cfg.Strategy); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(exitConfig)
+	}
+	if cfg.Autoscale && (cfg.LaunchRate > 0 || cfg.Ramp != "") {
+		fmt.Println("Error: -autoscale finds the launch rate the run sustains itself; drop -rate and -ramp")
+		os.Exit(exitConfig)
+	}
+	if cfg.Autoscale && cfg.MaxWorkers < cfg.Workers {
+		fmt.Printf("Error: -max-workers (%d) must be at least -workers (%d)\n", cfg.MaxWorkers, cfg.Workers)
+		os.Exit(exitConfig)
+	}
+	if cfg.SNMPSwitch == "" && (cfg.SNMPUser != "" || cfg.SNMPPort != "" || len(cfg.SNMPCounters) > 0 || cfg.SNMPLog != "") {
+		fmt.Println("Error: -snmp-user, -snmp-port, -snmp-counters and -snmp-log need -snmp-switch")
+		os.Exit(exitConfig)
+	}
+	if cfg.SNMPSwitch != "" && cfg.SNMPInterval <= 0 {
+		fmt.Println("Error: -snmp-interval must be positive")
+		os.Exit(exitConfig)
+	}
+	if cfg.SNMPPrivPass != "" && cfg.SNMPAuthPass == "" {
+		fmt.Println("Error: SNMPv3 privacy needs authentication; set -snmp-auth-pass with -snmp-priv-pass")
+		os.Exit(exitConfig)
+	}
+	if cfg.ResultsLabel != "" && cfg.ResultsDB == "" {
+		fmt.Println("Error: -results-label names the run in -results-db; set -results-db too")
+		os.Exit(exitConfig)
+	}
+	if cfg.Strategy == strategyCounts && (cfg.MaxLeases > 0 || cfg.Churn > 0) {
+		fmt.Println("Error: -strategy=counts sets the lease cap to the planned counts; it is not combined with -max-leases or -churn")
+		os.Exit(exitConfig)
+	}
+	if err := checkDHCPClient(cfg.DHCPClient); err != nil {
+		fmt.Printf("Error: -dhcp-client: %v\n", err)
+		os.Exit(exitConfig)
+	}
+	if cfg.ClientID == clientIDNone && cfg.Driver == driverIpvlan && cfg.Mode == modeDocker {
+		fmt.Println("Error: ipvlan clients share the parent's MAC and are told apart by their client identifier; -client-id=none cannot be used with -driver=ipvlan")
+		os.Exit(exitConfig)
+	}
+	limits, err := parseContainerLimits(cfg)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(exitConfig)
+	}
+	enableInternet := cfg.Internet
+
+	// Make sure the run timeline can be correlated with server logs.
+	if cfg.NTPServer != "" {
+		checkClockSkew(cfg.NTPServer, cfg.MaxClockSkew)
+	}
+
+	// A simulated run touches no network, so it needs neither the host
+	// checks nor an engagement to be tied to.
+	if cfg.Mode == modeSim {
+		if resumed != nil {
+			fmt.Println("Error: -resume and -attach adopt the client containers of a docker-mode run")
+			os.Exit(exitConfig)
+		}
+		if cfg.ResultsDB != "" {
+			if err := initResultsDB(cfg.ResultsDB); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(exitConfig)
+			}
+		}
+		schedule.waitForStart()
+		if err := runLocalMode(cfg, schedule, dash, progress); err != nil {
+			fmt.Printf("[ERROR] Simulation mode failed: %v\n", err)
+			os.Exit(exitCode(err))
+		}
+		return
+	}
+
+	if cfg.DryRun {
+		if cfg.Observe {
+			fmt.Println("Error: -dry-run plans a run that launches clients; -observe launches nothing")
+			os.Exit(exitConfig)
+		}
+		if err := runDryRun(cfg, host, targets); err != nil {
+			fmt.Printf("[ERROR] A real run would fail:\n%v\n", err)
+			os.Exit(exitFailed)
+		}
+		return
+	}
+
+	// Nothing has been changed yet: a host the run cannot work on is
+	// reported in full now rather than found out halfway through setup.
+	if err := printHostChecks(runHostChecks(cfg, host, targets)); err != nil {
+		fmt.Printf("[ERROR] Pre-flight checks failed; nothing was changed:\n%v\n", err)
+		os.Exit(exitCode(err))
+	}
+
+	// Everything from here on acts on the network: the run must be tied to
+	// an engagement, and what it does is recorded for it.
+	terminal, _ := os.Stdin.Stat()
+	authorization, err := authorize(&cfg, host, targets, os.Stdin, terminal != nil && terminal.Mode()&os.ModeCharDevice != 0)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(exitConfig)
+	}
+	if audit, err = openAuditLog(cfg.AuditLog, cfg.EngagementID, cfg.Operator); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(exitConfig)
+	}
+	var networks []string
+	for _, target := range targets {
+		if target.VLAN != 0 {
+			networks = append(networks, fmt.Sprintf("%s:%d", orDash(target.Interface), target.VLAN))
+		} else {
+			networks = append(networks, orDash(target.Interface))
+		}
+	}
+	osUserName, sudoUser := osUser()
+	hostname, _ := os.Hostname()
+	audit.record("run_started", map[string]any{
+		"args":          redactArgs(os.Args[1:]),
+		"config":        cfg.ConfigPath,
+		"mode":          cfg.Mode,
+		"scenario":      cfg.Scenario,
+		"networks":      networks,
+		"host":          host.String(),
+		"authorization": authorization,
+		"os_user":       osUserName,
+		"sudo_user":     sudoUser,
+		"hostname":      hostname,
+	})
+
+	// Everything from here on runs on the tagged subinterfaces.
+	for i, target := range targets {
+		if target.VLAN != 0 {
+			if targets[i].Interface, err = setupVLANInterface(host, target.Interface, target.VLAN); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(exitFailed)
+			}
+		}
+	}
+	cfg.Interface = targets[0].Interface
+
+	if cfg.Observe {
+		err := runObserve(cfg)
+		audit.finish(exitCode(err))
+		if err != nil {
+			fmt.Printf("[ERROR] Observation failed: %v\n", err)
+			os.Exit(exitFailed)
+		}
+		return
+	}
+
+	// macvlan over Wi-Fi fails silently: access points drop frames from MACs
+	// that never associated, so containers just never get leases. ipvlan
+	// sends from the adapter's own MAC and is not affected.
+	if wireless := wirelessParents(host, targets); cfg.Mode == modeDocker && cfg.Driver == driverMacvlan && len(wireless) > 0 {
+		fmt.Printf("Warning: parent interface %s is wireless; macvlan containers cannot obtain leases over Wi-Fi,\n", strings.Join(wireless, ", "))
+		fmt.Println("as access points drop frames from MACs that never associated with them.")
+		switch {
+		case cfg.WifiFallback == driverIpvlan && cfg.IPv6:
+			fmt.Println("Error: refusing to start. -wifi-fallback=ipvlan does not support -ipv6; use -wifi-fallback=raw")
+			os.Exit(exitConfig)
+		case cfg.WifiFallback == driverIpvlan && cfg.ClientID == clientIDNone:
+			fmt.Println("Error: refusing to start. ipvlan clients are told apart by their client identifier, which")
+			fmt.Println("-client-id=none turns off; drop it or use -wifi-fallback=raw.")
+			os.Exit(exitConfig)
+		case cfg.WifiFallback == driverIpvlan:
+			fmt.Println("Falling back to the ipvlan driver (-wifi-fallback=ipvlan): the clients stay containers but")
+			fmt.Println("all send from the adapter's own MAC, and the server tells them apart by their DHCP client")
+			fmt.Println("identifier. Servers that key leases on the hardware address alone give every client the")
+			fmt.Println("same lease; use -wifi-fallback=raw for those.")
+			cfg.Driver = driverIpvlan
+		case cfg.WifiFallback == modeRaw && len(targets) > 1:
+			fmt.Println("Error: refusing to start. Raw mode cannot take over a -networks run; drop the wireless interface")
+			fmt.Println("from -networks, or use -wifi-fallback=ipvlan, which sends from the adapter's own MAC.")
+			os.Exit(exitConfig)
+		case cfg.WifiFallback == modeRaw:
+			fmt.Println("Falling back to raw mode (-wifi-fallback=raw): no containers are started; each client is a")
+			fmt.Println("DHCP exchange ipocalypse sends itself from the adapter's own MAC, told apart by its client")
+			fmt.Println("hardware address (chaddr). Leases are held, not used: the clients answer no ARP or traffic.")
+			cfg.Mode = modeRaw
+		default:
+			fmt.Println("Error: refusing to start (-wifi-fallback=refuse). Use a wired interface (-interface=eth0),")
+			fmt.Println("-driver=ipvlan, which sends from the adapter's own MAC and tells clients apart by client")
+			fmt.Println("identifier, or -mode=raw, which varies only the DHCP client hardware address.")
+			os.Exit(exitConfig)
+		}
+	}
 
-  Launch with more workers:
-    sudo ./ipocalypse -workers=8
-`)
+	// Some VM and cloud kernels are built without macvlan; Docker then only
+	// fails when it creates the network, with "operation not supported".
+	// Check the driver's module up front and offer one the kernel has.
+	if cfg.Mode == modeDocker && !kernelSupports(host, cfg.Driver) {
+		fmt.Printf("Warning: the kernel on %s has no %s support: the %s module is neither loaded, built in nor available.\n", host, cfg.Driver, cfg.Driver)
+		switch {
+		case cfg.Driver != driverMacvlan:
+			fmt.Printf("Error: refusing to start. -driver=%s needs the %s module; use a kernel with it, or another -driver.\n", cfg.Driver, cfg.Driver)
+			os.Exit(exitConfig)
+		case cfg.DriverFallback != "refuse" && !kernelSupports(host, cfg.DriverFallback):
+			fmt.Printf("Error: refusing to start. The kernel has no %s support either (-driver-fallback=%s); use -mode=raw,\n", cfg.DriverFallback, cfg.DriverFallback)
+			fmt.Println("which needs no network driver and varies only the DHCP client hardware address.")
+			os.Exit(exitConfig)
+		case cfg.DriverFallback == driverIpvlan && cfg.IPv6:
+			fmt.Println("Error: refusing to start. -driver-fallback=ipvlan does not support -ipv6; use -driver-fallback=bridge")
+			os.Exit(exitConfig)
+		case cfg.DriverFallback == driverIpvlan && cfg.ClientID == clientIDNone:
+			fmt.Println("Error: refusing to start. ipvlan clients are told apart by their client identifier, which")
+			fmt.Println("-client-id=none turns off; drop it or use -driver-fallback=bridge.")
+			os.Exit(exitConfig)
+		case cfg.DriverFallback == driverIpvlan:
+			fmt.Println("Falling back to the ipvlan driver (-driver-fallback=ipvlan): the clients all send from the")
+			fmt.Println("parent's MAC, and the server tells them apart by their DHCP client identifier. Servers that")
+			fmt.Println("key leases on the hardware address alone give every client the same lease; use")
+			fmt.Println("-driver-fallback=bridge for those.")
+			cfg.Driver = driverIpvlan
+		case cfg.DriverFallback == driverBridge && cfg.IPv6:
+			fmt.Println("Error: refusing to start. -driver-fallback=bridge does not support -ipv6.")
+			os.Exit(exitConfig)
+		case cfg.DriverFallback == driverBridge:
+			fmt.Println("Falling back to the bridge driver (-driver-fallback=bridge): the clients keep their own MACs")
+			fmt.Println("and attach to the Linux bridge named by -interface, which must have the NIC as a port.")
+			cfg.Driver = driverBridge
+		default:
+			fmt.Println("Error: refusing to start (-driver-fallback=refuse). Use -driver=ipvlan, where the clients share")
+			fmt.Println("the parent's MAC and are told apart by client identifier, -driver=bridge with a Linux bridge")
+			fmt.Println("over the NIC as -interface, or -mode=raw, which needs no network driver.")
+			os.Exit(exitConfig)
+		}
+	}
+	// The bridge driver attaches the clients to a bridge the operator made:
+	// moving the host's address off the NIC is not something to do behind
+	// their back, least of all over SSH.
+	if cfg.Mode == modeDocker && cfg.Driver == driverBridge {
+		for _, target := range targets {
+			parent := targetParent(host, target)
+			switch {
+			case target.VLAN > 0:
+				fmt.Println("Error: -driver=bridge cannot tag a VLAN on the bridge; create the VLAN interface on the NIC,")
+				fmt.Println("a bridge over it, and name that bridge without a VLAN.")
+				os.Exit(exitConfig)
+			case isBridge(host, parent):
+			case bridgeOf(host, parent) != "":
+				fmt.Printf("Error: %s is a port of bridge %s; -driver=bridge needs the bridge: use -interface=%s\n", parent, bridgeOf(host, parent), bridgeOf(host, parent))
+				os.Exit(exitConfig)
+			default:
+				fmt.Printf("Error: %s is not a Linux bridge. -driver=bridge attaches the clients to an existing bridge that\n", orDash(parent))
+				fmt.Println("has the NIC as a port and holds the host's address, created for example with:")
+				fmt.Println("  ip link add br0 type bridge && ip link set eth0 master br0 && ip link set br0 up")
+				fmt.Println("and eth0's address moved to br0; then run with -interface=br0.")
+				os.Exit(exitConfig)
+			}
+		}
 	}
-	// Flags for Docker image building and container launching
-	var dockerfileDirs string
-	var workers int
-	var enableInternet bool
 
-	flag.StringVar(&dockerfileDirs, "dockerfiles", "", "Optional: Comma-separated list of directories containing Dockerfiles (must start with 'ipocalypse')")
-	flag.IntVar(&workers, "workers", 5, "Number of concurrent container launch workers")
-	flag.BoolVar(&enableInternet, "internet", false, "Enable internet access for containers")
-	flag.Parse()
+	if resumed != nil && cfg.Mode != modeDocker {
+		fmt.Println("Error: -resume and -attach adopt the client containers of a docker-mode run")
+		os.Exit(exitConfig)
+	}
+	if cfg.ContainerLogs != "" && cfg.Mode != modeDocker {
+		fmt.Printf("Warning: -container-logs keeps the output of client containers, which %s mode does not run; ignoring it\n", cfg.Mode)
+	}
+	if cfg.ResultsDB != "" {
+		if err := initResultsDB(cfg.ResultsDB); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(exitConfig)
+		}
+	}
+	schedule.waitForStart()
+	switch cfg.Mode {
+	case modeDocker:
+	case modeRaw:
+		if cfg.Scenario == scenarioFuzz {
+			err := runFuzz(cfg)
+			audit.finish(exitCode(err))
+			if err != nil {
+				fmt.Printf("[ERROR] Fuzz run failed: %v\n", err)
+				os.Exit(exitFailed)
+			}
+			return
+		}
+		if cfg.ShrinkTest {
+			err := runShrinkTest(cfg)
+			audit.finish(exitCode(err))
+			if err != nil {
+				fmt.Printf("[ERROR] Shrink test failed: %v\n", err)
+				os.Exit(exitFailed)
+			}
+			return
+		}
+		err := runLocalMode(cfg, schedule, dash, progress)
+		audit.finish(exitCode(err))
+		if err != nil {
+			fmt.Printf("[ERROR] Raw mode failed: %v\n", err)
+			os.Exit(exitCode(err))
+		}
+		return
+	case modeNetns:
+		err := runLocalMode(cfg, schedule, dash, progress)
+		audit.finish(exitCode(err))
+		if err != nil {
+			fmt.Printf("[ERROR] Netns mode failed: %v\n", err)
+			os.Exit(exitCode(err))
+		}
+		return
+	case modePD:
+		err := runLocalMode(cfg, schedule, dash, progress)
+		audit.finish(exitCode(err))
+		if err != nil {
+			fmt.Printf("[ERROR] Prefix delegation mode failed: %v\n", err)
+			os.Exit(exitCode(err))
+		}
+		return
+	case modeK8s:
+		err := runLocalMode(cfg, schedule, dash, progress)
+		audit.finish(exitCode(err))
+		if err != nil {
+			fmt.Printf("[ERROR] Kubernetes mode failed: %v\n", err)
+			os.Exit(exitCode(err))
+		}
+		return
+	default:
+		fmt.Printf("Error: unknown mode '%s' (use docker, raw, netns, pd, k8s or sim)\n", cfg.Mode)
+		os.Exit(exitConfig)
+	}
 
-	var dockerfileList []string
-	if dockerfileDirs == "" {
-		// Auto-discover directories
+	if len(cfg.Images) > 0 && len(cfg.Dockerfiles) > 0 {
+		fmt.Println("Error: use either -images or -dockerfiles, not both")
+		os.Exit(exitConfig)
+	}
+	// Both lists may weight their entries as name:weight.
+	imageRefs, imageRefWeights, err := parseImageSpecs(cfg.Images, true)
+	if err != nil {
+		fmt.Printf("Error: -images: %v\n", err)
+		os.Exit(exitConfig)
+	}
+	dockerfileList, dockerfileWeights, err := parseImageSpecs(cfg.Dockerfiles, false)
+	if err != nil {
+		fmt.Printf("Error: -dockerfiles: %v\n", err)
+		os.Exit(exitConfig)
+	}
+	var builtinDir string
+	if len(imageRefs) > 0 {
+		fmt.Printf("Using %d registry images with %d workers\n", len(imageRefs), workers)
+	} else if len(dockerfileList) == 0 {
+		// Auto-discover directories, falling back to the built-in image.
 		dirs, err := getIpocalypseDirs()
 		if err != nil {
-			fmt.Printf("Error discovering directories: %v\n", err)
-			os.Exit(1)
-		}
-		dockerfileList = dirs
-	} else {
-		// Use provided directories
-		dockerfileList = strings.Split(dockerfileDirs, ",")
-		// Validate directory names
-		for _, dir := range dockerfileList {
-			if !strings.HasPrefix(filepath.Base(dir), "ipocalypse") {
-				fmt.Printf("Error: Directory '%s' must start with 'ipocalypse'\n", dir)
-				os.Exit(1)
+			fmt.Printf("No ipocalypse_* directories found (%v); using the built-in BusyBox client image\n", err)
+			dir, err := writeDefaultImage()
+			if err != nil {
+				fmt.Printf("[ERROR] %v\n", err)
+				os.Exit(exitFailed)
 			}
+			builtinDir = dir
+			dirs = []string{dir}
 		}
+		dockerfileList = dirs
+	}
+	if len(dockerfileList) > 0 {
+		fmt.Printf("Processing %d Dockerfile directories with %d workers\n", len(dockerfileList), workers)
+	}
+
+	// Connect to the container runtime.
+	cli, runtimeName, err := newContainerRuntime(cfg)
+	if err != nil {
+		fmt.Printf("[ERROR] Error creating %s client: %v\n", cfg.Runtime, err)
+		os.Exit(exitRuntime)
+	}
+	pingCtx, pingCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	_, err = cli.Ping(pingCtx)
+	pingCancel()
+	if err != nil {
+		fmt.Printf("[ERROR] %s engine unreachable: %v\n", runtimeName, err)
+		os.Exit(exitRuntime)
+	}
+	platform, err := resolvePlatform(context.Background(), cli, cfg.Platform)
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		os.Exit(exitRuntime)
+	}
+	fmt.Printf("Client images are built and run for %s\n", platformString(platform))
+	fmt.Printf("Using the %s container runtime\n", runtimeName)
+	var engine Engine = &dockerEngine{cli: cli}
+	if err := checkCapabilities(engine, cfg); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(exitConfig)
+	}
+
+	// What earlier runs left is settled before the network is set up, which
+	// fails on a -network left with another parent.
+	orphanMode := orphansKeep
+	if orphans, err := findOrphans(context.Background(), cli); err != nil {
+		slog.Warn("could not look for the resources of earlier runs", "error", err)
+	} else if orphans.found() {
+		stdin, _ := os.Stdin.Stat()
+		orphanMode = chooseOrphans(cfg.Orphans, orphans, os.Stdin, stdin != nil && stdin.Mode()&os.ModeCharDevice != 0)
+	}
+	if orphanMode == orphansRemove && !removeOrphans(context.Background(), cli, host, cfg.NetworkName) {
+		fmt.Println("[ERROR] The resources of earlier runs were not all removed; see the report above")
+		os.Exit(exitFailed)
 	}
 
-	// Execute setup_network.sh with internet flag if enabled
+	// Create the macvlan networks, host interfaces and optional NAT.
 	fmt.Println("Setting up network configuration...")
-	var setupCmd *exec.Cmd
 	if enableInternet {
-		setupCmd = exec.Command("sudo", "utils/setup_network.sh", "-i")
 		fmt.Println("Internet access enabled for containers")
 	} else {
-		setupCmd = exec.Command("sudo", "utils/setup_network.sh")
 		fmt.Println("Internet access disabled for containers")
 	}
-	setupCmd.Stdout = os.Stdout
-	setupCmd.Stderr = os.Stderr
-	if err := setupCmd.Run(); err != nil {
-		fmt.Printf("Failed to setup network: %v\n", err)
-		os.Exit(1)
+	nets := &networkSet{}
+	for i, target := range targets {
+		name, link := networkNames(cfg.NetworkName, i, len(targets), target.Interface)
+		netCfg, err := setupNetwork(context.Background(), cli, host, name, link, cfg.Driver, target.Interface, target.VLAN > 0, enableInternet, cfg.IPv6)
+		if err != nil {
+			fmt.Printf("Failed to setup network: %v\n", err)
+			os.Exit(exitCode(err))
+		}
+		planner, err := newAddressPlanner(cfg.AddressOrder, netCfg)
+		if err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
+			os.Exit(exitConfig)
+		}
+		n := &targetNetwork{NetworkConfig: netCfg, planner: planner, stats: newRunStats()}
+		if !cfg.IPv6 {
+			n.stats.setCapacity(poolCapacity(netCfg))
+		}
+		nets.networks = append(nets.networks, n)
+	}
+	// Single-network features (-reserve-free, -pcap) work on the first.
+	netCfg := nets.networks[0].NetworkConfig
+	// A remote engine's LAN cannot be reached from here.
+	if !host.remote() {
+		for _, n := range nets.networks {
+			if err := preflight(n.Parent, cfg.TrustedServers, "", cfg.Force); err != nil {
+				fmt.Printf("[ERROR] %v\n", err)
+				os.Exit(exitFailed)
+			}
+		}
 	}
-
-	// Continue with your existing container setup logic...
-	fmt.Printf("Processing %d Dockerfile directories with %d workers\n", len(dockerfileList), workers)
-
-	// Create a Docker client.
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	occupancy, err := newPoolOccupancy(context.Background(), netCfg, cfg.ARPSweep)
 	if err != nil {
-		fmt.Printf("[ERROR] Error creating Docker client: %v\n", err)
-		os.Exit(1)
+		fmt.Printf("[ERROR] %v\n", err)
+		os.Exit(exitFailed)
 	}
 
 	// Build images using directory names
 	imageNames := make([]string, 0, len(dockerfileList))
-	for _, dir := range dockerfileList {
+	imageWeights := make(map[string]int)
+	manifests := make(map[string]*imageManifest, len(dockerfileList))
+	builds := make([]*imageBuild, 0, len(dockerfileList))
+	imageDirs := make(map[string]string, len(dockerfileList))
+	for i, dir := range dockerfileList {
 		// Use the directory name as the image name
-		imageName := fmt.Sprintf("%s:latest", filepath.Base(dir))
-		fmt.Printf("Building image %s from directory %s\n", imageName, dir)
-		if err = buildImage(cli, dir, imageName); err != nil {
-			fmt.Printf("[ERROR] Building image from %s failed: %v\n", dir, err)
-			os.Exit(1)
+		imageName := buildImageName(dir)
+		if other, ok := imageDirs[imageName]; ok {
+			fmt.Printf("Error: -dockerfiles %s and %s would both be built as %s; rename one of the directories\n", other, dir, imageName)
+			os.Exit(exitConfig)
+		}
+		imageDirs[imageName] = dir
+		if i < len(dockerfileWeights) {
+			imageWeights[imageName] = dockerfileWeights[i]
+		}
+		manifest, err := loadManifest(dir)
+		if err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
+			os.Exit(exitConfig)
+		}
+		dockerfile := cfg.Dockerfile
+		if manifest.Dockerfile != "" {
+			dockerfile = manifest.Dockerfile
+		}
+		if err := checkBuildContext(dir, dockerfile); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(exitConfig)
+		}
+		manifests[imageName] = manifest
+		if cfg.NoBuild {
+			info, _, err := cli.ImageInspectWithRaw(context.Background(), imageName)
+			if err != nil {
+				fmt.Printf("[ERROR] -no-build: image %s is not on the engine: %v\n", imageName, err)
+				os.Exit(exitConfig)
+			}
+			fmt.Printf("Using image %s (%s) as it is\n", imageName, info.ID)
+			imageNames = append(imageNames, imageName)
+			continue
 		}
+		builds = append(builds, &imageBuild{Dir: dir, Image: imageName, Dockerfile: dockerfile})
 		imageNames = append(imageNames, imageName)
 	}
+	if len(builds) > 0 {
+		builder, err := newImageBuilder(cfg, runtimeName)
+		if err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
+			os.Exit(exitConfig)
+		}
+		err = buildImages(cli, builder, builds, cfg.BuildWorkers)
+		if builtinDir != "" {
+			os.RemoveAll(filepath.Dir(builtinDir))
+		}
+		if err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
+			os.Exit(exitCode(err))
+		}
+	}
+	if len(imageRefs) > 0 {
+		if err := pullImages(cli, imageRefs); err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
+			os.Exit(exitCode(err))
+		}
+		// Registry images carry no manifest.
+		for i, ref := range imageRefs {
+			manifests[ref] = &imageManifest{}
+			imageWeights[ref] = imageRefWeights[i]
+			imageNames = append(imageNames, ref)
+		}
+	}
+	if err := validateImages(cli, imageNames, manifests, cfg.DHCPClient, cfg.IPv6); err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		os.Exit(exitCode(err))
+	}
+
+	profiles, err := parseProfiles(cfg.Profiles)
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		os.Exit(exitConfig)
+	}
+	hostnames, err := newHostnameGenerator(cfg.Hostnames, cfg.HostnameWords)
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		os.Exit(exitConfig)
+	}
+	clientIDs, err := newClientIDGenerator(cfg.ClientID)
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		os.Exit(exitConfig)
+	}
+	for flagName, servers := range map[string][]string{"client-dns": cfg.ClientDNS, "client-ntp": cfg.ClientNTP} {
+		for _, server := range servers {
+			if net.ParseIP(server) == nil {
+				fmt.Printf("[ERROR] -%s: %q is not an IP address\n", flagName, server)
+				os.Exit(exitConfig)
+			}
+		}
+	}
+	// Without configured pools Docker assigns MACs itself. ipvlan clients
+	// share the parent's MAC and always need one for their client identifier.
+	var macs *macGenerator
+	pools := cfg.MACPools
+	if len(pools) == 0 && cfg.Driver == driverIpvlan {
+		pools = []string{poolLocallyAdministered}
+	}
+	if len(pools) > 0 {
+		if macs, err = newMACGenerator(pools); err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
+			os.Exit(exitConfig)
+		}
+	}
 
 	// Start concurrent workers to launch containers.
 	fmt.Println("=== Starting container launch workers ===")
-	ctx, cancel := context.WithCancel(context.Background())
+	fmt.Printf("Run ID: %s (labelled %s on its containers, images and networks)\n", runID, labelRun)
+	// Everything the run does ends when its window closes.
+	window, closeWindow := schedule.context()
+	defer closeWindow()
+	ctx, cancel := context.WithCancel(window)
 	defer cancel()
 
-	var wg sync.WaitGroup
 	errorChan := make(chan error, 1)
 
-	// Seed the random number generator.
-	rand.Seed(time.Now().UnixNano())
-
-	for i := 0; i < workers; i++ {
-		wg.Add(1)
-		go func(workerID int) {
-			defer wg.Done()
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				default:
-					// Randomly select one of the built images.
-					chosenImage := imageNames[rand.Intn(len(imageNames))]
-					containerID, err := launchContainer(cli, chosenImage)
-					if err != nil {
-						fmt.Printf("[Worker %d] Error launching container: %v\n", workerID, err)
-						// If error indicates that no IP was assigned, assume subnet exhaustion.
-						if isNoIPError(err) {
-							errorChan <- err
-							cancel()
-							return
-						}
-						// Otherwise, wait briefly and try again.
-						time.Sleep(2 * time.Second)
-						continue
-					}
-					fmt.Printf("[Worker %d] Launched container %s using image %s\n", workerID, containerID, chosenImage)
-					time.Sleep(1 * time.Second)
+	stats := newRunStats()
+	if !cfg.IPv6 {
+		stats.setCapacity(nets.capacity())
+	}
+	leases := &leaseTable{}
+	var releaseAtExit func(ctx context.Context, r leaseRecord) error
+	if cfg.ReleaseOnExit {
+		releaseAtExit = engine.Release
+	}
+	exportOnSignal(leases, cfg.LeaseExport, releaseAtExit)
+	var adopted int
+	if resumed != nil {
+		var removed int
+		if adopted, removed, err = adoptRun(ctx, cli, resumed, leases); err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
+			os.Exit(exitCode(err))
+		}
+		if attach != "" && adopted+removed == 0 {
+			fmt.Printf("[ERROR] -attach: no containers of run %s found; ipocalypse status lists the runs\n", attach)
+			os.Exit(exitConfig)
+		}
+		fmt.Printf("Adopted %d clients of run %s with their leases (%d without a lease removed)\n", adopted, resumed.RunID, removed)
+		// Leases taken before the restart count in the statistics,
+		// metrics and report.
+		records := leases.snapshot()
+		stats.backfill(records)
+		for _, n := range nets.networks {
+			var on []leaseRecord
+			for _, r := range records {
+				if r.Network == n.Name {
+					on = append(on, r)
 				}
 			}
-		}(i)
+			n.stats.backfill(on)
+		}
+		if resumed.StartedAt.IsZero() {
+			// An attached run started no later than its first client.
+			resumed.StartedAt = clock.Now()
+			for _, r := range records {
+				if !r.AcquiredAt.IsZero() && r.AcquiredAt.Before(resumed.StartedAt) {
+					resumed.StartedAt = r.AcquiredAt
+				}
+			}
+		}
+	}
+	if orphanMode == orphansAdopt {
+		n, removed, err := adoptOrphans(ctx, cli, leases)
+		if err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
+			os.Exit(exitCode(err))
+		}
+		fmt.Printf("Adopted %d clients of earlier runs with their leases (%d without a lease removed)\n", n, removed)
+		adopted += n
+	}
+	state := newStateFile(cfg.StateFile, cfg, leases)
+	if resumed != nil && state != nil {
+		state.started = resumed.StartedAt
+	}
+	go state.watch(ctx, stateSaveInterval)
+	rogue, err := newRogueServer(cfg, netCfg, leases.hasMAC, os.Stdin)
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		os.Exit(exitConfig)
+	}
+	var capture *pcapCapture
+	if cfg.PCAP != "" {
+		if capture, err = startPCAP(netCfg.Parent, cfg.PCAP); err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
+			os.Exit(exitFailed)
+		}
+	}
+	announce, err := newAnnouncer(cfg.Announce, netCfg)
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		os.Exit(exitConfig)
+	}
+	if announce != nil {
+		fmt.Printf("Announcing client hostnames over %s every %s\n", announce, cfg.AnnounceInterval)
+		go announce.run(ctx, leases, cfg.AnnounceInterval)
+	}
+	// Container clients answer ARP themselves.
+	keepalive, err := newARPKeeper(cfg.ARPKeepalive, false, cfg.Driver == driverIpvlan, netCfg)
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		os.Exit(exitConfig)
+	}
+	if keepalive != nil {
+		fmt.Printf("Holding leases with %s\n", keepalive)
+		go keepalive.run(ctx, leases)
+	}
+	dnsQueries, err := newDNSLoad(cfg.DNSLoad, cfg.DNSLoadNames, cfg.DNSLoadServer, netCfg)
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		os.Exit(exitConfig)
+	}
+	if dnsQueries != nil {
+		fmt.Printf("DNS load: %s\n", dnsQueries)
+		go dnsQueries.run(ctx, leases)
+	}
+	timer, err := newTransactionTimer(cfg.DHCPLatency, cfg.DHCPLatencyFile, netCfg, stats)
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		os.Exit(exitFailed)
+	}
+	go timer.run(ctx)
+	var rogueIP net.IP
+	if rogue != nil {
+		rogueIP = rogue.serverIP
+	}
+	watch, err := newServerWatch(cfg.WatchServers && !host.remote(), netCfg, cfg.TrustedServers, rogueIP)
+	if err != nil {
+		slog.Warn("not watching for competing DHCP servers", "error", err)
+	}
+	go watch.run(ctx)
+	switchMon, err := newSwitchMonitor(cfg, stats)
+	if err != nil {
+		slog.Warn("not polling the switch", "error", err)
+	} else if switchMon != nil {
+		fmt.Printf("Polling switch %s every %v\n", switchMon, cfg.SNMPInterval)
+	}
+	go switchMon.run(ctx)
+	conflicts, err := newConflictCheck(cfg.DetectConflicts && !host.remote(), netCfg, leases)
+	if err != nil {
+		slog.Warn("not probing leased addresses for conflicts", "error", err)
+	}
+	go conflicts.run(ctx)
+	// The dashboard shows the status line itself.
+	var dashDone chan struct{}
+	if dash != nil {
+		dashDone = make(chan struct{})
+		go func() {
+			dash.run(ctx, stats, leases, time.Second)
+			close(dashDone)
+		}()
+	} else if progress != nil {
+		go progress.run(ctx, stats, cfg.StatusInterval)
+	} else {
+		go reportStatus(ctx, stats, cfg.StatusInterval)
+	}
+	// A daemon that stays away ends the run like any other fatal error.
+	daemon := newDaemonMonitor(cli, nets.configs(), retry, func(err error) {
+		select {
+		case errorChan <- err:
+		default:
+		}
+		cancel()
+	})
+	go daemon.watch(ctx, 10*time.Second)
+	if cfg.MetricsAddr != "" {
+		serveMetrics(cfg.MetricsAddr, stats)
+	}
+	// The run's own clients use generated or Docker-assigned MACs; the
+	// lease table catches those Podman assigned.
+	if cfg.Fingerprint && !host.remote() {
+		ours := func(mac net.HardwareAddr) bool {
+			return (macs != nil && macs.issued(mac)) || isDockerMAC(mac) || leases.hasMAC(mac.String())
+		}
+		for _, n := range nets.networks {
+			n.fingerprints = newFingerprinter(ours)
+			n.fingerprints.watch(ctx, n.Parent)
+		}
+	}
+
+	budget, err := newLeaseBudget(cfg.MaxLeases, cfg.LaunchRate)
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		os.Exit(exitConfig)
+	}
+	if budget.ramp, err = parseRamp(cfg.Ramp); err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		os.Exit(exitConfig)
+	}
+	budget.adopt(adopted)
+	fmt.Printf("Lease budget: %s\n", budget)
+	for i, target := range targets {
+		if target.MaxLeases == 0 && target.Rate == 0 {
+			continue
+		}
+		n := nets.networks[i]
+		if err := budget.limitNetwork(n.Name, target.MaxLeases, target.Rate); err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
+			os.Exit(exitConfig)
+		}
+		nb := budget.network(n.Name)
+		for _, r := range leases.held() {
+			if r.Network == n.Name {
+				nb.adopt(1)
+			}
+		}
+		fmt.Printf("Lease budget on %s: %s\n", n.Name, nb)
+	}
+	nets.budget = budget
+	fmt.Printf("Retry policy: %s\n", retry)
+	if !budget.paced() {
+		fmt.Printf("Launch pacing: %s\n", pacing)
+	}
+	reserve, err := newFreeReserve(netCfg, cfg.ReserveFree, leases, engine.Release)
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		os.Exit(exitConfig)
+	}
+	if reserve != nil {
+		fmt.Printf("Keeping at least %d addresses free for other devices\n", cfg.ReserveFree)
+		go reserve.watch(ctx, reserveSweepInterval)
+	}
+	churn, err := newClientChurn(cfg.Churn, cfg.ChurnInterval, leases, budget, engine.Release)
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		os.Exit(exitConfig)
+	}
+	if churn != nil {
+		fmt.Printf("Churning %.0f%% of the clients every %s\n", cfg.Churn*100, cfg.ChurnInterval)
+		go churn.watch(ctx)
+	}
+	storm, err := newRenewalStorm(cfg.RenewInterval, cfg.RenewWorkers, cfg.RenewRounds, leases, engine.Renew)
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		os.Exit(exitConfig)
+	}
+	renewer, err := newLeaseRenewer(cfg, true, leases, engine.Renew)
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		os.Exit(exitConfig)
+	}
+	if renewer != nil {
+		// Renewals go on after launching stops, for as long as the run
+		// holds its leases.
+		renewer.start(window)
+		fmt.Printf("Renewing leases %s\n", renewer)
+	}
+
+	if limits.set() {
+		fmt.Printf("Container limits: %s\n", limits)
+	}
+	clientLogs, err := newContainerLogs(cli, cfg.ContainerLogs)
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		os.Exit(exitRuntime)
+	}
+	if clientLogs != nil {
+		fmt.Printf("Keeping container logs in %s\n", clientLogs.dir)
+	}
+	traffic, err := newTrafficGenerator(cfg.Traffic, cfg.TrafficInterval)
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		os.Exit(exitConfig)
+	}
+	if traffic != nil {
+		fmt.Printf("Client traffic: %s\n", traffic)
+	}
+
+	fmt.Printf("Seed: %d (pass -seed=%[1]d to launch the same clients again)\n", seedIdentities(cfg.Seed))
+	// specMu makes each launch draw its image, MAC, hostname and profile
+	// in one go, so the Nth client of a seeded run is the same every time.
+	var specMu sync.Mutex
+
+	// newSpec describes the next container of image on target.
+	newSpec := func(image string, target *targetNetwork) launchSpec {
+		spec := launchSpec{Image: image, Network: target.Name, SharedMAC: cfg.Driver == driverIpvlan, RequestedIP: target.planner.Next(), DHCPv6: cfg.IPv6, DNS: cfg.ClientDNS, NTP: cfg.ClientNTP, DHCPTimeout: cfg.DHCPTimeout, DHCPPollInterval: cfg.DHCPPollInterval, Limits: limits, Logs: clientLogs}
+		if macs != nil {
+			spec.MAC = macs.Next()
+		}
+		m := manifests[image]
+		spec.Labels = runLabels(labelImage, image)
+		if m.Count > 0 {
+			spec.Labels[labelRole] = m.Role
+		}
+		spec.Command = m.Command
+		spec.DHCPClient = cmp.Or(m.DHCPClient, cfg.DHCPClient)
+		spec.Interface = cmp.Or(m.Interface, cfg.ClientInterface)
+		if name := manifests[image].Profile; name != "" {
+			spec.Profile, _ = lookupProfile(name)
+		} else if !profiles.empty() {
+			spec.Profile = profiles.pick()
+		}
+		clientIDs.apply(&spec)
+		if spec.Hostname = hostnames.next(); spec.Hostname == "" && spec.Profile != nil {
+			spec.Hostname = expandHostname(spec.Profile.HostnamePattern)
+		}
+		return spec
+	}
+
+	// Role containers come up in dependency order before any client.
+	roleImages, clientImages, err := planRoles(imageNames, manifests)
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		os.Exit(exitConfig)
+	}
+	mix := &weightedSet[string]{}
+	for _, image := range clientImages {
+		mix.add(image, max(imageWeights[image], 1))
+	}
+	clients, err := newImageSelector(cfg.Strategy, mix)
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		os.Exit(exitConfig)
+	}
+	if cfg.Strategy == strategyCounts {
+		// The budget stops the run once the plan is complete, counting the
+		// clients a resumed run adopted.
+		planned := clients.plan(leases.held())
+		_, rate := budget.limits()
+		budget.set(adopted+planned, rate)
+		fmt.Printf("Client image plan: %s, %d containers still to launch\n", mix.describeCounts(), planned)
+	} else if len(clientImages) > 1 {
+		fmt.Printf("Client image mix: %s, picked %s\n", mix.describe(), cfg.Strategy)
+	}
+	err = startRoles(ctx, engine, cli, roleImages, manifests, func(image string) launchSpec {
+		return newSpec(image, nets.pick())
+	}, func(spec launchSpec, result launchResult) {
+		leases.add(leaseRecord{IP: result.IP, MAC: result.MAC, LeaseSeconds: int(result.LeaseTime.Seconds()), Server: result.Server, Container: shortID(result.ID), Image: spec.Image, Network: spec.Network, ClientID: result.ClientID})
+	})
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		fmt.Println("Run with -cleanup to remove the containers already started.")
+		os.Exit(exitCode(err))
+	}
+
+	w := &launchWorker{
+		engine:       engine,
+		cli:          cli,
+		clock:        clock,
+		budget:       budget,
+		daemon:       daemon,
+		reserve:      reserve,
+		churn:        churn,
+		pacing:       pacing,
+		retry:        retry,
+		exhaustAfter: cfg.ExhaustAfter,
+		specMu:       &specMu,
+		clients:      clients,
+		nets:         nets,
+		newSpec:      newSpec,
+		manifests:    manifests,
+		stats:        stats,
+		leases:       leases,
+		conflicts:    conflicts,
+		announce:     announce,
+		keepalive:    keepalive,
+		dnsQueries:   dnsQueries,
+		traffic:      traffic,
+		dash:         dash,
+		errs:         errorChan,
+		cancel:       cancel,
+	}
+	ctl := newRunControl(ctx, cancel, w.run)
+	w.ctl = ctl
+	ctl.budget = budget
+	reloadOnHangup(ctl, cfg)
+	pauseOnSignal(ctl)
+	ctl.teardown = func() []teardownResult {
+		t := newTeardown(cli, host, cfg.NetworkName)
+		t.pruneImages = cfg.PruneImages
+		results := t.run(context.Background())
+		printTeardownReport(results)
+		return results
+	}
+	if err := ctl.setWorkers(workers); err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		os.Exit(exitFailed)
+	}
+	scaler := newWorkerScaler(cfg.Autoscale, cfg.MaxWorkers, ctl, stats)
+	go scaler.run(ctx)
+	if cfg.ListenAddr != "" {
+		serveControl(cfg.ListenAddr, ctl, stats, leases, cfg.LeaseExport, max(cfg.MaxWorkers, workers))
 	}
 
 	// Wait until a worker signals an error (e.g. no IP available) or cancellation.
+	var stopErr error
 	select {
-	case err := <-errorChan:
-		fmt.Printf("Stopping container launches due to error: %v\n", err)
+	case stopErr = <-errorChan:
+		slog.Error("stopping container launches", "error", stopErr)
 		cancel()
 	case <-ctx.Done():
 	}
 
-	wg.Wait()
+	ctl.stop()
+	if dashDone != nil {
+		<-dashDone
+	}
+	occupancy.finish(context.Background(), leases)
+	// The renewal storm runs once launching stopped, against the leases the
+	// run holds.
+	if storm != nil {
+		fmt.Printf("Renewing %d held leases every %s, %d rounds...\n", len(leases.held()), cfg.RenewInterval, cfg.RenewRounds)
+		storm.run(window)
+	}
+	if rogue != nil {
+		fmt.Printf("Serving rogue DHCP on %s for %s...\n", netCfg.Parent, cfg.RogueDuration)
+		rogue.serve(window)
+	}
+	if cfg.ReleaseOnExit {
+		renewer.stop()
+		releaseOnExit(leases, engine.Release)
+	}
+	if capture != nil {
+		if err := capture.stop(); err != nil {
+			slog.Error("pcap capture failed", "error", err)
+		}
+	}
 	fmt.Println("Finished launching containers.")
+	stats.printSummary()
+	if budget.reached() {
+		fmt.Printf("Stopped at the lease budget of %s\n", budget)
+	}
+	nets.printSummary()
+	budget.ramp.printReport()
+	scaler.printSummary()
+	reserve.printSummary()
+	churn.printSummary()
+	storm.printSummary()
+	renewer.printSummary()
+	rogue.printSummary()
+	dnsQueries.printSummary()
+	timer.printSummary()
+	watch.printSummary()
+	switchMon.printSummary()
+	conflicts.printSummary()
+	keepalive.printSummary()
+	occupancy.printReport()
+	for _, n := range nets.networks {
+		compareWithBaseline(cfg.BaselineDir, n.Subnet.String(), n.stats, leases.onNetwork(n.Name), "attack latency includes container start-up")
+	}
+	for _, n := range nets.networks {
+		if n.fingerprints == nil {
+			continue
+		}
+		if len(nets.networks) > 1 {
+			fmt.Printf("Network %s:\n", n.Name)
+		}
+		n.fingerprints.finish(cfg.BaselineDir, n.Subnet.String())
+	}
+	if cfg.LeaseExport != "" {
+		if err := leases.export(cfg.LeaseExport); err != nil {
+			slog.Error("lease export failed", "error", err)
+		}
+	}
+	var described []string
+	for _, n := range nets.networks {
+		described = append(described, fmt.Sprintf("%s on %s (%s)", n.Name, n.Parent, n.Subnet))
+	}
+	if cfg.Report != "" {
+		if err := writeReport(cfg.Report, cfg, strings.Join(described, ", "), stats, leases, watch, nets.reportSections(leases)); err != nil {
+			slog.Error("HTML report not written", "error", err)
+		} else {
+			fmt.Printf("HTML report written to %s\n", cfg.Report)
+		}
+	}
+	if cfg.ResultsDB != "" {
+		if err := saveResults(cfg.ResultsDB, cfg.ResultsLabel, cfg, strings.Join(described, ", "), stats, leases); err != nil {
+			slog.Error("results not saved", "error", err)
+		} else {
+			fmt.Printf("Results saved to %s as run %s\n", cfg.ResultsDB, runID)
+		}
+	}
+	if err := state.save(); err != nil {
+		slog.Error("run state not saved", "error", err)
+	}
+	if schedule.holdUntilEnd() {
+		renewer.stop()
+		ctl.teardown()
+		// Nothing is left for -resume to adopt.
+		if cfg.StateFile != "" {
+			os.Remove(cfg.StateFile)
+		}
+	}
+	flushTraces()
 
-	select {} // Keep the program running
+	code := exitCode(runError(stats, budget, stopErr))
+	audit.finish(code)
+	if cfg.Wait {
+		// The control API, metrics and clients stay up until Ctrl-C.
+		fmt.Printf("Run finished (exit status %d); waiting as -wait asks, Ctrl-C to exit\n", code)
+		select {}
+	}
+	os.Exit(code)
 }
 
-// buildImage builds a Docker image from the specified directory (which must contain a Dockerfile)
-// and tags it with the provided imageName.
-func buildImage(cli *client.Client, dockerfileDir, imageName string) error {
-	ctx := context.Background()
-	// Create a tar archive of the Dockerfile directory.
-	buildContext, err := archive.TarWithOptions(dockerfileDir, &archive.TarOptions{})
-	if err != nil {
-		return err
+// runCleanup tears down a previous run and exits non-zero if any step failed.
+// Cleanup needs no authorization, but what it removes is recorded.
+func runCleanup(cfg Config, host *hostShell) {
+	var t *teardown
+	if cfg.Mode == modeK8s {
+		kube, err := newKubectl(cfg)
+		if err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
+			os.Exit(exitRuntime)
+		}
+		t = &teardown{host: host, kube: kube}
+	} else {
+		cli, _, err := newContainerRuntime(cfg)
+		if err != nil {
+			fmt.Printf("[ERROR] Error creating %s client: %v\n", cfg.Runtime, err)
+			os.Exit(exitRuntime)
+		}
+		t = newTeardown(cli, host, cfg.NetworkName)
+		t.pruneImages = cfg.PruneImages
 	}
-	buildOptions := types.ImageBuildOptions{
-		Tags:       []string{imageName},
-		Dockerfile: "Dockerfile",
-		Remove:     true,
+	var err error
+	if audit, err = openAuditLog(cfg.AuditLog, cfg.EngagementID, cfg.Operator); err != nil {
+		slog.Warn("cleanup is not recorded in the audit log", "error", err)
 	}
-	response, err := cli.ImageBuild(ctx, buildContext, buildOptions)
-	if err != nil {
-		return err
+	audit.record("cleanup_started", map[string]any{"mode": cfg.Mode, "network": cfg.NetworkName, "host": host.String()})
+	fmt.Println("=== Cleaning Up ===")
+	if !printTeardownReport(t.run(context.Background())) {
+		audit.finish(exitFailed)
+		os.Exit(exitFailed)
+	}
+	audit.finish(exitOK)
+	// Nothing is left for -resume to adopt.
+	if cfg.StateFile != "" {
+		os.Remove(cfg.StateFile)
+	}
+}
+
+// launchSpec describes a single client container to launch.
+type launchSpec struct {
+	Image string
+	// Network is the Docker network the container is attached to.
+	Network string
+	// MAC, when set, is assigned to the container's endpoint instead of a
+	// Docker-generated address.
+	MAC net.HardwareAddr
+	// SharedMAC means the endpoint keeps the parent's MAC (ipvlan), so MAC
+	// is sent as the DHCP client identifier instead.
+	SharedMAC bool
+	// RequestedIP, when set, is passed to the container so its DHCP client
+	// asks for this address (option 50).
+	RequestedIP net.IP
+	// Profile and Hostname make the client's DHCP fingerprint match a
+	// device class.
+	Profile  *deviceProfile
+	Hostname string
+	// DHCPv6 makes the client request an IA_NA address with DHCPv6 instead
+	// of an IPv4 lease.
+	DHCPv6 bool
+	// DNS and NTP, when set, replace the servers offered by DHCP so client
+	// payloads keep working on networks with deliberately broken resolvers.
+	DNS []string
+	NTP []string
+	// DHCPTimeout bounds how long the client may take to obtain a lease,
+	// checked for every DHCPPollInterval.
+	DHCPTimeout      time.Duration
+	DHCPPollInterval time.Duration
+	// Limits caps the container's memory and CPU.
+	Limits containerLimits
+	// Command, when set, replaces the generated DHCP client command.
+	// Otherwise DHCPClient picks the client it runs and Interface the
+	// interface it runs on.
+	Command    []string
+	DHCPClient string
+	Interface  string
+	// ClientID is the client identifier (option 61) to send, or nil for
+	// the client's default; NoClientID sends none at all.
+	ClientID   []byte
+	NoClientID bool
+	// Labels are put on the container.
+	Labels map[string]string
+	// Logs, when set, keeps the container's output.
+	Logs *containerLogs
+}
+
+// env returns the environment variables the client image's entrypoint reads.
+func (s launchSpec) env() []string {
+	var env []string
+	if s.RequestedIP != nil {
+		env = append(env, "IPOCALYPSE_REQUESTED_IP="+s.RequestedIP.String())
+	}
+	if s.SharedMAC {
+		// Broadcast replies, since unicast ones would go to the shared MAC
+		// before the client has an address ipvlan can deliver them to.
+		env = append(env, "IPOCALYPSE_BROADCAST=1")
+	}
+	if s.ClientID != nil {
+		env = append(env, "IPOCALYPSE_CLIENT_ID="+formatClientID(s.ClientID))
+	}
+	if s.NoClientID {
+		env = append(env, "IPOCALYPSE_NO_CLIENT_ID=1")
+	}
+	if s.DHCPv6 {
+		env = append(env, "IPOCALYPSE_DHCPV6=1")
+	}
+	if len(s.DNS) > 0 {
+		env = append(env, "IPOCALYPSE_DNS="+strings.Join(s.DNS, ","))
 	}
-	defer response.Body.Close()
-	_, err = io.Copy(os.Stdout, response.Body)
-	return err
+	if len(s.NTP) > 0 {
+		env = append(env, "IPOCALYPSE_NTP="+strings.Join(s.NTP, ","))
+	}
+	if s.DHCPClient != "" && s.DHCPClient != dhcpClientAuto {
+		env = append(env, "IPOCALYPSE_DHCP_CLIENT="+s.DHCPClient)
+	}
+	if s.Interface != "" {
+		env = append(env, "IPOCALYPSE_INTERFACE="+s.Interface)
+	}
+	env = append(env, profileEnv(s.Profile, s.Hostname)...)
+	return env
+}
+
+// launchResult identifies a launched client container, its MAC and its
+// leased address.
+type launchResult struct {
+	ID        string
+	MAC       string
+	IP        string
+	LeaseTime time.Duration
+	Server    string
+	// ClientID is the client identifier sent, when known.
+	ClientID string
+	// DNS are the DNS servers the lease offers, when known.
+	DNS []string
+}
+
+// shortID abbreviates a container ID the way the Docker CLI does.
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
 }
 
-// launchContainer creates and starts a container using the given image and attaches it to the specified network.
-// The container's command starts a DHCP client (assuming "dhclient" is installed) on its eth0 interface and then sleeps.
-func launchContainer(cli *client.Client, imageName string) (string, error) {
-	ctx := context.Background()
+// launchContainer creates and starts a container using the given image and attaches it to the spec's network.
+// Unless the image's manifest sets a command, the container runs the spec's DHCP client (see clientScript).
+func launchContainer(ctx context.Context, cli containerRuntime, spec launchSpec) (launchResult, error) {
+	cmd := spec.Command
+	if len(cmd) == 0 {
+		cmd = []string{"sh", "-c", clientScript}
+	}
 	containerConfig := &container.Config{
-		Image: imageName,
-		Cmd:   []string{"sh", "-c", "dhclient eth0 && sleep 3600"},
+		Image:  spec.Image,
+		Cmd:    cmd,
+		Env:    spec.env(),
+		Labels: spec.Labels,
 	}
-	hostConfig := &container.HostConfig{}
+	hostConfig := &container.HostConfig{DNS: spec.DNS}
+	spec.Limits.apply(hostConfig)
 
 	// Specify the network configuration
+	endpoint := &network.EndpointSettings{NetworkID: spec.Network}
+	if !spec.SharedMAC {
+		endpoint.MacAddress = spec.MAC.String()
+	}
 	networkingConfig := &network.NetworkingConfig{
-		EndpointsConfig: map[string]*network.EndpointSettings{
-			"ipocalypse_net": {
-				NetworkID: "ipocalypse_net",
-			},
-		},
+		EndpointsConfig: map[string]*network.EndpointSettings{spec.Network: endpoint},
 	}
 
-	resp, err := cli.ContainerCreate(ctx, containerConfig, hostConfig, networkingConfig, nil, "")
+	spanCtx, span := startSpan(ctx, "container.create")
+	resp, err := cli.ContainerCreate(spanCtx, containerConfig, hostConfig, networkingConfig, clientPlatform, "")
+	endSpan(span, err)
 	if err != nil {
-		return "", err
+		return launchResult{}, fmt.Errorf("%w: %w", ErrContainerCreate, createError(ctx, cli, spec.Network, err))
 	}
-	if err := cli.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
-		return resp.ID, err
-	}
-	// Wait a short period to allow DHCP to assign an IP.
-	time.Sleep(10 * time.Second)
-	inspect, err := cli.ContainerInspect(ctx, resp.ID)
+	spanCtx, span = startSpan(ctx, "container.start", "container", shortID(resp.ID))
+	err = cli.ContainerStart(spanCtx, resp.ID, container.StartOptions{})
+	endSpan(span, err)
 	if err != nil {
-		return resp.ID, err
+		return launchResult{ID: resp.ID}, fmt.Errorf("%w: %w", ErrContainerStart, runtimeError(err))
 	}
-	ep, ok := inspect.NetworkSettings.Networks["ipocalypse_net"]
-	if !ok || ep.IPAddress == "" {
-		// Remove the container if no IP was assigned.
+	events.emit("container_launched", map[string]any{"container": shortID(resp.ID), "image": spec.Image, "network": spec.Network, "hostname": spec.Hostname})
+	spanCtx, span = startSpan(ctx, "dhcp.wait", "container", shortID(resp.ID))
+	err = waitForLease(spanCtx, cli, resp.ID, spec.DHCPTimeout, spec.DHCPPollInterval)
+	endSpan(span, err)
+	if err != nil {
+		// The run may be stopping; the container goes all the same.
+		ctx := context.WithoutCancel(ctx)
+		spec.Logs.collect(ctx, resp.ID)
 		cli.ContainerRemove(ctx, resp.ID, container.RemoveOptions{Force: true})
-		return resp.ID, fmt.Errorf("container did not receive an IP address")
+		return launchResult{ID: resp.ID}, runtimeError(err)
 	}
-	return resp.ID, nil
-}
-
-// isNoIPError returns true if the error message indicates that no IP address was assigned.
-func isNoIPError(err error) bool {
-	if err == nil {
-		return false
+	spanCtx, span = startSpan(ctx, "container.inspect", "container", shortID(resp.ID))
+	inspect, err := cli.ContainerInspect(spanCtx, resp.ID)
+	if err != nil {
+		endSpan(span, err)
+		return launchResult{ID: resp.ID}, runtimeError(err)
 	}
-	return strings.Contains(err.Error(), "did not receive an IP address")
-}
-
-func setupHostMacvlanInterface(parent, ipWithCIDR, dockerSubnet string) error {
-	// Remove existing macvlan0 interface if it exists
-	if err := exec.Command("bash", "-c", "ip link show macvlan0").Run(); err == nil {
-		if err := exec.Command("bash", "-c", "ip link delete macvlan0").Run(); err != nil {
-			return fmt.Errorf("failed to delete existing macvlan0: %v", err)
-		}
+	// Clients that gave up on DHCP self-assign a link-local address.
+	ip := apipaAddress(spanCtx, cli, resp.ID)
+	span.End()
+	if ip != nil {
+		spec.Logs.collect(ctx, resp.ID)
+		cli.ContainerRemove(ctx, resp.ID, container.RemoveOptions{Force: true})
+		return launchResult{ID: resp.ID}, fmt.Errorf("container %w (%w %s)", ErrNoLease, ErrAPIPA, ip)
 	}
-
-	// Create the macvlan interface exactly as in setup_network.sh
-	createCmd := fmt.Sprintf("ip link add macvlan0 link %s type macvlan mode bridge", parent)
-	if err := exec.Command("bash", "-c", createCmd).Run(); err != nil {
-		return fmt.Errorf("failed to create macvlan0 interface: %v", err)
+	ep, ok := inspect.NetworkSettings.Networks[spec.Network]
+	var result launchResult
+	if ok {
+		spanCtx, span = startSpan(ctx, "lease.read", "container", shortID(resp.ID))
+		// Docker's IPAM address of a macvlan endpoint is not the one the
+		// DHCP server handed out; the client's lease file records that.
+		result.IP, result.LeaseTime, result.Server, result.DNS = containerLease(spanCtx, cli, resp.ID)
+		span.End()
 	}
-
-	// Add IP address to macvlan0
-	addrCmd := fmt.Sprintf("ip addr add %s dev macvlan0", ipWithCIDR)
-	if err := exec.Command("bash", "-c", addrCmd).Run(); err != nil {
-		return fmt.Errorf("failed to assign IP address to macvlan0: %v", err)
+	if result.IP == "" {
+		// Remove the container if no IP was assigned.
+		spec.Logs.collect(ctx, resp.ID)
+		cli.ContainerRemove(ctx, resp.ID, container.RemoveOptions{Force: true})
+		return launchResult{ID: resp.ID}, fmt.Errorf("container %w", ErrNoLease)
 	}
-
-	// Bring up the interface
-	if err := exec.Command("bash", "-c", "ip link set macvlan0 up").Run(); err != nil {
-		return fmt.Errorf("failed to bring up macvlan0: %v", err)
+	spec.Logs.follow(resp.ID)
+	result.ID, result.MAC, result.ClientID = resp.ID, ep.MacAddress, formatClientID(spec.ClientID)
+	if spec.SharedMAC {
+		// Every ipvlan endpoint reports the parent's MAC; the client is
+		// known to the server by the MAC in its client identifier.
+		result.MAC = spec.MAC.String()
 	}
+	return result, nil
+}
 
-	// Add route for Docker subnet
-	routeCmd := fmt.Sprintf("ip route add %s dev macvlan0", dockerSubnet)
-	if err := exec.Command("bash", "-c", routeCmd).Run(); err != nil {
-		fmt.Printf("Warning: failed to add route (%v)\n", err)
+// waitForLease returns as soon as the container's DHCP client has recorded a
+// lease, checking every poll, or once timeout passes without one; the caller
+// then inspects the container to decide how the attempt went. A container
+// that exits while waiting is an error of its own, since its client never
+// got to finish, and so is ctx ending.
+func waitForLease(ctx context.Context, cli containerRuntime, containerID string, timeout, poll time.Duration) error {
+	deadline := clock.After(timeout)
+	for {
+		if containerHasLease(ctx, cli, containerID) {
+			return nil
+		}
+		inspect, err := cli.ContainerInspect(ctx, containerID)
+		if err != nil {
+			return err
+		}
+		if inspect.State != nil && !inspect.State.Running {
+			return fmt.Errorf("container exited with code %d before DHCP completed", inspect.State.ExitCode)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline:
+			return nil
+		case <-clock.After(poll):
+		}
 	}
-
-	return nil
 }
 
 func getIpocalypseDirs() ([]string, error) {
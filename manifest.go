@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// manifestFile is the optional per-image manifest read from each Dockerfile
+// directory.
+const manifestFile = "ipocalypse.yaml"
+
+// imageManifest describes image-specific behaviour beyond the Dockerfile.
+type imageManifest struct {
+	// Profile names the device profile every container of this image
+	// presents, overriding -profiles.
+	Profile     string       `yaml:"profile"`
+	HealthProbe *healthProbe `yaml:"health_probe"`
+
+	// Dockerfile is the image's Dockerfile within its directory,
+	// overriding -dockerfile.
+	Dockerfile string `yaml:"dockerfile"`
+
+	// Command replaces the generated DHCP client command, for images that
+	// start their client their own way. DHCPClient and Interface override
+	// -dhcp-client and -client-interface for the generated one.
+	Command    []string `yaml:"command"`
+	DHCPClient string   `yaml:"dhcp_client"`
+	Interface  string   `yaml:"interface"`
+
+	// Role names what the image's containers do in the topology, e.g.
+	// "rogue-server". With Count, exactly that many containers of the image
+	// are started before any client, after the roles listed in After.
+	// Images without a count are clients, launched by the workers.
+	Role  string   `yaml:"role"`
+	Count int      `yaml:"count"`
+	After []string `yaml:"after"`
+}
+
+// healthProbe is a post-lease check confirming the client's payload is
+// running. Exactly one of Command, TCPPort or HTTPPath should be set.
+type healthProbe struct {
+	// Command is executed inside the container; exit code 0 means healthy.
+	Command []string `yaml:"command"`
+	// TCPPort is dialled on the container's leased address.
+	TCPPort int `yaml:"tcp_port"`
+	// HTTPPath is requested from the container's leased address on
+	// HTTPPort (default 80); any 2xx or 3xx status means healthy.
+	HTTPPath string `yaml:"http_path"`
+	HTTPPort int    `yaml:"http_port"`
+
+	Timeout  time.Duration `yaml:"timeout"`
+	Retries  int           `yaml:"retries"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// loadManifest reads the manifest in dir. A missing manifest is not an error
+// and yields an empty manifest.
+func loadManifest(dir string) (*imageManifest, error) {
+	manifest := &imageManifest{}
+	data, err := os.ReadFile(filepath.Join(dir, manifestFile))
+	if os.IsNotExist(err) {
+		return manifest, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", manifestFile, err)
+	}
+	if err := yaml.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse %s in %s: %v", manifestFile, dir, err)
+	}
+	if manifest.Profile != "" {
+		if _, err := lookupProfile(manifest.Profile); err != nil {
+			return nil, fmt.Errorf("%s in %s: %v", manifestFile, dir, err)
+		}
+	}
+	if manifest.DHCPClient != "" {
+		if err := checkDHCPClient(manifest.DHCPClient); err != nil {
+			return nil, fmt.Errorf("%s in %s: %v", manifestFile, dir, err)
+		}
+	}
+	switch {
+	case manifest.Count < 0:
+		return nil, fmt.Errorf("count in %s must not be negative", dir)
+	case manifest.Count > 0 && manifest.Role == "":
+		return nil, fmt.Errorf("count in %s needs a role", dir)
+	case len(manifest.After) > 0 && manifest.Count == 0:
+		return nil, fmt.Errorf("after in %s applies to roles with a count; clients always start last", dir)
+	}
+	if p := manifest.HealthProbe; p != nil {
+		kinds := 0
+		for _, set := range []bool{len(p.Command) > 0, p.TCPPort > 0, p.HTTPPath != ""} {
+			if set {
+				kinds++
+			}
+		}
+		if kinds != 1 {
+			return nil, fmt.Errorf("health_probe in %s must set exactly one of command, tcp_port or http_path", dir)
+		}
+	}
+	return manifest, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the lease acquisition
+// latency histogram. Container launches include image start-up and the DHCP
+// wait, so the buckets reach into minutes.
+var latencyBuckets = []float64{0.1, 0.5, 1, 2, 5, 10, 15, 20, 30, 45, 60, 120}
+
+// serveMetrics exposes Prometheus metrics for the run on addr at /metrics.
+func serveMetrics(addr string, stats *runStats) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		stats.writeMetrics(w)
+	})
+	fmt.Printf("Serving Prometheus metrics on http://%s/metrics\n", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			slog.Error("metrics endpoint stopped", "error", err)
+		}
+	}()
+}
+
+// writeMetrics renders the run's counters in the Prometheus text format.
+func (s *runStats) writeMetrics(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	metric("ipocalypse_clients_launched_total", "counter", "Clients (containers or raw identities) launched.")
+	fmt.Fprintf(w, "ipocalypse_clients_launched_total %d\n", s.launched)
+
+	metric("ipocalypse_leases_acquired_total", "counter", "DHCP leases acquired.")
+	fmt.Fprintf(w, "ipocalypse_leases_acquired_total %d\n", s.leased)
+
+	metric("ipocalypse_launch_failures_total", "counter", "Launches that did not end with a lease, by failure type.")
+	kinds := make([]string, 0, len(s.failures))
+	for kind := range s.failures {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Fprintf(w, "ipocalypse_launch_failures_total{type=%q} %d\n", kind, s.failures[kind])
+	}
+
+	metric("ipocalypse_apipa_clients_total", "counter", "Clients that fell back to a 169.254.0.0/16 address.")
+	fmt.Fprintf(w, "ipocalypse_apipa_clients_total %d\n", len(s.apipa))
+
+	metric("ipocalypse_lease_acquisition_seconds", "histogram", "Time from launch to lease acquisition.")
+	var sum float64
+	counts := make([]int, len(latencyBuckets))
+	for _, latency := range s.latencies {
+		secs := latency.Seconds()
+		sum += secs
+		for i, bound := range latencyBuckets {
+			if secs <= bound {
+				counts[i]++
+			}
+		}
+	}
+	for i, bound := range latencyBuckets {
+		fmt.Fprintf(w, "ipocalypse_lease_acquisition_seconds_bucket{le=\"%g\"} %d\n", bound, counts[i])
+	}
+	fmt.Fprintf(w, "ipocalypse_lease_acquisition_seconds_bucket{le=\"+Inf\"} %d\n", len(s.latencies))
+	fmt.Fprintf(w, "ipocalypse_lease_acquisition_seconds_sum %g\n", sum)
+	fmt.Fprintf(w, "ipocalypse_lease_acquisition_seconds_count %d\n", len(s.latencies))
+
+	if s.capacity > 0 {
+		metric("ipocalypse_pool_utilization_ratio", "gauge", "Estimated share of the pool held by ipocalypse clients.")
+		fmt.Fprintf(w, "ipocalypse_pool_utilization_ratio %g\n", float64(s.leased)/float64(s.capacity))
+	}
+
+	metric("ipocalypse_run_duration_seconds", "gauge", "Time since the run started.")
+	fmt.Fprintf(w, "ipocalypse_run_duration_seconds %g\n", clock.Since(s.start).Round(time.Millisecond).Seconds())
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// networkTarget is one -networks entry: a parent interface and an optional
+// 802.1Q VLAN ID to launch clients into from it.
+type networkTarget struct {
+	Interface string
+	VLAN      int
+	// MaxLeases and Rate are the network's own lease cap and launches per
+	// minute, on top of the run's -max-leases and -rate; 0 for none.
+	MaxLeases int
+	Rate      float64
+}
+
+// parseNetworkTargets parses -networks entries of the form iface or
+// iface:vlan, e.g. eth1 or eth0:120, optionally followed by =max or
+// =max@rate to give the network a lease cap and launch rate of its own, e.g.
+// eth0:40=50 or eth0:40=0@30.
+func parseNetworkTargets(entries []string) ([]networkTarget, error) {
+	var targets []networkTarget
+	seen := make(map[networkTarget]bool)
+	for _, entry := range entries {
+		network, limits, limited := strings.Cut(entry, "=")
+		iface, vlan, tagged := strings.Cut(network, ":")
+		target := networkTarget{Interface: iface}
+		if iface == "" {
+			return nil, fmt.Errorf("invalid -networks entry %q: missing interface", entry)
+		}
+		if tagged {
+			id, err := strconv.Atoi(vlan)
+			if err != nil || id < 1 || id > 4094 {
+				return nil, fmt.Errorf("invalid -networks entry %q: VLAN IDs range from 1 to 4094", entry)
+			}
+			target.VLAN = id
+		}
+		if seen[target] {
+			return nil, fmt.Errorf("-networks lists %q twice", network)
+		}
+		seen[target] = true
+		if limited {
+			maxLeases, rate, paced := strings.Cut(limits, "@")
+			n, err := strconv.Atoi(maxLeases)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid -networks entry %q: the lease cap after = is a number of leases, 0 for none", entry)
+			}
+			target.MaxLeases = n
+			if paced {
+				r, err := strconv.ParseFloat(rate, 64)
+				if err != nil || r <= 0 {
+					return nil, fmt.Errorf("invalid -networks entry %q: the rate after @ is a positive number of launches per minute", entry)
+				}
+				target.Rate = r
+			}
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// networkNames returns the Docker network and host interface names for the
+// i-th of count target networks on parent. A single network is the -network
+// name itself with macvlan0.
+func networkNames(base string, i, count int, parent string) (name, link string) {
+	if count == 1 {
+		return base, hostLink
+	}
+	return base + "_" + parent, fmt.Sprintf("macvlan%d", i)
+}
+
+// targetNetwork is one network under attack with its own address plan and
+// statistics.
+type targetNetwork struct {
+	*NetworkConfig
+	planner *addressPlanner
+	stats   *runStats
+	// fingerprints is nil when -fingerprint is off.
+	fingerprints *fingerprinter
+}
+
+// networkSet spreads launches across the target networks and tracks which of
+// them have run out of addresses or met their own lease cap.
+type networkSet struct {
+	mu       sync.Mutex
+	networks []*targetNetwork
+	next     int
+	// budget holds the caps of networks that have one; nil when none do.
+	budget *leaseBudget
+}
+
+// pick returns the network for the next launch, taking the networks that
+// still have addresses and are below their cap in turn. Once all of them
+// are done it cycles through every network, so a -reserve-free run keeps
+// retrying its pool.
+func (s *networkSet) pick() *targetNetwork {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for range s.networks {
+		n := s.networks[s.next]
+		s.next = (s.next + 1) % len(s.networks)
+		if !s.done(n) {
+			return n
+		}
+	}
+	n := s.networks[s.next]
+	s.next = (s.next + 1) % len(s.networks)
+	return n
+}
+
+// exhaust marks n as out of addresses and reports whether every network now
+// is, or has met its cap.
+func (s *networkSet) exhaust(n *targetNetwork) bool {
+	n.stats.markExhausted()
+	return s.finished()
+}
+
+// done reports whether n takes no more launches: its pool is exhausted or
+// its own lease cap is met.
+func (s *networkSet) done(n *targetNetwork) bool {
+	return n.stats.isExhausted() || s.budget.networkReached(n.Name)
+}
+
+// finished reports whether every network is done.
+func (s *networkSet) finished() bool {
+	for _, n := range s.networks {
+		if !s.done(n) {
+			return false
+		}
+	}
+	return true
+}
+
+// configs returns the network configurations of the set.
+func (s *networkSet) configs() []*NetworkConfig {
+	configs := make([]*NetworkConfig, len(s.networks))
+	for i, n := range s.networks {
+		configs[i] = n.NetworkConfig
+	}
+	return configs
+}
+
+// capacity returns the combined pool size of the networks.
+func (s *networkSet) capacity() int {
+	total := 0
+	for _, n := range s.networks {
+		total += poolCapacity(n.NetworkConfig)
+	}
+	return total
+}
+
+// printSummary writes the per-network results of a multi-network run.
+func (s *networkSet) printSummary() {
+	if len(s.networks) < 2 {
+		return
+	}
+	fmt.Println("=== Per-Network Results ===")
+	for _, n := range s.networks {
+		launched, leased, _ := n.stats.launchRate()
+		fmt.Printf("  %-28s %-18s %5d leases from %5d clients  %s\n", n.Name, n.Subnet, leased, launched, s.outcome(n))
+	}
+}
+
+// outcome describes how launching on n ended.
+func (s *networkSet) outcome(n *targetNetwork) string {
+	if after, ok := n.stats.exhaustedAfter(); ok {
+		return "exhausted in " + after.Round(time.Second).String()
+	}
+	if s.budget.networkReached(n.Name) {
+		maxLeases, _ := s.budget.network(n.Name).limits()
+		return fmt.Sprintf("stopped at its cap of %d leases", maxLeases)
+	}
+	return "not exhausted"
+}
+
+// networkSection is the report section of one network of a multi-network
+// run.
+type networkSection struct {
+	Name, Subnet string
+	Rows         []reportRow
+}
+
+// reportSections returns the report sections of the networks of a
+// multi-network run, none for a single network.
+func (s *networkSet) reportSections(leases *leaseTable) []networkSection {
+	if len(s.networks) < 2 {
+		return nil
+	}
+	held := make(map[string]int)
+	for _, r := range leases.held() {
+		held[r.Network]++
+	}
+	sections := make([]networkSection, 0, len(s.networks))
+	for _, n := range s.networks {
+		launched, leased, _ := n.stats.launchRate()
+		budget := "the run's -max-leases and -rate"
+		if nb := s.budget.network(n.Name); nb != nil {
+			budget = nb.String()
+		}
+		sections = append(sections, networkSection{
+			Name:   n.Name,
+			Subnet: n.Subnet.String(),
+			Rows: []reportRow{
+				{"Outcome", s.outcome(n)},
+				{"Parent interface", n.Parent},
+				{"Lease budget", budget},
+				{"Clients launched", fmt.Sprint(launched)},
+				{"Leases acquired", fmt.Sprint(leased)},
+				{"Leases held at the end", fmt.Sprint(held[n.Name])},
+			},
+		})
+	}
+	return sections
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseNetworkTargets(t *testing.T) {
+	tests := []struct {
+		entries []string
+		want    []networkTarget
+		wantErr bool
+	}{
+		{[]string{"eth1"}, []networkTarget{{Interface: "eth1"}}, false},
+		{[]string{"eth0:30", "eth0:40", "eth1"}, []networkTarget{{Interface: "eth0", VLAN: 30}, {Interface: "eth0", VLAN: 40}, {Interface: "eth1"}}, false},
+		{[]string{"eth0:1", "eth0:4094"}, []networkTarget{{Interface: "eth0", VLAN: 1}, {Interface: "eth0", VLAN: 4094}}, false},
+		{[]string{"eth0:0"}, nil, true},
+		{[]string{"eth0:4095"}, nil, true},
+		{[]string{"eth0:vlan30"}, nil, true},
+		{[]string{":30"}, nil, true},
+		{[]string{"eth0:30", "eth0:30"}, nil, true},
+		{[]string{"eth0:30", "eth0:40=50"}, []networkTarget{{Interface: "eth0", VLAN: 30}, {Interface: "eth0", VLAN: 40, MaxLeases: 50}}, false},
+		{[]string{"eth0:40=50@12.5", "eth1=0@30"}, []networkTarget{{Interface: "eth0", VLAN: 40, MaxLeases: 50, Rate: 12.5}, {Interface: "eth1", Rate: 30}}, false},
+		{[]string{"eth0:30=5", "eth0:30"}, nil, true},
+		{[]string{"eth0:40=x"}, nil, true},
+		{[]string{"eth0:40=-1"}, nil, true},
+		{[]string{"eth0:40=5@0"}, nil, true},
+		{[]string{"eth0:40=5@"}, nil, true},
+		{[]string{"eth0:40=@30"}, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseNetworkTargets(tt.entries)
+		if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseNetworkTargets(%q) = %v, %v; want %v, error %v", tt.entries, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestNetworkNames(t *testing.T) {
+	tests := []struct {
+		i, count           int
+		parent             string
+		wantName, wantLink string
+	}{
+		{0, 1, "eth0", "ipocalypse_network", hostLink},
+		{0, 2, "eth0.30", "ipocalypse_network_eth0.30", "macvlan0"},
+		{1, 2, "eth1", "ipocalypse_network_eth1", "macvlan1"},
+	}
+	for _, tt := range tests {
+		name, link := networkNames("ipocalypse_network", tt.i, tt.count, tt.parent)
+		if name != tt.wantName || link != tt.wantLink {
+			t.Errorf("networkNames(%d of %d on %s) = %s, %s; want %s, %s", tt.i, tt.count, tt.parent, name, link, tt.wantName, tt.wantLink)
+		}
+	}
+}
+
+// testNetworkSet returns a set of networks named after subnets.
+func testNetworkSet(subnets ...string) *networkSet {
+	s := &networkSet{}
+	for _, subnet := range subnets {
+		_, ipnet, _ := net.ParseCIDR(subnet)
+		s.networks = append(s.networks, &targetNetwork{
+			NetworkConfig: &NetworkConfig{Name: subnet, Subnet: ipnet},
+			stats:         newRunStats(),
+		})
+	}
+	return s
+}
+
+func TestNetworkSetPick(t *testing.T) {
+	tests := []struct {
+		name      string
+		exhausted []int
+		// capped networks have met a cap of one lease of their own.
+		capped  []int
+		want    []string
+		wantAll bool
+	}{
+		{
+			name: "in turn",
+			want: []string{"10.0.30.0/24", "10.0.40.0/24", "10.0.50.0/24", "10.0.30.0/24"},
+		},
+		{
+			name:      "skips an exhausted network",
+			exhausted: []int{1},
+			want:      []string{"10.0.30.0/24", "10.0.50.0/24", "10.0.30.0/24", "10.0.50.0/24"},
+		},
+		{
+			name:      "one left",
+			exhausted: []int{0, 2},
+			want:      []string{"10.0.40.0/24", "10.0.40.0/24"},
+		},
+		{
+			name:   "skips a network at its cap",
+			capped: []int{0},
+			want:   []string{"10.0.40.0/24", "10.0.50.0/24", "10.0.40.0/24"},
+		},
+		{
+			name:      "rest exhausted or at their cap",
+			capped:    []int{0},
+			exhausted: []int{1, 2},
+			want:      []string{"10.0.30.0/24", "10.0.40.0/24", "10.0.50.0/24"},
+			wantAll:   true,
+		},
+		{
+			// A -reserve-free run keeps retrying every pool.
+			name:      "all exhausted",
+			exhausted: []int{0, 1, 2},
+			want:      []string{"10.0.30.0/24", "10.0.40.0/24", "10.0.50.0/24"},
+			wantAll:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testNetworkSet("10.0.30.0/24", "10.0.40.0/24", "10.0.50.0/24")
+			s.budget = &leaseBudget{}
+			for _, i := range tt.capped {
+				if err := s.budget.limitNetwork(s.networks[i].Name, 1, 0); err != nil {
+					t.Fatal(err)
+				}
+				s.budget.network(s.networks[i].Name).adopt(1)
+			}
+			var all bool
+			for _, i := range tt.exhausted {
+				all = s.exhaust(s.networks[i])
+			}
+			if all != tt.wantAll {
+				t.Errorf("exhaust() reported all exhausted = %v, want %v", all, tt.wantAll)
+			}
+			var got []string
+			for range tt.want {
+				got = append(got, s.pick().Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("picked %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNetworkSetCapacity(t *testing.T) {
+	s := testNetworkSet("10.0.30.0/24", "10.0.40.0/28", "10.0.50.0/30")
+	// 252 + 12 + 0: the network, broadcast, gateway and host addresses are
+	// not leased.
+	if got := s.capacity(); got != 264 {
+		t.Errorf("capacity() = %d, want 264", got)
+	}
+	if got := s.configs(); len(got) != 3 || got[1] != s.networks[1].NetworkConfig {
+		t.Errorf("configs() = %v", got)
+	}
+}
+
+func TestNetworkSetReportSections(t *testing.T) {
+	useManualClock(t)
+	if got := testNetworkSet("10.0.30.0/24").reportSections(&leaseTable{}); got != nil {
+		t.Errorf("single network got report sections %v", got)
+	}
+	s := testNetworkSet("10.0.30.0/24", "10.0.40.0/24")
+	s.budget = &leaseBudget{}
+	if err := s.budget.limitNetwork("10.0.40.0/24", 1, 30); err != nil {
+		t.Fatal(err)
+	}
+	s.budget.network("10.0.40.0/24").adopt(1)
+	leases := &leaseTable{}
+	leases.add(leaseRecord{IP: "10.0.40.7", Network: "10.0.40.0/24"})
+	sections := s.reportSections(leases)
+	if len(sections) != 2 {
+		t.Fatalf("got %d report sections, want 2", len(sections))
+	}
+	rows := make(map[string]string)
+	for _, row := range sections[1].Rows {
+		rows[row.Label] = row.Value
+	}
+	want := map[string]string{
+		"Outcome":                "stopped at its cap of 1 leases",
+		"Lease budget":           "1 leases at up to 30.0 launches/min",
+		"Leases held at the end": "1",
+	}
+	for label, value := range want {
+		if rows[label] != value {
+			t.Errorf("%s: %s = %q, want %q", sections[1].Name, label, rows[label], value)
+		}
+	}
+	if sections[0].Rows[2].Value != "the run's -max-leases and -rate" {
+		t.Errorf("network without a budget of its own shows %q", sections[0].Rows[2].Value)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// netnsPrefix starts the name of every network namespace a run creates,
+	// so cleanup finds them.
+	netnsPrefix = "ipocalypse-"
+	// netnsStateDir holds each namespace's dhclient configuration, lease
+	// and PID files.
+	netnsStateDir = "/run/ipocalypse"
+)
+
+// netnsEngine gives each client a bare network namespace with a macvlan
+// interface on the parent and runs the host's dhclient in it. Clients are
+// real kernel interfaces that answer ARP and renew their leases like
+// containers, without a container runtime in the way.
+type netnsEngine struct {
+	parent  string
+	timeout time.Duration
+
+	mu       sync.Mutex
+	acks     int
+	failures int
+	held     int
+}
+
+var netnsCapabilities = engineCapabilities{}
+
+func newNetnsEngine(parent string, timeout time.Duration) (*netnsEngine, error) {
+	if _, err := exec.LookPath("dhclient"); err != nil {
+		return nil, fmt.Errorf("the netns engine runs the host's dhclient, which was not found: install isc-dhcp-client")
+	}
+	if isWireless(localHost, parent) {
+		return nil, fmt.Errorf("parent interface %s is wireless and macvlan clients cannot obtain leases over Wi-Fi; use -mode=raw, or docker mode with -driver=ipvlan", parent)
+	}
+	if err := os.MkdirAll(netnsStateDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", netnsStateDir, err)
+	}
+	return &netnsEngine{parent: parent, timeout: timeout}, nil
+}
+
+func (e *netnsEngine) Name() string                     { return modeNetns }
+func (e *netnsEngine) Capabilities() engineCapabilities { return netnsCapabilities }
+
+// netnsNames returns the namespace and interface names of the client with
+// mac. The interface name fits the kernel's 15-character limit.
+func netnsNames(mac net.HardwareAddr) (ns, link string) {
+	ns = netnsPrefix + strings.ReplaceAll(mac.String(), ":", "")
+	return ns, netnsLink(ns)
+}
+
+// netnsLink returns the name of the client interface in namespace ns.
+func netnsLink(ns string) string {
+	return "ipo" + strings.TrimPrefix(ns, netnsPrefix)
+}
+
+// netnsFile returns the path of one of a namespace's state files.
+func netnsFile(ns, ext string) string {
+	return filepath.Join(netnsStateDir, ns+"."+ext)
+}
+
+// dhclientArgs returns the dhclient options that keep a namespace's client
+// on its own configuration, lease and PID files.
+func dhclientArgs(ns string) []string {
+	return []string{"-cf", netnsFile(ns, "conf"), "-lf", netnsFile(ns, "leases"), "-pf", netnsFile(ns, "pid")}
+}
+
+// netnsRun runs a command on the host, returning its output in the error.
+func netnsRun(name string, args ...string) error {
+	if out, err := localHost.command(name, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Launch creates the client's namespace and interface and runs dhclient in it
+// until it holds a lease. dhclient stays behind as a daemon renewing the
+// lease.
+func (e *netnsEngine) Launch(ctx context.Context, spec launchSpec) (launchResult, error) {
+	ns, link := netnsNames(spec.MAC)
+	if err := e.create(ns, link, spec); err != nil {
+		deleteNamespace(ns)
+		return launchResult{}, err
+	}
+	args := append([]string{"netns", "exec", ns, "dhclient", "-1", "-v"}, dhclientArgs(ns)...)
+	err := localHost.command("ip", append(args, link)...).Run()
+	ip, leaseTime, server := "", time.Duration(0), ""
+	var dns []string
+	if data, readErr := os.ReadFile(netnsFile(ns, "leases")); readErr == nil {
+		ip, leaseTime, server = parseDHClientLease(string(data))
+		dns = parseDHClientDNS(string(data))
+	}
+	if err != nil || ip == "" {
+		deleteNamespace(ns)
+		e.mu.Lock()
+		e.failures++
+		e.mu.Unlock()
+		return launchResult{}, fmt.Errorf("namespace %s %w", ns, ErrNoLease)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.acks++
+	e.held++
+	return launchResult{ID: ns, MAC: spec.MAC.String(), IP: ip, LeaseTime: leaseTime, Server: server, DNS: dns}, nil
+}
+
+// create sets up the namespace with its interface and dhclient
+// configuration. The namespace gets its own resolv.conf, which `ip netns
+// exec` mounts over the host's, so dhclient-script leaves the host's alone.
+func (e *netnsEngine) create(ns, link string, spec launchSpec) error {
+	if err := os.MkdirAll(filepath.Join("/etc/netns", ns), 0755); err != nil {
+		return fmt.Errorf("failed to create namespace config directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join("/etc/netns", ns, "resolv.conf"), nil, 0644); err != nil {
+		return fmt.Errorf("failed to create namespace resolv.conf: %v", err)
+	}
+	if err := os.WriteFile(netnsFile(ns, "conf"), []byte(e.dhclientConf(spec)), 0644); err != nil {
+		return fmt.Errorf("failed to write dhclient configuration: %v", err)
+	}
+	for _, args := range [][]string{
+		{"netns", "add", ns},
+		{"link", "add", "link", e.parent, "name", link, "address", spec.MAC.String(), "type", "macvlan", "mode", "bridge"},
+		{"link", "set", link, "netns", ns},
+		{"netns", "exec", ns, "ip", "link", "set", "lo", "up"},
+		{"netns", "exec", ns, "ip", "link", "set", link, "up"},
+	} {
+		if err := netnsRun("ip", args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dhclientConf returns the dhclient configuration presenting the spec's
+// requested address and device profile, as the client images do.
+func (e *netnsEngine) dhclientConf(spec launchSpec) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "timeout %d;\n", int(e.timeout.Seconds()))
+	if spec.RequestedIP != nil {
+		fmt.Fprintf(&b, "send dhcp-requested-address %s;\n", spec.RequestedIP)
+	}
+	if spec.Hostname != "" {
+		fmt.Fprintf(&b, "send host-name %q;\n", spec.Hostname)
+	}
+	if spec.ClientID != nil {
+		fmt.Fprintf(&b, "send dhcp-client-identifier %s;\n", formatClientID(spec.ClientID))
+	}
+	if spec.Profile != nil {
+		if spec.Profile.VendorClass != "" {
+			fmt.Fprintf(&b, "send vendor-class-identifier %q;\n", spec.Profile.VendorClass)
+		}
+		fmt.Fprintf(&b, "send dhcp-parameter-request-list %s;\n", strings.ReplaceAll(paramList(spec.Profile.ParamRequest), ",", ", "))
+	}
+	return b.String()
+}
+
+// Release has the namespace's dhclient release its lease and deletes the
+// namespace.
+func (e *netnsEngine) Release(ctx context.Context, r leaseRecord) error {
+	mac, err := net.ParseMAC(r.MAC)
+	if err != nil {
+		return err
+	}
+	ns, link := netnsNames(mac)
+	args := append([]string{"netns", "exec", ns, "dhclient", "-r"}, dhclientArgs(ns)...)
+	err = netnsRun("ip", append(args, link)...)
+	deleteNamespace(ns)
+	e.mu.Lock()
+	e.held--
+	e.mu.Unlock()
+	return err
+}
+
+// Verify checks that the client's interface still carries its address.
+func (e *netnsEngine) Verify(ctx context.Context, r leaseRecord) error {
+	mac, err := net.ParseMAC(r.MAC)
+	if err != nil {
+		return err
+	}
+	ns, link := netnsNames(mac)
+	out, err := localHost.command("ip", "netns", "exec", ns, "ip", "-4", "-o", "addr", "show", "dev", link).Output()
+	if err != nil {
+		return fmt.Errorf("namespace %s is gone: %v", ns, err)
+	}
+	if !strings.Contains(string(out), " "+r.IP+"/") {
+		return fmt.Errorf("namespace %s no longer holds %s", ns, r.IP)
+	}
+	return nil
+}
+
+// Renew restarts the namespace's dhclient without releasing, so it requests
+// the lease it recorded again.
+func (e *netnsEngine) Renew(ctx context.Context, r leaseRecord) error {
+	mac, err := net.ParseMAC(r.MAC)
+	if err != nil {
+		return err
+	}
+	ns, link := netnsNames(mac)
+	for _, flag := range []string{"-x", "-1"} {
+		args := append([]string{"netns", "exec", ns, "dhclient", flag}, dhclientArgs(ns)...)
+		if err := netnsRun("ip", append(args, link)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printSummary reports the engine's lease counters.
+func (e *netnsEngine) printSummary() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	fmt.Printf("Leases obtained:   %d\n", e.acks)
+	fmt.Printf("Failed attempts:   %d\n", e.failures)
+	fmt.Printf("Namespaces held:   %d\n", e.held)
+}
+
+// deleteNamespace stops the namespace's dhclient and removes the namespace,
+// its interface and its state files.
+func deleteNamespace(ns string) {
+	if data, err := os.ReadFile(netnsFile(ns, "pid")); err == nil {
+		localHost.command("kill", strings.TrimSpace(string(data))).Run()
+	}
+	localHost.command("ip", "netns", "delete", ns).Run()
+	for _, ext := range []string{"conf", "leases", "pid"} {
+		os.Remove(netnsFile(ns, ext))
+	}
+	os.RemoveAll(filepath.Join("/etc/netns", ns))
+}
+
+// runNamespaces returns the network namespaces created by a run.
+func runNamespaces(host *hostShell) ([]string, error) {
+	out, err := host.command("ip", "netns", "list").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list network namespaces: %v", err)
+	}
+	var names []string
+	for _, line := range strings.Split(string(out), "\n") {
+		// Namespaces with an ID are listed as "name (id: 3)".
+		fields := strings.Fields(line)
+		if len(fields) > 0 && strings.HasPrefix(fields[0], netnsPrefix) {
+			names = append(names, fields[0])
+		}
+	}
+	return names, nil
+}
+
+func checkNetnsEngine(cfg Config) error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("needs root to create network namespaces")
+	}
+	if _, err := exec.LookPath("dhclient"); err != nil {
+		return fmt.Errorf("dhclient not found")
+	}
+	return localHost.command("ip", "netns", "list").Run()
+}
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/vishvananda/netlink"
+)
+
+// Network drivers the client containers and the host interface can use.
+const (
+	driverMacvlan = "macvlan"
+	// driverIpvlan runs ipvlan in l2 mode: every client shares the parent's
+	// MAC, so ports limited to a few MACs by port security or 802.1X stay up,
+	// and clients are told apart by their DHCP client identifier.
+	driverIpvlan = "ipvlan"
+	// driverBridge attaches the clients to an existing Linux bridge that
+	// has the NIC as a port, for kernels without macvlan. Each client keeps
+	// its own MAC, as with macvlan, and the host needs no link of its own.
+	driverBridge = "bridge"
+)
+
+// bridgeNameOption names the existing bridge of a bridge-driver network.
+const bridgeNameOption = "com.docker.network.bridge.name"
+
+// hostLink is the host interface of a single-network run. With -networks
+// each target gets its own, see networkNames.
+const hostLink = "macvlan0"
+
+// NetworkConfig describes the LAN the containers are attached to, as detected
+// from the host's parent interface.
+type NetworkConfig struct {
+	// Name is the Docker network the clients attach to and HostLink the
+	// macvlan or ipvlan interface that lets the host reach them.
+	Name     string
+	HostLink string
+	Parent   string
+	// Driver is the Docker network driver, macvlan, ipvlan or bridge.
+	Driver  string
+	HostIP  net.IP
+	Subnet  *net.IPNet
+	Gateway net.IP
+	// Subnet6 is the parent's global IPv6 prefix, set only in -ipv6 mode.
+	Subnet6 *net.IPNet
+	// Host is the machine the parent interface belongs to.
+	Host *hostShell
+}
+
+// hostCIDR returns the host's address on the parent interface in CIDR form.
+func (n *NetworkConfig) hostCIDR() string {
+	ones, _ := n.Subnet.Mask.Size()
+	return fmt.Sprintf("%s/%d", n.HostIP, ones)
+}
+
+// setupNetwork detects (or uses the given) parent interface and recreates the
+// name macvlan or ipvlan network, the host interface link and, when enabled,
+// the NAT rule giving containers internet access. Host commands run on the
+// engine's host.
+func setupNetwork(ctx context.Context, cli containerRuntime, host *hostShell, name, link, driver, parent string, vlan, enableInternet, ipv6 bool) (*NetworkConfig, error) {
+	if err := host.requireRoot(); err != nil {
+		return nil, err
+	}
+
+	fmt.Println("=== Detecting Network Configuration ===")
+	if host.remote() {
+		fmt.Printf("Configuring the network on %s\n", host)
+	}
+	netCfg, err := detectNetwork(host, parent, vlan)
+	if err != nil {
+		return nil, err
+	}
+	netCfg.Name, netCfg.HostLink, netCfg.Driver = name, link, driver
+	fmt.Printf("Detected subnet: %s\n", netCfg.Subnet)
+	fmt.Printf("Detected gateway: %s\n", netCfg.Gateway)
+	if ipv6 {
+		if netCfg.Subnet6, err = detectIPv6Prefix(host, netCfg.Parent); err != nil {
+			return nil, err
+		}
+		fmt.Printf("Detected IPv6 prefix: %s\n", netCfg.Subnet6)
+	}
+
+	fmt.Println("=== Setting up Docker Network ===")
+	if err := ensureDockerNetwork(ctx, cli, netCfg); err != nil {
+		return nil, err
+	}
+	audit.record("docker_network", map[string]any{"network": netCfg.Name, "driver": netCfg.Driver, "parent": netCfg.Parent, "subnet": netCfg.Subnet.String(), "gateway": netCfg.Gateway.String(), "host": host.String()})
+
+	fmt.Println("=== Setting up Host Network Interface ===")
+	if netCfg.Driver == driverBridge {
+		fmt.Printf("Skipping %s: the host's address is on bridge %s, which reaches the containers\n", netCfg.HostLink, netCfg.Parent)
+	} else if netCfg.HostIP == nil {
+		fmt.Printf("%s has no address, skipping %s: the host cannot reach the containers\n", netCfg.Parent, netCfg.HostLink)
+	} else if err := setupHostMacvlanInterface(host, netCfg.Driver, netCfg.HostLink, netCfg.Parent, netCfg.hostCIDR(), netCfg.Subnet.String()); err != nil {
+		return nil, err
+	} else {
+		audit.record("host_interface", map[string]any{"interface": netCfg.HostLink, "driver": netCfg.Driver, "parent": netCfg.Parent, "address": netCfg.hostCIDR(), "host": host.String()})
+	}
+
+	if enableInternet {
+		fmt.Println("Enabling internet access for containers...")
+		if err := enableNAT(host, netCfg.Parent, netCfg.Subnet.String()); err != nil {
+			return nil, err
+		}
+		audit.record("nat_enabled", map[string]any{"parent": netCfg.Parent, "subnet": netCfg.Subnet.String(), "host": host.String()})
+	}
+
+	fmt.Println("=== Network Setup Complete ===")
+	fmt.Printf("Docker network '%s' ready with:\n", netCfg.Name)
+	fmt.Printf("  - Driver: %s\n", netCfg.Driver)
+	fmt.Printf("  - Parent interface: %s\n", netCfg.Parent)
+	fmt.Printf("  - Subnet: %s\n", netCfg.Subnet)
+	fmt.Printf("  - Gateway: %s\n", netCfg.Gateway)
+	if netCfg.Subnet6 != nil {
+		fmt.Printf("  - IPv6 prefix: %s\n", netCfg.Subnet6)
+	}
+	if netCfg.HostIP != nil && netCfg.Driver != driverBridge {
+		fmt.Println("Host network interface configured:")
+		fmt.Printf("  - Interface: %s\n", netCfg.HostLink)
+		fmt.Printf("  - IP: %s\n", netCfg.hostCIDR())
+	}
+	return netCfg, nil
+}
+
+// detectNetwork reads the IPv4 subnet of the parent interface. When parent is
+// empty the interface holding the default route is used, falling back to the
+// first wired interface that is up. With vlan, a local parent without an IPv4
+// address, as a freshly tagged VLAN usually is, has its subnet learned from a
+// DHCP offer and is left without a host address.
+func detectNetwork(host *hostShell, parent string, vlan bool) (*NetworkConfig, error) {
+	iface := parent
+	if iface == "" {
+		routeIface, _, err := defaultRoute(host, "")
+		if err != nil || routeIface == "" {
+			if host.remote() {
+				return nil, fmt.Errorf("no default route on %s, use -interface to name the parent interface", host)
+			}
+			slog.Warn("no default interface found from routes, trying to detect a likely interface")
+			routeIface = fallbackInterface()
+		}
+		iface = routeIface
+		fmt.Printf("Auto-detected parent interface: %s (use -interface to override)\n", iface)
+	} else {
+		fmt.Printf("Using parent interface: %s\n", iface)
+	}
+
+	addrs, err := host.interfaceAddrs(iface)
+	if err != nil {
+		return nil, err
+	}
+	for _, ipNet := range addrs {
+		if ipNet.IP.To4() == nil {
+			continue
+		}
+		subnet := &net.IPNet{IP: ipNet.IP.Mask(ipNet.Mask).To4(), Mask: ipNet.Mask}
+		_, gateway, _ := defaultRoute(host, iface)
+		if gateway == nil {
+			// Interfaces without a default route (e.g. a second NIC) still need
+			// a gateway for Docker's IPAM; assume the conventional first address.
+			gateway = nextIP(subnet.IP)
+			slog.Warn("no default route via interface, assuming gateway", "interface", iface, "gateway", gateway.String())
+		}
+		return &NetworkConfig{
+			Parent:  iface,
+			HostIP:  ipNet.IP.To4(),
+			Subnet:  subnet,
+			Gateway: gateway,
+			Host:    host,
+		}, nil
+	}
+	if !vlan || host.remote() {
+		return nil, fmt.Errorf("could not detect network configuration: %s has no IPv4 address", iface)
+	}
+	fmt.Printf("%s has no IPv4 address, learning the subnet from a DHCP offer (no lease is taken)\n", iface)
+	subnet, gateway, err := offeredNetwork(iface)
+	if err != nil {
+		return nil, fmt.Errorf("could not detect network configuration: %s has no IPv4 address and %v", iface, err)
+	}
+	if gateway == nil {
+		gateway = nextIP(subnet.IP)
+		slog.Warn("DHCP offer names no router, assuming gateway", "interface", iface, "gateway", gateway.String())
+	}
+	return &NetworkConfig{
+		Parent:  iface,
+		Subnet:  subnet,
+		Gateway: gateway,
+		Host:    host,
+	}, nil
+}
+
+// detectIPv6Prefix returns the global IPv6 prefix configured on iface, which
+// the DHCPv6 clients are expected to draw their IA_NA addresses from.
+func detectIPv6Prefix(host *hostShell, iface string) (*net.IPNet, error) {
+	addrs, err := host.interfaceAddrs(iface)
+	if err != nil {
+		return nil, err
+	}
+	for _, ipNet := range addrs {
+		if ipNet.IP.To4() != nil || !ipNet.IP.IsGlobalUnicast() {
+			continue
+		}
+		return &net.IPNet{IP: ipNet.IP.Mask(ipNet.Mask), Mask: ipNet.Mask}, nil
+	}
+	return nil, fmt.Errorf("%s has no global IPv6 address; -ipv6 needs a dual-stack parent interface", iface)
+}
+
+// defaultRoute returns the interface and gateway of the IPv4 default route by
+// reading /proc/net/route. When iface is non-empty only routes through that
+// interface are considered.
+func defaultRoute(host *hostShell, iface string) (string, net.IP, error) {
+	routes, err := host.readFile("/proc/net/route")
+	if err != nil {
+		return "", nil, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(routes))
+	scanner.Scan() // skip header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		if iface != "" && fields[0] != iface {
+			continue
+		}
+		raw, err := hex.DecodeString(fields[2])
+		if err != nil || len(raw) != 4 {
+			continue
+		}
+		// The kernel prints the gateway in host (little-endian) byte order.
+		gateway := make(net.IP, 4)
+		binary.BigEndian.PutUint32(gateway, binary.LittleEndian.Uint32(raw))
+		return fields[0], gateway, nil
+	}
+	return "", nil, scanner.Err()
+}
+
+// nextIP returns the address following ip.
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// isWireless reports whether iface is an 802.11 adapter.
+func isWireless(host *hostShell, iface string) bool {
+	if iface == "" {
+		return false
+	}
+	for _, entry := range []string{"wireless", "phy80211"} {
+		if host.exists(filepath.Join("/sys/class/net", iface, entry)) {
+			return true
+		}
+	}
+	return false
+}
+
+// targetParent returns the parent interface of target, the default route's
+// for a target without one.
+func targetParent(host *hostShell, target networkTarget) string {
+	if target.Interface != "" {
+		return target.Interface
+	}
+	parent, _, _ := defaultRoute(host, "")
+	return parent
+}
+
+// wirelessParents returns the wireless interfaces among the parents of
+// targets.
+func wirelessParents(host *hostShell, targets []networkTarget) []string {
+	var wireless []string
+	for _, target := range targets {
+		if parent := targetParent(host, target); isWireless(host, parent) {
+			wireless = append(wireless, parent)
+		}
+	}
+	return wireless
+}
+
+// kernelSupports reports whether the host kernel has the driver (macvlan,
+// ipvlan or bridge) loaded, built in or available as a module, which Docker
+// loads itself. A host without modprobe, or one ssh cannot reach, gives no
+// answer and counts as supported, leaving any failure to Docker.
+func kernelSupports(host *hostShell, driver string) bool {
+	if host.exists(filepath.Join("/sys/module", driver)) {
+		return true
+	}
+	var exitErr *exec.ExitError
+	err := host.command("modprobe", "-n", "-q", driver).Run()
+	return !errors.As(err, &exitErr) || exitErr.ExitCode() == 127 || exitErr.ExitCode() == 255
+}
+
+// isBridge reports whether iface is a Linux bridge.
+func isBridge(host *hostShell, iface string) bool {
+	return iface != "" && host.exists(filepath.Join("/sys/class/net", iface, "bridge"))
+}
+
+// bridgeOf returns the bridge iface is a port of, or "".
+func bridgeOf(host *hostShell, iface string) string {
+	if iface == "" || !host.exists(filepath.Join("/sys/class/net", iface, "brport")) {
+		return ""
+	}
+	out, err := host.command("readlink", filepath.Join("/sys/class/net", iface, "master")).Output()
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(strings.TrimSpace(string(out)))
+}
+
+// fallbackInterface picks the first up, wired-looking interface, or eth0.
+func fallbackInterface() string {
+	links, err := net.Interfaces()
+	if err != nil {
+		return "eth0"
+	}
+	for _, link := range links {
+		if link.Flags&net.FlagUp == 0 {
+			continue
+		}
+		for _, prefix := range []string{"en", "eth"} {
+			if strings.HasPrefix(link.Name, prefix) {
+				return link.Name
+			}
+		}
+	}
+	return "eth0"
+}
+
+// ensureDockerNetwork creates the netCfg.Name macvlan (bridge mode), ipvlan
+// (l2 mode) or bridge network on the parent interface unless it exists. An existing
+// network is reused only if its driver, parent and subnets match; any other
+// network of that name is an error rather than replaced, since it may belong
+// to someone else.
+func ensureDockerNetwork(ctx context.Context, cli containerRuntime, netCfg *NetworkConfig) error {
+	inspect, err := cli.NetworkInspect(ctx, netCfg.Name, network.InspectOptions{})
+	if err == nil {
+		if err := verifyDockerNetwork(inspect, netCfg); err != nil {
+			return err
+		}
+		if id := inspect.Labels[labelRun]; id != "" {
+			fmt.Printf("Adopting Docker network %s from run %s\n", netCfg.Name, id)
+		} else {
+			fmt.Printf("Reusing existing Docker network %s\n", netCfg.Name)
+		}
+		return nil
+	}
+	if !client.IsErrNotFound(err) {
+		return fmt.Errorf("failed to inspect Docker network %s: %v", netCfg.Name, err)
+	}
+
+	ipamConfig := []network.IPAMConfig{{
+		Subnet:  netCfg.Subnet.String(),
+		Gateway: netCfg.Gateway.String(),
+	}}
+	var enableIPv6 *bool
+	if netCfg.Subnet6 != nil {
+		ipamConfig = append(ipamConfig, network.IPAMConfig{Subnet: netCfg.Subnet6.String()})
+		enabled := true
+		enableIPv6 = &enabled
+	}
+
+	options := map[string]string{
+		"parent":       netCfg.Parent,
+		"macvlan_mode": "bridge",
+	}
+	switch netCfg.Driver {
+	case driverIpvlan:
+		options = map[string]string{
+			"parent":      netCfg.Parent,
+			"ipvlan_mode": "l2",
+		}
+	case driverBridge:
+		// The bridge already holds the host's address and the LAN's router
+		// is the clients' gateway, so Docker adds no address and no NAT.
+		options = map[string]string{
+			bridgeNameOption:                                 netCfg.Parent,
+			"com.docker.network.bridge.inhibit_ipv4":         "true",
+			"com.docker.network.bridge.enable_ip_masquerade": "false",
+		}
+	}
+
+	fmt.Printf("Creating Docker network %s...\n", netCfg.Name)
+	_, err = cli.NetworkCreate(ctx, netCfg.Name, network.CreateOptions{
+		Driver:     netCfg.Driver,
+		Options:    options,
+		IPAM:       &network.IPAM{Config: ipamConfig},
+		EnableIPv6: enableIPv6,
+		Attachable: true,
+		Labels:     runLabels(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create Docker network: %v", err)
+	}
+	return nil
+}
+
+// verifyDockerNetwork checks that an existing network is what netCfg
+// describes.
+func verifyDockerNetwork(inspect network.Inspect, netCfg *NetworkConfig) error {
+	mismatch := func(what, have, want string) error {
+		return fmt.Errorf("Docker network %s exists with %s %s instead of %s; remove it with -cleanup or -orphans=remove, or choose another -network", netCfg.Name, what, have, want)
+	}
+	if inspect.Driver != netCfg.Driver {
+		return mismatch("driver", inspect.Driver, netCfg.Driver)
+	}
+	parentOption := "parent"
+	if netCfg.Driver == driverBridge {
+		parentOption = bridgeNameOption
+	}
+	if parent := inspect.Options[parentOption]; parent != netCfg.Parent {
+		return mismatch("parent", orDash(parent), netCfg.Parent)
+	}
+	if netCfg.Driver == driverIpvlan && inspect.Options["ipvlan_mode"] != "l2" {
+		return mismatch("ipvlan mode", orDash(inspect.Options["ipvlan_mode"]), "l2")
+	}
+	want := []string{netCfg.Subnet.String()}
+	if netCfg.Subnet6 != nil {
+		want = append(want, netCfg.Subnet6.String())
+	}
+	var have []string
+	for _, cfg := range inspect.IPAM.Config {
+		have = append(have, cfg.Subnet)
+	}
+	for _, subnet := range want {
+		if !slices.Contains(have, subnet) {
+			return mismatch("subnets", orDash(strings.Join(have, ",")), strings.Join(want, ","))
+		}
+	}
+	return nil
+}
+
+// setupHostMacvlanInterface recreates the link interface on the parent so the
+// host can reach containers on the Docker network. It is of the same type as
+// the network driver, since macvlan and ipvlan links cannot share a parent,
+// and is labelled so cleanup finds it. Locally it is set up over netlink; on
+// a -host engine with ip, run over ssh.
+func setupHostMacvlanInterface(host *hostShell, driver, link, parent, ipWithCIDR, dockerSubnet string) error {
+	if host.remote() {
+		return setupRemoteHostLink(host, driver, link, parent, ipWithCIDR, dockerSubnet)
+	}
+	addr, err := netlink.ParseAddr(ipWithCIDR)
+	if err != nil {
+		return fmt.Errorf("invalid host address %s: %v", ipWithCIDR, err)
+	}
+	_, route, err := net.ParseCIDR(dockerSubnet)
+	if err != nil {
+		return fmt.Errorf("invalid subnet %s: %v", dockerSubnet, err)
+	}
+	// Remove an existing interface of that name
+	if existing, err := netlink.LinkByName(link); err == nil {
+		if err := netlink.LinkDel(existing); err != nil {
+			return fmt.Errorf("failed to delete existing %s: %v", link, err)
+		}
+	}
+	parentLink, err := netlink.LinkByName(parent)
+	if err != nil {
+		return fmt.Errorf("failed to find parent interface %s: %v", parent, err)
+	}
+
+	// Create the interface in bridge (macvlan) or l2 (ipvlan) mode on the parent
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = link
+	attrs.ParentIndex = parentLink.Attrs().Index
+	var created netlink.Link = &netlink.Macvlan{LinkAttrs: attrs, Mode: netlink.MACVLAN_MODE_BRIDGE}
+	if driver == driverIpvlan {
+		created = &netlink.IPVlan{LinkAttrs: attrs, Mode: netlink.IPVLAN_MODE_L2}
+	}
+	if err := netlink.LinkAdd(created); err != nil {
+		return fmt.Errorf("failed to create %s interface: %v", link, err)
+	}
+	created, err = netlink.LinkByName(link)
+	if err != nil {
+		return fmt.Errorf("failed to create %s interface: %v", link, err)
+	}
+	if err := netlink.LinkSetAlias(created, linkAlias); err != nil {
+		return fmt.Errorf("failed to label %s: %v", link, err)
+	}
+	if err := netlink.AddrAdd(created, addr); err != nil {
+		return fmt.Errorf("failed to assign IP address to %s: %v", link, err)
+	}
+	if err := netlink.LinkSetUp(created); err != nil {
+		return fmt.Errorf("failed to bring up %s: %v", link, err)
+	}
+	if err := netlink.RouteAdd(&netlink.Route{LinkIndex: created.Attrs().Index, Dst: route}); err != nil {
+		slog.Warn("failed to add route", "route", dockerSubnet, "error", err)
+	}
+	return nil
+}
+
+// setupRemoteHostLink is setupHostMacvlanInterface on a -host engine. Every
+// step runs ip with its arguments quoted, never through a shell command line.
+func setupRemoteHostLink(host *hostShell, driver, link, parent, ipWithCIDR, dockerSubnet string) error {
+	ip := func(args ...string) error {
+		return host.command("ip", args...).Run()
+	}
+	// Remove an existing interface of that name
+	if err := ip("link", "show", "dev", link); err == nil {
+		if err := ip("link", "delete", "dev", link); err != nil {
+			return fmt.Errorf("failed to delete existing %s: %v", link, err)
+		}
+	}
+	create := []string{"link", "add", link, "link", parent, "type", "macvlan", "mode", "bridge"}
+	if driver == driverIpvlan {
+		create = []string{"link", "add", link, "link", parent, "type", "ipvlan", "mode", "l2"}
+	}
+	if err := ip(create...); err != nil {
+		return fmt.Errorf("failed to create %s interface: %v", link, err)
+	}
+	if err := ip("link", "set", "dev", link, "alias", linkAlias); err != nil {
+		return fmt.Errorf("failed to label %s: %v", link, err)
+	}
+	if err := ip("addr", "add", ipWithCIDR, "dev", link); err != nil {
+		return fmt.Errorf("failed to assign IP address to %s: %v", link, err)
+	}
+	if err := ip("link", "set", "dev", link, "up"); err != nil {
+		return fmt.Errorf("failed to bring up %s: %v", link, err)
+	}
+	if err := ip("route", "add", dockerSubnet, "dev", link); err != nil {
+		slog.Warn("failed to add route", "route", dockerSubnet, "error", err)
+	}
+	return nil
+}
+
+// runHostLinks returns the macvlan and ipvlan host interfaces created by a
+// run.
+func runHostLinks(host *hostShell) ([]string, error) {
+	var names []string
+	for _, kind := range []string{driverMacvlan, driverIpvlan} {
+		out, err := host.command("ip", "-o", "link", "show", "type", kind).Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s interfaces: %v", kind, err)
+		}
+		names = append(names, labelledLinks(string(out))...)
+	}
+	return names, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// operatorNote is a timestamped remark attached to a run, e.g. "customer
+// rebooted DHCP server".
+type operatorNote struct {
+	Time time.Time `json:"time"`
+	Text string    `json:"text"`
+}
+
+// recordNote attaches a note to the run at the current time.
+func (s *runStats) recordNote(text string) operatorNote {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	note := operatorNote{Time: clock.Now(), Text: text}
+	s.notes = append(s.notes, note)
+	return note
+}
+
+// runAnnotate implements the annotate subcommand, which sends a note to a
+// run's control API.
+func runAnnotate(args []string) {
+	fs := flag.NewFlagSet("annotate", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:8080", "Control API address of the running ipocalypse (its -listen value)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage:
+  ./ipocalypse annotate [-addr host:port] <note text>
+
+Attaches a timestamped note to a run started with -listen, e.g.
+  ./ipocalypse annotate "customer rebooted DHCP server"
+
+Options:
+`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	text := strings.TrimSpace(strings.Join(fs.Args(), " "))
+	if text == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	host := *addr
+	if strings.HasPrefix(host, ":") {
+		host = "localhost" + host
+	}
+	body, _ := json.Marshal(map[string]string{"text": text})
+	req, err := newControlRequest(context.Background(), http.MethodPost, "http://"+host+"/notes", bytes.NewReader(body))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Printf("Error: could not reach the control API at %s: %v\n", host, err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		fmt.Printf("Error: note rejected (%s): %s\n", resp.Status, strings.TrimSpace(string(msg)))
+		os.Exit(1)
+	}
+	var note operatorNote
+	if err := json.NewDecoder(resp.Body).Decode(&note); err != nil {
+		fmt.Printf("Error: unexpected response from the control API: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Note recorded at %s\n", note.Time.Format("15:04:05"))
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxARPSweep bounds the ARP sweep so a large subnet is not flooded; bigger
+// subnets are reported without a pool estimate.
+const maxARPSweep = 4096
+
+// observedServer is a DHCP server seen answering on the segment.
+type observedServer struct {
+	IP        net.IP
+	MAC       net.HardwareAddr
+	Offers    int
+	Acks      int
+	Naks      int
+	LeaseTime time.Duration
+	Trusted   bool
+}
+
+// observer passively records DHCP traffic on the segment. It never sends DHCP
+// messages; the only frames it transmits are ARP requests for the sweep.
+type observer struct {
+	netCfg  *NetworkConfig
+	trusted map[string]bool
+
+	mu       sync.Mutex
+	messages map[byte]int
+	clients  map[string]bool
+	servers  map[string]*observedServer
+	inUse    map[string]net.HardwareAddr
+	swept    int
+	// discovers holds when each transaction's DISCOVER was seen, so the
+	// matching ACK yields the client's lease acquisition latency.
+	discovers map[uint32]time.Time
+	latencies []time.Duration
+	// outcomes holds the last server answer each client got, or 0 while it
+	// has had none.
+	outcomes map[string]byte
+	// source describes where the traffic came from when it was not captured
+	// live on netCfg's interface.
+	source string
+	// fingerprints collects the device mix of the clients seen.
+	fingerprints *fingerprinter
+}
+
+func newObserver(netCfg *NetworkConfig, trusted []string) *observer {
+	o := &observer{
+		netCfg:   netCfg,
+		trusted:  make(map[string]bool),
+		messages: make(map[byte]int),
+		clients:  make(map[string]bool),
+		servers:  make(map[string]*observedServer),
+		inUse:    make(map[string]net.HardwareAddr),
+
+		discovers: make(map[uint32]time.Time),
+		outcomes:  make(map[string]byte),
+
+		fingerprints: newFingerprinter(nil),
+	}
+	for _, ip := range trusted {
+		o.trusted[ip] = true
+	}
+	return o
+}
+
+// capture records DHCP messages seen on the interface until ctx is done.
+func (o *observer) capture(ctx context.Context, conn *packetConn) {
+	buf := make([]byte, 65536)
+	for ctx.Err() == nil {
+		n, err := conn.readFrame(buf)
+		if err != nil || n == 0 {
+			continue
+		}
+		frame, ok := parseUDPFrame(buf[:n])
+		if !ok || (frame.DstPort != dhcpServerPort && frame.DstPort != dhcpClientPort) {
+			continue
+		}
+		msg, err := parseDHCP(frame.Payload)
+		if err != nil {
+			continue
+		}
+		o.record(clock.Now(), frame, msg)
+	}
+}
+
+// record accounts for one DHCP message seen at the given time.
+func (o *observer) record(at time.Time, frame udpFrame, msg *dhcpMessage) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	t := msg.msgType()
+	o.messages[t]++
+	if msg.Op != bootReply {
+		client := msg.CHAddr.String()
+		o.clients[client] = true
+		if _, ok := o.outcomes[client]; !ok && t != dhcpRelease && t != dhcpInform {
+			o.outcomes[client] = 0
+		}
+		if _, seen := o.discovers[msg.XID]; t == dhcpDiscover && !seen {
+			o.discovers[msg.XID] = at
+		}
+		o.fingerprints.record(at, msg)
+		return
+	}
+	if t == dhcpOffer || t == dhcpAck || t == dhcpNak {
+		o.outcomes[msg.CHAddr.String()] = t
+	}
+	if t == dhcpAck {
+		if sent, ok := o.discovers[msg.XID]; ok {
+			o.latencies = append(o.latencies, at.Sub(sent))
+			delete(o.discovers, msg.XID)
+		}
+	}
+
+	serverIP := msg.serverID()
+	if serverIP == nil {
+		serverIP = frame.SrcIP
+	}
+	key := serverIP.String()
+	server, ok := o.servers[key]
+	if !ok {
+		server = &observedServer{
+			IP:      append(net.IP(nil), serverIP...),
+			MAC:     append(net.HardwareAddr(nil), frame.SrcMAC...),
+			Trusted: o.isTrusted(key),
+		}
+		o.servers[key] = server
+		if server.Trusted {
+			slog.Info("DHCP server seen", "server", key, "mac", server.MAC.String())
+		} else {
+			slog.Warn("possible rogue DHCP server", "server", key, "mac", server.MAC.String())
+		}
+	}
+	switch t {
+	case dhcpOffer:
+		server.Offers++
+	case dhcpAck:
+		server.Acks++
+		if lt := msg.leaseTime(); lt > 0 {
+			server.LeaseTime = lt
+		}
+	case dhcpNak:
+		server.Naks++
+	}
+}
+
+// isTrusted reports whether server may hand out leases. Without a trusted
+// list every server is suspect once more than one has been seen. Callers must
+// hold o.mu.
+func (o *observer) isTrusted(server string) bool {
+	if len(o.trusted) > 0 {
+		return o.trusted[server]
+	}
+	return len(o.servers) == 0
+}
+
+// sweep ARPs every address in the subnet and records which ones answer, for
+// the pool usage estimate.
+func (o *observer) sweep(ctx context.Context) error {
+	ones, bits := o.netCfg.Subnet.Mask.Size()
+	hosts := 1<<uint(bits-ones) - 2
+	if hosts > maxARPSweep {
+		return fmt.Errorf("subnet %s is too large to sweep (more than %d addresses)", o.netCfg.Subnet, maxARPSweep)
+	}
+	conn, err := openPacketConn(o.netCfg.Parent, etherTypeARP)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.setReadTimeout(200 * time.Millisecond); err != nil {
+		return fmt.Errorf("failed to set socket timeout: %v", err)
+	}
+
+	srcMAC := conn.iface.HardwareAddr
+	// Without an address on the segment the requests go out as ARP probes
+	// from 0.0.0.0, which are answered to 0.0.0.0.
+	srcIP := o.netCfg.HostIP
+	if srcIP == nil {
+		srcIP = net.IPv4zero
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 1514)
+		deadline := clock.Now().Add(time.Duration(hosts)*time.Millisecond + 2*time.Second)
+		for ctx.Err() == nil && clock.Now().Before(deadline) {
+			n, err := conn.readFrame(buf)
+			if err != nil || n < 42 {
+				continue
+			}
+			arp := buf[14:n]
+			// Replies (op 2) addressed to our own IP.
+			if binary.BigEndian.Uint16(arp[6:8]) != 2 || !net.IP(arp[24:28]).Equal(srcIP) {
+				continue
+			}
+			o.mu.Lock()
+			o.inUse[net.IP(arp[14:18]).String()] = append(net.HardwareAddr(nil), arp[8:14]...)
+			o.mu.Unlock()
+		}
+	}()
+
+	base := ipToUint32(o.netCfg.Subnet.IP)
+	for i := 1; i <= hosts && ctx.Err() == nil; i++ {
+		target := uint32ToIP(base + uint32(i))
+		if target.Equal(srcIP) {
+			continue
+		}
+		if err := conn.writeFrame(buildARPRequest(srcMAC, srcIP, target)); err != nil {
+			return fmt.Errorf("failed to send ARP request: %v", err)
+		}
+		clock.Sleep(time.Millisecond)
+	}
+	<-done
+	o.mu.Lock()
+	o.swept = hosts
+	o.mu.Unlock()
+	return nil
+}
+
+// buildARPRequest builds a broadcast who-has frame for target.
+func buildARPRequest(srcMAC net.HardwareAddr, srcIP, target net.IP) []byte {
+	frame := make([]byte, 42)
+	copy(frame[0:6], broadcastMAC)
+	copy(frame[6:12], srcMAC)
+	binary.BigEndian.PutUint16(frame[12:14], etherTypeARP)
+	arp := frame[14:]
+	binary.BigEndian.PutUint16(arp[0:2], 1) // Ethernet
+	binary.BigEndian.PutUint16(arp[2:4], etherTypeIPv4)
+	arp[4], arp[5] = 6, 4
+	binary.BigEndian.PutUint16(arp[6:8], 1) // request
+	copy(arp[8:14], srcMAC)
+	copy(arp[14:18], srcIP.To4())
+	copy(arp[24:28], target.To4())
+	return frame
+}
+
+// printReport writes the baseline report for the segment.
+func (o *observer) printReport(elapsed time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	fmt.Println("=== Observation Report ===")
+	if o.source != "" {
+		fmt.Printf("Capture:           %s\n", o.source)
+	} else {
+		fmt.Printf("Interface:         %s (subnet %s)\n", o.netCfg.Parent, o.netCfg.Subnet)
+	}
+	fmt.Printf("Observed for:      %v\n", elapsed.Round(time.Second))
+
+	var counts []string
+	for _, t := range []byte{dhcpDiscover, dhcpOffer, dhcpRequest, dhcpAck, dhcpNak, dhcpDecline, dhcpRelease, dhcpInform} {
+		if n := o.messages[t]; n > 0 {
+			counts = append(counts, fmt.Sprintf("%s %d", dhcpTypeName(t), n))
+		}
+	}
+	if len(counts) == 0 {
+		counts = []string{"none"}
+	}
+	fmt.Printf("DHCP messages:     %s\n", strings.Join(counts, ", "))
+	fmt.Printf("Clients seen:      %d\n", len(o.clients))
+	if len(o.outcomes) > 0 {
+		byOutcome := make(map[byte]int)
+		for _, t := range o.outcomes {
+			byOutcome[t]++
+		}
+		fmt.Printf("Client outcomes:   %d acked, %d NAKed, %d offered but not acked, %d unanswered\n",
+			byOutcome[dhcpAck], byOutcome[dhcpNak], byOutcome[dhcpOffer], byOutcome[0])
+	}
+	if len(o.latencies) > 0 {
+		fmt.Printf("Lease latency:     p95 %v over %d DISCOVER-to-ACK exchanges\n", percentile(o.latencies, 95).Round(time.Millisecond), len(o.latencies))
+	}
+
+	keys := make([]string, 0, len(o.servers))
+	for key := range o.servers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	fmt.Printf("DHCP servers:      %d\n", len(keys))
+	rogues := 0
+	for _, key := range keys {
+		s := o.servers[key]
+		flag := "trusted"
+		if !s.Trusted {
+			flag = "POSSIBLE ROGUE"
+			rogues++
+		}
+		lease := "unknown"
+		if s.LeaseTime > 0 {
+			lease = s.LeaseTime.String()
+		}
+		fmt.Printf("  %-15s %s  offers %d, acks %d, naks %d, lease time %s  [%s]\n", key, s.MAC, s.Offers, s.Acks, s.Naks, lease, flag)
+	}
+	if rogues > 0 {
+		fmt.Printf("Rogue servers:     %d answered that are not trusted (see -trusted-servers)\n", rogues)
+	}
+
+	if o.swept > 0 {
+		capacity := poolCapacity(o.netCfg)
+		used := len(o.inUse)
+		fmt.Printf("Addresses in use:  %d of %d answered ARP\n", used, o.swept)
+		if capacity > 0 {
+			fmt.Printf("Pool estimate:     ~%d free of %d usable (%.1f%% in use; the DHCP range may be smaller than the subnet)\n",
+				max(capacity-used, 0), capacity, float64(used)/float64(capacity)*100)
+		}
+	}
+	o.fingerprints.printReport()
+}
+
+// runObserve watches the segment for the configured duration without
+// launching clients and prints a baseline report.
+func runObserve(cfg Config) error {
+	netCfg, err := detectNetwork(localHost, cfg.Interface, false)
+	if err != nil {
+		return err
+	}
+	// Protocol-specific packet sockets only see inbound frames; ETH_P_ALL also
+	// sees clients running on this host.
+	conn, err := openPacketConn(netCfg.Parent, etherTypeAll)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.setReadTimeout(500 * time.Millisecond); err != nil {
+		return fmt.Errorf("failed to set socket timeout: %v", err)
+	}
+
+	fmt.Printf("Observing %s for %v; nothing will be launched\n", netCfg.Parent, cfg.ObserveDuration)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ObserveDuration)
+	defer cancel()
+	start := clock.Now()
+
+	obs := newObserver(netCfg, cfg.TrustedServers)
+	if !cfg.Fingerprint {
+		obs.fingerprints = nil
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		obs.capture(ctx, conn)
+	}()
+	if err := obs.sweep(ctx); err != nil {
+		slog.Warn("ARP sweep skipped, no pool estimate", "error", err)
+	}
+	<-ctx.Done()
+	wg.Wait()
+
+	elapsed := clock.Since(start)
+	obs.printReport(elapsed)
+	if cfg.BaselineDir != "" {
+		path, err := saveBaseline(cfg.BaselineDir, obs.baseline(elapsed))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Baseline saved to %s; later runs on %s are compared against it\n", path, netCfg.Subnet)
+	}
+	if cfg.BaselineDir != "" && obs.fingerprints != nil {
+		path, err := obs.fingerprints.save(cfg.BaselineDir, netCfg.Subnet.String())
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Client fingerprints added to %s\n", path)
+	}
+	return nil
+}
+
+// baseline summarises the observation for later comparison.
+func (o *observer) baseline(elapsed time.Duration) *networkBaseline {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	b := &networkBaseline{
+		Subnet:     o.netCfg.Subnet.String(),
+		Interface:  o.netCfg.Parent,
+		ObservedAt: clock.Now(),
+		Duration:   elapsed,
+		Acks:       o.messages[dhcpAck],
+		Naks:       o.messages[dhcpNak],
+		Clients:    len(o.clients),
+		InUse:      len(o.inUse),
+	}
+	for key := range o.servers {
+		b.Servers = append(b.Servers, key)
+	}
+	sort.Strings(b.Servers)
+	if len(o.latencies) > 0 {
+		var total time.Duration
+		for _, latency := range o.latencies {
+			total += latency
+		}
+		b.AvgLatency = total / time.Duration(len(o.latencies))
+		b.P95Latency = percentile(o.latencies, 95)
+	}
+	return b
+}
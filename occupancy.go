@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// poolOccupancy compares ARP sweeps of the target subnet taken before and
+// after the run, for -arp-sweep: how full the subnet already was, how many
+// leases that left in theory, and how full the run left it.
+type poolOccupancy struct {
+	netCfg *NetworkConfig
+	// usable is the number of addresses other clients could be given: the
+	// subnet less its network and broadcast addresses and this host.
+	usable int
+	before int
+	// after counts the answering addresses the run does not hold, and held
+	// the leases it does, or -1 when the closing sweep failed.
+	after    int
+	held     int
+	acquired int
+}
+
+// sweepInUse ARPs the subnet and returns the addresses that answered.
+func sweepInUse(ctx context.Context, netCfg *NetworkConfig) (map[string]bool, error) {
+	obs := newObserver(netCfg, nil)
+	if err := obs.sweep(ctx); err != nil {
+		return nil, err
+	}
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	inUse := make(map[string]bool, len(obs.inUse))
+	for ip := range obs.inUse {
+		inUse[ip] = true
+	}
+	return inUse, nil
+}
+
+// newPoolOccupancy sweeps the subnet before anything is launched and reports
+// how many addresses are already in use. It returns nil when sweep is false.
+func newPoolOccupancy(ctx context.Context, netCfg *NetworkConfig, sweep bool) (*poolOccupancy, error) {
+	if !sweep {
+		return nil, nil
+	}
+	fmt.Printf("Pre-flight: ARP sweeping %s...\n", netCfg.Subnet)
+	inUse, err := sweepInUse(ctx, netCfg)
+	if err != nil {
+		return nil, fmt.Errorf("pre-flight ARP sweep failed: %v", err)
+	}
+	ones, bits := netCfg.Subnet.Mask.Size()
+	usable := 1<<uint(bits-ones) - 2
+	if netCfg.HostIP != nil {
+		usable--
+	}
+	p := &poolOccupancy{netCfg: netCfg, usable: usable, before: len(inUse), after: -1}
+	fmt.Printf("%d of %d addresses in %s already answer ARP; at most %d leases remain\n", p.before, p.usable, netCfg.Subnet, p.remaining())
+	return p, nil
+}
+
+// remaining is the theoretical number of leases left before the run: every
+// usable address not answering ARP. The server's pool may well be smaller.
+func (p *poolOccupancy) remaining() int {
+	return max(0, p.usable-p.before)
+}
+
+// finish sweeps the subnet again once launching stopped. Clients that do not
+// answer ARP, such as raw-mode ones, are counted through the lease table.
+// A nil occupancy does nothing.
+func (p *poolOccupancy) finish(ctx context.Context, leases *leaseTable) {
+	if p == nil {
+		return
+	}
+	p.acquired = len(leases.snapshot())
+	inUse, err := sweepInUse(ctx, p.netCfg)
+	if err != nil {
+		slog.Warn("closing ARP sweep failed, no occupancy after the run", "error", err)
+		return
+	}
+	held := leases.held()
+	ours := make(map[string]bool, len(held))
+	for _, lease := range held {
+		ours[lease.IP] = true
+	}
+	others := 0
+	for ip := range inUse {
+		if !ours[ip] {
+			others++
+		}
+	}
+	p.after, p.held = others, len(held)
+}
+
+// printReport writes the occupancy before and after the run. A nil
+// occupancy prints nothing.
+func (p *poolOccupancy) printReport() {
+	if p == nil {
+		return
+	}
+	fmt.Println("=== Pool Occupancy ===")
+	fmt.Printf("Usable addresses:  %d in %s\n", p.usable, p.netCfg.Subnet)
+	fmt.Printf("In use before:     %d (%.1f%%)\n", p.before, percentOf(p.before, p.usable))
+	fmt.Printf("Leases remaining:  at most %d before the run, %d acquired (%.1f%%)\n", p.remaining(), p.acquired, percentOf(p.acquired, p.remaining()))
+	if p.after < 0 {
+		fmt.Println("In use after:      unknown")
+		return
+	}
+	total := p.after + p.held
+	fmt.Printf("In use after:      %d (%.1f%%): %d held by this run, %d by other devices\n", total, percentOf(total, p.usable), p.held, p.after)
+	fmt.Printf("Free after:        at most %d\n", max(0, p.usable-total))
+}
+
+// percentOf returns n as a percentage of total, or 0 when total is 0.
+func percentOf(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total) * 100
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+)
+
+// Ways -orphans handles the containers and networks earlier runs left.
+const (
+	orphansAsk    = "ask"
+	orphansAdopt  = "adopt"
+	orphansRemove = "remove"
+	orphansKeep   = "keep"
+)
+
+// orphanedResources are the labelled containers and networks of runs other
+// than this one (or the one -resume continues).
+type orphanedResources struct {
+	// containers counts the containers by run ID.
+	containers map[string]int
+	networks   []string
+}
+
+// checkOrphansMode reports whether mode is one -orphans accepts.
+func checkOrphansMode(mode string) error {
+	switch mode {
+	case orphansAsk, orphansAdopt, orphansRemove, orphansKeep:
+		return nil
+	}
+	return fmt.Errorf("unknown -orphans %q: use ask, adopt, remove or keep", mode)
+}
+
+// findOrphans lists what earlier runs left on the container engine.
+func findOrphans(ctx context.Context, cli containerRuntime) (*orphanedResources, error) {
+	o := &orphanedResources{}
+	var err error
+	if o.containers, err = earlierRunContainers(ctx, cli); err != nil {
+		return nil, fmt.Errorf("failed to list the containers of earlier runs: %v", err)
+	}
+	networks, err := cli.NetworkList(ctx, network.ListOptions{Filters: labelledFilter()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the networks of earlier runs: %v", err)
+	}
+	for _, n := range networks {
+		if n.Labels[labelRun] != runID {
+			o.networks = append(o.networks, n.Name)
+		}
+	}
+	sort.Strings(o.networks)
+	return o, nil
+}
+
+func (o *orphanedResources) String() string {
+	runs := make([]string, 0, len(o.containers))
+	for id := range o.containers {
+		runs = append(runs, id)
+	}
+	sort.Strings(runs)
+	var parts []string
+	for _, id := range runs {
+		parts = append(parts, fmt.Sprintf("%d containers of run %s", o.containers[id], orDash(id)))
+	}
+	if len(o.networks) > 0 {
+		parts = append(parts, "networks "+strings.Join(o.networks, ", "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// found reports whether earlier runs left anything.
+func (o *orphanedResources) found() bool {
+	return len(o.containers) > 0 || len(o.networks) > 0
+}
+
+// chooseOrphans settles what to do with the orphans: ask prompts on a
+// terminal and keeps them otherwise. Networks alone are never asked about,
+// since a run reusing the -network of an earlier one is the usual case and
+// ensureDockerNetwork checks it.
+func chooseOrphans(mode string, o *orphanedResources, in io.Reader, interactive bool) string {
+	choice := mode
+	if mode == orphansAsk {
+		choice = orphansKeep
+		if len(o.containers) > 0 && interactive {
+			choice = askOrphans(o, in)
+		}
+	}
+	if choice == orphansKeep && len(o.containers) > 0 {
+		slog.Warn("earlier runs left containers behind; this run does not count the leases they hold (use -orphans=adopt or -orphans=remove)", "orphans", o.String())
+	}
+	return choice
+}
+
+// askOrphans has the operator choose between adopting, removing and keeping
+// the orphans.
+func askOrphans(o *orphanedResources, in io.Reader) string {
+	fmt.Printf("Earlier runs left %s.\n", o)
+	fmt.Println("Their clients may still hold leases this run would not count.")
+	reader := bufio.NewReader(in)
+	for {
+		fmt.Print("[a]dopt them into this run, [r]emove them, or [k]eep them as they are? ")
+		line, err := reader.ReadString('\n')
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "a", orphansAdopt:
+			return orphansAdopt
+		case "r", orphansRemove:
+			return orphansRemove
+		case "k", orphansKeep:
+			return orphansKeep
+		}
+		if err != nil {
+			return orphansKeep
+		}
+	}
+}
+
+// removeOrphans tears down what earlier runs left, as -cleanup does, sparing
+// this run's own resources when -resume continues it.
+func removeOrphans(ctx context.Context, cli containerRuntime, host *hostShell, networkName string) bool {
+	t := newTeardown(cli, host, networkName)
+	t.keep = runID
+	fmt.Println("=== Removing the resources of earlier runs ===")
+	return printTeardownReport(t.run(ctx))
+}
+
+// adoptOrphans takes the running clients of earlier runs that still hold a
+// lease into this run's lease table, so the budget, reserve and summary count
+// the addresses they hold, and removes the ones without a lease.
+func adoptOrphans(ctx context.Context, cli containerRuntime, leases *leaseTable) (adopted, removed int, err error) {
+	containers, err := cli.ContainerList(ctx, container.ListOptions{All: true, Filters: labelledFilter()})
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to list the containers of earlier runs: %v", err)
+	}
+	var restored []leaseRecord
+	for _, c := range containers {
+		if c.Labels[labelRun] == runID {
+			continue
+		}
+		r, ok := adoptContainer(ctx, cli, c.ID, nil)
+		if !ok {
+			slog.Info("removing client of an earlier run without a lease", "container", shortID(c.ID), "run_id", orDash(c.Labels[labelRun]), "state", c.State)
+			cli.ContainerRemove(ctx, c.ID, container.RemoveOptions{Force: true})
+			removed++
+			continue
+		}
+		restored = append(restored, r)
+		adopted++
+	}
+	leases.restore(restored)
+	return adopted, removed, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Output modes selectable with -output.
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// Verbosity levels set by -quiet and -v.
+const (
+	verbosityQuiet   = -1
+	verbosityNormal  = 0
+	verbosityVerbose = 1
+)
+
+// verbosity is how much progress output the run prints.
+var verbosity = verbosityNormal
+
+// buildProgress returns what of a successful build's output is printed at the
+// current verbosity: nothing when quiet, the Dockerfile steps and result by
+// default, and everything, including the output of each step, with -v.
+func buildProgress(output string) string {
+	switch verbosity {
+	case verbosityQuiet:
+		return ""
+	case verbosityVerbose:
+		return output
+	}
+	var b strings.Builder
+	for _, line := range strings.SplitAfter(output, "\n") {
+		if strings.HasPrefix(line, "Step ") || strings.HasPrefix(line, "Successfully ") {
+			b.WriteString(line)
+		}
+	}
+	return b.String()
+}
+
+// eventStream writes one JSON object per line for -output=json, so CI jobs
+// and scripts can follow a run without scraping its human-oriented output.
+type eventStream struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// events is the run's event stream, nil unless -output=json.
+var events *eventStream
+
+// setupOutput selects the output mode. In JSON mode stdout carries only
+// events; banners, logs and summaries move to stderr.
+func setupOutput(mode string) error {
+	switch mode {
+	case outputText:
+		return nil
+	case outputJSON:
+		events = &eventStream{enc: json.NewEncoder(os.Stdout)}
+		os.Stdout = os.Stderr
+		return nil
+	}
+	return fmt.Errorf("invalid output mode %q (use text or json)", mode)
+}
+
+// emit writes an event with its name, time and the given fields, and records
+// it in the audit log. A nil stream writes nothing.
+func (e *eventStream) emit(event string, fields map[string]any) {
+	audit.record(event, fields)
+	if e == nil {
+		return
+	}
+	record := map[string]any{"event": event, "time": clock.Now().UTC()}
+	for k, v := range fields {
+		record[k] = v
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.enc.Encode(record)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// launchPacing spaces out a worker's launches when no -rate or -ramp paces
+// them: each pause is interval plus a random part of jitter, and a worker's
+// first launch waits a random part of stagger, so the workers do not launch
+// in lockstep bursts that rate limiters spot and that skew latencies.
+type launchPacing struct {
+	interval time.Duration
+	jitter   time.Duration
+	stagger  time.Duration
+}
+
+func newLaunchPacing(cfg Config) (*launchPacing, error) {
+	switch {
+	case cfg.LaunchInterval < 0:
+		return nil, fmt.Errorf("-launch-interval must not be negative")
+	case cfg.LaunchJitter < 0:
+		return nil, fmt.Errorf("-launch-jitter must not be negative")
+	case cfg.LaunchStagger < 0:
+		return nil, fmt.Errorf("-launch-stagger must not be negative")
+	}
+	return &launchPacing{interval: cfg.LaunchInterval, jitter: cfg.LaunchJitter, stagger: cfg.LaunchStagger}, nil
+}
+
+// pause returns how long a worker waits before its next launch.
+func (p *launchPacing) pause() time.Duration {
+	return p.interval + randDuration(p.jitter)
+}
+
+// staggerStart holds a starting worker back a random part of the stagger,
+// or until ctx is done.
+func (p *launchPacing) staggerStart(ctx context.Context) {
+	d := randDuration(p.stagger)
+	if d == 0 {
+		return
+	}
+	_, span := startSpan(ctx, "worker.stagger")
+	defer span.End()
+	select {
+	case <-ctx.Done():
+	case <-clock.After(d):
+	}
+}
+
+// String describes the pacing for the run banner.
+func (p *launchPacing) String() string {
+	s := fmt.Sprintf("%s between launches", p.interval)
+	if p.jitter > 0 {
+		s = fmt.Sprintf("%s plus up to %s between launches", p.interval, p.jitter)
+	}
+	if p.stagger > 0 {
+		s += fmt.Sprintf(", first launches staggered over %s", p.stagger)
+	}
+	return s
+}
+
+// randDuration returns a random duration in [0, d), 0 for d of 0.
+func randDuration(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
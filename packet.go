@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// EtherTypes used with packet sockets.
+const (
+	etherTypeIPv4 uint16 = 0x0800
+	etherTypeARP  uint16 = 0x0806
+	etherTypeIPv6 uint16 = 0x86dd
+	etherTypeVLAN uint16 = 0x8100
+	etherTypeAll  uint16 = 0x0003
+)
+
+var broadcastMAC = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// packetConn is an AF_PACKET socket bound to one interface, used to send and
+// receive whole Ethernet frames with arbitrary source MACs.
+type packetConn struct {
+	fd    int
+	iface *net.Interface
+}
+
+// openPacketConn opens a raw packet socket on the named interface receiving
+// frames of the given EtherType.
+func openPacketConn(ifaceName string, etherType uint16) (*packetConn, error) {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up interface %s: %v", ifaceName, err)
+	}
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(etherType)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open packet socket (requires root): %v", err)
+	}
+	addr := &syscall.SockaddrLinklayer{Protocol: htons(etherType), Ifindex: iface.Index}
+	if err := syscall.Bind(fd, addr); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to bind packet socket to %s: %v", ifaceName, err)
+	}
+	return &packetConn{fd: fd, iface: iface}, nil
+}
+
+// setReadTimeout bounds how long readFrame blocks.
+func (c *packetConn) setReadTimeout(d time.Duration) error {
+	tv := syscall.NsecToTimeval(d.Nanoseconds())
+	return syscall.SetsockoptTimeval(c.fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv)
+}
+
+// writeFrame sends a complete Ethernet frame.
+func (c *packetConn) writeFrame(frame []byte) error {
+	addr := &syscall.SockaddrLinklayer{Ifindex: c.iface.Index, Halen: 6}
+	copy(addr.Addr[:], frame[0:6])
+	return syscall.Sendto(c.fd, frame, 0, addr)
+}
+
+// readFrame reads one Ethernet frame into buf. A read timeout is reported as
+// n == 0 with a nil error.
+func (c *packetConn) readFrame(buf []byte) (int, error) {
+	n, _, err := syscall.Recvfrom(c.fd, buf, 0)
+	if err == syscall.EAGAIN || err == syscall.EWOULDBLOCK || err == syscall.EINTR {
+		return 0, nil
+	}
+	return n, err
+}
+
+func (c *packetConn) Close() error {
+	return syscall.Close(c.fd)
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// udpFrame is the decoded view of an Ethernet/IPv4/UDP frame.
+type udpFrame struct {
+	SrcMAC, DstMAC   net.HardwareAddr
+	SrcIP, DstIP     net.IP
+	SrcPort, DstPort uint16
+	Payload          []byte
+	// TTL is the IPv4 time to live, 64 when zero.
+	TTL uint8
+}
+
+// buildUDPFrame assembles an Ethernet/IPv4/UDP frame. The UDP checksum is left
+// zero, which IPv4 permits.
+func buildUDPFrame(f udpFrame) []byte {
+	udpLen := 8 + len(f.Payload)
+	ipLen := 20 + udpLen
+	frame := make([]byte, 14+ipLen)
+
+	copy(frame[0:6], f.DstMAC)
+	copy(frame[6:12], f.SrcMAC)
+	binary.BigEndian.PutUint16(frame[12:14], etherTypeIPv4)
+
+	ip := frame[14:34]
+	ip[0] = 0x45 // version 4, 20-byte header
+	binary.BigEndian.PutUint16(ip[2:4], uint16(ipLen))
+	ip[8] = 64
+	if f.TTL != 0 {
+		ip[8] = f.TTL
+	}
+	ip[9] = syscall.IPPROTO_UDP
+	copy(ip[12:16], f.SrcIP.To4())
+	copy(ip[16:20], f.DstIP.To4())
+	binary.BigEndian.PutUint16(ip[10:12], ipChecksum(ip))
+
+	udp := frame[34:]
+	binary.BigEndian.PutUint16(udp[0:2], f.SrcPort)
+	binary.BigEndian.PutUint16(udp[2:4], f.DstPort)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(udpLen))
+	copy(udp[8:], f.Payload)
+	return frame
+}
+
+// parseUDPFrame decodes an Ethernet/IPv4/UDP frame, reporting false for
+// anything else.
+func parseUDPFrame(frame []byte) (udpFrame, bool) {
+	if len(frame) < 14+20+8 || binary.BigEndian.Uint16(frame[12:14]) != etherTypeIPv4 {
+		return udpFrame{}, false
+	}
+	ip := frame[14:]
+	ihl := int(ip[0]&0x0f) * 4
+	if ip[0]>>4 != 4 || ip[9] != syscall.IPPROTO_UDP || len(ip) < ihl+8 {
+		return udpFrame{}, false
+	}
+	udp := ip[ihl:]
+	udpLen := int(binary.BigEndian.Uint16(udp[4:6]))
+	if udpLen < 8 || udpLen > len(udp) {
+		udpLen = len(udp)
+	}
+	return udpFrame{
+		DstMAC:  net.HardwareAddr(frame[0:6]),
+		SrcMAC:  net.HardwareAddr(frame[6:12]),
+		SrcIP:   net.IP(ip[12:16]),
+		DstIP:   net.IP(ip[16:20]),
+		SrcPort: binary.BigEndian.Uint16(udp[0:2]),
+		DstPort: binary.BigEndian.Uint16(udp[2:4]),
+		Payload: udp[8:udpLen],
+	}, true
+}
+
+// buildUDP6Frame assembles an Ethernet/IPv6/UDP frame with the UDP checksum
+// IPv6 requires. TTL is the hop limit, 64 when zero.
+func buildUDP6Frame(f udpFrame) []byte {
+	udpLen := 8 + len(f.Payload)
+	frame := make([]byte, 14+40+udpLen)
+
+	copy(frame[0:6], f.DstMAC)
+	copy(frame[6:12], f.SrcMAC)
+	binary.BigEndian.PutUint16(frame[12:14], etherTypeIPv6)
+
+	ip := frame[14:54]
+	ip[0] = 0x60 // version 6
+	binary.BigEndian.PutUint16(ip[4:6], uint16(udpLen))
+	ip[6] = syscall.IPPROTO_UDP
+	ip[7] = 64
+	if f.TTL != 0 {
+		ip[7] = f.TTL
+	}
+	copy(ip[8:24], f.SrcIP.To16())
+	copy(ip[24:40], f.DstIP.To16())
+
+	udp := frame[54:]
+	binary.BigEndian.PutUint16(udp[0:2], f.SrcPort)
+	binary.BigEndian.PutUint16(udp[2:4], f.DstPort)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(udpLen))
+	copy(udp[8:], f.Payload)
+
+	// The checksum covers a pseudo-header of both addresses, the length and
+	// the next header, padded to whole 16-bit words.
+	sum := make([]byte, 0, 40+udpLen+1)
+	sum = append(sum, ip[8:40]...)
+	sum = binary.BigEndian.AppendUint32(sum, uint32(udpLen))
+	sum = append(sum, 0, 0, 0, syscall.IPPROTO_UDP)
+	sum = append(sum, udp...)
+	if len(sum)%2 == 1 {
+		sum = append(sum, 0)
+	}
+	checksum := ipChecksum(sum)
+	if checksum == 0 {
+		checksum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:8], checksum)
+	return frame
+}
+
+// parseUDP6Frame decodes an Ethernet/IPv6/UDP frame without extension
+// headers, reporting false for anything else.
+func parseUDP6Frame(frame []byte) (udpFrame, bool) {
+	if len(frame) < 14+40+8 || binary.BigEndian.Uint16(frame[12:14]) != etherTypeIPv6 {
+		return udpFrame{}, false
+	}
+	ip := frame[14:]
+	if ip[0]>>4 != 6 || ip[6] != syscall.IPPROTO_UDP {
+		return udpFrame{}, false
+	}
+	udp := ip[40:]
+	udpLen := int(binary.BigEndian.Uint16(udp[4:6]))
+	if udpLen < 8 || udpLen > len(udp) {
+		udpLen = len(udp)
+	}
+	return udpFrame{
+		DstMAC:  net.HardwareAddr(frame[0:6]),
+		SrcMAC:  net.HardwareAddr(frame[6:12]),
+		SrcIP:   net.IP(ip[8:24]),
+		DstIP:   net.IP(ip[24:40]),
+		SrcPort: binary.BigEndian.Uint16(udp[0:2]),
+		DstPort: binary.BigEndian.Uint16(udp[2:4]),
+		Payload: udp[8:udpLen],
+		TTL:     ip[7],
+	}, true
+}
+
+// ipChecksum computes the Internet checksum of an IPv4 header, or of any
+// data padded to whole 16-bit words.
+func ipChecksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i : i+2]))
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	dhcpv6ClientPort = 546
+	dhcpv6ServerPort = 547
+
+	pcapSnapLen       = 65535
+	pcapLinkEthernet  = 1
+	pcapMagicMicrosec = 0xa1b2c3d4
+)
+
+// pcapCapture writes the DHCP and DHCPv6 frames seen on an interface to a
+// pcap file. Records are written unbuffered so the file stays readable if the
+// run is interrupted.
+type pcapCapture struct {
+	conn    *packetConn
+	file    *os.File
+	cancel  context.CancelFunc
+	done    chan struct{}
+	mu      sync.Mutex
+	packets int
+	err     error
+}
+
+// startPCAP begins capturing DHCP traffic on iface into path. The capture
+// runs until stop is called.
+func startPCAP(iface, path string) (*pcapCapture, error) {
+	// ETH_P_ALL so the clients' own outgoing frames are captured as well.
+	conn, err := openPacketConn(iface, etherTypeAll)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.setReadTimeout(500 * time.Millisecond); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to set socket timeout: %v", err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create pcap file: %v", err)
+	}
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:4], pcapMagicMicrosec)
+	binary.LittleEndian.PutUint16(header[4:6], 2)
+	binary.LittleEndian.PutUint16(header[6:8], 4)
+	binary.LittleEndian.PutUint32(header[16:20], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:24], pcapLinkEthernet)
+	if _, err := f.Write(header); err != nil {
+		conn.Close()
+		f.Close()
+		return nil, fmt.Errorf("failed to write pcap header: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &pcapCapture{conn: conn, file: f, cancel: cancel, done: make(chan struct{})}
+	go p.capture(ctx)
+	fmt.Printf("Capturing DHCP traffic on %s to %s\n", iface, path)
+	return p, nil
+}
+
+func (p *pcapCapture) capture(ctx context.Context) {
+	defer close(p.done)
+	buf := make([]byte, pcapSnapLen)
+	for ctx.Err() == nil {
+		n, err := p.conn.readFrame(buf)
+		if err != nil || n == 0 || !isDHCPFrame(buf[:n]) {
+			continue
+		}
+		if err := p.write(clock.Now(), buf[:n]); err != nil {
+			slog.Error("pcap capture stopped", "error", err)
+			p.mu.Lock()
+			p.err = err
+			p.mu.Unlock()
+			return
+		}
+	}
+}
+
+// write appends one frame as a pcap record.
+func (p *pcapCapture) write(ts time.Time, frame []byte) error {
+	record := make([]byte, 16+len(frame))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(record[4:8], uint32(ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:12], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(record[12:16], uint32(len(frame)))
+	copy(record[16:], frame)
+	if _, err := p.file.Write(record); err != nil {
+		return fmt.Errorf("failed to write pcap record: %v", err)
+	}
+	p.mu.Lock()
+	p.packets++
+	p.mu.Unlock()
+	return nil
+}
+
+// stop ends the capture and closes the file.
+func (p *pcapCapture) stop() error {
+	p.cancel()
+	<-p.done
+	p.conn.Close()
+	if err := p.file.Close(); err != nil {
+		return fmt.Errorf("failed to close pcap file: %v", err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	fmt.Printf("Captured %d DHCP packets to %s\n", p.packets, p.file.Name())
+	return nil
+}
+
+// isDHCPFrame reports whether frame is UDP to or from the DHCP (67/68) or
+// DHCPv6 (546/547) ports, over IPv4 or IPv6 and optionally VLAN tagged.
+func isDHCPFrame(frame []byte) bool {
+	if len(frame) < 14 {
+		return false
+	}
+	etherType := binary.BigEndian.Uint16(frame[12:14])
+	payload := frame[14:]
+	if etherType == etherTypeVLAN && len(frame) >= 18 {
+		etherType = binary.BigEndian.Uint16(frame[16:18])
+		payload = frame[18:]
+	}
+
+	var udp []byte
+	switch etherType {
+	case etherTypeIPv4:
+		if len(payload) < 20 || payload[0]>>4 != 4 || payload[9] != syscall.IPPROTO_UDP {
+			return false
+		}
+		ihl := int(payload[0]&0x0f) * 4
+		if len(payload) < ihl+4 {
+			return false
+		}
+		udp = payload[ihl:]
+	case etherTypeIPv6:
+		// DHCPv6 messages carry no extension headers in practice.
+		if len(payload) < 44 || payload[6] != syscall.IPPROTO_UDP {
+			return false
+		}
+		udp = payload[40:]
+	default:
+		return false
+	}
+	src, dst := binary.BigEndian.Uint16(udp[0:2]), binary.BigEndian.Uint16(udp[2:4])
+	for _, port := range []uint16{src, dst} {
+		switch port {
+		case dhcpServerPort, dhcpClientPort, dhcpv6ClientPort, dhcpv6ServerPort:
+			return true
+		}
+	}
+	return false
+}
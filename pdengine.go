@@ -0,0 +1,597 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DHCPv6 message types and options (RFC 8415) the prefix delegation engine
+// uses.
+const (
+	dhcpv6Solicit   byte = 1
+	dhcpv6Advertise byte = 2
+	dhcpv6Request   byte = 3
+	dhcpv6Renew     byte = 5
+	dhcpv6Reply     byte = 7
+	dhcpv6Release   byte = 8
+
+	optv6ClientID    uint16 = 1
+	optv6ServerID    uint16 = 2
+	optv6ElapsedTime uint16 = 8
+	optv6StatusCode  uint16 = 13
+	optv6IAPD        uint16 = 25
+	optv6IAPrefix    uint16 = 26
+
+	dhcpv6NoBinding     uint16 = 3
+	dhcpv6NoPrefixAvail uint16 = 6
+)
+
+var (
+	// allDHCPServers is All_DHCP_Relay_Agents_and_Servers, and
+	// allDHCPServersMAC its Ethernet multicast address.
+	allDHCPServers    = net.ParseIP("ff02::1:2")
+	allDHCPServersMAC = net.HardwareAddr{0x33, 0x33, 0x00, 0x01, 0x00, 0x02}
+)
+
+// dhcpv6Option is one option of a DHCPv6 message, or of an IA_PD or
+// IAPREFIX option.
+type dhcpv6Option struct {
+	Code uint16
+	Data []byte
+}
+
+// dhcpv6Message is a client or server DHCPv6 message; the transaction ID is
+// 24 bits.
+type dhcpv6Message struct {
+	Type    byte
+	XID     uint32
+	Options []dhcpv6Option
+	// Source is the address a received message came from.
+	Source net.IP
+}
+
+func (m *dhcpv6Message) addOption(code uint16, data []byte) {
+	m.Options = append(m.Options, dhcpv6Option{Code: code, Data: data})
+}
+
+// option returns the data of the first option with code, or nil.
+func (m *dhcpv6Message) option(code uint16) []byte {
+	return findDHCPv6Option(m.Options, code)
+}
+
+func (m *dhcpv6Message) marshal() []byte {
+	b := []byte{m.Type, byte(m.XID >> 16), byte(m.XID >> 8), byte(m.XID)}
+	return appendDHCPv6Options(b, m.Options)
+}
+
+func appendDHCPv6Options(b []byte, options []dhcpv6Option) []byte {
+	for _, o := range options {
+		b = binary.BigEndian.AppendUint16(b, o.Code)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(o.Data)))
+		b = append(b, o.Data...)
+	}
+	return b
+}
+
+// parseDHCPv6 decodes a DHCPv6 message, copying it out of b.
+func parseDHCPv6(b []byte) (*dhcpv6Message, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("DHCPv6 message too short: %d bytes", len(b))
+	}
+	options, err := parseDHCPv6Options(b[4:])
+	if err != nil {
+		return nil, err
+	}
+	return &dhcpv6Message{Type: b[0], XID: uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3]), Options: options}, nil
+}
+
+func parseDHCPv6Options(b []byte) ([]dhcpv6Option, error) {
+	var options []dhcpv6Option
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, fmt.Errorf("truncated DHCPv6 option")
+		}
+		code, n := binary.BigEndian.Uint16(b[0:2]), int(binary.BigEndian.Uint16(b[2:4]))
+		if len(b) < 4+n {
+			return nil, fmt.Errorf("DHCPv6 option %d overruns the message", code)
+		}
+		options = append(options, dhcpv6Option{Code: code, Data: append([]byte(nil), b[4:4+n]...)})
+		b = b[4+n:]
+	}
+	return options, nil
+}
+
+func findDHCPv6Option(options []dhcpv6Option, code uint16) []byte {
+	for _, o := range options {
+		if o.Code == code {
+			return o.Data
+		}
+	}
+	return nil
+}
+
+// dhcpv6Status returns the status code among options, 0 (Success) when
+// there is none.
+func dhcpv6Status(options []dhcpv6Option) uint16 {
+	if status := findDHCPv6Option(options, optv6StatusCode); len(status) >= 2 {
+		return binary.BigEndian.Uint16(status)
+	}
+	return 0
+}
+
+func dhcpv6TypeName(t byte) string {
+	names := map[byte]string{
+		dhcpv6Solicit:   "SOLICIT",
+		dhcpv6Advertise: "ADVERTISE",
+		dhcpv6Request:   "REQUEST",
+		dhcpv6Renew:     "RENEW",
+		dhcpv6Reply:     "REPLY",
+		dhcpv6Release:   "RELEASE",
+	}
+	if name, ok := names[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("type %d", t)
+}
+
+// delegatedPrefix is one prefix of an IA_PD.
+type delegatedPrefix struct {
+	Prefix           *net.IPNet
+	Preferred, Valid time.Duration
+}
+
+// iaPD builds an IA_PD option for iaid asking for prefixes, or, without
+// any, for a prefix of length bits (0 for the server's choice).
+func iaPD(iaid uint32, prefixes []delegatedPrefix, length int) []byte {
+	b := binary.BigEndian.AppendUint32(nil, iaid)
+	b = append(b, make([]byte, 8)...) // T1 and T2 are the server's choice
+	var options []dhcpv6Option
+	for _, p := range prefixes {
+		ones, _ := p.Prefix.Mask.Size()
+		options = append(options, dhcpv6Option{Code: optv6IAPrefix, Data: iaPrefix(p.Prefix.IP, ones)})
+	}
+	if len(prefixes) == 0 && length > 0 {
+		options = append(options, dhcpv6Option{Code: optv6IAPrefix, Data: iaPrefix(net.IPv6zero, length)})
+	}
+	return appendDHCPv6Options(b, options)
+}
+
+// iaPrefix builds IAPREFIX option data with lifetimes left to the server.
+func iaPrefix(prefix net.IP, length int) []byte {
+	b := make([]byte, 8, 25)
+	b = append(b, byte(length))
+	return append(b, prefix.To16()...)
+}
+
+// parseIAPD returns the prefixes of the IA_PD options of a server message,
+// and the status code an IA_PD carries when it has none.
+func parseIAPD(msg *dhcpv6Message) ([]delegatedPrefix, uint16) {
+	var prefixes []delegatedPrefix
+	status := dhcpv6Status(msg.Options)
+	for _, o := range msg.Options {
+		if o.Code != optv6IAPD || len(o.Data) < 12 {
+			continue
+		}
+		options, err := parseDHCPv6Options(o.Data[12:])
+		if err != nil {
+			continue
+		}
+		if s := dhcpv6Status(options); s != 0 {
+			status = s
+		}
+		for _, p := range options {
+			if p.Code != optv6IAPrefix || len(p.Data) < 25 {
+				continue
+			}
+			valid := binary.BigEndian.Uint32(p.Data[4:8])
+			if valid == 0 {
+				continue
+			}
+			length := int(p.Data[8])
+			prefixes = append(prefixes, delegatedPrefix{
+				Prefix:    &net.IPNet{IP: net.IP(p.Data[9:25]), Mask: net.CIDRMask(length, 128)},
+				Preferred: time.Duration(binary.BigEndian.Uint32(p.Data[0:4])) * time.Second,
+				Valid:     time.Duration(valid) * time.Second,
+			})
+		}
+	}
+	if len(prefixes) > 0 {
+		status = 0
+	}
+	return prefixes, status
+}
+
+// pdLease is a prefix delegated to one of the engine's clients.
+type pdLease struct {
+	MAC      net.HardwareAddr
+	DUID     []byte
+	Prefixes []delegatedPrefix
+	// Server is the link-local address the server answered from, and
+	// ServerID its DUID.
+	Server   net.IP
+	ServerID []byte
+	Acquired time.Time
+}
+
+// pdEngine exhausts the delegated prefix pools of DHCPv6-PD servers, as
+// ISP-style routers and lab servers run them: every client solicits an
+// IA_PD under a DUID of its own (DUID-LL of its spoofed MAC) and holds the
+// prefix it is delegated. Frames go out from the host's own MAC and
+// link-local address, which the server answers unicast, so the replies reach
+// the packet socket without promiscuous mode or neighbor discovery for the
+// clients, and Wi-Fi parents work too; servers bind prefixes to the DUID and
+// IAID only.
+type pdEngine struct {
+	conn  *packetConn
+	srcIP net.IP
+	// length is the prefix length hinted in every SOLICIT, 0 for none.
+	length int
+
+	mu         sync.Mutex
+	pending    map[uint32]chan *dhcpv6Message
+	leases     map[string]*pdLease
+	advertises int
+	replies    int
+	noPrefix   int
+}
+
+// pdIAID is the IAID of every client's IA_PD; each client has its own DUID.
+const pdIAID = 1
+
+var pdCapabilities = engineCapabilities{Wireless: true}
+
+func newPDEngine(iface string, length int) (*pdEngine, error) {
+	if length < 0 || length > 128 {
+		return nil, fmt.Errorf("-pd-length must be between 0 and 128")
+	}
+	conn, err := openPacketConn(iface, etherTypeIPv6)
+	if err != nil {
+		return nil, err
+	}
+	srcIP, err := linkLocalAddr(conn.iface)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := conn.setReadTimeout(500 * time.Millisecond); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to set socket timeout: %v", err)
+	}
+	return &pdEngine{
+		conn:    conn,
+		srcIP:   srcIP,
+		length:  length,
+		pending: make(map[uint32]chan *dhcpv6Message),
+		leases:  make(map[string]*pdLease),
+	}, nil
+}
+
+// linkLocalAddr returns the IPv6 link-local address of iface, which the
+// kernel answers neighbor solicitations for.
+func linkLocalAddr(iface *net.Interface) (net.IP, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the addresses of %s: %v", iface.Name, err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() == nil && ipNet.IP.IsLinkLocalUnicast() {
+			return ipNet.IP, nil
+		}
+	}
+	return nil, fmt.Errorf("%s has no IPv6 link-local address; enable IPv6 on it for -mode=pd", iface.Name)
+}
+
+// describePDLength describes the prefix length -pd-length hints.
+func describePDLength(length int) string {
+	if length == 0 {
+		return "any prefix length"
+	}
+	return fmt.Sprintf("hinting /%d", length)
+}
+
+func (e *pdEngine) Name() string                     { return modePD }
+func (e *pdEngine) Capabilities() engineCapabilities { return pdCapabilities }
+
+// receive reads server replies and routes them to the transaction waiting on
+// their transaction ID until ctx is cancelled.
+func (e *pdEngine) receive(ctx context.Context) {
+	buf := make([]byte, 65536)
+	for ctx.Err() == nil {
+		n, err := e.conn.readFrame(buf)
+		if err != nil || n == 0 {
+			continue
+		}
+		frame, ok := parseUDP6Frame(buf[:n])
+		if !ok || frame.SrcPort != dhcpv6ServerPort || frame.DstPort != dhcpv6ClientPort {
+			continue
+		}
+		msg, err := parseDHCPv6(frame.Payload)
+		if err != nil || (msg.Type != dhcpv6Advertise && msg.Type != dhcpv6Reply) {
+			continue
+		}
+		msg.Source = append(net.IP(nil), frame.SrcIP...)
+		e.mu.Lock()
+		ch, ok := e.pending[msg.XID]
+		e.mu.Unlock()
+		if ok {
+			select {
+			case ch <- msg:
+			default:
+			}
+		}
+	}
+}
+
+// send multicasts a client message to the servers on the link.
+func (e *pdEngine) send(msg *dhcpv6Message) error {
+	frame := buildUDP6Frame(udpFrame{
+		SrcMAC:  e.conn.iface.HardwareAddr,
+		DstMAC:  allDHCPServersMAC,
+		SrcIP:   e.srcIP,
+		DstIP:   allDHCPServers,
+		SrcPort: dhcpv6ClientPort,
+		DstPort: dhcpv6ServerPort,
+		TTL:     1,
+		Payload: msg.marshal(),
+	})
+	return e.conn.writeFrame(frame)
+}
+
+// transact sends msg up to attempts times and waits for a reply of type
+// want, updating the elapsed time option on every retransmission.
+func (e *pdEngine) transact(ctx context.Context, msg *dhcpv6Message, attempts int, timeout time.Duration, want byte) (*dhcpv6Message, error) {
+	ch := make(chan *dhcpv6Message, 8)
+	e.mu.Lock()
+	e.pending[msg.XID] = ch
+	e.mu.Unlock()
+	defer func() {
+		e.mu.Lock()
+		delete(e.pending, msg.XID)
+		e.mu.Unlock()
+	}()
+
+	start := clock.Now()
+	for attempt := 0; attempt < attempts; attempt++ {
+		elapsed := min(clock.Since(start).Milliseconds()/10, 0xffff)
+		for i := range msg.Options {
+			if msg.Options[i].Code == optv6ElapsedTime {
+				msg.Options[i].Data = binary.BigEndian.AppendUint16(nil, uint16(elapsed))
+			}
+		}
+		if err := e.send(msg); err != nil {
+			return nil, fmt.Errorf("failed to send %s: %v", dhcpv6TypeName(msg.Type), err)
+		}
+		deadline := clock.After(timeout)
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-deadline:
+				break wait
+			case reply := <-ch:
+				if reply.Type == want {
+					return reply, nil
+				}
+			}
+		}
+	}
+	return nil, nil
+}
+
+// newDHCPv6Request starts a client message with a fresh transaction ID, the
+// client's DUID and an elapsed time.
+func newDHCPv6Request(t byte, duid []byte) *dhcpv6Message {
+	msg := &dhcpv6Message{Type: t, XID: rand.Uint32() & 0xffffff}
+	msg.addOption(optv6ClientID, duid)
+	msg.addOption(optv6ElapsedTime, []byte{0, 0})
+	return msg
+}
+
+// pdDUID returns the DUID-LL (RFC 8415 section 11.4) of mac.
+func pdDUID(mac net.HardwareAddr) []byte {
+	return append([]byte{0, 3, 0, 1}, mac...)
+}
+
+// acquire runs a SOLICIT/ADVERTISE/REQUEST/REPLY exchange for an IA_PD
+// under mac's DUID.
+func (e *pdEngine) acquire(ctx context.Context, mac net.HardwareAddr) (*pdLease, error) {
+	duid := pdDUID(mac)
+	solicit := newDHCPv6Request(dhcpv6Solicit, duid)
+	solicit.addOption(optv6IAPD, iaPD(pdIAID, nil, e.length))
+	advertise, err := e.transact(ctx, solicit, 3, 3*time.Second, dhcpv6Advertise)
+	if err != nil {
+		return nil, err
+	}
+	if advertise == nil {
+		return nil, fmt.Errorf("no advertise for %s: client %w", mac, ErrNoLease)
+	}
+	offered, status := parseIAPD(advertise)
+	e.mu.Lock()
+	e.advertises++
+	if len(offered) == 0 {
+		if status == dhcpv6NoPrefixAvail {
+			e.noPrefix++
+		}
+		e.mu.Unlock()
+		return nil, fmt.Errorf("no prefix advertised for %s (status %d): client %w", mac, status, ErrNoLease)
+	}
+	e.mu.Unlock()
+
+	serverID := advertise.option(optv6ServerID)
+	request := newDHCPv6Request(dhcpv6Request, duid)
+	request.addOption(optv6ServerID, serverID)
+	request.addOption(optv6IAPD, iaPD(pdIAID, offered, 0))
+	reply, err := e.transact(ctx, request, 2, 3*time.Second, dhcpv6Reply)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, fmt.Errorf("%w for %s after advertise of %s", ErrNoACK, mac, offered[0].Prefix)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.replies++
+	prefixes, status := parseIAPD(reply)
+	if len(prefixes) == 0 {
+		if status == dhcpv6NoPrefixAvail {
+			e.noPrefix++
+		}
+		return nil, fmt.Errorf("server %w request for %s from %s (status %d)", ErrNAK, offered[0].Prefix, mac, status)
+	}
+	lease := &pdLease{
+		MAC:      mac,
+		DUID:     duid,
+		Prefixes: prefixes,
+		Server:   reply.Source,
+		ServerID: serverID,
+		Acquired: clock.Now(),
+	}
+	e.leases[mac.String()] = lease
+	return lease, nil
+}
+
+// Launch has the spec's MAC solicit a delegated prefix. The lease's address
+// is the first prefix delegated, and its client identifier the DUID.
+func (e *pdEngine) Launch(ctx context.Context, spec launchSpec) (launchResult, error) {
+	lease, err := e.acquire(ctx, spec.MAC)
+	if err != nil {
+		return launchResult{}, err
+	}
+	return launchResult{
+		MAC:       lease.MAC.String(),
+		IP:        lease.Prefixes[0].Prefix.String(),
+		LeaseTime: lease.Prefixes[0].Valid,
+		Server:    lease.Server.String(),
+		ClientID:  formatClientID(lease.DUID),
+	}, nil
+}
+
+// lease returns the lease held by the client with the record's MAC.
+func (e *pdEngine) lease(r leaseRecord) (*pdLease, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	lease, ok := e.leases[r.MAC]
+	if !ok {
+		return nil, fmt.Errorf("no prefix held for %s", r.MAC)
+	}
+	return lease, nil
+}
+
+// Release gives the client's prefixes back with a RELEASE, without waiting
+// for the server's REPLY.
+func (e *pdEngine) Release(ctx context.Context, r leaseRecord) error {
+	lease, err := e.lease(r)
+	if err != nil {
+		return err
+	}
+	msg := newDHCPv6Request(dhcpv6Release, lease.DUID)
+	msg.addOption(optv6ServerID, lease.ServerID)
+	msg.addOption(optv6IAPD, iaPD(pdIAID, lease.Prefixes, 0))
+	if err := e.send(msg); err != nil {
+		return fmt.Errorf("failed to send RELEASE: %v", err)
+	}
+	e.mu.Lock()
+	delete(e.leases, r.MAC)
+	e.mu.Unlock()
+	return nil
+}
+
+// Verify renews the client's prefixes: DHCPv6 has no way to confirm a
+// delegated prefix that leaves the binding alone.
+func (e *pdEngine) Verify(ctx context.Context, r leaseRecord) error {
+	return e.Renew(ctx, r)
+}
+
+// Renew sends a RENEW for the client's prefixes to the server that
+// delegated them.
+func (e *pdEngine) Renew(ctx context.Context, r leaseRecord) error {
+	lease, err := e.lease(r)
+	if err != nil {
+		return err
+	}
+	msg := newDHCPv6Request(dhcpv6Renew, lease.DUID)
+	msg.addOption(optv6ServerID, lease.ServerID)
+	msg.addOption(optv6IAPD, iaPD(pdIAID, lease.Prefixes, 0))
+	reply, err := e.transact(ctx, msg, 2, 3*time.Second, dhcpv6Reply)
+	switch {
+	case err != nil:
+		return err
+	case reply == nil:
+		return fmt.Errorf("no reply renewing %s for %s", r.IP, r.MAC)
+	}
+	prefixes, status := parseIAPD(reply)
+	if len(prefixes) == 0 {
+		if status == dhcpv6NoBinding {
+			return fmt.Errorf("server %w renewal of %s for %s: no binding", ErrNAK, r.IP, r.MAC)
+		}
+		return fmt.Errorf("server %w renewal of %s for %s (status %d)", ErrNAK, r.IP, r.MAC, status)
+	}
+	e.mu.Lock()
+	lease.Prefixes = prefixes
+	e.mu.Unlock()
+	return nil
+}
+
+// printSummary reports the engine's transaction counters and the prefixes
+// it holds, by length.
+func (e *pdEngine) printSummary() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	fmt.Printf("Advertises:        %d\n", e.advertises)
+	fmt.Printf("Replies received:  %d\n", e.replies)
+	fmt.Printf("NoPrefixAvail:     %d\n", e.noPrefix)
+	type held struct {
+		prefix *net.IPNet
+		mac    string
+	}
+	var prefixes []held
+	byLength := make(map[int]int)
+	for _, lease := range e.leases {
+		for _, p := range lease.Prefixes {
+			prefixes = append(prefixes, held{p.Prefix, lease.MAC.String()})
+			ones, _ := p.Prefix.Mask.Size()
+			byLength[ones]++
+		}
+	}
+	fmt.Printf("Prefixes held:     %d\n", len(prefixes))
+	lengths := make([]int, 0, len(byLength))
+	for length := range byLength {
+		lengths = append(lengths, length)
+	}
+	sort.Ints(lengths)
+	for _, length := range lengths {
+		fmt.Printf("  /%-3d %d\n", length, byLength[length])
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		return string(prefixes[i].prefix.IP.To16()) < string(prefixes[j].prefix.IP.To16())
+	})
+	for _, p := range prefixes {
+		fmt.Printf("  %-43s %s\n", p.prefix, p.mac)
+	}
+}
+
+func checkPDEngine(cfg Config) error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("needs root for a packet socket")
+	}
+	netCfg, err := detectNetwork(localHost, cfg.Interface, false)
+	if err != nil {
+		return err
+	}
+	conn, err := openPacketConn(netCfg.Parent, etherTypeIPv6)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = linkLocalAddr(conn.iface)
+	return err
+}
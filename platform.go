@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// clientPlatform is the platform client images are built, pulled and run
+// for: -platform, or the container engine's own, so a Raspberry Pi drop box
+// gets arm64 images and a laptop amd64 ones. It is nil until
+// resolvePlatform sets it, which leaves the choice to the engine.
+var clientPlatform *ocispec.Platform
+
+// resolvePlatform sets clientPlatform from -platform, or from the engine's
+// OS and architecture when it is empty, and returns it.
+func resolvePlatform(ctx context.Context, cli containerRuntime, platform string) (*ocispec.Platform, error) {
+	if platform != "" {
+		p, err := parsePlatform(platform)
+		if err != nil {
+			return nil, err
+		}
+		clientPlatform = p
+		return p, nil
+	}
+	v, err := cli.ServerVersion(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the engine's platform: %w", runtimeError(err))
+	}
+	// The engine reports Go's GOOS and GOARCH, which are the OCI names.
+	clientPlatform = &ocispec.Platform{OS: v.Os, Architecture: v.Arch}
+	return clientPlatform, nil
+}
+
+// parsePlatform parses os/arch[/variant], e.g. linux/arm64 or linux/arm/v7.
+func parsePlatform(s string) (*ocispec.Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid -platform %q (use os/arch[/variant], e.g. linux/arm64)", s)
+	}
+	p := &ocispec.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// platformString formats p as the build and pull APIs take it, or returns
+// "" for nil, which leaves the platform to the engine.
+func platformString(p *ocispec.Platform) string {
+	if p == nil {
+		return ""
+	}
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// preflightWait is how long the pre-flight DISCOVER collects offers.
+const preflightWait = 3 * time.Second
+
+// offeringServer is a DHCP server that answered the pre-flight DISCOVER.
+type offeringServer struct {
+	IP        net.IP
+	MAC       net.HardwareAddr
+	Offered   net.IP
+	Mask      net.IPMask
+	LeaseTime time.Duration
+	Options   []dhcpOption
+}
+
+// discoverServers broadcasts a DISCOVER from iface's own MAC and collects
+// every offer made within wait, one per server. No REQUEST follows, so no
+// lease is taken.
+func discoverServers(iface string, wait time.Duration) ([]offeringServer, error) {
+	conn, err := openPacketConn(iface, etherTypeIPv4)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.setReadTimeout(500 * time.Millisecond); err != nil {
+		return nil, fmt.Errorf("failed to set socket timeout: %v", err)
+	}
+
+	mac := conn.iface.HardwareAddr
+	discover := newDHCPRequest(dhcpDiscover, rand.Uint32(), mac)
+	discover.addOption(optClientID, append([]byte{1}, mac...))
+	discover.addOption(optParamRequest, []byte{optSubnetMask, optRouter, optDNS, optLeaseTime, optServerID})
+	frame := buildUDPFrame(udpFrame{
+		SrcMAC:  mac,
+		DstMAC:  broadcastMAC,
+		SrcIP:   net.IPv4zero,
+		DstIP:   net.IPv4bcast,
+		SrcPort: dhcpClientPort,
+		DstPort: dhcpServerPort,
+		Payload: discover.marshal(),
+	})
+	if err := conn.writeFrame(frame); err != nil {
+		return nil, fmt.Errorf("failed to send DISCOVER on %s: %v", iface, err)
+	}
+
+	var servers []offeringServer
+	seen := make(map[string]bool)
+	buf := make([]byte, 65536)
+	for deadline := clock.Now().Add(wait); clock.Now().Before(deadline); {
+		n, err := conn.readFrame(buf)
+		if err != nil || n == 0 {
+			continue
+		}
+		frame, ok := parseUDPFrame(buf[:n])
+		if !ok || frame.SrcPort != dhcpServerPort || frame.DstPort != dhcpClientPort {
+			continue
+		}
+		msg, err := parseDHCP(frame.Payload)
+		if err != nil || msg.Op != bootReply || msg.XID != discover.XID || msg.msgType() != dhcpOffer {
+			continue
+		}
+		ip := msg.serverID()
+		if ip == nil {
+			ip = frame.SrcIP
+		}
+		if seen[ip.String()] {
+			continue
+		}
+		seen[ip.String()] = true
+		servers = append(servers, offeringServer{
+			IP:        append(net.IP(nil), ip...),
+			MAC:       append(net.HardwareAddr(nil), frame.SrcMAC...),
+			Offered:   msg.YIAddr,
+			Mask:      net.IPMask(msg.option(optSubnetMask)),
+			LeaseTime: msg.leaseTime(),
+			Options:   msg.Options,
+		})
+	}
+	return servers, nil
+}
+
+// describe formats what the server offered for the pre-flight report.
+func (s offeringServer) describe() string {
+	offered := s.Offered.String()
+	if len(s.Mask) == 4 {
+		ones, _ := s.Mask.Size()
+		offered += "/" + strconv.Itoa(ones)
+	}
+	parts := []string{"offered " + offered}
+	if s.LeaseTime > 0 {
+		parts = append(parts, "lease "+s.LeaseTime.String())
+	}
+	var codes []string
+	for _, opt := range s.Options {
+		switch opt.Code {
+		case optRouter:
+			if len(opt.Data) >= 4 {
+				parts = append(parts, "router "+net.IP(opt.Data[:4]).String())
+			}
+		case optDNS:
+			var dns []string
+			for i := 0; i+4 <= len(opt.Data); i += 4 {
+				dns = append(dns, net.IP(opt.Data[i:i+4]).String())
+			}
+			parts = append(parts, "DNS "+strings.Join(dns, ","))
+		}
+		codes = append(codes, strconv.Itoa(int(opt.Code)))
+	}
+	return strings.Join(parts, ", ") + " [options " + strings.Join(codes, ",") + "]"
+}
+
+// preflight lists the DHCP servers answering on iface before anything is
+// launched. More than one server usually means the wrong segment or a rogue
+// server already present, so it is an error unless force is set, or the run
+// targets one of them with -server; a target that does not answer is an
+// error too.
+func preflight(iface string, trusted []string, target string, force bool) error {
+	fmt.Printf("Pre-flight: looking for DHCP servers on %s...\n", iface)
+	servers, err := discoverServers(iface, preflightWait)
+	if err != nil {
+		return err
+	}
+	fmt.Println("=== DHCP Servers ===")
+	if len(servers) == 0 {
+		fmt.Printf("No DHCP server answered on %s within %s\n", iface, preflightWait)
+		return nil
+	}
+	targetFound := false
+	for _, s := range servers {
+		note := ""
+		switch {
+		case s.IP.String() == target:
+			note = "  <- -server target"
+			targetFound = true
+		case target != "":
+			note = "  <- ignored"
+		case len(trusted) > 0 && !slices.Contains(trusted, s.IP.String()):
+			note = "  <- not in -trusted-servers"
+		}
+		fmt.Printf("  %-15s %s  %s%s\n", s.IP, s.MAC, s.describe(), note)
+	}
+	if target != "" {
+		if !targetFound && !force {
+			return fmt.Errorf("-server %s did not answer on %s; check the address, or use -force to launch anyway", target, iface)
+		}
+		return nil
+	}
+	if len(servers) > 1 && !force {
+		return fmt.Errorf("%d DHCP servers answered on %s; check the target segment, or use -force to launch anyway", len(servers), iface)
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// runPreload implements the preload subcommand, which builds the client
+// images once and loads them onto the Docker engines of the hosts that are
+// to run them.
+func runPreload(args []string) {
+	fs := flag.NewFlagSet("preload", flag.ExitOnError)
+	var engines, dockerfiles stringList
+	fs.Var(&engines, "engines", "Comma-separated Docker engines to load the images onto, e.g. tcp://10.0.0.5:2376 or ssh://root@10.0.0.6")
+	fs.Var(&dockerfiles, "dockerfiles", "Comma-separated directories to build the images from (default: the ipocalypse* directories)")
+	buildWorkers := fs.Int("build-workers", defaultConfig().BuildWorkers, "Number of images built concurrently")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage:
+  ./ipocalypse preload -engines tcp://host:port,... [-dockerfiles dir,...] [-build-workers N]
+
+Builds the client images here once and loads them onto every engine, e.g.
+the Docker engines of the hosts that exhaust the pool together:
+  ./ipocalypse preload -engines tcp://10.0.0.5:2376,ssh://root@10.0.0.6
+then, on each of those hosts:
+  sudo ./ipocalypse -no-build
+
+Those runs launch identical images, checked by ID, and start at once
+instead of as each build finishes. Engines are reached as -host reaches
+them; DOCKER_CERT_PATH and DOCKER_TLS_VERIFY apply to tcp:// engines.
+
+Options:
+`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if len(engines) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	dirs := []string(dockerfiles)
+	if len(dirs) == 0 {
+		found, err := getIpocalypseDirs()
+		if err != nil {
+			fmt.Printf("Error discovering directories: %v\n", err)
+			os.Exit(1)
+		}
+		dirs = found
+	}
+	if err := preloadImages(dirs, engines, *buildWorkers); err != nil {
+		fmt.Printf("[ERROR] Image preload failed: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// preloadResult is how loading the images onto one engine went.
+type preloadResult struct {
+	engine  string
+	elapsed time.Duration
+	err     error
+}
+
+// preloadImages builds the images of dirs on the local engine, saves them as
+// one archive, as `docker save` does, and loads it onto every engine at once.
+func preloadImages(dirs, engines []string, buildWorkers int) error {
+	ctx := context.Background()
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("failed to create Docker client: %v", err)
+	}
+	names := make([]string, 0, len(dirs))
+	builds := make([]*imageBuild, 0, len(dirs))
+	for _, dir := range dirs {
+		imageName := buildImageName(dir)
+		// Built as a run would build it, honouring the manifest's dockerfile.
+		manifest, err := loadManifest(dir)
+		if err != nil {
+			return err
+		}
+		dockerfile := defaultConfig().Dockerfile
+		if manifest.Dockerfile != "" {
+			dockerfile = manifest.Dockerfile
+		}
+		if err := checkBuildContext(dir, dockerfile); err != nil {
+			return err
+		}
+		builds = append(builds, &imageBuild{Dir: dir, Image: imageName, Dockerfile: dockerfile})
+		names = append(names, imageName)
+	}
+	builder, err := newImageBuilder(defaultConfig(), runtimeDocker)
+	if err != nil {
+		return err
+	}
+	if err := buildImages(cli, builder, builds, buildWorkers); err != nil {
+		return err
+	}
+	ids := make(map[string]string, len(names))
+	for _, imageName := range names {
+		info, _, err := cli.ImageInspectWithRaw(ctx, imageName)
+		if err != nil {
+			return fmt.Errorf("failed to inspect %s: %v", imageName, err)
+		}
+		ids[imageName] = info.ID
+	}
+
+	// The archive is saved once and read by every load, so a slow engine
+	// does not hold the others back.
+	archive, err := os.CreateTemp("", "ipocalypse-images-*.tar")
+	if err != nil {
+		return fmt.Errorf("failed to create image archive: %v", err)
+	}
+	defer os.Remove(archive.Name())
+	defer archive.Close()
+	saved, err := cli.ImageSave(ctx, names)
+	if err != nil {
+		return fmt.Errorf("failed to save images: %v", err)
+	}
+	size, err := io.Copy(archive, saved)
+	saved.Close()
+	if err != nil {
+		return fmt.Errorf("failed to save images: %v", err)
+	}
+	fmt.Printf("Saved %d images (%.1f MB), loading them onto %d engines\n", len(names), float64(size)/1e6, len(engines))
+
+	results := make([]preloadResult, len(engines))
+	var wg sync.WaitGroup
+	for i, engine := range engines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := clock.Now()
+			results[i] = preloadResult{engine: engine, err: loadImages(ctx, engine, archive.Name(), ids)}
+			results[i].elapsed = clock.Since(start)
+		}()
+	}
+	wg.Wait()
+
+	var failed []string
+	for _, r := range results {
+		if r.err != nil {
+			fmt.Printf("  %-32s FAILED %v\n", r.engine, r.err)
+			failed = append(failed, r.engine)
+			continue
+		}
+		fmt.Printf("  %-32s loaded in %v\n", r.engine, r.elapsed.Round(time.Second))
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("images could not be loaded onto %s", strings.Join(failed, ", "))
+	}
+	for _, name := range names {
+		fmt.Printf("%s is %s on every engine\n", name, ids[name])
+	}
+	return nil
+}
+
+// loadImages loads the image archive at path onto engine and checks that
+// every image there has the ID it was built with.
+func loadImages(ctx context.Context, engine, path string, ids map[string]string) error {
+	if !strings.HasPrefix(engine, "tcp://") && !strings.HasPrefix(engine, "unix://") && !strings.HasPrefix(engine, "ssh://") {
+		return fmt.Errorf("unsupported engine address %q (use tcp://host:port, ssh://user@host or unix:///path)", engine)
+	}
+	// The engine is reached as -host reaches it, so ssh:// works as well.
+	cfg := defaultConfig()
+	cfg.Runtime = runtimeDocker
+	cfg.Host = engine
+	cli, _, err := newContainerRuntime(cfg)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	resp, err := cli.ImageLoad(ctx, f, true)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// A failed load can arrive as an error message in the response stream.
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Error string `json:"error"`
+		}
+		if err := dec.Decode(&msg); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if msg.Error != "" {
+			return fmt.Errorf("%s", strings.TrimSpace(msg.Error))
+		}
+	}
+	for name, id := range ids {
+		info, _, err := cli.ImageInspectWithRaw(ctx, name)
+		if err != nil {
+			return fmt.Errorf("%s missing after the load: %v", name, err)
+		}
+		if info.ID != id {
+			return fmt.Errorf("%s loaded as %s, not %s", name, info.ID, id)
+		}
+	}
+	return nil
+}
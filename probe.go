@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// runHealthProbe checks that a leased client's payload is functioning,
+// retrying until the probe passes or its retries are used up.
+func runHealthProbe(cli containerRuntime, p *healthProbe, containerID, ip string) error {
+	timeout := p.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	interval := p.Interval
+	if interval == 0 {
+		interval = 2 * time.Second
+	}
+
+	var err error
+	for attempt := 0; attempt <= p.Retries; attempt++ {
+		if attempt > 0 {
+			clock.Sleep(interval)
+		}
+		if err = probeOnce(cli, p, containerID, ip, timeout); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// probeOnce runs a single attempt of the configured probe.
+func probeOnce(cli containerRuntime, p *healthProbe, containerID, ip string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	switch {
+	case len(p.Command) > 0:
+		_, err := containerExec(ctx, cli, containerID, p.Command)
+		return err
+	case p.TCPPort > 0:
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, strconv.Itoa(p.TCPPort)), timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	default:
+		port := p.HTTPPort
+		if port == 0 {
+			port = 80
+		}
+		url := fmt.Sprintf("http://%s%s", net.JoinHostPort(ip, strconv.Itoa(port)), p.HTTPPath)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("GET %s returned %s", url, resp.Status)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// deviceProfile makes a client look like a particular device class to DHCP
+// fingerprinting engines, which key on the vendor class identifier (option
+// 60), the parameter request list (option 55, including its order) and the
+// hostname (option 12).
+type deviceProfile struct {
+	Name         string
+	VendorClass  string
+	ParamRequest []byte
+	// HostnamePattern is expanded per client, see expandHostname.
+	HostnamePattern string
+}
+
+// deviceProfiles are the built-in profiles selectable with -profiles or a
+// manifest's profile key. Parameter request lists match what the real devices
+// send.
+var deviceProfiles = map[string]*deviceProfile{
+	"windows": {
+		Name:            "windows",
+		VendorClass:     "MSFT 5.0",
+		ParamRequest:    []byte{1, 3, 6, 15, 31, 33, 43, 44, 46, 47, 119, 121, 249, 252},
+		HostnamePattern: "DESKTOP-{ALNUM:7}",
+	},
+	"macos": {
+		Name:            "macos",
+		ParamRequest:    []byte{1, 121, 3, 6, 15, 108, 114, 119, 252, 95, 44, 46},
+		HostnamePattern: "MacBook-Pro-{n}",
+	},
+	"iphone": {
+		Name:            "iphone",
+		ParamRequest:    []byte{1, 121, 3, 6, 15, 108, 114, 119, 252},
+		HostnamePattern: "iPhone",
+	},
+	"android": {
+		Name:            "android",
+		VendorClass:     "android-dhcp-13",
+		ParamRequest:    []byte{1, 3, 6, 15, 26, 28, 51, 58, 59, 43, 114, 108},
+		HostnamePattern: "android-{hex:16}",
+	},
+	"hp-printer": {
+		Name:            "hp-printer",
+		VendorClass:     "Hewlett-Packard JetDirect",
+		ParamRequest:    []byte{1, 3, 6, 15, 44, 47, 12, 81, 69, 42, 252, 119},
+		HostnamePattern: "HP{HEX:6}",
+	},
+	"polycom-phone": {
+		Name:            "polycom-phone",
+		VendorClass:     "Polycom-VVX411",
+		ParamRequest:    []byte{1, 3, 6, 15, 42, 43, 66, 150, 160, 151, 7, 12},
+		HostnamePattern: "SEP{HEX:12}",
+	},
+	"iot": {
+		Name:            "iot",
+		VendorClass:     "udhcp 1.30.1",
+		ParamRequest:    []byte{1, 3, 6, 12, 15, 28, 42},
+		HostnamePattern: "ESP_{HEX:6}",
+	},
+}
+
+// lookupProfile returns the named built-in profile.
+func lookupProfile(name string) (*deviceProfile, error) {
+	profile, ok := deviceProfiles[strings.ToLower(name)]
+	if !ok {
+		var names []string
+		for n := range deviceProfiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown device profile %q (available: %s)", name, strings.Join(names, ", "))
+	}
+	return profile, nil
+}
+
+// parseProfiles builds a weighted profile set from "name[:weight]" specs.
+func parseProfiles(specs []string) (*weightedSet[*deviceProfile], error) {
+	set := &weightedSet[*deviceProfile]{}
+	for _, spec := range specs {
+		name, weight, err := parseWeight(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid device profile: %v", err)
+		}
+		profile, err := lookupProfile(name)
+		if err != nil {
+			return nil, err
+		}
+		set.add(profile, weight)
+	}
+	return set, nil
+}
+
+// hostnamePlaceholder matches {HEX:n}, {hex:n}, {ALNUM:n} and {n}.
+var hostnamePlaceholder = regexp.MustCompile(`\{(HEX|hex|ALNUM|alnum):(\d+)\}|\{n\}`)
+
+// expandHostname fills the random placeholders in a hostname pattern.
+func expandHostname(pattern string) string {
+	return hostnamePlaceholder.ReplaceAllStringFunc(pattern, func(m string) string {
+		if m == "{n}" {
+			return strconv.Itoa(identityRand.Intn(99) + 1)
+		}
+		parts := hostnamePlaceholder.FindStringSubmatch(m)
+		n, _ := strconv.Atoi(parts[2])
+		var alphabet string
+		switch parts[1] {
+		case "HEX":
+			alphabet = "0123456789ABCDEF"
+		case "hex":
+			alphabet = "0123456789abcdef"
+		case "ALNUM":
+			alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+		default:
+			alphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+		}
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = alphabet[identityRand.Intn(len(alphabet))]
+		}
+		return string(b)
+	})
+}
+
+// applyProfile adds the client's hostname and the profile's fingerprint
+// options to a raw DHCP message, replacing the default parameter request
+// list. Either may be unset.
+func applyProfile(msg *dhcpMessage, profile *deviceProfile, hostname string) {
+	if profile != nil {
+		for i, opt := range msg.Options {
+			if opt.Code == optParamRequest {
+				msg.Options[i].Data = profile.ParamRequest
+			}
+		}
+	}
+	if hostname != "" {
+		msg.addOption(optHostname, []byte(hostname))
+	}
+	if profile != nil && profile.VendorClass != "" {
+		msg.addOption(optVendorClass, []byte(profile.VendorClass))
+	}
+}
+
+// profileEnv returns the environment variables that make a container's DHCP
+// client present the hostname and the profile. Either may be unset.
+func profileEnv(profile *deviceProfile, hostname string) []string {
+	var env []string
+	if hostname != "" {
+		env = append(env, "IPOCALYPSE_HOSTNAME="+hostname)
+	}
+	if profile == nil {
+		return env
+	}
+	codes := make([]string, len(profile.ParamRequest))
+	for i, code := range profile.ParamRequest {
+		codes[i] = strconv.Itoa(int(code))
+	}
+	env = append(env, "IPOCALYPSE_PARAM_REQUEST="+strings.Join(codes, ","))
+	if profile.VendorClass != "" {
+		env = append(env, "IPOCALYPSE_VENDOR_CLASS="+profile.VendorClass)
+	}
+	return env
+}
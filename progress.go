@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// progressLine is the -progress status line. On a terminal it is redrawn in
+// place every second below the log lines, which it prints above itself;
+// elsewhere, such as in a CI log, it is printed as a plain line every
+// -status-interval.
+type progressLine struct {
+	mu       sync.Mutex
+	out      io.Writer
+	terminal bool
+	line     string
+}
+
+func newProgressLine(out *os.File) *progressLine {
+	info, err := out.Stat()
+	return &progressLine{out: out, terminal: err == nil && info.Mode()&os.ModeCharDevice != 0}
+}
+
+// Write makes the progress line the log destination: log output is printed
+// above the line, which is then redrawn.
+func (p *progressLine) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.terminal || p.line == "" {
+		return p.out.Write(b)
+	}
+	fmt.Fprint(p.out, "\r"+ansiClearLine)
+	n, err := p.out.Write(b)
+	fmt.Fprint(p.out, p.line)
+	return n, err
+}
+
+// run redraws the line until ctx is done, then leaves the final one in place.
+func (p *progressLine) run(ctx context.Context, stats *runStats, statusInterval time.Duration) {
+	interval := time.Second
+	if !p.terminal {
+		if statusInterval <= 0 {
+			return
+		}
+		interval = statusInterval
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			p.draw(stats.progress())
+			if p.terminal {
+				fmt.Fprintln(p.out)
+			}
+			return
+		case <-clock.After(interval):
+			p.draw(stats.progress())
+		}
+	}
+}
+
+func (p *progressLine) draw(line string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.terminal {
+		fmt.Fprintln(p.out, line)
+		return
+	}
+	p.line = line
+	fmt.Fprint(p.out, "\r"+ansiClearLine+line)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rampFailureRate is the share of launches in a step failing for reasons
+// other than an exhausted pool at which the server counts as failing.
+const rampFailureRate = 0.1
+
+// rampSchedule raises the launch rate in steps, e.g. starting at 5 launches
+// per minute and doubling every 2 minutes, and records how the server copes
+// with each step, to find the request rate at which it starts failing.
+type rampSchedule struct {
+	start  float64 // launches per minute in the first step
+	factor float64
+	every  time.Duration
+
+	mu    sync.Mutex
+	began time.Time
+	steps []rampStep
+}
+
+// rampStep is what happened while one rate was in force.
+type rampStep struct {
+	Rate     float64
+	Launches int
+	Leases   int
+	// Exhausted counts launches that found no free address, which says
+	// nothing about the rate the server copes with.
+	Exhausted int
+	Failures  int
+	latency   time.Duration
+}
+
+// parseRamp parses a -ramp value of the form start:factor:interval, e.g.
+// 5:2:2m. An empty value means no ramp.
+func parseRamp(spec string) (*rampSchedule, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	parts := strings.Split(spec, ":")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid -ramp %q: use start:factor:interval, e.g. 5:2:2m", spec)
+	}
+	start, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || start <= 0 {
+		return nil, fmt.Errorf("invalid -ramp %q: the starting rate must be a positive number of launches per minute", spec)
+	}
+	factor, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil || factor <= 1 {
+		return nil, fmt.Errorf("invalid -ramp %q: the factor must be greater than 1", spec)
+	}
+	every, err := time.ParseDuration(parts[2])
+	if err != nil || every <= 0 {
+		return nil, fmt.Errorf("invalid -ramp %q: the interval must be a positive duration", spec)
+	}
+	return &rampSchedule{start: start, factor: factor, every: every}, nil
+}
+
+// step returns the index of the step in force at t. The schedule starts with
+// the first launch, so image builds and setup do not eat into the first step.
+func (r *rampSchedule) step(t time.Time) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.began.IsZero() {
+		r.began = t
+	}
+	return int(t.Sub(r.began) / r.every)
+}
+
+// rateAt returns the launch rate of step i, capped at ceiling unless it is 0.
+func (r *rampSchedule) rateAt(i int, ceiling float64) float64 {
+	rate := r.start * math.Pow(r.factor, float64(i))
+	if ceiling > 0 && rate > ceiling {
+		return ceiling
+	}
+	return rate
+}
+
+// record adds the outcome of a launch started at t to its step. A nil
+// schedule records nothing.
+func (r *rampSchedule) record(t time.Time, latency time.Duration, err error, ceiling float64) {
+	if r == nil {
+		return
+	}
+	i := r.step(t)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for len(r.steps) <= i {
+		r.steps = append(r.steps, rampStep{Rate: r.rateAt(len(r.steps), ceiling)})
+	}
+	s := &r.steps[i]
+	s.Launches++
+	switch {
+	case err == nil:
+		s.Leases++
+		s.latency += latency
+	case errors.Is(err, ErrNoLease):
+		s.Exhausted++
+	default:
+		s.Failures++
+	}
+}
+
+// String describes the schedule for the run banner.
+func (r *rampSchedule) String() string {
+	return fmt.Sprintf("ramping from %.1f launches/min, x%g every %s", r.start, r.factor, r.every)
+}
+
+// printReport writes the outcome of every step and the first rate at which
+// the server failed more than rampFailureRate of the launches or took twice
+// the first step's mean time to lease. A nil schedule prints nothing.
+func (r *rampSchedule) printReport() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fmt.Println("=== Launch Rate Ramp ===")
+	if len(r.steps) == 0 {
+		fmt.Println("No launches were made")
+		return
+	}
+	var baseline time.Duration
+	breaking := -1
+	for i, s := range r.steps {
+		var mean time.Duration
+		if s.Leases > 0 {
+			mean = s.latency / time.Duration(s.Leases)
+		}
+		if i == 0 {
+			baseline = mean
+		}
+		failing := s.Launches > 0 && float64(s.Failures)/float64(s.Launches) > rampFailureRate
+		slow := baseline > 0 && mean > 2*baseline
+		note := ""
+		if failing || slow {
+			note = "  <- degraded"
+			if breaking < 0 {
+				breaking = i
+			}
+		}
+		fmt.Printf("  step %-3d %7.1f/min  %5d launches  %5d leases  %4d failed  %4d no address  mean %s%s\n",
+			i+1, s.Rate, s.Launches, s.Leases, s.Failures, s.Exhausted, mean.Round(time.Millisecond), note)
+	}
+	if breaking < 0 {
+		fmt.Printf("The server kept up with every step, up to %.1f launches/min\n", r.steps[len(r.steps)-1].Rate)
+		return
+	}
+	fmt.Printf("The server started failing at %.1f launches/min (step %d)\n", r.steps[breaking].Rate, breaking+1)
+}
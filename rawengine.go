@@ -0,0 +1,891 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Run modes accepted by -mode.
+const (
+	modeDocker = "docker"
+	modeRaw    = "raw"
+	modeNetns  = "netns"
+	modePD     = "pd"
+	modeK8s    = "k8s"
+	modeSim    = "sim"
+)
+
+// rawLease is a lease acquired in-process by the raw engine.
+type rawLease struct {
+	MAC       net.HardwareAddr
+	IP        net.IP
+	Server    net.IP
+	LeaseTime time.Duration
+	Acquired  time.Time
+	// DNS are the DNS servers the lease offers.
+	DNS []net.IP
+	// Hostname and ClientID are the host name and client identifier the
+	// client sent, if any.
+	Hostname string
+	ClientID []byte
+}
+
+// rawClient is the identity a raw-mode client presents to the server.
+type rawClient struct {
+	MAC      net.HardwareAddr
+	Profile  *deviceProfile
+	Hostname string
+	// ClientID is sent as option 61 unless nil.
+	ClientID []byte
+}
+
+// addClientID adds the client identifier option unless id is nil.
+func addClientID(msg *dhcpMessage, id []byte) {
+	if id != nil {
+		msg.addOption(optClientID, id)
+	}
+}
+
+// identity returns the hostname and client identifier the client with mac
+// leased under. Clients without a lease are assumed to use the MAC
+// identifier.
+func (e *rawEngine) identity(mac net.HardwareAddr) (string, []byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if lease, ok := e.leases[mac.String()]; ok {
+		return lease.Hostname, lease.ClientID
+	}
+	return "", append([]byte{1}, mac...)
+}
+
+// rawEngine exhausts a DHCP pool without containers by crafting DISCOVER and
+// REQUEST messages from spoofed MACs on a packet socket.
+type rawEngine struct {
+	conn *packetConn
+	// srcMAC, when set, is used as the Ethernet source of every frame while
+	// the spoofed MAC only appears in the DHCP chaddr field. Wi-Fi access
+	// points drop frames from MACs that never associated.
+	srcMAC net.HardwareAddr
+	// relay, when set, sends every message through the relay agent
+	// -relay-server sets up rather than broadcasting it.
+	relay *dhcpRelay
+	// server, when set, is the one server -server targets.
+	server *targetServer
+
+	mu      sync.Mutex
+	pending map[uint32]chan *dhcpMessage
+	leases  map[string]*rawLease
+	offers  int
+	acks    int
+	naks    int
+}
+
+func newRawEngine(iface string) (*rawEngine, error) {
+	conn, err := openPacketConn(iface, etherTypeIPv4)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.setReadTimeout(500 * time.Millisecond); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to set socket timeout: %v", err)
+	}
+	return &rawEngine{
+		conn:    conn,
+		pending: make(map[uint32]chan *dhcpMessage),
+		leases:  make(map[string]*rawLease),
+	}, nil
+}
+
+// receive reads server replies and routes them to the transaction waiting on
+// their xid until ctx is cancelled.
+func (e *rawEngine) receive(ctx context.Context) {
+	buf := make([]byte, 65536)
+	for ctx.Err() == nil {
+		n, err := e.conn.readFrame(buf)
+		if err != nil || n == 0 {
+			continue
+		}
+		frame, ok := parseUDPFrame(buf[:n])
+		if !ok || frame.SrcPort != dhcpServerPort {
+			continue
+		}
+		// Servers answer a relay agent on the server port.
+		if frame.DstPort != dhcpClientPort && (e.relay == nil || frame.DstPort != dhcpServerPort) {
+			continue
+		}
+		msg, err := parseDHCP(frame.Payload)
+		if err != nil || msg.Op != bootReply || !e.server.accepts(msg) {
+			continue
+		}
+		e.mu.Lock()
+		ch, ok := e.pending[msg.XID]
+		e.mu.Unlock()
+		if ok {
+			select {
+			case ch <- msg:
+			default:
+			}
+		}
+	}
+}
+
+// send broadcasts a client message from the message's spoofed MAC, sends
+// it to the -server target, or relays it.
+func (e *rawEngine) send(msg *dhcpMessage) error {
+	if e.relay != nil {
+		return e.conn.writeFrame(e.relay.frame(e.relay.wrap(msg).marshal()))
+	}
+	if e.server.direct(msg) {
+		return e.conn.writeFrame(e.server.frame(e.source(msg.CHAddr), msg))
+	}
+	return e.sendPayload(msg.CHAddr, msg.marshal())
+}
+
+// source returns the Ethernet source of the frames of the client with mac.
+func (e *rawEngine) source(mac net.HardwareAddr) net.HardwareAddr {
+	if e.srcMAC != nil {
+		return e.srcMAC
+	}
+	return mac
+}
+
+// sendPayload broadcasts a DHCP payload, well-formed or not, from mac.
+func (e *rawEngine) sendPayload(mac net.HardwareAddr, payload []byte) error {
+	frame := buildUDPFrame(udpFrame{
+		SrcMAC:  e.source(mac),
+		DstMAC:  broadcastMAC,
+		SrcIP:   net.IPv4zero,
+		DstIP:   net.IPv4bcast,
+		SrcPort: dhcpClientPort,
+		DstPort: dhcpServerPort,
+		Payload: payload,
+	})
+	return e.conn.writeFrame(frame)
+}
+
+// transact sends msg up to attempts times and waits for a reply of one of the
+// wanted types.
+func (e *rawEngine) transact(ctx context.Context, msg *dhcpMessage, attempts int, timeout time.Duration, want ...byte) (*dhcpMessage, error) {
+	ch := make(chan *dhcpMessage, 8)
+	e.mu.Lock()
+	e.pending[msg.XID] = ch
+	e.mu.Unlock()
+	defer func() {
+		e.mu.Lock()
+		delete(e.pending, msg.XID)
+		e.mu.Unlock()
+	}()
+
+	for attempt := 0; attempt < attempts; attempt++ {
+		if err := e.send(msg); err != nil {
+			return nil, fmt.Errorf("failed to send %s: %v", dhcpTypeName(msg.msgType()), err)
+		}
+		deadline := clock.After(timeout)
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-deadline:
+				break wait
+			case reply := <-ch:
+				for _, t := range want {
+					if reply.msgType() == t {
+						return reply, nil
+					}
+				}
+			}
+		}
+	}
+	return nil, nil
+}
+
+// acquire runs a full DISCOVER/OFFER/REQUEST/ACK exchange for client.
+func (e *rawEngine) acquire(ctx context.Context, client rawClient) (*rawLease, error) {
+	mac := client.MAC
+	params := []byte{optSubnetMask, optRouter, optDNS, optLeaseTime, optServerID}
+
+	discover := newDHCPRequest(dhcpDiscover, rand.Uint32(), mac)
+	addClientID(discover, client.ClientID)
+	discover.addOption(optParamRequest, params)
+	applyProfile(discover, client.Profile, client.Hostname)
+	offer, err := e.transact(ctx, discover, 3, 3*time.Second, dhcpOffer)
+	if err != nil {
+		return nil, err
+	}
+	if offer == nil {
+		return nil, fmt.Errorf("no offer for %s: client %w", mac, ErrNoLease)
+	}
+	e.mu.Lock()
+	e.offers++
+	e.mu.Unlock()
+
+	request := newDHCPRequest(dhcpRequest, discover.XID, mac)
+	request.addOption(optRequestedIP, offer.YIAddr.To4())
+	if server := offer.serverID(); server != nil {
+		request.addOption(optServerID, server.To4())
+	}
+	addClientID(request, client.ClientID)
+	request.addOption(optParamRequest, params)
+	applyProfile(request, client.Profile, client.Hostname)
+	reply, err := e.transact(ctx, request, 2, 3*time.Second, dhcpAck, dhcpNak)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, fmt.Errorf("%w for %s after offer of %s", ErrNoACK, mac, offer.YIAddr)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if reply.msgType() == dhcpNak {
+		e.naks++
+		if message := reply.option(optMessage); len(message) > 0 {
+			return nil, fmt.Errorf("server %w request for %s from %s: %q", ErrNAK, offer.YIAddr, mac, message)
+		}
+		return nil, fmt.Errorf("server %w request for %s from %s", ErrNAK, offer.YIAddr, mac)
+	}
+	e.acks++
+	lease := &rawLease{
+		MAC:       mac,
+		IP:        reply.YIAddr,
+		Server:    reply.serverID(),
+		LeaseTime: reply.leaseTime(),
+		Acquired:  clock.Now(),
+		DNS:       reply.dnsServers(),
+		Hostname:  client.Hostname,
+		ClientID:  client.ClientID,
+	}
+	e.leases[mac.String()] = lease
+	return lease, nil
+}
+
+// release gives the lease held by mac back to its server with a DHCPRELEASE.
+// The message is addressed to the server's IP but sent as an Ethernet
+// broadcast, since the server's MAC is not tracked, unless it is the -server
+// target.
+func (e *rawEngine) release(mac net.HardwareAddr) error {
+	e.mu.Lock()
+	lease, ok := e.leases[mac.String()]
+	e.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no lease held for %s", mac)
+	}
+	msg := newDHCPRequest(dhcpRelease, rand.Uint32(), mac)
+	msg.Flags = 0
+	msg.CIAddr = lease.IP
+	if lease.Server != nil {
+		msg.addOption(optServerID, lease.Server.To4())
+	}
+	addClientID(msg, lease.ClientID)
+	if e.relay != nil {
+		if err := e.send(msg); err != nil {
+			return fmt.Errorf("failed to send RELEASE: %v", err)
+		}
+		e.mu.Lock()
+		delete(e.leases, mac.String())
+		e.mu.Unlock()
+		return nil
+	}
+	dst, dstMAC := net.IPv4bcast, broadcastMAC
+	if lease.Server != nil {
+		dst = lease.Server
+	}
+	if e.server != nil {
+		dst, dstMAC = e.server.ip, e.server.mac
+	}
+	frame := buildUDPFrame(udpFrame{
+		SrcMAC:  e.source(mac),
+		DstMAC:  dstMAC,
+		SrcIP:   lease.IP,
+		DstIP:   dst,
+		SrcPort: dhcpClientPort,
+		DstPort: dhcpServerPort,
+		Payload: msg.marshal(),
+	})
+	if err := e.conn.writeFrame(frame); err != nil {
+		return fmt.Errorf("failed to send RELEASE: %v", err)
+	}
+	e.mu.Lock()
+	delete(e.leases, mac.String())
+	e.mu.Unlock()
+	return nil
+}
+
+// printSummary reports the engine's in-process transaction counters.
+func (e *rawEngine) printSummary() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	fmt.Printf("Offers received:   %d\n", e.offers)
+	fmt.Printf("ACKs received:     %d\n", e.acks)
+	fmt.Printf("NAKs received:     %d\n", e.naks)
+	fmt.Printf("Leases held:       %d\n", len(e.leases))
+	e.server.printSummary()
+}
+
+// runLocalMode exhausts the pool on the parent interface without Docker,
+// with raw DHCP packets or, in netns mode, with a network namespace per
+// client, until the server stops offering addresses. In pd mode the pool is
+// the server's delegated prefixes, and in sim mode an in-memory -sim-pool.
+// A non-nil dash or progress replaces the periodic status lines with the
+// live dashboard or the progress line. It returns nil when the run ended as intended (see
+// runError).
+func runLocalMode(cfg Config, schedule *runSchedule, dash *dashboard, progress *progressLine) error {
+	// A simulated run has no interface: its network is the -sim-pool.
+	sim := cfg.Mode == modeSim
+	var netCfg *NetworkConfig
+	var err error
+	if sim {
+		netCfg, err = simNetwork(cfg.SimPool)
+	} else {
+		netCfg, err = detectNetwork(localHost, cfg.Interface, cfg.VLAN > 0)
+	}
+	if err != nil {
+		return err
+	}
+	name := "Raw mode"
+	switch cfg.Mode {
+	case modeNetns:
+		name = "Netns mode"
+	case modePD:
+		name = "Prefix delegation mode"
+	case modeK8s:
+		name = "Kubernetes mode"
+	case modeSim:
+		name = "Simulation mode"
+	}
+	if cfg.Mode != modeRaw && cfg.IdentityChurn > 0 {
+		return fmt.Errorf("-identity-churn runs in raw mode (-mode=raw)")
+	}
+	fmt.Printf("%s on %s (subnet %s) with %d workers\n", name, netCfg.Parent, netCfg.Subnet, cfg.Workers)
+	// The pre-flight check counts DHCPv4 servers, which prefix delegation
+	// does not talk to and a simulated run has none of.
+	if cfg.Mode != modePD && !sim {
+		if err := preflight(netCfg.Parent, cfg.TrustedServers, cfg.Server, cfg.Force); err != nil {
+			return err
+		}
+	}
+	occupancy, err := newPoolOccupancy(context.Background(), netCfg, cfg.ARPSweep)
+	if err != nil {
+		return err
+	}
+
+	macs, err := newMACGenerator(cfg.MACPools)
+	if err != nil {
+		return err
+	}
+
+	profiles, err := parseProfiles(cfg.Profiles)
+	if err != nil {
+		return err
+	}
+	hostnames, err := newHostnameGenerator(cfg.Hostnames, cfg.HostnameWords)
+	if err != nil {
+		return err
+	}
+	clientIDs, err := newClientIDGenerator(cfg.ClientID)
+	if err != nil {
+		return err
+	}
+	budget, err := newLeaseBudget(cfg.MaxLeases, cfg.LaunchRate)
+	if err != nil {
+		return err
+	}
+	if budget.ramp, err = parseRamp(cfg.Ramp); err != nil {
+		return err
+	}
+	fmt.Printf("Lease budget: %s\n", budget)
+	retry, err := newRetryPolicy(cfg)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Retry policy: %s\n", retry)
+	pacing, err := newLaunchPacing(cfg)
+	if err != nil {
+		return err
+	}
+	if cfg.ReserveFree > 0 {
+		fmt.Printf("Keeping at least %d addresses free for other devices\n", cfg.ReserveFree)
+	}
+
+	// raw is set in raw mode and pd in pd mode; netns, k8s and sim modes
+	// have no packet socket of their own.
+	var engine interface {
+		Engine
+		printSummary()
+	}
+	var raw *rawEngine
+	var pd *pdEngine
+	switch cfg.Mode {
+	case modeNetns:
+		if engine, err = newNetnsEngine(netCfg.Parent, cfg.DHCPTimeout); err != nil {
+			return err
+		}
+	case modePD:
+		if pd, err = newPDEngine(netCfg.Parent, cfg.PDLength); err != nil {
+			return err
+		}
+		defer pd.conn.Close()
+		engine = pd
+		fmt.Printf("Soliciting IA_PD prefixes from %s (%s)\n", pd.srcIP, describePDLength(cfg.PDLength))
+	case modeK8s:
+		if engine, err = newK8sEngine(context.Background(), cfg, netCfg.Parent); err != nil {
+			return err
+		}
+	case modeSim:
+		if engine, err = newSimEngine(netCfg, cfg.SimLatency); err != nil {
+			return err
+		}
+		fmt.Println("Simulating the DHCP server: no packet is sent and no interface is touched")
+	default:
+		if raw, err = newRawEngine(netCfg.Parent); err != nil {
+			return err
+		}
+		defer raw.conn.Close()
+		engine = raw
+	}
+	if err := checkCapabilities(engine, cfg); err != nil {
+		return err
+	}
+	// Only the k8s engine runs -images; the others leave images nil.
+	var images *imageSelector
+	if engine.Capabilities().Images {
+		refs, weights, err := parseImageSpecs(cfg.Images, true)
+		if err != nil {
+			return err
+		}
+		mix := &weightedSet[string]{}
+		for i, ref := range refs {
+			mix.add(ref, weights[i])
+		}
+		if images, err = newImageSelector(cfg.Strategy, mix); err != nil {
+			return err
+		}
+		if cfg.Strategy == strategyCounts {
+			planned := images.plan(nil)
+			_, rate := budget.limits()
+			budget.set(planned, rate)
+			fmt.Printf("Client image plan: %s, %d pods to launch\n", mix.describeCounts(), planned)
+		} else if len(refs) > 1 {
+			fmt.Printf("Client image mix: %s, picked %s\n", mix.describe(), cfg.Strategy)
+		}
+	}
+	if raw != nil && isWireless(localHost, netCfg.Parent) {
+		raw.srcMAC = raw.conn.iface.HardwareAddr
+		fmt.Printf("Wireless parent detected: sending every frame from the adapter's own MAC %s;\n", raw.srcMAC)
+		fmt.Println("client MACs vary only in the DHCP chaddr field, which servers that cross-check it will reject")
+	}
+	if raw != nil {
+		if raw.relay, err = newDHCPRelay(cfg, netCfg, raw.conn.iface.HardwareAddr); err != nil {
+			return err
+		}
+		if raw.relay != nil {
+			fmt.Printf("Acting as a DHCP relay agent: %s\n", raw.relay)
+		}
+		if raw.server, err = newTargetServer(cfg, netCfg); err != nil {
+			return err
+		}
+		if raw.server != nil {
+			fmt.Printf("Targeting DHCP server %s\n", raw.server)
+		}
+	}
+
+	// Everything the run does ends when its window closes.
+	window, closeWindow := schedule.context()
+	defer closeWindow()
+	ctx, cancel := context.WithCancel(window)
+	defer cancel()
+	if raw != nil {
+		go raw.receive(ctx)
+	}
+	if pd != nil {
+		go pd.receive(ctx)
+	}
+
+	stats := newRunStats()
+	// The IPv4 subnet says nothing about a delegated prefix pool.
+	if pd == nil {
+		stats.setCapacity(poolCapacity(netCfg))
+	}
+	leases := &leaseTable{}
+	var releaseAtExit func(ctx context.Context, r leaseRecord) error
+	if cfg.ReleaseOnExit {
+		releaseAtExit = engine.Release
+	}
+	exportOnSignal(leases, cfg.LeaseExport, releaseAtExit)
+	rogue, err := newRogueServer(cfg, netCfg, leases.hasMAC, os.Stdin)
+	if err != nil {
+		return err
+	}
+	evict, err := newLeaseEviction(cfg, netCfg, raw, os.Stdin)
+	if err != nil {
+		return err
+	}
+	reserve, err := newFreeReserve(netCfg, cfg.ReserveFree, leases, engine.Release)
+	if err != nil {
+		return err
+	}
+	go reserve.watch(ctx, reserveSweepInterval)
+	churn, err := newClientChurn(cfg.Churn, cfg.ChurnInterval, leases, budget, engine.Release)
+	if err != nil {
+		return err
+	}
+	if churn != nil {
+		fmt.Printf("Churning %.0f%% of the clients every %s\n", cfg.Churn*100, cfg.ChurnInterval)
+		go churn.watch(ctx)
+	}
+	storm, err := newRenewalStorm(cfg.RenewInterval, cfg.RenewWorkers, cfg.RenewRounds, leases, engine.Renew)
+	if err != nil {
+		return err
+	}
+	renewer, err := newLeaseRenewer(cfg, raw == nil && pd == nil, leases, engine.Renew)
+	if err != nil {
+		return err
+	}
+	if renewer != nil {
+		// Renewals go on after launching stops, for as long as the run
+		// holds its leases, on a receive loop of their own.
+		renewCtx, stopRenewing := context.WithCancel(window)
+		defer stopRenewing()
+		if raw != nil {
+			go raw.receive(renewCtx)
+		}
+		if pd != nil {
+			go pd.receive(renewCtx)
+		}
+		renewer.start(renewCtx)
+		fmt.Printf("Renewing leases %s\n", renewer)
+	}
+	var capture *pcapCapture
+	if cfg.PCAP != "" {
+		if capture, err = startPCAP(netCfg.Parent, cfg.PCAP); err != nil {
+			return err
+		}
+	}
+	announce, err := newAnnouncer(cfg.Announce, netCfg)
+	if err != nil {
+		return err
+	}
+	if announce != nil {
+		fmt.Printf("Announcing client hostnames over %s every %s\n", announce, cfg.AnnounceInterval)
+		go announce.run(ctx, leases, cfg.AnnounceInterval)
+	}
+	// Raw-mode clients have no network stack to answer ARP; netns clients
+	// do.
+	keepalive, err := newARPKeeper(cfg.ARPKeepalive, raw != nil, raw != nil && raw.srcMAC != nil, netCfg)
+	if err != nil {
+		return err
+	}
+	if keepalive != nil {
+		fmt.Printf("Holding leases with %s\n", keepalive)
+		go keepalive.run(ctx, leases)
+	}
+	dnsQueries, err := newDNSLoad(cfg.DNSLoad, cfg.DNSLoadNames, cfg.DNSLoadServer, netCfg)
+	if err != nil {
+		return err
+	}
+	if dnsQueries != nil {
+		fmt.Printf("DNS load: %s\n", dnsQueries)
+		go dnsQueries.run(ctx, leases)
+	}
+	timer, err := newTransactionTimer(cfg.DHCPLatency, cfg.DHCPLatencyFile, netCfg, stats)
+	if err != nil {
+		return err
+	}
+	go timer.run(ctx)
+	var rogueIP net.IP
+	if rogue != nil {
+		rogueIP = rogue.serverIP
+	}
+	watch, err := newServerWatch(cfg.WatchServers && !sim, netCfg, cfg.TrustedServers, rogueIP)
+	if err != nil {
+		slog.Warn("not watching for competing DHCP servers", "error", err)
+	}
+	go watch.run(ctx)
+	switchMon, err := newSwitchMonitor(cfg, stats)
+	if err != nil {
+		slog.Warn("not polling the switch", "error", err)
+	} else if switchMon != nil {
+		fmt.Printf("Polling switch %s every %v\n", switchMon, cfg.SNMPInterval)
+	}
+	go switchMon.run(ctx)
+	// Relayed leases are on another segment, out of ARP's reach, delegated
+	// prefixes are not addresses, and simulated leases are on no segment.
+	conflicts, err := newConflictCheck(cfg.DetectConflicts && cfg.RelayServer == "" && pd == nil && !sim, netCfg, leases)
+	if err != nil {
+		slog.Warn("not probing leased addresses for conflicts", "error", err)
+	}
+	go conflicts.run(ctx)
+	var dashDone chan struct{}
+	if dash != nil {
+		dashDone = make(chan struct{})
+		go func() {
+			dash.run(ctx, stats, leases, time.Second)
+			close(dashDone)
+		}()
+	} else if progress != nil {
+		go progress.run(ctx, stats, cfg.StatusInterval)
+	} else {
+		go reportStatus(ctx, stats, cfg.StatusInterval)
+	}
+	if cfg.MetricsAddr != "" {
+		serveMetrics(cfg.MetricsAddr, stats)
+	}
+	var fingerprints *fingerprinter
+	if cfg.Fingerprint && !sim {
+		fingerprints = newFingerprinter(macs.issued)
+		fingerprints.watch(ctx, netCfg.Parent)
+	}
+	// The released leases go back to the pool before the clients ask for
+	// addresses.
+	if err := evict.run(ctx); err != nil {
+		return err
+	}
+	fmt.Printf("Seed: %d (pass -seed=%[1]d to draw the same clients again)\n", seedIdentities(cfg.Seed))
+	// specMu makes each client draw its MAC, hostname and profile in one
+	// go, so the Nth client of a seeded run is the same every time.
+	var specMu sync.Mutex
+
+	errorChan := make(chan error, 1)
+	var ctl *runControl
+	ctl = newRunControl(ctx, cancel, func(ctx context.Context, workerID int) {
+		log := workerLogger(workerID)
+		// failures counts this worker's consecutive failed acquisitions.
+		failures := 0
+		pacing.staggerStart(ctx)
+		for ctx.Err() == nil {
+			if ctl.retired(workerID) {
+				dash.setWorker(workerID, "retired")
+				return
+			}
+			ctl.wait(ctx)
+			reserve.wait(ctx)
+			if !budget.take(ctx) {
+				if churn != nil && ctx.Err() == nil {
+					dash.setWorker(workerID, "waiting for churn")
+					churn.wait(ctx)
+					continue
+				}
+				dash.setWorker(workerID, "stopped: lease budget reached")
+				return
+			}
+			specMu.Lock()
+			spec := launchSpec{MAC: macs.Next(), Hostname: hostnames.next()}
+			if images != nil {
+				spec.Image = images.pick()
+			}
+			clientIDs.apply(&spec)
+			if !profiles.empty() {
+				spec.Profile = profiles.pick()
+				if spec.Hostname == "" {
+					spec.Hostname = expandHostname(spec.Profile.HostnamePattern)
+				}
+			}
+			specMu.Unlock()
+			dash.setWorker(workerID, "acquiring for "+spec.MAC.String())
+			acquireStart := clock.Now()
+			lease, err := engine.Launch(ctx, spec)
+			capReached := budget.settle(err == nil)
+			if images != nil {
+				images.settle(spec.Image, err == nil)
+			}
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				budget.recordLaunch(acquireStart, err)
+				log.Error("error acquiring lease", "mac", spec.MAC.String(), "error", err)
+				stats.recordFailure(clientKey(workerID, spec.Image, spec.Profile), err, clock.Since(acquireStart))
+				events.emit("launch_failed", map[string]any{"worker": workerID, "mac": spec.MAC.String(), "reason": failureKind(err), "error": err.Error()})
+				// No offer at all, -exhaust-after times in a row, means the
+				// pool is exhausted.
+				if missed := stats.missedLeases(); errors.Is(err, ErrNoLease) && missed < cfg.ExhaustAfter {
+					log.Warn("no lease, not yet treating the pool as exhausted", "missed_in_a_row", missed, "exhaust_after", cfg.ExhaustAfter)
+				} else if errors.Is(err, ErrNoLease) {
+					if stats.markExhausted() {
+						emitExhausted(stats)
+					}
+					if reserve != nil {
+						dash.setWorker(workerID, "restoring free reserve")
+						reserve.exhausted(ctx)
+						continue
+					}
+					if churn != nil {
+						dash.setWorker(workerID, "waiting for churn")
+						churn.wait(ctx)
+						continue
+					}
+					dash.setWorker(workerID, "stopped: pool exhausted")
+					select {
+					case errorChan <- err:
+					default:
+					}
+					cancel()
+					return
+				}
+				if isDHCPOutcome(err) {
+					failures = 0
+				} else if failures++; retry.exhausted(failures) {
+					dash.setWorker(workerID, "stopped: too many consecutive failures")
+					select {
+					case errorChan <- fmt.Errorf("giving up after %d consecutive failed acquisitions: %w", failures, err):
+					default:
+					}
+					cancel()
+					return
+				}
+				dash.setWorker(workerID, "retrying after error: "+failureKind(err))
+				clock.Sleep(retry.delay(failures))
+				continue
+			}
+			failures = 0
+			budget.recordLaunch(acquireStart, nil)
+			stats.recordLease(clientKey(workerID, spec.Image, spec.Profile), clock.Since(acquireStart))
+			record := leaseRecord{IP: lease.IP, MAC: lease.MAC, LeaseSeconds: int(lease.LeaseTime.Seconds()), Server: lease.Server, Image: spec.Image, Worker: workerID, ClientID: lease.ClientID}
+			if images != nil {
+				// The pod holding the lease, as a container does in
+				// docker mode.
+				record.Container = lease.ID
+			}
+			leases.add(record)
+			events.emit("lease_acquired", map[string]any{"worker": workerID, "mac": lease.MAC, "ip": lease.IP, "server": lease.Server, "lease_seconds": int(lease.LeaseTime.Seconds()), "latency_ms": clock.Since(acquireStart).Milliseconds()})
+			conflicts.check(ctx, lease.IP, lease.MAC)
+			log.Info("leased address", "ip", lease.IP, "mac", lease.MAC, "server", lease.Server, "lease", lease.LeaseTime.String())
+			announce.add(lease.MAC, lease.IP, spec.Hostname)
+			keepalive.add(lease.MAC, lease.IP)
+			dnsQueries.add(lease.MAC, lease.IP, lease.DNS)
+			reserve.rebalance(ctx)
+			if capReached && churn == nil {
+				slog.Info("lease budget reached, stopping acquisition", "budget", budget.String())
+				dash.setWorker(workerID, "stopped: lease budget reached")
+				cancel()
+				return
+			}
+		}
+	})
+	ctl.budget = budget
+	reloadOnHangup(ctl, cfg)
+	pauseOnSignal(ctl)
+	if err := ctl.setWorkers(cfg.Workers); err != nil {
+		return err
+	}
+	scaler := newWorkerScaler(cfg.Autoscale, cfg.MaxWorkers, ctl, stats)
+	go scaler.run(ctx)
+	if cfg.ListenAddr != "" {
+		serveControl(cfg.ListenAddr, ctl, stats, leases, cfg.LeaseExport, max(cfg.MaxWorkers, cfg.Workers))
+	}
+
+	var stopErr error
+	select {
+	case stopErr = <-errorChan:
+		slog.Error("stopping lease acquisition", "error", stopErr)
+		cancel()
+	case <-ctx.Done():
+	}
+	ctl.stop()
+	if dashDone != nil {
+		<-dashDone
+	}
+
+	occupancy.finish(context.Background(), leases)
+	// The renewal storm and identity churn phases run after launching
+	// stopped, on a fresh receive loop.
+	if storm != nil {
+		stormCtx, stormCancel := context.WithCancel(window)
+		if raw != nil {
+			go raw.receive(stormCtx)
+		}
+		if pd != nil {
+			go pd.receive(stormCtx)
+		}
+		fmt.Printf("Renewing %d held leases every %s, %d rounds...\n", len(leases.held()), cfg.RenewInterval, cfg.RenewRounds)
+		storm.run(stormCtx)
+		stormCancel()
+	}
+	var identities []churnResult
+	if cfg.IdentityChurn > 0 {
+		churnCtx, churnCancel := context.WithCancel(window)
+		go raw.receive(churnCtx)
+		fmt.Printf("Reconfirming up to %d held leases with altered identities...\n", cfg.IdentityChurn)
+		identities = raw.identityChurn(churnCtx, macs, cfg.IdentityChurn)
+		churnCancel()
+	}
+	if rogue != nil {
+		fmt.Printf("Serving rogue DHCP on %s for %s...\n", netCfg.Parent, cfg.RogueDuration)
+		rogue.serve(window)
+	}
+	if cfg.ReleaseOnExit {
+		renewer.stop()
+		releaseOnExit(leases, engine.Release)
+	}
+	if capture != nil {
+		if err := capture.stop(); err != nil {
+			slog.Error("pcap capture failed", "error", err)
+		}
+	}
+
+	stats.printSummary()
+	engine.printSummary()
+	if budget.reached() {
+		fmt.Printf("Stopped at the lease budget of %s\n", budget)
+	}
+	budget.ramp.printReport()
+	scaler.printSummary()
+	reserve.printSummary()
+	churn.printSummary()
+	storm.printSummary()
+	renewer.printSummary()
+	rogue.printSummary()
+	evict.printSummary(leases)
+	dnsQueries.printSummary()
+	timer.printSummary()
+	watch.printSummary()
+	switchMon.printSummary()
+	conflicts.printSummary()
+	keepalive.printSummary()
+	occupancy.printReport()
+	if cfg.IdentityChurn > 0 {
+		printChurnReport(identities)
+	}
+	compareWithBaseline(cfg.BaselineDir, netCfg.Subnet.String(), stats, leases, "")
+	if fingerprints != nil {
+		fingerprints.finish(cfg.BaselineDir, netCfg.Subnet.String())
+	}
+	if cfg.LeaseExport != "" {
+		if err := leases.export(cfg.LeaseExport); err != nil {
+			return err
+		}
+	}
+	if cfg.Report != "" {
+		if err := writeReport(cfg.Report, cfg, fmt.Sprintf("%s (%s)", netCfg.Parent, netCfg.Subnet), stats, leases, watch, nil); err != nil {
+			return err
+		}
+		fmt.Printf("HTML report written to %s\n", cfg.Report)
+	}
+	if cfg.ResultsDB != "" {
+		if err := saveResults(cfg.ResultsDB, cfg.ResultsLabel, cfg, fmt.Sprintf("%s (%s)", netCfg.Parent, netCfg.Subnet), stats, leases); err != nil {
+			return err
+		}
+		fmt.Printf("Results saved to %s as run %s\n", cfg.ResultsDB, runID)
+	}
+	// Raw and netns clients leave nothing behind but their leases.
+	if schedule.holdUntilEnd() && !cfg.ReleaseOnExit {
+		renewer.stop()
+		releaseOnExit(leases, engine.Release)
+	}
+	if err := runError(stats, budget, stopErr); err != nil {
+		return err
+	}
+	if cfg.Wait {
+		fmt.Println("Run finished; waiting as -wait asks, Ctrl-C to exit")
+		select {}
+	}
+	return nil
+}
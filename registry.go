@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/registry"
+)
+
+// dockerHubAuthKey is the key Docker Hub credentials are stored under in the
+// Docker CLI config.
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
+// pullImages pulls every image from its registry, so shared client images
+// can be used without local ipocalypse_* build contexts.
+func pullImages(cli containerRuntime, images []string) error {
+	ctx := context.Background()
+	for _, ref := range images {
+		auth, err := registryAuth(registryHost(ref))
+		if err != nil {
+			return fmt.Errorf("credentials for %s: %v", ref, err)
+		}
+		fmt.Printf("Pulling image %s\n", ref)
+		if err := pullImage(ctx, cli, ref, auth); err != nil {
+			return fmt.Errorf("pulling image %s failed: %v", ref, err)
+		}
+	}
+	return nil
+}
+
+// pullImage pulls one image and prints the daemon's final status line.
+func pullImage(ctx context.Context, cli containerRuntime, ref, auth string) error {
+	body, err := cli.ImagePull(ctx, ref, image.PullOptions{RegistryAuth: auth, Platform: platformString(clientPlatform)})
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	// Like builds, a failed pull can arrive as an error message in the
+	// progress stream.
+	var last string
+	dec := json.NewDecoder(body)
+	for {
+		var msg struct {
+			Status string `json:"status"`
+			Error  string `json:"error"`
+		}
+		if err := dec.Decode(&msg); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if msg.Error != "" {
+			return fmt.Errorf("%s", strings.TrimSpace(msg.Error))
+		}
+		if strings.HasPrefix(msg.Status, "Status:") || strings.HasPrefix(msg.Status, "Digest:") {
+			last = msg.Status
+		}
+	}
+	if last != "" {
+		fmt.Println(last)
+	}
+	return nil
+}
+
+// registryHost returns the registry an image reference is pulled from, using
+// the same rule as the Docker CLI: the first path component is a registry
+// when it looks like a host name.
+func registryHost(ref string) string {
+	first, _, found := strings.Cut(ref, "/")
+	if !found || (!strings.ContainsAny(first, ".:") && first != "localhost") {
+		return "docker.io"
+	}
+	return first
+}
+
+// registryAuth returns the encoded credentials for host, or "" for anonymous
+// pulls. IPOCALYPSE_REGISTRY_USER and IPOCALYPSE_REGISTRY_PASSWORD take
+// precedence; otherwise credentials stored by `docker login` in the Docker
+// CLI config are used. Credential helpers are not consulted.
+func registryAuth(host string) (string, error) {
+	if user := os.Getenv("IPOCALYPSE_REGISTRY_USER"); user != "" {
+		return registry.EncodeAuthConfig(registry.AuthConfig{
+			Username:      user,
+			Password:      os.Getenv("IPOCALYPSE_REGISTRY_PASSWORD"),
+			ServerAddress: host,
+		})
+	}
+
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", nil
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read Docker config: %v", err)
+	}
+	var config struct {
+		Auths map[string]struct {
+			Auth          string `json:"auth"`
+			IdentityToken string `json:"identitytoken"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return "", fmt.Errorf("failed to parse Docker config: %v", err)
+	}
+	key := host
+	if host == "docker.io" {
+		key = dockerHubAuthKey
+	}
+	entry, ok := config.Auths[key]
+	if !ok {
+		entry, ok = config.Auths["https://"+key]
+	}
+	if !ok {
+		return "", nil
+	}
+	authConfig := registry.AuthConfig{ServerAddress: host, IdentityToken: entry.IdentityToken}
+	if entry.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			return "", fmt.Errorf("invalid auth for %s in Docker config: %v", key, err)
+		}
+		authConfig.Username, authConfig.Password, _ = strings.Cut(string(decoded), ":")
+	}
+	return registry.EncodeAuthConfig(authConfig)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Relay agent information (option 82, RFC 3046) and its sub-options.
+const (
+	optRelayAgentInfo byte = 82
+
+	relayCircuitID     byte = 1
+	relayRemoteID      byte = 2
+	relayLinkSelection byte = 5
+)
+
+// dhcpRelay makes the raw engine act as a DHCP relay agent on another
+// segment: every client message gets a giaddr and relay agent information
+// and is sent unicast to the server from this host, and the replies come
+// back to the relay port. That reaches the scopes of remote segments, and
+// option-82-based allocation policies, without being on those segments.
+type dhcpRelay struct {
+	server net.IP
+	// giaddr is the relay address the server picks the scope by and sends
+	// its replies to.
+	giaddr net.IP
+	// link, when set, selects the scope instead of giaddr (RFC 3527), so
+	// giaddr can stay this host's address and the replies still reach it.
+	link net.IP
+	// circuitID and remoteID are templates; {MAC} becomes the client's MAC.
+	circuitID, remoteID string
+
+	srcMAC net.HardwareAddr
+	srcIP  net.IP
+	// dstMAC is the next hop towards the server.
+	dstMAC net.HardwareAddr
+}
+
+// newDHCPRelay sets up relaying to server from netCfg's parent interface. It
+// returns nil without a server.
+func newDHCPRelay(cfg Config, netCfg *NetworkConfig, srcMAC net.HardwareAddr) (*dhcpRelay, error) {
+	if cfg.RelayServer == "" {
+		return nil, nil
+	}
+	r := &dhcpRelay{circuitID: cfg.RelayCircuitID, remoteID: cfg.RelayRemoteID, srcMAC: srcMAC, srcIP: netCfg.HostIP}
+	if r.server = net.ParseIP(cfg.RelayServer).To4(); r.server == nil {
+		return nil, fmt.Errorf("invalid -relay-server %q: want an IPv4 address", cfg.RelayServer)
+	}
+	if r.srcIP == nil {
+		return nil, fmt.Errorf("-relay-server needs an address on %s to relay from", netCfg.Parent)
+	}
+	r.giaddr = r.srcIP
+	if cfg.RelayGIAddr != "" {
+		if r.giaddr = net.ParseIP(cfg.RelayGIAddr).To4(); r.giaddr == nil {
+			return nil, fmt.Errorf("invalid -relay-giaddr %q: want an IPv4 address", cfg.RelayGIAddr)
+		}
+	}
+	if cfg.RelayLink != "" {
+		if r.link = net.ParseIP(cfg.RelayLink).To4(); r.link == nil {
+			return nil, fmt.Errorf("invalid -relay-link %q: want an IPv4 address", cfg.RelayLink)
+		}
+	}
+	// The server's own MAC on this subnet, the gateway's otherwise, as for
+	// -dns-load queries.
+	hop := r.server
+	if netCfg.Subnet != nil && !netCfg.Subnet.Contains(r.server) && netCfg.Gateway != nil {
+		hop = netCfg.Gateway
+	}
+	mac, err := resolveMAC(netCfg, hop, 2*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("-relay-server %s: next hop %s: %v", r.server, hop, err)
+	}
+	r.dstMAC = mac
+	return r, nil
+}
+
+func (r *dhcpRelay) String() string {
+	s := fmt.Sprintf("relaying to %s with giaddr %s", r.server, r.giaddr)
+	if r.link != nil {
+		s += fmt.Sprintf(", link selection %s", r.link)
+	}
+	return s
+}
+
+// wrap returns the relayed copy of a client message, leaving msg as it is
+// for retransmissions.
+func (r *dhcpRelay) wrap(msg *dhcpMessage) *dhcpMessage {
+	relayed := *msg
+	relayed.Options = append([]dhcpOption(nil), msg.Options...)
+	relayed.GIAddr = r.giaddr
+	relayed.Hops++
+	mac := msg.CHAddr.String()
+	var info []byte
+	add := func(code byte, data []byte) {
+		if len(data) > 0 {
+			info = append(info, code, byte(len(data)))
+			info = append(info, data...)
+		}
+	}
+	add(relayCircuitID, []byte(strings.ReplaceAll(r.circuitID, "{MAC}", mac)))
+	add(relayRemoteID, []byte(strings.ReplaceAll(r.remoteID, "{MAC}", mac)))
+	add(relayLinkSelection, r.link)
+	if len(info) > 0 {
+		relayed.addOption(optRelayAgentInfo, info)
+	}
+	return &relayed
+}
+
+// frame builds the unicast frame carrying a relayed payload to the server.
+func (r *dhcpRelay) frame(payload []byte) []byte {
+	return buildUDPFrame(udpFrame{
+		SrcMAC:  r.srcMAC,
+		DstMAC:  r.dstMAC,
+		SrcIP:   r.srcIP,
+		DstIP:   r.server,
+		SrcPort: dhcpServerPort,
+		DstPort: dhcpServerPort,
+		Payload: payload,
+	})
+}
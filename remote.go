@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hostShell runs commands and reads files on the machine the container engine
+// runs on, which is the one attached to the target LAN. For a remote engine
+// that is done over ssh; otherwise on this machine.
+type hostShell struct {
+	// target is the ssh destination (user@host), empty for this machine.
+	target string
+	port   string
+}
+
+// localHost is this machine.
+var localHost = &hostShell{}
+
+// newHostShell returns the shell for the engine at host (the -host value).
+// ssh:// hosts are reached at the same address; tcp:// hosts need sshTarget
+// (-host-ssh) because the Docker API cannot set up host networking.
+func newHostShell(host, sshTarget string) (*hostShell, error) {
+	if sshTarget != "" {
+		return parseSSHTarget(sshTarget)
+	}
+	switch {
+	case host == "" || strings.HasPrefix(host, "unix://"):
+		return localHost, nil
+	case strings.HasPrefix(host, "ssh://"):
+		return parseSSHTarget(host)
+	default:
+		return nil, fmt.Errorf("-host %s needs -host-ssh user@host so the network setup can run on the engine's machine", host)
+	}
+}
+
+// parseSSHTarget accepts user@host, user@host:port or ssh://user@host:port.
+func parseSSHTarget(target string) (*hostShell, error) {
+	if !strings.HasPrefix(target, "ssh://") {
+		target = "ssh://" + target
+	}
+	u, err := url.Parse(target)
+	if err != nil || u.Hostname() == "" || (u.Path != "" && u.Path != "/") {
+		return nil, fmt.Errorf("invalid ssh destination %q (use user@host or ssh://user@host:port)", target)
+	}
+	dest := u.Hostname()
+	if u.User != nil {
+		dest = u.User.Username() + "@" + dest
+	}
+	return &hostShell{target: dest, port: u.Port()}, nil
+}
+
+func (h *hostShell) remote() bool {
+	return h.target != ""
+}
+
+func (h *hostShell) String() string {
+	if !h.remote() {
+		return "this host"
+	}
+	return h.target
+}
+
+// sshArgs returns the ssh options and destination. BatchMode makes ssh fail
+// instead of prompting, since many connections are opened during a run.
+func (h *hostShell) sshArgs() []string {
+	args := []string{"-o", "BatchMode=yes"}
+	if h.port != "" {
+		args = append(args, "-p", h.port)
+	}
+	return append(args, h.target)
+}
+
+// command prepares name with args on the host.
+func (h *hostShell) command(name string, args ...string) *exec.Cmd {
+	if !h.remote() {
+		return exec.Command(name, args...)
+	}
+	words := []string{shellQuote(name)}
+	for _, arg := range args {
+		words = append(words, shellQuote(arg))
+	}
+	return exec.Command("ssh", append(h.sshArgs(), "--", strings.Join(words, " "))...)
+}
+
+// shellQuote quotes s for a POSIX shell, as ssh passes the remote command
+// through the login shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func (h *hostShell) readFile(path string) ([]byte, error) {
+	if !h.remote() {
+		return os.ReadFile(path)
+	}
+	out, err := h.command("cat", path).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s on %s: %v", path, h, err)
+	}
+	return out, nil
+}
+
+func (h *hostShell) writeFile(path string, data []byte) error {
+	if !h.remote() {
+		return os.WriteFile(path, data, 0644)
+	}
+	cmd := h.command("sh", "-c", "cat > "+shellQuote(path))
+	cmd.Stdin = bytes.NewReader(data)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (h *hostShell) exists(path string) bool {
+	if !h.remote() {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+	return h.command("test", "-e", path).Run() == nil
+}
+
+// requireRoot fails unless commands on the host run as root.
+func (h *hostShell) requireRoot() error {
+	if !h.remote() {
+		if os.Geteuid() != 0 {
+			return fmt.Errorf("network setup requires root, please run with sudo")
+		}
+		return nil
+	}
+	out, err := h.command("id", "-u").Output()
+	if err != nil {
+		return fmt.Errorf("failed to run commands on %s over ssh: %v", h, err)
+	}
+	if strings.TrimSpace(string(out)) != "0" {
+		return fmt.Errorf("network setup on %s requires root, connect as root (e.g. root@host)", h)
+	}
+	return nil
+}
+
+// interfaceAddrs returns the addresses configured on iface.
+func (h *hostShell) interfaceAddrs(iface string) ([]*net.IPNet, error) {
+	var addrs []*net.IPNet
+	if !h.remote() {
+		link, err := net.InterfaceByName(iface)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up interface %s: %v", iface, err)
+		}
+		linkAddrs, err := link.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read addresses of %s: %v", iface, err)
+		}
+		for _, addr := range linkAddrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				addrs = append(addrs, ipNet)
+			}
+		}
+		return addrs, nil
+	}
+
+	out, err := h.command("ip", "-o", "addr", "show", "dev", iface).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up interface %s on %s: %v", iface, h, err)
+	}
+	// One line per address: "2: eth0    inet 10.0.0.5/24 brd ... scope global eth0"
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] != "inet" && fields[i] != "inet6" {
+				continue
+			}
+			ip, ipNet, err := net.ParseCIDR(fields[i+1])
+			if err == nil {
+				addrs = append(addrs, &net.IPNet{IP: ip, Mask: ipNet.Mask})
+			}
+			break
+		}
+	}
+	return addrs, nil
+}
+
+// sshDialer connects to the Docker API of an ssh:// host through
+// `docker system dial-stdio`, as the Docker CLI does.
+func (h *hostShell) sshDialer(ctx context.Context, network, addr string) (net.Conn, error) {
+	cmd := exec.Command("ssh", append(h.sshArgs(), "--", "docker", "system", "dial-stdio")...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	conn := &cmdConn{cmd: cmd, stdin: stdin, stdout: stdout}
+	cmd.Stderr = &conn.stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start ssh to %s: %v", h, err)
+	}
+	return conn, nil
+}
+
+// cmdConn is a net.Conn over a command's stdin and stdout.
+type cmdConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	stderr lockedBuffer
+	once   sync.Once
+}
+
+func (c *cmdConn) Read(p []byte) (int, error) {
+	n, err := c.stdout.Read(p)
+	if err == io.EOF {
+		if msg := c.stderr.String(); msg != "" {
+			return n, fmt.Errorf("ssh: %s", msg)
+		}
+	}
+	return n, err
+}
+
+func (c *cmdConn) Write(p []byte) (int, error) {
+	return c.stdin.Write(p)
+}
+
+func (c *cmdConn) Close() error {
+	c.once.Do(func() {
+		c.stdin.Close()
+		c.cmd.Process.Kill()
+		c.cmd.Wait()
+	})
+	return nil
+}
+
+func (c *cmdConn) LocalAddr() net.Addr                { return cmdAddr{} }
+func (c *cmdConn) RemoteAddr() net.Addr               { return cmdAddr{} }
+func (c *cmdConn) SetDeadline(t time.Time) error      { return nil }
+func (c *cmdConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *cmdConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type cmdAddr struct{}
+
+func (cmdAddr) Network() string { return "cmd" }
+func (cmdAddr) String() string  { return "ssh" }
+
+// lockedBuffer collects a command's stderr while it is read concurrently.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return strings.TrimSpace(b.buf.String())
+}
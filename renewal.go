@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// renewalStorm has every held lease renewed every interval, with a bounded
+// number of renewals in flight, to stress the server's renewal path and log
+// volume once the pool is full.
+type renewalStorm struct {
+	interval time.Duration
+	workers  int
+	rounds   int
+	leases   *leaseTable
+	renew    func(ctx context.Context, r leaseRecord) error
+
+	mu       sync.Mutex
+	done     int
+	renewed  int
+	failed   int
+	latency  time.Duration
+	slowest  time.Duration
+	failures map[string]int
+}
+
+// newRenewalStorm returns a storm of rounds renewals of every held lease, one
+// round every interval, or nil when interval is 0.
+func newRenewalStorm(interval time.Duration, workers, rounds int, leases *leaseTable, renew func(ctx context.Context, r leaseRecord) error) (*renewalStorm, error) {
+	if interval < 0 {
+		return nil, fmt.Errorf("-renew-interval must not be negative")
+	}
+	if interval == 0 {
+		return nil, nil
+	}
+	if workers < 1 {
+		return nil, fmt.Errorf("-renew-workers must be at least 1")
+	}
+	if rounds < 1 {
+		return nil, fmt.Errorf("-renew-rounds must be at least 1")
+	}
+	return &renewalStorm{interval: interval, workers: workers, rounds: rounds, leases: leases, renew: renew, failures: make(map[string]int)}, nil
+}
+
+// run renews every held lease once per interval until all rounds are done or
+// ctx is cancelled. A round that takes longer than the interval is followed
+// straight away by the next.
+func (s *renewalStorm) run(ctx context.Context) {
+	for i := 0; i < s.rounds && ctx.Err() == nil; i++ {
+		start := clock.Now()
+		s.round(ctx)
+		s.mu.Lock()
+		s.done++
+		renewed, failed := s.renewed, s.failed
+		s.mu.Unlock()
+		slog.Info("renewal round finished", "round", i+1, "of", s.rounds, "took", clock.Since(start).Round(time.Millisecond).String(), "renewed", renewed, "failed", failed)
+		if wait := s.interval - clock.Since(start); wait > 0 && i < s.rounds-1 {
+			select {
+			case <-clock.After(wait):
+			case <-ctx.Done():
+			}
+		}
+	}
+}
+
+// round renews every held lease with up to s.workers renewals in flight.
+func (s *renewalStorm) round(ctx context.Context) {
+	held := make(chan leaseRecord)
+	var wg sync.WaitGroup
+	for i := 0; i < s.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for lease := range held {
+				start := clock.Now()
+				err := s.renew(ctx, lease)
+				s.record(clock.Since(start), err)
+				if err == nil {
+					s.leases.markRenewed(lease.IP, lease.MAC)
+				}
+				if err != nil && ctx.Err() == nil {
+					slog.Debug("renewal failed", "ip", lease.IP, "mac", lease.MAC, "error", err)
+				}
+			}
+		}()
+	}
+	for _, lease := range s.leases.held() {
+		if ctx.Err() != nil {
+			break
+		}
+		held <- lease
+	}
+	close(held)
+	wg.Wait()
+}
+
+func (s *renewalStorm) record(latency time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.failed++
+		s.failures[failureKind(err)]++
+		return
+	}
+	s.renewed++
+	s.latency += latency
+	s.slowest = max(s.slowest, latency)
+}
+
+// printSummary reports the storm's renewals. A nil storm prints nothing.
+func (s *renewalStorm) printSummary() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Println("=== Renewal Storm ===")
+	fmt.Printf("Rounds:            %d of %d, every %s with %d renewals in flight\n", s.done, s.rounds, s.interval, s.workers)
+	fmt.Printf("Renewals:          %d succeeded, %d failed\n", s.renewed, s.failed)
+	if s.renewed > 0 {
+		fmt.Printf("Renewal time:      mean %s, slowest %s\n", (s.latency / time.Duration(s.renewed)).Round(time.Millisecond), s.slowest.Round(time.Millisecond))
+	}
+	kinds := make([]string, 0, len(s.failures))
+	for kind := range s.failures {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Printf("  %-24s %d\n", kind, s.failures[kind])
+	}
+}
+
+// renew sends a RENEWING-state REQUEST for a held lease: ciaddr carries the
+// address and, unlike INIT-REBOOT, neither the requested address nor the
+// server identifier is included.
+func (e *rawEngine) renew(ctx context.Context, mac net.HardwareAddr, ip net.IP, clientID []byte, hostname string) (*dhcpMessage, error) {
+	request := newDHCPRequest(dhcpRequest, rand.Uint32(), mac)
+	request.CIAddr = ip
+	addClientID(request, clientID)
+	if hostname != "" {
+		request.addOption(optHostname, []byte(hostname))
+	}
+	request.addOption(optParamRequest, []byte{optSubnetMask, optRouter, optDNS, optLeaseTime, optServerID})
+	return e.transact(ctx, request, 2, 3*time.Second, dhcpAck, dhcpNak)
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// runReport is what the -report HTML file shows: everything the console
+// summary has that an assessment deliverable needs, in one file without
+// external assets.
+type runReport struct {
+	Generated time.Time
+	Scenario  string
+	Mode      string
+	Target    string
+	Outcome   string
+	Summary   []reportRow
+	Latency   []reportRow
+	Failures  []reportRow
+	// Responses are the refusals and silences behind the failures, with the
+	// NAK messages captured and what they add up to.
+	Responses  []responseRow
+	NAKReasons []reportRow
+	Diagnosis  string
+	Timeline   reportTimeline
+	Servers    []watchedServer
+	// LeasesByServer counts the leases each server granted.
+	LeasesByServer []reportRow
+	// Networks has a section per network of a multi-network run.
+	Networks []networkSection
+	Leases   []leaseRecord
+	Notes    []operatorNote
+	Start    time.Time
+	// Settings are the options that differ from the defaults.
+	Settings []reportRow
+}
+
+type reportRow struct {
+	Label, Value string
+}
+
+// reportTimeline is the exhaustion chart: held leases over the run, the
+// failed launches under it, and when the pool ran out.
+type reportTimeline struct {
+	Width, Height int
+	// Points is the SVG polyline of leases acquired over time.
+	Points string
+	// Failures are the x positions of launches that failed.
+	Failures []float64
+	// Exhausted is the x position of the exhaustion, 0 if it did not happen.
+	Exhausted float64
+	MaxLeases int
+	Elapsed   time.Duration
+}
+
+// Chart area of the timeline, inside its axes.
+const (
+	reportChartWidth  = 720
+	reportChartHeight = 240
+)
+
+// reportStats copies what the report needs out of the run's stats.
+func (s *runStats) reportStats() (start time.Time, leaseTimes, strained []time.Time, latencies []time.Duration, failures map[string]int, exhausted time.Time, launched, leased int, notes []operatorNote) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	failures = make(map[string]int, len(s.failures))
+	for kind, n := range s.failures {
+		failures[kind] = n
+	}
+	return s.start, append([]time.Time(nil), s.leaseTimes...), append([]time.Time(nil), s.strained...), append([]time.Duration(nil), s.latencies...), failures, s.exhausted, s.launched, s.leased, append([]operatorNote(nil), s.notes...)
+}
+
+// writeReport renders the run's HTML report to path. target describes the
+// networks the run was on and networks has their sections, if there are
+// several; watch may be nil.
+func writeReport(path string, cfg Config, target string, stats *runStats, leases *leaseTable, watch *serverWatch, networks []networkSection) error {
+	start, leaseTimes, strained, latencies, failures, exhausted, launched, leased, notes := stats.reportStats()
+	now := clock.Now()
+	r := runReport{
+		Generated: now,
+		Scenario:  cfg.Scenario,
+		Mode:      cfg.Mode,
+		Target:    target,
+		Leases:    leases.snapshot(),
+		Notes:     notes,
+		Start:     start,
+		Servers:   watch.snapshot(),
+		Networks:  networks,
+	}
+
+	r.Outcome = "Launching stopped before the pool was exhausted"
+	if !exhausted.IsZero() {
+		r.Outcome = fmt.Sprintf("Pool exhausted after %v", exhausted.Sub(start).Round(time.Second))
+	}
+	r.Summary = []reportRow{
+		{"Elapsed time", now.Sub(start).Round(time.Second).String()},
+		{"Clients launched", fmt.Sprint(launched)},
+		{"Leases acquired", fmt.Sprint(leased)},
+		{"Leases held at the end", fmt.Sprint(len(leases.held()))},
+	}
+	if launched > 0 {
+		failed := launched - leased
+		r.Summary = append(r.Summary, reportRow{"Launch failures", fmt.Sprintf("%d (%.1f%% of launches)", failed, float64(failed)/float64(launched)*100)})
+	}
+	conflicts := 0
+	for _, l := range r.Leases {
+		if len(l.ConflictMACs) > 0 {
+			conflicts++
+		}
+	}
+	if conflicts > 0 {
+		r.Summary = append(r.Summary, reportRow{"Leases already in use", fmt.Sprint(conflicts)})
+	}
+
+	if len(latencies) > 0 {
+		for _, p := range []float64{50, 90, 95, 99, 100} {
+			label := fmt.Sprintf("p%.0f", p)
+			if p == 100 {
+				label = "max"
+			}
+			r.Latency = append(r.Latency, reportRow{label, percentile(latencies, p).Round(time.Millisecond).String()})
+		}
+	}
+	kinds := make([]string, 0, len(failures))
+	for kind := range failures {
+		kinds = append(kinds, kind)
+	}
+	sort.Slice(kinds, func(i, j int) bool { return failures[kinds[i]] > failures[kinds[j]] })
+	for _, kind := range kinds {
+		r.Failures = append(r.Failures, reportRow{kind, fmt.Sprint(failures[kind])})
+	}
+
+	responses, reasons, diagnosis := stats.responseReport()
+	r.Responses, r.Diagnosis = responses, diagnosis
+	messages := make([]string, 0, len(reasons))
+	for message := range reasons {
+		messages = append(messages, message)
+	}
+	sort.Slice(messages, func(i, j int) bool { return reasons[messages[i]] > reasons[messages[j]] })
+	for _, message := range messages {
+		r.NAKReasons = append(r.NAKReasons, reportRow{message, fmt.Sprint(reasons[message])})
+	}
+
+	byServer := make(map[string]int)
+	for _, l := range r.Leases {
+		byServer[orDash(l.Server)]++
+	}
+	servers := make([]string, 0, len(byServer))
+	for server := range byServer {
+		servers = append(servers, server)
+	}
+	sort.Slice(servers, func(i, j int) bool { return byServer[servers[i]] > byServer[servers[j]] })
+	for _, server := range servers {
+		r.LeasesByServer = append(r.LeasesByServer, reportRow{server, fmt.Sprint(byServer[server])})
+	}
+
+	// Leases adopted from before a restart all came before this process's.
+	r.Timeline = timelineChart(start, now, append(stats.adoptedTimes(), leaseTimes...), strained, exhausted)
+	settings, err := changedSettings(cfg)
+	if err != nil {
+		return err
+	}
+	r.Settings = settings
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create report %s: %v", path, err)
+	}
+	if err := reportTemplate.Execute(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write report %s: %v", path, err)
+	}
+	return f.Close()
+}
+
+// timelineChart lays the leases and failures of the run out on the chart.
+func timelineChart(start, end time.Time, leaseTimes, failures []time.Time, exhausted time.Time) reportTimeline {
+	t := reportTimeline{Width: reportChartWidth, Height: reportChartHeight, MaxLeases: len(leaseTimes), Elapsed: end.Sub(start).Round(time.Second)}
+	span := end.Sub(start)
+	if span <= 0 {
+		span = time.Second
+	}
+	x := func(at time.Time) float64 {
+		return float64(at.Sub(start)) / float64(span) * reportChartWidth
+	}
+	y := func(n int) float64 {
+		if t.MaxLeases == 0 {
+			return reportChartHeight
+		}
+		return reportChartHeight - float64(n)/float64(t.MaxLeases)*reportChartHeight
+	}
+	points := []string{fmt.Sprintf("0,%.1f", y(0))}
+	for i, at := range leaseTimes {
+		// A step: the count holds until the next lease.
+		points = append(points, fmt.Sprintf("%.1f,%.1f", x(at), y(i)), fmt.Sprintf("%.1f,%.1f", x(at), y(i+1)))
+	}
+	points = append(points, fmt.Sprintf("%d,%.1f", reportChartWidth, y(len(leaseTimes))))
+	t.Points = strings.Join(points, " ")
+	for _, at := range failures {
+		t.Failures = append(t.Failures, x(at))
+	}
+	if !exhausted.IsZero() {
+		t.Exhausted = x(exhausted)
+	}
+	return t
+}
+
+// changedSettings lists the options of cfg that differ from the defaults,
+// by their configuration file keys.
+func changedSettings(cfg Config) ([]reportRow, error) {
+	current, err := configKeys(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defaults, err := configKeys(defaultConfig())
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(current))
+	for key := range current {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var rows []reportRow
+	for _, key := range keys {
+		if reflect.DeepEqual(current[key], defaults[key]) {
+			continue
+		}
+		value := fmt.Sprint(current[key])
+		if list, ok := current[key].([]any); ok {
+			items := make([]string, len(list))
+			for i, item := range list {
+				items[i] = fmt.Sprint(item)
+			}
+			value = strings.Join(items, ", ")
+		}
+		rows = append(rows, reportRow{key, value})
+	}
+	return rows, nil
+}
+
+// configSecrets are the configuration file keys whose values stay out of
+// reports and the results database, as auditSecrets do out of the audit log.
+var configSecrets = map[string]bool{"snmp_community": true, "snmp_auth_pass": true, "snmp_priv_pass": true}
+
+// configKeys maps cfg's configuration file keys to their values, with
+// configSecrets that differ from their defaults shown as REDACTED.
+func configKeys(cfg Config) (map[string]any, error) {
+	keys, err := rawConfigKeys(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defaults, err := rawConfigKeys(defaultConfig())
+	if err != nil {
+		return nil, err
+	}
+	for key := range configSecrets {
+		if keys[key] != defaults[key] {
+			keys[key] = "REDACTED"
+		}
+	}
+	return keys, nil
+}
+
+func rawConfigKeys(cfg Config) (map[string]any, error) {
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode the configuration: %v", err)
+	}
+	var keys map[string]any
+	if err := yaml.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("failed to encode the configuration: %v", err)
+	}
+	return keys, nil
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"stamp": func(t time.Time) string { return t.Format("2006-01-02 15:04:05") },
+	"since": func(start, t time.Time) string { return "+" + t.Sub(start).Round(time.Second).String() },
+	"after": func(d time.Duration) string { return "+" + d.Round(time.Second).String() },
+	"ms":    func(d time.Duration) string { return d.Round(time.Millisecond).String() },
+	"join":  func(s []string) string { return strings.Join(s, ", ") },
+	"dash":  orDash,
+	"plus":  func(a, b int) int { return a + b },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>ipocalypse run report {{stamp .Generated}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; color: #1f2328; margin: 2em auto; max-width: 1100px; padding: 0 1em; }
+h1 { margin-bottom: 0.2em; }
+h2 { border-bottom: 1px solid #d0d7de; padding-bottom: 0.2em; margin-top: 1.6em; }
+.meta { color: #59636e; }
+.outcome { font-size: 1.2em; font-weight: 600; }
+table { border-collapse: collapse; margin: 0.5em 0; font-size: 0.92em; }
+th, td { border: 1px solid #d0d7de; padding: 0.25em 0.6em; text-align: left; }
+th { background: #f6f8fa; }
+td.num { text-align: right; }
+tr.flag td { background: #fff1e5; }
+.grid { display: flex; gap: 2em; flex-wrap: wrap; }
+svg text { font-size: 11px; fill: #59636e; }
+</style>
+</head>
+<body>
+<h1>ipocalypse run report</h1>
+<p class="meta">Generated {{stamp .Generated}} &middot; {{.Scenario}} scenario on the {{.Mode}} engine &middot; {{.Target}}</p>
+<p class="outcome">{{.Outcome}}</p>
+
+<h2>Summary</h2>
+<div class="grid">
+<table>
+{{range .Summary}}<tr><th>{{.Label}}</th><td class="num">{{.Value}}</td></tr>
+{{end}}</table>
+{{if .Latency}}<table>
+<tr><th colspan="2">Lease latency</th></tr>
+{{range .Latency}}<tr><th>{{.Label}}</th><td class="num">{{.Value}}</td></tr>
+{{end}}</table>{{end}}
+{{if .Failures}}<table>
+<tr><th colspan="2">Failures by kind</th></tr>
+{{range .Failures}}<tr><th>{{.Label}}</th><td class="num">{{.Value}}</td></tr>
+{{end}}</table>{{end}}
+</div>
+
+{{range .Networks}}<h2>Network {{.Name}} ({{.Subnet}})</h2>
+<table>
+{{range .Rows}}<tr><th>{{.Label}}</th><td class="num">{{.Value}}</td></tr>
+{{end}}</table>
+{{end}}
+{{if .Responses}}<h2>Server responses</h2>
+{{if .Diagnosis}}<p class="outcome">{{.Diagnosis}}</p>
+{{end}}<div class="grid">
+<table>
+<tr><th>Response</th><th>Count</th><th>First</th><th>Last</th><th>Wait p50</th><th>Leases between</th></tr>
+{{range .Responses}}<tr><th>{{.Label}}</th><td class="num">{{.Count}}</td><td class="num">{{after .First}}</td><td class="num">{{after .Last}}</td><td class="num">{{if .Wait}}{{ms .Wait}}{{else}}-{{end}}</td><td class="num">{{.LeasesBetween}}</td></tr>
+{{end}}</table>
+{{if .NAKReasons}}<table>
+<tr><th colspan="2">NAK messages</th></tr>
+{{range .NAKReasons}}<tr><th>{{.Label}}</th><td class="num">{{.Value}}</td></tr>
+{{end}}</table>{{end}}
+</div>{{end}}
+
+<h2>Exhaustion timeline</h2>
+{{with .Timeline}}<svg width="{{plus .Width 70}}" height="{{plus .Height 40}}" role="img" aria-label="Leases acquired over the run">
+<g transform="translate(60,10)">
+<line x1="0" y1="{{.Height}}" x2="{{.Width}}" y2="{{.Height}}" stroke="#59636e"/>
+<line x1="0" y1="0" x2="0" y2="{{.Height}}" stroke="#59636e"/>
+<text x="-6" y="4" text-anchor="end">{{.MaxLeases}}</text>
+<text x="-6" y="{{.Height}}" text-anchor="end">0</text>
+<text x="0" y="{{plus .Height 16}}">0s</text>
+<text x="{{.Width}}" y="{{plus .Height 16}}" text-anchor="end">{{.Elapsed}}</text>
+<polyline points="{{.Points}}" fill="none" stroke="#0969da" stroke-width="2"/>
+{{$h := .Height}}{{range .Failures}}<line x1="{{.}}" y1="{{$h}}" x2="{{.}}" y2="{{plus $h -8}}" stroke="#cf222e"/>
+{{end}}{{if .Exhausted}}<line x1="{{.Exhausted}}" y1="0" x2="{{.Exhausted}}" y2="{{.Height}}" stroke="#9a6700" stroke-dasharray="4 3"/>
+<text x="{{.Exhausted}}" y="-1" text-anchor="middle">exhausted</text>{{end}}
+</g>
+</svg>
+<p class="meta">Blue: leases acquired. Red ticks: failed launches, other than for an exhausted pool.{{if .Exhausted}} Dashed: the pool ran out.{{end}}</p>{{end}}
+
+<h2>DHCP servers</h2>
+{{if .Servers}}<table>
+<tr><th>Server</th><th>MACs</th><th>Offers</th><th>ACKs</th><th>NAKs</th><th>First seen</th><th></th></tr>
+{{range .Servers}}<tr{{if .Rogue}} class="flag"{{end}}><td>{{.IP}}</td><td>{{join .MACs}}</td><td class="num">{{.Offers}}</td><td class="num">{{.Acks}}</td><td class="num">{{.Naks}}</td><td>{{stamp .FirstSeen}}</td><td>{{if .Rogue}}competing{{else}}target{{end}}</td></tr>
+{{end}}</table>{{end}}
+{{if .LeasesByServer}}<table>
+<tr><th>Granted by</th><th>Leases</th></tr>
+{{range .LeasesByServer}}<tr><td>{{.Label}}</td><td class="num">{{.Value}}</td></tr>
+{{end}}</table>{{else}}<p>No leases were granted.</p>{{end}}
+
+<h2>Leases ({{len .Leases}})</h2>
+{{if .Leases}}<table>
+<tr><th>IP</th><th>MAC</th><th>Server</th><th>Lease</th><th>Client ID</th><th>Image</th><th>Network</th><th>Acquired</th><th>Released</th><th>Conflict</th></tr>
+{{$start := .Start}}{{range .Leases}}<tr{{if .ConflictMACs}} class="flag"{{end}}><td>{{.IP}}</td><td>{{.MAC}}</td><td>{{dash .Server}}</td><td class="num">{{if .LeaseSeconds}}{{.LeaseSeconds}}s{{else}}-{{end}}</td><td>{{dash .ClientID}}</td><td>{{dash .Image}}</td><td>{{dash .Network}}</td><td>{{since $start .AcquiredAt}}</td><td>{{with .ReleasedAt}}{{since $start .}}{{else}}-{{end}}</td><td>{{if .ConflictMACs}}{{join .ConflictMACs}}{{else}}-{{end}}</td></tr>
+{{end}}</table>{{end}}
+
+{{if .Notes}}<h2>Operator notes</h2>
+<table>
+{{$start := .Start}}{{range .Notes}}<tr><td>{{stamp .Time}} ({{since $start .Time}})</td><td>{{.Text}}</td></tr>
+{{end}}</table>{{end}}
+
+<h2>Configuration</h2>
+{{if .Settings}}<p class="meta">Options that differ from the defaults.</p>
+<table>
+{{range .Settings}}<tr><th>{{.Label}}</th><td>{{.Value}}</td></tr>
+{{end}}</table>{{else}}<p>Every option at its default.</p>{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestChangedSettingsRedactsSecrets(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.SNMPSwitch = "10.0.0.2"
+	cfg.SNMPCommunity = "s3cret-community"
+	cfg.SNMPUser = "monitor"
+	cfg.SNMPAuthPass = "s3cret-auth"
+	cfg.SNMPPrivPass = "s3cret-priv"
+	rows, err := changedSettings(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string, len(rows))
+	for _, row := range rows {
+		if strings.Contains(row.Value, "s3cret") {
+			t.Errorf("%s = %q leaks a secret", row.Label, row.Value)
+		}
+		got[row.Label] = row.Value
+	}
+	for _, key := range []string{"snmp_community", "snmp_auth_pass", "snmp_priv_pass"} {
+		if got[key] != "REDACTED" {
+			t.Errorf("%s = %q, want it listed as REDACTED", key, got[key])
+		}
+	}
+	if got["snmp_user"] != "monitor" {
+		t.Errorf("snmp_user = %q, want monitor", got["snmp_user"])
+	}
+
+	// The default community is no secret, and unchanged.
+	keys, err := configKeys(defaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys["snmp_community"] != "public" {
+		t.Errorf("default snmp_community = %v, want public", keys["snmp_community"])
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// Output formats of the leases subcommand.
+const (
+	leaseFormatTable = "table"
+	leaseFormatJSON  = "json"
+	leaseFormatISC   = "isc"
+	leaseFormatKea   = "kea"
+)
+
+// reservationIdentities returns the held leases a server-side reservation or
+// deny entry is written for: released leases are skipped and each MAC keeps
+// only its latest address.
+func reservationIdentities(records []leaseRecord) []leaseRecord {
+	latest := make(map[string]int)
+	var identities []leaseRecord
+	for _, r := range records {
+		if r.ReleasedAt != nil || r.MAC == "" {
+			continue
+		}
+		mac := strings.ToLower(r.MAC)
+		if i, ok := latest[mac]; ok {
+			identities[i] = r
+			continue
+		}
+		latest[mac] = len(identities)
+		identities = append(identities, r)
+	}
+	return identities
+}
+
+// writeISCHosts writes ISC dhcpd host declarations for the test identities.
+// Reservations pin each MAC to the address it held; with deny the hosts are
+// refused instead.
+func writeISCHosts(w io.Writer, records []leaseRecord, deny bool) {
+	for _, r := range reservationIdentities(records) {
+		fmt.Fprintf(w, "host ipocalypse-%s {\n", strings.ReplaceAll(strings.ToLower(r.MAC), ":", ""))
+		fmt.Fprintf(w, "  hardware ethernet %s;\n", strings.ToLower(r.MAC))
+		switch ip := net.ParseIP(r.IP); {
+		case deny:
+			fmt.Fprintln(w, "  deny booting;")
+		case ip == nil:
+		case ip.To4() != nil:
+			fmt.Fprintf(w, "  fixed-address %s;\n", ip)
+		default:
+			fmt.Fprintf(w, "  fixed-address6 %s;\n", ip)
+		}
+		fmt.Fprintln(w, "}")
+	}
+}
+
+// keaReservation is one entry of a Kea subnet's "reservations" list.
+type keaReservation struct {
+	HWAddress     string   `json:"hw-address"`
+	IPAddress     string   `json:"ip-address,omitempty"`
+	IPAddresses   []string `json:"ip-addresses,omitempty"`
+	ClientClasses []string `json:"client-classes,omitempty"`
+}
+
+// writeKeaReservations writes a Kea "reservations" list for the test
+// identities, to paste into the subnet4 or subnet6 entry. With deny each
+// identity is put in Kea's built-in DROP class, whose packets are dropped.
+func writeKeaReservations(w io.Writer, records []leaseRecord, deny bool) error {
+	reservations := []keaReservation{}
+	for _, r := range reservationIdentities(records) {
+		res := keaReservation{HWAddress: strings.ToLower(r.MAC)}
+		switch ip := net.ParseIP(r.IP); {
+		case deny:
+			res.ClientClasses = []string{"DROP"}
+		case ip == nil:
+		case ip.To4() != nil:
+			res.IPAddress = ip.String()
+		default:
+			res.IPAddresses = []string{ip.String()}
+		}
+		reservations = append(reservations, res)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(map[string]any{"reservations": reservations})
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// reserveSweepInterval is how often the reserve re-counts the addresses used
+// by other devices with an ARP sweep.
+const reserveSweepInterval = 30 * time.Second
+
+// freeReserve keeps at least min addresses of the pool free for legitimate
+// devices, for engagements that call for pressure but not an outage. It
+// estimates the free addresses as the pool size less the addresses other
+// devices answer ARP on and the leases the run holds, holds back launches that
+// would eat into the reserve and releases the run's own leases when the
+// estimate drops below it. The pool size starts as the subnet size and is
+// corrected the first time the server runs out of addresses.
+type freeReserve struct {
+	netCfg  *NetworkConfig
+	min     int
+	leases  *leaseTable
+	release func(ctx context.Context, r leaseRecord) error
+
+	// balance serializes rebalancing so concurrent workers do not release
+	// the same shortfall twice.
+	balance sync.Mutex
+
+	mu         sync.Mutex
+	capacity   int
+	others     int
+	released   int
+	calibrated bool
+}
+
+// newFreeReserve returns a reserve of min addresses, or nil when min is 0.
+// release gives one of the run's leases back to the server.
+func newFreeReserve(netCfg *NetworkConfig, min int, leases *leaseTable, release func(ctx context.Context, r leaseRecord) error) (*freeReserve, error) {
+	if min < 0 {
+		return nil, fmt.Errorf("-reserve-free must not be negative")
+	}
+	if min == 0 {
+		return nil, nil
+	}
+	return &freeReserve{netCfg: netCfg, min: min, leases: leases, release: release, capacity: poolCapacity(netCfg)}, nil
+}
+
+// free returns the current estimate of free addresses and whether one can be
+// made at all.
+func (r *freeReserve) free() (int, bool) {
+	held := len(r.leases.held())
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.capacity <= 0 {
+		return 0, false
+	}
+	return r.capacity - r.others - held, true
+}
+
+// wait blocks while launching another client would eat into the reserve.
+// A nil reserve never blocks.
+func (r *freeReserve) wait(ctx context.Context) {
+	if r == nil {
+		return
+	}
+	for {
+		if free, ok := r.free(); !ok || free > r.min {
+			return
+		}
+		select {
+		case <-clock.After(time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// exhausted records that the server had no address left: the pool is exactly
+// the addresses in use, so the pool size is corrected to match before the
+// reserve is restored. Reports from launches that were already in flight when
+// the reserve was restored are ignored.
+func (r *freeReserve) exhausted(ctx context.Context) {
+	r.balance.Lock()
+	defer r.balance.Unlock()
+	if free, ok := r.free(); ok && free <= r.min {
+		return
+	}
+	held := len(r.leases.held())
+	r.mu.Lock()
+	if r.capacity != r.others+held {
+		r.capacity = r.others + held
+		slog.Info("pool size corrected at exhaustion", "pool", r.capacity, "held", held, "others", r.others)
+	}
+	r.calibrated = true
+	r.mu.Unlock()
+	r.restore(ctx)
+}
+
+// rebalance releases the run's oldest leases until the reserve is restored.
+// A nil reserve does nothing.
+func (r *freeReserve) rebalance(ctx context.Context) {
+	if r == nil {
+		return
+	}
+	r.balance.Lock()
+	defer r.balance.Unlock()
+	r.restore(ctx)
+}
+
+// restore releases leases to cover the shortfall. Callers must hold
+// r.balance.
+func (r *freeReserve) restore(ctx context.Context) {
+	free, ok := r.free()
+	if !ok || free >= r.min {
+		return
+	}
+	held := r.leases.held()
+	for i := 0; i < r.min-free && i < len(held) && ctx.Err() == nil; i++ {
+		lease := held[i]
+		if err := r.release(ctx, lease); err != nil {
+			slog.Warn("failed to release lease for the free reserve", "ip", lease.IP, "mac", lease.MAC, "error", err)
+			continue
+		}
+		r.leases.markReleased(lease.IP)
+		r.mu.Lock()
+		r.released++
+		r.mu.Unlock()
+		slog.Info("released lease to keep addresses free", "ip", lease.IP, "mac", lease.MAC, "reserve", r.min)
+	}
+}
+
+// watch re-counts the addresses used by other devices every interval until
+// ctx is done. A nil reserve returns immediately.
+func (r *freeReserve) watch(ctx context.Context, interval time.Duration) {
+	if r == nil {
+		return
+	}
+	for {
+		r.sweep(ctx)
+		r.rebalance(ctx)
+		select {
+		case <-clock.After(interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sweep ARPs the subnet and counts the answering addresses the run does not
+// hold. Subnets too large to sweep, and the LANs of remote engines, rely on
+// the exhaustion correction alone.
+func (r *freeReserve) sweep(ctx context.Context) {
+	if r.netCfg.Host.remote() {
+		return
+	}
+	obs := newObserver(r.netCfg, nil)
+	if err := obs.sweep(ctx); err != nil {
+		if ctx.Err() == nil {
+			slog.Warn("free reserve ARP sweep failed", "error", err)
+		}
+		return
+	}
+	ours := make(map[string]bool)
+	for _, lease := range r.leases.held() {
+		ours[lease.IP] = true
+	}
+	obs.mu.Lock()
+	others := 0
+	for ip := range obs.inUse {
+		if !ours[ip] {
+			others++
+		}
+	}
+	obs.mu.Unlock()
+	r.mu.Lock()
+	r.others = others
+	r.mu.Unlock()
+}
+
+// printSummary reports how the reserve was kept. A nil reserve prints
+// nothing.
+func (r *freeReserve) printSummary() {
+	if r == nil {
+		return
+	}
+	free, ok := r.free()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	estimate := "unknown"
+	if ok {
+		estimate = fmt.Sprintf("%d", free)
+		if !r.calibrated {
+			estimate += " (pool size not confirmed by exhaustion)"
+		}
+	}
+	fmt.Printf("Free reserve:      %d addresses kept free, %d leases released, %s free now\n", r.min, r.released, estimate)
+}
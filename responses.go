@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// responseDecline is the kind the clients' DHCPDECLINEs are counted under.
+const responseDecline = "decline"
+
+// responseKinds are the server responses the run tells apart beyond a lease,
+// in the order they are reported: refusals, silence, and the clients'
+// declines of addresses they were given.
+var responseKinds = []struct {
+	kind  string
+	label string
+}{
+	{"nak", "NAK"},
+	{"no_ack", "offer, no ACK"},
+	{"no_lease", "no answer"},
+	{"apipa", "no answer, APIPA"},
+	{responseDecline, "client DECLINE"},
+}
+
+// responseTiming is when one kind of response came over the run, and how
+// long the launches that got it waited for it.
+type responseTiming struct {
+	count       int
+	first, last time.Time
+	waits       []time.Duration
+}
+
+// responseRow is one kind of response, as the summary, the summary event and
+// the report give it.
+type responseRow struct {
+	Kind  string `json:"kind"`
+	Label string `json:"-"`
+	Count int    `json:"count"`
+	// First and Last are how far into the run the first and last came.
+	First time.Duration `json:"-"`
+	Last  time.Duration `json:"-"`
+	// Wait is the median time the launches waited for the response, or
+	// for an answer that never came; 0 for declines.
+	Wait time.Duration `json:"-"`
+	// LeasesBetween counts the leases granted between the first and the
+	// last, which tells a server that came back from one that did not.
+	LeasesBetween int `json:"leases_between"`
+
+	FirstAfterSeconds float64 `json:"first_after_seconds"`
+	LastAfterSeconds  float64 `json:"last_after_seconds"`
+	WaitP50Ms         int64   `json:"wait_p50_ms"`
+}
+
+// recordResponse counts a response of kind that came after the launch
+// waited wait. Callers must hold s.mu.
+func (s *runStats) recordResponse(kind string, wait time.Duration) {
+	r := s.responses[kind]
+	if r == nil {
+		r = &responseTiming{first: clock.Now()}
+		s.responses[kind] = r
+	}
+	r.count++
+	r.last = clock.Now()
+	if wait > 0 {
+		r.waits = append(r.waits, wait)
+	}
+}
+
+// recordDecline counts a DHCPDECLINE a client sent for an address it was
+// given, as the -dhcp-latency capture sees them.
+func (s *runStats) recordDecline() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recordResponse(responseDecline, 0)
+}
+
+// recordNAKReason counts the message (option 56) a server gave with a NAK,
+// as the -dhcp-latency capture sees them.
+func (s *runStats) recordNAKReason(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nakReasons[reason]++
+}
+
+// responseRows returns the responses seen, in responseKinds order. Callers
+// must hold s.mu.
+func (s *runStats) responseRows() []responseRow {
+	var rows []responseRow
+	for _, k := range responseKinds {
+		r := s.responses[k.kind]
+		if r == nil {
+			continue
+		}
+		row := responseRow{
+			Kind:          k.kind,
+			Label:         k.label,
+			Count:         r.count,
+			First:         r.first.Sub(s.start),
+			Last:          r.last.Sub(s.start),
+			Wait:          percentile(r.waits, 50),
+			LeasesBetween: s.leasesBetween(r.first, r.last),
+		}
+		row.FirstAfterSeconds = row.First.Seconds()
+		row.LastAfterSeconds = row.Last.Seconds()
+		row.WaitP50Ms = row.Wait.Milliseconds()
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// leasesBetween counts the leases granted after from and before to. Callers
+// must hold s.mu.
+func (s *runStats) leasesBetween(from, to time.Time) int {
+	i := sort.Search(len(s.leaseTimes), func(i int) bool { return s.leaseTimes[i].After(from) })
+	j := sort.Search(len(s.leaseTimes), func(j int) bool { return !s.leaseTimes[j].Before(to) })
+	return max(j-i, 0)
+}
+
+// span returns the first and last time any of kinds came, and how many came.
+// Callers must hold s.mu.
+func (s *runStats) span(kinds ...string) (first, last time.Time, count int) {
+	for _, kind := range kinds {
+		r := s.responses[kind]
+		if r == nil {
+			continue
+		}
+		if first.IsZero() || r.first.Before(first) {
+			first = r.first
+		}
+		if r.last.After(last) {
+			last = r.last
+		}
+		count += r.count
+	}
+	return first, last, count
+}
+
+// diagnosis reads the responses for why the server stopped granting leases,
+// the call otherwise made by hand from the server's logs and a capture: a
+// pool that ran out, a server rate-limiting the run, or a switch dropping
+// the run's DHCP traffic before it reached the server. It is empty when no
+// launch was refused or went unanswered. Callers must hold s.mu.
+func (s *runStats) diagnosis() string {
+	refusedFirst, _, refused := s.span("nak", "no_ack")
+	silentFirst, silentLast, silent := s.span("no_lease", "apipa")
+	now := clock.Now()
+	switch {
+	case refused+silent == 0:
+		return ""
+	case silent > 0 && s.leasesBetween(silentFirst, silentLast) > 0:
+		return fmt.Sprintf("rate-limited: %d launches went unanswered between +%v and +%v, with %d leases granted in between, so the server came back after each spell of silence",
+			silent, silentFirst.Sub(s.start).Round(time.Second), silentLast.Sub(s.start).Round(time.Second), s.leasesBetween(silentFirst, silentLast))
+	case refused > 0 && s.leasesBetween(refusedFirst, now) == 0:
+		line := fmt.Sprintf("pool exhausted: the server refused every request from +%v on, after %d leases", refusedFirst.Sub(s.start).Round(time.Second), s.leased)
+		if reason := s.topNAKReason(); reason != "" {
+			line += fmt.Sprintf(" (its NAKs said %q)", reason)
+		}
+		return line
+	case refused > 0:
+		return fmt.Sprintf("refusing some requests: %d NAKs or unacknowledged offers among the leases, which points to addresses in use or an allocation policy rather than an empty pool", refused)
+	}
+	line := fmt.Sprintf("the server went silent at +%v after %d leases", silentFirst.Sub(s.start).Round(time.Second), s.leased)
+	switch {
+	case s.capacity == 0:
+		return "pool exhausted or dropped by the switch: " + line + "; the pool size is unknown, so check the server's free addresses and the switch's DHCP snooping counters"
+	case s.leased < s.capacity*9/10:
+		return fmt.Sprintf("dropped on the way: %s of about %d, short of an exhausted pool, without a NAK; DHCP snooping or port security on the switch is the likely cause (see -snmp-switch)", line, s.capacity)
+	}
+	return fmt.Sprintf("pool exhausted: %s of about %d", line, s.capacity)
+}
+
+// topNAKReason returns the message servers gave most with their NAKs, empty
+// if none was captured. Callers must hold s.mu.
+func (s *runStats) topNAKReason() string {
+	top := ""
+	for reason, n := range s.nakReasons {
+		if top == "" || n > s.nakReasons[top] || n == s.nakReasons[top] && reason < top {
+			top = reason
+		}
+	}
+	return top
+}
+
+// responseReport returns the responses seen, the NAK messages captured and
+// the diagnosis, for the report.
+func (s *runStats) responseReport() (rows []responseRow, reasons map[string]int, diagnosis string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reasons = make(map[string]int, len(s.nakReasons))
+	for reason, n := range s.nakReasons {
+		reasons[reason] = n
+	}
+	return s.responseRows(), reasons, s.diagnosis()
+}
+
+// printResponses prints the responses table, the NAK messages and the
+// diagnosis of the summary. Callers must hold s.mu.
+func (s *runStats) printResponses() {
+	rows := s.responseRows()
+	if len(rows) == 0 {
+		return
+	}
+	fmt.Println("Server responses:")
+	fmt.Printf("  %-16s  %5s  %8s  %8s  %8s  %14s\n", "RESPONSE", "COUNT", "FIRST", "LAST", "WAIT P50", "LEASES BETWEEN")
+	for _, row := range rows {
+		wait := "-"
+		if row.Wait > 0 {
+			wait = row.Wait.Round(time.Millisecond).String()
+		}
+		fmt.Printf("  %-16s  %5d  %8s  %8s  %8s  %14d\n", row.Label, row.Count, "+"+row.First.Round(time.Second).String(), "+"+row.Last.Round(time.Second).String(), wait, row.LeasesBetween)
+	}
+	if len(s.nakReasons) > 0 {
+		reasons := make([]string, 0, len(s.nakReasons))
+		for reason := range s.nakReasons {
+			reasons = append(reasons, reason)
+		}
+		sort.Slice(reasons, func(i, j int) bool { return s.nakReasons[reasons[i]] > s.nakReasons[reasons[j]] })
+		var parts []string
+		for _, reason := range reasons {
+			parts = append(parts, fmt.Sprintf("%q %d", reason, s.nakReasons[reason]))
+		}
+		fmt.Printf("NAK messages:      %s\n", strings.Join(parts, ", "))
+	}
+	if d := s.diagnosis(); d != "" {
+		fmt.Printf("Diagnosis:         %s\n", d)
+	}
+}
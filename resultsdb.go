@@ -0,0 +1,607 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// The -results-db database is a plain SQLite file, written and read through
+// the embedded, cgo-free SQLite driver, so it can be queried directly too:
+//
+//	runs       one row per run: options, counts and outcome
+//	leases     every lease the run acquired
+//	latencies  each lease's latency, by its offset into the run
+//	failures   failed launches by kind
+const resultsSchema = `
+CREATE TABLE IF NOT EXISTS runs (
+	id TEXT PRIMARY KEY,
+	label TEXT NOT NULL DEFAULT '',
+	started_at TEXT NOT NULL,
+	ended_at TEXT NOT NULL,
+	scenario TEXT NOT NULL DEFAULT '',
+	mode TEXT NOT NULL,
+	target TEXT NOT NULL,
+	outcome TEXT NOT NULL,
+	launched INTEGER NOT NULL,
+	leased INTEGER NOT NULL,
+	exhausted_after_seconds REAL,
+	settings TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS leases (
+	run_id TEXT NOT NULL REFERENCES runs(id),
+	ip TEXT NOT NULL,
+	mac TEXT NOT NULL,
+	server TEXT NOT NULL DEFAULT '',
+	lease_seconds INTEGER NOT NULL DEFAULT 0,
+	acquired_at TEXT NOT NULL,
+	released_at TEXT
+);
+CREATE TABLE IF NOT EXISTS latencies (
+	run_id TEXT NOT NULL REFERENCES runs(id),
+	at_seconds REAL NOT NULL,
+	latency_ms REAL NOT NULL
+);
+CREATE TABLE IF NOT EXISTS failures (
+	run_id TEXT NOT NULL REFERENCES runs(id),
+	kind TEXT NOT NULL,
+	count INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS leases_run ON leases(run_id);
+CREATE INDEX IF NOT EXISTS latencies_run ON latencies(run_id);
+CREATE INDEX IF NOT EXISTS failures_run ON failures(run_id);
+`
+
+// openResultsDB opens the SQLite database at path, creating it if need be.
+func openResultsDB(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return db, nil
+}
+
+// initResultsDB creates the tables in the database at path if they do not
+// exist yet, so a run that could not save its results stops before it
+// starts.
+func initResultsDB(path string) error {
+	db, err := openResultsDB(path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if _, err := db.Exec(resultsSchema); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// saveResults stores the run in the database at path, replacing what an
+// earlier save under the same run ID (a resumed run) stored. target
+// describes the networks the run was on.
+func saveResults(path, label string, cfg Config, target string, stats *runStats, leases *leaseTable) error {
+	start, leaseTimes, _, latencies, failures, exhausted, launched, leased, _ := stats.reportStats()
+	end := clock.Now()
+	settings, err := changedSettings(cfg)
+	if err != nil {
+		return err
+	}
+	changed := make(map[string]string, len(settings))
+	for _, s := range settings {
+		changed[s.Label] = s.Value
+	}
+	// Where the results went is not part of what the run did.
+	delete(changed, "results_db")
+	delete(changed, "results_label")
+	encoded, err := json.Marshal(changed)
+	if err != nil {
+		return fmt.Errorf("failed to encode the settings: %v", err)
+	}
+
+	outcome, exhaustedAfter := "stopped before exhaustion", any(nil)
+	if !exhausted.IsZero() {
+		outcome, exhaustedAfter = "exhausted", exhausted.Sub(start).Seconds()
+	}
+
+	db, err := openResultsDB(path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	defer tx.Rollback()
+	exec := func(query string, args ...any) {
+		if err == nil {
+			_, err = tx.Exec(query, args...)
+		}
+	}
+	exec("DELETE FROM leases WHERE run_id = ?", runID)
+	exec("DELETE FROM latencies WHERE run_id = ?", runID)
+	exec("DELETE FROM failures WHERE run_id = ?", runID)
+	exec("DELETE FROM runs WHERE id = ?", runID)
+	exec("INSERT INTO runs VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", runID, label, sqlTime(start), sqlTime(end), cfg.Scenario, cfg.Mode, target, outcome, launched, leased, exhaustedAfter, string(encoded))
+	for _, l := range leases.snapshot() {
+		var released any
+		if l.ReleasedAt != nil {
+			released = sqlTime(*l.ReleasedAt)
+		}
+		exec("INSERT INTO leases VALUES (?, ?, ?, ?, ?, ?, ?)", runID, l.IP, l.MAC, l.Server, l.LeaseSeconds, sqlTime(l.AcquiredAt), released)
+	}
+	for i, latency := range latencies {
+		exec("INSERT INTO latencies VALUES (?, ?, ?)", runID, leaseTimes[i].Sub(start).Seconds(), float64(latency)/float64(time.Millisecond))
+	}
+	for kind, n := range failures {
+		exec("INSERT INTO failures VALUES (?, ?, ?)", runID, kind, n)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// sqlTime renders t as stored: RFC 3339 text in UTC, which sorts
+// chronologically.
+func sqlTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// storedRun is a row of the runs table.
+type storedRun struct {
+	ID             string
+	Label          string
+	StartedAt      string
+	EndedAt        string
+	Scenario       string
+	Mode           string
+	Target         string
+	Outcome        string
+	Launched       int
+	Leased         int
+	ExhaustedAfter *float64
+	Settings       string
+}
+
+func (r storedRun) started() time.Time {
+	start, _ := time.Parse(time.RFC3339Nano, r.StartedAt)
+	return start
+}
+
+func (r storedRun) elapsed() time.Duration {
+	end, _ := time.Parse(time.RFC3339Nano, r.EndedAt)
+	return end.Sub(r.started())
+}
+
+func (r storedRun) exhaustedAfter() time.Duration {
+	if r.ExhaustedAfter == nil {
+		return 0
+	}
+	return time.Duration(*r.ExhaustedAfter * float64(time.Second))
+}
+
+// name is the run's ID with its label, if it has one.
+func (r storedRun) name() string {
+	if r.Label == "" {
+		return r.ID
+	}
+	return fmt.Sprintf("%s (%s)", r.ID, r.Label)
+}
+
+// runResults is a stored run with the measurements compare reads from the
+// other tables.
+type runResults struct {
+	storedRun
+	latencies []time.Duration
+	failures  map[string]int
+	// leaseTime is the median lease time granted.
+	leaseTime time.Duration
+	servers   []string
+	settings  map[string]string
+}
+
+// runCompare implements "ipocalypse compare": the results of two runs saved
+// with -results-db side by side.
+func runCompare(args []string) {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	dbPath := fs.String("db", "ipocalypse.db", "Results database written with -results-db")
+	list := fs.Bool("list", false, "List the stored runs instead of comparing two")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage:
+  ./ipocalypse compare [-db ipocalypse.db] [-list] [before after]
+
+Compares two runs saved with -results-db: time to exhaustion, leases, lease
+rate, failures, lease latency, lease time and servers, and the options that
+differ between them, e.g. before and after enabling DHCP snooping. Runs are
+named by ID, a unique prefix of one, or -results-label; without them the
+last two runs are compared.
+
+Options:
+`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *list {
+		if fs.NArg() != 0 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		if err := listRuns(*dbPath); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if fs.NArg() != 0 && fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err := compareRuns(*dbPath, fs.Args()); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// openStoredResults opens the existing database at path for compare.
+func openStoredResults(path string) (*sql.DB, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	return openResultsDB(path)
+}
+
+// storedRuns returns the runs in db, oldest first.
+func storedRuns(db *sql.DB) ([]storedRun, error) {
+	rows, err := db.Query("SELECT id, label, started_at, ended_at, scenario, mode, target, outcome, launched, leased, exhausted_after_seconds, settings FROM runs ORDER BY started_at, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var runs []storedRun
+	for rows.Next() {
+		var r storedRun
+		if err := rows.Scan(&r.ID, &r.Label, &r.StartedAt, &r.EndedAt, &r.Scenario, &r.Mode, &r.Target, &r.Outcome, &r.Launched, &r.Leased, &r.ExhaustedAfter, &r.Settings); err != nil {
+			return nil, err
+		}
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
+func listRuns(path string) error {
+	db, err := openStoredResults(path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	runs, err := storedRuns(db)
+	if err != nil {
+		return err
+	}
+	if len(runs) == 0 {
+		fmt.Printf("No runs stored in %s\n", path)
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RUN\tLABEL\tSCENARIO\tMODE\tTARGET\tLEASES\tEXHAUSTED AFTER")
+	for _, r := range runs {
+		exhausted := "-"
+		if r.ExhaustedAfter != nil {
+			exhausted = r.exhaustedAfter().Round(time.Second).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n", r.ID, orDash(r.Label), orDash(r.Scenario), r.Mode, r.Target, r.Leased, exhausted)
+	}
+	return w.Flush()
+}
+
+// findRun picks the run named by name: its ID, a unique prefix of one, or
+// its label (the latest run with it).
+func findRun(runs []storedRun, name string) (storedRun, error) {
+	var matches []storedRun
+	for _, r := range runs {
+		if r.ID == name {
+			return r, nil
+		}
+		if strings.HasPrefix(r.ID, name) {
+			matches = append(matches, r)
+		}
+	}
+	switch len(matches) {
+	case 1:
+		return matches[0], nil
+	case 0:
+		for i := len(runs) - 1; i >= 0; i-- {
+			if runs[i].Label == name {
+				return runs[i], nil
+			}
+		}
+		return storedRun{}, fmt.Errorf("no stored run %q", name)
+	}
+	return storedRun{}, fmt.Errorf("%q matches %d runs; give more of the ID", name, len(matches))
+}
+
+// loadResults reads what compare needs about run r from the other tables.
+func loadResults(db *sql.DB, r storedRun) (*runResults, error) {
+	res := &runResults{storedRun: r, failures: make(map[string]int), settings: make(map[string]string)}
+	if err := json.Unmarshal([]byte(r.Settings), &res.settings); err != nil {
+		return nil, fmt.Errorf("run %s: invalid settings: %v", r.ID, err)
+	}
+
+	err := queryRows(db, func(rows *sql.Rows) error {
+		var ms float64
+		if err := rows.Scan(&ms); err != nil {
+			return err
+		}
+		res.latencies = append(res.latencies, time.Duration(ms*float64(time.Millisecond)))
+		return nil
+	}, "SELECT latency_ms FROM latencies WHERE run_id = ? ORDER BY at_seconds", r.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = queryRows(db, func(rows *sql.Rows) error {
+		var kind string
+		var count int
+		if err := rows.Scan(&kind, &count); err != nil {
+			return err
+		}
+		res.failures[kind] = count
+		return nil
+	}, "SELECT kind, count FROM failures WHERE run_id = ?", r.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var leaseTimes []int
+	err = queryRows(db, func(rows *sql.Rows) error {
+		var seconds int
+		if err := rows.Scan(&seconds); err != nil {
+			return err
+		}
+		leaseTimes = append(leaseTimes, seconds)
+		return nil
+	}, "SELECT lease_seconds FROM leases WHERE run_id = ? AND lease_seconds > 0 ORDER BY lease_seconds", r.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(leaseTimes) > 0 {
+		res.leaseTime = time.Duration(leaseTimes[len(leaseTimes)/2]) * time.Second
+	}
+
+	err = queryRows(db, func(rows *sql.Rows) error {
+		var server string
+		if err := rows.Scan(&server); err != nil {
+			return err
+		}
+		res.servers = append(res.servers, server)
+		return nil
+	}, "SELECT DISTINCT server FROM leases WHERE run_id = ? AND server != '' ORDER BY server", r.ID)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// queryRows runs query with args against db and calls scan for each row.
+func queryRows(db *sql.DB, scan func(*sql.Rows) error, query string, args ...any) error {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// compareRuns prints the comparison of the two runs named, or of the last
+// two stored.
+func compareRuns(path string, names []string) error {
+	db, err := openStoredResults(path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	runs, err := storedRuns(db)
+	if err != nil {
+		return err
+	}
+	var picked []storedRun
+	if len(names) == 0 {
+		if len(runs) < 2 {
+			return fmt.Errorf("%s holds %d run(s); two are needed to compare", path, len(runs))
+		}
+		picked = runs[len(runs)-2:]
+	} else {
+		for _, name := range names {
+			r, err := findRun(runs, name)
+			if err != nil {
+				return err
+			}
+			picked = append(picked, r)
+		}
+	}
+	a, err := loadResults(db, picked[0])
+	if err != nil {
+		return err
+	}
+	b, err := loadResults(db, picked[1])
+	if err != nil {
+		return err
+	}
+	printComparison(a, b)
+	return nil
+}
+
+// printComparison prints run a against run b, b's changes relative to a.
+func printComparison(a, b *runResults) {
+	fmt.Println("=== Run Comparison ===")
+	fmt.Printf("Before: %s, started %s on %s\n", a.name(), a.started().Local().Format("2006-01-02 15:04:05"), a.Target)
+	fmt.Printf("After:  %s, started %s on %s\n", b.name(), b.started().Local().Format("2006-01-02 15:04:05"), b.Target)
+	fmt.Printf("Result: %s\n\n", comparisonVerdict(a, b))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\tBEFORE\tAFTER\tCHANGE")
+	row := func(label, before, after, change string) {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", label, before, after, change)
+	}
+	durationRow := func(label string, before, after time.Duration) {
+		change := "n/a"
+		if before > 0 && after > 0 {
+			change = percentChange(before, after)
+		}
+		row(label, orNone(before), orNone(after), change)
+	}
+	countRow := func(label string, before, after int) {
+		change := "n/a"
+		if before > 0 {
+			change = fmt.Sprintf("%+.0f%%", float64(after-before)/float64(before)*100)
+		}
+		row(label, fmt.Sprint(before), fmt.Sprint(after), change)
+	}
+
+	row("Scenario", orDash(a.Scenario), orDash(b.Scenario), "")
+	row("Mode", a.Mode, b.Mode, "")
+	row("Outcome", a.Outcome, b.Outcome, "")
+	durationRow("Time to exhaustion", a.exhaustedAfter(), b.exhaustedAfter())
+	durationRow("Elapsed time", a.elapsed(), b.elapsed())
+	countRow("Clients launched", a.Launched, b.Launched)
+	countRow("Leases acquired", a.Leased, b.Leased)
+	rateA, rateB := leaseRate(a), leaseRate(b)
+	rateChange := "n/a"
+	if rateA > 0 {
+		rateChange = fmt.Sprintf("%+.0f%%", (rateB-rateA)/rateA*100)
+	}
+	row("Leases per minute", fmt.Sprintf("%.1f", rateA), fmt.Sprintf("%.1f", rateB), rateChange)
+	row("Launch failures", failureShare(a), failureShare(b), "")
+	for _, p := range []float64{50, 95, 99} {
+		var before, after time.Duration
+		if len(a.latencies) > 0 {
+			before = percentile(a.latencies, p).Round(time.Millisecond)
+		}
+		if len(b.latencies) > 0 {
+			after = percentile(b.latencies, p).Round(time.Millisecond)
+		}
+		durationRow(fmt.Sprintf("Lease latency p%.0f", p), before, after)
+	}
+	durationRow("Median lease time", a.leaseTime, b.leaseTime)
+	row("Servers", orDash(strings.Join(a.servers, ", ")), orDash(strings.Join(b.servers, ", ")), "")
+	w.Flush()
+
+	kinds := make(map[string]bool)
+	for kind := range a.failures {
+		kinds[kind] = true
+	}
+	for kind := range b.failures {
+		kinds[kind] = true
+	}
+	if len(kinds) > 0 {
+		fmt.Println("\nFailures by kind:")
+		w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, kind := range sortedSet(kinds) {
+			fmt.Fprintf(w, "  %s\t%d\t%d\n", kind, a.failures[kind], b.failures[kind])
+		}
+		w.Flush()
+	}
+
+	keys := make(map[string]bool)
+	for key := range a.settings {
+		keys[key] = true
+	}
+	for key := range b.settings {
+		keys[key] = true
+	}
+	var differ []string
+	for _, key := range sortedSet(keys) {
+		before, inA := a.settings[key]
+		after, inB := b.settings[key]
+		if before != after || inA != inB {
+			differ = append(differ, key)
+		}
+	}
+	if len(differ) == 0 {
+		fmt.Println("\nBoth runs used the same options.")
+		return
+	}
+	// Only options changed from the defaults are stored; the others show
+	// this version's default.
+	defaults, _ := configKeys(defaultConfig())
+	setting := func(settings map[string]string, key string) string {
+		if value, ok := settings[key]; ok {
+			return value
+		}
+		return fmt.Sprintf("%v (default)", defaults[key])
+	}
+	fmt.Println("\nOptions that differ:")
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, key := range differ {
+		fmt.Fprintf(w, "  %s\t%s\t%s\n", key, setting(a.settings, key), setting(b.settings, key))
+	}
+	w.Flush()
+}
+
+// comparisonVerdict sums up whether the pool held out longer in run b.
+func comparisonVerdict(a, b *runResults) string {
+	before, after := a.exhaustedAfter(), b.exhaustedAfter()
+	switch {
+	case before > 0 && after == 0:
+		return fmt.Sprintf("the pool was exhausted after %v before, and not at all after (%d leases in %v)", before.Round(time.Second), b.Leased, b.elapsed().Round(time.Second))
+	case before == 0 && after > 0:
+		return fmt.Sprintf("the pool held out before, and was exhausted after %v after", after.Round(time.Second))
+	case before > 0 && after > 0:
+		return fmt.Sprintf("time to exhaustion went from %v to %v (%s)", before.Round(time.Second), after.Round(time.Second), percentChange(before, after))
+	}
+	return "neither run exhausted the pool"
+}
+
+// leaseRate is how many leases per minute a run acquired until the pool ran
+// out, or over the whole run if it did not.
+func leaseRate(r *runResults) float64 {
+	span := r.exhaustedAfter()
+	if span == 0 {
+		span = r.elapsed()
+	}
+	if span <= 0 {
+		return 0
+	}
+	return float64(r.Leased) / span.Minutes()
+}
+
+func failureShare(r *runResults) string {
+	if r.Launched == 0 {
+		return "0"
+	}
+	failed := r.Launched - r.Leased
+	return fmt.Sprintf("%d (%.1f%%)", failed, float64(failed)/float64(r.Launched)*100)
+}
+
+func orNone(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	}
+	return d.Round(time.Millisecond).String()
+}
+
+func sortedSet(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResultsDB(t *testing.T) {
+	c := useManualClock(t)
+	path := filepath.Join(t.TempDir(), "results.db")
+	if err := initResultsDB(path); err != nil {
+		t.Fatal(err)
+	}
+	savedID := runID
+	t.Cleanup(func() { runID = savedID })
+
+	cfg := defaultConfig()
+	cfg.Scenario = "starvation"
+	save := func(id, label string, leaseSeconds []int) {
+		t.Helper()
+		runID = id
+		stats, leases := newRunStats(), &leaseTable{}
+		for i, seconds := range leaseSeconds {
+			c.advance(time.Second)
+			stats.recordLease(launchKey{Worker: i}, time.Duration(100*(i+1))*time.Millisecond)
+			leases.add(leaseRecord{IP: "192.168.1.57", MAC: "02:42:ac:11:00:02", Server: "192.168.1.1", LeaseSeconds: seconds})
+		}
+		stats.recordFailure(launchKey{}, ErrNoLease, time.Second)
+		if err := saveResults(path, label, cfg, "eth0", stats, leases); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Values go in as parameters, so quotes in them need no escaping.
+	save("run-a", "before O'Brien's change", []int{3600, 3600, 7200})
+	save("run-b", "after", []int{600})
+	// A resumed run replaces its earlier save.
+	save("run-b", "after", []int{1800, 1800})
+
+	db, err := openStoredResults(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	runs, err := storedRuns(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 2 {
+		t.Fatalf("stored %d runs, want 2", len(runs))
+	}
+	a, err := findRun(runs, "before O'Brien's change")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Leased != 3 || a.Launched != 4 || a.ExhaustedAfter != nil || a.Scenario != "starvation" {
+		t.Errorf("run a = %+v", a)
+	}
+	res, err := loadResults(db, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.latencies) != 3 || res.latencies[2] != 300*time.Millisecond {
+		t.Errorf("latencies = %v, want 100ms, 200ms, 300ms", res.latencies)
+	}
+	if res.failures["no_lease"] != 1 {
+		t.Errorf("failures = %v, want one no_lease", res.failures)
+	}
+	if res.leaseTime != time.Hour {
+		t.Errorf("median lease time = %v, want 1h", res.leaseTime)
+	}
+	if len(res.servers) != 1 || res.servers[0] != "192.168.1.1" {
+		t.Errorf("servers = %v", res.servers)
+	}
+
+	b, err := findRun(runs, "run-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = loadResults(db, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Leased != 2 || len(res.latencies) != 2 || res.leaseTime != 30*time.Minute {
+		t.Errorf("resumed run b: %d leases, latencies %v, lease time %v; want its second save only", b.Leased, res.latencies, res.leaseTime)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/docker/docker/errdefs"
+)
+
+// retryPolicy spaces out retries after failures: the delay starts at initial
+// and grows by multiplier with every consecutive failure up to max, spread
+// by up to ±jitter of itself so workers do not retry in lockstep. After
+// attempts consecutive failures the caller gives up; 0 retries forever.
+type retryPolicy struct {
+	initial    time.Duration
+	multiplier float64
+	max        time.Duration
+	attempts   int
+	jitter     float64
+}
+
+func newRetryPolicy(cfg Config) (*retryPolicy, error) {
+	switch {
+	case cfg.RetryInitial <= 0:
+		return nil, fmt.Errorf("-retry-initial must be positive")
+	case cfg.RetryMultiplier < 1:
+		return nil, fmt.Errorf("-retry-multiplier must be at least 1")
+	case cfg.RetryMax < cfg.RetryInitial:
+		return nil, fmt.Errorf("-retry-max must not be below -retry-initial")
+	case cfg.RetryAttempts < 0:
+		return nil, fmt.Errorf("-retry-attempts must not be negative")
+	case cfg.RetryJitter < 0 || cfg.RetryJitter >= 1:
+		return nil, fmt.Errorf("-retry-jitter must be a fraction between 0 and 1")
+	}
+	return &retryPolicy{
+		initial:    cfg.RetryInitial,
+		multiplier: cfg.RetryMultiplier,
+		max:        cfg.RetryMax,
+		attempts:   cfg.RetryAttempts,
+		jitter:     cfg.RetryJitter,
+	}, nil
+}
+
+// delay returns how long to wait after the n-th consecutive failure.
+func (p *retryPolicy) delay(n int) time.Duration {
+	d := float64(p.initial) * math.Pow(p.multiplier, float64(max(n, 1)-1))
+	d = math.Min(d, float64(p.max))
+	d *= 1 + p.jitter*(2*rand.Float64()-1)
+	return time.Duration(d)
+}
+
+// exhausted reports whether n consecutive failures use up the attempts.
+func (p *retryPolicy) exhausted(n int) bool {
+	return p.attempts > 0 && n >= p.attempts
+}
+
+// String describes the policy for the run banner.
+func (p *retryPolicy) String() string {
+	limit := "retrying forever"
+	if p.attempts > 0 {
+		limit = fmt.Sprintf("giving up after %d in a row", p.attempts)
+	}
+	return fmt.Sprintf("from %s, x%g per failure up to %s, ±%.0f%% jitter, %s", p.initial, p.multiplier, p.max, p.jitter*100, limit)
+}
+
+// retryable reports whether a failed launch can succeed when tried again.
+// Requests the runtime rejects outright, such as a missing image or an
+// invalid container configuration, fail the same way every time.
+func retryable(err error) bool {
+	if !errors.Is(err, ErrContainerCreate) && !errors.Is(err, ErrContainerStart) {
+		return true
+	}
+	if errors.Is(err, ErrNetworkMissing) || errors.Is(err, ErrDaemonUnavailable) {
+		return true
+	}
+	// errors.As, unlike the errdefs helpers, follows errors wrapping
+	// several others.
+	var (
+		notFound     errdefs.ErrNotFound
+		invalid      errdefs.ErrInvalidParameter
+		forbidden    errdefs.ErrForbidden
+		unauthorized errdefs.ErrUnauthorized
+	)
+	return !errors.As(err, &notFound) && !errors.As(err, &invalid) && !errors.As(err, &forbidden) && !errors.As(err, &unauthorized)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.RetryInitial, cfg.RetryMultiplier, cfg.RetryMax = time.Second, 2, 5*time.Second
+	cfg.RetryAttempts, cfg.RetryJitter = 4, 0
+	p, err := newRetryPolicy(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		failures      int
+		wantDelay     time.Duration
+		wantExhausted bool
+	}{
+		{1, time.Second, false},
+		{2, 2 * time.Second, false},
+		{3, 4 * time.Second, false},
+		{4, 5 * time.Second, true},
+		{9, 5 * time.Second, true},
+	}
+	for _, tt := range tests {
+		if got := p.delay(tt.failures); got != tt.wantDelay {
+			t.Errorf("delay(%d) = %v, want %v", tt.failures, got, tt.wantDelay)
+		}
+		if got := p.exhausted(tt.failures); got != tt.wantExhausted {
+			t.Errorf("exhausted(%d) = %v, want %v", tt.failures, got, tt.wantExhausted)
+		}
+	}
+
+	p.jitter = 0.25
+	for range 100 {
+		if d := p.delay(3); d < 3*time.Second || d > 5*time.Second {
+			t.Fatalf("delay(3) with 25%% jitter = %v, want within 3s..5s", d)
+		}
+	}
+	p.attempts = 0
+	if p.exhausted(1000) {
+		t.Error("exhausted with attempts 0, want retries forever")
+	}
+}
+
+func TestNewRetryPolicyRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Config)
+	}{
+		{"initial", func(c *Config) { c.RetryInitial = 0 }},
+		{"multiplier", func(c *Config) { c.RetryMultiplier = 0.5 }},
+		{"max", func(c *Config) { c.RetryMax = c.RetryInitial / 2 }},
+		{"attempts", func(c *Config) { c.RetryAttempts = -1 }},
+		{"jitter", func(c *Config) { c.RetryJitter = 1 }},
+	}
+	for _, tt := range tests {
+		cfg := defaultConfig()
+		tt.modify(&cfg)
+		if _, err := newRetryPolicy(cfg); err == nil {
+			t.Errorf("%s: newRetryPolicy accepted an invalid policy", tt.name)
+		}
+	}
+}
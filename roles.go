@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+// planRoles splits the images into the role images started before the run,
+// in dependency order, and the client images the workers launch. Roles are
+// started in the order their after lists require, alphabetically where the
+// order is free.
+func planRoles(images []string, manifests map[string]*imageManifest) (roles, clients []string, err error) {
+	byRole := make(map[string][]string)
+	for _, image := range images {
+		m := manifests[image]
+		if m.Count == 0 {
+			clients = append(clients, image)
+			continue
+		}
+		byRole[m.Role] = append(byRole[m.Role], image)
+	}
+	if len(clients) == 0 {
+		return nil, nil, fmt.Errorf("every image has a role count; at least one image must be a client")
+	}
+
+	// Kahn's algorithm over the roles.
+	pending := make(map[string]int)
+	dependents := make(map[string][]string)
+	for role, roleImages := range byRole {
+		pending[role] += 0
+		for _, image := range roleImages {
+			for _, dep := range manifests[image].After {
+				if _, ok := byRole[dep]; !ok {
+					return nil, nil, fmt.Errorf("image %s starts after role %q, which no image with a count provides", image, dep)
+				}
+				pending[role]++
+				dependents[dep] = append(dependents[dep], role)
+			}
+		}
+	}
+	var ready []string
+	for role, n := range pending {
+		if n == 0 {
+			ready = append(ready, role)
+		}
+	}
+	var order []string
+	for len(ready) > 0 {
+		sort.Strings(ready)
+		role := ready[0]
+		ready = ready[1:]
+		order = append(order, role)
+		for _, dependent := range dependents[role] {
+			if pending[dependent]--; pending[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+	if len(order) != len(byRole) {
+		var cyclic []string
+		for role, n := range pending {
+			if n > 0 {
+				cyclic = append(cyclic, role)
+			}
+		}
+		sort.Strings(cyclic)
+		return nil, nil, fmt.Errorf("roles %s depend on each other in a cycle", strings.Join(cyclic, ", "))
+	}
+	for _, role := range order {
+		roleImages := byRole[role]
+		sort.Strings(roleImages)
+		roles = append(roles, roleImages...)
+	}
+	return roles, clients, nil
+}
+
+// startRoles launches every role image's containers in order. Each container
+// must obtain a lease and pass the image's health probe before the next one
+// starts, so dependents never start against a role that is not up. newSpec
+// builds the launch spec for an image the way the workers do; started
+// containers are passed to record for the lease table.
+func startRoles(ctx context.Context, engine Engine, cli containerRuntime, roles []string, manifests map[string]*imageManifest, newSpec func(image string) launchSpec, record func(spec launchSpec, result launchResult)) error {
+	if len(roles) > 0 {
+		fmt.Println("=== Starting role containers ===")
+	}
+	for _, image := range roles {
+		m := manifests[image]
+		for i := 0; i < m.Count; i++ {
+			spec := newSpec(image)
+			result, err := engine.Launch(ctx, spec)
+			if err != nil {
+				return fmt.Errorf("role %s (%s) container %d of %d failed to start: %v", m.Role, image, i+1, m.Count, err)
+			}
+			record(spec, result)
+			if m.HealthProbe != nil {
+				if err := runHealthProbe(cli, m.HealthProbe, result.ID, result.IP); err != nil {
+					return fmt.Errorf("role %s (%s) container %s failed its health probe: %v", m.Role, image, shortID(result.ID), err)
+				}
+			}
+			slog.Info("started role container", "role", m.Role, "image", image, "container", shortID(result.ID), "ip", result.IP)
+		}
+		fmt.Printf("Role %s: %d %s container(s) up\n", m.Role, m.Count, image)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/system"
+	"github.com/docker/docker/client"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Container runtimes accepted by -runtime.
+const (
+	runtimeAuto   = "auto"
+	runtimeDocker = "docker"
+	runtimePodman = "podman"
+)
+
+// Default API sockets of the runtimes.
+const (
+	dockerSocket = "/var/run/docker.sock"
+	podmanSocket = "/run/podman/podman.sock"
+)
+
+// containerRuntime is the part of the container engine API ipocalypse uses.
+// The Docker client implements it against either Docker or Podman, which
+// serves the same REST API on its own socket. The build, launch, daemon and
+// cleanup paths only take this interface, so any implementation of it, such
+// as an in-memory fake, can drive them.
+type containerRuntime interface {
+	Ping(ctx context.Context) (types.Ping, error)
+	ServerVersion(ctx context.Context) (types.Version, error)
+	Info(ctx context.Context) (system.Info, error)
+
+	ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *ocispec.Platform, containerName string) (container.CreateResponse, error)
+	ContainerStart(ctx context.Context, containerID string, options container.StartOptions) error
+	ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error)
+	ContainerList(ctx context.Context, options container.ListOptions) ([]types.Container, error)
+	ContainerRemove(ctx context.Context, containerID string, options container.RemoveOptions) error
+	ContainerLogs(ctx context.Context, container string, options container.LogsOptions) (io.ReadCloser, error)
+
+	ContainerExecCreate(ctx context.Context, container string, options container.ExecOptions) (types.IDResponse, error)
+	ContainerExecAttach(ctx context.Context, execID string, config container.ExecAttachOptions) (types.HijackedResponse, error)
+	ContainerExecInspect(ctx context.Context, execID string) (container.ExecInspect, error)
+
+	ImageBuild(ctx context.Context, buildContext io.Reader, options types.ImageBuildOptions) (types.ImageBuildResponse, error)
+	ImagePull(ctx context.Context, refStr string, options image.PullOptions) (io.ReadCloser, error)
+	ImageList(ctx context.Context, options image.ListOptions) ([]image.Summary, error)
+	ImageInspectWithRaw(ctx context.Context, imageID string) (types.ImageInspect, []byte, error)
+	ImageLoad(ctx context.Context, input io.Reader, quiet bool) (image.LoadResponse, error)
+	ImageRemove(ctx context.Context, imageID string, options image.RemoveOptions) ([]image.DeleteResponse, error)
+	ImagesPrune(ctx context.Context, pruneFilters filters.Args) (image.PruneReport, error)
+
+	NetworkCreate(ctx context.Context, name string, options network.CreateOptions) (network.CreateResponse, error)
+	NetworkInspect(ctx context.Context, networkID string, options network.InspectOptions) (network.Inspect, error)
+	NetworkList(ctx context.Context, options network.ListOptions) ([]network.Summary, error)
+	NetworkRemove(ctx context.Context, networkID string) error
+}
+
+var _ containerRuntime = (*client.Client)(nil)
+
+// newContainerRuntime connects to the runtime named by cfg.Runtime and returns
+// the runtime actually chosen. auto honours -host and DOCKER_HOST, then uses
+// Docker's socket if it exists and Podman's otherwise. -host selects a remote
+// engine: ssh:// goes through `docker system dial-stdio` on that host, tcp://
+// uses the -tls-* certificates when given.
+func newContainerRuntime(cfg Config) (containerRuntime, string, error) {
+	name := cfg.Runtime
+	if name == runtimeAuto {
+		name = runtimeDocker
+		if cfg.Host == "" && os.Getenv("DOCKER_HOST") == "" && !socketExists(dockerSocket) && (socketExists(podmanSocket) || os.Getenv("CONTAINER_HOST") != "") {
+			name = runtimePodman
+		}
+	}
+	opts := []client.Opt{client.FromEnv, client.WithAPIVersionNegotiation()}
+	switch name {
+	case runtimeDocker:
+	case runtimePodman:
+		// Podman's Docker-compatible API. CONTAINER_HOST is Podman's own
+		// equivalent of DOCKER_HOST.
+		host := os.Getenv("CONTAINER_HOST")
+		if host == "" {
+			host = "unix://" + podmanSocket
+		}
+		opts = append(opts, client.WithHost(host))
+	default:
+		return nil, "", fmt.Errorf("unknown runtime '%s' (use auto, docker or podman)", name)
+	}
+
+	switch {
+	case cfg.Host == "":
+	case strings.HasPrefix(cfg.Host, "ssh://"):
+		if name != runtimeDocker {
+			return nil, "", fmt.Errorf("ssh:// hosts need the docker runtime; expose Podman's API over tcp:// instead")
+		}
+		shell, err := parseSSHTarget(cfg.Host)
+		if err != nil {
+			return nil, "", err
+		}
+		// The host name is a placeholder; every connection is dialed over ssh.
+		opts = append(opts, client.WithHost("http://docker.example.com"), client.WithDialContext(shell.sshDialer))
+	default:
+		opts = append(opts, client.WithHost(cfg.Host))
+	}
+	if cfg.TLSCA != "" || cfg.TLSCert != "" || cfg.TLSKey != "" {
+		if !strings.HasPrefix(cfg.Host, "tcp://") {
+			return nil, "", fmt.Errorf("-tls-ca, -tls-cert and -tls-key need a tcp:// -host")
+		}
+		opts = append(opts, client.WithTLSClientConfig(cfg.TLSCA, cfg.TLSCert, cfg.TLSKey))
+	}
+
+	cli, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		return nil, "", err
+	}
+	return cli, name, nil
+}
+
+func socketExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode()&os.ModeSocket != 0
+}
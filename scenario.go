@@ -0,0 +1,156 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Scenarios accepted by -scenario.
+const (
+	scenarioStarvation = "starvation"
+	scenarioChurn      = "churn"
+	scenarioRenewal    = "renewal-storm"
+	scenarioObserve    = "observe"
+	scenarioThreshold  = "threshold"
+	scenarioFuzz       = "fuzz"
+)
+
+// scenarioInfo describes a kind of run: what it does, the engine it needs and
+// the settings it turns on, so a scenario starts from safe defaults instead
+// of a hand-picked combination of flags.
+type scenarioInfo struct {
+	Name        string
+	Description string
+	// Engine is the -mode the scenario runs on, or empty for either.
+	Engine string
+	// apply turns on the scenario's settings, or is nil when the defaults
+	// already describe it.
+	apply func(cfg *Config)
+}
+
+var scenarios = []scenarioInfo{
+	{scenarioStarvation, "launch clients until the pool is exhausted", "", nil},
+	{scenarioChurn, "keep killing a fraction of the clients and launching replacements", "", applyChurn},
+	{scenarioRenewal, "fill the pool, then have every client renew its lease over and over", "", applyRenewal},
+	{scenarioObserve, "passively baseline the segment, launching nothing", "", func(cfg *Config) { cfg.Observe = true }},
+	{scenarioThreshold, "bisect the smallest population that denies a canary a lease", modeRaw, func(cfg *Config) { cfg.ShrinkTest = true }},
+	{scenarioFuzz, "send malformed DISCOVERs and check the server keeps answering", modeRaw, nil},
+}
+
+// defaultChurn is the fraction of clients the churn scenario kills per round
+// when -churn is not given.
+const defaultChurn = 0.1
+
+func applyChurn(cfg *Config) {
+	if cfg.Churn == 0 {
+		cfg.Churn = defaultChurn
+	}
+}
+
+// defaultRenewInterval is how often the renewal-storm scenario renews every
+// lease when -renew-interval is not given.
+const defaultRenewInterval = 10 * time.Second
+
+func applyRenewal(cfg *Config) {
+	if cfg.RenewInterval == 0 {
+		cfg.RenewInterval = defaultRenewInterval
+	}
+}
+
+// findScenario returns the scenario with the given name.
+func findScenario(name string) (scenarioInfo, bool) {
+	for _, s := range scenarios {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return scenarioInfo{}, false
+}
+
+// applyScenario resolves cfg.Scenario and applies its engine and settings.
+// -observe, -shrink-test, -churn and -renew-interval remain shorthands for
+// their scenarios. A scenario's engine replaces the default -mode; modeSet
+// means -mode was given explicitly, and a conflicting one is refused rather
+// than overridden.
+func applyScenario(cfg *Config, modeSet bool) error {
+	var shorthands []string
+	if cfg.Observe {
+		shorthands = append(shorthands, scenarioObserve)
+	}
+	if cfg.ShrinkTest {
+		shorthands = append(shorthands, scenarioThreshold)
+	}
+	if cfg.Churn > 0 {
+		shorthands = append(shorthands, scenarioChurn)
+	}
+	if cfg.RenewInterval > 0 {
+		shorthands = append(shorthands, scenarioRenewal)
+	}
+	for _, name := range shorthands {
+		switch cfg.Scenario {
+		case scenarioStarvation:
+			cfg.Scenario = name
+		case name:
+		default:
+			return fmt.Errorf("-scenario=%s cannot be combined with the options of the %s scenario", cfg.Scenario, name)
+		}
+	}
+	s, ok := findScenario(cfg.Scenario)
+	if !ok {
+		names := make([]string, len(scenarios))
+		for i, s := range scenarios {
+			names[i] = s.Name
+		}
+		return fmt.Errorf("unknown -scenario '%s' (use %s)", cfg.Scenario, strings.Join(names, ", "))
+	}
+	if s.Engine != "" && cfg.Mode != s.Engine {
+		if modeSet {
+			return fmt.Errorf("the %s scenario runs on the %s engine; drop -mode=%s", s.Name, s.Engine, cfg.Mode)
+		}
+		cfg.Mode = s.Engine
+	}
+	if s.apply != nil {
+		s.apply(cfg)
+	}
+	return nil
+}
+
+// flagSet reports whether the named flag was given on the command line.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// runScenarios implements the scenarios subcommand: it lists the scenarios
+// -scenario accepts and the engine each runs on.
+func runScenarios(args []string) {
+	fs := flag.NewFlagSet("scenarios", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage:
+  ./ipocalypse scenarios
+
+Lists the kinds of run -scenario selects and the engine (-mode) each runs on.
+`)
+	}
+	fs.Parse(args)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SCENARIO\tENGINE\tDESCRIPTION")
+	for _, s := range scenarios {
+		engine := s.Engine
+		if engine == "" {
+			engine = modeDocker + "," + modeRaw
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", s.Name, engine, s.Description)
+	}
+	w.Flush()
+}
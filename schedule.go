@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runSchedule is the change window a run is armed for: it starts launching
+// at start and, with -window, is torn down at end.
+type runSchedule struct {
+	start time.Time
+	// end is zero without -window.
+	end time.Time
+}
+
+// newRunSchedule works out the window from -start-at or -schedule and
+// -window. It returns nil when none of them is set, for a run that starts
+// now and lasts as long as it needs.
+func newRunSchedule(startAt, cron string, window time.Duration) (*runSchedule, error) {
+	if startAt == "" && cron == "" && window == 0 {
+		return nil, nil
+	}
+	if startAt != "" && cron != "" {
+		return nil, fmt.Errorf("-start-at and -schedule both set the start; use one of them")
+	}
+	if window < 0 {
+		return nil, fmt.Errorf("-window must be positive")
+	}
+	now := clock.Now()
+	s := &runSchedule{start: now}
+	switch {
+	case startAt != "":
+		start, err := parseStartAt(startAt, now)
+		if err != nil {
+			return nil, err
+		}
+		s.start = start
+	case cron != "":
+		spec, err := parseCron(cron)
+		if err != nil {
+			return nil, err
+		}
+		if s.start = spec.next(now); s.start.IsZero() {
+			return nil, fmt.Errorf("-schedule %q never matches", cron)
+		}
+	}
+	if window > 0 {
+		s.end = s.start.Add(window)
+		if !s.end.After(now) {
+			return nil, fmt.Errorf("the window from %s closed at %s", s.start.Format(time.RFC3339), s.end.Format(time.RFC3339))
+		}
+	}
+	return s, nil
+}
+
+// parseStartAt accepts an RFC 3339 time, a local "2006-01-02 15:04", or a
+// local "15:04" for the next time the clock shows it.
+func parseStartAt(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("15:04", s, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid -start-at %q (use 15:04, \"2006-01-02 15:04\" or RFC 3339)", s)
+	}
+	local := now.In(time.Local)
+	start := time.Date(local.Year(), local.Month(), local.Day(), t.Hour(), t.Minute(), 0, 0, time.Local)
+	if !start.After(now) {
+		start = start.AddDate(0, 0, 1)
+	}
+	return start, nil
+}
+
+// waitForStart blocks until the window opens. A window that opened already,
+// e.g. -start-at in the past with a -window still open, starts right away.
+// A nil schedule returns at once.
+func (s *runSchedule) waitForStart() {
+	if s == nil {
+		return
+	}
+	if s.end.IsZero() {
+		fmt.Printf("Armed: the run starts at %s\n", s.start.Format(time.RFC3339))
+	} else {
+		fmt.Printf("Armed: the run starts at %s and is torn down at %s\n", s.start.Format(time.RFC3339), s.end.Format(time.RFC3339))
+	}
+	if wait := s.start.Sub(clock.Now()); wait > 0 {
+		fmt.Printf("Waiting %s for the window to open, Ctrl-C to disarm\n", wait.Round(time.Second))
+		<-clock.After(wait)
+	}
+	fmt.Println("Window open, starting the run")
+}
+
+// context returns a context that is done when the window closes, for
+// everything the run does in it. Without a -window it is never done.
+func (s *runSchedule) context() (context.Context, context.CancelFunc) {
+	if s == nil || s.end.IsZero() {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithDeadline(context.Background(), s.end)
+}
+
+// holdUntilEnd keeps the run's clients up until the window closes and
+// reports whether the run has one, so the caller tears it down then.
+func (s *runSchedule) holdUntilEnd() bool {
+	if s == nil || s.end.IsZero() {
+		return false
+	}
+	if wait := s.end.Sub(clock.Now()); wait > 0 {
+		fmt.Printf("Holding the leases until the window closes at %s\n", s.end.Format(time.RFC3339))
+		<-clock.After(wait)
+	}
+	fmt.Println("Window closed, tearing the run down")
+	return true
+}
+
+// cronSpec is a parsed five-field cron expression: minute, hour, day of
+// month, month and day of week.
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	// domAny and dowAny record a "*" day field. As in cron, when both day
+	// fields are restricted a day matching either is enough.
+	domAny, dowAny bool
+}
+
+// parseCron parses a cron expression such as "0 22 * * 6" (22:00 every
+// Saturday). Fields take *, numbers, ranges (1-5), steps (*/15, 8-18/2) and
+// comma-separated lists of them; day of week 0 and 7 are both Sunday.
+func parseCron(expr string) (*cronSpec, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid -schedule %q: want 5 fields (minute hour day-of-month month day-of-week)", expr)
+	}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	var sets [5]uint64
+	for i, field := range fields {
+		set, err := parseCronField(field, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid -schedule %q: %v", expr, err)
+		}
+		sets[i] = set
+	}
+	// Sunday is 0 for time.Weekday.
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+	return &cronSpec{minute: sets[0], hour: sets[1], dom: sets[2], month: sets[3], dow: sets[4], domAny: fields[2] == "*", dowAny: fields[4] == "*"}, nil
+}
+
+// parseCronField parses one field into a bit set of the values it allows.
+func parseCronField(field string, lo, hi int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if r, s, ok := strings.Cut(part, "/"); ok {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+			rng, step = r, n
+		}
+		first, last := lo, hi
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if first, err = strconv.Atoi(a); err != nil {
+				return 0, fmt.Errorf("bad value %q", part)
+			}
+			last = first
+			if isRange {
+				if last, err = strconv.Atoi(b); err != nil {
+					return 0, fmt.Errorf("bad range %q", part)
+				}
+			} else if step > 1 {
+				last = hi
+			}
+		}
+		if first > last {
+			return 0, fmt.Errorf("bad range %q", part)
+		}
+		if first < lo || last > hi {
+			return 0, fmt.Errorf("%q is outside %d-%d", part, lo, hi)
+		}
+		for v := first; v <= last; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+// next returns the first minute after t the expression matches, in t's
+// location, or the zero time if none does within five years.
+func (c *cronSpec) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); {
+		switch {
+		case c.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (c *cronSpec) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<t.Day()) != 0
+	dow := c.dow&(1<<int(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr bool
+	}{
+		{"0 22 * * 6", false},
+		{"*/15 8-18 * * 1-5", false},
+		{"0,30 8-18/2 1,15 */3 0,7", false},
+		{"0 22 * *", true},
+		{"0 22 * * 6 2024", true},
+		{"60 * * * *", true},
+		{"* 24 * * *", true},
+		{"* * 0 * *", true},
+		{"* * * 13 *", true},
+		{"* * * * 8", true},
+		{"*/0 * * * *", true},
+		{"5-1 * * * *", true},
+		{"a * * * *", true},
+		{"1-x * * * *", true},
+	}
+	for _, tt := range tests {
+		if _, err := parseCron(tt.expr); (err != nil) != tt.wantErr {
+			t.Errorf("parseCron(%q) error = %v, want error %v", tt.expr, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// A Monday.
+	now := time.Date(2024, 1, 1, 10, 30, 20, 0, time.UTC)
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"0 22 * * 6", time.Date(2024, 1, 6, 22, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 1, 1, 10, 45, 0, 0, time.UTC)},
+		{"0 8-18/2 * * 1-5", time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)},
+		{"30 10 * * *", time.Date(2024, 1, 2, 10, 30, 0, 0, time.UTC)},
+		{"30 2 1 * *", time.Date(2024, 2, 1, 2, 30, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Both day fields restricted: either one matching is enough.
+		{"0 0 13 * 5", time.Date(2024, 1, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 0", time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 2 *", time.Time{}},
+	}
+	for _, tt := range tests {
+		spec, err := parseCron(tt.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := spec.next(now); !got.Equal(tt.want) {
+			t.Errorf("%q after %v = %v, want %v", tt.expr, now, got, tt.want)
+		}
+	}
+}
+
+func TestParseStartAt(t *testing.T) {
+	saved := time.Local
+	time.Local = time.UTC
+	t.Cleanup(func() { time.Local = saved })
+	now := time.Date(2024, 1, 1, 10, 30, 0, 0, time.UTC)
+	tests := []struct {
+		in      string
+		want    time.Time
+		wantErr bool
+	}{
+		{"22:00", time.Date(2024, 1, 1, 22, 0, 0, 0, time.UTC), false},
+		{"10:30", time.Date(2024, 1, 2, 10, 30, 0, 0, time.UTC), false},
+		{"06:15", time.Date(2024, 1, 2, 6, 15, 0, 0, time.UTC), false},
+		{"2024-01-06 22:00", time.Date(2024, 1, 6, 22, 0, 0, 0, time.UTC), false},
+		{"2024-01-06T22:00:00+01:00", time.Date(2024, 1, 6, 21, 0, 0, 0, time.UTC), false},
+		{"tonight", time.Time{}, true},
+		{"25:00", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseStartAt(tt.in, now)
+		if (err != nil) != tt.wantErr || !got.Equal(tt.want) {
+			t.Errorf("parseStartAt(%q) = %v, %v; want %v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestNewRunSchedule(t *testing.T) {
+	c := useManualClock(t)
+	now := c.Now()
+	tests := []struct {
+		name      string
+		startAt   string
+		cron      string
+		window    time.Duration
+		wantStart time.Time
+		wantEnd   time.Time
+		wantNil   bool
+		wantErr   bool
+	}{
+		{name: "none", wantNil: true},
+		{name: "window from now", window: time.Hour, wantStart: now, wantEnd: now.Add(time.Hour)},
+		{name: "start at", startAt: "2024-01-06T22:00:00Z", window: 2 * time.Hour, wantStart: time.Date(2024, 1, 6, 22, 0, 0, 0, time.UTC), wantEnd: time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC)},
+		{name: "schedule", cron: "0 22 * * 6", wantStart: time.Date(2024, 1, 6, 22, 0, 0, 0, time.UTC)},
+		{name: "window still open", startAt: "2023-12-31T23:30:00Z", window: time.Hour, wantStart: time.Date(2023, 12, 31, 23, 30, 0, 0, time.UTC), wantEnd: time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)},
+		{name: "window closed", startAt: "2023-12-31T22:00:00Z", window: time.Hour, wantErr: true},
+		{name: "both starts", startAt: "22:00", cron: "0 22 * * 6", wantErr: true},
+		{name: "never matches", cron: "0 0 31 2 *", wantErr: true},
+		{name: "negative window", window: -time.Hour, wantErr: true},
+	}
+	for _, tt := range tests {
+		s, err := newRunSchedule(tt.startAt, tt.cron, tt.window)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: newRunSchedule() error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if (s == nil) != tt.wantNil {
+			t.Errorf("%s: newRunSchedule() = %v, want nil %v", tt.name, s, tt.wantNil)
+			continue
+		}
+		if s != nil && (!s.start.Equal(tt.wantStart) || !s.end.Equal(tt.wantEnd)) {
+			t.Errorf("%s: window %v to %v, want %v to %v", tt.name, s.start, s.end, tt.wantStart, tt.wantEnd)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// identityRand draws what tells the run's clients apart: the image each
+// launch uses, its MAC, hostname, profile and client identifier. It has a
+// source of its own, seeded by -seed, so transaction IDs, retry jitter and
+// the other random choices of a run do not shift it, and the Nth client of
+// two runs with the same seed gets the same identity.
+var identityRand = &lockedRand{r: rand.New(rand.NewSource(clock.Now().UnixNano()))}
+
+// lockedRand is a rand.Rand safe for use by the workers at once.
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func (l *lockedRand) Intn(n int) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Intn(n)
+}
+
+func (l *lockedRand) Read(b []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.r.Read(b)
+}
+
+// seedIdentities seeds identityRand, with a seed of its own when seed is 0,
+// and returns the seed used, for printing so the run can be repeated.
+func seedIdentities(seed int64) int64 {
+	if seed == 0 {
+		// Never 0, which would pick another seed when passed back.
+		seed = rand.Int63n(1<<53) + 1
+	}
+	identityRand.mu.Lock()
+	defer identityRand.mu.Unlock()
+	identityRand.r.Seed(seed)
+	return seed
+}
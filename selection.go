@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Image selection strategies accepted by -strategy.
+const (
+	strategyRandom     = "random"
+	strategyRoundRobin = "roundrobin"
+	strategySequential = "sequential"
+	strategyCounts     = "counts"
+)
+
+// imageSelector decides which client image each launch uses. random picks
+// by weight; roundrobin and sequential follow a fixed order shared by all
+// workers, so runs launch the same image sequence every time. counts takes
+// the weights as exact container counts and hands them out from a queue
+// shared by the workers, so the final population matches the plan.
+type imageSelector struct {
+	strategy string
+	images   *weightedSet[string]
+
+	mu sync.Mutex
+	// credit is each image's smooth weighted round-robin balance.
+	credit []int
+	// next is the image sequential is on and used how many launches it
+	// has had of its weight.
+	next, used int
+	// left is how many more containers of each image counts still plans,
+	// not counting the launches in flight.
+	left []int
+}
+
+// checkStrategy reports whether strategy is one -strategy accepts.
+func checkStrategy(strategy string) error {
+	switch strategy {
+	case strategyRandom, strategyRoundRobin, strategySequential, strategyCounts:
+		return nil
+	}
+	return fmt.Errorf("unknown -strategy %q: use random, roundrobin, sequential or counts", strategy)
+}
+
+func newImageSelector(strategy string, images *weightedSet[string]) (*imageSelector, error) {
+	if err := checkStrategy(strategy); err != nil {
+		return nil, err
+	}
+	s := &imageSelector{strategy: strategy, images: images, credit: make([]int, len(images.values))}
+	if strategy == strategyCounts {
+		s.left = append([]int(nil), images.weights...)
+	}
+	return s, nil
+}
+
+// plan counts the leases held, e.g. by the clients a resumed run adopted,
+// against each image's count, and returns how many more launches the plan
+// needs, for the lease budget's cap. It returns 0 for the other strategies.
+func (s *imageSelector) plan(held []leaseRecord) int {
+	if s.strategy != strategyCounts {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range held {
+		for i, image := range s.images.values {
+			if image == r.Image && s.left[i] > 0 {
+				s.left[i]--
+			}
+		}
+	}
+	total := 0
+	for _, n := range s.left {
+		total += n
+	}
+	return total
+}
+
+// settle reports the outcome of a launch of image. With counts, a launch
+// that got no lease goes back on the queue, for this or another worker to
+// launch again.
+func (s *imageSelector) settle(image string, leased bool) {
+	if s.strategy != strategyCounts || leased {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, value := range s.images.values {
+		if value == image {
+			s.left[i]++
+		}
+	}
+}
+
+// pick returns the image for the next launch.
+func (s *imageSelector) pick() string {
+	if s.strategy == strategyRandom {
+		return s.images.pick()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.strategy == strategySequential {
+		image := s.images.values[s.next]
+		if s.used++; s.used == s.images.weights[s.next] {
+			s.next, s.used = (s.next+1)%len(s.images.values), 0
+		}
+		return image
+	}
+	if s.strategy == strategyCounts {
+		return s.pickCount()
+	}
+	// Smooth weighted round robin interleaves the images: weights 2 and 1
+	// give a, b, a rather than a, a, b.
+	best := 0
+	for i, weight := range s.images.weights {
+		s.credit[i] += weight
+		if s.credit[i] > s.credit[best] {
+			best = i
+		}
+	}
+	s.credit[best] -= s.images.total
+	return s.images.values[best]
+}
+
+// pickCount takes the next launch off the counts queue, interleaving the
+// images by what each has left so a run stopped early still has the
+// planned mix. The lease budget's cap keeps launches from outrunning the
+// queue; should it run dry anyway, the first image is launched.
+func (s *imageSelector) pickCount() string {
+	best, total := -1, 0
+	for i, n := range s.left {
+		if n == 0 {
+			continue
+		}
+		total += n
+		s.credit[i] += n
+		if best < 0 || s.credit[i] > s.credit[best] {
+			best = i
+		}
+	}
+	if best < 0 {
+		return s.images.values[0]
+	}
+	s.credit[best] -= total
+	s.left[best]--
+	return s.images.values[best]
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+)
+
+// selftestServerFiles is the build context of the self-test's dnsmasq image.
+//
+//go:embed selftest_server
+var selftestServerFiles embed.FS
+
+// Names of what the self-test creates, apart from a run's defaults so a real
+// run's network is left alone.
+const (
+	selftestLink    = "ipoc-selftest"
+	selftestNetwork = "ipocalypse_selftest"
+	selftestServer  = "ipocalypse_selftest_dhcp"
+	selftestImage   = selftestServer + ":latest"
+	// selftestLeaseFile is dnsmasq's lease database in the server container.
+	selftestLeaseFile = "/tmp/dnsmasq.leases"
+)
+
+// selftestLab is the isolated segment the self-test runs against: a dummy
+// interface with no wire behind it as the parent, a macvlan network on it and
+// a dnsmasq container serving a small pool. The clients and the server only
+// reach each other through the macvlan bridge on the dummy, so nothing of
+// the test leaves the host.
+type selftestLab struct {
+	cli    containerRuntime
+	subnet *net.IPNet
+	pool   int
+	// host is the dummy's address, also the gateway a run assumes;
+	// server is dnsmasq's; the pool runs from first to last.
+	host, server, first, last net.IP
+	serverID                  string
+}
+
+func newSelftestLab(cli containerRuntime, cidr string, pool int) (*selftestLab, error) {
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil || subnet.IP.To4() == nil {
+		return nil, fmt.Errorf("invalid -subnet %q: use an IPv4 network such as 198.18.0.0/24", cidr)
+	}
+	if ones, _ := subnet.Mask.Size(); ones > 24 {
+		return nil, fmt.Errorf("-subnet %s is too small: use a /24 or larger", cidr)
+	}
+	if pool < 1 || pool > 150 {
+		return nil, fmt.Errorf("-pool must be between 1 and 150")
+	}
+	base := binary.BigEndian.Uint32(subnet.IP.To4())
+	at := func(n int) net.IP {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, base+uint32(n))
+		return ip
+	}
+	return &selftestLab{cli: cli, subnet: subnet, pool: pool, host: at(1), server: at(2), first: at(100), last: at(100 + pool - 1)}, nil
+}
+
+// setup creates the dummy interface, the Docker network and the server.
+func (l *selftestLab) setup(ctx context.Context) error {
+	// A single-network run always uses macvlan0 for its host interface;
+	// the self-test's run would replace that of a run in progress.
+	if localHost.command("ip", "link", "show", hostLink).Run() == nil {
+		return fmt.Errorf("%s exists, so a run seems to be in progress; the self-test would replace its host interface. Let it finish or remove it with -cleanup first", hostLink)
+	}
+	for _, driver := range []string{"dummy", driverMacvlan} {
+		if !kernelSupports(localHost, driver) {
+			return fmt.Errorf("the kernel has no %s support, which the self-test lab needs", driver)
+		}
+	}
+	if err := checkSubnetFree(l.subnet); err != nil {
+		return err
+	}
+	ones, _ := l.subnet.Mask.Size()
+	if localHost.command("ip", "link", "show", selftestLink).Run() == nil {
+		fmt.Printf("Removing %s left by an earlier self-test\n", selftestLink)
+		if err := l.teardown(ctx); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Creating dummy interface %s with %s/%d\n", selftestLink, l.host, ones)
+	for _, args := range [][]string{
+		{"link", "add", selftestLink, "type", "dummy"},
+		{"addr", "add", fmt.Sprintf("%s/%d", l.host, ones), "dev", selftestLink},
+		{"link", "set", selftestLink, "up"},
+	} {
+		if out, err := localHost.command("ip", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to set up %s: ip %s: %v: %s", selftestLink, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+		}
+	}
+
+	fmt.Println("Building the lab DHCP server image...")
+	dir, err := writeBuildContext(selftestServerFiles, "selftest_server", selftestServer)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(filepath.Dir(dir))
+	if err := buildImage(ctx, l.cli, dir, "Dockerfile", selftestImage, io.Discard); err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrBuildFailed, selftestImage, err)
+	}
+
+	// The run reuses the network, since driver, parent and subnet match.
+	netCfg := &NetworkConfig{Name: selftestNetwork, Parent: selftestLink, Driver: driverMacvlan, HostIP: l.host, Subnet: l.subnet, Gateway: l.host, Host: localHost}
+	if err := ensureDockerNetwork(ctx, l.cli, netCfg); err != nil {
+		return err
+	}
+
+	fmt.Printf("Starting dnsmasq on %s, serving %d addresses from %s to %s\n", l.server, l.pool, l.first, l.last)
+	resp, err := l.cli.ContainerCreate(ctx, &container.Config{
+		Image: selftestImage,
+		Cmd: []string{
+			fmt.Sprintf("--dhcp-range=%s,%s,%s,10m", l.first, l.last, net.IP(l.subnet.Mask)),
+			"--dhcp-authoritative",
+			"--dhcp-leasefile=" + selftestLeaseFile,
+			"--log-dhcp",
+		},
+		Labels: map[string]string{labelRole: "selftest-server"},
+	}, &container.HostConfig{
+		CapAdd: []string{"NET_ADMIN", "NET_RAW"},
+	}, &network.NetworkingConfig{
+		EndpointsConfig: map[string]*network.EndpointSettings{selftestNetwork: {
+			IPAMConfig: &network.EndpointIPAMConfig{IPv4Address: l.server.String()},
+		}},
+	}, clientPlatform, selftestServer)
+	if err != nil {
+		return fmt.Errorf("failed to create the lab DHCP server: %v", runtimeError(err))
+	}
+	l.serverID = resp.ID
+	if err := l.cli.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
+		return fmt.Errorf("failed to start the lab DHCP server: %v", runtimeError(err))
+	}
+	return nil
+}
+
+// checkSubnetFree fails when an interface of this host is already on subnet,
+// whose traffic the dummy's route would then take over.
+func checkSubnetFree(subnet *net.IPNet) error {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return fmt.Errorf("failed to list interface addresses: %v", err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && (subnet.Contains(ipNet.IP) || ipNet.Contains(subnet.IP)) {
+			return fmt.Errorf("this host is already on %s (%s); choose another -subnet", subnet, ipNet)
+		}
+	}
+	return nil
+}
+
+// run has a separate ipocalypse process exhaust the lab's pool with the
+// given flags, from an empty directory so the built-in client image is used,
+// and returns its exit status.
+func (l *selftestLab) run(ctx context.Context, dir string, args []string) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	operator, _ := osUser()
+	args = append([]string{
+		// The lab is the self-test's own; the run needs no authorization
+		// beyond it.
+		"-engagement-id=selftest",
+		"-operator=" + operator,
+		"-interface=" + selftestLink,
+		"-network=" + selftestNetwork,
+		"-orphans=" + orphansKeep,
+		"-lease-export=" + filepath.Join(dir, "leases"),
+		"-dhcp-timeout=20s",
+		"-workers=4",
+	}, args...)
+	fmt.Printf("=== Running ipocalypse %s ===\n", strings.Join(args, " "))
+	cmd := exec.CommandContext(ctx, exe, args...)
+	cmd.Dir = dir
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	// A run stopped by the timeout still writes its summary and leases.
+	cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGTERM) }
+	cmd.WaitDelay = time.Minute
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), nil
+	}
+	return 0, err
+}
+
+// selftestCheck is one verdict of the self-test.
+type selftestCheck struct {
+	Name   string
+	Passed bool
+	Detail string
+}
+
+// verify checks the run's outcome against the lab: a clean exit, which with
+// no lease budget means the pool was found exhausted, one lease per pool
+// address in the run's ledger, and the server's lease database full. Which
+// addresses were leased is the server's to tell: docker-mode ledgers record
+// the address Docker assigned each client.
+func (l *selftestLab) verify(ctx context.Context, dir string, exitStatus int) []selftestCheck {
+	checks := []selftestCheck{{
+		Name:   "run detected the exhausted pool",
+		Passed: exitStatus == exitOK,
+		Detail: fmt.Sprintf("exit status %d", exitStatus),
+	}}
+
+	ledger := selftestCheck{Name: fmt.Sprintf("run holds all %d pool addresses", l.pool)}
+	if records, err := readLedger(filepath.Join(dir, "leases.json")); err != nil {
+		ledger.Detail = err.Error()
+	} else {
+		held := make(map[string]bool)
+		for _, r := range records {
+			if r.ReleasedAt == nil {
+				held[r.MAC] = true
+			}
+		}
+		ledger.Passed = len(held) == l.pool
+		ledger.Detail = fmt.Sprintf("%d clients hold a lease", len(held))
+	}
+	checks = append(checks, ledger)
+
+	server := selftestCheck{Name: "lab server has no address left"}
+	if out, err := containerExec(ctx, l.cli, l.serverID, []string{"cat", selftestLeaseFile}); err != nil {
+		server.Detail = err.Error()
+	} else {
+		// One line per lease.
+		n := 0
+		if out = strings.TrimSpace(out); out != "" {
+			n = len(strings.Split(out, "\n"))
+		}
+		server.Passed = n == l.pool
+		server.Detail = fmt.Sprintf("%d of %d addresses leased", n, l.pool)
+	}
+	return append(checks, server)
+}
+
+// teardown removes the lab: the containers on its network, among them the
+// server, the network, and the dummy interface, which takes the run's
+// macvlan0 on it along. The images are kept for the next self-test.
+func (l *selftestLab) teardown(ctx context.Context) error {
+	var errs []error
+	containers, err := l.cli.ContainerList(ctx, container.ListOptions{All: true, Filters: filters.NewArgs(filters.Arg("network", selftestNetwork))})
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to list the lab's containers: %v", err))
+	}
+	ids := []string{selftestServer}
+	for _, c := range containers {
+		ids = append(ids, c.ID)
+	}
+	for _, id := range ids {
+		l.cli.ContainerRemove(ctx, id, container.RemoveOptions{Force: true})
+	}
+	if err := l.cli.NetworkRemove(ctx, selftestNetwork); err != nil && !client.IsErrNotFound(err) {
+		errs = append(errs, fmt.Errorf("failed to remove network %s: %v", selftestNetwork, err))
+	}
+	if localHost.command("ip", "link", "show", selftestLink).Run() == nil {
+		if out, err := localHost.command("ip", "link", "delete", selftestLink).CombinedOutput(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete %s: %v: %s", selftestLink, err, strings.TrimSpace(string(out))))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// selftestForbidden are the run flags the self-test sets itself.
+// -daemon would serve instead of running.
+var selftestForbidden = []string{"interface", "network", "networks", "vlan", "driver", "lease-export", "host", "host-ssh", "config", "daemon"}
+
+// runSelftest handles "ipocalypse selftest": it builds an isolated lab with a
+// dnsmasq server, has a run exhaust its pool and checks the run noticed.
+func runSelftest(args []string) {
+	cfg := defaultConfig()
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	subnet := fs.String("subnet", "198.18.0.0/24", "Lab subnet, on no other interface of this host")
+	pool := fs.Int("pool", 8, "Addresses the lab's DHCP server hands out")
+	timeout := fs.Duration("timeout", 10*time.Minute, "Longest the run may take to exhaust the pool")
+	keep := fs.Bool("keep", false, "Leave the lab up after the test, for a look at the server's log")
+	teardownOnly := fs.Bool("teardown", false, "Only remove a lab left by -keep or an interrupted self-test")
+	fs.StringVar(&cfg.Runtime, "runtime", cfg.Runtime, "Container runtime: docker, podman or auto")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage:
+  sudo ./ipocalypse selftest [-subnet cidr] [-pool N] [-timeout 10m] [-keep] [-- run flags]
+  sudo ./ipocalypse selftest -teardown
+
+Checks the whole pipeline without touching a real network: builds an
+isolated lab (a dummy interface, a macvlan network on it and a dnsmasq
+server with a small pool), runs ipocalypse against it with the built-in
+client image, and verifies that the run took every address and detected
+the exhausted pool. Flags after -- are added to the run's, e.g.
+-- -mode=netns. Exits 0 when every check passed.
+
+Options:
+`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	runArgs := fs.Args()
+	for _, arg := range runArgs {
+		name := strings.TrimLeft(strings.SplitN(arg, "=", 2)[0], "-")
+		for _, forbidden := range selftestForbidden {
+			if name == forbidden {
+				fmt.Printf("Error: -%s is set by the self-test and cannot be given to its run\n", name)
+				os.Exit(exitConfig)
+			}
+		}
+	}
+	if err := localHost.requireRoot(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(exitConfig)
+	}
+	cli, _, err := newContainerRuntime(cfg)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(exitRuntime)
+	}
+	lab, err := newSelftestLab(cli, *subnet, *pool)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(exitConfig)
+	}
+	// Ctrl-C reaches the run directly; the self-test only stops waiting
+	// and removes the lab.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *teardownOnly {
+		if err := lab.teardown(context.Background()); err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
+			os.Exit(exitFailed)
+		}
+		fmt.Println("Self-test lab removed")
+		return
+	}
+	os.Exit(lab.test(ctx, runArgs, *timeout, *keep))
+}
+
+// test sets the lab up, runs against it and reports, returning the exit
+// status of the self-test.
+func (l *selftestLab) test(ctx context.Context, runArgs []string, timeout time.Duration, keep bool) int {
+	cleanup := func() {
+		if keep {
+			fmt.Printf("Lab left up: network %s on %s, server container %s (docker logs %s).\n", selftestNetwork, selftestLink, selftestServer, selftestServer)
+			fmt.Println("Remove it with: ipocalypse selftest -teardown")
+			return
+		}
+		fmt.Println("=== Removing the self-test lab ===")
+		if err := l.teardown(context.Background()); err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
+		}
+	}
+	fmt.Println("=== Setting up the self-test lab ===")
+	if err := l.setup(ctx); err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		cleanup()
+		return exitCode(err)
+	}
+	defer cleanup()
+
+	dir, err := os.MkdirTemp("", "ipocalypse-selftest")
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		return exitFailed
+	}
+	defer os.RemoveAll(dir)
+	runCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	status, err := l.run(runCtx, dir, runArgs)
+	if err != nil {
+		fmt.Printf("[ERROR] failed to run ipocalypse: %v\n", err)
+		return exitFailed
+	}
+	if runCtx.Err() != nil {
+		fmt.Printf("The run was stopped after %s without finishing\n", timeout)
+	}
+
+	fmt.Println("=== Self-Test Results ===")
+	passed := true
+	for _, c := range l.verify(context.Background(), dir, status) {
+		verdict := "PASS"
+		if !c.Passed {
+			verdict, passed = "FAIL", false
+		}
+		fmt.Printf("  %s  %-40s %s\n", verdict, c.Name, c.Detail)
+	}
+	if !passed {
+		fmt.Println("Self-test FAILED")
+		return exitFailed
+	}
+	fmt.Println("Self-test passed")
+	return exitOK
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// watchedServer is a DHCP server seen answering during the run.
+type watchedServer struct {
+	IP        net.IP
+	MACs      []string
+	FirstSeen time.Time
+	Offers    int
+	Acks      int
+	Naks      int
+	// Rogue means the server is not the run's target: not in
+	// -trusted-servers, or, without that list, not the first to answer.
+	Rogue bool
+}
+
+// serverWatch listens for OFFERs, ACKs and NAKs on the parent interface for
+// the whole run and warns as soon as a second server answers, or a known
+// server answers from a second MAC. That catches a misconfigured test
+// segment early and shows how exposed the segment is to a rogue server.
+type serverWatch struct {
+	conn    *packetConn
+	trusted []string
+	// own is the address of the run's -rogue-server, which is expected.
+	own string
+
+	mu      sync.Mutex
+	servers map[string]*watchedServer
+	order   []string
+}
+
+// newServerWatch opens the capture on netCfg's parent interface. own is the
+// run's -rogue-server address, if any. It returns nil when disabled.
+func newServerWatch(enabled bool, netCfg *NetworkConfig, trusted []string, own net.IP) (*serverWatch, error) {
+	if !enabled {
+		return nil, nil
+	}
+	conn, err := openPacketConn(netCfg.Parent, etherTypeIPv4)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.setReadTimeout(500 * time.Millisecond); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to set socket timeout: %v", err)
+	}
+	w := &serverWatch{conn: conn, trusted: trusted, servers: make(map[string]*watchedServer)}
+	if own != nil {
+		w.own = own.String()
+	}
+	return w, nil
+}
+
+// run watches until ctx is done.
+func (w *serverWatch) run(ctx context.Context) {
+	if w == nil {
+		return
+	}
+	defer w.conn.Close()
+	buf := make([]byte, 65536)
+	for ctx.Err() == nil {
+		n, err := w.conn.readFrame(buf)
+		if err != nil || n == 0 {
+			continue
+		}
+		frame, ok := parseUDPFrame(buf[:n])
+		if !ok || frame.SrcPort != dhcpServerPort || frame.DstPort != dhcpClientPort {
+			continue
+		}
+		msg, err := parseDHCP(frame.Payload)
+		if err != nil || msg.Op != bootReply {
+			continue
+		}
+		w.record(clock.Now(), frame, msg)
+	}
+}
+
+// record accounts for one server answer seen at the given time.
+func (w *serverWatch) record(at time.Time, frame udpFrame, msg *dhcpMessage) {
+	t := msg.msgType()
+	if t != dhcpOffer && t != dhcpAck && t != dhcpNak {
+		return
+	}
+	serverIP := msg.serverID()
+	if serverIP == nil {
+		serverIP = frame.SrcIP
+	}
+	key := serverIP.String()
+	if key == w.own {
+		return
+	}
+	mac := frame.SrcMAC.String()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	server, ok := w.servers[key]
+	if !ok {
+		server = &watchedServer{IP: append(net.IP(nil), serverIP...), FirstSeen: at}
+		if len(w.trusted) > 0 {
+			server.Rogue = !slices.Contains(w.trusted, key)
+		} else {
+			server.Rogue = len(w.servers) > 0
+		}
+		w.servers[key] = server
+		w.order = append(w.order, key)
+		if server.Rogue {
+			slog.Warn("competing DHCP server answering clients", "server", key, "mac", mac, "servers_seen", len(w.servers))
+			events.emit("rogue_server_detected", map[string]any{"server": key, "mac": mac, "message": dhcpTypeName(t)})
+		} else {
+			slog.Info("DHCP server answering", "server", key, "mac", mac)
+		}
+	}
+	if !slices.Contains(server.MACs, mac) {
+		server.MACs = append(server.MACs, mac)
+		if len(server.MACs) > 1 {
+			slog.Warn("DHCP server answering from another MAC", "server", key, "mac", mac, "macs", strings.Join(server.MACs, ","))
+			events.emit("rogue_server_detected", map[string]any{"server": key, "mac": mac, "message": dhcpTypeName(t), "macs": server.MACs})
+		}
+	}
+	switch t {
+	case dhcpOffer:
+		server.Offers++
+	case dhcpAck:
+		server.Acks++
+	case dhcpNak:
+		server.Naks++
+	}
+}
+
+// snapshot returns copies of the servers that answered, the target ones
+// first. A nil watch has none.
+func (w *serverWatch) snapshot() []watchedServer {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var servers []watchedServer
+	for _, key := range w.sortedKeys() {
+		s := *w.servers[key]
+		s.MACs = append([]string(nil), s.MACs...)
+		servers = append(servers, s)
+	}
+	return servers
+}
+
+// sortedKeys returns the servers in the order they answered, the target
+// ones first. Callers must hold w.mu.
+func (w *serverWatch) sortedKeys() []string {
+	keys := append([]string(nil), w.order...)
+	sort.SliceStable(keys, func(i, j int) bool { return !w.servers[keys[i]].Rogue && w.servers[keys[j]].Rogue })
+	return keys
+}
+
+// printSummary lists the servers that answered, flagging the competing ones.
+// A nil watch prints nothing.
+func (w *serverWatch) printSummary() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	keys := w.sortedKeys()
+	rogues := 0
+	fmt.Printf("DHCP servers:      %d answered during the run\n", len(keys))
+	for _, key := range keys {
+		s := w.servers[key]
+		flag := "target"
+		if s.Rogue {
+			flag = "COMPETING"
+			rogues++
+		}
+		if len(s.MACs) > 1 {
+			flag += ", several MACs"
+		}
+		fmt.Printf("  %-15s %s  offers %d, acks %d, naks %d, first seen %s  [%s]\n", key, strings.Join(s.MACs, ","), s.Offers, s.Acks, s.Naks, s.FirstSeen.Format(time.TimeOnly), flag)
+	}
+	if rogues > 0 {
+		fmt.Printf("Warning: competing DHCP servers answered the clients (%d); leases from them are not from the target server\n", rogues)
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// serviceStopTimeout is how long a run may take to shut down when the
+// service stops or the run is stopped through the API before it is killed.
+const serviceStopTimeout = 60 * time.Second
+
+// serviceRun is one run the service started, as a child process with its
+// own control API on a loopback port.
+type serviceRun struct {
+	ID          int        `json:"id"`
+	Args        []string   `json:"args"`
+	PID         int        `json:"pid"`
+	StartedAt   time.Time  `json:"started_at"`
+	EndedAt     *time.Time `json:"ended_at,omitempty"`
+	ExitCode    int        `json:"exit_code"`
+	State       string     `json:"state"`
+	controlAddr string
+	cmd         *exec.Cmd
+	done        chan struct{}
+}
+
+// service is -daemon: a long-lived process on a drop box that starts runs
+// when asked through its API, one at a time.
+type service struct {
+	cfg Config
+
+	mu   sync.Mutex
+	next int
+	run  *serviceRun
+}
+
+// runService serves the service API on cfg.ListenAddr, and the gRPC
+// control plane on cfg.GRPCListen, until SIGINT or SIGTERM, stopping the
+// current run, if any, on the way out. With IPOCALYPSE_CONTROL_TOKEN set,
+// every request must carry it, as for a run's control API. Under systemd
+// it reports readiness and status over the notify socket and keeps the
+// watchdog fed; pidFile, when set, receives the process ID.
+func runService(cfg Config, pidFile string) error {
+	if cfg.ListenAddr == "" && cfg.GRPCListen == "" {
+		return fmt.Errorf("-daemon serves its API on -listen, or gRPC on -grpc-listen; give an address such as :8080 for loopback only")
+	}
+	if pidFile != "" {
+		if err := os.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
+			return fmt.Errorf("failed to write PID file: %v", err)
+		}
+		defer os.Remove(pidFile)
+	}
+	s := &service{cfg: cfg}
+	if cfg.ListenAddr != "" {
+		ln, err := net.Listen("tcp", cfg.ListenAddr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %v", cfg.ListenAddr, err)
+		}
+		go func() {
+			if err := http.Serve(ln, requireToken(s.handler())); err != nil {
+				slog.Error("service API stopped", "error", err)
+			}
+		}()
+		fmt.Printf("ipocalypse service listening on http://%s\n", ln.Addr())
+	}
+	if cfg.GRPCListen != "" {
+		srv, err := serveGRPC(cfg.GRPCListen, s)
+		if err != nil {
+			return err
+		}
+		// After the run: its status streams end with its exit.
+		defer srv.Stop()
+	}
+	sdNotify("READY=1\nSTATUS=idle")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go sdWatchdog(ctx)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	sig := <-sigs
+	fmt.Printf("Received %v, stopping the service\n", sig)
+	sdNotify("STOPPING=1")
+	s.mu.Lock()
+	run := s.run
+	s.mu.Unlock()
+	if run != nil {
+		run.stop()
+	}
+	return nil
+}
+
+// handler returns the service API:
+//
+//	GET  /healthz             liveness and whether the container engine answers
+//	GET  /runs/current        the current or last run
+//	POST /runs                start a run ({"args": ["-max-leases=50", ...]})
+//	POST /runs/current/stop   stop the current run
+//	/run/...                  the current run's control API, e.g. /run/status
+func (s *service) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		health := map[string]any{"status": "ok", "state": "idle"}
+		if run := s.current(); run != nil && run.State == "running" {
+			health["state"] = "running"
+			health["run"] = run.ID
+		}
+		status := http.StatusOK
+		if err := s.pingRuntime(r.Context()); err != nil {
+			health["status"], health["error"] = "degraded", err.Error()
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, health)
+	})
+	mux.HandleFunc("GET /runs/current", func(w http.ResponseWriter, r *http.Request) {
+		run := s.current()
+		if run == nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "no run has been started"})
+			return
+		}
+		writeJSON(w, http.StatusOK, run)
+	})
+	mux.HandleFunc("POST /runs", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Args []string `json:"args"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxControlBody)).Decode(&req); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid run request: %v", err)})
+				return
+			}
+		}
+		run, err := s.start(req.Args)
+		if err != nil {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusAccepted, run)
+	})
+	mux.HandleFunc("POST /runs/current/stop", func(w http.ResponseWriter, r *http.Request) {
+		run := s.current()
+		if run == nil || run.State != "running" {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "no run is in progress"})
+			return
+		}
+		go run.stop()
+		writeJSON(w, http.StatusAccepted, map[string]string{"state": "stopping"})
+	})
+	mux.HandleFunc("/run/", func(w http.ResponseWriter, r *http.Request) {
+		run := s.current()
+		if run == nil || run.State != "running" {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "no run is in progress"})
+			return
+		}
+		proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: run.controlAddr})
+		r.URL.Path = strings.TrimPrefix(r.URL.Path, "/run")
+		proxy.ServeHTTP(w, r)
+	})
+	return mux
+}
+
+// current returns a copy of the current or last run, or nil.
+func (s *service) current() *serviceRun {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.run == nil {
+		return nil
+	}
+	run := *s.run
+	return &run
+}
+
+// pingRuntime checks that the container engine docker-mode runs need
+// answers. Raw and netns runs do without one, so only a configured engine
+// that does not answer counts.
+func (s *service) pingRuntime(ctx context.Context) error {
+	if s.cfg.Runtime == runtimeAuto && s.cfg.Host == "" && os.Getenv("DOCKER_HOST") == "" && !socketExists(dockerSocket) && !socketExists(podmanSocket) {
+		return nil
+	}
+	cli, _, err := newContainerRuntime(s.cfg)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	_, err = cli.Ping(ctx)
+	return err
+}
+
+// start launches a run with args, giving it a control API on a free loopback
+// port the service proxies to.
+func (s *service) start(args []string) (*serviceRun, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.run != nil && s.run.State == "running" {
+		return nil, fmt.Errorf("run %d is still in progress", s.run.ID)
+	}
+	if err := checkRunArgs(args); err != nil {
+		return nil, err
+	}
+	addr, err := freeLoopbackAddr()
+	if err != nil {
+		return nil, err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	s.next++
+	run := &serviceRun{ID: s.next, Args: args, StartedAt: clock.Now(), State: "running", controlAddr: addr, done: make(chan struct{})}
+	run.cmd = exec.Command(exe, append([]string{"-listen=" + addr}, args...)...)
+	run.cmd.Stdout, run.cmd.Stderr = os.Stdout, os.Stderr
+	if err := run.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start run: %v", err)
+	}
+	run.PID = run.cmd.Process.Pid
+	s.run = run
+	slog.Info("run started", "run", run.ID, "pid", run.PID, "args", strings.Join(args, " "))
+	sdNotify(fmt.Sprintf("STATUS=run %d in progress", run.ID))
+	go func() {
+		err := run.cmd.Wait()
+		s.mu.Lock()
+		ended := clock.Now()
+		run.EndedAt, run.State = &ended, "finished"
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			run.ExitCode = exitErr.ExitCode()
+		}
+		s.mu.Unlock()
+		close(run.done)
+		slog.Info("run finished", "run", run.ID, "exit_code", run.ExitCode)
+		sdNotify(fmt.Sprintf("STATUS=idle, run %d exited with %d", run.ID, run.ExitCode))
+	}()
+	return run, nil
+}
+
+// remoteRunFlags are the flags a run started through the service API may
+// be given: those shaping the test itself. Flags naming files, endpoints
+// outside the target segment or another container engine, and the ones
+// that give a run its own API, stay with whoever installed the service.
+var remoteRunFlags = map[string]bool{
+	"engagement-id": true, "operator": true,
+
+	"mode": true, "scenario": true, "fuzz-cases": true, "pd-length": true, "dry-run": true, "force": true,
+	"observe": true, "observe-duration": true, "arp-sweep": true, "fingerprint": true, "trusted-servers": true,
+	"wifi-fallback": true, "k8s-namespace": true, "k8s-network": true, "k8s-master": true, "k8s-node-selector": true,
+
+	"images": true, "no-build": true, "strategy": true, "platform": true, "build-workers": true, "orphans": true,
+
+	"workers": true, "autoscale": true, "max-workers": true, "max-leases": true, "reserve-free": true,
+	"rate": true, "ramp": true, "seed": true, "churn": true, "churn-interval": true, "identity-churn": true, "shrink-test": true,
+	"renew-interval": true, "renew-workers": true, "renew-rounds": true, "renew-leases": true, "let-expire": true,
+	"dhcp-timeout": true, "dhcp-poll-interval": true, "exhaust-after": true,
+	"retry-initial": true, "retry-multiplier": true, "retry-max": true, "retry-attempts": true, "retry-jitter": true,
+	"launch-interval": true, "launch-jitter": true, "launch-stagger": true,
+	"wait": true, "start-at": true, "schedule": true, "window": true, "release-on-exit": true,
+
+	"interface": true, "vlan": true, "network": true, "networks": true, "driver": true, "driver-fallback": true,
+	"ipv6": true, "internet": true, "container-memory": true, "container-cpus": true, "read-only": true,
+	"address-order": true, "mac-pools": true, "hostnames": true, "client-id": true, "profiles": true,
+	"client-dns": true, "client-ntp": true, "dhcp-client": true, "client-interface": true,
+	"traffic": true, "traffic-interval": true, "announce": true, "announce-interval": true, "arp-keepalive": true,
+	"dns-load": true, "dns-load-names": true, "dns-load-server": true,
+	"server": true, "server-unicast": true, "relay-server": true, "relay-giaddr": true, "relay-link": true,
+	"relay-circuit-id": true, "relay-remote-id": true,
+	"spoof-release": true, "spoof-release-exclude": true, "rogue-server": true, "rogue-pool": true,
+	"rogue-gateway": true, "rogue-dns": true, "rogue-lease": true, "rogue-duration": true,
+
+	"dhcp-latency": true, "watch-servers": true, "detect-conflicts": true,
+	"snmp-switch": true, "snmp-community": true, "snmp-user": true, "snmp-auth-pass": true, "snmp-priv-pass": true,
+	"snmp-port": true, "snmp-interval": true, "snmp-counters": true,
+	"ntp-server": true, "max-clock-skew": true, "status-interval": true, "results-label": true,
+	"log-format": true, "log-level": true, "output": true, "quiet": true, "v": true, "progress": true,
+}
+
+// checkRunArgs rejects any argument of a run started by the service that is
+// not a flag in remoteRunFlags. Values go with their flag, as -flag=value: a
+// bare argument would end flag parsing in the run, and as the first one
+// select a subcommand.
+func checkRunArgs(args []string) error {
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			return fmt.Errorf("%q is not a flag; give values as -flag=value", arg)
+		}
+		name := strings.TrimLeft(strings.SplitN(arg, "=", 2)[0], "-")
+		if !remoteRunFlags[name] {
+			return fmt.Errorf("-%s cannot be given to a run started by the service", name)
+		}
+	}
+	return nil
+}
+
+// stop asks the run to shut down with SIGTERM, as Ctrl-C would, and kills
+// it if it has not exited after serviceStopTimeout.
+func (r *serviceRun) stop() {
+	r.cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-r.done:
+	case <-time.After(serviceStopTimeout):
+		r.cmd.Process.Kill()
+		<-r.done
+	}
+}
+
+// freeLoopbackAddr returns a loopback address with a port nothing listens on.
+func freeLoopbackAddr() (string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer ln.Close()
+	return ln.Addr().String(), nil
+}
+
+// sdNotify sends a state update to systemd when running as a Type=notify
+// service; elsewhere it does nothing.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		slog.Warn("systemd notification failed", "error", err)
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte(state))
+}
+
+// sdWatchdog pings systemd's watchdog at half the interval WatchdogSec= set,
+// until ctx is done.
+func sdWatchdog(ctx context.Context) {
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(usec) * time.Microsecond / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			sdNotify("WATCHDOG=1")
+		}
+	}
+}
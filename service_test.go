@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestCheckRunArgs(t *testing.T) {
+	tests := []struct {
+		args    []string
+		wantErr bool
+	}{
+		{[]string{"-engagement-id=ACME-1", "-operator=jdoe", "-max-leases=200", "-rate=60"}, false},
+		{[]string{"-workers=5", "--strategy=random", "-ipv6"}, false},
+		{[]string{"-state-file=/etc/cron.d/x"}, true},
+		{[]string{"-workers=5", "-pcap=/root/.ssh/authorized_keys"}, true},
+		// Values apart from their flag, and any other bare argument, are
+		// positionals: they end flag parsing in the run, and the first one
+		// picks a subcommand.
+		{[]string{"-workers", "5"}, true},
+		{[]string{"-max-leases=5", "x"}, true},
+		{[]string{"-max-leases=5", "x", "-listen=0.0.0.0:80"}, true},
+		{[]string{"report", "-max-leases=5"}, true},
+		{[]string{"-force", "true"}, true},
+		{[]string{""}, true},
+		{[]string{"-"}, true},
+		{[]string{"--report=/tmp/r.html"}, true},
+		{[]string{"-results-db=/tmp/r.db"}, true},
+		{[]string{"-audit-log", "/tmp/a"}, true},
+		{[]string{"-log-sink=udp://203.0.113.9"}, true},
+		{[]string{"-host=ssh://root@elsewhere"}, true},
+		{[]string{"-listen=:9999"}, true},
+		{[]string{"-i-am-authorized"}, true},
+		{[]string{"--", "-state-file=x"}, true},
+	}
+	for _, tt := range tests {
+		if err := checkRunArgs(tt.args); (err != nil) != tt.wantErr {
+			t.Errorf("checkRunArgs(%q) error = %v, want error %v", tt.args, err, tt.wantErr)
+		}
+	}
+}
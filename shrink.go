@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// shrinkSettle is how long the server is given to process a trial's releases
+// before the next trial starts.
+const shrinkSettle = 2 * time.Second
+
+// shrinkTrial is one short scenario of the shrink test: a population of
+// clients takes leases, then a canary client tries to get one as a newly
+// arriving legitimate device would.
+type shrinkTrial struct {
+	Clients int
+	// Held is how many leases the population actually held when the canary
+	// ran; fewer than Clients means the pool ran out first.
+	Held         int
+	CanaryFailed bool
+	CanaryErr    error
+}
+
+// runShrinkTest bisects the client population in raw mode to find the
+// smallest one that still makes the canary fail: the threshold of impact.
+// Every trial releases its leases before the next one starts, so the search
+// relies on the server honouring DHCPRELEASE.
+func runShrinkTest(cfg Config) error {
+	netCfg, err := detectNetwork(localHost, cfg.Interface, cfg.VLAN > 0)
+	if err != nil {
+		return err
+	}
+	macs, err := newMACGenerator(cfg.MACPools)
+	if err != nil {
+		return err
+	}
+	profiles, err := parseProfiles(cfg.Profiles)
+	if err != nil {
+		return err
+	}
+	upper := cfg.MaxLeases
+	if upper == 0 {
+		upper = poolCapacity(netCfg)
+	}
+	if upper <= 0 {
+		return fmt.Errorf("subnet %s is too small for a shrink test; set -max-leases", netCfg.Subnet)
+	}
+
+	engine, err := newRawEngine(netCfg.Parent)
+	if err != nil {
+		return err
+	}
+	defer engine.conn.Close()
+	if err := checkCapabilities(engine, cfg); err != nil {
+		return err
+	}
+	if isWireless(localHost, netCfg.Parent) {
+		engine.srcMAC = engine.conn.iface.HardwareAddr
+		fmt.Printf("Wireless parent detected: sending every frame from the adapter's own MAC %s\n", engine.srcMAC)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go engine.receive(ctx)
+
+	fmt.Printf("Shrink test on %s (subnet %s): finding the smallest population that makes a canary fail, up to %d clients\n", netCfg.Parent, netCfg.Subnet, upper)
+	var trials []shrinkTrial
+	run := func(n int) (shrinkTrial, error) {
+		t, err := engine.shrinkTrial(ctx, cfg, macs, profiles, n)
+		if err != nil {
+			return t, err
+		}
+		trials = append(trials, t)
+		outcome := "canary leased"
+		if t.CanaryFailed {
+			outcome = "canary failed: " + t.CanaryErr.Error()
+		}
+		fmt.Printf("Trial %d: %d clients, %d held, %s\n", len(trials), t.Clients, t.Held, outcome)
+		return t, nil
+	}
+
+	// A canary that fails with no clients at all says nothing about the run.
+	t, err := run(0)
+	if err != nil {
+		return err
+	}
+	if t.CanaryFailed {
+		printShrinkReport(trials, -1)
+		return fmt.Errorf("the canary fails without any clients; check the interface and DHCP server")
+	}
+	if t, err = run(upper); err != nil {
+		return err
+	}
+	if !t.CanaryFailed {
+		printShrinkReport(trials, 0)
+		return nil
+	}
+	lo, hi := 0, upper
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		if t, err = run(mid); err != nil {
+			return err
+		}
+		if t.CanaryFailed {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	printShrinkReport(trials, hi)
+	return nil
+}
+
+// shrinkTrial takes up to n leases with cfg.Workers workers at the -rate
+// pace, runs the canary and releases everything again.
+func (e *rawEngine) shrinkTrial(ctx context.Context, cfg Config, macs *macGenerator, profiles *weightedSet[*deviceProfile], n int) (shrinkTrial, error) {
+	t := shrinkTrial{Clients: n}
+	if n > 0 {
+		budget, err := newLeaseBudget(n, cfg.LaunchRate)
+		if err != nil {
+			return t, err
+		}
+		fillCtx, cancel := context.WithCancel(ctx)
+		var wg sync.WaitGroup
+		for i := 0; i < max(cfg.Workers, 1); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for budget.take(fillCtx) {
+					spec := launchSpec{MAC: macs.Next()}
+					if !profiles.empty() {
+						spec.Profile = profiles.pick()
+						spec.Hostname = expandHostname(spec.Profile.HostnamePattern)
+					}
+					_, err := e.Launch(fillCtx, spec)
+					budget.settle(err == nil)
+					if errors.Is(err, ErrNoLease) {
+						// The pool ran out before the population was complete.
+						cancel()
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		cancel()
+	}
+	if ctx.Err() != nil {
+		e.releaseAll()
+		return t, ctx.Err()
+	}
+	e.mu.Lock()
+	t.Held = len(e.leases)
+	e.mu.Unlock()
+
+	canary := macs.Next()
+	if _, err := e.Launch(ctx, launchSpec{MAC: canary}); err != nil {
+		t.CanaryFailed, t.CanaryErr = true, err
+	}
+	e.releaseAll()
+	clock.Sleep(shrinkSettle)
+	return t, ctx.Err()
+}
+
+// releaseAll gives every lease the engine holds back to the server.
+func (e *rawEngine) releaseAll() {
+	e.mu.Lock()
+	var held []*rawLease
+	for _, lease := range e.leases {
+		held = append(held, lease)
+	}
+	e.mu.Unlock()
+	for _, lease := range held {
+		if err := e.release(lease.MAC); err != nil {
+			slog.Warn("failed to release lease", "mac", lease.MAC.String(), "ip", lease.IP.String(), "error", err)
+		}
+	}
+}
+
+// printShrinkReport writes the trials and the threshold of impact: the
+// smallest failing population, 0 when even the largest tried did not cause a
+// failure, or -1 when the canary failed without any clients.
+func printShrinkReport(trials []shrinkTrial, threshold int) {
+	fmt.Println("=== Shrink Test ===")
+	for i, t := range trials {
+		outcome := "canary leased"
+		if t.CanaryFailed {
+			outcome = "canary failed"
+		}
+		fmt.Printf("  trial %-3d %5d clients  %5d held  %s\n", i+1, t.Clients, t.Held, outcome)
+	}
+	switch {
+	case threshold < 0:
+		fmt.Println("Threshold of impact: undetermined, the canary fails without any clients")
+	case threshold == 0:
+		largest := 0
+		for _, t := range trials {
+			largest = max(largest, t.Clients)
+		}
+		fmt.Printf("Threshold of impact: none found, the canary still got a lease with %d clients\n", largest)
+	default:
+		fmt.Printf("Threshold of impact: %d clients (the canary fails with %d and gets a lease with %d)\n", threshold, threshold, threshold-1)
+	}
+}
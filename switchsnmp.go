@@ -0,0 +1,444 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// Objects the switch monitor polls. The forwarding table is read from
+// Q-BRIDGE-MIB, which VLAN-aware switches implement, and from BRIDGE-MIB on
+// the others; err-disabled ports from CISCO-ERR-DISABLE-MIB, which other
+// vendors do not have, so only the port's operational status shows there.
+const (
+	oidSysName           = ".1.3.6.1.2.1.1.5.0"
+	oidIfDescr           = ".1.3.6.1.2.1.2.2.1.2"
+	oidIfOperStatus      = ".1.3.6.1.2.1.2.2.1.8"
+	oidIfName            = ".1.3.6.1.2.1.31.1.1.1.1"
+	oidBasePortIfIndex   = ".1.3.6.1.2.1.17.1.4.1.2"
+	oidDot1dTpFdbPort    = ".1.3.6.1.2.1.17.4.3.1.2"
+	oidDot1qTpFdbPort    = ".1.3.6.1.2.1.17.7.1.2.2.1.2"
+	oidErrDisableIfCause = ".1.3.6.1.4.1.9.9.548.1.3.1.1.2"
+)
+
+// errDisableCauses names the CISCO-ERR-DISABLE-MIB causes a DHCP exhaustion
+// run can trigger; others are shown by number.
+var errDisableCauses = map[int]string{
+	2:  "bpduGuard",
+	8:  "dot1xSecurityViolation",
+	9:  "portSecurityViolation",
+	11: "dhcpRateLimit",
+	14: "stormControl",
+	16: "arpInspection",
+	19: "macLimit",
+}
+
+// switchStallPolls is how many polls in a row the MAC table may stay the
+// same size while launches continue before the monitor reports that it
+// stopped learning.
+const switchStallPolls = 3
+
+// switchCounter is an extra object polled as a counter (-snmp-counters),
+// e.g. a DHCP snooping drop counter of the switch's MIB.
+type switchCounter struct {
+	name, oid string
+}
+
+// switchSample is one poll of the switch, with the run's counts at the time.
+type switchSample struct {
+	At       time.Duration
+	Launched int
+	Leased   int
+	// MACs is the size of the forwarding table; PortMACs the entries learnt
+	// on the watched port (-1 without one).
+	MACs, PortMACs int
+	// PortStatus is the watched port's ifOperStatus, "" without one.
+	PortStatus string
+	Counters   []uint64
+}
+
+// switchEvent is a change on the switch, placed on the launch timeline.
+type switchEvent struct {
+	At     time.Duration
+	Leased int
+	What   string
+}
+
+// switchMonitor polls the access switch over SNMP during the run
+// (-snmp-switch): the size of its MAC address table, the status of the
+// port the host is on and any err-disable cause, and optional counters such
+// as DHCP snooping drops. Every change is logged with the leases acquired
+// at the time, so the summary shows when port security, a MAC limit or
+// snooping kicked in.
+type switchMonitor struct {
+	snmp     *gosnmp.GoSNMP
+	stats    *runStats
+	interval time.Duration
+	name     string
+	counters []switchCounter
+	logPath  string
+	// port is the watched port as given and ifIndex its interface index; 0
+	// when no port is watched.
+	port    string
+	ifIndex int
+
+	mu      sync.Mutex
+	samples []switchSample
+	events  []switchEvent
+	// stalled counts the polls the MAC table has not grown in while
+	// launches continued; reported once it reaches switchStallPolls.
+	stalled      int
+	stallFlagged bool
+	errDisabled  map[int]bool
+	pollErrors   int
+}
+
+// newSwitchMonitor connects to the -snmp-switch and resolves the watched
+// port. It returns nil when no switch is given.
+func newSwitchMonitor(cfg Config, stats *runStats) (*switchMonitor, error) {
+	if cfg.SNMPSwitch == "" {
+		return nil, nil
+	}
+	host, port := cfg.SNMPSwitch, uint16(161)
+	if h, p, err := net.SplitHostPort(cfg.SNMPSwitch); err == nil {
+		n, err := strconv.ParseUint(p, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -snmp-switch port %q", p)
+		}
+		host, port = h, uint16(n)
+	}
+	g := &gosnmp.GoSNMP{
+		Target:             host,
+		Port:               port,
+		Community:          cfg.SNMPCommunity,
+		Version:            gosnmp.Version2c,
+		Timeout:            2 * time.Second,
+		Retries:            2,
+		ExponentialTimeout: true,
+		MaxOids:            gosnmp.MaxOids,
+	}
+	if cfg.SNMPUser != "" {
+		usm := &gosnmp.UsmSecurityParameters{UserName: cfg.SNMPUser}
+		g.Version, g.SecurityModel, g.MsgFlags = gosnmp.Version3, gosnmp.UserSecurityModel, gosnmp.NoAuthNoPriv
+		if cfg.SNMPAuthPass != "" {
+			usm.AuthenticationProtocol, usm.AuthenticationPassphrase = gosnmp.SHA, cfg.SNMPAuthPass
+			g.MsgFlags = gosnmp.AuthNoPriv
+		}
+		if cfg.SNMPPrivPass != "" {
+			usm.PrivacyProtocol, usm.PrivacyPassphrase = gosnmp.AES, cfg.SNMPPrivPass
+			g.MsgFlags = gosnmp.AuthPriv
+		}
+		g.SecurityParameters = usm
+	}
+	m := &switchMonitor{snmp: g, stats: stats, interval: cfg.SNMPInterval, logPath: cfg.SNMPLog, port: cfg.SNMPPort, errDisabled: make(map[int]bool)}
+	for _, c := range cfg.SNMPCounters {
+		name, oid, ok := strings.Cut(c, "=")
+		if !ok || name == "" || oid == "" {
+			return nil, fmt.Errorf("invalid -snmp-counters entry %q: want name=oid", c)
+		}
+		if !strings.HasPrefix(oid, ".") {
+			oid = "." + oid
+		}
+		m.counters = append(m.counters, switchCounter{name: name, oid: oid})
+	}
+
+	if err := g.Connect(); err != nil {
+		return nil, fmt.Errorf("-snmp-switch %s: %v", cfg.SNMPSwitch, err)
+	}
+	res, err := g.Get([]string{oidSysName})
+	if err != nil {
+		g.Conn.Close()
+		return nil, fmt.Errorf("-snmp-switch %s not answering: %v", cfg.SNMPSwitch, err)
+	}
+	m.name = cfg.SNMPSwitch
+	if len(res.Variables) == 1 {
+		if b, ok := res.Variables[0].Value.([]byte); ok && len(b) > 0 {
+			m.name = fmt.Sprintf("%s (%s)", b, cfg.SNMPSwitch)
+		}
+	}
+	if m.port != "" {
+		if m.ifIndex, err = m.resolvePort(m.port); err != nil {
+			g.Conn.Close()
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// resolvePort finds the interface index of the watched port, given as an
+// index or as the interface's name or description, e.g. Gi1/0/5, and names
+// it as the switch does.
+func (m *switchMonitor) resolvePort(port string) (int, error) {
+	if n, err := strconv.Atoi(port); err == nil {
+		return n, nil
+	}
+	for _, root := range []string{oidIfName, oidIfDescr} {
+		index := 0
+		m.snmp.BulkWalk(root, func(pdu gosnmp.SnmpPDU) error {
+			if b, ok := pdu.Value.([]byte); ok && strings.EqualFold(string(b), port) {
+				index, m.port = oidIndex(pdu.Name, root), string(b)
+			}
+			return nil
+		})
+		if index > 0 {
+			return index, nil
+		}
+	}
+	return 0, fmt.Errorf("-snmp-port %s: no interface of that name on the switch", port)
+}
+
+// oidIndex returns the first sub-identifier after root in name.
+func oidIndex(name, root string) int {
+	rest := strings.TrimPrefix(strings.TrimPrefix(name, root), ".")
+	first, _, _ := strings.Cut(rest, ".")
+	n, _ := strconv.Atoi(first)
+	return n
+}
+
+func (m *switchMonitor) String() string {
+	if m.port == "" {
+		return m.name
+	}
+	return fmt.Sprintf("%s, port %s (ifIndex %d)", m.name, m.port, m.ifIndex)
+}
+
+// run polls the switch every interval until ctx is done.
+func (m *switchMonitor) run(ctx context.Context) {
+	if m == nil {
+		return
+	}
+	defer m.snmp.Conn.Close()
+	start := m.stats.start
+	for {
+		m.poll(clock.Since(start))
+		select {
+		case <-ctx.Done():
+			return
+		case <-clock.After(m.interval):
+		}
+	}
+}
+
+// poll takes one sample and records the changes since the last one.
+func (m *switchMonitor) poll(at time.Duration) {
+	launched, leased, _ := m.stats.launchRate()
+	s := switchSample{At: at, Launched: launched, Leased: leased, PortMACs: -1}
+
+	macs, portMACs, err := m.forwardingTable()
+	if err != nil {
+		m.mu.Lock()
+		m.pollErrors++
+		m.mu.Unlock()
+		slog.Warn("switch poll failed", "switch", m.name, "error", err)
+		return
+	}
+	s.MACs = macs
+	if m.ifIndex > 0 {
+		s.PortMACs = portMACs
+		if res, err := m.snmp.Get([]string{fmt.Sprintf("%s.%d", oidIfOperStatus, m.ifIndex)}); err == nil && len(res.Variables) == 1 {
+			s.PortStatus = operStatus(gosnmp.ToBigInt(res.Variables[0].Value).Int64())
+		}
+	}
+	causes := m.errDisableCauses()
+	for _, c := range m.counters {
+		var v uint64
+		if res, err := m.snmp.Get([]string{c.oid}); err == nil && len(res.Variables) == 1 {
+			v = gosnmp.ToBigInt(res.Variables[0].Value).Uint64()
+		}
+		s.Counters = append(s.Counters, v)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	event := func(format string, args ...any) {
+		e := switchEvent{At: at, Leased: leased, What: fmt.Sprintf(format, args...)}
+		m.events = append(m.events, e)
+		slog.Warn("switch: "+e.What, "leases", leased)
+	}
+	if n := len(m.samples); n > 0 {
+		prev := m.samples[n-1]
+		// The table the run fills: the port's if one is watched.
+		learnt, before := s.MACs, prev.MACs
+		where := "the MAC table"
+		if m.ifIndex > 0 {
+			learnt, before, where = s.PortMACs, prev.PortMACs, "the MAC table on "+m.port
+		}
+		if learnt <= before && s.Launched > prev.Launched {
+			m.stalled++
+		} else {
+			m.stalled = 0
+		}
+		if m.stalled == switchStallPolls && !m.stallFlagged {
+			m.stallFlagged = true
+			event("%s stopped growing at %d entries while launches continued (port security or a MAC limit?)", where, learnt)
+		}
+		if s.PortStatus != prev.PortStatus && prev.PortStatus != "" {
+			event("port %s went %s", m.port, s.PortStatus)
+		}
+		for i, c := range m.counters {
+			if s.Counters[i] > prev.Counters[i] && prevCounterFlat(m.samples, i) {
+				event("%s started rising (+%d)", c.name, s.Counters[i]-prev.Counters[i])
+			}
+		}
+	}
+	for index, cause := range causes {
+		if m.errDisabled[index] {
+			continue
+		}
+		m.errDisabled[index] = true
+		port := fmt.Sprintf("ifIndex %d", index)
+		if index == m.ifIndex {
+			port = m.port
+		}
+		event("port %s err-disabled: %s", port, cause)
+	}
+	m.samples = append(m.samples, s)
+}
+
+// prevCounterFlat reports whether counter i did not change over the
+// samples so far, so a rise is its first.
+func prevCounterFlat(samples []switchSample, i int) bool {
+	for _, s := range samples[1:] {
+		if s.Counters[i] != samples[0].Counters[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// forwardingTable counts the learnt MAC addresses, in all and on the
+// watched port.
+func (m *switchMonitor) forwardingTable() (macs, portMACs int, err error) {
+	// Bridge ports number differently from interfaces.
+	bridgePorts := make(map[int]int)
+	if m.ifIndex > 0 {
+		m.snmp.BulkWalk(oidBasePortIfIndex, func(pdu gosnmp.SnmpPDU) error {
+			bridgePorts[oidIndex(pdu.Name, oidBasePortIfIndex)] = int(gosnmp.ToBigInt(pdu.Value).Int64())
+			return nil
+		})
+	}
+	count := func(pdu gosnmp.SnmpPDU) error {
+		macs++
+		if m.ifIndex > 0 && bridgePorts[int(gosnmp.ToBigInt(pdu.Value).Int64())] == m.ifIndex {
+			portMACs++
+		}
+		return nil
+	}
+	if err = m.snmp.BulkWalk(oidDot1qTpFdbPort, count); err == nil && macs > 0 {
+		return macs, portMACs, nil
+	}
+	macs, portMACs = 0, 0
+	err = m.snmp.BulkWalk(oidDot1dTpFdbPort, count)
+	return macs, portMACs, err
+}
+
+// errDisableCauses returns the err-disabled ports by ifIndex with their
+// cause; empty on switches without CISCO-ERR-DISABLE-MIB.
+func (m *switchMonitor) errDisableCauses() map[int]string {
+	causes := make(map[int]string)
+	m.snmp.BulkWalk(oidErrDisableIfCause, func(pdu gosnmp.SnmpPDU) error {
+		code := int(gosnmp.ToBigInt(pdu.Value).Int64())
+		cause, ok := errDisableCauses[code]
+		if !ok {
+			cause = fmt.Sprintf("cause %d", code)
+		}
+		causes[oidIndex(pdu.Name, oidErrDisableIfCause)] = cause
+		return nil
+	})
+	return causes
+}
+
+// operStatus names an IF-MIB ifOperStatus value.
+func operStatus(v int64) string {
+	names := []string{1: "up", 2: "down", 3: "testing", 4: "unknown", 5: "dormant", 6: "notPresent", 7: "lowerLayerDown"}
+	if v > 0 && int(v) < len(names) {
+		return names[v]
+	}
+	return fmt.Sprintf("status %d", v)
+}
+
+// printSummary reports how the switch tables moved over the run and the
+// events on the launch timeline, and writes the samples to -snmp-log. A
+// nil monitor prints nothing.
+func (m *switchMonitor) printSummary() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Printf("Switch:            %s, %d polls", m, len(m.samples))
+	if m.pollErrors > 0 {
+		fmt.Printf(", %d failed", m.pollErrors)
+	}
+	fmt.Println()
+	if len(m.samples) == 0 {
+		return
+	}
+	first, last := m.samples[0], m.samples[len(m.samples)-1]
+	peak := first
+	for _, s := range m.samples {
+		if s.MACs > peak.MACs {
+			peak = s
+		}
+	}
+	fmt.Printf("  MAC table:       %d -> %d entries, peak %d at +%v", first.MACs, last.MACs, peak.MACs, peak.At.Round(time.Second))
+	if m.ifIndex > 0 {
+		fmt.Printf("; on %s %d -> %d", m.port, first.PortMACs, last.PortMACs)
+	}
+	fmt.Println()
+	if m.ifIndex > 0 {
+		fmt.Printf("  Port status:     %s -> %s\n", orDash(first.PortStatus), orDash(last.PortStatus))
+	}
+	for i, c := range m.counters {
+		fmt.Printf("  %-16s %d -> %d (+%d)\n", c.name+":", first.Counters[i], last.Counters[i], last.Counters[i]-first.Counters[i])
+	}
+	if len(m.events) == 0 {
+		fmt.Println("  No port security, MAC limit or counter changes seen")
+	}
+	for _, e := range m.events {
+		fmt.Printf("  +%-8v %5d leases  %s\n", e.At.Round(time.Second), e.Leased, e.What)
+	}
+	if m.logPath != "" {
+		if err := m.writeLog(); err != nil {
+			slog.Error("switch samples not written", "error", err)
+		} else {
+			fmt.Printf("  Samples written to %s\n", m.logPath)
+		}
+	}
+}
+
+// writeLog writes the samples as CSV, one row per poll.
+func (m *switchMonitor) writeLog() error {
+	f, err := os.Create(m.logPath)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	header := []string{"seconds", "launched", "leased", "macs", "port_macs", "port_status"}
+	for _, c := range m.counters {
+		header = append(header, c.name)
+	}
+	w.Write(header)
+	for _, s := range m.samples {
+		row := []string{fmt.Sprintf("%.0f", s.At.Seconds()), strconv.Itoa(s.Launched), strconv.Itoa(s.Leased), strconv.Itoa(s.MACs), strconv.Itoa(s.PortMACs), s.PortStatus}
+		for _, v := range s.Counters {
+			row = append(row, strconv.FormatUint(v, 10))
+		}
+		w.Write(row)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
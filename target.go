@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// targetServer points the raw engine at one DHCP server (-server) on a
+// segment with several, when only that one may be tested: replies from the
+// others are dropped, so no REQUEST ever names them, and renewals go to the
+// target unicast. With unicast set, DISCOVERs and REQUESTs are sent to it
+// too, and the others never see the run at all.
+type targetServer struct {
+	ip  net.IP
+	mac net.HardwareAddr
+	// unicast sends every message to the server instead of broadcasting.
+	unicast bool
+
+	mu      sync.Mutex
+	ignored int
+}
+
+// newTargetServer resolves the -server to send to. It returns nil without
+// one.
+func newTargetServer(cfg Config, netCfg *NetworkConfig) (*targetServer, error) {
+	if cfg.Server == "" {
+		return nil, nil
+	}
+	t := &targetServer{unicast: cfg.ServerUnicast}
+	if t.ip = net.ParseIP(cfg.Server).To4(); t.ip == nil {
+		return nil, fmt.Errorf("invalid -server %q: want an IPv4 address", cfg.Server)
+	}
+	// The server's own MAC on this subnet, the gateway's otherwise, as for
+	// -relay-server.
+	hop := t.ip
+	if netCfg.Subnet != nil && !netCfg.Subnet.Contains(t.ip) && netCfg.Gateway != nil {
+		hop = netCfg.Gateway
+	}
+	mac, err := resolveMAC(netCfg, hop, 2*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("-server %s: next hop %s: %v", t.ip, hop, err)
+	}
+	t.mac = mac
+	return t, nil
+}
+
+func (t *targetServer) String() string {
+	if t.unicast {
+		return fmt.Sprintf("%s (%s), every message unicast", t.ip, t.mac)
+	}
+	return fmt.Sprintf("%s (%s), renewals unicast", t.ip, t.mac)
+}
+
+// accepts reports whether a server reply comes from the target, counting
+// the ones that do not. A nil target accepts every reply.
+func (t *targetServer) accepts(msg *dhcpMessage) bool {
+	if t == nil {
+		return true
+	}
+	if server := msg.serverID(); server == nil || server.Equal(t.ip) {
+		return true
+	}
+	t.mu.Lock()
+	t.ignored++
+	t.mu.Unlock()
+	return false
+}
+
+// direct reports whether msg is sent to the server unicast: a renewal,
+// which carries the client's address, always is. A nil target sends
+// nothing unicast.
+func (t *targetServer) direct(msg *dhcpMessage) bool {
+	if t == nil {
+		return false
+	}
+	return t.unicast || (msg.CIAddr != nil && !msg.CIAddr.IsUnspecified())
+}
+
+// frame builds the unicast frame carrying msg from srcMAC to the server,
+// from the client's address if it has one.
+func (t *targetServer) frame(srcMAC net.HardwareAddr, msg *dhcpMessage) []byte {
+	src := net.IPv4zero
+	if msg.CIAddr != nil && !msg.CIAddr.IsUnspecified() {
+		src = msg.CIAddr
+	}
+	return buildUDPFrame(udpFrame{
+		SrcMAC:  srcMAC,
+		DstMAC:  t.mac,
+		SrcIP:   src,
+		DstIP:   t.ip,
+		SrcPort: dhcpClientPort,
+		DstPort: dhcpServerPort,
+		Payload: msg.marshal(),
+	})
+}
+
+// printSummary reports the replies from other servers that were dropped. A
+// nil target prints nothing.
+func (t *targetServer) printSummary() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Printf("Other servers:     %d replies from servers other than %s ignored\n", t.ignored, t.ip)
+}
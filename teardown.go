@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-units"
+)
+
+// teardownStep is one stage of cleanup. run returns a short note on what was
+// done, or an error; later steps run even when an earlier one fails so the
+// report shows everything that was left behind.
+type teardownStep struct {
+	Name string
+	run  func(ctx context.Context) (string, error)
+}
+
+// teardownResult is a step's outcome in the cleanup report.
+type teardownResult struct {
+	Step string
+	Note string
+	Err  error
+}
+
+// teardown removes everything a run created in dependency order: traffic
+// generators stop before leases are released, leases are released before
+// their containers and namespaces go away, containers before the network
+// they are attached to, the networks before their host interfaces, those before the VLAN
+// interfaces they may sit on, and NAT rules last. Images, when pruned, go
+// once no container uses them.
+type teardown struct {
+	cli  containerRuntime
+	host *hostShell
+	// kube, when set, tears down a k8s-mode run's pods and attachment
+	// networks instead of the container engine's resources.
+	kube *kubectl
+	// network is the -network name; -networks runs add per-network
+	// networks named after it.
+	network string
+	// keep, when set, is a run ID whose labelled containers and networks
+	// are left alone, for removing orphans while -resume continues it.
+	keep string
+	// pruneImages adds the removal of the images runs built, for
+	// -prune-images.
+	pruneImages bool
+
+	// networks, containers and subnet are discovered before the networks are
+	// removed. discoverErr fails the container steps when discovery did.
+	networks    []string
+	containers  []types.Container
+	namespaces  []string
+	pods        map[string]string
+	subnet      string
+	discoverErr error
+}
+
+func newTeardown(cli containerRuntime, host *hostShell, network string) *teardown {
+	return &teardown{cli: cli, host: host, network: network}
+}
+
+// steps returns the cleanup stages in the order they must run.
+func (t *teardown) steps() []teardownStep {
+	if t.kube != nil {
+		return []teardownStep{
+			{"release leases", t.releasePods},
+			{"delete pods", t.deletePods},
+			{"delete network attachments", t.deleteAttachments},
+		}
+	}
+	steps := []teardownStep{
+		{"stop traffic generators", t.stopTraffic},
+		{"release leases", t.releaseLeases},
+		{"remove containers", t.removeContainers},
+		{"delete namespaces", t.deleteNamespaces},
+		{"delete networks", t.deleteNetworks},
+		{"delete host interfaces", t.deleteHostInterfaces},
+		{"delete VLAN interfaces", t.deleteVLANInterfaces},
+		{"remove NAT rules", t.removeNAT},
+	}
+	if t.pruneImages {
+		steps = append(steps, teardownStep{"remove images", t.removeImages})
+	}
+	return steps
+}
+
+// run executes every step and returns the per-step results.
+func (t *teardown) run(ctx context.Context) []teardownResult {
+	if t.discoverErr = t.discover(ctx); t.discoverErr != nil {
+		slog.Warn("cleanup discovery incomplete", "error", t.discoverErr)
+	}
+	var results []teardownResult
+	for _, step := range t.steps() {
+		fmt.Printf("Cleanup: %s...\n", step.Name)
+		note, err := step.run(ctx)
+		results = append(results, teardownResult{Step: step.Name, Note: note, Err: err})
+		entry := map[string]any{"step": step.Name, "note": note}
+		if err != nil {
+			entry["error"] = err.Error()
+		}
+		audit.record("cleanup_step", entry)
+	}
+	return results
+}
+
+// discover finds the run's Docker networks, their client containers, the
+// container subnet and the network namespaces of a netns-mode run, or the
+// client pods of a k8s-mode run. Networks and containers are found by name
+// and attachment, and by the labels runs put on them, which also catches
+// those of runs with another -network.
+func (t *teardown) discover(ctx context.Context) error {
+	if t.kube != nil {
+		pods, err := runPods(ctx, t.kube)
+		if err != nil {
+			return fmt.Errorf("failed to list client pods: %v", err)
+		}
+		t.pods = pods
+		return nil
+	}
+	// Netns mode only runs on this machine.
+	if !t.host.remote() {
+		namespaces, err := runNamespaces(t.host)
+		if err != nil {
+			return err
+		}
+		t.namespaces = namespaces
+	}
+	summaries, err := t.cli.NetworkList(ctx, network.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("name", t.network)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list Docker networks: %v", err)
+	}
+	labelled, err := t.cli.NetworkList(ctx, network.ListOptions{Filters: labelledFilter()})
+	if err != nil {
+		return fmt.Errorf("failed to list Docker networks: %v", err)
+	}
+	seen := make(map[string]bool)
+	for _, summary := range append(summaries, labelled...) {
+		// The name filter matches substrings.
+		if summary.Labels[labelRun] == "" && summary.Name != t.network && !strings.HasPrefix(summary.Name, t.network+"_") {
+			continue
+		}
+		if seen[summary.ID] || (t.keep != "" && summary.Labels[labelRun] == t.keep) {
+			continue
+		}
+		seen[summary.ID] = true
+		t.networks = append(t.networks, summary.Name)
+		for _, cfg := range summary.IPAM.Config {
+			if !strings.Contains(cfg.Subnet, ":") {
+				t.subnet = cfg.Subnet
+			}
+		}
+		containers, err := t.cli.ContainerList(ctx, container.ListOptions{
+			All:     true,
+			Filters: filters.NewArgs(filters.Arg("network", summary.Name)),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to list client containers: %v", err)
+		}
+		t.containers = append(t.containers, containers...)
+	}
+	// Labelled containers may have lost their network, e.g. the image
+	// checks, which have none.
+	containers, err := t.cli.ContainerList(ctx, container.ListOptions{All: true, Filters: labelledFilter()})
+	if err != nil {
+		return fmt.Errorf("failed to list client containers: %v", err)
+	}
+	for _, c := range containers {
+		if !slices.ContainsFunc(t.containers, func(have types.Container) bool { return have.ID == c.ID }) {
+			t.containers = append(t.containers, c)
+		}
+	}
+	if t.keep != "" {
+		t.containers = slices.DeleteFunc(t.containers, func(c types.Container) bool { return c.Labels[labelRun] == t.keep })
+	}
+	return nil
+}
+
+// stopTraffic halts client workloads so nothing is still using an address
+// when its lease is released: the -traffic loops of the client containers.
+func (t *teardown) stopTraffic(ctx context.Context) (string, error) {
+	if t.discoverErr != nil {
+		return "", t.discoverErr
+	}
+	var errs []error
+	stopped := 0
+	for _, c := range t.containers {
+		if c.State != "running" {
+			continue
+		}
+		out, err := containerExec(ctx, t.cli, c.ID, []string{"sh", "-c", containerStopTraffic})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", shortID(c.ID), err))
+			continue
+		}
+		if strings.TrimSpace(out) == "stopped" {
+			stopped++
+		}
+	}
+	if stopped == 0 && len(errs) == 0 {
+		return "no traffic generators running", nil
+	}
+	return fmt.Sprintf("%d traffic generators stopped", stopped), errors.Join(errs...)
+}
+
+// releaseLeases has every running client send a DHCPRELEASE, returning its
+// address to the pool instead of leaving it held until lease expiry.
+func (t *teardown) releaseLeases(ctx context.Context) (string, error) {
+	if t.discoverErr != nil {
+		return "", t.discoverErr
+	}
+	var errs []error
+	released := 0
+	for _, c := range t.containers {
+		if c.State != "running" {
+			continue
+		}
+		if _, err := containerExec(ctx, t.cli, c.ID, []string{"sh", "-c", containerRelease}); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", shortID(c.ID), err))
+			continue
+		}
+		released++
+	}
+	for _, ns := range t.namespaces {
+		args := append([]string{"netns", "exec", ns, "dhclient", "-r"}, dhclientArgs(ns)...)
+		if err := netnsRun("ip", append(args, netnsLink(ns))...); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", ns, err))
+			continue
+		}
+		released++
+	}
+	return fmt.Sprintf("%d leases released", released), errors.Join(errs...)
+}
+
+// removeContainers force-removes every client container.
+func (t *teardown) removeContainers(ctx context.Context) (string, error) {
+	if t.discoverErr != nil {
+		return "", t.discoverErr
+	}
+	var errs []error
+	removed := 0
+	for _, c := range t.containers {
+		if err := t.cli.ContainerRemove(ctx, c.ID, container.RemoveOptions{Force: true}); err != nil && !client.IsErrNotFound(err) {
+			errs = append(errs, fmt.Errorf("%s: %v", shortID(c.ID), err))
+			continue
+		}
+		removed++
+	}
+	return fmt.Sprintf("%d containers removed", removed), errors.Join(errs...)
+}
+
+// deleteNamespaces removes the network namespaces of a netns-mode run with
+// their interfaces and dhclient state.
+func (t *teardown) deleteNamespaces(ctx context.Context) (string, error) {
+	if t.discoverErr != nil {
+		return "", t.discoverErr
+	}
+	if len(t.namespaces) == 0 {
+		return "no namespaces created by a run", nil
+	}
+	for _, ns := range t.namespaces {
+		deleteNamespace(ns)
+	}
+	return fmt.Sprintf("%d namespaces removed", len(t.namespaces)), nil
+}
+
+// deleteNetworks removes the -network network and the per-network networks
+// of a -networks run.
+func (t *teardown) deleteNetworks(ctx context.Context) (string, error) {
+	if len(t.networks) == 0 {
+		return t.network + " not present", nil
+	}
+	var errs []error
+	var removed []string
+	for _, name := range t.networks {
+		if err := t.cli.NetworkRemove(ctx, name); err != nil && !client.IsErrNotFound(err) {
+			errs = append(errs, fmt.Errorf("failed to remove Docker network %s: %v", name, err))
+			continue
+		}
+		removed = append(removed, name)
+	}
+	return strings.Join(removed, ", ") + " removed", errors.Join(errs...)
+}
+
+// deleteHostInterfaces removes macvlan0 and the other host interfaces a run
+// created and, with them, their routes.
+func (t *teardown) deleteHostInterfaces(ctx context.Context) (string, error) {
+	names, err := runHostLinks(t.host)
+	if err != nil {
+		return "", err
+	}
+	// macvlan0 predates the label and is removed either way.
+	if !slices.Contains(names, hostLink) && t.host.command("ip", "link", "show", hostLink).Run() == nil {
+		names = append(names, hostLink)
+	}
+	if len(names) == 0 {
+		return hostLink + " not present", nil
+	}
+	for _, name := range names {
+		if out, err := t.host.command("ip", "link", "delete", name).CombinedOutput(); err != nil {
+			return "", fmt.Errorf("failed to delete %s: %v: %s", name, err, strings.TrimSpace(string(out)))
+		}
+	}
+	return strings.Join(names, ", ") + " and their routes removed", nil
+}
+
+// deleteVLANInterfaces removes the -vlan subinterfaces a run created.
+func (t *teardown) deleteVLANInterfaces(ctx context.Context) (string, error) {
+	names, err := runVLANInterfaces(t.host)
+	if err != nil {
+		return "", err
+	}
+	if len(names) == 0 {
+		return "no VLAN interfaces created by a run", nil
+	}
+	for _, name := range names {
+		if out, err := t.host.command("ip", "link", "delete", name).CombinedOutput(); err != nil {
+			return "", fmt.Errorf("failed to delete %s: %v: %s", name, err, strings.TrimSpace(string(out)))
+		}
+	}
+	return strings.Join(names, ", ") + " removed", nil
+}
+
+// removeNAT deletes the masquerade rule added by -internet through the
+// firewall framework it was added with, and restores IP forwarding.
+func (t *teardown) removeNAT(ctx context.Context) (string, error) {
+	return disableNAT(t.host, t.subnet)
+}
+
+// removeImages removes the images runs built, client images and image check
+// builds alike, found by their labels, and then their dangling layers: the
+// untagged images earlier builds of the same tags left behind. Registry
+// images pulled for -images carry no labels and are kept.
+func (t *teardown) removeImages(ctx context.Context) (string, error) {
+	images, err := t.cli.ImageList(ctx, image.ListOptions{Filters: labelledFilter()})
+	if err != nil {
+		return "", fmt.Errorf("failed to list images: %v", err)
+	}
+	var errs []error
+	removed := 0
+	for _, img := range images {
+		if t.keep != "" && img.Labels[labelRun] == t.keep {
+			continue
+		}
+		if _, err := t.cli.ImageRemove(ctx, img.ID, image.RemoveOptions{Force: true, PruneChildren: true}); err != nil && !client.IsErrNotFound(err) {
+			errs = append(errs, fmt.Errorf("%s: %v", orDash(strings.Join(img.RepoTags, ",")), err))
+			continue
+		}
+		removed++
+	}
+	dangling := labelledFilter()
+	dangling.Add("dangling", "true")
+	report, err := t.cli.ImagesPrune(ctx, dangling)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to prune dangling images: %v", err))
+	}
+	pruned := 0
+	for _, deleted := range report.ImagesDeleted {
+		if deleted.Deleted != "" {
+			pruned++
+		}
+	}
+	return fmt.Sprintf("%d images removed, %d dangling layers pruned, %s reclaimed", removed, pruned, units.HumanSize(float64(report.SpaceReclaimed))), errors.Join(errs...)
+}
+
+// printTeardownReport writes the outcome of every cleanup step and reports
+// whether all of them succeeded.
+func printTeardownReport(results []teardownResult) bool {
+	fmt.Println("=== Cleanup Report ===")
+	ok := true
+	for i, r := range results {
+		if r.Err != nil {
+			ok = false
+			fmt.Printf("%d. %-24s FAILED %s\n", i+1, r.Step, r.Note)
+			for _, line := range strings.Split(r.Err.Error(), "\n") {
+				fmt.Printf("     - %s\n", line)
+			}
+			continue
+		}
+		fmt.Printf("%d. %-24s ok     %s\n", i+1, r.Step, r.Note)
+	}
+	return ok
+}
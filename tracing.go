@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer records the spans of the build and launch pipeline. Until
+// setupTracing installs an exporter it is a no-op.
+var tracer = otel.Tracer("github.com/ipocalypse")
+
+// setupTracing exports spans to the OTLP/HTTP collector at endpoint, e.g.
+// http://localhost:4318, and returns a function flushing the spans still
+// buffered. An empty endpoint leaves tracing off.
+func setupTracing(endpoint string) (func(), error) {
+	if endpoint == "" {
+		return func() {}, nil
+	}
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up OTLP export to %s: %v", endpoint, err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "ipocalypse"),
+			attribute.String("ipocalypse.run_id", runID),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	fmt.Printf("Exporting traces to %s\n", endpoint)
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		provider.Shutdown(ctx)
+	}, nil
+}
+
+// startSpan starts a span of the pipeline with the given string attributes,
+// as key/value pairs.
+func startSpan(ctx context.Context, name string, attrs ...string) (context.Context, trace.Span) {
+	kvs := make([]attribute.KeyValue, 0, len(attrs)/2)
+	for i := 0; i+1 < len(attrs); i += 2 {
+		kvs = append(kvs, attribute.String(attrs[i], attrs[i+1]))
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(kvs...))
+}
+
+// endSpan ends span, marking it failed if err is set.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracedSleep sleeps for d on c in a span of its own, so the run's own pauses show
+// up in traces next to the time spent in Docker and DHCP.
+func tracedSleep(ctx context.Context, c Clock, name string, d time.Duration) {
+	_, span := startSpan(ctx, name)
+	span.SetAttributes(attribute.Int64("duration_ms", d.Milliseconds()))
+	c.Sleep(d)
+	span.End()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Kinds of background traffic accepted by -traffic.
+const (
+	trafficPing = "ping"
+	trafficDNS  = "dns"
+	trafficHTTP = "http"
+)
+
+// trafficPIDFile is where a client's traffic loop records its PID, so cleanup
+// can stop it before the lease is released.
+const trafficPIDFile = "/tmp/ipocalypse-traffic.pid"
+
+// trafficTarget is one thing a client reaches out to on every round.
+type trafficTarget struct {
+	Kind   string
+	Target string
+}
+
+func (t trafficTarget) String() string {
+	if t.Kind == trafficHTTP {
+		return t.Target
+	}
+	return t.Kind + ":" + t.Target
+}
+
+// command is the shell command reaching the target once. The alternatives
+// cover BusyBox and the usual distribution images; output is discarded.
+func (t trafficTarget) command() string {
+	target := shellQuote(t.Target)
+	switch t.Kind {
+	case trafficPing:
+		return "ping -c 1 -W 2 " + target
+	case trafficDNS:
+		return "nslookup " + target + " || getent hosts " + target
+	}
+	return "wget -q -O /dev/null -T 10 " + target + " || curl -s -o /dev/null -m 10 " + target
+}
+
+// parseTrafficTarget parses a -traffic entry: ping:<host>, dns:<name> or an
+// http:// or https:// URL.
+func parseTrafficTarget(raw string) (trafficTarget, error) {
+	if strings.HasPrefix(raw, "http://") || strings.HasPrefix(raw, "https://") {
+		if u, err := url.Parse(raw); err != nil || u.Host == "" {
+			return trafficTarget{}, fmt.Errorf("invalid traffic target %q: not a URL", raw)
+		}
+		return trafficTarget{Kind: trafficHTTP, Target: raw}, nil
+	}
+	kind, target, ok := strings.Cut(raw, ":")
+	if !ok || target == "" || (kind != trafficPing && kind != trafficDNS) {
+		return trafficTarget{}, fmt.Errorf("invalid traffic target %q (use ping:<host>, dns:<name> or an http(s) URL)", raw)
+	}
+	return trafficTarget{Kind: kind, Target: target}, nil
+}
+
+// trafficGenerator has every client that obtains a lease reach its targets
+// in the background, so the exhausted pool comes with the kind of traffic
+// real clients make for NAC and monitoring to react to.
+type trafficGenerator struct {
+	targets  []trafficTarget
+	interval time.Duration
+}
+
+// newTrafficGenerator returns nil without targets.
+func newTrafficGenerator(targets []string, interval time.Duration) (*trafficGenerator, error) {
+	if len(targets) == 0 {
+		return nil, nil
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("-traffic-interval must be positive")
+	}
+	g := &trafficGenerator{interval: interval}
+	for _, raw := range targets {
+		t, err := parseTrafficTarget(raw)
+		if err != nil {
+			return nil, err
+		}
+		g.targets = append(g.targets, t)
+	}
+	return g, nil
+}
+
+func (g *trafficGenerator) String() string {
+	names := make([]string, len(g.targets))
+	for i, t := range g.targets {
+		names[i] = t.String()
+	}
+	return fmt.Sprintf("%s every %s", strings.Join(names, ", "), g.interval)
+}
+
+// script is the traffic loop run in each client. Clients start at a random
+// point of the interval, where the shell has $RANDOM, so they do not all
+// send in step.
+func (g *trafficGenerator) script() string {
+	seconds := max(int(g.interval.Seconds()), 1)
+	var b strings.Builder
+	fmt.Fprintf(&b, "echo $$ > %s\n", trafficPIDFile)
+	fmt.Fprintf(&b, "sleep $(( ${RANDOM:-0} %% %d ))\n", seconds)
+	b.WriteString("while :; do\n")
+	for _, t := range g.targets {
+		fmt.Fprintf(&b, "    (%s) >/dev/null 2>&1\n", t.command())
+	}
+	fmt.Fprintf(&b, "    sleep %d\ndone", seconds)
+	return b.String()
+}
+
+// start runs the traffic loop in a client container. It is detached from the
+// exec, so it keeps running until the container is stopped or cleanup kills
+// it. A nil generator does nothing.
+func (g *trafficGenerator) start(ctx context.Context, cli containerRuntime, containerID string) error {
+	if g == nil {
+		return nil
+	}
+	detached := "nohup sh -c " + shellQuote(g.script()) + " >/dev/null 2>&1 &"
+	_, err := containerExec(ctx, cli, containerID, []string{"sh", "-c", detached})
+	return err
+}
+
+// containerStopTraffic stops a client's traffic loop, printing "stopped" if
+// it ran one.
+const containerStopTraffic = `if [ -f ` + trafficPIDFile + ` ]; then kill $(cat ` + trafficPIDFile + `) 2>/dev/null; rm -f ` + trafficPIDFile + `; echo stopped; fi`
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// dashboardEvents is how many recent warnings and errors the dashboard
+	// keeps; dashboardLeases is how many of the newest leases it lists.
+	dashboardEvents = 8
+	dashboardLeases = 15
+
+	ansiHome      = "\033[H"
+	ansiClear     = "\033[2J"
+	ansiClearLine = "\033[K"
+	ansiClearDown = "\033[J"
+	ansiHide      = "\033[?25l"
+	ansiShow      = "\033[?25h"
+)
+
+// dashboard is the -tui live view of a run. It redraws in place instead of
+// scrolling log lines. A nil *dashboard ignores every call, so workers can
+// report to it unconditionally.
+type dashboard struct {
+	mu      sync.Mutex
+	workers map[int]string
+	events  []string
+	partial []byte
+}
+
+func newDashboard() *dashboard {
+	return &dashboard{workers: make(map[int]string)}
+}
+
+// setWorker records what a worker is currently doing.
+func (d *dashboard) setWorker(id int, status string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.workers[id] = status
+}
+
+// Write makes the dashboard the log destination in -tui mode: each complete
+// log line becomes a recent event.
+func (d *dashboard) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.partial = append(d.partial, p...)
+	for {
+		i := bytes.IndexByte(d.partial, '\n')
+		if i < 0 {
+			break
+		}
+		d.events = append(d.events, string(d.partial[:i]))
+		d.partial = d.partial[i+1:]
+	}
+	if len(d.events) > dashboardEvents {
+		d.events = d.events[len(d.events)-dashboardEvents:]
+	}
+	return len(p), nil
+}
+
+// run redraws the dashboard every interval until ctx is cancelled, then
+// restores the cursor.
+func (d *dashboard) run(ctx context.Context, stats *runStats, leases *leaseTable, interval time.Duration) {
+	fmt.Print(ansiHide + ansiClear)
+	defer fmt.Print(ansiShow)
+	for {
+		d.render(stats, leases)
+		select {
+		case <-ctx.Done():
+			d.render(stats, leases)
+			return
+		case <-clock.After(interval):
+		}
+	}
+}
+
+// render draws one frame.
+func (d *dashboard) render(stats *runStats, leases *leaseTable) {
+	var b strings.Builder
+	line := func(format string, args ...any) {
+		fmt.Fprintf(&b, format, args...)
+		b.WriteString(ansiClearLine + "\n")
+	}
+
+	launched, leased, perMinute := stats.launchRate()
+	line("ipocalypse - %s", clock.Now().Format("15:04:05"))
+	line("")
+	line("Leases acquired: %d   Clients launched: %d   Launch rate: %.1f/min", leased, launched, perMinute)
+	line("%s", stats.statusLine())
+	line("")
+
+	d.mu.Lock()
+	ids := make([]int, 0, len(d.workers))
+	for id := range d.workers {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	line("Workers")
+	for _, id := range ids {
+		line("  %3d  %s", id, d.workers[id])
+	}
+	line("")
+
+	records := leases.snapshot()
+	line("Recent leases (%d total)", len(records))
+	line("  %-39s  %-17s  %-6s  %-8s  %s", "IP", "MAC", "WORKER", "TIME", "IMAGE")
+	first := len(records) - dashboardLeases
+	if first < 0 {
+		first = 0
+	}
+	for i := len(records) - 1; i >= first; i-- {
+		l := records[i]
+		line("  %-39s  %-17s  %-6d  %-8s  %s", l.IP, l.MAC, l.Worker, l.AcquiredAt.Format("15:04:05"), l.Image)
+	}
+	line("")
+
+	line("Recent warnings and errors")
+	for _, event := range d.events {
+		line("  %s", event)
+	}
+	d.mu.Unlock()
+
+	// Clear whatever a longer previous frame left below this one.
+	fmt.Print(ansiHome + b.String() + ansiClearDown)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+// linkAlias marks the VLAN subinterfaces and host interfaces a run created,
+// so cleanup removes those and leaves links the operator set up alone.
+const linkAlias = "ipocalypse"
+
+// setupVLANInterface makes sure the 802.1Q subinterface for id exists on
+// parent (the default route's interface when empty) and is up, and returns
+// its name. Clients are then launched on the subinterface, so their frames
+// leave the parent tagged with the VLAN ID.
+func setupVLANInterface(host *hostShell, parent string, id int) (string, error) {
+	if id < 1 || id > 4094 {
+		return "", fmt.Errorf("invalid -vlan %d: VLAN IDs range from 1 to 4094", id)
+	}
+	if err := host.requireRoot(); err != nil {
+		return "", err
+	}
+	if parent == "" {
+		routeIface, _, err := defaultRoute(host, "")
+		if err != nil || routeIface == "" {
+			return "", fmt.Errorf("no default route to find the trunk interface, use -interface to name it")
+		}
+		parent = routeIface
+	}
+	name := vlanInterfaceName(parent, id)
+
+	fmt.Println("=== Setting up VLAN Interface ===")
+	if host.command("ip", "link", "show", name).Run() == nil {
+		fmt.Printf("Using existing VLAN interface %s\n", name)
+	} else {
+		if out, err := host.command("ip", "link", "add", "link", parent, "name", name, "type", "vlan", "id", fmt.Sprint(id)).CombinedOutput(); err != nil {
+			return "", fmt.Errorf("failed to create VLAN interface %s: %v: %s", name, err, strings.TrimSpace(string(out)))
+		}
+		if out, err := host.command("ip", "link", "set", "dev", name, "alias", linkAlias).CombinedOutput(); err != nil {
+			return "", fmt.Errorf("failed to label VLAN interface %s: %v: %s", name, err, strings.TrimSpace(string(out)))
+		}
+		fmt.Printf("Created VLAN interface %s (802.1Q ID %d on %s)\n", name, id, parent)
+		audit.record("vlan_interface", map[string]any{"interface": name, "parent": parent, "vlan": id, "host": host.String()})
+	}
+	if out, err := host.command("ip", "link", "set", "dev", name, "up").CombinedOutput(); err != nil {
+		return "", fmt.Errorf("failed to bring up %s: %v: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	return name, nil
+}
+
+// vlanInterfaceName returns the conventional parent.id name, or vlan<id>
+// when that would exceed the kernel's 15-character interface name limit.
+func vlanInterfaceName(parent string, id int) string {
+	name := fmt.Sprintf("%s.%d", parent, id)
+	if len(name) > 15 {
+		name = fmt.Sprintf("vlan%d", id)
+	}
+	return name
+}
+
+// runVLANInterfaces returns the VLAN subinterfaces created by a run.
+func runVLANInterfaces(host *hostShell) ([]string, error) {
+	out, err := host.command("ip", "-o", "link", "show", "type", "vlan").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list VLAN interfaces: %v", err)
+	}
+	return labelledLinks(string(out)), nil
+}
+
+// labelledLinks returns the names of the links in `ip -o link show` output
+// that carry linkAlias.
+func labelledLinks(out string) []string {
+	var names []string
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.Contains(line, "alias "+linkAlias) {
+			continue
+		}
+		// "7: eth0.120@eth0: <...> ... alias ipocalypse"
+		name, _, _ := strings.Cut(strings.TrimSuffix(fields[1], ":"), "@")
+		names = append(names, name)
+	}
+	return names
+}
+
+// offeredNetwork learns the subnet and gateway of a segment the host has no
+// address on, such as a freshly tagged VLAN, from a DHCP OFFER to the
+// interface's own MAC. No REQUEST follows, so no lease is taken.
+func offeredNetwork(iface string) (*net.IPNet, net.IP, error) {
+	engine, err := newRawEngine(iface)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer engine.conn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go engine.receive(ctx)
+
+	mac := engine.conn.iface.HardwareAddr
+	discover := newDHCPRequest(dhcpDiscover, rand.Uint32(), mac)
+	discover.addOption(optClientID, append([]byte{1}, mac...))
+	discover.addOption(optParamRequest, []byte{optSubnetMask, optRouter})
+	offer, err := engine.transact(ctx, discover, 3, 3*time.Second, dhcpOffer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if offer == nil {
+		return nil, nil, fmt.Errorf("no DHCP server answered on %s", iface)
+	}
+	mask := offer.option(optSubnetMask)
+	if len(mask) != 4 || offer.YIAddr.To4() == nil {
+		return nil, nil, fmt.Errorf("the DHCP offer on %s carries no subnet mask", iface)
+	}
+	subnet := &net.IPNet{IP: offer.YIAddr.Mask(net.IPMask(mask)).To4(), Mask: net.IPMask(mask)}
+	var gateway net.IP
+	if router := offer.option(optRouter); len(router) >= 4 {
+		gateway = net.IP(router[:4])
+	}
+	return subnet, gateway, nil
+}
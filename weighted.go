@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// weightedSet picks values at random in proportion to their weights.
+type weightedSet[T any] struct {
+	values  []T
+	weights []int
+	total   int
+}
+
+func (w *weightedSet[T]) add(value T, weight int) {
+	w.values = append(w.values, value)
+	w.weights = append(w.weights, weight)
+	w.total += weight
+}
+
+func (w *weightedSet[T]) empty() bool {
+	return len(w.values) == 0
+}
+
+// pick returns a random value; the set must not be empty.
+func (w *weightedSet[T]) pick() T {
+	n := identityRand.Intn(w.total)
+	for i, weight := range w.weights {
+		if n < weight {
+			return w.values[i]
+		}
+		n -= weight
+	}
+	return w.values[len(w.values)-1]
+}
+
+// parseWeight splits a "name[:weight]" spec. The weight defaults to 1.
+func parseWeight(spec string) (string, int, error) {
+	i := strings.LastIndex(spec, ":")
+	if i < 0 {
+		return spec, 1, nil
+	}
+	weight, err := strconv.Atoi(spec[i+1:])
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid weight in %q", spec)
+	}
+	if weight <= 0 {
+		return "", 0, fmt.Errorf("%q must have a positive weight", spec)
+	}
+	return spec[:i], weight, nil
+}
+
+// parseImageWeight splits a "reference[:weight]" registry image spec. The
+// last colon may also start the reference's tag or digest, so what follows it
+// is only a weight when the reference before it is tagged or pinned already:
+// alpine:3 is the image alpine:3, while alpine:3:5 is alpine:3 with weight 5.
+func parseImageWeight(spec string) (string, int, error) {
+	i := strings.LastIndex(spec, ":")
+	if i < 0 {
+		return spec, 1, nil
+	}
+	ref := spec[:i]
+	name := ref[strings.LastIndex(ref, "/")+1:]
+	if !strings.Contains(name, ":") {
+		return spec, 1, nil
+	}
+	return parseWeight(spec)
+}
+
+// parseImageSpecs splits -dockerfiles directories or, with registry set,
+// -images references from their optional weights.
+func parseImageSpecs(specs []string, registry bool) ([]string, []int, error) {
+	parse := parseWeight
+	if registry {
+		parse = parseImageWeight
+	}
+	names := make([]string, 0, len(specs))
+	weights := make([]int, 0, len(specs))
+	for _, spec := range specs {
+		name, weight, err := parse(spec)
+		if err != nil {
+			return nil, nil, err
+		}
+		names = append(names, name)
+		weights = append(weights, weight)
+	}
+	return names, weights, nil
+}
+
+// describeCounts lists the values with their weights taken as counts, e.g.
+// "basic 50, phone 200".
+func (w *weightedSet[T]) describeCounts() string {
+	parts := make([]string, len(w.values))
+	for i, value := range w.values {
+		parts[i] = fmt.Sprintf("%v %d", value, w.weights[i])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// describe lists the values with their share of the picks, e.g.
+// "basic 70%, phone 30%".
+func (w *weightedSet[T]) describe() string {
+	parts := make([]string, len(w.values))
+	for i, value := range w.values {
+		parts[i] = fmt.Sprintf("%v %.0f%%", value, float64(w.weights[i])/float64(w.total)*100)
+	}
+	return strings.Join(parts, ", ")
+}
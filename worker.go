@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+)
+
+// launchWorker is what the run's launch workers share: the engine that
+// launches clients on the container runtime, the clock launches are timed,
+// paced and backed off by, and the budget, networks and monitors of the run.
+// The optional monitors are nil when their flags are off.
+type launchWorker struct {
+	engine Engine
+	cli    containerRuntime
+	clock  Clock
+
+	ctl     *runControl
+	budget  *leaseBudget
+	daemon  *daemonMonitor
+	reserve *freeReserve
+	churn   *clientChurn
+	pacing  *launchPacing
+	retry   *retryPolicy
+	// exhaustAfter is how many launches in a row must get no lease before
+	// a network's pool counts as exhausted.
+	exhaustAfter int
+
+	specMu    *sync.Mutex
+	clients   *imageSelector
+	nets      *networkSet
+	newSpec   func(image string, target *targetNetwork) launchSpec
+	manifests map[string]*imageManifest
+
+	stats      *runStats
+	leases     *leaseTable
+	conflicts  *conflictCheck
+	announce   *announcer
+	keepalive  *arpKeeper
+	dnsQueries *dnsLoad
+	traffic    *trafficGenerator
+	dash       *dashboard
+
+	// errs receives the error that ends the run, and cancel ends it.
+	errs   chan<- error
+	cancel context.CancelFunc
+}
+
+// run launches clients one after another as worker workerID until ctx ends,
+// the worker is retired, the budget or pool runs out or launches keep
+// failing.
+func (w *launchWorker) run(ctx context.Context, workerID int) {
+	log := workerLogger(workerID)
+	// failures counts this worker's consecutive failed launches.
+	failures := 0
+	giveUp := func(err error, status string) {
+		w.dash.setWorker(workerID, "stopped: "+status)
+		select {
+		case w.errs <- err:
+		default:
+		}
+		w.cancel()
+	}
+	w.pacing.staggerStart(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			if w.ctl.retired(workerID) {
+				w.dash.setWorker(workerID, "retired")
+				return
+			}
+			// Hold off while paused or while the Docker daemon is being
+			// reconnected.
+			w.ctl.wait(ctx)
+			w.daemon.wait(ctx)
+			w.reserve.wait(ctx)
+			_, waitSpan := startSpan(ctx, "budget.wait", "worker", strconv.Itoa(workerID))
+			took := w.budget.take(ctx)
+			waitSpan.End()
+			if !took {
+				if w.churn != nil && ctx.Err() == nil {
+					w.dash.setWorker(workerID, "waiting for churn")
+					w.churn.wait(ctx)
+					continue
+				}
+				w.dash.setWorker(workerID, "stopped: lease budget reached")
+				return
+			}
+			// Launch on the next network that still has addresses and
+			// room under its own cap, if it has one.
+			target := w.nets.pick()
+			if !w.budget.takeNetwork(ctx, target.Name) {
+				w.budget.settle(false)
+				if ctx.Err() != nil || !w.nets.finished() {
+					continue
+				}
+				if w.churn != nil {
+					w.dash.setWorker(workerID, "waiting for churn")
+					w.churn.wait(ctx)
+					continue
+				}
+				w.dash.setWorker(workerID, "stopped: lease budget reached")
+				w.cancel()
+				return
+			}
+			// Pick the next client image by -strategy.
+			w.specMu.Lock()
+			chosenImage := w.clients.pick()
+			spec := w.newSpec(chosenImage, target)
+			w.specMu.Unlock()
+			w.dash.setWorker(workerID, "launching "+chosenImage)
+			spec.Labels[labelWorker] = strconv.Itoa(workerID)
+			launchStart := w.clock.Now()
+			launchCtx, span := startSpan(ctx, "client.launch", "image", chosenImage, "network", target.Name, "worker", strconv.Itoa(workerID))
+			result, err := w.engine.Launch(launchCtx, spec)
+			endSpan(span, err)
+			capReached := w.budget.settle(err == nil)
+			networkCapReached := w.budget.settleNetwork(target.Name, err == nil)
+			w.clients.settle(chosenImage, err == nil)
+			if err != nil {
+				// A daemon outage is not the DHCP server's doing; wait
+				// for the reconnect and retry without counting it. DHCP
+				// outcomes came from a working daemon and need no ping.
+				if !isDHCPOutcome(err) && (w.daemon.check(ctx) || errors.Is(err, ErrDaemonUnavailable)) {
+					log.Warn("launch interrupted by Docker daemon outage, retrying", "image", chosenImage)
+					continue
+				}
+				// Neither is a network deleted under the run.
+				if errors.Is(err, ErrNetworkMissing) {
+					if err := w.daemon.restoreNetwork(ctx, target.NetworkConfig); err != nil {
+						log.Error("failed to recreate Docker network", "network", target.Name, "error", err)
+						failures++
+						w.clock.Sleep(w.retry.delay(failures))
+					}
+					continue
+				}
+				w.budget.recordLaunch(launchStart, err)
+				failLog := log
+				if path := spec.Logs.saved(result.ID); path != "" {
+					failLog = log.With("log", path)
+				}
+				failLog.Error("error launching container", "image", chosenImage, "network", target.Name, "container", shortID(result.ID), "mac", spec.MAC.String(), "error", err)
+				w.stats.recordFailure(clientKey(workerID, chosenImage, spec.Profile), err, w.clock.Since(launchStart))
+				target.stats.recordFailure(clientKey(workerID, chosenImage, spec.Profile), err, w.clock.Since(launchStart))
+				events.emit("launch_failed", map[string]any{"worker": workerID, "container": shortID(result.ID), "image": chosenImage, "network": target.Name, "reason": failureKind(err), "error": err.Error()})
+				if errors.Is(err, ErrAPIPA) {
+					count, rate := w.stats.recordAPIPA()
+					log.Warn("client fell back to APIPA", "container", shortID(result.ID), "apipa_clients", count, "apipa_rate_pct", rate)
+				}
+				// Once -exhaust-after launches in a row got no IP, assume
+				// subnet exhaustion, and carry on with the other networks
+				// if any. Fewer may just be a briefly slow server.
+				if missed := target.stats.missedLeases(); errors.Is(err, ErrNoLease) && missed < w.exhaustAfter {
+					log.Warn("no lease, not yet treating the pool as exhausted", "network", target.Name, "missed_in_a_row", missed, "exhaust_after", w.exhaustAfter)
+				} else if errors.Is(err, ErrNoLease) {
+					if !w.nets.exhaust(target) {
+						log.Warn("network pool exhausted, launching on the remaining networks", "network", target.Name, "subnet", target.Subnet.String())
+						continue
+					}
+					if w.stats.markExhausted() {
+						emitExhausted(w.stats)
+					}
+					if w.reserve != nil {
+						w.dash.setWorker(workerID, "restoring free reserve")
+						w.reserve.exhausted(ctx)
+						continue
+					}
+					if w.churn != nil {
+						w.dash.setWorker(workerID, "waiting for churn")
+						w.churn.wait(ctx)
+						continue
+					}
+					w.dash.setWorker(workerID, "stopped: pool exhausted")
+					select {
+					case w.errs <- err:
+					default:
+					}
+					w.cancel()
+					return
+				}
+				// Otherwise, back off and try again, unless the runtime
+				// rejected the launch outright or it keeps failing.
+				if !retryable(err) {
+					giveUp(err, "launch cannot succeed on retry")
+					return
+				}
+				if isDHCPOutcome(err) {
+					failures = 0
+				} else if failures++; w.retry.exhausted(failures) {
+					giveUp(fmt.Errorf("giving up after %d consecutive failed launches: %w", failures, err), "too many consecutive failures")
+					return
+				}
+				w.dash.setWorker(workerID, "retrying after error: "+failureKind(err))
+				tracedSleep(ctx, w.clock, "worker.backoff", w.retry.delay(failures))
+				continue
+			}
+			failures = 0
+			w.budget.recordLaunch(launchStart, nil)
+			w.stats.recordLease(clientKey(workerID, chosenImage, spec.Profile), w.clock.Since(launchStart))
+			target.stats.recordLease(clientKey(workerID, chosenImage, spec.Profile), w.clock.Since(launchStart))
+			w.leases.add(leaseRecord{IP: result.IP, MAC: result.MAC, LeaseSeconds: int(result.LeaseTime.Seconds()), Server: result.Server, Container: shortID(result.ID), Image: chosenImage, Network: target.Name, Worker: workerID, ClientID: result.ClientID})
+			events.emit("lease_acquired", map[string]any{"worker": workerID, "container": shortID(result.ID), "image": chosenImage, "network": target.Name, "mac": result.MAC, "ip": result.IP, "server": result.Server, "lease_seconds": int(result.LeaseTime.Seconds()), "latency_ms": w.clock.Since(launchStart).Milliseconds()})
+			w.conflicts.check(ctx, result.IP, result.MAC)
+			log.Info("launched container", "container", shortID(result.ID), "image", chosenImage, "network", target.Name, "mac", result.MAC, "ip", result.IP)
+			// Confirm the client's payload is running, not just that it holds a lease.
+			if probe := w.manifests[chosenImage].HealthProbe; probe != nil {
+				w.dash.setWorker(workerID, "probing "+shortID(result.ID))
+				if err := runHealthProbe(w.cli, probe, result.ID, result.IP); err != nil {
+					w.stats.recordProbe(false)
+					log.Warn("container has a lease but failed its health probe", "container", shortID(result.ID), "image", chosenImage, "ip", result.IP, "error", err)
+				} else {
+					w.stats.recordProbe(true)
+					log.Info("container is fully operational", "container", shortID(result.ID), "image", chosenImage, "ip", result.IP)
+				}
+			}
+			w.announce.add(result.MAC, result.IP, spec.Hostname)
+			w.keepalive.add(result.MAC, result.IP)
+			w.dnsQueries.add(result.MAC, result.IP, result.DNS)
+			if err := w.traffic.start(ctx, w.cli, result.ID); err != nil {
+				log.Warn("container has a lease but its traffic generator did not start", "container", shortID(result.ID), "image", chosenImage, "error", err)
+			}
+			w.reserve.rebalance(ctx)
+			// The run's budget is also used up once every network is
+			// exhausted or at its own cap.
+			if networkCapReached && w.nets.finished() {
+				capReached = true
+			} else if networkCapReached {
+				log.Info("network lease budget reached, launching on the remaining networks", "network", target.Name, "budget", w.budget.network(target.Name).String())
+			}
+			if capReached && w.churn == nil {
+				slog.Info("lease budget reached, stopping launches", "budget", w.budget.String())
+				w.dash.setWorker(workerID, "stopped: lease budget reached")
+				w.cancel()
+				return
+			}
+			// Without a rate or ramp, -launch-interval keeps each
+			// worker from hammering the daemon.
+			if !w.budget.paced() {
+				tracedSleep(ctx, w.clock, "worker.pause", w.pacing.pause())
+			}
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/errdefs"
+)
+
+// newTestWorker returns a launch worker that launches testSpec clients on
+// cli, timed by c, until maxLeases are held (0 for no cap), with ctl set to
+// run it.
+func newTestWorker(t *testing.T, c *manualClock, cli *fakeRuntime, retry *retryPolicy, maxLeases int) (*launchWorker, chan error) {
+	t.Helper()
+	budget, err := newLeaseBudget(maxLeases, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mix := &weightedSet[string]{}
+	mix.add(testSpec().Image, 1)
+	clients, err := newImageSelector(strategyRoundRobin, mix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nets := testNetworkSet("172.18.0.0/16")
+	nets.networks[0].Name = testNetwork
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	errs := make(chan error, 1)
+	w := &launchWorker{
+		engine:  &dockerEngine{cli: cli},
+		cli:     cli,
+		clock:   c,
+		budget:  budget,
+		daemon:  newDaemonMonitor(cli, nets.configs(), retry, func(error) {}),
+		pacing:  &launchPacing{interval: 2 * time.Second},
+		retry:   retry,
+		specMu:  new(sync.Mutex),
+		clients: clients,
+		nets:    nets,
+		newSpec: func(image string, target *targetNetwork) launchSpec {
+			spec := testSpec()
+			spec.Image, spec.Network = image, target.Name
+			spec.Labels = runLabels(labelImage, image)
+			return spec
+		},
+		manifests:    map[string]*imageManifest{testSpec().Image: {}},
+		exhaustAfter: 3,
+		stats:        newRunStats(),
+		leases:       &leaseTable{},
+		errs:         errs,
+		cancel:       cancel,
+	}
+	w.ctl = newRunControl(ctx, cancel, w.run)
+	return w, errs
+}
+
+// runTestWorker runs w as the only worker until it stops the run.
+func runTestWorker(t *testing.T, w *launchWorker) {
+	t.Helper()
+	if err := w.ctl.setWorkers(1); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-w.ctl.ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker did not stop the run")
+	}
+	w.ctl.stop()
+}
+
+func TestLaunchWorkerRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		startErr     error
+		attempts     int
+		wantLaunches int
+		wantElapsed  time.Duration
+		wantErr      string
+	}{
+		{
+			name:         "gives up after the attempts",
+			startErr:     errors.New("driver failed programming external connectivity"),
+			attempts:     3,
+			wantLaunches: 3,
+			// 1s after the first failure, 2s after the second.
+			wantElapsed: 3 * time.Second,
+			wantErr:     "giving up after 3 consecutive failed launches",
+		},
+		{
+			name:         "backoff capped at the max",
+			startErr:     errors.New("driver failed programming external connectivity"),
+			attempts:     5,
+			wantLaunches: 5,
+			wantElapsed:  (1 + 2 + 3 + 3) * time.Second,
+			wantErr:      "giving up after 5 consecutive failed launches",
+		},
+		{
+			name:         "not retried",
+			startErr:     errdefs.InvalidParameter(errors.New("invalid mac address")),
+			attempts:     3,
+			wantLaunches: 1,
+			wantErr:      "invalid mac address",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := useManualClock(t)
+			start := c.Now()
+			cli := newFakeRuntime(c, testNetwork, func() *fakeContainer { return &fakeContainer{lease: testLease} })
+			cli.startErr = tt.startErr
+			retry := &retryPolicy{initial: time.Second, multiplier: 2, max: 3 * time.Second, attempts: tt.attempts}
+			w, errs := newTestWorker(t, c, cli, retry, 0)
+			runTestWorker(t, w)
+
+			if got := len(cli.containers); got != tt.wantLaunches {
+				t.Errorf("worker launched %d times, want %d", got, tt.wantLaunches)
+			}
+			if got := c.Since(start); got != tt.wantElapsed {
+				t.Errorf("worker backed off for %v, want %v", got, tt.wantElapsed)
+			}
+			select {
+			case err := <-errs:
+				if !errors.Is(err, ErrContainerStart) || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("run stopped with %v, want %q", err, tt.wantErr)
+				}
+			default:
+				t.Error("worker stopped the run without reporting why")
+			}
+		})
+	}
+}
+
+func TestLaunchWorkerLeases(t *testing.T) {
+	c := useManualClock(t)
+	start := c.Now()
+	cli := newFakeRuntime(c, testNetwork, func() *fakeContainer { return &fakeContainer{lease: testLease} })
+	retry := &retryPolicy{initial: time.Second, multiplier: 2, max: 3 * time.Second, attempts: 3}
+	w, errs := newTestWorker(t, c, cli, retry, 2)
+	runTestWorker(t, w)
+
+	held := w.leases.held()
+	if len(held) != 2 {
+		t.Fatalf("worker holds %d leases, want 2", len(held))
+	}
+	if r := held[0]; r.IP != "192.168.1.57" || r.Network != testNetwork || r.Worker != 0 {
+		t.Errorf("lease record = %+v", r)
+	}
+	for id, ctr := range cli.containers {
+		if got := ctr.config.Labels[labelWorker]; got != "0" {
+			t.Errorf("container %s labelled worker %q, want 0", shortID(id), got)
+		}
+	}
+	// One -launch-interval pause between the two launches, none after the
+	// budget is reached.
+	if got := c.Since(start); got != 2*time.Second {
+		t.Errorf("worker took %v, want 2s", got)
+	}
+	select {
+	case err := <-errs:
+		t.Errorf("run stopped with %v at the lease budget", err)
+	default:
+	}
+}
+
+// TestLaunchWorkerNetworkCap checks that a network's own cap stops the run
+// once no other network takes launches, with no cap on the run itself.
+func TestLaunchWorkerNetworkCap(t *testing.T) {
+	c := useManualClock(t)
+	cli := newFakeRuntime(c, testNetwork, func() *fakeContainer { return &fakeContainer{lease: testLease} })
+	retry := &retryPolicy{initial: time.Second, multiplier: 2, max: 3 * time.Second, attempts: 3}
+	w, errs := newTestWorker(t, c, cli, retry, 0)
+	if err := w.budget.limitNetwork(testNetwork, 3, 0); err != nil {
+		t.Fatal(err)
+	}
+	w.nets.budget = w.budget
+	runTestWorker(t, w)
+
+	if got := len(w.leases.held()); got != 3 {
+		t.Errorf("worker holds %d leases, want the network's cap of 3", got)
+	}
+	if got := w.nets.outcome(w.nets.networks[0]); got != "stopped at its cap of 3 leases" {
+		t.Errorf("network outcome = %q", got)
+	}
+	select {
+	case err := <-errs:
+		t.Errorf("run stopped with %v at the network's budget", err)
+	default:
+	}
+}